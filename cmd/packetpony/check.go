@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/script"
+)
+
+// runCheck implements "packetpony check": validate a config file and print
+// best-practice warnings. Returns the process exit code.
+func runCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "path to configuration file")
+	strict := fs.Bool("strict", false, "treat warnings as errors")
+	dump := fs.Bool("dump", false, "print the effective configuration")
+	fs.Parse(args)
+
+	if *dump {
+		return dumpConfig(*configPath)
+	}
+	return checkConfig(*configPath, *strict)
+}
+
+// checkConfig validates a config file and prints lint warnings.
+// Returns the process exit code.
+func checkConfig(path string, strict bool) int {
+	cfg, err := loadAndValidate(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	warnings := cfg.Lint()
+	for _, w := range warnings {
+		fmt.Printf("WARNING: %s\n", w)
+	}
+
+	fmt.Printf("%s: configuration OK (%d listeners, %d warnings)\n", path, len(cfg.Listeners), len(warnings))
+
+	if strict && len(warnings) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// dumpConfig validates a config file and prints the effective configuration
+// to stdout, with warnings on stderr. Returns the process exit code.
+func dumpConfig(path string) int {
+	cfg, err := loadAndValidate(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	for _, w := range cfg.Lint() {
+		fmt.Fprintf(os.Stderr, "WARNING: %s\n", w)
+	}
+
+	if err := cfg.Dump(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to dump config: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// loadAndValidate loads and validates a config file, and compiles the
+// listeners' scripts
+func loadAndValidate(path string) (*config.Config, error) {
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	for _, l := range cfg.Listeners {
+		if l.Script != nil && l.Script.Enabled {
+			if err := script.Check(l.Script.Path); err != nil {
+				return nil, fmt.Errorf("invalid configuration: listener %s script: %w", l.Name, err)
+			}
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+
+	"github.com/espegro/packetpony/internal/listener"
+)
+
+// watchEmergencySignals engages emergency mode on the engage signal and
+// releases it on the release signal, where the platform has them
+func watchEmergencySignals(manager *listener.Manager) {
+	engage, release := emergencySignals()
+	if engage == nil {
+		return
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, engage, release)
+	go func() {
+		for sig := range sigChan {
+			if sig == engage {
+				manager.EngageEmergency(0, "signal", "SIGRTMIN+1")
+			} else {
+				manager.ReleaseEmergency("SIGRTMIN+2")
+			}
+		}
+	}()
+}
@@ -0,0 +1,17 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// sigRTMIN is the first real-time signal as numbered by the C library and
+// kill(1); the Go runtime does not use it
+const sigRTMIN = 34
+
+// emergencySignals returns SIGRTMIN+1 (engage) and SIGRTMIN+2 (release)
+func emergencySignals() (engage, release os.Signal) {
+	return syscall.Signal(sigRTMIN + 1), syscall.Signal(sigRTMIN + 2)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// emergencySignals returns nil: real-time signals are Linux only, so
+// emergency mode is controlled through the admin API
+func emergencySignals() (engage, release os.Signal) {
+	return nil, nil
+}
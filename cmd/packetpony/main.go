@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/espegro/packetpony/internal/admin"
 	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/handover"
+	"github.com/espegro/packetpony/internal/lifecycle"
 	"github.com/espegro/packetpony/internal/listener"
 	"github.com/espegro/packetpony/internal/logging"
 	"github.com/espegro/packetpony/internal/metrics"
@@ -21,17 +26,33 @@ var (
 	buildTime = "unknown"
 )
 
-const (
-	defaultConfigPath = "/etc/packetpony/config.yaml"
-	shutdownTimeout   = 30 * time.Second
-)
+const defaultConfigPath = "/etc/packetpony/config.yaml"
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
 	// Parse command-line flags
 	configPath := flag.String("config", defaultConfigPath, "path to configuration file")
 	showVersion := flag.Bool("version", false, "show version and exit")
+	checkOnly := flag.Bool("check-config", false, "validate the configuration and exit")
+	dumpOnly := flag.Bool("dump-config", false, "print the effective configuration and exit")
+	quiet := flag.Bool("quiet", false, "log only warnings, errors and the running event during startup")
 	flag.Parse()
 
+	// Dry-run modes: validate without starting listeners
+	if *dumpOnly {
+		os.Exit(dumpConfig(*configPath))
+	}
+	if *checkOnly {
+		os.Exit(checkConfig(*configPath, false))
+	}
+
 	// Show version and exit
 	if *showVersion {
 		fmt.Printf("PacketPony %s\n", version)
@@ -53,77 +74,217 @@ func main() {
 		os.Exit(1)
 	}
 
-	fmt.Printf("PacketPony v%s starting with config: %s\n", version, *configPath)
-	fmt.Printf("Server name: %s\n", cfg.Server.Name)
-
 	// Setup logging
-	logger, err := logging.NewMultiLogger(cfg.Logging)
+	multiLogger, err := logging.NewMultiLogger(cfg.Logging)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
 		os.Exit(1)
 	}
-	defer logger.Close()
 
-	logger.LogInfo("PacketPony starting", map[string]interface{}{
+	var base logging.Logger = multiLogger
+	if *quiet {
+		base = &quietLogger{Logger: multiLogger}
+	}
+	var denials *logging.DenyAggregator
+	if cfg.Logging.DenyAggregation.Enabled {
+		denials = logging.NewDenyAggregator(base, cfg.Logging.DenyAggregation)
+		base = denials
+	}
+	level, _ := logging.ParseLevel(cfg.Logging.GetLevel()) // checked by Validate
+	var logger logging.Logger = logging.NewLeveledLogger(base, level)
+
+	logger.LogInfo(logging.EventStarting, map[string]interface{}{
 		"version": version,
 		"server":  cfg.Server.Name,
 		"config":  *configPath,
 	})
 
-	// Setup metrics
-	proxyMetrics := metrics.NewProxyMetrics()
-	if err := metrics.StartMetricsServer(cfg.Metrics.Prometheus); err != nil {
-		logger.LogError("Failed to start metrics server", map[string]interface{}{
-			"error": err.Error(),
+	// Report non-fatal configuration findings
+	for _, w := range cfg.Lint() {
+		logger.LogWarning(logging.EventConfigWarning, map[string]interface{}{
+			"listener": w.Listener,
+			"warning":  w.Message,
 		})
-		os.Exit(1)
 	}
 
+	// SIGUSR1 reopens log files after logrotate
+	watchReopenSignal(multiLogger, logger)
+
+	// Components register a stop step as they start and are stopped in
+	// reverse order: admin API, listeners, then the metrics server
+	stack := lifecycle.NewCoordinator()
+
+	// Setup metrics
+	proxyMetrics := metrics.NewProxyMetrics(cfg.Metrics.Prometheus.TagLabels, cfg.Metrics.Prometheus.ClientMetrics)
 	if cfg.Metrics.Prometheus.Enabled {
-		logger.LogInfo("Prometheus metrics server started", map[string]interface{}{
-			"address": cfg.Metrics.Prometheus.ListenAddress,
-			"path":    cfg.Metrics.Prometheus.Path,
-		})
+		metrics.RegisterLogDrops(multiLogger.Dropped)
+		if denials != nil {
+			metrics.RegisterDenialsAggregated(denials.Aggregated)
+		}
 	}
 
 	// Create listener manager
 	manager, err := listener.NewManager(cfg, logger, proxyMetrics)
 	if err != nil {
-		logger.LogError("Failed to create listener manager", map[string]interface{}{
+		startupFailed(logger, stack, logging.EventManagerCreateFailed, err)
+	}
+
+	// Start metrics server
+	metricsServer := metrics.NewServer(cfg.Metrics.Prometheus, manager.Health)
+	metricsServer.OnError(func(err error) {
+		logger.LogError(logging.EventMetricsServeFailed, map[string]interface{}{
 			"error": err.Error(),
 		})
-		os.Exit(1)
+	})
+	if cfg.Server.RunAsUser != "" {
+		if uid, gid, err := cfg.Server.RunAsIDs(); err == nil {
+			metricsServer.OwnSockets(uid, gid)
+		}
+	}
+	if err := metricsServer.Start(); err != nil {
+		startupFailed(logger, stack, logging.EventMetricsFailed, err)
 	}
+	stack.Add("metrics server", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return metricsServer.Shutdown(ctx)
+	})
+
+	if addrs := cfg.Metrics.Prometheus.Addresses(); cfg.Metrics.Prometheus.Enabled && len(addrs) > 0 {
+		logger.LogInfo(logging.EventMetricsStarted, map[string]interface{}{
+			"address": strings.Join(addrs, ","),
+			"path":    cfg.Metrics.Prometheus.Path,
+		})
+	}
+
+	// Listeners are stopped right away if startup fails, drained once running
+	running, upgraded := false, false
+	stack.Add("listeners", func() error {
+		switch {
+		case !running:
+			return manager.Stop()
+		case upgraded:
+			return manager.HandoverShutdown(cfg.Server.GetShutdownTimeout())
+		default:
+			return manager.GracefulShutdown(cfg.Server.GetShutdownTimeout())
+		}
+	})
 
 	// Start all listeners
 	if err := manager.Start(); err != nil {
-		logger.LogError("Failed to start listeners", map[string]interface{}{
-			"error": err.Error(),
+		startupFailed(logger, stack, logging.EventListenersStartFailed, err)
+	}
+
+	// Export top talkers if enabled
+	if cfg.Metrics.Prometheus.Enabled && cfg.Metrics.Prometheus.TopTalkers > 0 {
+		topN := cfg.Metrics.Prometheus.TopTalkers
+		metrics.RegisterTopTalkers(func() []metrics.TopTalker {
+			return manager.CollectTopTalkers(topN)
+		})
+	}
+
+	// Start admin API if enabled
+	if cfg.Admin.Enabled {
+		adminServer := admin.NewServer(cfg, *configPath, manager, logger)
+		if cfg.Metrics.Prometheus.Enabled && cfg.Metrics.Prometheus.ServeOnAdmin {
+			for _, path := range metricsServer.Paths() {
+				adminServer.Handle(path, metricsServer.Handler())
+			}
+		}
+		if err := adminServer.Start(); err != nil {
+			startupFailed(logger, stack, logging.EventAdminStartFailed, err)
+		}
+		stack.Add("admin API", func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return adminServer.Shutdown(ctx)
+		})
+		logger.LogInfo(logging.EventAdminStarted, map[string]interface{}{
+			"address": cfg.Admin.ListenAddress,
 		})
-		os.Exit(1)
 	}
 
-	// Setup signal handling for graceful shutdown
+	// Every socket is bound; give up root if configured
+	if err := dropPrivileges(&cfg.Server, logger); err != nil {
+		startupFailed(logger, stack, logging.EventPrivilegeDropFailed, err)
+	}
+
+	// SIGRTMIN+1 and SIGRTMIN+2 engage and release emergency mode
+	watchEmergencySignals(manager)
+
+	// Setup signal handling for graceful shutdown and binary upgrades
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+
+	// Sockets from systemd that no listener matched are closed by Ready
+	for _, sock := range handover.Unclaimed() {
+		logger.LogWarning(logging.EventSystemdSocketIgnored, map[string]interface{}{
+			"socket": sock,
+		})
+	}
+
+	// Tell the previous process (after an upgrade) and systemd we are up
+	if err := handover.Ready(); err != nil {
+		logger.LogError(logging.EventUpgradeSignalFailed, map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	if handover.Inherited() {
+		handover.Notify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+	} else {
+		handover.Notify("READY=1")
+	}
 
-	logger.LogInfo("PacketPony is running", map[string]interface{}{
+	logger.LogInfo(logging.EventRunning, map[string]interface{}{
+		"version":   version,
+		"server":    cfg.Server.Name,
 		"listeners": len(cfg.Listeners),
+		"endpoints": listenerSummary(cfg.Listeners),
 	})
 
-	// Wait for shutdown signal
-	sig := <-sigChan
-	logger.LogInfo("Received shutdown signal", map[string]interface{}{
-		"signal": sig.String(),
-	})
+	// Wait for shutdown signal or a successful upgrade
+	running = true
+	upgraded = waitForShutdown(sigChan, logger)
 
-	// Graceful shutdown
-	if err := manager.GracefulShutdown(shutdownTimeout); err != nil {
-		logger.LogError("Error during graceful shutdown", map[string]interface{}{
+	// Graceful shutdown; the logger is closed last so every step can log
+	if err := stack.Shutdown(); err != nil {
+		logger.LogError(logging.EventShutdownError, map[string]interface{}{
 			"error": err.Error(),
 		})
+		logger.Close()
 		os.Exit(1)
 	}
 
-	logger.LogInfo("PacketPony stopped gracefully", nil)
+	logger.LogInfo(logging.EventStopped, nil)
+	logger.Close()
+}
+
+// startupFailed logs a fatal startup error, stops the components that
+// already started, logs the exit event and exits. The logger is closed
+// last, after the exit event, so buffered backends flush it.
+func startupFailed(logger logging.Logger, stack *lifecycle.Coordinator, ev logging.Event, err error) {
+	logger.LogError(ev, map[string]interface{}{
+		"error": err.Error(),
+	})
+	if err := stack.Shutdown(); err != nil {
+		logger.LogError(logging.EventShutdownError, map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	logger.LogError(logging.EventStartupAborted, map[string]interface{}{
+		"reason":    ev.Code,
+		"error":     err.Error(),
+		"exit_code": 1,
+	})
+	logger.Close()
+	os.Exit(1)
+}
+
+// listenerSummary describes each listener as name=protocol/listen_address
+func listenerSummary(listeners []config.ListenerConfig) []string {
+	summary := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		summary = append(summary, l.Name+"="+l.Protocol+"/"+l.ListenAddress)
+	}
+	return summary
 }
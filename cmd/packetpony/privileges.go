@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// dropPrivileges switches to server.run_as_user and run_as_group. It runs
+// once every socket is bound; a process started by an upgrade inherits
+// its sockets and already runs as that user.
+func dropPrivileges(server *config.ServerConfig, logger logging.Logger) error {
+	if server.RunAsUser == "" {
+		return nil
+	}
+	uid, gid, err := server.RunAsIDs()
+	if err != nil {
+		return err
+	}
+	if os.Getuid() == uid && os.Getgid() == gid {
+		return nil
+	}
+	if err := setIDs(uid, gid); err != nil {
+		return err
+	}
+
+	logger.LogInfo(logging.EventPrivilegesDropped, map[string]interface{}{
+		"user": server.RunAsUser,
+		"uid":  uid,
+		"gid":  gid,
+	})
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// setIDs is not supported on this platform; configuration validation
+// rejects run_as_user outside Linux
+func setIDs(uid, gid int) error {
+	return errors.New("run_as_user is only supported on Linux")
+}
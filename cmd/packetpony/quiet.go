@@ -0,0 +1,25 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// quietLogger drops informational messages until the process reports it
+// is running, so -quiet startups log only warnings, errors and the final
+// running event. Connection events and later messages pass through.
+type quietLogger struct {
+	logging.Logger
+	running atomic.Bool
+}
+
+// LogInfo forwards msg once startup has completed
+func (q *quietLogger) LogInfo(ev logging.Event, fields map[string]interface{}) {
+	if ev == logging.EventRunning {
+		q.running.Store(true)
+	}
+	if q.running.Load() {
+		q.Logger.LogInfo(ev, fields)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// watchReopenSignal reopens the log files on SIGUSR1, so logrotate can
+// move them away without restarting the daemon
+func watchReopenSignal(files *logging.MultiLogger, logger logging.Logger) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+	go func() {
+		for range sigChan {
+			if err := files.Reopen(); err != nil {
+				logger.LogError(logging.EventLogsReopenFailed, map[string]interface{}{
+					"error": err.Error(),
+				})
+				continue
+			}
+			logger.LogInfo(logging.EventLogsReopened, nil)
+		}
+	}()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/espegro/packetpony/internal/capture"
+)
+
+// runReplay implements "packetpony replay": send the datagrams of a replay
+// capture to a target with their original timing, one socket per recorded
+// session. Returns the process exit code.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	path := fs.String("file", "", "replay capture to send (from the admin API with format replay)")
+	targetAddr := fs.String("target", "", "host:port to send the datagrams to")
+	speed := fs.Float64("speed", 1, "timing multiplier: 2 replays twice as fast, 0 sends without pauses")
+	wait := fs.Duration("wait", time.Second, "how long to wait for replies after the last datagram")
+	fs.Parse(args)
+
+	if *path == "" || *targetAddr == "" {
+		fmt.Fprintln(os.Stderr, "Error: -file and -target are required")
+		return 1
+	}
+	if *speed < 0 {
+		fmt.Fprintln(os.Stderr, "Error: -speed must not be negative")
+		return 1
+	}
+
+	reader, err := capture.OpenReplay(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer reader.Close()
+
+	r := &replayer{target: *targetAddr, conns: make(map[uint32]*net.UDPConn)}
+	defer r.close()
+
+	start := time.Now()
+	first := time.Duration(-1)
+	for {
+		rec, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: stopping at damaged record: %v\n", err)
+			break
+		}
+
+		// Keep the gaps between datagrams, not the wait before the first
+		if first < 0 {
+			first = rec.Offset
+		}
+		if *speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Offset-first) / *speed))
+			time.Sleep(time.Until(due))
+		}
+
+		if err := r.send(rec); err != nil {
+			r.errors++
+			if r.errors == 1 {
+				fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+			}
+		}
+	}
+	elapsed := time.Since(start)
+	time.Sleep(*wait)
+
+	fmt.Printf("%s: replayed %d datagrams (%d bytes) in %d sessions to %s in %s, %d replies (%d bytes), %d errors\n",
+		*path, r.datagrams, r.bytes, len(r.conns), *targetAddr, elapsed.Round(time.Millisecond),
+		r.replies.Load(), r.replyBytes.Load(), r.errors)
+
+	if r.errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayer sends replayed datagrams and counts the replies
+type replayer struct {
+	target     string
+	conns      map[uint32]*net.UDPConn // By recorded session
+	datagrams  int
+	bytes      int
+	errors     int
+	replies    atomic.Int64
+	replyBytes atomic.Int64
+	wg         sync.WaitGroup
+}
+
+// send sends a record on its session's socket, opening it on first use
+func (r *replayer) send(rec capture.ReplayRecord) error {
+	conn, ok := r.conns[rec.Session]
+	if !ok {
+		addr, err := net.ResolveUDPAddr("udp", r.target)
+		if err != nil {
+			return fmt.Errorf("failed to resolve target: %w", err)
+		}
+		conn, err = net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return fmt.Errorf("failed to open session %d: %w", rec.Session, err)
+		}
+		r.conns[rec.Session] = conn
+		r.wg.Add(1)
+		go r.readReplies(conn)
+	}
+
+	if _, err := conn.Write(rec.Payload); err != nil {
+		return fmt.Errorf("session %d: %w", rec.Session, err)
+	}
+	r.datagrams++
+	r.bytes += len(rec.Payload)
+	return nil
+}
+
+// readReplies counts the datagrams the target sends back until conn is closed
+func (r *replayer) readReplies(conn *net.UDPConn) {
+	defer r.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue // e.g. connection refused reported by ICMP
+		}
+		r.replies.Add(1)
+		r.replyBytes.Add(int64(n))
+	}
+}
+
+// close closes every session socket and waits for the readers
+func (r *replayer) close() {
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	r.wg.Wait()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/espegro/packetpony/internal/handover"
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// upgradeTimeout bounds how long the new process may take to become ready
+const upgradeTimeout = 30 * time.Second
+
+// waitForShutdown blocks until a shutdown signal arrives or SIGUSR2 hands the
+// listening sockets to a new process. Returns true after a successful upgrade.
+// A failed upgrade is logged and the current process keeps running.
+func waitForShutdown(sigChan <-chan os.Signal, logger logging.Logger) bool {
+	for sig := range sigChan {
+		if sig != syscall.SIGUSR2 {
+			logger.LogInfo(logging.EventShutdownSignal, map[string]interface{}{
+				"signal": sig.String(),
+			})
+			return false
+		}
+
+		logger.LogInfo(logging.EventUpgradeSignal, nil)
+		process, err := handover.Upgrade(upgradeTimeout)
+		if err != nil {
+			logger.LogError(logging.EventUpgradeFailed, map[string]interface{}{
+				"error": err.Error(),
+			})
+			continue
+		}
+
+		logger.LogInfo(logging.EventUpgradeReady, map[string]interface{}{
+			"pid": process.Pid,
+		})
+		return true
+	}
+	return false
+}
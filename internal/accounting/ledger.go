@@ -0,0 +1,389 @@
+// Package accounting keeps per-listener and per-tenant traffic totals for
+// billing. Totals are counted in memory as traffic flows and snapshotted to
+// the storage backend on an interval, so after a crash at most one flush
+// interval of traffic is lost. Unlike Prometheus counters, totals continue
+// from their persisted values after a restart.
+package accounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/storage"
+)
+
+// keyPrefix namespaces accounting records in the store
+const keyPrefix = "accounting/"
+
+// Scopes of an accounting record
+const (
+	ScopeListener = "listener"
+	ScopeTenant   = "tenant"
+)
+
+// Counters are traffic totals. Sent is client to target, received is
+// target to client.
+type Counters struct {
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+	Flows         int64 `json:"flows"`
+}
+
+// sub returns c minus o
+func (c Counters) sub(o Counters) Counters {
+	return Counters{
+		BytesSent:     c.BytesSent - o.BytesSent,
+		BytesReceived: c.BytesReceived - o.BytesReceived,
+		Flows:         c.Flows - o.Flows,
+	}
+}
+
+// storedRecord is the persisted form of an account
+type storedRecord struct {
+	Counters
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// account accumulates the totals of one listener or tenant
+type account struct {
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	flows         atomic.Int64
+}
+
+// load returns the current totals
+func (a *account) load() Counters {
+	return Counters{
+		BytesSent:     a.bytesSent.Load(),
+		BytesReceived: a.bytesReceived.Load(),
+		Flows:         a.flows.Load(),
+	}
+}
+
+// Ledger holds the live totals of this instance and persists them
+type Ledger struct {
+	store     storage.Store
+	instance  string
+	tenantTag string
+	interval  time.Duration
+	logger    logging.Logger
+
+	mu        sync.RWMutex
+	accounts  map[string]*account // scope/name -> live totals
+	persisted map[string]Counters // scope/name -> totals at the last flush
+	flushMu   sync.Mutex
+	flushedAt time.Time
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Open creates a ledger for the instance named by server.name, continuing
+// from the totals it last persisted, and starts the flush loop
+func Open(cfg config.AccountingConfig, instance string, store storage.Store, logger logging.Logger) (*Ledger, error) {
+	l := &Ledger{
+		store:     store,
+		instance:  instance,
+		tenantTag: cfg.GetTenantTag(),
+		interval:  cfg.GetFlushInterval(),
+		logger:    logger,
+		accounts:  make(map[string]*account),
+		persisted: make(map[string]Counters),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	prefix := l.prefix()
+	var decodeErr error
+	err := store.Scan(prefix, func(key string, value []byte) bool {
+		var rec storedRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			decodeErr = fmt.Errorf("invalid accounting record %s: %w", key, err)
+			return false
+		}
+		name := strings.TrimPrefix(key, prefix)
+		a := &account{}
+		a.bytesSent.Store(rec.BytesSent)
+		a.bytesReceived.Store(rec.BytesReceived)
+		a.flows.Store(rec.Flows)
+		l.accounts[name] = a
+		l.persisted[name] = rec.Counters
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load accounting totals: %w", err)
+	}
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	go l.flushLoop()
+
+	return l, nil
+}
+
+// Meter records the traffic of one flow
+type Meter struct {
+	listener *account
+	tenant   *account // nil if the flow has no tenant tag
+}
+
+// Meter starts accounting a new flow on listener. The flow is attributed to
+// the tenant named by its tenant tag, if it has one.
+func (l *Ledger) Meter(listener string, tags map[string]string) *Meter {
+	if l == nil {
+		return nil
+	}
+
+	m := &Meter{listener: l.account(ScopeListener, listener)}
+	m.listener.flows.Add(1)
+	if tenant := tags[l.tenantTag]; tenant != "" {
+		m.tenant = l.account(ScopeTenant, tenant)
+		m.tenant.flows.Add(1)
+	}
+	return m
+}
+
+// Add records n bytes in direction "sent" or "received"
+func (m *Meter) Add(direction string, n int64) {
+	if m == nil || n <= 0 {
+		return
+	}
+	for _, a := range []*account{m.listener, m.tenant} {
+		if a == nil {
+			continue
+		}
+		if direction == "sent" {
+			a.bytesSent.Add(n)
+		} else {
+			a.bytesReceived.Add(n)
+		}
+	}
+}
+
+// account returns the live account for scope/name, creating it if needed
+func (l *Ledger) account(scope, name string) *account {
+	key := scope + "/" + name
+
+	l.mu.RLock()
+	a, exists := l.accounts[key]
+	l.mu.RUnlock()
+	if exists {
+		return a
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if a, exists = l.accounts[key]; !exists {
+		a = &account{}
+		l.accounts[key] = a
+	}
+	return a
+}
+
+// Flush writes every account that changed since the last flush to the store
+func (l *Ledger) Flush() error {
+	if l == nil {
+		return nil
+	}
+
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+
+	l.mu.RLock()
+	live := make(map[string]Counters, len(l.accounts))
+	for key, a := range l.accounts {
+		live[key] = a.load()
+	}
+	l.mu.RUnlock()
+
+	now := time.Now()
+	var firstErr error
+	for key, counters := range live {
+		if persisted, ok := l.persisted[key]; ok && persisted == counters {
+			continue
+		}
+		data, err := json.Marshal(storedRecord{Counters: counters, UpdatedAt: now})
+		if err == nil {
+			err = l.store.Set(l.prefix()+key, data, 0)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to persist %s: %w", key, err)
+			}
+			continue
+		}
+		l.persisted[key] = counters
+	}
+
+	if firstErr != nil {
+		l.logger.LogError(logging.EventAccountingFlushFailed, map[string]interface{}{
+			"error": firstErr.Error(),
+		})
+		return firstErr
+	}
+	l.flushedAt = now
+	return nil
+}
+
+// flushLoop persists totals every flush interval
+func (l *Ledger) flushLoop() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.Flush()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Close stops the flush loop and persists the final totals. The store must
+// still be open.
+func (l *Ledger) Close() error {
+	if l == nil {
+		return nil
+	}
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.stop)
+		<-l.done
+		err = l.Flush()
+	})
+	return err
+}
+
+// prefix returns the store key prefix of this instance's records
+func (l *Ledger) prefix() string {
+	return keyPrefix + l.instance + "/"
+}
+
+// Record is one account in a reconciliation report. Live and Pending are
+// only set for accounts of the reporting instance; Pending is the traffic
+// not yet persisted, which would be lost if the instance crashed now.
+type Record struct {
+	Instance  string     `json:"instance"`
+	Scope     string     `json:"scope"`
+	Name      string     `json:"name"`
+	Persisted Counters   `json:"persisted"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"` // nil if never persisted
+	Live      *Counters  `json:"live,omitempty"`
+	Pending   *Counters  `json:"pending,omitempty"`
+}
+
+// Report compares live and persisted totals for billing exports
+type Report struct {
+	Instance      string     `json:"instance"`
+	FlushInterval string     `json:"flush_interval"`
+	FlushedAt     *time.Time `json:"flushed_at,omitempty"` // nil until the first successful flush
+	Records       []Record   `json:"records"`
+}
+
+// Report returns the persisted totals of every instance sharing the store,
+// with this instance's live totals alongside. scope filters the records
+// (empty = all scopes).
+func (l *Ledger) Report(scope string) (Report, error) {
+	report := Report{
+		Instance:      l.instance,
+		FlushInterval: l.interval.String(),
+		Records:       []Record{},
+	}
+	l.flushMu.Lock()
+	if !l.flushedAt.IsZero() {
+		flushedAt := l.flushedAt
+		report.FlushedAt = &flushedAt
+	}
+	l.flushMu.Unlock()
+
+	seen := make(map[string]bool)
+	var decodeErr error
+	err := l.store.Scan(keyPrefix, func(key string, value []byte) bool {
+		parts := strings.SplitN(strings.TrimPrefix(key, keyPrefix), "/", 3)
+		if len(parts) != 3 || (scope != "" && parts[1] != scope) {
+			return true
+		}
+		var rec storedRecord
+		if err := json.Unmarshal(value, &rec); err != nil {
+			decodeErr = fmt.Errorf("invalid accounting record %s: %w", key, err)
+			return false
+		}
+		record := Record{
+			Instance:  parts[0],
+			Scope:     parts[1],
+			Name:      parts[2],
+			Persisted: rec.Counters,
+			UpdatedAt: &rec.UpdatedAt,
+		}
+		if parts[0] == l.instance {
+			seen[parts[1]+"/"+parts[2]] = true
+			l.addLive(&record)
+		}
+		report.Records = append(report.Records, record)
+		return true
+	})
+	if err != nil {
+		return Report{}, fmt.Errorf("failed to read accounting totals: %w", err)
+	}
+	if decodeErr != nil {
+		return Report{}, decodeErr
+	}
+
+	// Accounts created since the last flush are not in the store yet
+	l.mu.RLock()
+	var unflushed []string
+	for key := range l.accounts {
+		if !seen[key] {
+			unflushed = append(unflushed, key)
+		}
+	}
+	l.mu.RUnlock()
+	for _, key := range unflushed {
+		parts := strings.SplitN(key, "/", 2)
+		if scope != "" && parts[0] != scope {
+			continue
+		}
+		record := Record{Instance: l.instance, Scope: parts[0], Name: parts[1]}
+		l.addLive(&record)
+		report.Records = append(report.Records, record)
+	}
+
+	sort.Slice(report.Records, func(i, j int) bool {
+		a, b := report.Records[i], report.Records[j]
+		if a.Instance != b.Instance {
+			return a.Instance < b.Instance
+		}
+		if a.Scope != b.Scope {
+			return a.Scope < b.Scope
+		}
+		return a.Name < b.Name
+	})
+
+	return report, nil
+}
+
+// addLive fills in the live and pending totals of a record of this instance
+func (l *Ledger) addLive(record *Record) {
+	l.mu.RLock()
+	a, exists := l.accounts[record.Scope+"/"+record.Name]
+	l.mu.RUnlock()
+	if !exists {
+		return
+	}
+	live := a.load()
+	pending := live.sub(record.Persisted)
+	record.Live = &live
+	record.Pending = &pending
+}
@@ -1,16 +1,38 @@
 // Package acl provides IP-based access control lists (ACLs) for connections.
-// Supports both individual IP addresses and CIDR ranges for allowlisting.
+// Supports both individual IP addresses and CIDR ranges for allowlisting,
+// optionally restricted to a schedule. Entries can also be added at runtime
+// and shared with other instances through a storage.Store.
 package acl
 
 import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/storage"
 )
 
 // Allowlist manages IP and CIDR-based access control
 type Allowlist struct {
-	rules []*net.IPNet
+	rules     []*net.IPNet
+	scheduled []scheduledRule
+
+	mu           sync.RWMutex
+	runtime      map[string]runtimeRule // By network
+	onStoreError func(err error)
+	store        storage.Store
+	keyPrefix    string
+	stop         chan struct{}
+	closeOnce    sync.Once
+}
+
+// scheduledRule allows its networks only while active reports true
+type scheduledRule struct {
+	nets   []*net.IPNet
+	name   string
+	active func(t time.Time) bool
 }
 
 // NewAllowlist creates a new allowlist from CIDR strings and IP addresses
@@ -26,24 +48,81 @@ func NewAllowlist(entries []string) (*Allowlist, error) {
 	}
 
 	return &Allowlist{
-		rules: rules,
+		rules:   rules,
+		runtime: make(map[string]runtimeRule),
 	}, nil
 }
 
+// AddScheduled adds entries that are only allowed while active reports
+// true. name identifies the schedule in Check.
+func (a *Allowlist) AddScheduled(entries []string, name string, active func(t time.Time) bool) error {
+	rule := scheduledRule{name: name, active: active}
+	for _, entry := range entries {
+		ipNet, err := parseCIDROrIP(entry)
+		if err != nil {
+			return fmt.Errorf("invalid allowlist entry %q: %w", entry, err)
+		}
+		rule.nets = append(rule.nets, ipNet)
+	}
+	a.scheduled = append(a.scheduled, rule)
+	return nil
+}
+
 // IsAllowed checks if an IP address is allowed
 func (a *Allowlist) IsAllowed(ip net.IP) bool {
-	// If no rules are defined, deny all
-	if len(a.rules) == 0 {
-		return false
-	}
+	allowed, _ := a.Check(ip)
+	return allowed
+}
 
-	// Check if IP matches any rule
+// Check checks if an IP address is allowed. A denied IP that matches a
+// scheduled entry outside its schedule also gets the schedule's name.
+func (a *Allowlist) Check(ip net.IP) (bool, string) {
+	// Check if IP matches any rule; if no rules are defined, deny all
 	for _, rule := range a.rules {
 		if rule.Contains(ip) {
-			return true
+			return true, ""
 		}
 	}
 
+	now := time.Now()
+	if a.allowedAtRuntime(ip, now) {
+		return true, ""
+	}
+
+	closed := ""
+	for _, rule := range a.scheduled {
+		if !containsIP(rule.nets, ip) {
+			continue
+		}
+		if rule.active(now) {
+			return true, ""
+		}
+		if closed == "" {
+			closed = rule.name
+		}
+	}
+
+	return false, closed
+}
+
+// Networks returns every network the configured entries can allow,
+// including those of scheduled entries whatever their schedule. Runtime
+// entries are left out; see RuntimeNetworks.
+func (a *Allowlist) Networks() []*net.IPNet {
+	nets := append([]*net.IPNet(nil), a.rules...)
+	for _, rule := range a.scheduled {
+		nets = append(nets, rule.nets...)
+	}
+	return nets
+}
+
+// containsIP reports whether any of nets contains ip
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
 	return false
 }
 
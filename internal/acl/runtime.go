@@ -0,0 +1,224 @@
+package acl
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/espegro/packetpony/internal/storage"
+)
+
+// syncInterval is how often entries added or removed by other instances
+// sharing the store are picked up
+const syncInterval = 5 * time.Second
+
+// Entry is an allowlist entry added at runtime
+type Entry struct {
+	Network   string     `json:"network"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Nil = until removed
+}
+
+// expired reports whether the entry has expired at now
+func (e *Entry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// runtimeRule is a runtime entry with its parsed network
+type runtimeRule struct {
+	entry Entry
+	net   *net.IPNet
+	added time.Time // When it was added on this instance, zero if read from the store
+}
+
+// Share keeps the runtime entries in store under keyPrefix, so that they
+// survive restarts and reach every instance sharing the store. Entries
+// already in the store are loaded, and the store is read again every
+// syncInterval until Close.
+func (a *Allowlist) Share(store storage.Store, keyPrefix string) {
+	if a.stop != nil {
+		return
+	}
+	a.store = store
+	a.keyPrefix = keyPrefix
+	a.stop = make(chan struct{})
+	a.sync()
+	go a.syncLoop()
+}
+
+// Allow adds an entry allowing network, an IP address or CIDR range, for
+// duration or until removed if zero. An entry for the same network is
+// replaced. The entry is stored first and only applies once stored.
+func (a *Allowlist) Allow(network string, duration time.Duration, reason string) (Entry, error) {
+	ipNet, err := parseCIDROrIP(network)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry := Entry{Network: ipNet.String(), Reason: reason}
+	if duration > 0 {
+		expiry := time.Now().Add(duration)
+		entry.ExpiresAt = &expiry
+	}
+
+	if a.store != nil {
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return Entry{}, err
+		}
+		if err := a.store.Set(a.keyPrefix+entry.Network, value, duration); err != nil {
+			a.storeError(err)
+			return Entry{}, err
+		}
+	}
+
+	a.mu.Lock()
+	a.runtime[entry.Network] = runtimeRule{entry: entry, net: ipNet, added: time.Now()}
+	a.mu.Unlock()
+	return entry, nil
+}
+
+// Disallow removes the runtime entry for network. Returns false if there
+// was none. If removing it from the store fails, the entry stays.
+func (a *Allowlist) Disallow(network string) (bool, error) {
+	ipNet, err := parseCIDROrIP(network)
+	if err != nil {
+		return false, err
+	}
+	key := ipNet.String()
+
+	if a.store != nil {
+		if err := a.store.Delete(a.keyPrefix + key); err != nil {
+			a.storeError(err)
+			return false, err
+		}
+	}
+
+	a.mu.Lock()
+	rule, exists := a.runtime[key]
+	delete(a.runtime, key)
+	a.mu.Unlock()
+	return exists && !rule.entry.expired(time.Now()), nil
+}
+
+// Entries returns the active runtime entries, ordered by network
+func (a *Allowlist) Entries() []Entry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	now := time.Now()
+	entries := make([]Entry, 0, len(a.runtime))
+	for _, rule := range a.runtime {
+		if !rule.entry.expired(now) {
+			entries = append(entries, rule.entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Network < entries[j].Network
+	})
+	return entries
+}
+
+// RuntimeNetworks returns the networks of the active runtime entries
+func (a *Allowlist) RuntimeNetworks() []*net.IPNet {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	now := time.Now()
+	nets := make([]*net.IPNet, 0, len(a.runtime))
+	for _, rule := range a.runtime {
+		if !rule.entry.expired(now) {
+			nets = append(nets, rule.net)
+		}
+	}
+	return nets
+}
+
+// OnStoreError registers a callback invoked when the store fails. Until
+// it recovers, the entries last read from it keep applying.
+func (a *Allowlist) OnStoreError(fn func(err error)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.onStoreError = fn
+}
+
+// Close stops reading the store
+func (a *Allowlist) Close() {
+	if a.stop == nil {
+		return
+	}
+	a.closeOnce.Do(func() {
+		close(a.stop)
+	})
+}
+
+// allowedAtRuntime reports whether a runtime entry allows ip at now
+func (a *Allowlist) allowedAtRuntime(ip net.IP, now time.Time) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, rule := range a.runtime {
+		if rule.net.Contains(ip) && !rule.entry.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncLoop periodically reads the runtime entries from the store
+func (a *Allowlist) syncLoop() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.sync()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// sync replaces the runtime entries with those in the store. Entries
+// missing from it were removed by another instance or expired.
+func (a *Allowlist) sync() {
+	start := time.Now()
+	stored := make(map[string]runtimeRule)
+	err := a.store.Scan(a.keyPrefix, func(key string, value []byte) bool {
+		var entry Entry
+		if err := json.Unmarshal(value, &entry); err != nil || entry.expired(start) {
+			return true
+		}
+		_, ipNet, err := net.ParseCIDR(entry.Network)
+		if err != nil {
+			return true
+		}
+		stored[entry.Network] = runtimeRule{entry: entry, net: ipNet}
+		return true
+	})
+	if err != nil {
+		a.storeError(err)
+		return
+	}
+
+	a.mu.Lock()
+	// Entries added after the scan started may be missing from it
+	for network, rule := range a.runtime {
+		if !rule.added.Before(start) {
+			stored[network] = rule
+		}
+	}
+	a.runtime = stored
+	a.mu.Unlock()
+}
+
+// storeError reports a storage failure to the registered callback
+func (a *Allowlist) storeError(err error) {
+	a.mu.RLock()
+	fn := a.onStoreError
+	a.mu.RUnlock()
+	if fn != nil {
+		fn(err)
+	}
+}
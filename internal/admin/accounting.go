@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/espegro/packetpony/internal/accounting"
+)
+
+// handleAccounting serves GET /api/accounting?scope=<listener|tenant>, the
+// persisted totals of every instance sharing the store alongside this
+// instance's live totals
+func (s *Server) handleAccounting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	s.writeAccountingReport(w, r.URL.Query().Get("scope"))
+}
+
+// handleAccountingFlush serves POST /api/accounting/flush, which persists
+// the live totals immediately, e.g. at a billing cutoff, and returns the
+// resulting report
+func (s *Server) handleAccountingFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ledger := s.manager.Accounting()
+	if ledger == nil {
+		writeError(w, http.StatusNotFound, "accounting is not enabled")
+		return
+	}
+	if err := ledger.Flush(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	s.writeAccountingReport(w, r.URL.Query().Get("scope"))
+}
+
+// writeAccountingReport writes the reconciliation report for scope
+func (s *Server) writeAccountingReport(w http.ResponseWriter, scope string) {
+	ledger := s.manager.Accounting()
+	if ledger == nil {
+		writeError(w, http.StatusNotFound, "accounting is not enabled")
+		return
+	}
+	if scope != "" && scope != accounting.ScopeListener && scope != accounting.ScopeTenant {
+		writeError(w, http.StatusBadRequest, "scope must be listener or tenant")
+		return
+	}
+
+	report, err := ledger.Report(scope)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
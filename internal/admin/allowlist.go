@@ -0,0 +1,124 @@
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/espegro/packetpony/internal/acl"
+)
+
+// allowRequest is the body of POST /api/allowlist
+type allowRequest struct {
+	Listener string `json:"listener"`
+	Network  string `json:"network"`  // IP address or CIDR range
+	Duration string `json:"duration"` // Empty = until removed
+	Reason   string `json:"reason"`
+}
+
+// handleAllowlist serves GET ?listener=<name> (list), POST (add) and
+// DELETE ?listener=<name>&network=<cidr> (remove) on /api/allowlist
+func (s *Server) handleAllowlist(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		names := s.manager.ListenerNames()
+		if name := r.URL.Query().Get("listener"); name != "" {
+			if !slices.Contains(names, name) {
+				writeError(w, http.StatusNotFound, "unknown listener: "+name)
+				return
+			}
+			names = []string{name}
+		}
+		result := make(map[string][]acl.Entry)
+		for _, name := range names {
+			if entries, err := s.manager.AllowlistEntries(name); err == nil {
+				result[name] = entries
+			}
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case http.MethodPost:
+		var req allowRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		network, ok := parseNetwork(req.Network)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid network: "+req.Network)
+			return
+		}
+		if req.Reason == "" {
+			writeError(w, http.StatusBadRequest, "reason is required")
+			return
+		}
+		if !slices.Contains(s.manager.ListenerNames(), req.Listener) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+req.Listener)
+			return
+		}
+		var duration time.Duration
+		if req.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(req.Duration); err != nil || duration <= 0 {
+				writeError(w, http.StatusBadRequest, "duration must be a duration such as 1h")
+				return
+			}
+		}
+
+		entry, err := s.manager.AllowNetwork(req.Listener, network, duration, req.Reason, r.RemoteAddr)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, "failed to store allowlist entry: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, entry)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("listener")
+		if !slices.Contains(s.manager.ListenerNames(), name) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+name)
+			return
+		}
+		network, ok := parseNetwork(r.URL.Query().Get("network"))
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid network: "+r.URL.Query().Get("network"))
+			return
+		}
+
+		removed, err := s.manager.DisallowNetwork(name, network, r.RemoteAddr)
+		switch {
+		case err != nil:
+			writeError(w, http.StatusBadGateway, "failed to remove allowlist entry: "+err.Error())
+		case !removed:
+			writeError(w, http.StatusNotFound, "no runtime allowlist entry for "+network)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// parseNetwork returns an IP address or CIDR range in canonical CIDR form
+func parseNetwork(s string) (string, bool) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return "", false
+		}
+		return network.String(), true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", false
+	}
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+	network := net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	return network.String(), true
+}
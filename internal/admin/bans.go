@@ -0,0 +1,106 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/espegro/packetpony/internal/ban"
+	"github.com/espegro/packetpony/internal/listener"
+)
+
+// banRequest is the body of POST /api/bans
+type banRequest struct {
+	Listener string `json:"listener"`
+	IP       string `json:"ip"`
+	Duration string `json:"duration"` // Empty = the listener's ban_duration
+	Reason   string `json:"reason"`
+}
+
+// handleBans serves GET ?listener=<name> (list), POST (ban) and DELETE
+// ?listener=<name>&ip=<ip> (unban) on /api/bans
+func (s *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		names := s.manager.ListenerNames()
+		if name := r.URL.Query().Get("listener"); name != "" {
+			if !slices.Contains(names, name) {
+				writeError(w, http.StatusNotFound, "unknown listener: "+name)
+				return
+			}
+			names = []string{name}
+		}
+		result := make(map[string][]ban.Ban)
+		for _, name := range names {
+			if bans, err := s.manager.Bans(name); err == nil {
+				result[name] = bans
+			}
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case http.MethodPost:
+		var req banRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		ip := net.ParseIP(req.IP)
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, "invalid IP address: "+req.IP)
+			return
+		}
+		if req.Reason == "" {
+			writeError(w, http.StatusBadRequest, "reason is required")
+			return
+		}
+		if !slices.Contains(s.manager.ListenerNames(), req.Listener) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+req.Listener)
+			return
+		}
+		var duration time.Duration
+		if req.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(req.Duration); err != nil || duration <= 0 {
+				writeError(w, http.StatusBadRequest, "duration must be a duration such as 1h")
+				return
+			}
+		}
+
+		b, err := s.manager.BanClient(req.Listener, ip.String(), duration, req.Reason, r.RemoteAddr)
+		if errors.Is(err, listener.ErrBansDisabled) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, b)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("listener")
+		if !slices.Contains(s.manager.ListenerNames(), name) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+name)
+			return
+		}
+		ip := net.ParseIP(r.URL.Query().Get("ip"))
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, "invalid IP address: "+r.URL.Query().Get("ip"))
+			return
+		}
+
+		banned, err := s.manager.UnbanClient(name, ip.String(), r.RemoteAddr)
+		switch {
+		case errors.Is(err, listener.ErrBansDisabled):
+			writeError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			writeError(w, http.StatusBadGateway, "ban lifted on this instance only: "+err.Error())
+		case !banned:
+			writeError(w, http.StatusNotFound, "client is not banned: "+ip.String())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
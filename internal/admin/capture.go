@@ -0,0 +1,147 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/espegro/packetpony/internal/capture"
+	"github.com/espegro/packetpony/internal/listener"
+	"github.com/espegro/packetpony/internal/proxy"
+)
+
+// defaultCaptureDuration is used when a capture request has no duration
+const defaultCaptureDuration = time.Minute
+
+// captureRequest is the body of POST /api/capture
+type captureRequest struct {
+	Listener string `json:"listener"`
+	Format   string `json:"format"`    // pcap (default) or replay
+	Side     string `json:"side"`      // client, target or both (default); pcap only
+	Duration string `json:"duration"`  // Default 1m, capped by admin.max_capture_duration
+	MaxBytes int64  `json:"max_bytes"` // Default and cap admin.max_capture_size
+}
+
+// handleCapture serves GET (running captures), POST (start a capture) and
+// DELETE ?listener=<name> (stop one) on /api/capture
+func (s *Server) handleCapture(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.CaptureDir == "" {
+		writeError(w, http.StatusNotFound, "captures are disabled, set admin.capture_dir")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.manager.Captures())
+
+	case http.MethodPost:
+		var req captureRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		opts, err := s.captureOptions(req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !slices.Contains(s.manager.ListenerNames(), req.Listener) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+req.Listener)
+			return
+		}
+		status, err := s.manager.StartCapture(req.Listener, opts, r.RemoteAddr)
+		if errors.Is(err, proxy.ErrCaptureRunning) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if errors.Is(err, listener.ErrReplayNotUDP) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("listener")
+		if !slices.Contains(s.manager.ListenerNames(), name) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+name)
+			return
+		}
+		status, err := s.manager.StopCapture(name)
+		if errors.Is(err, listener.ErrNoCapture) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// captureOptions checks a capture request against the configured limits
+// and names its file after the listener and the start time
+func (s *Server) captureOptions(req captureRequest) (capture.Options, error) {
+	opts := capture.Options{
+		Format:   req.Format,
+		Side:     req.Side,
+		Duration: defaultCaptureDuration,
+		MaxBytes: s.cfg.GetMaxCaptureSize(),
+	}
+
+	switch req.Format {
+	case "":
+		opts.Format = capture.FormatPcap
+	case capture.FormatPcap, capture.FormatReplay:
+	default:
+		return opts, fmt.Errorf("format must be pcap or replay")
+	}
+
+	switch req.Side {
+	case "":
+		opts.Side = capture.SideBoth
+	case capture.SideClient, capture.SideTarget, capture.SideBoth:
+	default:
+		return opts, fmt.Errorf("side must be client, target or both")
+	}
+	if opts.Format == capture.FormatReplay {
+		if req.Side != "" && req.Side != capture.SideClient {
+			return opts, fmt.Errorf("replay captures record the client side only")
+		}
+		opts.Side = capture.SideClient
+	}
+
+	if req.Duration != "" {
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			return opts, fmt.Errorf("duration must be a positive duration such as 30s")
+		}
+		opts.Duration = duration
+	}
+	if limit := s.cfg.GetMaxCaptureDuration(); opts.Duration > limit {
+		return opts, fmt.Errorf("duration must not exceed %s", limit)
+	}
+
+	if req.MaxBytes < 0 {
+		return opts, fmt.Errorf("max_bytes must not be negative")
+	}
+	if req.MaxBytes > opts.MaxBytes {
+		return opts, fmt.Errorf("max_bytes must not exceed %d", opts.MaxBytes)
+	}
+	if req.MaxBytes > 0 {
+		opts.MaxBytes = req.MaxBytes
+	}
+
+	// Listener names come from the config, but keep them from leaving the directory
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(req.Listener)
+	opts.Path = filepath.Join(s.cfg.CaptureDir, fmt.Sprintf("%s-%s.%s", name, time.Now().Format("20060102-150405"), opts.Format))
+	return opts, nil
+}
@@ -0,0 +1,136 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/espegro/packetpony/internal/chaos"
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// chaosRequest is the body of POST /api/chaos
+type chaosRequest struct {
+	Listener     string  `json:"listener"`
+	Latency      string  `json:"latency"`      // Added delay, e.g. "100ms"
+	Jitter       string  `json:"jitter"`       // Spread of the added delay
+	Distribution string  `json:"distribution"` // uniform (default) or normal
+	Loss         float64 `json:"loss"`         // Percent of UDP datagrams dropped
+	Bandwidth    string  `json:"bandwidth"`    // Throughput cap per second in each direction, e.g. "1MB"
+}
+
+// chaosStatus reports the faults injected into a listener
+type chaosStatus struct {
+	Latency      string  `json:"latency"`
+	Jitter       string  `json:"jitter"`
+	Distribution string  `json:"distribution"`
+	Loss         float64 `json:"loss"`
+	Bandwidth    int64   `json:"bandwidth"` // Bytes per second, 0 = unlimited
+}
+
+// newChaosStatus formats settings for the API
+func newChaosStatus(s chaos.Settings) chaosStatus {
+	return chaosStatus{
+		Latency:      s.Latency.String(),
+		Jitter:       s.Jitter.String(),
+		Distribution: s.Distribution,
+		Loss:         s.Loss,
+		Bandwidth:    s.Bandwidth,
+	}
+}
+
+// handleChaos serves GET (faults of every listener in chaos mode), POST
+// (set one listener's faults) and DELETE ?listener=<name> (clear them) on
+// /api/chaos
+func (s *Server) handleChaos(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.AllowChaos {
+		writeError(w, http.StatusNotFound, "chaos mode is disabled, set admin.allow_chaos")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		statuses := make(map[string]chaosStatus)
+		for name, settings := range s.manager.ChaosSettings() {
+			statuses[name] = newChaosStatus(settings)
+		}
+		writeJSON(w, http.StatusOK, statuses)
+
+	case http.MethodPost:
+		var req chaosRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		settings, err := chaosSettings(req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !slices.Contains(s.manager.ListenerNames(), req.Listener) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+req.Listener)
+			return
+		}
+		if err := s.manager.SetChaos(req.Listener, settings, r.RemoteAddr); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, newChaosStatus(settings))
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("listener")
+		if !slices.Contains(s.manager.ListenerNames(), name) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+name)
+			return
+		}
+		cleared, err := s.manager.ClearChaos(name, r.RemoteAddr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !cleared {
+			writeError(w, http.StatusConflict, "no chaos faults set on this listener")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"listener": name, "status": "cleared"})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// chaosSettings checks a chaos request with the same rules as a
+// listener's chaos block
+func chaosSettings(req chaosRequest) (chaos.Settings, error) {
+	cfg := config.ChaosConfig{
+		Enabled:      true,
+		Distribution: req.Distribution,
+		Loss:         req.Loss,
+		Bandwidth:    req.Bandwidth,
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"latency", req.Latency, &cfg.Latency},
+		{"jitter", req.Jitter, &cfg.Jitter},
+	} {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return chaos.Settings{}, fmt.Errorf("%s must be a duration such as 100ms", d.name)
+		}
+		*d.dst = duration
+	}
+	if err := cfg.Validate(); err != nil {
+		return chaos.Settings{}, err
+	}
+
+	settings, _ := chaos.FromConfig(&cfg)
+	return settings, nil
+}
@@ -0,0 +1,52 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/espegro/packetpony/internal/listener"
+)
+
+// emergencyRequest is the body of POST /api/emergency
+type emergencyRequest struct {
+	Factor float64 `json:"factor"` // 0 = emergency.bandwidth_factor
+	Reason string  `json:"reason"`
+}
+
+// handleEmergency serves GET (state), POST (engage) and DELETE (release)
+// on /api/emergency
+func (s *Server) handleEmergency(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.manager.Emergency())
+
+	case http.MethodPost:
+		var req emergencyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if req.Reason == "" {
+			writeError(w, http.StatusBadRequest, "reason is required")
+			return
+		}
+		state, err := s.manager.EngageEmergency(req.Factor, req.Reason, r.RemoteAddr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+
+	case http.MethodDelete:
+		state, err := s.manager.ReleaseEmergency(r.RemoteAddr)
+		if errors.Is(err, listener.ErrEmergencyInactive) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
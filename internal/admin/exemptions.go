@@ -0,0 +1,110 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/espegro/packetpony/internal/exempt"
+)
+
+// issueRequest is the body of POST /api/exemptions
+type issueRequest struct {
+	Listener string `json:"listener"` // Empty = all listeners
+	TTL      string `json:"ttl"`
+	Reason   string `json:"reason"`
+	IssuedBy string `json:"issued_by"`
+}
+
+// issueResponse returns the new token; it is not retrievable later
+type issueResponse struct {
+	exempt.Exemption
+	Token string `json:"token"`
+}
+
+// registerRequest is the body of POST /api/exemptions/register
+type registerRequest struct {
+	Token string `json:"token"`
+	IP    string `json:"ip"` // Empty = the source IP of the request
+}
+
+// handleExemptions serves GET (list), POST (issue) and DELETE ?id=<id>
+// (revoke) on /api/exemptions
+func (s *Server) handleExemptions(w http.ResponseWriter, r *http.Request) {
+	registry := s.manager.Exemptions()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, registry.List())
+
+	case http.MethodPost:
+		var req issueRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if req.Reason == "" || req.IssuedBy == "" {
+			writeError(w, http.StatusBadRequest, "reason and issued_by are required")
+			return
+		}
+		if req.Listener != "" && !slices.Contains(s.manager.ListenerNames(), req.Listener) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+req.Listener)
+			return
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "ttl must be a duration such as 30m")
+			return
+		}
+
+		e, token, err := registry.Issue(req.Listener, ttl, req.Reason, req.IssuedBy, r.RemoteAddr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, issueResponse{Exemption: e, Token: token})
+
+	case http.MethodDelete:
+		if err := registry.Revoke(r.URL.Query().Get("id"), r.RemoteAddr); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleRegisterExemption serves POST /api/exemptions/register, binding a
+// token to a client IP
+func (s *Server) handleRegisterExemption(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.IP == "" {
+		req.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+
+	e, err := s.manager.Exemptions().Register(req.Token, req.IP, r.RemoteAddr)
+	switch {
+	case errors.Is(err, exempt.ErrUnknownToken):
+		writeError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, exempt.ErrTokenUsed):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, e)
+	}
+}
@@ -0,0 +1,104 @@
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/espegro/packetpony/internal/listener"
+	"github.com/espegro/packetpony/internal/proxy"
+)
+
+// killRequest is the body of POST /api/flows/kill
+type killRequest struct {
+	Listener string `json:"listener"`  // Empty = all listeners
+	Source   string `json:"source"`    // Client IP or CIDR
+	MinIdle  string `json:"min_idle"`  // Duration such as 5m
+	MinBytes int64  `json:"min_bytes"` // Both directions
+	DryRun   bool   `json:"dry_run"`
+}
+
+// killResponse reports the flows matched per listener
+type killResponse struct {
+	DryRun    bool                   `json:"dry_run"`
+	Total     int                    `json:"total"`
+	Listeners []listener.KilledFlows `json:"listeners"`
+}
+
+// handleKillFlows serves POST /api/flows/kill, which closes the TCP
+// connections and UDP sessions matching a filter
+func (s *Server) handleKillFlows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req killRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	// An empty filter would kill every flow of the instance
+	if req.Listener == "" && req.Source == "" && req.MinIdle == "" && req.MinBytes == 0 {
+		writeError(w, http.StatusBadRequest, "at least one of listener, source, min_idle or min_bytes is required")
+		return
+	}
+
+	var filter proxy.FlowFilter
+	if req.Source != "" {
+		source, err := parseSource(req.Source)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "source must be an IP address or CIDR")
+			return
+		}
+		filter.Source = source
+	}
+	if req.MinIdle != "" {
+		minIdle, err := time.ParseDuration(req.MinIdle)
+		if err != nil || minIdle < 0 {
+			writeError(w, http.StatusBadRequest, "min_idle must be a duration such as 5m")
+			return
+		}
+		filter.MinIdle = minIdle
+	}
+	if req.MinBytes < 0 {
+		writeError(w, http.StatusBadRequest, "min_bytes must not be negative")
+		return
+	}
+	filter.MinBytes = req.MinBytes
+
+	if req.Listener != "" && !slices.Contains(s.manager.ListenerNames(), req.Listener) {
+		writeError(w, http.StatusNotFound, "unknown listener: "+req.Listener)
+		return
+	}
+	results, err := s.manager.KillFlows(req.Listener, filter, req.DryRun, r.RemoteAddr)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	resp := killResponse{DryRun: req.DryRun, Listeners: results}
+	for _, result := range results {
+		resp.Total += result.Flows
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseSource parses an IP address or CIDR into a network
+func parseSource(s string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: s}
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/espegro/packetpony/internal/listener"
+	"github.com/espegro/packetpony/internal/quota"
+)
+
+// handleQuotas serves GET ?listener=<name>[&ip=<ip>] (usage) and DELETE
+// ?listener=<name>&ip=<ip> (reset) on /api/quotas
+func (s *Server) handleQuotas(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		names := s.manager.ListenerNames()
+		if name := r.URL.Query().Get("listener"); name != "" {
+			if !slices.Contains(names, name) {
+				writeError(w, http.StatusNotFound, "unknown listener: "+name)
+				return
+			}
+			names = []string{name}
+		}
+		var ip string
+		if value := r.URL.Query().Get("ip"); value != "" {
+			parsed := net.ParseIP(value)
+			if parsed == nil {
+				writeError(w, http.StatusBadRequest, "invalid IP address: "+value)
+				return
+			}
+			ip = parsed.String()
+		}
+
+		result := make(map[string][]quota.Usage)
+		for _, name := range names {
+			var usages []quota.Usage
+			var err error
+			if ip != "" {
+				usages, err = s.manager.ClientQuota(name, ip)
+			} else {
+				usages, err = s.manager.Quotas(name)
+			}
+			switch {
+			case errors.Is(err, listener.ErrQuotaDisabled):
+				continue
+			case err != nil:
+				writeError(w, http.StatusBadGateway, err.Error())
+				return
+			}
+			result[name] = usages
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("listener")
+		if !slices.Contains(s.manager.ListenerNames(), name) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+name)
+			return
+		}
+		ip := net.ParseIP(r.URL.Query().Get("ip"))
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, "invalid IP address: "+r.URL.Query().Get("ip"))
+			return
+		}
+
+		err := s.manager.ResetQuota(name, ip.String(), r.RemoteAddr)
+		switch {
+		case errors.Is(err, listener.ErrQuotaDisabled):
+			writeError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			writeError(w, http.StatusBadGateway, err.Error())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// reloadResponse previews the effect of reloading the configuration file
+type reloadResponse struct {
+	DryRun   bool     `json:"dry_run"`
+	Config   string   `json:"config"`
+	Differs  bool     `json:"differs"` // The file differs from the running configuration
+	Warnings []string `json:"warnings"`
+	*config.Diff
+}
+
+// handleReload serves POST /api/config/reload?dry_run=true, which loads and
+// validates the configuration file and reports how it differs from the
+// running configuration. Reloads are applied with a binary upgrade
+// (SIGUSR2), which starts a new process with the file on disk.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if r.URL.Query().Get("dry_run") != "true" {
+		writeError(w, http.StatusBadRequest, "only dry_run=true is supported; apply a reload with SIGUSR2")
+		return
+	}
+
+	next, err := config.LoadConfig(s.configPath)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err := next.Validate(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "invalid configuration: "+err.Error())
+		return
+	}
+
+	diff, err := config.DiffConfigs(s.running, next)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	warnings := []string{}
+	for _, warning := range next.Lint() {
+		warnings = append(warnings, warning.String())
+	}
+
+	writeJSON(w, http.StatusOK, reloadResponse{
+		DryRun:   true,
+		Config:   s.configPath,
+		Differs:  !diff.Empty(),
+		Warnings: warnings,
+		Diff:     diff,
+	})
+}
@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+)
+
+// samplingRequest is the body of POST /api/sampling
+type samplingRequest struct {
+	Listener string `json:"listener"`
+	Rate     int    `json:"rate"` // Log and time 1 in rate flows, 1 = every flow
+}
+
+// samplingResponse reports a changed sample rate
+type samplingResponse struct {
+	Listener string `json:"listener"`
+	Rate     int    `json:"rate"`
+	Previous int    `json:"previous"`
+}
+
+// handleSampling serves GET (the sample rate of every listener) and POST
+// (change one listener's rate) on /api/sampling
+func (s *Server) handleSampling(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.manager.SampleRates())
+
+	case http.MethodPost:
+		var req samplingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if req.Rate < 1 {
+			writeError(w, http.StatusBadRequest, "rate must be a positive integer")
+			return
+		}
+		if !slices.Contains(s.manager.ListenerNames(), req.Listener) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+req.Listener)
+			return
+		}
+		previous, err := s.manager.SetSampleRate(req.Listener, req.Rate, r.RemoteAddr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, samplingResponse{Listener: req.Listener, Rate: req.Rate, Previous: previous})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,153 @@
+// Package admin provides the runtime administration HTTP API.
+// The API runs on its own listener, separate from the metrics endpoint,
+// and should only be bound to trusted interfaces.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/handover"
+	"github.com/espegro/packetpony/internal/listener"
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+const defaultTopTalkers = 10
+
+// Server is the admin API HTTP server
+type Server struct {
+	cfg        config.AdminConfig
+	running    *config.Config // Configuration the process started with
+	configPath string         // File a reload would read
+	manager    *listener.Manager
+	logger     logging.Logger
+	mux        *http.ServeMux
+	server     *http.Server
+}
+
+// NewServer creates a new admin API server. running is the configuration
+// loaded from configPath at startup.
+func NewServer(running *config.Config, configPath string, manager *listener.Manager, logger logging.Logger) *Server {
+	s := &Server{
+		cfg:        running.Admin,
+		running:    running,
+		configPath: configPath,
+		manager:    manager,
+		logger:     logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/toptalkers", s.handleTopTalkers)
+	mux.HandleFunc("/api/exemptions", s.handleExemptions)
+	mux.HandleFunc("/api/exemptions/register", s.handleRegisterExemption)
+	mux.HandleFunc("/api/bans", s.handleBans)
+	mux.HandleFunc("/api/allowlist", s.handleAllowlist)
+	mux.HandleFunc("/api/quotas", s.handleQuotas)
+	mux.HandleFunc("/api/targets", s.handleTargets)
+	mux.HandleFunc("/api/targets/drain", s.handleDrain)
+	mux.HandleFunc("/api/accounting", s.handleAccounting)
+	mux.HandleFunc("/api/emergency", s.handleEmergency)
+	mux.HandleFunc("/api/accounting/flush", s.handleAccountingFlush)
+	mux.HandleFunc("/api/flows/kill", s.handleKillFlows)
+	mux.HandleFunc("/api/sampling", s.handleSampling)
+	mux.HandleFunc("/api/capture", s.handleCapture)
+	mux.HandleFunc("/api/chaos", s.handleChaos)
+	mux.HandleFunc("/api/config/reload", s.handleReload)
+	s.mux = mux
+
+	s.server = &http.Server{
+		Addr:    s.cfg.ListenAddress,
+		Handler: mux,
+	}
+
+	return s
+}
+
+// Handle serves handler at pattern next to the API, such as the metrics
+// endpoints with serve_on_admin. It must be called before Start.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start binds the admin listener and serves requests in the background
+func (s *Server) Start() error {
+	ln, err := handover.Listen("admin", s.cfg.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.ListenAddress, err)
+	}
+
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.logger.LogError(logging.EventAdminFailed, map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown gracefully stops the admin API server
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// topTalkersResponse is the per-listener top talkers payload
+type topTalkersResponse struct {
+	ByBytes       interface{} `json:"by_bytes"`
+	ByConnections interface{} `json:"by_connections"`
+}
+
+// handleTopTalkers serves GET /api/toptalkers?listener=<name>&n=<count>
+func (s *Server) handleTopTalkers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	n := defaultTopTalkers
+	if v := r.URL.Query().Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, "n must be a positive integer")
+			return
+		}
+		n = parsed
+	}
+
+	names := s.manager.ListenerNames()
+	if name := r.URL.Query().Get("listener"); name != "" {
+		names = []string{name}
+	}
+
+	result := make(map[string]topTalkersResponse, len(names))
+	for _, name := range names {
+		byBytes, byConnections, err := s.manager.TopTalkers(name, n)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		result[name] = topTalkersResponse{
+			ByBytes:       byBytes,
+			ByConnections: byConnections,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,96 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/espegro/packetpony/internal/target"
+)
+
+// drainRequest is the body of POST /api/targets/drain
+type drainRequest struct {
+	Listener string `json:"listener"`
+	Target   string `json:"target"`
+	Grace    string `json:"grace"` // Empty = keep flows until they end
+}
+
+// handleTargets serves GET /api/targets?listener=<name>, the state of each
+// balanced target
+func (s *Server) handleTargets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	names := s.manager.ListenerNames()
+	if name := r.URL.Query().Get("listener"); name != "" {
+		if !slices.Contains(names, name) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+name)
+			return
+		}
+		names = []string{name}
+	}
+
+	result := make(map[string][]target.TargetStatus)
+	for _, name := range names {
+		targets, _ := s.manager.Targets(name)
+		if targets != nil {
+			result[name] = targets
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleDrain serves POST (drain) and DELETE ?listener=<name>&target=<addr>
+// (back into service) on /api/targets/drain
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	var status target.TargetStatus
+	var err error
+
+	switch r.Method {
+	case http.MethodPost:
+		var req drainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		var grace time.Duration
+		if req.Grace != "" {
+			if grace, err = time.ParseDuration(req.Grace); err != nil || grace < 0 {
+				writeError(w, http.StatusBadRequest, "grace must be a duration such as 5m")
+				return
+			}
+		}
+		if !slices.Contains(s.manager.ListenerNames(), req.Listener) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+req.Listener)
+			return
+		}
+		status, err = s.manager.DrainTarget(req.Listener, req.Target, grace, r.RemoteAddr)
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("listener")
+		if !slices.Contains(s.manager.ListenerNames(), name) {
+			writeError(w, http.StatusNotFound, "unknown listener: "+name)
+			return
+		}
+		status, err = s.manager.UndrainTarget(name, r.URL.Query().Get("target"), r.RemoteAddr)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	switch {
+	case errors.Is(err, target.ErrUnknownTarget):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, target.ErrLastTarget), errors.Is(err, target.ErrNotDraining):
+		writeError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, status)
+	}
+}
@@ -0,0 +1,385 @@
+// Package ban provides a temporary ban list for repeat rate limit offenders.
+// Clients that exceed limits too often within a window are banned for a fixed duration.
+// Bans are persisted to a storage.Store; violation counts are kept in memory.
+package ban
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/storage"
+)
+
+// syncInterval is how often bans made or lifted by other instances
+// sharing the store are picked up
+const syncInterval = 5 * time.Second
+
+// Ban is an active ban
+type Ban struct {
+	IP        string    `json:"ip"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// BanList tracks rate limit violations per IP and maintains timed bans
+type BanList struct {
+	mu            sync.RWMutex
+	maxViolations int
+	window        time.Duration
+	duration      time.Duration
+	violations    map[string][]time.Time
+	bans          map[string]time.Time // IP -> ban expiry
+	stored        map[string]time.Time // IP -> when its ban was last known to be in the store
+	onExpire      func(ip string)
+	onLift        func(ip string)
+	onStoreError  func(err error)
+	store         storage.Store
+	keyPrefix     string
+	stopCleanup   chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewBanList creates a ban list that bans an IP for duration after
+// maxViolations violations within window. Bans are stored in store under
+// keyPrefix, and bans already in the store are loaded.
+func NewBanList(maxViolations int, window, duration time.Duration, store storage.Store, keyPrefix string) *BanList {
+	b := &BanList{
+		maxViolations: maxViolations,
+		window:        window,
+		duration:      duration,
+		violations:    make(map[string][]time.Time),
+		bans:          make(map[string]time.Time),
+		stored:        make(map[string]time.Time),
+		store:         store,
+		keyPrefix:     keyPrefix,
+		stopCleanup:   make(chan struct{}),
+	}
+
+	// Restore bans from a previous run or another instance
+	b.sync()
+
+	// Start cleanup goroutine
+	go b.cleanupLoop()
+
+	return b
+}
+
+// IsBanned checks if an IP is currently banned
+func (b *BanList) IsBanned(ip string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	expiry, exists := b.bans[ip]
+	return exists && time.Now().Before(expiry)
+}
+
+// RecordViolation records a rate limit violation for an IP.
+// Returns true if this violation caused the IP to be banned.
+func (b *BanList) RecordViolation(ip string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+
+	now := time.Now()
+
+	// Already banned, nothing more to count
+	if expiry, exists := b.bans[ip]; exists && now.Before(expiry) {
+		b.mu.Unlock()
+		return false
+	}
+
+	cutoff := now.Add(-b.window)
+	timestamps := b.violations[ip]
+	valid := make([]time.Time, 0, len(timestamps)+1)
+	for _, ts := range timestamps {
+		if ts.After(cutoff) {
+			valid = append(valid, ts)
+		}
+	}
+	valid = append(valid, now)
+
+	if len(valid) >= b.maxViolations {
+		delete(b.violations, ip)
+		expiry := now.Add(b.duration)
+		b.bans[ip] = expiry
+		b.mu.Unlock()
+
+		// Persist outside the lock; the ban applies locally regardless
+		b.persist(ip, expiry)
+		return true
+	}
+
+	b.violations[ip] = valid
+	b.mu.Unlock()
+	return false
+}
+
+// Ban bans an IP for duration, replacing any ban it already has
+func (b *BanList) Ban(ip string, duration time.Duration) Ban {
+	expiry := time.Now().Add(duration)
+
+	b.mu.Lock()
+	b.bans[ip] = expiry
+	delete(b.violations, ip)
+	b.mu.Unlock()
+
+	b.persist(ip, expiry)
+	return Ban{IP: ip, ExpiresAt: expiry}
+}
+
+// Unban lifts the ban on an IP. Returns false if it was not banned. The
+// ban is lifted locally even if removing it from the store fails, but
+// then comes back at the next sync.
+func (b *BanList) Unban(ip string) (bool, error) {
+	b.mu.Lock()
+	expiry, exists := b.bans[ip]
+	delete(b.bans, ip)
+	delete(b.stored, ip)
+	delete(b.violations, ip)
+	b.mu.Unlock()
+
+	banned := exists && time.Now().Before(expiry)
+	if b.store != nil {
+		if err := b.store.Delete(b.keyPrefix + ip); err != nil {
+			b.storeError(err)
+			return banned, err
+		}
+	}
+	return banned, nil
+}
+
+// List returns the active bans, soonest expiry first
+func (b *BanList) List() []Ban {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	result := make([]Ban, 0, len(b.bans))
+	for ip, expiry := range b.bans {
+		if now.Before(expiry) {
+			result = append(result, Ban{IP: ip, ExpiresAt: expiry})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ExpiresAt.Before(result[j].ExpiresAt)
+	})
+	return result
+}
+
+// persist writes a ban to the store
+func (b *BanList) persist(ip string, expiry time.Time) {
+	if b.store == nil {
+		return
+	}
+	value := strconv.FormatInt(expiry.UnixNano(), 10)
+	if err := b.store.Set(b.keyPrefix+ip, []byte(value), time.Until(expiry)); err != nil {
+		b.storeError(err)
+		return
+	}
+
+	b.mu.Lock()
+	if b.bans[ip].Equal(expiry) {
+		b.stored[ip] = time.Now()
+	}
+	b.mu.Unlock()
+}
+
+// sync merges bans from the store into the local ban table. Bans that were
+// in the store and are gone from it were lifted by another instance.
+func (b *BanList) sync() {
+	if b.store == nil {
+		return
+	}
+
+	now := time.Now()
+	stored := make(map[string]time.Time)
+	err := b.store.Scan(b.keyPrefix, func(key string, value []byte) bool {
+		nanos, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return true
+		}
+		if expiry := time.Unix(0, nanos); now.Before(expiry) {
+			stored[key[len(b.keyPrefix):]] = expiry
+		}
+		return true
+	})
+	if err != nil {
+		b.storeError(err)
+		return
+	}
+
+	b.mu.Lock()
+	for ip, expiry := range stored {
+		b.stored[ip] = now
+		if expiry.After(b.bans[ip]) {
+			b.bans[ip] = expiry
+			delete(b.violations, ip)
+		}
+	}
+
+	// Bans stored after the scan started may be missing from it
+	var lifted []string
+	for ip, seen := range b.stored {
+		if _, exists := stored[ip]; exists || !seen.Before(now) {
+			continue
+		}
+		delete(b.stored, ip)
+		if expiry, exists := b.bans[ip]; exists && now.Before(expiry) {
+			delete(b.bans, ip)
+			lifted = append(lifted, ip)
+		}
+	}
+	onLift := b.onLift
+	b.mu.Unlock()
+
+	if onLift != nil {
+		for _, ip := range lifted {
+			onLift(ip)
+		}
+	}
+}
+
+// storeError reports a storage failure to the registered callback
+func (b *BanList) storeError(err error) {
+	b.mu.RLock()
+	fn := b.onStoreError
+	b.mu.RUnlock()
+	if fn != nil {
+		fn(err)
+	}
+}
+
+// OnExpire registers a callback invoked when a ban expires
+func (b *BanList) OnExpire(fn func(ip string)) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onExpire = fn
+}
+
+// OnLift registers a callback invoked when another instance sharing the
+// store lifts a ban
+func (b *BanList) OnLift(fn func(ip string)) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onLift = fn
+}
+
+// OnStoreError registers a callback invoked when the ban store fails.
+// Bans keep applying locally while the store is unavailable.
+func (b *BanList) OnStoreError(fn func(err error)) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onStoreError = fn
+}
+
+// Duration returns the configured ban duration
+func (b *BanList) Duration() time.Duration {
+	return b.duration
+}
+
+// ActiveBans returns the number of currently banned IPs
+func (b *BanList) ActiveBans() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := time.Now()
+	count := 0
+	for _, expiry := range b.bans {
+		if now.Before(expiry) {
+			count++
+		}
+	}
+	return count
+}
+
+// cleanupLoop periodically removes expired bans and violations
+func (b *BanList) cleanupLoop() {
+	interval := b.window
+	if b.duration < interval {
+		interval = b.duration
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	syncTicker := time.NewTicker(syncInterval)
+	defer syncTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.cleanup()
+		case <-syncTicker.C:
+			b.sync()
+		case <-b.stopCleanup:
+			return
+		}
+	}
+}
+
+// cleanup removes expired bans and violations
+func (b *BanList) cleanup() {
+	b.mu.Lock()
+
+	now := time.Now()
+	var expired []string
+	for ip, expiry := range b.bans {
+		if !now.Before(expiry) {
+			delete(b.bans, ip)
+			delete(b.stored, ip)
+			expired = append(expired, ip)
+		}
+	}
+
+	cutoff := now.Add(-b.window)
+	for ip, timestamps := range b.violations {
+		if len(timestamps) == 0 || timestamps[len(timestamps)-1].Before(cutoff) {
+			delete(b.violations, ip)
+		}
+	}
+
+	onExpire := b.onExpire
+	b.mu.Unlock()
+
+	// Invoke callbacks outside the lock
+	if onExpire != nil {
+		for _, ip := range expired {
+			onExpire(ip)
+		}
+	}
+}
+
+// Close stops the cleanup goroutine
+func (b *BanList) Close() {
+	if b == nil {
+		return
+	}
+	b.closeOnce.Do(func() {
+		close(b.stopCleanup)
+	})
+}
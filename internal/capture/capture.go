@@ -0,0 +1,283 @@
+// Package capture records the traffic of a listener to a pcap file for
+// debugging. PacketPony proxies at the socket level and never sees packets
+// on the wire, so each payload is wrapped in a synthesized IP and TCP or
+// UDP header carrying the flow's real addresses. The client side (client to
+// listener) and the target side (packetpony to target) can be recorded
+// separately, which shows whether bad data came from the client or the
+// backend. A replay capture instead records the datagrams UDP clients send
+// in a format "packetpony replay" can send to a target again.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Sides of a flow that can be captured
+const (
+	SideClient = "client" // Between the client and the listener
+	SideTarget = "target" // Between packetpony and the target
+	SideBoth   = "both"
+)
+
+// Capture file formats
+const (
+	FormatPcap   = "pcap"   // Both sides, for Wireshark or tcpdump
+	FormatReplay = "replay" // Datagrams from UDP clients, for packetpony replay
+)
+
+// Reasons a capture stopped
+const (
+	StopDuration = "duration"
+	StopMaxBytes = "max_bytes"
+	StopRequest  = "stopped"
+	StopError    = "write_error"
+)
+
+// Options bound a capture
+type Options struct {
+	Path     string
+	Format   string        // FormatPcap (default) or FormatReplay
+	Side     string        // SideClient, SideTarget or SideBoth; pcap only
+	Duration time.Duration // Stop after this long
+	MaxBytes int64         // Stop before the file grows past this
+}
+
+// Status describes a running or finished capture
+type Status struct {
+	Listener   string    `json:"listener"`
+	Path       string    `json:"path"`
+	Format     string    `json:"format"`
+	Side       string    `json:"side"`
+	Started    time.Time `json:"started"`
+	Until      time.Time `json:"until"`
+	MaxBytes   int64     `json:"max_bytes"`
+	Packets    int64     `json:"packets"`
+	Bytes      int64     `json:"bytes"`
+	Active     bool      `json:"active"`
+	StopReason string    `json:"stop_reason,omitempty"`
+}
+
+// Capture writes the packets of one listener to a pcap file until its
+// duration or size limit is reached or it is stopped
+type Capture struct {
+	listener string
+	opts     Options
+	started  time.Time
+	timer    *time.Timer
+	onStop   func(Status)
+
+	mu       sync.Mutex
+	file     *os.File
+	w        *bufio.Writer
+	bytes    int64
+	packets  int64
+	sessions map[string]uint32 // Replay session numbers by session ID
+	reason   string            // Set once stopped
+}
+
+// Start creates the capture file and starts recording. onStop is called
+// once, without locks held, when the capture stops for any reason.
+func Start(listener string, opts Options, onStop func(Status)) (*Capture, error) {
+	file, err := os.OpenFile(opts.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	if opts.Format == "" {
+		opts.Format = FormatPcap
+	}
+	c := &Capture{
+		listener: listener,
+		opts:     opts,
+		started:  time.Now(),
+		onStop:   onStop,
+		file:     file,
+		w:        bufio.NewWriter(file),
+		sessions: make(map[string]uint32),
+	}
+
+	header := fileHeader()
+	if opts.Format == FormatReplay {
+		header = replayHeader(c.started)
+	}
+	c.w.Write(header)
+	c.bytes = int64(len(header))
+
+	c.mu.Lock()
+	c.timer = time.AfterFunc(opts.Duration, func() {
+		c.stop(StopDuration)
+	})
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+// Records reports whether side is being recorded to a pcap file
+func (c *Capture) Records(side string) bool {
+	return c != nil && c.opts.Format == FormatPcap && (c.opts.Side == SideBoth || c.opts.Side == side)
+}
+
+// TCP records payload sent on one side of a TCP connection. fromA is true
+// for data sent by the stream's initiator (the client on the client side,
+// packetpony on the target side).
+func (c *Capture) TCP(s *Stream, fromA bool, payload []byte) {
+	if !c.Records(s.side) || len(payload) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(payload) > 0 {
+		n := min(len(payload), maxSegment)
+		var packet []byte
+		if fromA {
+			packet = tcpPacket(s.a, s.b, s.seqA, s.seqB, payload[:n])
+			s.seqA += uint32(n)
+		} else {
+			packet = tcpPacket(s.b, s.a, s.seqB, s.seqA, payload[:n])
+			s.seqB += uint32(n)
+		}
+		if !c.write(packet) {
+			return
+		}
+		payload = payload[n:]
+	}
+}
+
+// UDP records a datagram sent from src to dst on side
+func (c *Capture) UDP(side string, src, dst net.Addr, payload []byte) {
+	if !c.Records(side) {
+		return
+	}
+	c.write(udpPacket(src, dst, payload))
+}
+
+// Replay records a datagram a UDP client sent in the session with the
+// given ID, if this is a replay capture
+func (c *Capture) Replay(session string, payload []byte) {
+	if c == nil || c.opts.Format != FormatReplay {
+		return
+	}
+	c.mu.Lock()
+	n, ok := c.sessions[session]
+	if !ok {
+		n = uint32(len(c.sessions))
+		c.sessions[session] = n
+	}
+	c.mu.Unlock()
+	c.append(replayRecord(time.Since(c.started), n, payload))
+}
+
+// write appends a pcap packet record. Reports whether the capture is still
+// running.
+func (c *Capture) write(packet []byte) bool {
+	now := time.Now()
+	var h [recordHeaderLen]byte
+	binary.LittleEndian.PutUint32(h[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(h[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(h[12:], uint32(len(packet)))
+	return c.append(h[:], packet)
+}
+
+// append writes the parts of one record, stopping the capture when they
+// would take the file past MaxBytes. Reports whether the capture is still
+// running.
+func (c *Capture) append(parts ...[]byte) bool {
+	c.mu.Lock()
+	if c.reason != "" {
+		c.mu.Unlock()
+		return false
+	}
+	var size int64
+	for _, part := range parts {
+		size += int64(len(part))
+	}
+	if c.bytes+size > c.opts.MaxBytes {
+		c.mu.Unlock()
+		c.stop(StopMaxBytes)
+		return false
+	}
+
+	var err error
+	for _, part := range parts {
+		if _, err = c.w.Write(part); err != nil {
+			break
+		}
+	}
+	c.bytes += size
+	c.packets++
+	c.mu.Unlock()
+
+	if err != nil {
+		c.stop(StopError)
+		return false
+	}
+	return true
+}
+
+// Stop ends the capture and closes the file. Stopping a capture that has
+// already stopped does nothing.
+func (c *Capture) Stop() error {
+	return c.stop(StopRequest)
+}
+
+// stop ends the capture with reason, flushing and closing the file
+func (c *Capture) stop(reason string) error {
+	c.mu.Lock()
+	if c.reason != "" {
+		c.mu.Unlock()
+		return nil
+	}
+	c.reason = reason
+	c.timer.Stop()
+	err := c.w.Flush()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	c.mu.Unlock()
+
+	if c.onStop != nil {
+		c.onStop(c.Status())
+	}
+	return err
+}
+
+// Status returns the capture's progress
+func (c *Capture) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Status{
+		Listener:   c.listener,
+		Path:       c.opts.Path,
+		Format:     c.opts.Format,
+		Side:       c.opts.Side,
+		Started:    c.started,
+		Until:      c.started.Add(c.opts.Duration),
+		MaxBytes:   c.opts.MaxBytes,
+		Packets:    c.packets,
+		Bytes:      c.bytes,
+		Active:     c.reason == "",
+		StopReason: c.reason,
+	}
+}
+
+// Stream holds the synthesized sequence numbers of one side of a TCP
+// connection, so the segments recorded for it reassemble in order
+type Stream struct {
+	side       string
+	a, b       net.Addr // a opened the connection
+	mu         sync.Mutex
+	seqA, seqB uint32
+}
+
+// NewStream tracks the side of a connection opened from a to b
+func NewStream(side string, a, b net.Addr) *Stream {
+	return &Stream{side: side, a: a, b: b, seqA: 1, seqB: 1}
+}
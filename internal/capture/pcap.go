@@ -0,0 +1,138 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// pcap file format constants (microsecond timestamps, raw IP link type)
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	pcapSnapLen      = 65535
+	linkTypeRaw      = 101 // LINKTYPE_RAW: packets start with an IPv4 or IPv6 header
+
+	pcapHeaderLen   = 24
+	recordHeaderLen = 16
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	tcpHeaderLen  = 20
+	udpHeaderLen  = 8
+
+	protoTCP = 6
+	protoUDP = 17
+
+	// maxSegment is the most payload put in one synthesized packet, so the
+	// IP length fields cannot overflow
+	maxSegment = 65000
+)
+
+// TCP flags set on synthesized segments
+const (
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// fileHeader returns the pcap global header
+func fileHeader() []byte {
+	h := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(h[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(h[4:], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(h[6:], pcapVersionMinor)
+	// Bytes 8-15 (timezone offset and timestamp accuracy) stay zero
+	binary.LittleEndian.PutUint32(h[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(h[20:], linkTypeRaw)
+	return h
+}
+
+// endpoint returns the IP and port of a TCP or UDP address
+func endpoint(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	default:
+		return net.IPv4zero, 0
+	}
+}
+
+// ipHeader appends an IPv4 header, or an IPv6 header unless both addresses
+// are IPv4, for a packet carrying payloadLen bytes of protocol proto
+func ipHeader(b []byte, src, dst net.IP, proto byte, payloadLen int) []byte {
+	src4, dst4 := src.To4(), dst.To4()
+	if src4 != nil && dst4 != nil {
+		h := make([]byte, ipv4HeaderLen)
+		h[0] = 0x45 // Version 4, 5 words
+		binary.BigEndian.PutUint16(h[2:], uint16(ipv4HeaderLen+payloadLen))
+		h[6] = 0x40 // Don't fragment
+		h[8] = 64   // TTL
+		h[9] = proto
+		copy(h[12:16], src4)
+		copy(h[16:20], dst4)
+		binary.BigEndian.PutUint16(h[10:], checksum(h))
+		return append(b, h...)
+	}
+
+	h := make([]byte, ipv6HeaderLen)
+	h[0] = 0x60 // Version 6
+	binary.BigEndian.PutUint16(h[4:], uint16(payloadLen))
+	h[6] = proto
+	h[7] = 64 // Hop limit
+	copy(h[8:24], src.To16())
+	copy(h[24:40], dst.To16())
+	return append(b, h...)
+}
+
+// tcpPacket returns a synthesized IP/TCP packet. Checksums of the TCP
+// header are left zero; Wireshark does not verify them by default.
+func tcpPacket(src, dst net.Addr, seq, ack uint32, payload []byte) []byte {
+	srcIP, srcPort := endpoint(src)
+	dstIP, dstPort := endpoint(dst)
+
+	b := make([]byte, 0, ipv6HeaderLen+tcpHeaderLen+len(payload))
+	b = ipHeader(b, srcIP, dstIP, protoTCP, tcpHeaderLen+len(payload))
+
+	h := make([]byte, tcpHeaderLen)
+	binary.BigEndian.PutUint16(h[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(h[2:], uint16(dstPort))
+	binary.BigEndian.PutUint32(h[4:], seq)
+	binary.BigEndian.PutUint32(h[8:], ack)
+	h[12] = (tcpHeaderLen / 4) << 4
+	h[13] = tcpFlagPSH | tcpFlagACK
+	binary.BigEndian.PutUint16(h[14:], 65535) // Window
+	b = append(b, h...)
+
+	return append(b, payload...)
+}
+
+// udpPacket returns a synthesized IP/UDP packet without a UDP checksum
+func udpPacket(src, dst net.Addr, payload []byte) []byte {
+	srcIP, srcPort := endpoint(src)
+	dstIP, dstPort := endpoint(dst)
+
+	b := make([]byte, 0, ipv6HeaderLen+udpHeaderLen+len(payload))
+	b = ipHeader(b, srcIP, dstIP, protoUDP, udpHeaderLen+len(payload))
+
+	h := make([]byte, udpHeaderLen)
+	binary.BigEndian.PutUint16(h[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(h[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(h[4:], uint16(udpHeaderLen+len(payload)))
+	b = append(b, h...)
+
+	return append(b, payload...)
+}
+
+// checksum computes the Internet checksum of an IPv4 header
+func checksum(h []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(h); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(h[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,114 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Replay file format. A replay capture holds the datagrams UDP clients
+// sent, with their timing and session, so they can be sent to a target
+// again by "packetpony replay". All integers are big-endian.
+//
+//	header: magic "PPREPLAY", version uint32, start time uint64 (Unix ns)
+//	record: offset from start uint64 (ns), session uint32, length uint32, payload
+const (
+	replayMagic         = "PPREPLAY"
+	replayVersion       = 1
+	replayHeaderLen     = 20
+	replayRecordHeadLen = 16
+)
+
+// ReplayRecord is one datagram of a replay capture
+type ReplayRecord struct {
+	Offset  time.Duration // Time since the capture started
+	Session uint32        // Numbered from 0 in order of first datagram
+	Payload []byte
+}
+
+// replayHeader returns the replay file header for a capture started at start
+func replayHeader(start time.Time) []byte {
+	h := make([]byte, replayHeaderLen)
+	copy(h, replayMagic)
+	binary.BigEndian.PutUint32(h[8:], replayVersion)
+	binary.BigEndian.PutUint64(h[12:], uint64(start.UnixNano()))
+	return h
+}
+
+// replayRecord returns the record of a datagram from session
+func replayRecord(offset time.Duration, session uint32, payload []byte) []byte {
+	b := make([]byte, replayRecordHeadLen, replayRecordHeadLen+len(payload))
+	binary.BigEndian.PutUint64(b[0:], uint64(offset))
+	binary.BigEndian.PutUint32(b[8:], session)
+	binary.BigEndian.PutUint32(b[12:], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+// ReplayReader reads the records of a replay capture
+type ReplayReader struct {
+	file    *os.File
+	r       *bufio.Reader
+	Started time.Time // When the capture started
+}
+
+// OpenReplay opens a replay capture and reads its header
+func OpenReplay(path string) (*ReplayReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(file)
+	h := make([]byte, replayHeaderLen)
+	if _, err := io.ReadFull(r, h); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: not a replay capture: %w", path, err)
+	}
+	if string(h[:8]) != replayMagic {
+		file.Close()
+		return nil, fmt.Errorf("%s: not a replay capture", path)
+	}
+	if v := binary.BigEndian.Uint32(h[8:]); v != replayVersion {
+		file.Close()
+		return nil, fmt.Errorf("%s: unsupported replay capture version %d", path, v)
+	}
+
+	return &ReplayReader{
+		file:    file,
+		r:       r,
+		Started: time.Unix(0, int64(binary.BigEndian.Uint64(h[12:]))),
+	}, nil
+}
+
+// Next returns the next record, or io.EOF after the last one. A record
+// cut short, as left by a capture that could not finish writing, is
+// reported as io.ErrUnexpectedEOF.
+func (rr *ReplayReader) Next() (ReplayRecord, error) {
+	var h [replayRecordHeadLen]byte
+	if _, err := io.ReadFull(rr.r, h[:]); err != nil {
+		return ReplayRecord{}, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(h[12:]))
+	if _, err := io.ReadFull(rr.r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return ReplayRecord{}, err
+	}
+
+	return ReplayRecord{
+		Offset:  time.Duration(binary.BigEndian.Uint64(h[0:])),
+		Session: binary.BigEndian.Uint32(h[8:]),
+		Payload: payload,
+	}, nil
+}
+
+// Close closes the file
+func (rr *ReplayReader) Close() error {
+	return rr.file.Close()
+}
@@ -0,0 +1,176 @@
+// Package chaos injects network faults into a listener's flows: added
+// latency with jitter, UDP packet loss and a bandwidth bottleneck. It turns
+// packetpony into an inline chaos tool for staging environments, to see how
+// clients and backends cope with a bad network.
+package chaos
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+// maxQueue is the longest a datagram may wait for the bandwidth
+// bottleneck; datagrams that would wait longer are dropped, like a full
+// router queue
+const maxQueue = 200 * time.Millisecond
+
+// Directions a flow's data travels in
+const (
+	Upstream   = 0 // Client to target
+	Downstream = 1 // Target to client
+)
+
+// Settings are the faults injected into a listener's flows
+type Settings struct {
+	Latency      time.Duration
+	Jitter       time.Duration
+	Distribution string  // config.ChaosDistributionUniform or config.ChaosDistributionNormal
+	Loss         float64 // Percent of UDP datagrams dropped
+	Bandwidth    int64   // Bytes per second in each direction, 0 = unlimited
+}
+
+// FromConfig returns the settings of a listener's chaos block, reporting
+// false if it is absent or disabled
+func FromConfig(cfg *config.ChaosConfig) (Settings, bool) {
+	if cfg == nil || !cfg.Enabled {
+		return Settings{}, false
+	}
+	return Settings{
+		Latency:      cfg.Latency,
+		Jitter:       cfg.Jitter,
+		Distribution: cfg.GetDistribution(),
+		Loss:         cfg.Loss,
+		Bandwidth:    cfg.GetBandwidth(),
+	}, true
+}
+
+// Injector holds the faults injected into one listener. Settings can be
+// replaced at any time and apply to data sent from then on.
+type Injector struct {
+	listener string
+	metrics  *metrics.ProxyMetrics
+	settings atomic.Pointer[Settings] // nil = no faults
+	pacers   [2]pacer                 // By direction
+}
+
+// NewInjector creates the injector of a listener, starting with the
+// faults of its chaos block if enabled
+func NewInjector(listener string, cfg *config.ChaosConfig, metricsCollector *metrics.ProxyMetrics) *Injector {
+	i := &Injector{listener: listener, metrics: metricsCollector}
+	if settings, ok := FromConfig(cfg); ok {
+		i.Set(settings)
+	} else {
+		i.Clear()
+	}
+	return i
+}
+
+// Settings returns the faults being injected, reporting false if none are
+func (i *Injector) Settings() (Settings, bool) {
+	if s := i.settings.Load(); s != nil {
+		return *s, true
+	}
+	return Settings{}, false
+}
+
+// Set starts injecting the faults in s
+func (i *Injector) Set(s Settings) {
+	if s.Distribution == "" {
+		s.Distribution = config.ChaosDistributionUniform
+	}
+	i.settings.Store(&s)
+	i.metrics.ChaosActive.WithLabelValues(i.listener).Set(1)
+}
+
+// Clear stops injecting faults
+func (i *Injector) Clear() {
+	i.settings.Store(nil)
+	i.metrics.ChaosActive.WithLabelValues(i.listener).Set(0)
+}
+
+// Hold returns how long to hold back n bytes of a stream travelling in
+// direction: the added latency plus the wait for the bandwidth bottleneck.
+// Streams are never dropped from.
+func (i *Injector) Hold(direction, n int) time.Duration {
+	if i == nil {
+		return 0
+	}
+	s := i.settings.Load()
+	if s == nil {
+		return 0
+	}
+	wait, _ := i.pacers[direction].reserve(n, s.Bandwidth, 0)
+	return s.delay() + wait
+}
+
+// Admit decides the fate of a datagram of n bytes travelling in
+// direction. It returns how long to delay the datagram, or false if it is
+// lost or the bandwidth bottleneck's queue is full.
+func (i *Injector) Admit(direction, n int) (time.Duration, bool) {
+	if i == nil {
+		return 0, true
+	}
+	s := i.settings.Load()
+	if s == nil {
+		return 0, true
+	}
+	if s.Loss > 0 && rand.Float64()*100 < s.Loss {
+		i.metrics.ChaosDrops.WithLabelValues(i.listener, "loss").Inc()
+		return 0, false
+	}
+	wait, ok := i.pacers[direction].reserve(n, s.Bandwidth, maxQueue)
+	if !ok {
+		i.metrics.ChaosDrops.WithLabelValues(i.listener, "bandwidth").Inc()
+		return 0, false
+	}
+	return s.delay() + wait, true
+}
+
+// delay draws the latency added to one chunk or datagram
+func (s *Settings) delay() time.Duration {
+	d := s.Latency
+	if s.Jitter > 0 {
+		switch s.Distribution {
+		case config.ChaosDistributionNormal:
+			d += time.Duration(rand.NormFloat64() * float64(s.Jitter))
+		default:
+			d += time.Duration((rand.Float64()*2 - 1) * float64(s.Jitter))
+		}
+	}
+	return max(d, 0)
+}
+
+// pacer spaces out data to a byte rate, like the queue in front of a slow
+// link
+type pacer struct {
+	mu   sync.Mutex
+	next time.Time // When the link is free again
+}
+
+// reserve returns how long n bytes must wait for the link at rate bytes
+// per second, and takes the link for them. With a positive limit, data
+// that would wait longer is refused and does not take the link.
+func (p *pacer) reserve(n int, rate int64, limit time.Duration) (time.Duration, bool) {
+	if rate <= 0 {
+		return 0, true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	wait := p.next.Sub(now)
+	if limit > 0 && wait > limit {
+		return 0, false
+	}
+	p.next = p.next.Add(time.Duration(math.Ceil(float64(n) / float64(rate) * float64(time.Second))))
+	return wait, true
+}
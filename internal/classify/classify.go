@@ -0,0 +1,162 @@
+// Package classify guesses the application protocol of a flow from its
+// first payload using cheap header heuristics. It is meant for traffic
+// statistics and protocol sniffing routes, not for enforcement.
+package classify
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Application protocols reported by the classifier
+const (
+	DNS     = "dns"
+	TLS     = "tls"
+	QUIC    = "quic"
+	SSH     = "ssh"
+	RTP     = "rtp"
+	HTTP    = "http"
+	Unknown = "unknown"
+)
+
+// httpMethods are request-line prefixes identifying plaintext HTTP
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("HEAD "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "),
+}
+
+// TCP classifies the first bytes seen in either direction of a TCP stream
+func TCP(payload []byte) string {
+	switch {
+	case bytes.HasPrefix(payload, []byte("SSH-")):
+		return SSH
+	case isTLSRecord(payload):
+		return TLS
+	case isHTTPRequest(payload) || bytes.HasPrefix(payload, []byte("HTTP/1.")):
+		return HTTP
+	case len(payload) >= 2 && isDNSMessage(payload[2:]) &&
+		int(binary.BigEndian.Uint16(payload)) >= 12:
+		// DNS over TCP: two-byte length prefix
+		return DNS
+	}
+	return Unknown
+}
+
+// Incomplete reports whether payload, the first bytes of a TCP stream, is
+// too short for TCP to recognise protocol but consistent with it so far
+func Incomplete(payload []byte, protocol string) bool {
+	switch protocol {
+	case SSH:
+		return len(payload) < 4 && bytes.HasPrefix([]byte("SSH-"), payload)
+	case TLS:
+		return len(payload) < 5 &&
+			(len(payload) < 1 || payload[0] == 0x16 || payload[0] == 0x15) &&
+			(len(payload) < 2 || payload[1] == 0x03) &&
+			(len(payload) < 3 || payload[2] <= 0x04)
+	case HTTP:
+		if len(payload) < 7 && bytes.HasPrefix([]byte("HTTP/1."), payload) {
+			return true
+		}
+		for _, method := range httpMethods {
+			if len(payload) < len(method) && bytes.HasPrefix(method, payload) {
+				return true
+			}
+		}
+		return false
+	case DNS:
+		return len(payload) < 14 // Length prefix and message header
+	}
+	return false
+}
+
+// MaxSSHBannerBytes is the longest SSH identification string, line end
+// included (RFC 4253, section 4.2)
+const MaxSSHBannerBytes = 255
+
+// SSHBanner returns the identification string that starts payload, the
+// first bytes an SSH client sends, without its line end, or "" if there is
+// none. Banners with other than printable ASCII are not returned.
+// incomplete reports whether payload could be the start of a banner that
+// has not fully arrived.
+func SSHBanner(payload []byte) (banner string, incomplete bool) {
+	if !bytes.HasPrefix(payload, []byte("SSH-")) {
+		return "", Incomplete(payload, SSH)
+	}
+	line := payload[:min(len(payload), MaxSSHBannerBytes)]
+	end := bytes.IndexByte(line, '\n')
+	if end < 0 {
+		return "", len(payload) < MaxSSHBannerBytes
+	}
+	line = bytes.TrimSuffix(line[:end], []byte("\r"))
+	for _, c := range line {
+		if c < 0x20 || c > 0x7e {
+			return "", false
+		}
+	}
+	return string(line), false
+}
+
+// UDP classifies the first datagram of a UDP session
+func UDP(payload []byte) string {
+	switch {
+	case isQUIC(payload):
+		return QUIC
+	case isDNSMessage(payload):
+		return DNS
+	case isRTP(payload):
+		return RTP
+	}
+	return Unknown
+}
+
+// isTLSRecord matches a TLS handshake or alert record header (SSL 3.0 - TLS 1.3)
+func isTLSRecord(p []byte) bool {
+	return len(p) >= 5 && (p[0] == 0x16 || p[0] == 0x15) && p[1] == 0x03 && p[2] <= 0x04
+}
+
+// isHTTPRequest matches an HTTP/1.x request line
+func isHTTPRequest(p []byte) bool {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(p, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDNSMessage matches a DNS query header: standard opcode, one or a few
+// questions and no answer or authority records
+func isDNSMessage(p []byte) bool {
+	if len(p) < 12 {
+		return false
+	}
+	flags := binary.BigEndian.Uint16(p[2:])
+	opcode := (flags >> 11) & 0x0f
+	qdcount := binary.BigEndian.Uint16(p[4:])
+	ancount := binary.BigEndian.Uint16(p[6:])
+	nscount := binary.BigEndian.Uint16(p[8:])
+	isQuery := flags&0x8000 == 0
+	return isQuery && opcode <= 2 && qdcount >= 1 && qdcount <= 4 && ancount == 0 && nscount == 0
+}
+
+// isQUIC matches a QUIC long header packet (v1, v2 or version negotiation)
+// padded to the minimum Initial size
+func isQUIC(p []byte) bool {
+	if len(p) < 1200 || p[0]&0xc0 != 0xc0 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(p[1:]) {
+	case 0x00000001, 0x6b3343cf, 0x00000000:
+		return true
+	}
+	return false
+}
+
+// isRTP matches an RTP version 2 header with a static or dynamic payload type
+func isRTP(p []byte) bool {
+	if len(p) < 12 || p[0]>>6 != 2 {
+		return false
+	}
+	pt := p[1] & 0x7f
+	return pt <= 34 || (pt >= 96 && pt <= 127)
+}
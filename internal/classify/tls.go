@@ -0,0 +1,221 @@
+package classify
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// MaxClientHelloBytes bounds the bytes read for a ClientHello: one TLS
+// record of the largest size
+const MaxClientHelloBytes = 5 + 16384
+
+// HelloIncomplete reports whether payload, the first bytes of a TCP
+// stream, could be the start of a TLS handshake record that has not fully
+// arrived
+func HelloIncomplete(payload []byte) bool {
+	if len(payload) < 5 {
+		return Incomplete(payload, TLS)
+	}
+	if payload[0] != 0x16 || !isTLSRecord(payload) {
+		return false
+	}
+	return len(payload) < 5+int(binary.BigEndian.Uint16(payload[3:]))
+}
+
+// clientHello returns the body of the ClientHello in the first TLS record
+// of payload. Only a ClientHello within a single record is parsed.
+func clientHello(payload []byte) ([]byte, bool) {
+	if len(payload) < 5 || payload[0] != 0x16 || !isTLSRecord(payload) {
+		return nil, false
+	}
+	record := payload[5:]
+	if n := int(binary.BigEndian.Uint16(payload[3:])); n < len(record) {
+		record = record[:n]
+	}
+
+	// Handshake header: ClientHello (1) and a 3-byte length
+	if len(record) < 4 || record[0] != 0x01 {
+		return nil, false
+	}
+	hello := record[4:]
+	if n := int(record[1])<<16 | int(record[2])<<8 | int(record[3]); n < len(hello) {
+		hello = hello[:n]
+	}
+	return hello, true
+}
+
+// ServerName returns the server name (SNI) of the ClientHello in the
+// first TLS record of payload, or "" if there is none
+func ServerName(payload []byte) string {
+	hello, ok := clientHello(payload)
+	if !ok {
+		return ""
+	}
+
+	// Version and random, then session ID, cipher suites and compression
+	// methods, each behind its length
+	r := reader(hello)
+	if !r.skip(2+32) || !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		return ""
+	}
+	extensions, ok := r.vector(2)
+	if !ok {
+		return ""
+	}
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions)
+		ext := reader(extensions[2:])
+		data, ok := ext.vector(2)
+		if !ok {
+			return ""
+		}
+		extensions = ext
+		if extType != 0 { // server_name
+			continue
+		}
+
+		// server_name_list of (type, name) entries; type 0 is a host name
+		list := reader(data)
+		names, ok := list.vector(2)
+		for ok && len(names) >= 3 {
+			nameType := names[0]
+			entry := reader(names[1:])
+			var name []byte
+			if name, ok = entry.vector(2); ok && nameType == 0 {
+				return string(name)
+			}
+			names = entry
+		}
+		return ""
+	}
+	return ""
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello in the first TLS
+// record of payload, or "" if there is none: the MD5 hash of its version,
+// cipher suites, extensions, supported groups and point formats, leaving
+// out GREASE values (RFC 8701)
+func JA3(payload []byte) string {
+	hello, ok := clientHello(payload)
+	if !ok || len(hello) < 2 {
+		return ""
+	}
+	version := binary.BigEndian.Uint16(hello)
+
+	r := reader(hello)
+	if !r.skip(2+32) || !r.skipVector(1) {
+		return ""
+	}
+	ciphers, ok := r.vector(2)
+	if !ok || !r.skipVector(1) {
+		return ""
+	}
+
+	var extensions, groups, formats []uint16
+	if len(r) > 0 {
+		list, ok := r.vector(2)
+		if !ok {
+			return ""
+		}
+		for len(list) > 0 {
+			if len(list) < 4 {
+				return ""
+			}
+			extType := binary.BigEndian.Uint16(list)
+			ext := reader(list[2:])
+			data, ok := ext.vector(2)
+			if !ok {
+				return ""
+			}
+			list = ext
+			if grease(extType) {
+				continue
+			}
+			extensions = append(extensions, extType)
+			switch extType {
+			case 10: // supported_groups
+				d := reader(data)
+				if values, ok := d.vector(2); ok {
+					groups = uint16s(values)
+				}
+			case 11: // ec_point_formats
+				d := reader(data)
+				if values, ok := d.vector(1); ok {
+					for _, v := range values {
+						formats = append(formats, uint16(v))
+					}
+				}
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(version)))
+	for _, field := range [][]uint16{uint16s(ciphers), extensions, groups, formats} {
+		b.WriteByte(',')
+		for i, v := range field {
+			if i > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteString(strconv.Itoa(int(v)))
+		}
+	}
+	sum := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// uint16s returns the big-endian values of a TLS list, leaving out GREASE
+// values
+func uint16s(data []byte) []uint16 {
+	values := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if v := binary.BigEndian.Uint16(data[i:]); !grease(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// grease reports whether v is one of the values clients send to keep
+// servers tolerant of unknown ones (0x0a0a, 0x1a1a, ... 0xfafa)
+func grease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// reader consumes the length-prefixed fields of a TLS handshake message
+type reader []byte
+
+// skip drops n bytes, reporting false if there are fewer
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+// vector returns the next field with a big-endian length of size bytes
+func (r *reader) vector(size int) ([]byte, bool) {
+	if len(*r) < size {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*r)[:size] {
+		n = n<<8 | int(b)
+	}
+	if len(*r) < size+n {
+		return nil, false
+	}
+	field := (*r)[size : size+n]
+	*r = (*r)[size+n:]
+	return field, true
+}
+
+// skipVector drops the next field with a length of size bytes
+func (r *reader) skipVector(size int) bool {
+	_, ok := r.vector(size)
+	return ok
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// perListenerKeys may not have a default, since no two listeners share them
+var perListenerKeys = []string{"name", "listen_address"}
+
+// templates are the top-level sections listeners build on: the defaults
+// section and the named rate limit profiles
+type templates struct {
+	defaults   *yaml.Node
+	rateLimits map[string]*yaml.Node
+}
+
+// loadTemplates returns copies of the defaults section and rate limit
+// profiles of a parsed document
+func loadTemplates(root *yaml.Node) (*templates, error) {
+	t := &templates{}
+	if root.Kind == 0 {
+		return t, nil
+	}
+	doc := root.Content[0]
+
+	var err error
+	if t.rateLimits, err = loadRateLimitProfiles(doc); err != nil {
+		return nil, err
+	}
+
+	section := mappingValue(doc, "defaults")
+	if section == nil || section.Tag == "!!null" {
+		return t, nil
+	}
+	defaults := copyNode(section)
+	if defaults.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: defaults must be a mapping of listener settings", section.Line)
+	}
+	inlineMerges(defaults)
+	for _, key := range perListenerKeys {
+		if value := mappingValue(defaults, key); value != nil {
+			return nil, fmt.Errorf("line %d: defaults: %s must be set on each listener", value.Line, key)
+		}
+	}
+	if err := t.applyRateLimitProfile(defaults); err != nil {
+		return nil, fmt.Errorf("defaults: %w", err)
+	}
+	t.defaults = defaults
+	return t, nil
+}
+
+// apply resolves the rate limit profile of every listener in a parsed
+// document, then fills in the settings the listener does not set itself
+// from the defaults. A listener's own settings win over its profile, and
+// its profile over the defaults.
+func (t *templates) apply(root *yaml.Node) error {
+	if root.Kind == 0 {
+		return nil
+	}
+	listeners := mappingValue(root.Content[0], "listeners")
+	if listeners == nil || listeners.Kind != yaml.SequenceNode {
+		return nil
+	}
+	for i, listener := range listeners.Content {
+		if listener.Kind == yaml.AliasNode {
+			listener = copyNode(listener)
+			listeners.Content[i] = listener
+		}
+		if listener.Kind != yaml.MappingNode {
+			continue
+		}
+		inlineMerges(listener)
+		if err := t.applyRateLimitProfile(listener); err != nil {
+			if name := mappingValue(listener, "name"); name != nil {
+				return fmt.Errorf("listener %s: %w", name.Value, err)
+			}
+			return err
+		}
+		if t.defaults == nil {
+			continue
+		}
+
+		// tcp and udp defaults only apply to listeners of that protocol
+		protocol := mappingValue(listener, "protocol")
+		if protocol == nil {
+			protocol = mappingValue(t.defaults, "protocol")
+		}
+		skip := map[string]bool{"tcp": true, "udp": true}
+		if protocol != nil {
+			delete(skip, strings.ToLower(protocol.Value))
+		}
+		mergeDefaults(listener, t.defaults, skip)
+	}
+	return nil
+}
+
+// mergeDefaults adds the settings of defaults that dst does not set.
+// Mappings are merged key by key; any other value set in dst, including
+// an explicit null, replaces the default whole. Top-level keys in skip
+// are left out.
+func mergeDefaults(dst, defaults *yaml.Node, skip map[string]bool) {
+	for i := 0; i+1 < len(defaults.Content); i += 2 {
+		key, value := defaults.Content[i], defaults.Content[i+1]
+		if skip[key.Value] {
+			continue
+		}
+		j := mappingIndex(dst, key.Value)
+		if j < 0 {
+			dst.Content = append(dst.Content, copyNode(key), copyNode(value))
+			continue
+		}
+		existing := dst.Content[j+1]
+		if existing.Kind == yaml.AliasNode {
+			existing = copyNode(existing)
+			dst.Content[j+1] = existing
+		}
+		if existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			inlineMerges(existing)
+			mergeDefaults(existing, value, nil)
+		}
+	}
+}
+
+// inlineMerges replaces the YAML merge key (<<) of a mapping with the
+// keys it merges in, so they count as set by the mapping itself. Keys of
+// the mapping win over merged ones, and earlier merged mappings over later
+// ones, as when decoding.
+func inlineMerges(node *yaml.Node) {
+	j := mappingIndex(node, "<<")
+	if j < 0 {
+		return
+	}
+	merged := copyNode(node.Content[j+1])
+	node.Content = append(node.Content[:j], node.Content[j+2:]...)
+
+	sources := []*yaml.Node{merged}
+	if merged.Kind == yaml.SequenceNode {
+		sources = merged.Content
+	}
+	for _, source := range sources {
+		if source.Kind != yaml.MappingNode {
+			continue
+		}
+		inlineMerges(source)
+		for i := 0; i+1 < len(source.Content); i += 2 {
+			if mappingIndex(node, source.Content[i].Value) < 0 {
+				node.Content = append(node.Content, source.Content[i], source.Content[i+1])
+			}
+		}
+	}
+}
+
+// mappingIndex returns the index of key in the content of a mapping, or
+// -1 if it is not set
+func mappingIndex(node *yaml.Node, key string) int {
+	if node.Kind != yaml.MappingNode {
+		return -1
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// mappingValue returns the value of key in a mapping, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if i := mappingIndex(node, key); i >= 0 {
+		return node.Content[i+1]
+	}
+	return nil
+}
+
+// copyNode returns a deep copy of a node with aliases resolved, so the
+// copy can be changed without touching anchors or other listeners
+func copyNode(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		return copyNode(node.Alias)
+	}
+	copied := *node
+	copied.Anchor = ""
+	copied.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		copied.Content[i] = copyNode(child)
+	}
+	return &copied
+}
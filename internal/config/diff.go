@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redactedKeys are YAML keys whose values are never shown in a diff
+var redactedKeys = map[string]bool{
+	"password": true,
+}
+
+// redacted replaces the values of redactedKeys in a diff
+const redacted = "[redacted]"
+
+// FieldChange is a setting whose effective value differs between two
+// configurations. Old or New is nil when the setting is only present in
+// one of them.
+type FieldChange struct {
+	Field string      `json:"field"` // Dotted YAML path, e.g. rate_limits.action or targets[1].weight
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// ListenerChange lists the changed settings of a listener present in both
+// configurations
+type ListenerChange struct {
+	Name   string        `json:"name"`
+	Fields []FieldChange `json:"fields"`
+}
+
+// Diff is the difference between two configurations. Listeners are matched
+// by name.
+type Diff struct {
+	Added   []string         `json:"added"`
+	Removed []string         `json:"removed"`
+	Changed []ListenerChange `json:"changed"`
+	Global  []FieldChange    `json:"global"` // Settings outside listeners
+}
+
+// Empty reports whether the configurations are equivalent
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Global) == 0
+}
+
+// DiffConfigs compares the effective configurations of old and new, so a
+// setting changed from its default to the same explicit value is not
+// reported
+func DiffConfigs(old, new *Config) (*Diff, error) {
+	oldEff, newEff := old.Effective(), new.Effective()
+	diff := &Diff{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []ListenerChange{},
+	}
+
+	oldListeners := make(map[string]ListenerConfig, len(oldEff.Listeners))
+	for _, l := range oldEff.Listeners {
+		oldListeners[l.Name] = l
+	}
+	newNames := make(map[string]bool, len(newEff.Listeners))
+	for _, l := range newEff.Listeners {
+		newNames[l.Name] = true
+		before, exists := oldListeners[l.Name]
+		if !exists {
+			diff.Added = append(diff.Added, l.Name)
+			continue
+		}
+		fields, err := diffValues(before, l)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", l.Name, err)
+		}
+		if len(fields) > 0 {
+			diff.Changed = append(diff.Changed, ListenerChange{Name: l.Name, Fields: fields})
+		}
+	}
+	for _, l := range oldEff.Listeners {
+		if !newNames[l.Name] {
+			diff.Removed = append(diff.Removed, l.Name)
+		}
+	}
+
+	oldEff.Listeners, newEff.Listeners = nil, nil
+	global, err := diffValues(oldEff, newEff)
+	if err != nil {
+		return nil, err
+	}
+	diff.Global = global
+	return diff, nil
+}
+
+// diffValues compares two values field by field through their YAML form
+func diffValues(old, new interface{}) ([]FieldChange, error) {
+	before, err := flatten(old)
+	if err != nil {
+		return nil, err
+	}
+	after, err := flatten(new)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, 0, len(before)+len(after))
+	for field := range before {
+		fields = append(fields, field)
+	}
+	for field := range after {
+		if _, exists := before[field]; !exists {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []FieldChange{}
+	for _, field := range fields {
+		if !reflect.DeepEqual(before[field], after[field]) {
+			changes = append(changes, FieldChange{
+				Field: field,
+				Old:   redact(field, before[field]),
+				New:   redact(field, after[field]),
+			})
+		}
+	}
+	return changes, nil
+}
+
+// redact hides the value of a secret field and the password of a
+// target_proxy URL
+func redact(field string, value interface{}) interface{} {
+	key := field[strings.LastIndex(field, ".")+1:]
+	if redactedKeys[key] && value != nil && value != "" {
+		return redacted
+	}
+	if raw, ok := value.(string); ok && key == "target_proxy" {
+		if u, err := url.Parse(raw); err == nil {
+			return u.Redacted()
+		}
+	}
+	return value
+}
+
+// flatten maps the dotted YAML paths of v to their values. Lists of
+// mappings are indexed; lists of scalars are kept whole.
+func flatten(v interface{}) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	flat := make(map[string]interface{})
+	var walk func(prefix string, node interface{})
+	walk = func(prefix string, node interface{}) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			for key, value := range n {
+				path := key
+				if prefix != "" {
+					path = prefix + "." + key
+				}
+				walk(path, value)
+			}
+		case []interface{}:
+			for i, item := range n {
+				if _, isMap := item.(map[string]interface{}); !isMap {
+					flat[prefix] = n
+					return
+				}
+				walk(prefix+"["+strconv.Itoa(i)+"]", item)
+			}
+		default:
+			flat[prefix] = n
+		}
+	}
+	walk("", tree)
+	return flat, nil
+}
@@ -0,0 +1,337 @@
+package config
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sizeKeys are YAML keys holding byte sizes; Dump annotates them with the
+// parsed value
+var sizeKeys = map[string]bool{
+	"max_bandwidth_per_ip":     true,
+	"throttle_minimum":         true,
+	"max_bytes_per_connection": true,
+	"periodic_log_bytes":       true,
+	"max_size":                 true,
+	"min_log_bytes":            true,
+	"daily":                    true,
+	"monthly":                  true,
+	"throttle_rate":            true,
+}
+
+// Dump writes the effective configuration as YAML: defaults are filled in
+// and byte sizes are annotated with their parsed values
+func (c *Config) Dump(w io.Writer) error {
+	var doc yaml.Node
+	if err := doc.Encode(c.Effective()); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	annotateSizes(&doc)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return enc.Close()
+}
+
+// Effective returns a copy of the configuration with the defaults applied at
+// runtime filled in. The receiver is not modified.
+func (c *Config) Effective() *Config {
+	eff := *c
+	eff.Server.ShutdownTimeout = c.Server.GetShutdownTimeout()
+	eff.Logging.Level = c.Logging.GetLevel()
+	eff.Logging.QueueSize = c.Logging.GetQueueSize()
+
+	if eff.Logging.Syslog.Enabled {
+		required := eff.Logging.Syslog.IsRequired()
+		eff.Logging.Syslog.Required = &required
+		if eff.Logging.Syslog.OnDisconnect == "" {
+			eff.Logging.Syslog.OnDisconnect = "buffer"
+		}
+		if eff.Logging.Syslog.BufferSize <= 0 {
+			eff.Logging.Syslog.BufferSize = DefaultSyslogBufferSize
+		}
+		eff.Logging.Syslog.Format = c.Logging.Syslog.GetFormat()
+	}
+	if eff.Logging.JSONLog.Enabled {
+		required := eff.Logging.JSONLog.IsRequired()
+		eff.Logging.JSONLog.Required = &required
+	}
+	if eff.Logging.Stream.Enabled {
+		required := eff.Logging.Stream.IsRequired()
+		eff.Logging.Stream.Required = &required
+		eff.Logging.Stream.BatchSize = c.Logging.Stream.GetBatchSize()
+		eff.Logging.Stream.QueueSize = c.Logging.Stream.GetQueueSize()
+		eff.Logging.Stream.FlushInterval = c.Logging.Stream.GetFlushInterval()
+		eff.Logging.Stream.Timeout = c.Logging.Stream.GetTimeout()
+	}
+	if eff.Logging.Webhook.Enabled {
+		eff.Logging.Webhook.BatchSize = c.Logging.Webhook.GetBatchSize()
+		eff.Logging.Webhook.QueueSize = c.Logging.Webhook.GetQueueSize()
+		eff.Logging.Webhook.FlushInterval = c.Logging.Webhook.GetFlushInterval()
+		eff.Logging.Webhook.Timeout = c.Logging.Webhook.GetTimeout()
+	}
+	if eff.Logging.DenyAggregation.Enabled {
+		eff.Logging.DenyAggregation.Interval = c.Logging.DenyAggregation.GetInterval()
+		eff.Logging.DenyAggregation.Burst = c.Logging.DenyAggregation.GetBurst()
+		eff.Logging.DenyAggregation.MaxClients = c.Logging.DenyAggregation.GetMaxClients()
+		eff.Logging.DenyAggregation.Events = c.Logging.DenyAggregation.GetEvents()
+	}
+
+	if eff.Metrics.Prometheus.ClientMetrics.Enabled {
+		eff.Metrics.Prometheus.ClientMetrics.MaxClients = c.Metrics.Prometheus.ClientMetrics.GetMaxClients()
+	}
+
+	if eff.Admin.Enabled {
+		eff.Admin.MaxExemptionTTL = c.Admin.GetMaxExemptionTTL()
+		if eff.Admin.CaptureDir != "" {
+			eff.Admin.MaxCaptureDuration = c.Admin.GetMaxCaptureDuration()
+			if eff.Admin.MaxCaptureSize == "" {
+				eff.Admin.MaxCaptureSize = "100MB"
+			}
+		}
+	}
+
+	if eff.Storage.Backend == "" {
+		eff.Storage.Backend = "memory"
+	}
+
+	eff.Emergency.BandwidthFactor = c.Emergency.GetBandwidthFactor()
+
+	eff.DNS.Timeout = c.DNS.GetTimeout()
+	eff.DNS.CacheTTL = c.DNS.GetCacheTTL()
+	eff.DNS.NegativeTTL = c.DNS.GetNegativeTTL()
+
+	if eff.Tracing.Enabled {
+		eff.Tracing.ServiceName = c.Tracing.GetServiceName()
+		eff.Tracing.BatchSize = c.Tracing.GetBatchSize()
+		eff.Tracing.QueueSize = c.Tracing.GetQueueSize()
+		eff.Tracing.FlushInterval = c.Tracing.GetFlushInterval()
+		eff.Tracing.Timeout = c.Tracing.GetTimeout()
+	}
+
+	if eff.Accounting.Enabled {
+		eff.Accounting.FlushInterval = c.Accounting.GetFlushInterval()
+		eff.Accounting.TenantTag = c.Accounting.GetTenantTag()
+	}
+
+	// Included listeners are already merged in, and profiles expanded
+	eff.Include = nil
+	eff.ACLProfiles = nil
+	eff.RateLimitProfiles = nil
+
+	eff.Listeners = make([]ListenerConfig, len(c.Listeners))
+	for i, l := range c.Listeners {
+		eff.Listeners[i] = l.effective()
+	}
+	return &eff
+}
+
+// effective returns a copy of the listener with runtime defaults filled in
+func (l ListenerConfig) effective() ListenerConfig {
+	if l.RateLimits.Action == "" {
+		l.RateLimits.Action = "drop"
+	}
+	if l.RateLimits.RateLimitKey == "" {
+		l.RateLimits.RateLimitKey = "ip"
+	}
+	l.SampleRate = l.GetSampleRate()
+	l.Enforcement = l.GetEnforcement()
+	l.TargetDialTimeout = l.GetTargetDialTimeout()
+	if len(l.Targets) > 0 {
+		l.Balance = l.GetBalance()
+		l.Targets = append([]TargetEntry(nil), l.Targets...)
+		for i := range l.Targets {
+			l.Targets[i].Weight = l.Targets[i].GetWeight()
+		}
+	}
+	if l.HasCircuitBreaker() {
+		var breaker CircuitBreakerConfig
+		if l.CircuitBreaker != nil {
+			breaker = *l.CircuitBreaker
+		}
+		breaker.Enabled = true
+		breaker.FailureThreshold = breaker.GetFailureThreshold()
+		breaker.Cooldown = breaker.GetCooldown()
+		l.CircuitBreaker = &breaker
+	}
+	if l.Quota != nil && l.Quota.Enabled {
+		quota := *l.Quota
+		quota.Action = quota.GetAction()
+		l.Quota = &quota
+	}
+	if l.Greylist != nil && l.Greylist.Enabled {
+		greylist := *l.Greylist
+		greylist.Action = greylist.GetAction()
+		greylist.Delay = greylist.GetDelay()
+		greylist.RetryWindow = greylist.GetRetryWindow()
+		greylist.Remember = greylist.GetRemember()
+		greylist.MaxPending = greylist.GetMaxPending()
+		l.Greylist = &greylist
+	}
+	if l.Failover != nil && l.Failover.Enabled {
+		failover := *l.Failover
+		failover.MaxAttempts = failover.GetMaxAttempts(len(l.Targets))
+		l.Failover = &failover
+	}
+
+	switch l.Protocol {
+	case "tcp":
+		tcp := TCPConfig{}
+		if l.TCP != nil {
+			tcp = *l.TCP
+		}
+		tcp.BufferSize = tcp.GetBufferSize()
+		noDelay := tcp.GetNoDelay()
+		tcp.NoDelay = &noDelay
+		if tcp.MaxConcurrentConnections > 0 && tcp.ConcurrencyQueue > 0 {
+			tcp.ConcurrencyQueueTimeout = tcp.GetConcurrencyQueueTimeout()
+		}
+		if tcp.DenyResponse != nil {
+			deny := *tcp.DenyResponse
+			deny.Action = deny.GetAction()
+			if deny.Action == DenyActionTarpit {
+				deny.TarpitDuration = deny.GetTarpitDuration()
+				deny.TarpitInterval = deny.GetTarpitInterval()
+				deny.MaxTarpitted = deny.GetMaxTarpitted()
+			}
+			tcp.DenyResponse = &deny
+		}
+		l.TCP = &tcp
+	case "udp":
+		udp := UDPConfig{}
+		if l.UDP != nil {
+			udp = *l.UDP
+		}
+		if udp.SessionTimeout <= 0 {
+			udp.SessionTimeout = DefaultUDPSessionTimeout
+		}
+		if udp.BufferSize <= 0 {
+			udp.BufferSize = DefaultUDPBufferSize
+		}
+		if udp.Logging == nil {
+			udp.Logging = defaultUDPLogging()
+		}
+		udp.SessionKey = udp.GetSessionKey()
+		if udp.DialRetries > 0 {
+			udp.DialRetryBackoff = udp.GetDialRetryBackoff()
+		}
+		if udp.DialFailureBackoff >= 0 {
+			udp.DialFailureBackoff = udp.GetDialFailureBackoff()
+			udp.DialFailureBackoffMax = udp.GetDialFailureBackoffMax()
+		}
+		if udp.MaxReplySize > 0 {
+			udp.OversizeReply = udp.GetOversizeReply()
+		}
+		udp.BatchSize = udp.GetBatchSize()
+		if udp.AFXDP != nil {
+			afxdp := *udp.AFXDP
+			afxdp.Frames = afxdp.GetFrames()
+			afxdp.SendBatch = afxdp.GetSendBatch()
+			udp.AFXDP = &afxdp
+		}
+		if udp.DenyResponse != nil {
+			deny := *udp.DenyResponse
+			deny.Action = deny.GetAction()
+			if deny.Action != UDPDenyActionDrop {
+				deny.MaxPerSecond = deny.GetMaxPerSecond()
+			}
+			udp.DenyResponse = &deny
+		}
+		l.UDP = &udp
+	}
+
+	if l.HTTP != nil {
+		http := *l.HTTP
+		http.FlowIDHeader = l.HTTP.GetFlowIDHeader()
+		if http.RateLimitHeaders == "" {
+			http.RateLimitHeaders = "off"
+		}
+		l.HTTP = &http
+	}
+
+	if len(l.PacketRules) > 0 {
+		rules := make([]PacketRule, len(l.PacketRules))
+		for i, rule := range l.PacketRules {
+			rule.Action = rule.GetAction()
+			rules[i] = rule
+		}
+		l.PacketRules = rules
+	}
+
+	if len(l.Signatures) > 0 {
+		signatures := make([]Signature, len(l.Signatures))
+		for i, sig := range l.Signatures {
+			sig.Action = sig.GetAction()
+			signatures[i] = sig
+		}
+		l.Signatures = signatures
+	}
+
+	if l.Chaos != nil {
+		chaos := *l.Chaos
+		chaos.Distribution = chaos.GetDistribution()
+		l.Chaos = &chaos
+	}
+
+	if l.SIP != nil {
+		sip := *l.SIP
+		sip.MediaTimeout = sip.GetMediaTimeout()
+		l.SIP = &sip
+	}
+
+	if l.Sniff != nil {
+		sniff := *l.Sniff
+		sniff.Timeout = sniff.GetTimeout()
+		l.Sniff = &sniff
+	}
+
+	if l.PreHook != nil {
+		hook := *l.PreHook
+		if hook.Timeout <= 0 {
+			hook.Timeout = DefaultPreHookTimeout
+		}
+		if hook.OnError == "" {
+			hook.OnError = "deny"
+		}
+		l.PreHook = &hook
+	}
+
+	if l.Script != nil {
+		script := *l.Script
+		script.Timeout = script.GetTimeout()
+		if script.OnError == "" {
+			script.OnError = "deny"
+		}
+		l.Script = &script
+	}
+
+	if l.XDP != nil {
+		xdp := *l.XDP
+		xdp.Mode = xdp.GetMode()
+		l.XDP = &xdp
+	}
+
+	return l
+}
+
+// annotateSizes adds the parsed byte count as a comment to size values
+func annotateSizes(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if sizeKeys[key.Value] && value.Kind == yaml.ScalarNode && value.Value != "" {
+				if n, err := ParseBandwidth(value.Value); err == nil {
+					value.LineComment = fmt.Sprintf("%d bytes", n)
+				}
+			}
+		}
+	}
+	for _, child := range node.Content {
+		annotateSizes(child)
+	}
+}
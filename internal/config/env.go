@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envRefRegexp matches $${...} (escaped), ${VAR} and ${VAR:-default}
+var envRefRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandEnv substitutes environment variables in all scalar values of a
+// parsed YAML document. ${VAR} must be set; ${VAR:-default} falls back to
+// default when VAR is unset or empty; $${ produces a literal ${.
+func expandEnv(node *yaml.Node) error {
+	missing := make(map[string]bool)
+	expandNode(node, missing)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unset environment variables: %s", strings.Join(names, ", "))
+}
+
+// expandNode expands references in node and its children, recording
+// required variables that are unset
+func expandNode(node *yaml.Node, missing map[string]bool) {
+	if node.Kind == yaml.ScalarNode && strings.Contains(node.Value, "${") {
+		node.Value = envRefRegexp.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			if ref == "$${" {
+				return "${"
+			}
+			m := envRefRegexp.FindStringSubmatch(ref)
+			name, def := m[1], m[2]
+			if value := os.Getenv(name); value != "" {
+				return value
+			}
+			if strings.Contains(ref, ":-") {
+				return def
+			}
+			if _, set := os.LookupEnv(name); !set {
+				missing[name] = true
+			}
+			return ""
+		})
+
+		// Let unquoted values resolve to their natural type, so
+		// "max_sessions: ${MAX}" decodes as an integer
+		if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			node.Tag = ""
+		}
+	}
+
+	for _, child := range node.Content {
+		expandNode(child, missing)
+	}
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// IncludeList holds include patterns. It accepts a single pattern or a list.
+type IncludeList []string
+
+// UnmarshalYAML accepts both "include: pattern" and "include: [a, b]"
+func (l *IncludeList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = IncludeList{node.Value}
+		return nil
+	}
+	var patterns []string
+	if err := node.Decode(&patterns); err != nil {
+		return err
+	}
+	*l = patterns
+	return nil
+}
+
+// fragment is the content of an included file. Fragments may only define
+// listeners; server-wide settings stay in the main file.
+type fragment struct {
+	Listeners []ListenerConfig `yaml:"listeners"`
+}
+
+// loadIncludes appends the listeners of all files matching the include
+// patterns. Relative patterns are resolved against baseDir. Files are merged
+// in lexical order so the result does not depend on directory listing order.
+// A pattern matching no files is not an error, so an empty conf.d is valid.
+// Listeners use the profiles and defaults of the main file.
+func (c *Config) loadIncludes(baseDir string, t *templates) error {
+	seen := make(map[string]bool)
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("include %s: %w", pattern, err)
+		}
+		sort.Strings(matches)
+
+		for _, path := range matches {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+
+			listeners, err := loadFragment(path, t)
+			if err != nil {
+				return fmt.Errorf("include %s: %w", path, err)
+			}
+			c.Listeners = append(c.Listeners, listeners...)
+		}
+	}
+	return nil
+}
+
+// loadFragment parses a fragment file, expanding environment variables and
+// applying profiles and defaults like the main file
+func loadFragment(path string, t *templates) ([]ListenerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if root.Kind == 0 {
+		return nil, nil
+	}
+	if err := expandEnv(&root); err != nil {
+		return nil, err
+	}
+
+	// Reject anything but listeners, so a misplaced server or logging
+	// section is not silently ignored
+	if doc := root.Content[0]; doc.Kind == yaml.MappingNode {
+		for i := 0; i < len(doc.Content); i += 2 {
+			if key := doc.Content[i].Value; key != "listeners" {
+				return nil, fmt.Errorf("line %d: only listeners may be defined in an included file, found %q", doc.Content[i].Line, key)
+			}
+		}
+	}
+
+	if err := t.apply(&root); err != nil {
+		return nil, err
+	}
+
+	var frag fragment
+	if err := root.Decode(&frag); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	for i := range frag.Listeners {
+		frag.Listeners[i].source = path
+	}
+	return frag.Listeners, nil
+}
+
+// origin describes where a listener was defined, for error messages
+func (l *ListenerConfig) origin() string {
+	if l.source == "" {
+		return ""
+	}
+	return " in " + l.source
+}
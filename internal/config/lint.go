@@ -0,0 +1,406 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// largeUDPBuffer is the buffer size above which a per-session memory warning is raised
+const largeUDPBuffer = 16 * 1024
+
+// largeUDPBatchBuffers is the memory for batched reads above which a
+// per-session memory warning is raised
+const largeUDPBatchBuffers = 256 * 1024
+
+// slowUDPScript is the script timeout above which a udp listener is warned
+// that a slow on_connect stalls its traffic
+const slowUDPScript = DefaultScriptTimeout
+
+// Warning is a non-fatal best-practice finding in a valid configuration
+type Warning struct {
+	Listener string // empty for global findings
+	Message  string
+}
+
+// String formats the warning for display
+func (w Warning) String() string {
+	if w.Listener == "" {
+		return w.Message
+	}
+	return fmt.Sprintf("listener %s: %s", w.Listener, w.Message)
+}
+
+// Lint returns best-practice warnings for a configuration that has already
+// passed Validate. Warnings never prevent startup.
+func (c *Config) Lint() []Warning {
+	var warnings []Warning
+	if c.Accounting.Enabled && (c.Storage.Backend == "" || c.Storage.Backend == "memory") {
+		warnings = append(warnings, Warning{Message: "accounting is enabled with the memory storage backend; totals are lost on restart"})
+	}
+	for _, l := range c.Listeners {
+		if l.UDP != nil && l.UDP.PersistSessions && (c.Storage.Backend == "" || c.Storage.Backend == "memory") {
+			warnings = append(warnings, Warning{Listener: l.Name, Message: "udp persist_sessions is set with the memory storage backend; sessions are lost on restart"})
+		}
+		if l.Quota != nil && l.Quota.Enabled && (c.Storage.Backend == "" || c.Storage.Backend == "memory") {
+			warnings = append(warnings, Warning{Listener: l.Name, Message: "quota is enabled with the memory storage backend; usage is lost on restart"})
+		}
+		if l.Greylist != nil && l.Greylist.Enabled && (c.Storage.Backend == "" || c.Storage.Backend == "memory") {
+			warnings = append(warnings, Warning{Listener: l.Name, Message: "greylist is enabled with the memory storage backend; every client is new again after a restart"})
+		}
+	}
+	if j := c.Logging.JSONLog; j.Enabled && (j.Compress || j.MaxBackups > 0) && !j.Rotates() {
+		warnings = append(warnings, Warning{Message: "jsonlog compress and max_backups only apply to rotation by max_size or max_age"})
+	}
+	if w := c.Logging.Webhook; w.Enabled && w.Secret == "" && strings.HasPrefix(w.URL, "http://") {
+		warnings = append(warnings, Warning{Message: "webhook posts to a plain http url without a secret; the receiver cannot verify events"})
+	}
+	if c.Logging.Level == "debug" {
+		warnings = append(warnings, Warning{Message: "logging level is debug; per-packet diagnostics can flood the logs, prefer log_level on a single listener"})
+	}
+	if cm := c.Metrics.Prometheus.ClientMetrics; cm.Enabled && len(cm.Clients) == 0 {
+		warnings = append(warnings, Warning{Message: fmt.Sprintf("client_metrics has no clients; any %d client IPs get series and busy clients evict each other", cm.GetMaxClients())})
+	}
+	if p := c.Metrics.Prometheus; p.Enabled && p.BasicAuth.Enabled() && !p.TLS.Enabled() {
+		warnings = append(warnings, Warning{Message: "metrics basic_auth is set without tls; credentials are sent in cleartext"})
+	}
+	if p := c.Metrics.Prometheus; p.Enabled {
+		for _, addr := range p.Addresses() {
+			path, ok := strings.CutPrefix(addr, UnixAddressPrefix)
+			if !ok {
+				continue
+			}
+			if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+				warnings = append(warnings, Warning{Message: fmt.Sprintf("metrics unix socket directory %s does not exist; binding %s will fail", filepath.Dir(path), path)})
+			}
+		}
+	}
+	if c.Server.RunAsUser != "" {
+		warnings = append(warnings, c.lintRunAs()...)
+	}
+	for i := range c.Listeners {
+		warnings = append(warnings, c.Listeners[i].Lint()...)
+	}
+	return warnings
+}
+
+// lintRunAs warns about settings that stop working once privileges are
+// dropped to server.run_as_user
+func (c *Config) lintRunAs() []Warning {
+	var warnings []Warning
+	if _, err := LookupUser(c.Server.RunAsUser); err != nil {
+		warnings = append(warnings, Warning{Message: fmt.Sprintf("server.run_as_user: %v; startup will fail", err)})
+	}
+	if c.Server.RunAsGroup != "" {
+		if _, err := LookupGroup(c.Server.RunAsGroup); err != nil {
+			warnings = append(warnings, Warning{Message: fmt.Sprintf("server.run_as_group: %v; startup will fail", err)})
+		}
+	}
+	if c.Server.PartialStart {
+		for _, l := range c.Listeners {
+			if _, port, err := net.SplitHostPort(l.ListenAddress); err == nil {
+				if n, _ := strconv.Atoi(port); n > 0 && n < 1024 {
+					warnings = append(warnings, Warning{Listener: l.Name, Message: fmt.Sprintf("partial_start retries binding port %d after privileges are dropped to %s, which fails for ports below 1024", n, c.Server.RunAsUser)})
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// Lint returns best-practice warnings for a single listener
+func (l *ListenerConfig) Lint() []Warning {
+	var warnings []Warning
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, Warning{Listener: l.Name, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(l.Allowlist) == 0 && len(l.ScheduledAllowlist) == 0 {
+		warn("allowlist is empty, all connections will be denied")
+	}
+
+	if isWildcardBind(l.ListenAddress) && !l.RateLimits.hasLimits() {
+		warn("listens on all interfaces (%s) without any rate limits", l.ListenAddress)
+	}
+
+	if l.UDP != nil && l.UDP.Oversize != "" && l.UDP.MTU == 0 && runtime.GOOS != "linux" {
+		warn("udp oversize needs udp mtu on %s; path MTU detection is only available on Linux", runtime.GOOS)
+	}
+
+	if l.UDP.GetSessionKey() == SessionKeyIPDSCP && runtime.GOOS != "linux" {
+		warn("udp session_key %s reads DSCP only on Linux; on %s it behaves like %s", SessionKeyIPDSCP, runtime.GOOS, SessionKeyIP)
+	}
+
+	if l.TCP != nil && l.TCP.AcceptPauseThreshold > 0 && l.TCP.MaxPendingAccepts >= l.TCP.AcceptPauseThreshold {
+		warn("tcp max_pending_accepts %d is never reached; accept pauses at accept_pause_threshold %d first", l.TCP.MaxPendingAccepts, l.TCP.AcceptPauseThreshold)
+	}
+
+	if l.TCP != nil && l.TCP.MaxPendingAccepts > 0 && l.TCP.ConcurrencyQueue >= l.TCP.MaxPendingAccepts {
+		warn("tcp concurrency_queue %d never fills; queued connections count toward max_pending_accepts %d", l.TCP.ConcurrencyQueue, l.TCP.MaxPendingAccepts)
+	}
+
+	if l.TCP != nil && l.TCP.DenyResponse.GetAction() == DenyActionTarpit && l.TCP.AcceptPauseThreshold > 0 && l.TCP.DenyResponse.GetMaxTarpitted() >= l.TCP.AcceptPauseThreshold {
+		warn("tcp deny_response max_tarpitted %d can pause accepting; tarpitted connections count toward accept_pause_threshold %d", l.TCP.DenyResponse.GetMaxTarpitted(), l.TCP.AcceptPauseThreshold)
+	}
+
+	if l.TCP != nil && l.TCP.UserTimeout > 0 && runtime.GOOS != "linux" {
+		warn("tcp user_timeout is only supported on Linux; it is ignored on %s", runtime.GOOS)
+	}
+
+	if l.Socket != nil {
+		for _, buffer := range []struct {
+			name, sysctl string
+			size         int
+		}{
+			{"receive_buffer", "net.core.rmem_max", l.Socket.GetReceiveBuffer()},
+			{"send_buffer", "net.core.wmem_max", l.Socket.GetSendBuffer()},
+		} {
+			if limit, ok := sysctlInt(buffer.sysctl); ok && int64(buffer.size) > limit {
+				warn("socket %s %d exceeds %s (%d bytes); the kernel caps it", buffer.name, buffer.size, buffer.sysctl, limit)
+			}
+		}
+	}
+
+	if l.HasXDP() {
+		if _, err := net.InterfaceByName(l.XDP.Interface); err != nil {
+			warn("xdp interface %s does not exist on this host; denied clients will be dropped in userspace only", l.XDP.Interface)
+		}
+	}
+
+	if l.Protocol == "udp" && l.UDP.HasAFXDP() {
+		if _, err := net.InterfaceByName(l.UDP.AFXDP.Interface); err != nil {
+			warn("udp af_xdp interface %s does not exist on this host; datagrams will be read from the socket only", l.UDP.AFXDP.Interface)
+		}
+	}
+
+	if ip := l.BindSourceIP(); ip != nil && !ip.IsUnspecified() && !slices.ContainsFunc(LocalIPs(), ip.Equal) {
+		warn("bind_source_address %s is not an address of this host; connecting to targets will fail", l.BindSourceAddress)
+	}
+
+	if l.UDP != nil && l.UDP.BufferSize > largeUDPBuffer {
+		warn("udp buffer_size %d is large; each session allocates a buffer of this size", l.UDP.BufferSize)
+	}
+	if l.UDP != nil && l.UDP.BatchSize > 1 {
+		bufferSize := l.UDP.GetReadBufferSize()
+		if l.UDP.BatchSize*bufferSize > largeUDPBatchBuffers {
+			warn("udp batch_size %d with read buffers of %d bytes allocates %d KiB per session", l.UDP.BatchSize, bufferSize, l.UDP.BatchSize*bufferSize/1024)
+		}
+	}
+
+	for _, msg := range shadowedEntries(l.Allowlist) {
+		warn("allowlist: %s", msg)
+	}
+
+	allowNets := parseNets(l.Allowlist)
+	for i, entry := range l.ScheduledAllowlist {
+		for j, n := range parseNets(entry.Match) {
+			if n != nil && slices.ContainsFunc(allowNets, func(a *net.IPNet) bool { return a != nil && netContains(a, n) }) {
+				warn("scheduled_allowlist[%d]: %s is always allowed by the allowlist, so schedule %s does not restrict it", i, entry.Match[j], entry.Schedule)
+			}
+		}
+	}
+
+	mapMatches := make([][]string, len(l.TargetMap))
+	for i, entry := range l.TargetMap {
+		mapMatches[i] = entry.Match
+	}
+	for _, msg := range shadowedRules(mapMatches) {
+		warn("target_map: %s", msg)
+	}
+
+	if l.HTTP != nil && l.HTTP.Enabled {
+		for _, msg := range shadowedHostRoutes(l.HTTP.HostRoutes) {
+			warn("http.host_routes: %s", msg)
+		}
+	}
+
+	// A udp listener's on_connect runs while its session table is locked
+	if l.Script != nil && l.Script.Enabled && l.Protocol == "udp" && l.Script.GetTimeout() > slowUDPScript {
+		warn("script timeout %s is long for a udp listener; all its datagrams wait while on_connect runs for a new session", l.Script.GetTimeout())
+	}
+
+	if l.Audit() {
+		warn("enforcement is audit; clients the allowlist and rate limits would deny are only logged")
+	}
+
+	if l.Chaos != nil && l.Chaos.Enabled {
+		warn("chaos is enabled and injects faults into every flow; use it in staging only")
+	}
+
+	if l.Sniff != nil && l.Sniff.Enabled {
+		prefixes := make([][]byte, len(l.Sniff.Routes))
+		for i := range l.Sniff.Routes {
+			prefixes[i] = l.Sniff.Routes[i].MatchPrefix()
+		}
+		for _, msg := range shadowedPrefixes("route", prefixes) {
+			warn("sniff.routes: %s", msg)
+		}
+	}
+
+	if len(l.PacketRules) > 0 {
+		prefixes := make([][]byte, len(l.PacketRules))
+		for i := range l.PacketRules {
+			prefixes[i] = l.PacketRules[i].MatchPrefix()
+		}
+		for _, msg := range shadowedPrefixes("rule", prefixes) {
+			warn("packet_rules: %s", msg)
+		}
+	}
+
+	return warnings
+}
+
+// shadowedPrefixes reports prefix matchers that can never match because an
+// earlier matcher's prefix is a prefix of theirs. Entries without a prefix
+// (nil) are skipped; kind names the entries in the messages.
+func shadowedPrefixes(kind string, prefixes [][]byte) []string {
+	var msgs []string
+	for i, prefix := range prefixes {
+		if prefix == nil {
+			continue
+		}
+		for j, earlier := range prefixes[:i] {
+			if earlier != nil && bytes.HasPrefix(prefix, earlier) {
+				msgs = append(msgs, fmt.Sprintf("%s %d (prefix %q) is already matched by %s %d (prefix %q)", kind, i, prefix, kind, j, earlier))
+				break
+			}
+		}
+	}
+	return msgs
+}
+
+// shadowedHostRoutes reports host routes that can never match because an
+// earlier wildcard route covers them
+func shadowedHostRoutes(routes []HostRoute) []string {
+	var msgs []string
+	for i, route := range routes {
+		host := strings.ToLower(route.Host)
+		for _, earlier := range routes[:i] {
+			suffix, ok := strings.CutPrefix(strings.ToLower(earlier.Host), "*")
+			if ok && strings.HasSuffix(host, suffix) {
+				msgs = append(msgs, fmt.Sprintf("%s is already covered by %s", route.Host, earlier.Host))
+				break
+			}
+		}
+	}
+	return msgs
+}
+
+// hasLimits reports whether any rate limit is configured
+func (r *RateLimitConfig) hasLimits() bool {
+	return r.MaxConnectionsPerIP > 0 ||
+		r.MaxConnectionAttemptsPerIP > 0 ||
+		r.MaxBandwidthPerIP != "" ||
+		r.MaxTotalConnections > 0
+}
+
+// isWildcardBind reports whether addr binds all interfaces
+func isWildcardBind(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// shadowedEntries reports allowlist entries fully covered by an earlier entry
+func shadowedEntries(entries []string) []string {
+	var msgs []string
+	nets := parseNets(entries)
+	for i, n := range nets {
+		for j := 0; j < i; j++ {
+			if n != nil && nets[j] != nil && netContains(nets[j], n) {
+				msgs = append(msgs, fmt.Sprintf("%s is already covered by %s", entries[i], entries[j]))
+				break
+			}
+		}
+	}
+	return msgs
+}
+
+// shadowedRules reports first-match rules that can never match because every
+// network they list is covered by an earlier rule
+func shadowedRules(rules [][]string) []string {
+	var msgs []string
+	parsed := make([][]*net.IPNet, len(rules))
+	for i, match := range rules {
+		parsed[i] = parseNets(match)
+	}
+
+	for i, nets := range parsed {
+		if len(nets) == 0 {
+			continue
+		}
+		shadowed := true
+		for _, n := range nets {
+			covered := false
+			for j := 0; j < i && !covered; j++ {
+				for _, earlier := range parsed[j] {
+					if n != nil && earlier != nil && netContains(earlier, n) {
+						covered = true
+						break
+					}
+				}
+			}
+			if !covered {
+				shadowed = false
+				break
+			}
+		}
+		if shadowed {
+			msgs = append(msgs, fmt.Sprintf("entry %d (%s) is unreachable, earlier entries match first", i, strings.Join(rules[i], ", ")))
+		}
+	}
+	return msgs
+}
+
+// sysctlInt reads an integer kernel setting from /proc/sys, reporting
+// false where it is unavailable
+func sysctlInt(name string) (int64, bool) {
+	data, err := os.ReadFile("/proc/sys/" + strings.ReplaceAll(name, ".", "/"))
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return n, err == nil
+}
+
+// parseNets parses CIDR/IP entries, leaving nil for invalid ones
+func parseNets(entries []string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(entries))
+	for i, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			nets[i] = n
+		}
+	}
+	return nets
+}
+
+// netContains reports whether outer fully contains inner
+func netContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Endpoint is an address a local listener receives traffic on
+type Endpoint struct {
+	Listener string
+	Protocol string
+	IP       net.IP // nil = all interfaces
+	Port     int
+}
+
+// ListenerEndpoints returns the endpoints of all configured listeners
+func ListenerEndpoints(listeners []ListenerConfig) []Endpoint {
+	var endpoints []Endpoint
+	for _, l := range listeners {
+		host, portStr, err := net.SplitHostPort(l.ListenAddress)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip != nil && ip.IsUnspecified() {
+			ip = nil
+		}
+		endpoints = append(endpoints, Endpoint{
+			Listener: l.Name,
+			Protocol: strings.ToLower(l.Protocol),
+			IP:       ip,
+			Port:     port,
+		})
+	}
+	return endpoints
+}
+
+// LocalIPs returns the addresses assigned to local interfaces
+func LocalIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// MatchEndpoint returns the local listener that would receive traffic sent
+// to ip:port, if any
+func MatchEndpoint(endpoints []Endpoint, localIPs []net.IP, protocol string, ip net.IP, port int) (string, bool) {
+	for _, ep := range endpoints {
+		if ep.Protocol != protocol || ep.Port != port {
+			continue
+		}
+		if ep.IP == nil {
+			if isLocalAddress(ip, localIPs) {
+				return ep.Listener, true
+			}
+		} else if ep.IP.Equal(ip) || ip.IsUnspecified() {
+			return ep.Listener, true
+		}
+	}
+	return "", false
+}
+
+// isLocalAddress reports whether ip belongs to this host
+func isLocalAddress(ip net.IP, localIPs []net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, local := range localIPs {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveHost returns the IPs for a host, which may be an IP literal
+func ResolveHost(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return net.LookupIP(host)
+}
+
+// detectLoops refuses listeners that forward to themselves, to another local
+// listener without allow_chaining, or into a forwarding cycle.
+// Targets with placeholders are checked per flow at runtime instead.
+// Hostnames that do not resolve are skipped.
+func (c *Config) detectLoops() error {
+	endpoints := ListenerEndpoints(c.Listeners)
+	localIPs := LocalIPs()
+	edges := make(map[string][]string)
+
+	for _, l := range c.Listeners {
+		targets := l.TargetAddresses()
+		for _, entry := range l.TargetMap {
+			targets = append(targets, entry.Target)
+		}
+		if l.HTTP != nil && l.HTTP.Enabled {
+			for _, route := range l.HTTP.HostRoutes {
+				targets = append(targets, route.Target)
+			}
+		}
+		for _, rule := range l.PacketRules {
+			if rule.Target != "" {
+				targets = append(targets, rule.Target)
+			}
+		}
+		if l.Sniff != nil && l.Sniff.Enabled {
+			for _, route := range l.Sniff.Routes {
+				targets = append(targets, route.Target)
+			}
+			if l.Sniff.TimeoutTarget != "" {
+				targets = append(targets, l.Sniff.TimeoutTarget)
+			}
+		}
+
+		if l.TargetProxy != "" {
+			if u, err := ParseTargetProxy(l.TargetProxy); err == nil {
+				targets = append(targets, u.Host)
+			}
+		}
+		if l.MirrorTarget != "" {
+			targets = append(targets, l.MirrorTarget)
+		}
+
+		for _, target := range targets {
+			if strings.Contains(target, "{") {
+				continue
+			}
+			host, portStr, err := net.SplitHostPort(target)
+			if err != nil {
+				continue
+			}
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				continue
+			}
+			ips, err := ResolveHost(host)
+			if err != nil {
+				continue
+			}
+
+			for _, ip := range ips {
+				name, ok := MatchEndpoint(endpoints, localIPs, strings.ToLower(l.Protocol), ip, port)
+				if !ok {
+					continue
+				}
+				if name == l.Name {
+					return fmt.Errorf("listener %s forwards to itself via %s", l.Name, target)
+				}
+				if !l.AllowChaining {
+					return fmt.Errorf("listener %s forwards to local listener %s via %s (set allow_chaining to permit)", l.Name, name, target)
+				}
+				edges[l.Name] = append(edges[l.Name], name)
+				break
+			}
+		}
+	}
+
+	if cycle := findCycle(edges); cycle != nil {
+		return fmt.Errorf("forwarding loop between listeners: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// findCycle returns a cycle in the listener forwarding graph, if any
+func findCycle(edges map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+
+	var visit func(node string) []string
+	visit = func(node string) []string {
+		state[node] = visiting
+		path = append(path, node)
+		for _, next := range edges[node] {
+			switch state[next] {
+			case visiting:
+				for i, n := range path {
+					if n == next {
+						return append(append([]string{}, path[i:]...), next)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[node] = done
+		return nil
+	}
+
+	for node := range edges {
+		if state[node] == unvisited {
+			if cycle := visit(node); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MaxPortRange is the most ports a listen_address range may span
+const MaxPortRange = 1024
+
+// portRange is an address whose port is a range, such as 0.0.0.0:30000-30100
+type portRange struct {
+	host        string
+	first, last int
+}
+
+// parsePortRange parses an address with a port range. Returns nil for an
+// address with a single port, which is left to validation.
+func parsePortRange(addr string) (*portRange, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil
+	}
+	firstStr, lastStr, isRange := strings.Cut(port, "-")
+	if !isRange {
+		return nil, nil
+	}
+	first, err1 := strconv.Atoi(firstStr)
+	last, err2 := strconv.Atoi(lastStr)
+	if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+		return nil, fmt.Errorf("invalid port range %q (must be first-last within 1-65535)", port)
+	}
+	return &portRange{host: host, first: first, last: last}, nil
+}
+
+// size returns the number of ports in the range
+func (r *portRange) size() int {
+	return r.last - r.first + 1
+}
+
+// address returns the address of the i-th port of the range
+func (r *portRange) address(i int) string {
+	return net.JoinHostPort(r.host, strconv.Itoa(r.first+i))
+}
+
+// expandPortRanges replaces every listener whose listen_address has a port
+// range with one listener per port, named <name>-<port>. A target address
+// with a range of the same size maps each port to the port at the same
+// offset; a target with a single port is shared by all of them.
+func (c *Config) expandPortRanges() error {
+	var expanded []ListenerConfig
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		listen, err := parsePortRange(l.ListenAddress)
+		if err != nil {
+			return fmt.Errorf("listener %s%s listen_address: %w", l.Name, l.origin(), err)
+		}
+		if listen == nil {
+			if expanded != nil {
+				expanded = append(expanded, *l)
+			}
+			continue
+		}
+		if expanded == nil {
+			expanded = append([]ListenerConfig(nil), c.Listeners[:i]...)
+		}
+
+		ports, err := l.expandPortRange(listen)
+		if err != nil {
+			return fmt.Errorf("listener %s%s: %w", l.Name, l.origin(), err)
+		}
+		expanded = append(expanded, ports...)
+	}
+	if expanded != nil {
+		c.Listeners = expanded
+	}
+	return nil
+}
+
+// expandPortRange returns the listeners of each port of listen
+func (l *ListenerConfig) expandPortRange(listen *portRange) ([]ListenerConfig, error) {
+	if listen.size() > MaxPortRange {
+		return nil, fmt.Errorf("listen_address: port range of %d ports exceeds the maximum of %d", listen.size(), MaxPortRange)
+	}
+	if l.ProtocolHint == ProtocolHintSIP {
+		return nil, fmt.Errorf("listen_address: port ranges cannot be used with protocol_hint sip")
+	}
+
+	// Targets may be ranges of the same size
+	targets := append([]string{l.TargetAddress}, make([]string, len(l.Targets))...)
+	for i, t := range l.Targets {
+		targets[i+1] = t.Address
+	}
+	ranges := make([]*portRange, len(targets))
+	for i, target := range targets {
+		r, err := parsePortRange(target)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target, err)
+		}
+		if r != nil && r.size() != listen.size() {
+			return nil, fmt.Errorf("target %s: port range has %d ports, listen_address has %d", target, r.size(), listen.size())
+		}
+		ranges[i] = r
+	}
+
+	// Each listener gets its own copy of every section
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy listener: %w", err)
+	}
+
+	listeners := make([]ListenerConfig, listen.size())
+	for i := range listeners {
+		port := &listeners[i]
+		if err := yaml.Unmarshal(data, port); err != nil {
+			return nil, fmt.Errorf("failed to copy listener: %w", err)
+		}
+		port.source = l.source
+		port.Name = l.Name + "-" + strconv.Itoa(listen.first+i)
+		port.ListenAddress = listen.address(i)
+		if ranges[0] != nil {
+			port.TargetAddress = ranges[0].address(i)
+		}
+		for j := range port.Targets {
+			if r := ranges[j+1]; r != nil {
+				port.Targets[j].Address = r.address(i)
+			}
+		}
+	}
+	return listeners, nil
+}
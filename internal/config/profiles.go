@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// aclProfilePrefix marks an allowlist or priority_clients entry naming an
+// acl_profiles entry
+const aclProfilePrefix = "@"
+
+// loadRateLimitProfiles returns copies of the ratelimit_profiles of a
+// parsed document, by name
+func loadRateLimitProfiles(doc *yaml.Node) (map[string]*yaml.Node, error) {
+	section := mappingValue(doc, "ratelimit_profiles")
+	if section == nil || section.Tag == "!!null" {
+		return nil, nil
+	}
+	section = copyNode(section)
+	if section.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: ratelimit_profiles must map profile names to rate limits", section.Line)
+	}
+
+	profiles := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(section.Content); i += 2 {
+		name, profile := section.Content[i], section.Content[i+1]
+		if profile.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("line %d: ratelimit_profiles: %s must be a mapping of rate limits", profile.Line, name.Value)
+		}
+		inlineMerges(profile)
+		if value := mappingValue(profile, "profile"); value != nil {
+			return nil, fmt.Errorf("line %d: ratelimit_profiles: %s cannot extend another profile", value.Line, name.Value)
+		}
+		profiles[name.Value] = profile
+	}
+	return profiles, nil
+}
+
+// applyRateLimitProfile fills in the rate limits of a listener, or of the
+// defaults section, that its rate_limits do not set from the profile they
+// name
+func (t *templates) applyRateLimitProfile(listener *yaml.Node) error {
+	i := mappingIndex(listener, "rate_limits")
+	if i < 0 {
+		return nil
+	}
+	rateLimits := listener.Content[i+1]
+	if rateLimits.Kind == yaml.AliasNode {
+		rateLimits = copyNode(rateLimits)
+		listener.Content[i+1] = rateLimits
+	}
+	inlineMerges(rateLimits)
+
+	name := mappingValue(rateLimits, "profile")
+	if name == nil || name.Value == "" {
+		return nil
+	}
+	profile, exists := t.rateLimits[name.Value]
+	if !exists {
+		return fmt.Errorf("line %d: unknown rate limit profile %q", name.Line, name.Value)
+	}
+	mergeDefaults(rateLimits, profile, nil)
+	return nil
+}
+
+// expandACLProfiles replaces "@name" entries of every listener's allowlist,
+// scheduled_allowlist and priority_clients with the entries of
+// acl_profiles[name]
+func (c *Config) expandACLProfiles() error {
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		var err error
+		if l.Allowlist, err = c.expandACL(l.Allowlist); err != nil {
+			return fmt.Errorf("listener %s%s allowlist: %w", l.Name, l.origin(), err)
+		}
+		for j := range l.ScheduledAllowlist {
+			entry := &l.ScheduledAllowlist[j]
+			if entry.Match, err = c.expandACL(entry.Match); err != nil {
+				return fmt.Errorf("listener %s%s scheduled_allowlist[%d]: %w", l.Name, l.origin(), j, err)
+			}
+		}
+		if l.RateLimits.PriorityClients, err = c.expandACL(l.RateLimits.PriorityClients); err != nil {
+			return fmt.Errorf("listener %s%s priority_clients: %w", l.Name, l.origin(), err)
+		}
+	}
+	return nil
+}
+
+// expandACL returns entries with profile references expanded, or entries
+// itself if they have none
+func (c *Config) expandACL(entries []string) ([]string, error) {
+	if !slicesContainPrefix(entries, aclProfilePrefix) {
+		return entries, nil
+	}
+	expanded := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name, isProfile := strings.CutPrefix(strings.TrimSpace(entry), aclProfilePrefix)
+		if !isProfile {
+			expanded = append(expanded, entry)
+			continue
+		}
+		profile, exists := c.ACLProfiles[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown acl profile %q (defined: %s)", name, strings.Join(c.aclProfileNames(), ", "))
+		}
+		expanded = append(expanded, profile...)
+	}
+	return expanded, nil
+}
+
+// aclProfileNames returns the names of the acl profiles, sorted
+func (c *Config) aclProfileNames() []string {
+	names := make([]string, 0, len(c.ACLProfiles))
+	for name := range c.ACLProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// slicesContainPrefix reports whether any entry starts with prefix
+func slicesContainPrefix(entries []string, prefix string) bool {
+	for _, entry := range entries {
+		if strings.HasPrefix(strings.TrimSpace(entry), prefix) {
+			return true
+		}
+	}
+	return false
+}
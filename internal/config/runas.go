@@ -0,0 +1,48 @@
+package config
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// LookupUser resolves a user name or numeric user ID
+func LookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// LookupGroup resolves a group name or numeric group ID
+func LookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupGroupId(name)
+	}
+	return user.LookupGroup(name)
+}
+
+// RunAsIDs returns the user and group IDs privileges are dropped to,
+// looking up run_as_user and run_as_group on this host
+func (s *ServerConfig) RunAsIDs() (uid, gid int, err error) {
+	u, err := LookupUser(s.RunAsUser)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidStr := u.Gid
+	if s.RunAsGroup != "" {
+		g, err := LookupGroup(s.RunAsGroup)
+		if err != nil {
+			return 0, 0, err
+		}
+		gidStr = g.Gid
+	}
+
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, fmt.Errorf("user %s has non-numeric uid %s", u.Username, u.Uid)
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		return 0, 0, fmt.Errorf("group of %s has non-numeric gid %s", u.Username, gidStr)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a recurring time window, such as weekdays from 08:00 to
+// 18:00. A window whose to is not after from runs past midnight, and
+// belongs to the day it starts on.
+type Schedule struct {
+	Days     []string `yaml:"days,omitempty"` // mon to sun, or ranges such as mon-fri (empty = every day)
+	From     string   `yaml:"from"`           // HH:MM (default 00:00)
+	To       string   `yaml:"to"`             // HH:MM, exclusive (default 24:00)
+	Timezone string   `yaml:"timezone"`       // IANA zone such as Europe/Oslo (default local time)
+
+	name     string
+	days     [7]bool // Indexed by time.Weekday
+	from, to int     // Minutes since midnight
+	location *time.Location
+}
+
+// ScheduledACLEntry admits the clients in Match while Schedule is active
+type ScheduledACLEntry struct {
+	Match    []string `yaml:"match"` // IPs, CIDRs or @acl_profiles names
+	Schedule string   `yaml:"schedule"`
+	schedule *Schedule
+}
+
+// weekdays maps day names to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parse checks a schedule and fills in its parsed values
+func (s *Schedule) parse(name string) error {
+	s.name = name
+	s.days = [7]bool{}
+	if len(s.Days) == 0 {
+		for d := range s.days {
+			s.days[d] = true
+		}
+	}
+	for _, entry := range s.Days {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		firstName, lastName, isRange := strings.Cut(entry, "-")
+		if !isRange {
+			lastName = firstName
+		}
+		first, ok1 := weekdays[firstName]
+		last, ok2 := weekdays[lastName]
+		if !ok1 || !ok2 {
+			return fmt.Errorf("invalid day %q (must be mon to sun or a range such as mon-fri)", entry)
+		}
+		// Ranges may wrap around the week, as in fri-mon
+		for d := first; ; d = (d + 1) % 7 {
+			s.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	var err error
+	if s.from, err = parseClock(s.From, 0); err != nil {
+		return fmt.Errorf("from: %w", err)
+	}
+	if s.to, err = parseClock(s.To, 24*60); err != nil {
+		return fmt.Errorf("to: %w", err)
+	}
+	if s.from == 24*60 {
+		return fmt.Errorf("from: must be before 24:00")
+	}
+
+	s.location = time.Local
+	if s.Timezone != "" {
+		if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", s.Timezone, err)
+		}
+	}
+	return nil
+}
+
+// parseClock parses an HH:MM time of day into minutes since midnight.
+// An empty value is def.
+func parseClock(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || len(minutes) != 2 || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q (must be HH:MM between 00:00 and 24:00)", value)
+	}
+	return h*60 + m, nil
+}
+
+// Name returns the name the schedule is defined under
+func (s *Schedule) Name() string {
+	return s.name
+}
+
+// Active reports whether t falls within the schedule. A nil schedule is
+// always active.
+func (s *Schedule) Active(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	t = t.In(s.location)
+	day := t.Weekday()
+	minute := t.Hour()*60 + t.Minute()
+	if s.from < s.to {
+		return s.days[day] && minute >= s.from && minute < s.to
+	}
+	// Past midnight: the evening of a scheduled day, or the morning after
+	return (s.days[day] && minute >= s.from) || (s.days[(day+6)%7] && minute < s.to)
+}
+
+// GetSchedule returns the schedule the rate limits apply in, or nil if
+// they always apply
+func (r *RateLimitConfig) GetSchedule() *Schedule {
+	return r.schedule
+}
+
+// GetSchedule returns the schedule the entry admits clients in
+func (e *ScheduledACLEntry) GetSchedule() *Schedule {
+	return e.schedule
+}
+
+// resolveSchedules parses the schedules and links every listener's
+// references to them
+func (c *Config) resolveSchedules() error {
+	for _, name := range c.scheduleNames() {
+		s := c.Schedules[name]
+		if err := s.parse(name); err != nil {
+			return fmt.Errorf("schedules.%s: %w", name, err)
+		}
+		c.Schedules[name] = s
+	}
+
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		var err error
+		if l.RateLimits.schedule, err = c.schedule(l.RateLimits.Schedule); err != nil {
+			return fmt.Errorf("listener %s%s rate_limits: %w", l.Name, l.origin(), err)
+		}
+		for j := range l.ScheduledAllowlist {
+			entry := &l.ScheduledAllowlist[j]
+			if entry.Schedule == "" {
+				return fmt.Errorf("listener %s%s scheduled_allowlist[%d]: schedule is required", l.Name, l.origin(), j)
+			}
+			if entry.schedule, err = c.schedule(entry.Schedule); err != nil {
+				return fmt.Errorf("listener %s%s scheduled_allowlist[%d]: %w", l.Name, l.origin(), j, err)
+			}
+		}
+	}
+	return nil
+}
+
+// schedule returns a copy of the named schedule, or nil for an empty name
+func (c *Config) schedule(name string) (*Schedule, error) {
+	if name == "" {
+		return nil, nil
+	}
+	s, exists := c.Schedules[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown schedule %q (defined: %s)", name, strings.Join(c.scheduleNames(), ", "))
+	}
+	return &s, nil
+}
+
+// scheduleNames returns the names of the schedules, sorted
+func (c *Config) scheduleNames() []string {
+	names := make([]string, 0, len(c.Schedules))
+	for name := range c.Schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
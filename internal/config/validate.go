@@ -1,17 +1,46 @@
 package config
 
 import (
+	"encoding/hex"
 	"fmt"
+	"math"
 	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// labelNameRegexp matches valid Prometheus label names
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// headerNameRegexp matches valid HTTP header field names (RFC 9110 token)
+var headerNameRegexp = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// reservedLabels are label names already used by the tagged metrics
+var reservedLabels = map[string]bool{
+	"listener": true, "direction": true,
+}
+
 // Validate validates the entire configuration
 func (c *Config) Validate() error {
 	// Validate server config
 	if c.Server.Name == "" {
 		return fmt.Errorf("server.name is required")
 	}
+	if c.Server.ShutdownTimeout < 0 {
+		return fmt.Errorf("server.shutdown_timeout must be non-negative")
+	}
+	if c.Server.RunAsGroup != "" && c.Server.RunAsUser == "" {
+		return fmt.Errorf("server.run_as_group requires run_as_user")
+	}
+	if c.Server.RunAsUser != "" && runtime.GOOS != "linux" {
+		return fmt.Errorf("server.run_as_user is only supported on Linux")
+	}
 
 	// Validate logging config
 	if err := c.Logging.Validate(); err != nil {
@@ -23,6 +52,70 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("metrics config: %w", err)
 	}
 
+	// Validate admin config
+	if err := c.Admin.Validate(); err != nil {
+		return fmt.Errorf("admin config: %w", err)
+	}
+
+	// The admin API serves the metrics endpoints next to its own
+	if p := c.Metrics.Prometheus; p.Enabled && p.ServeOnAdmin {
+		if !c.Admin.Enabled {
+			return fmt.Errorf("metrics config: prometheus: serve_on_admin requires the admin API to be enabled")
+		}
+		if strings.HasPrefix(p.Path, "/api/") {
+			return fmt.Errorf("metrics config: prometheus: path %s collides with the admin API with serve_on_admin", p.Path)
+		}
+	}
+
+	// Validate storage config
+	if err := c.Storage.Validate(); err != nil {
+		return fmt.Errorf("storage config: %w", err)
+	}
+
+	// Validate acl profiles, which may be unused
+	for _, name := range c.aclProfileNames() {
+		for i, entry := range c.ACLProfiles[name] {
+			if err := validateCIDROrIP(entry); err != nil {
+				return fmt.Errorf("acl_profiles.%s[%d]: %w", name, i, err)
+			}
+		}
+	}
+
+	// Validate schedules, which may be unused
+	for _, name := range c.scheduleNames() {
+		s := c.Schedules[name]
+		if err := s.parse(name); err != nil {
+			return fmt.Errorf("schedules.%s: %w", name, err)
+		}
+	}
+
+	// Validate emergency config
+	if f := c.Emergency.BandwidthFactor; f < 0 || f > 1 {
+		return fmt.Errorf("emergency config: bandwidth_factor must be between 0 and 1")
+	}
+
+	// Validate accounting config
+	if err := c.Accounting.Validate(); err != nil {
+		return fmt.Errorf("accounting config: %w", err)
+	}
+
+	// Validate GeoIP config
+	if err := c.GeoIP.Validate(); err != nil {
+		return fmt.Errorf("geoip config: %w", err)
+	}
+
+	// Validate DNS config
+	if err := c.DNS.Validate(); err != nil {
+		return fmt.Errorf("dns config: %w", err)
+	}
+
+	// Validate tracing config
+	if c.Tracing.Enabled {
+		if err := c.Tracing.Validate(); err != nil {
+			return fmt.Errorf("tracing config: %w", err)
+		}
+	}
+
 	// Validate listeners
 	if len(c.Listeners) == 0 {
 		return fmt.Errorf("at least one listener is required")
@@ -30,30 +123,204 @@ func (c *Config) Validate() error {
 
 	listenerNames := make(map[string]bool)
 	listenerAddrs := make(map[string]bool)
+	xdpModes := make(map[string]*ListenerConfig)        // Interface to the first listener with XDP on it
+	afxdpInterfaces := make(map[string]*ListenerConfig) // Interface to the listener reading from it with AF_XDP
 
 	for i, listener := range c.Listeners {
 		if err := listener.Validate(); err != nil {
-			return fmt.Errorf("listener[%d] (%s): %w", i, listener.Name, err)
+			return fmt.Errorf("listener[%d] (%s)%s: %w", i, listener.Name, listener.origin(), err)
 		}
 
 		// Check for duplicate names
 		if listenerNames[listener.Name] {
-			return fmt.Errorf("duplicate listener name: %s", listener.Name)
+			return fmt.Errorf("duplicate listener name: %s%s", listener.Name, listener.origin())
 		}
 		listenerNames[listener.Name] = true
 
 		// Check for duplicate listen addresses
 		if listenerAddrs[listener.ListenAddress] {
-			return fmt.Errorf("duplicate listen address: %s", listener.ListenAddress)
+			return fmt.Errorf("duplicate listen address: %s%s", listener.ListenAddress, listener.origin())
 		}
 		listenerAddrs[listener.ListenAddress] = true
+
+		// Listeners on an interface share its XDP program, unless it
+		// steers datagrams to the AF_XDP sockets of a single listener
+		if listener.HasXDP() {
+			iface := listener.XDP.Interface
+			if other := afxdpInterfaces[iface]; other != nil {
+				return fmt.Errorf("listener[%d] (%s)%s: xdp interface %s is used for af_xdp by listener %s", i, listener.Name, listener.origin(), iface, other.Name)
+			}
+			if first := xdpModes[iface]; first == nil {
+				xdpModes[iface] = &c.Listeners[i]
+			} else if first.XDP.GetMode() != listener.XDP.GetMode() {
+				return fmt.Errorf("listener[%d] (%s)%s: xdp mode %s differs from mode %s of listener %s on interface %s", i, listener.Name, listener.origin(), listener.XDP.GetMode(), first.XDP.GetMode(), first.Name, iface)
+			}
+		}
+		if listener.Protocol == "udp" && listener.UDP.HasAFXDP() {
+			iface := listener.UDP.AFXDP.Interface
+			if other := afxdpInterfaces[iface]; other != nil {
+				return fmt.Errorf("listener[%d] (%s)%s: af_xdp interface %s is already used by listener %s", i, listener.Name, listener.origin(), iface, other.Name)
+			}
+			if other := xdpModes[iface]; other != nil {
+				return fmt.Errorf("listener[%d] (%s)%s: af_xdp interface %s is used for xdp by listener %s", i, listener.Name, listener.origin(), iface, other.Name)
+			}
+			afxdpInterfaces[iface] = &c.Listeners[i]
+		}
+
+		// Schedules must be defined
+		if _, err := c.schedule(listener.RateLimits.Schedule); err != nil {
+			return fmt.Errorf("listener[%d] (%s)%s: rate_limits: %w", i, listener.Name, listener.origin(), err)
+		}
+		for j, entry := range listener.ScheduledAllowlist {
+			if _, err := c.schedule(entry.Schedule); err != nil {
+				return fmt.Errorf("listener[%d] (%s)%s: scheduled_allowlist[%d]: %w", i, listener.Name, listener.origin(), j, err)
+			}
+		}
+
+		// Countries are looked up in the GeoIP database
+		for j, rule := range listener.TagRules {
+			if len(rule.Countries) > 0 && c.GeoIP.Database == "" {
+				return fmt.Errorf("listener[%d] (%s)%s: tag_rules[%d]: countries requires geoip.database", i, listener.Name, listener.origin(), j)
+			}
+		}
+
+		// Shared limits are only shared through redis
+		if listener.RateLimits.Shared && c.Storage.Backend != "redis" {
+			return fmt.Errorf("listener[%d] (%s)%s: rate_limits shared requires the redis storage backend", i, listener.Name, listener.origin())
+		}
+
+		// Options set on every target connection need CAP_NET_ADMIN,
+		// which is gone once privileges are dropped
+		if c.Server.RunAsUser != "" {
+			if listener.Transparent {
+				return fmt.Errorf("listener[%d] (%s)%s: transparent cannot be combined with server.run_as_user", i, listener.Name, listener.origin())
+			}
+			if listener.Socket != nil && listener.Socket.Mark != 0 {
+				return fmt.Errorf("listener[%d] (%s)%s: socket mark cannot be combined with server.run_as_user", i, listener.Name, listener.origin())
+			}
+		}
+	}
+
+	// Refuse forwarding loops between listeners
+	if err := c.detectLoops(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Validate validates the storage configuration
+func (s *StorageConfig) Validate() error {
+	switch s.Backend {
+	case "", "memory":
+	case "file", "bolt":
+		if s.Path == "" {
+			return fmt.Errorf("path is required for the %s backend", s.Backend)
+		}
+	case "redis":
+		if s.Redis == nil || s.Redis.Address == "" {
+			return fmt.Errorf("redis.address is required for the redis backend")
+		}
+		if s.Redis.DB < 0 {
+			return fmt.Errorf("redis.db must be non-negative")
+		}
+		if s.Redis.Timeout < 0 {
+			return fmt.Errorf("redis.timeout must be non-negative")
+		}
+	default:
+		return fmt.Errorf("invalid backend: %s (must be memory, file, bolt or redis)", s.Backend)
+	}
+	return nil
+}
+
+// Validate validates the accounting configuration
+func (a *AccountingConfig) Validate() error {
+	if !a.Enabled {
+		return nil
+	}
+	if a.FlushInterval < 0 {
+		return fmt.Errorf("flush_interval must be non-negative")
+	}
+	if a.FlushInterval > 0 && a.FlushInterval < time.Second {
+		return fmt.Errorf("flush_interval must be at least 1s")
+	}
+	if strings.ContainsAny(a.TenantTag, "/ ") {
+		return fmt.Errorf("tenant_tag must not contain '/' or spaces")
+	}
+	return nil
+}
+
+// Validate validates the GeoIP configuration
+func (g *GeoIPConfig) Validate() error {
+	if g.Database == "" {
+		return nil
+	}
+	if info, err := os.Stat(g.Database); err != nil || info.IsDir() {
+		return fmt.Errorf("database %s is not a file", g.Database)
+	}
+	return nil
+}
+
+// Validate validates the DNS resolver configuration
+func (d *DNSConfig) Validate() error {
+	for _, server := range d.Servers {
+		if net.ParseIP(server) != nil {
+			continue
+		}
+		host, port, err := net.SplitHostPort(server)
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid server %q (must be an IP address with optional port)", server)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port in server %q", server)
+		}
+	}
+	if d.Timeout < 0 {
+		return fmt.Errorf("timeout must be non-negative")
+	}
+	if d.CacheTTL < 0 {
+		return fmt.Errorf("cache_ttl must be non-negative")
 	}
+	if d.NegativeTTL < 0 {
+		return fmt.Errorf("negative_ttl must be non-negative")
+	}
+	return nil
+}
 
+// Validate validates the tracing configuration
+func (t *TracingConfig) Validate() error {
+	if t.Endpoint == "" {
+		return fmt.Errorf("endpoint is required when tracing is enabled")
+	}
+	u, err := url.Parse(t.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q (must be an http or https URL)", t.Endpoint)
+	}
+	if t.BatchSize < 0 {
+		return fmt.Errorf("batch_size must be non-negative")
+	}
+	if t.QueueSize < 0 {
+		return fmt.Errorf("queue_size must be non-negative")
+	}
+	if t.FlushInterval < 0 {
+		return fmt.Errorf("flush_interval must be non-negative")
+	}
+	if t.Timeout < 0 {
+		return fmt.Errorf("timeout must be non-negative")
+	}
 	return nil
 }
 
 // Validate validates the logging configuration
 func (l *LoggingConfig) Validate() error {
+	if l.Level != "" && !logLevels[l.Level] {
+		return fmt.Errorf("invalid level: %s (must be debug, info, warning or error)", l.Level)
+	}
+
+	if l.QueueSize < 0 {
+		return fmt.Errorf("queue_size must be non-negative")
+	}
+
 	if l.Syslog.Enabled {
 		if err := l.Syslog.Validate(); err != nil {
 			return fmt.Errorf("syslog: %w", err)
@@ -66,13 +333,58 @@ func (l *LoggingConfig) Validate() error {
 		}
 	}
 
-	if !l.Syslog.Enabled && !l.JSONLog.Enabled && !l.Stdout.Enabled {
+	if l.Stream.Enabled {
+		if err := l.Stream.Validate(); err != nil {
+			return fmt.Errorf("stream: %w", err)
+		}
+	}
+
+	if l.Webhook.Enabled {
+		if err := l.Webhook.Validate(); err != nil {
+			return fmt.Errorf("webhook: %w", err)
+		}
+	}
+
+	if l.DenyAggregation.Enabled {
+		if err := l.DenyAggregation.Validate(); err != nil {
+			return fmt.Errorf("deny_aggregation: %w", err)
+		}
+	}
+
+	if !l.Syslog.Enabled && !l.JSONLog.Enabled && !l.Stdout.Enabled && !l.Stream.Enabled && !l.Webhook.Enabled {
 		return fmt.Errorf("at least one logging method must be enabled")
 	}
 
 	return nil
 }
 
+// eventCodeRegexp matches the codes of the event catalog
+var eventCodeRegexp = regexp.MustCompile(`^PP[1-5][0-9]{3}$`)
+
+// Validate validates the deny aggregation configuration
+func (d *DenyAggregationConfig) Validate() error {
+	if d.Interval < 0 {
+		return fmt.Errorf("interval must be non-negative")
+	}
+	if d.Burst < 0 {
+		return fmt.Errorf("burst must be non-negative")
+	}
+	if d.MaxClients < 0 {
+		return fmt.Errorf("max_clients must be non-negative")
+	}
+	seen := make(map[string]bool)
+	for _, code := range d.Events {
+		if !eventCodeRegexp.MatchString(code) {
+			return fmt.Errorf("invalid event code: %q (must look like PP3001)", code)
+		}
+		if seen[code] {
+			return fmt.Errorf("duplicate event code: %s", code)
+		}
+		seen[code] = true
+	}
+	return nil
+}
+
 // Validate validates the syslog configuration
 func (s *SyslogConfig) Validate() error {
 	if s.Network != "" && s.Network != "udp" && s.Network != "tcp" && s.Network != "unix" {
@@ -90,6 +402,18 @@ func (s *SyslogConfig) Validate() error {
 		return fmt.Errorf("invalid priority: %s (must be debug, info, warning, or error)", s.Priority)
 	}
 
+	if s.OnDisconnect != "" && s.OnDisconnect != "buffer" && s.OnDisconnect != "drop" {
+		return fmt.Errorf("invalid on_disconnect: %s (must be buffer or drop)", s.OnDisconnect)
+	}
+
+	if s.BufferSize < 0 {
+		return fmt.Errorf("buffer_size must be non-negative")
+	}
+
+	if s.Format != "" && s.Format != SyslogFormatRFC3164 && s.Format != SyslogFormatRFC5424 {
+		return fmt.Errorf("invalid format: %s (must be %s or %s)", s.Format, SyslogFormatRFC3164, SyslogFormatRFC5424)
+	}
+
 	return nil
 }
 
@@ -98,6 +422,77 @@ func (j *JSONLogConfig) Validate() error {
 	if j.Path == "" {
 		return fmt.Errorf("path is required when JSON logging is enabled")
 	}
+	if j.MaxSize != "" && j.maxSize <= 0 {
+		return fmt.Errorf("max_size must be positive")
+	}
+	if j.MaxAge < 0 {
+		return fmt.Errorf("max_age must be non-negative")
+	}
+	if j.MaxBackups < 0 {
+		return fmt.Errorf("max_backups must be non-negative")
+	}
+	return nil
+}
+
+// Validate validates the webhook configuration
+func (w *WebhookConfig) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid url %q (must be an http or https URL)", w.URL)
+	}
+	if w.BatchSize < 0 {
+		return fmt.Errorf("batch_size must be non-negative")
+	}
+	if w.QueueSize < 0 {
+		return fmt.Errorf("queue_size must be non-negative")
+	}
+	if w.FlushInterval < 0 {
+		return fmt.Errorf("flush_interval must be non-negative")
+	}
+	if w.Timeout < 0 {
+		return fmt.Errorf("timeout must be non-negative")
+	}
+	return nil
+}
+
+// Validate validates the event stream configuration
+func (s *StreamConfig) Validate() error {
+	if s.Type != StreamTypeNATS && s.Type != StreamTypeKafka {
+		return fmt.Errorf("invalid type: %q (must be %s or %s)", s.Type, StreamTypeNATS, StreamTypeKafka)
+	}
+	if len(s.Brokers) == 0 {
+		return fmt.Errorf("brokers is required when the stream is enabled")
+	}
+	for _, broker := range s.Brokers {
+		u, err := url.Parse(broker)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid broker %q (must be a URL)", broker)
+		}
+		if s.Type == StreamTypeNATS && u.Scheme != "nats" {
+			return fmt.Errorf("invalid broker %q (must be a nats URL)", broker)
+		}
+		if s.Type == StreamTypeKafka && u.Scheme != "kafka" {
+			return fmt.Errorf("invalid broker %q (must be a kafka URL)", broker)
+		}
+	}
+	if s.Topic == "" {
+		return fmt.Errorf("topic is required when the stream is enabled")
+	}
+	if s.Type == StreamTypeNATS && strings.ContainsAny(s.Topic, " \t\r\n") {
+		return fmt.Errorf("topic must not contain whitespace")
+	}
+	if s.BatchSize < 0 {
+		return fmt.Errorf("batch_size must be non-negative")
+	}
+	if s.QueueSize < 0 {
+		return fmt.Errorf("queue_size must be non-negative")
+	}
+	if s.FlushInterval < 0 {
+		return fmt.Errorf("flush_interval must be non-negative")
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("timeout must be non-negative")
+	}
 	return nil
 }
 
@@ -113,8 +508,23 @@ func (m *MetricsConfig) Validate() error {
 
 // Validate validates the Prometheus configuration
 func (p *PrometheusConfig) Validate() error {
-	if p.ListenAddress == "" {
-		return fmt.Errorf("listen_address is required when Prometheus is enabled")
+	addrs := p.Addresses()
+	if len(addrs) == 0 && !p.ServeOnAdmin {
+		return fmt.Errorf("listen_address, listen_addresses or serve_on_admin is required when Prometheus is enabled")
+	}
+	bound := make(map[string]bool)
+	for _, addr := range addrs {
+		if path, ok := strings.CutPrefix(addr, UnixAddressPrefix); ok {
+			if !filepath.IsAbs(path) {
+				return fmt.Errorf("unix socket path %s must be absolute", path)
+			}
+		} else if err := validateAddress(addr); err != nil {
+			return fmt.Errorf("invalid listen address %s: %w", addr, err)
+		}
+		if bound[addr] {
+			return fmt.Errorf("duplicate listen address: %s", addr)
+		}
+		bound[addr] = true
 	}
 
 	if p.Path == "" {
@@ -125,133 +535,1019 @@ func (p *PrometheusConfig) Validate() error {
 		return fmt.Errorf("path must start with /")
 	}
 
-	return nil
-}
-
-// Validate validates the listener configuration
-func (l *ListenerConfig) Validate() error {
-	if l.Name == "" {
-		return fmt.Errorf("name is required")
+	if p.TopTalkers < 0 {
+		return fmt.Errorf("top_talkers must be non-negative")
 	}
 
-	// Validate protocol
-	if err := validateProtocol(l.Protocol); err != nil {
-		return err
+	if err := p.ClientMetrics.Validate(); err != nil {
+		return fmt.Errorf("client_metrics: %w", err)
 	}
 
-	// Validate listen address
-	if l.ListenAddress == "" {
-		return fmt.Errorf("listen_address is required")
-	}
-	if err := validateAddress(l.ListenAddress); err != nil {
-		return fmt.Errorf("invalid listen_address: %w", err)
+	if p.TLS.Enabled() && (p.TLS.CertFile == "" || p.TLS.KeyFile == "") {
+		return fmt.Errorf("tls requires both cert_file and key_file")
 	}
 
-	// Validate target address
-	if l.TargetAddress == "" {
-		return fmt.Errorf("target_address is required")
-	}
-	if err := validateAddress(l.TargetAddress); err != nil {
-		return fmt.Errorf("invalid target_address: %w", err)
+	if p.BasicAuth.Enabled() && (p.BasicAuth.Username == "" || p.BasicAuth.Password == "") {
+		return fmt.Errorf("basic_auth requires both username and password")
 	}
 
-	// Validate allowlist
-	for i, entry := range l.Allowlist {
-		if err := validateCIDROrIP(entry); err != nil {
-			return fmt.Errorf("allowlist[%d]: %w", i, err)
+	seen := make(map[string]bool)
+	for _, label := range p.TagLabels {
+		if !labelNameRegexp.MatchString(label) {
+			return fmt.Errorf("invalid tag label: %q", label)
+		}
+		if reservedLabels[label] {
+			return fmt.Errorf("tag label %q collides with a built-in label", label)
+		}
+		if seen[label] {
+			return fmt.Errorf("duplicate tag label: %s", label)
 		}
+		seen[label] = true
 	}
 
-	// Validate rate limits
-	if err := l.RateLimits.Validate(); err != nil {
-		return fmt.Errorf("rate_limits: %w", err)
-	}
+	return nil
+}
 
-	// Validate protocol-specific config
-	if l.Protocol == "tcp" && l.TCP != nil {
-		if err := l.TCP.Validate(); err != nil {
-			return fmt.Errorf("tcp config: %w", err)
-		}
+// Validate validates the per-client metrics configuration
+func (c *ClientMetricsConfig) Validate() error {
+	if c.MaxClients < 0 {
+		return fmt.Errorf("max_clients must be non-negative")
 	}
-
-	if l.Protocol == "udp" && l.UDP != nil {
-		if err := l.UDP.Validate(); err != nil {
-			return fmt.Errorf("udp config: %w", err)
+	for _, entry := range c.Clients {
+		if err := validateCIDROrIP(entry); err != nil {
+			return fmt.Errorf("invalid clients entry %q: %w", entry, err)
 		}
 	}
-
 	return nil
 }
 
-// Validate validates the rate limit configuration
-func (r *RateLimitConfig) Validate() error {
-	if r.MaxConnectionsPerIP < 0 {
-		return fmt.Errorf("max_connections_per_ip must be non-negative")
+// Validate validates a balanced target
+func (t *TargetEntry) Validate() error {
+	if t.Address == "" {
+		return fmt.Errorf("address is required")
 	}
-
-	if r.ConnectionsWindow < 0 {
-		return fmt.Errorf("connections_window must be non-negative")
+	if err := validateTargetAddress(t.Address); err != nil {
+		return fmt.Errorf("invalid address: %w", err)
 	}
-
-	if r.MaxConnectionAttemptsPerIP < 0 {
-		return fmt.Errorf("max_connection_attempts_per_ip must be non-negative")
+	if t.Weight < 0 {
+		return fmt.Errorf("weight must be non-negative")
 	}
+	return nil
+}
 
-	if r.AttemptsWindow < 0 {
-		return fmt.Errorf("attempts_window must be non-negative")
+// Validate validates a target map entry
+func (t *TargetMapEntry) Validate() error {
+	if len(t.Match) == 0 {
+		return fmt.Errorf("match must contain at least one CIDR or IP")
 	}
-
-	if r.MaxBandwidthPerIP != "" {
-		if _, err := ParseBandwidth(r.MaxBandwidthPerIP); err != nil {
-			return fmt.Errorf("invalid max_bandwidth_per_ip: %w", err)
+	for i, entry := range t.Match {
+		if err := validateCIDROrIP(entry); err != nil {
+			return fmt.Errorf("match[%d]: %w", i, err)
 		}
 	}
-
-	if r.BandwidthWindow < 0 {
-		return fmt.Errorf("bandwidth_window must be non-negative")
+	if t.Target == "" {
+		return fmt.Errorf("target is required")
 	}
-
-	if r.MaxTotalConnections < 0 {
-		return fmt.Errorf("max_total_connections must be non-negative")
+	if err := validateTargetAddress(t.Target); err != nil {
+		return fmt.Errorf("invalid target: %w", err)
 	}
+	return nil
+}
 
-	// Validate action mode
-	if r.Action != "" {
-		validActions := map[string]bool{
-			"drop": true, "throttle": true, "log_only": true,
-		}
-		if !validActions[strings.ToLower(r.Action)] {
-			return fmt.Errorf("invalid action: %s (must be drop, throttle, or log_only)", r.Action)
+// Validate validates a tag rule
+func (t *TagRuleConfig) Validate() error {
+	if len(t.Match) == 0 && len(t.Countries) == 0 && len(t.Identities) == 0 {
+		return fmt.Errorf("at least one of match, countries or identities is required")
+	}
+	for i, entry := range t.Match {
+		if err := validateCIDROrIP(entry); err != nil {
+			return fmt.Errorf("match[%d]: %w", i, err)
 		}
 	}
-
-	// Validate throttle_minimum if action is throttle
-	if strings.ToLower(r.Action) == "throttle" {
-		if r.ThrottleMinimumBandwidth == "" {
-			return fmt.Errorf("throttle_minimum is required when action is 'throttle'")
+	for i, country := range t.Countries {
+		if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+			return fmt.Errorf("countries[%d]: %q is not an upper-case ISO 3166-1 alpha-2 code such as NO", i, country)
 		}
-		if _, err := ParseBandwidth(r.ThrottleMinimumBandwidth); err != nil {
-			return fmt.Errorf("invalid throttle_minimum: %w", err)
+	}
+	for i, identity := range t.Identities {
+		if identity == "" {
+			return fmt.Errorf("identities[%d] must not be empty", i)
 		}
 	}
-
-	return nil
+	if len(t.Tags) == 0 {
+		return fmt.Errorf("tags must not be empty")
+	}
+	return validateTags(t.Tags)
 }
 
-// Validate validates the TCP configuration
-func (t *TCPConfig) Validate() error {
-	if t.ReadTimeout < 0 {
-		return fmt.Errorf("read_timeout must be non-negative")
+// Validate validates the admin API configuration
+func (a *AdminConfig) Validate() error {
+	if !a.Enabled {
+		return nil
 	}
-	if t.WriteTimeout < 0 {
-		return fmt.Errorf("write_timeout must be non-negative")
+	if a.MaxExemptionTTL < 0 {
+		return fmt.Errorf("max_exemption_ttl must be non-negative")
 	}
-	if t.IdleTimeout < 0 {
-		return fmt.Errorf("idle_timeout must be non-negative")
+	if a.MaxCaptureDuration < 0 {
+		return fmt.Errorf("max_capture_duration must be non-negative")
 	}
-	return nil
-}
-
+	if a.MaxCaptureSize != "" && a.maxCaptureSize <= 0 {
+		return fmt.Errorf("max_capture_size must be positive")
+	}
+	if a.CaptureDir != "" {
+		if info, err := os.Stat(a.CaptureDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("capture_dir %s is not a directory", a.CaptureDir)
+		}
+	}
+	if a.ListenAddress == "" {
+		return fmt.Errorf("listen_address is required when the admin API is enabled")
+	}
+	if err := validateAddress(a.ListenAddress); err != nil {
+		return fmt.Errorf("invalid listen_address: %w", err)
+	}
+	return nil
+}
+
+// Validate validates the listener configuration
+func (l *ListenerConfig) Validate() error {
+	if l.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	// Validate protocol
+	if err := validateProtocol(l.Protocol); err != nil {
+		return err
+	}
+
+	// Validate listen address
+	if l.ListenAddress == "" {
+		return fmt.Errorf("listen_address is required")
+	}
+	if err := validateAddress(l.ListenAddress); err != nil {
+		return fmt.Errorf("invalid listen_address: %w", err)
+	}
+
+	// Validate target address
+	if len(l.Targets) > 0 {
+		if l.TargetAddress != "" {
+			return fmt.Errorf("target_address and targets are mutually exclusive")
+		}
+		seen := make(map[string]bool)
+		for i, entry := range l.Targets {
+			if err := entry.Validate(); err != nil {
+				return fmt.Errorf("targets[%d]: %w", i, err)
+			}
+			if seen[entry.Address] {
+				return fmt.Errorf("targets[%d]: duplicate address %s", i, entry.Address)
+			}
+			seen[entry.Address] = true
+		}
+	} else {
+		if l.TargetAddress == "" {
+			return fmt.Errorf("target_address is required")
+		}
+		if err := validateTargetAddress(l.TargetAddress); err != nil {
+			return fmt.Errorf("invalid target_address: %w", err)
+		}
+	}
+	switch l.Balance {
+	case "", BalanceRoundRobin, BalanceWeighted, BalanceLeastConn, BalanceRandom:
+	default:
+		return fmt.Errorf("invalid balance: %s (must be round_robin, weighted, least_conn or random)", l.Balance)
+	}
+	if l.Failover != nil && l.Failover.Enabled {
+		if l.Protocol != "tcp" {
+			return fmt.Errorf("failover is only supported for tcp listeners")
+		}
+		if len(l.Targets) < 2 {
+			return fmt.Errorf("failover requires at least two targets")
+		}
+		if l.Failover.MaxAttempts < 0 {
+			return fmt.Errorf("failover.max_attempts must be non-negative")
+		}
+	}
+	if l.CircuitBreaker != nil && l.CircuitBreaker.Enabled {
+		if len(l.Targets) == 0 {
+			return fmt.Errorf("circuit_breaker requires targets")
+		}
+		if l.CircuitBreaker.FailureThreshold < 0 {
+			return fmt.Errorf("circuit_breaker.failure_threshold must be non-negative")
+		}
+		if l.CircuitBreaker.Cooldown < 0 {
+			return fmt.Errorf("circuit_breaker.cooldown must be non-negative")
+		}
+	}
+	if l.SampleRate < 0 {
+		return fmt.Errorf("sample_rate must be non-negative")
+	}
+	if l.LogLevel != "" && !logLevels[l.LogLevel] {
+		return fmt.Errorf("invalid log_level: %s (must be debug, info, warning or error)", l.LogLevel)
+	}
+	switch l.Enforcement {
+	case "", EnforcementEnforce, EnforcementAudit:
+	default:
+		return fmt.Errorf("invalid enforcement: %s (must be enforce or audit)", l.Enforcement)
+	}
+	if l.TargetResolveInterval < 0 {
+		return fmt.Errorf("target_resolve_interval must be non-negative")
+	}
+	if l.TargetResolveInterval > 0 && l.TargetResolveInterval < time.Second {
+		return fmt.Errorf("target_resolve_interval must be at least 1s")
+	}
+	if l.TargetDialTimeout < 0 {
+		return fmt.Errorf("target_dial_timeout must be non-negative")
+	}
+	if l.TargetKeepalive != 0 && l.Protocol != "tcp" {
+		return fmt.Errorf("target_keepalive is only supported for tcp listeners")
+	}
+	if l.Fingerprint && l.Protocol != "tcp" {
+		return fmt.Errorf("fingerprint is only supported for tcp listeners")
+	}
+	if l.BindSourceAddress != "" {
+		if l.BindSourceIP() == nil {
+			return fmt.Errorf("invalid bind_source_address: %s (must be an IP address)", l.BindSourceAddress)
+		}
+		if l.Transparent {
+			return fmt.Errorf("bind_source_address cannot be combined with transparent; transparent connects from the client's address")
+		}
+	}
+
+	if l.TargetProxy != "" {
+		if l.Protocol != "tcp" {
+			return fmt.Errorf("target_proxy is only supported for tcp listeners")
+		}
+		if _, err := ParseTargetProxy(l.TargetProxy); err != nil {
+			return fmt.Errorf("target_proxy: %w", err)
+		}
+		if l.TargetResolveInterval > 0 {
+			return fmt.Errorf("target_resolve_interval cannot be combined with target_proxy; the proxy resolves targets")
+		}
+	}
+
+	switch l.ProtocolHint {
+	case "":
+	case ProtocolHintDNS, ProtocolHintSIP:
+		if l.Protocol != "udp" {
+			return fmt.Errorf("protocol_hint %s is only supported for udp listeners", l.ProtocolHint)
+		}
+	default:
+		return fmt.Errorf("invalid protocol_hint: %s (must be dns or sip)", l.ProtocolHint)
+	}
+	if l.ProtocolHint == ProtocolHintSIP {
+		if l.SIP == nil {
+			return fmt.Errorf("protocol_hint sip requires a sip block with media_ports")
+		}
+		if err := l.SIP.Validate(l.ListenAddress); err != nil {
+			return fmt.Errorf("sip: %w", err)
+		}
+	} else if l.SIP != nil {
+		return fmt.Errorf("sip requires protocol_hint sip")
+	}
+
+	if l.MirrorTarget != "" {
+		if err := validateAddress(l.MirrorTarget); err != nil {
+			return fmt.Errorf("mirror_target: %w", err)
+		}
+	}
+
+	if l.Transparent {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("transparent is only supported on Linux")
+		}
+		if l.TargetProxy != "" {
+			return fmt.Errorf("transparent cannot be combined with target_proxy")
+		}
+	}
+
+	// Validate target map
+	for i, entry := range l.TargetMap {
+		if err := entry.Validate(); err != nil {
+			return fmt.Errorf("target_map[%d]: %w", i, err)
+		}
+	}
+
+	// Validate allowlist
+	for i, entry := range l.Allowlist {
+		if err := validateCIDROrIP(entry); err != nil {
+			return fmt.Errorf("allowlist[%d]: %w", i, err)
+		}
+	}
+	for i, entry := range l.ScheduledAllowlist {
+		if len(entry.Match) == 0 {
+			return fmt.Errorf("scheduled_allowlist[%d]: match must not be empty", i)
+		}
+		if entry.Schedule == "" {
+			return fmt.Errorf("scheduled_allowlist[%d]: schedule is required", i)
+		}
+		for j, match := range entry.Match {
+			if err := validateCIDROrIP(match); err != nil {
+				return fmt.Errorf("scheduled_allowlist[%d].match[%d]: %w", i, j, err)
+			}
+		}
+	}
+
+	// Validate tags
+	if err := validateTags(l.Tags); err != nil {
+		return fmt.Errorf("tags: %w", err)
+	}
+	for i, rule := range l.TagRules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("tag_rules[%d]: %w", i, err)
+		}
+	}
+
+	// Validate rate limits
+	if err := l.RateLimits.Validate(); err != nil {
+		return fmt.Errorf("rate_limits: %w", err)
+	}
+
+	// Validate ban config
+	if l.Ban != nil && l.Ban.Enabled {
+		if err := l.Ban.Validate(); err != nil {
+			return fmt.Errorf("ban: %w", err)
+		}
+	}
+
+	// Validate quota config
+	if l.Quota != nil && l.Quota.Enabled {
+		if err := l.Quota.Validate(); err != nil {
+			return fmt.Errorf("quota: %w", err)
+		}
+	}
+
+	// Validate greylist config
+	if l.Greylist != nil && l.Greylist.Enabled {
+		if err := l.Greylist.Validate(); err != nil {
+			return fmt.Errorf("greylist: %w", err)
+		}
+	}
+
+	// Validate pre-hook config
+	if l.PreHook != nil && l.PreHook.Enabled {
+		if err := l.PreHook.Validate(); err != nil {
+			return fmt.Errorf("pre_hook: %w", err)
+		}
+		if l.PreHook.SNI && l.Protocol != "tcp" {
+			return fmt.Errorf("pre_hook: sni is only supported for tcp listeners")
+		}
+		if l.PreHook.SNI && l.HTTP != nil && l.HTTP.Enabled {
+			return fmt.Errorf("pre_hook: sni and http mode cannot be combined")
+		}
+	}
+
+	// Identities come from the answer of a pre-hook service
+	for i, rule := range l.TagRules {
+		if len(rule.Identities) > 0 && (l.PreHook == nil || !l.PreHook.Enabled || l.PreHook.Exec != "") {
+			return fmt.Errorf("tag_rules[%d]: identities requires a pre_hook with unix_socket or url", i)
+		}
+	}
+
+	// Validate script config
+	if l.Script != nil && l.Script.Enabled {
+		if err := l.Script.Validate(); err != nil {
+			return fmt.Errorf("script: %w", err)
+		}
+	}
+
+	// Validate HTTP-aware mode
+	if l.HTTP != nil && l.HTTP.Enabled {
+		if l.Protocol != "tcp" {
+			return fmt.Errorf("http mode is only supported for tcp listeners")
+		}
+		if err := l.HTTP.Validate(); err != nil {
+			return fmt.Errorf("http: %w", err)
+		}
+		if l.HTTP.RateLimitHeaders != "" && l.HTTP.RateLimitHeaders != "off" &&
+			(l.RateLimits.MaxConnectionAttemptsPerIP <= 0 || l.RateLimits.AttemptsWindow <= 0) {
+			return fmt.Errorf("http.rate_limit_headers requires rate_limits.max_connection_attempts_per_ip and attempts_window")
+		}
+	}
+
+	if l.Chaos != nil && l.Chaos.Enabled {
+		if err := l.Chaos.Validate(); err != nil {
+			return fmt.Errorf("chaos: %w", err)
+		}
+	}
+
+	if l.Socket != nil {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("socket options are only supported on Linux")
+		}
+		if err := l.Socket.Validate(); err != nil {
+			return fmt.Errorf("socket: %w", err)
+		}
+	}
+
+	if l.HasXDP() {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("xdp is only supported on Linux")
+		}
+		if err := l.XDP.Validate(); err != nil {
+			return fmt.Errorf("xdp: %w", err)
+		}
+		// The program matches packets by destination IP and port
+		if host, _, _ := net.SplitHostPort(l.ListenAddress); host != "" && net.ParseIP(host) == nil {
+			return fmt.Errorf("xdp requires an IP address in listen_address, not host name %s", host)
+		}
+	}
+
+	// Validate protocol sniffing
+	if l.Sniff != nil && l.Sniff.Enabled {
+		if l.Protocol != "tcp" {
+			return fmt.Errorf("sniff is only supported for tcp listeners")
+		}
+		if l.HTTP != nil && l.HTTP.Enabled {
+			return fmt.Errorf("sniff and http mode cannot be combined; use http.host_routes to route HTTP")
+		}
+		if err := l.Sniff.Validate(); err != nil {
+			return fmt.Errorf("sniff: %w", err)
+		}
+	}
+
+	// Validate packet rules
+	if len(l.PacketRules) > 0 && l.Protocol != "udp" {
+		return fmt.Errorf("packet_rules are only supported for udp listeners")
+	}
+	for i, rule := range l.PacketRules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("packet_rules[%d]: %w", i, err)
+		}
+	}
+
+	// Validate signatures
+	signatures := make(map[string]bool)
+	for i, sig := range l.Signatures {
+		if err := sig.Validate(); err != nil {
+			return fmt.Errorf("signatures[%d]: %w", i, err)
+		}
+		if signatures[sig.Name] {
+			return fmt.Errorf("signatures[%d]: duplicate name: %s", i, sig.Name)
+		}
+		signatures[sig.Name] = true
+	}
+
+	// Validate protocol-specific config
+	if l.Protocol == "tcp" && l.TCP != nil {
+		if err := l.TCP.Validate(); err != nil {
+			return fmt.Errorf("tcp config: %w", err)
+		}
+	}
+
+	if l.Protocol == "udp" && l.UDP != nil {
+		if err := l.UDP.Validate(); err != nil {
+			return fmt.Errorf("udp config: %w", err)
+		}
+	}
+
+	if l.Protocol == "udp" && l.UDP != nil && l.UDP.Offload && runtime.GOOS != "linux" {
+		return fmt.Errorf("udp offload is only supported on Linux")
+	}
+
+	if l.Protocol == "udp" && l.UDP.HasAFXDP() {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("udp af_xdp is only supported on Linux")
+		}
+		// The program matches datagrams by destination IP and port
+		if host, _, _ := net.SplitHostPort(l.ListenAddress); host != "" && net.ParseIP(host) == nil {
+			return fmt.Errorf("udp af_xdp requires an IP address in listen_address, not host name %s", host)
+		}
+	}
+
+	return nil
+}
+
+// Validate validates the rate limit configuration
+func (r *RateLimitConfig) Validate() error {
+	if r.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("max_connections_per_ip must be non-negative")
+	}
+
+	if r.ConnectionsWindow < 0 {
+		return fmt.Errorf("connections_window must be non-negative")
+	}
+
+	if r.MaxConnectionAttemptsPerIP < 0 {
+		return fmt.Errorf("max_connection_attempts_per_ip must be non-negative")
+	}
+
+	if r.AttemptsWindow < 0 {
+		return fmt.Errorf("attempts_window must be non-negative")
+	}
+
+	if r.MaxBandwidthPerIP != "" {
+		if _, err := ParseBandwidth(r.MaxBandwidthPerIP); err != nil {
+			return fmt.Errorf("invalid max_bandwidth_per_ip: %w", err)
+		}
+	}
+
+	if r.BandwidthWindow < 0 {
+		return fmt.Errorf("bandwidth_window must be non-negative")
+	}
+
+	if r.MaxTotalConnections < 0 {
+		return fmt.Errorf("max_total_connections must be non-negative")
+	}
+
+	// Validate action mode
+	if r.Action != "" {
+		validActions := map[string]bool{
+			"drop": true, "throttle": true, "log_only": true,
+		}
+		if !validActions[strings.ToLower(r.Action)] {
+			return fmt.Errorf("invalid action: %s (must be drop, throttle, or log_only)", r.Action)
+		}
+	}
+
+	for _, entry := range r.PriorityClients {
+		if err := validateCIDROrIP(entry); err != nil {
+			return fmt.Errorf("invalid priority_clients entry %q: %w", entry, err)
+		}
+	}
+	if r.PriorityReserve < 0 || r.PriorityReserve >= 1 {
+		return fmt.Errorf("priority_reserve must be at least 0 and less than 1")
+	}
+	if (len(r.PriorityClients) > 0) != (r.PriorityReserve > 0) {
+		return fmt.Errorf("priority_clients and priority_reserve must be set together")
+	}
+	if r.PriorityReserve > 0 {
+		if r.MaxTotalConnections <= 0 {
+			return fmt.Errorf("priority_reserve requires max_total_connections")
+		}
+		if r.GetPriorityReserved() >= r.MaxTotalConnections {
+			return fmt.Errorf("priority_reserve leaves no connections for other clients")
+		}
+	}
+
+	if _, _, err := ParseRateLimitKey(r.RateLimitKey); err != nil {
+		return fmt.Errorf("invalid rate_limit_key: %w", err)
+	}
+
+	if r.Shared && (r.MaxConnectionAttemptsPerIP == 0 || r.AttemptsWindow == 0) && (r.MaxBandwidthPerIP == "" || r.BandwidthWindow == 0) {
+		return fmt.Errorf("shared requires max_connection_attempts_per_ip or max_bandwidth_per_ip with its window")
+	}
+
+	// Validate throttle_minimum if action is throttle
+	if strings.ToLower(r.Action) == "throttle" {
+		if r.ThrottleMinimumBandwidth == "" {
+			return fmt.Errorf("throttle_minimum is required when action is 'throttle'")
+		}
+		if _, err := ParseBandwidth(r.ThrottleMinimumBandwidth); err != nil {
+			return fmt.Errorf("invalid throttle_minimum: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Validate validates the ban configuration
+func (b *BanConfig) Validate() error {
+	if b.MaxViolations <= 0 {
+		return fmt.Errorf("max_violations must be positive")
+	}
+	if b.ViolationWindow <= 0 {
+		return fmt.Errorf("violation_window must be positive")
+	}
+	if b.BanDuration <= 0 {
+		return fmt.Errorf("ban_duration must be positive")
+	}
+	return nil
+}
+
+// Validate validates the quota configuration
+func (q *QuotaConfig) Validate() error {
+	if q.Daily == "" && q.Monthly == "" {
+		return fmt.Errorf("daily or monthly is required")
+	}
+	for _, field := range []struct{ name, value string }{
+		{"daily", q.Daily},
+		{"monthly", q.Monthly},
+		{"throttle_rate", q.ThrottleRate},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if bytes, err := ParseBandwidth(field.value); err != nil {
+			return fmt.Errorf("invalid %s: %w", field.name, err)
+		} else if bytes <= 0 {
+			return fmt.Errorf("%s must be positive", field.name)
+		}
+	}
+	switch q.GetAction() {
+	case QuotaActionDrop:
+	case QuotaActionThrottle:
+		if q.ThrottleRate == "" {
+			return fmt.Errorf("throttle_rate is required with action throttle")
+		}
+	default:
+		return fmt.Errorf("invalid action: %s (must be drop or throttle)", q.Action)
+	}
+	if q.Timezone != "" {
+		if _, err := time.LoadLocation(q.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q: %w", q.Timezone, err)
+		}
+	}
+	return nil
+}
+
+// Validate validates the greylist configuration
+func (g *GreylistConfig) Validate() error {
+	switch g.Action {
+	case "", GreylistActionDelay, GreylistActionReject:
+	default:
+		return fmt.Errorf("invalid action: %s (must be delay or reject)", g.Action)
+	}
+	for _, field := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"delay", g.Delay},
+		{"retry_window", g.RetryWindow},
+		{"remember", g.Remember},
+	} {
+		if field.value < 0 {
+			return fmt.Errorf("%s must not be negative", field.name)
+		}
+	}
+	if g.GetRetryWindow() <= g.GetDelay() {
+		return fmt.Errorf("retry_window (%s) must be longer than delay (%s)", g.GetRetryWindow(), g.GetDelay())
+	}
+	if g.MaxPending < 0 {
+		return fmt.Errorf("max_pending must not be negative")
+	}
+	return nil
+}
+
+// Validate validates the pre-hook configuration
+func (h *PreHookConfig) Validate() error {
+	set := 0
+	for _, v := range []string{h.Exec, h.UnixSocket, h.URL} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of exec, unix_socket or url must be set")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid url %q (must be an http or https URL)", h.URL)
+		}
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("timeout must be non-negative")
+	}
+	if h.CacheTTL < 0 {
+		return fmt.Errorf("cache_ttl must be non-negative")
+	}
+	if h.OnError != "" && h.OnError != "deny" && h.OnError != "allow" {
+		return fmt.Errorf("invalid on_error: %s (must be deny or allow)", h.OnError)
+	}
+	return nil
+}
+
+// Validate validates the script configuration. The script itself is
+// compiled when the listener starts.
+func (s *ScriptConfig) Validate() error {
+	if s.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if s.Timeout < 0 {
+		return fmt.Errorf("timeout must be non-negative")
+	}
+	if s.OnError != "" && s.OnError != "deny" && s.OnError != "allow" {
+		return fmt.Errorf("invalid on_error: %s (must be deny or allow)", s.OnError)
+	}
+	return nil
+}
+
+// Validate validates the XDP configuration
+func (x *XDPConfig) Validate() error {
+	if x.Interface == "" {
+		return fmt.Errorf("interface is required")
+	}
+	switch x.Mode {
+	case "", XDPModeAuto, XDPModeNative, XDPModeGeneric:
+	default:
+		return fmt.Errorf("invalid mode: %s (must be auto, native or generic)", x.Mode)
+	}
+	return nil
+}
+
+// Validate validates the TCP configuration
+func (t *TCPConfig) Validate() error {
+	if t.ReadTimeout < 0 {
+		return fmt.Errorf("read_timeout must be non-negative")
+	}
+	if t.WriteTimeout < 0 {
+		return fmt.Errorf("write_timeout must be non-negative")
+	}
+	if t.IdleTimeout < 0 {
+		return fmt.Errorf("idle_timeout must be non-negative")
+	}
+	if t.MaxConnectionDuration < 0 {
+		return fmt.Errorf("max_connection_duration must be non-negative")
+	}
+	if t.SendProxyProtocol != "" && t.SendProxyProtocol != "v1" && t.SendProxyProtocol != "v2" {
+		return fmt.Errorf("invalid send_proxy_protocol: %s (must be v1 or v2)", t.SendProxyProtocol)
+	}
+	if t.MaxPendingAccepts < 0 {
+		return fmt.Errorf("max_pending_accepts must be non-negative")
+	}
+	if t.AcceptPauseThreshold < 0 {
+		return fmt.Errorf("accept_pause_threshold must be non-negative")
+	}
+	if t.BufferSize != 0 && (t.BufferSize < MinTCPBufferSize || t.BufferSize > MaxTCPBufferSize) {
+		return fmt.Errorf("buffer_size must be between %d and %d bytes", MinTCPBufferSize, MaxTCPBufferSize)
+	}
+	if t.KeepaliveInterval < 0 {
+		return fmt.Errorf("keepalive_interval must be non-negative")
+	}
+	if t.KeepaliveCount < 0 {
+		return fmt.Errorf("keepalive_count must be non-negative")
+	}
+	if t.UserTimeout < 0 {
+		return fmt.Errorf("user_timeout must be non-negative")
+	}
+	if t.MaxConcurrentConnections < 0 || t.ConcurrencyQueue < 0 || t.ConcurrencyQueueTimeout < 0 {
+		return fmt.Errorf("max_concurrent_connections, concurrency_queue and concurrency_queue_timeout must be non-negative")
+	}
+	if (t.ConcurrencyQueue > 0 || t.ConcurrencyQueueTimeout > 0) && t.MaxConcurrentConnections == 0 {
+		return fmt.Errorf("concurrency_queue and concurrency_queue_timeout require max_concurrent_connections")
+	}
+	if t.DenyResponse != nil {
+		if err := t.DenyResponse.Validate(); err != nil {
+			return fmt.Errorf("deny_response: %w", err)
+		}
+	}
+	return nil
+}
+
+// Validate validates the response to denied TCP clients
+func (d *DenyResponseConfig) Validate() error {
+	switch d.Action {
+	case "", DenyActionClose, DenyActionReset, DenyActionTarpit:
+	case DenyActionBanner:
+		if d.Banner == "" {
+			return fmt.Errorf("action banner requires a banner")
+		}
+	default:
+		return fmt.Errorf("invalid action: %s (must be close, reset, banner or tarpit)", d.Action)
+	}
+	if len(d.Banner) > MaxDenyBannerSize {
+		return fmt.Errorf("banner must be at most %d bytes", MaxDenyBannerSize)
+	}
+	if d.TarpitDuration < 0 || d.TarpitInterval < 0 || d.MaxTarpitted < 0 {
+		return fmt.Errorf("tarpit_duration, tarpit_interval and max_tarpitted must be non-negative")
+	}
+	return nil
+}
+
+// Validate validates the HTTP-aware mode configuration
+func (h *HTTPConfig) Validate() error {
+	for _, name := range []string{h.FlowIDHeader, h.TagsHeader} {
+		if name != "" && !headerNameRegexp.MatchString(name) {
+			return fmt.Errorf("invalid header name: %q", name)
+		}
+	}
+	switch h.RateLimitHeaders {
+	case "", "off", "warn", "always":
+	default:
+		return fmt.Errorf("invalid rate_limit_headers: %s (must be off, warn or always)", h.RateLimitHeaders)
+	}
+	seen := make(map[string]bool)
+	for i, route := range h.HostRoutes {
+		if err := route.Validate(); err != nil {
+			return fmt.Errorf("host_routes[%d]: %w", i, err)
+		}
+		host := strings.ToLower(route.Host)
+		if seen[host] {
+			return fmt.Errorf("host_routes[%d]: duplicate host %s", i, route.Host)
+		}
+		seen[host] = true
+	}
+	return nil
+}
+
+// sniffProtocols lists the protocols a sniff route can match
+var sniffProtocols = map[string]bool{"tls": true, "ssh": true, "http": true, "dns": true}
+
+// Validate validates the fault injection settings
+func (c *ChaosConfig) Validate() error {
+	if c.Latency < 0 || c.Jitter < 0 {
+		return fmt.Errorf("latency and jitter must not be negative")
+	}
+	switch c.GetDistribution() {
+	case ChaosDistributionUniform, ChaosDistributionNormal:
+	default:
+		return fmt.Errorf("invalid distribution: %s (must be uniform or normal)", c.Distribution)
+	}
+	if c.Loss < 0 || c.Loss > 100 {
+		return fmt.Errorf("loss must be a percentage between 0 and 100")
+	}
+	if _, err := ParseBandwidth(c.Bandwidth); err != nil {
+		return fmt.Errorf("bandwidth: %w", err)
+	}
+	return nil
+}
+
+// Validate validates the media relay of a SIP listener
+func (s *SIPConfig) Validate(listenAddress string) error {
+	if s.MediaAddress != "" && net.ParseIP(s.MediaAddress) == nil {
+		return fmt.Errorf("invalid media_address: %s (must be an IP address)", s.MediaAddress)
+	}
+	if ip := s.MediaIP(listenAddress); ip == nil || ip.IsUnspecified() {
+		return fmt.Errorf("media_address is required when listening on all addresses")
+	}
+	if s.MediaPorts == "" {
+		return fmt.Errorf("media_ports is required")
+	}
+	first, last, err := s.MediaPortRange()
+	if err != nil {
+		return fmt.Errorf("media_ports: %w", err)
+	}
+	// Relays take ports in even/odd pairs, one pair per side of a stream
+	if first += first % 2; (last-first+1)/2 < 2 {
+		return fmt.Errorf("media_ports must hold at least two even/odd port pairs, one per side of a call")
+	}
+	if s.MediaTimeout < 0 {
+		return fmt.Errorf("media_timeout must be non-negative")
+	}
+	if s.MaxCalls < 0 {
+		return fmt.Errorf("max_calls must be non-negative")
+	}
+	return nil
+}
+
+// Validate validates the socket options
+func (s *SocketConfig) Validate() error {
+	for _, buffer := range []struct{ name, size string }{
+		{"receive_buffer", s.ReceiveBuffer},
+		{"send_buffer", s.SendBuffer},
+	} {
+		n, err := ParseBandwidth(buffer.size)
+		if err != nil {
+			return fmt.Errorf("%s: %w", buffer.name, err)
+		}
+		if n > math.MaxInt32 {
+			return fmt.Errorf("%s must be below 2GB", buffer.name)
+		}
+	}
+	if s.DSCP != "" {
+		if _, err := ParseDSCP(s.DSCP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate validates the protocol sniffing configuration
+func (s *SniffConfig) Validate() error {
+	if s.Timeout < 0 {
+		return fmt.Errorf("timeout must be non-negative")
+	}
+	if len(s.Routes) == 0 {
+		return fmt.Errorf("at least one route is required")
+	}
+	for i, route := range s.Routes {
+		if err := route.Validate(); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+	}
+	if s.TimeoutTarget != "" {
+		if err := validateTargetAddress(s.TimeoutTarget); err != nil {
+			return fmt.Errorf("invalid timeout_target: %w", err)
+		}
+	}
+	return nil
+}
+
+// Validate validates a protocol sniffing route
+func (r *SniffRoute) Validate() error {
+	set := 0
+	for _, v := range []string{r.Protocol, r.Prefix, r.PrefixHex} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of protocol, prefix or prefix_hex is required")
+	}
+	if r.Protocol != "" && !sniffProtocols[r.Protocol] {
+		return fmt.Errorf("invalid protocol: %s (must be tls, ssh, http or dns)", r.Protocol)
+	}
+	if r.PrefixHex != "" {
+		if _, err := hex.DecodeString(r.PrefixHex); err != nil {
+			return fmt.Errorf("invalid prefix_hex: %w", err)
+		}
+	}
+	if len(r.MatchPrefix()) > MaxSniffBytes {
+		return fmt.Errorf("prefix must not be longer than %d bytes", MaxSniffBytes)
+	}
+	if r.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if err := validateTargetAddress(r.Target); err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+	return nil
+}
+
+// Validate validates a payload signature
+func (s *Signature) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if (s.Pattern == "") == (s.PatternHex == "") {
+		return fmt.Errorf("exactly one of pattern or pattern_hex is required")
+	}
+	if s.PatternHex != "" {
+		pattern, err := hex.DecodeString(s.PatternHex)
+		if err != nil {
+			return fmt.Errorf("invalid pattern_hex: %w", err)
+		}
+		if len(pattern) == 0 {
+			return fmt.Errorf("pattern_hex must not be empty")
+		}
+	}
+	size := len(s.GetPattern())
+	if size > MaxSignatureBytes {
+		return fmt.Errorf("pattern is %d bytes (max %d)", size, MaxSignatureBytes)
+	}
+	if s.Offset < 0 {
+		return fmt.Errorf("offset must not be negative")
+	}
+	if s.Depth < 0 {
+		return fmt.Errorf("depth must not be negative")
+	}
+	if s.Depth > 0 && s.Depth < size {
+		return fmt.Errorf("depth (%d) must be at least the pattern length (%d)", s.Depth, size)
+	}
+	switch s.GetAction() {
+	case SignatureActionDrop, SignatureActionLog:
+	default:
+		return fmt.Errorf("invalid action: %s (must be drop or log)", s.Action)
+	}
+	return nil
+}
+
+// Validate validates a UDP packet rule
+func (r *PacketRule) Validate() error {
+	set := 0
+	for _, v := range []string{r.Prefix, r.PrefixHex, r.Regex} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of prefix, prefix_hex or regex is required")
+	}
+	if r.PrefixHex != "" {
+		if _, err := hex.DecodeString(r.PrefixHex); err != nil {
+			return fmt.Errorf("invalid prefix_hex: %w", err)
+		}
+	}
+	if r.Regex != "" {
+		if _, err := regexp.Compile(r.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	switch r.GetAction() {
+	case PacketActionRoute:
+		if r.Target == "" {
+			return fmt.Errorf("target is required for action %s", PacketActionRoute)
+		}
+		if err := validateTargetAddress(r.Target); err != nil {
+			return fmt.Errorf("invalid target: %w", err)
+		}
+	case PacketActionDrop:
+		if r.Target != "" {
+			return fmt.Errorf("target must not be set for action %s", PacketActionDrop)
+		}
+	default:
+		return fmt.Errorf("invalid action: %s (must be route or drop)", r.Action)
+	}
+	return nil
+}
+
+// Validate validates an HTTP host route
+func (r *HostRoute) Validate() error {
+	if r.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	name := strings.TrimPrefix(r.Host, "*.")
+	if name == "" || strings.ContainsAny(name, ":*/ ") || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".") {
+		return fmt.Errorf("invalid host: %q (must be a hostname or *.domain, without port)", r.Host)
+	}
+	if r.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if err := validateTargetAddress(r.Target); err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+	return nil
+}
+
 // Validate validates the UDP configuration
 func (u *UDPConfig) Validate() error {
 	if u.SessionTimeout <= 0 {
@@ -263,6 +1559,149 @@ func (u *UDPConfig) Validate() error {
 	if u.BufferSize > 65536 {
 		return fmt.Errorf("buffer_size must not exceed 65536 bytes")
 	}
+	if u.MaxSessions < 0 {
+		return fmt.Errorf("max_sessions must be non-negative")
+	}
+	if u.MaxSessionsPerIP < 0 {
+		return fmt.Errorf("max_sessions_per_ip must be non-negative")
+	}
+	if u.MaxConnectionDuration < 0 {
+		return fmt.Errorf("max_connection_duration must be non-negative")
+	}
+	if u.DialRetries < 0 || u.DialRetries > MaxDialRetries {
+		return fmt.Errorf("dial_retries must be between 0 and %d", MaxDialRetries)
+	}
+	if u.DialRetryBackoff < 0 || u.DialRetryBackoff > MaxDialRetryBackoff {
+		return fmt.Errorf("dial_retry_backoff must be between 0 and %s", MaxDialRetryBackoff)
+	}
+	if u.DialFailureBackoffMax < 0 {
+		return fmt.Errorf("dial_failure_backoff_max must be non-negative")
+	}
+	if u.DialFailureBackoffMax > 0 && u.DialFailureBackoffMax < u.GetDialFailureBackoff() {
+		return fmt.Errorf("dial_failure_backoff_max must not be below dial_failure_backoff")
+	}
+	if u.MaxReplySize < 0 || u.MaxReplySize >= u.BufferSize {
+		return fmt.Errorf("max_reply_size must be non-negative and below buffer_size (%d)", u.BufferSize)
+	}
+	switch u.OversizeReply {
+	case "", OversizeReplyDrop:
+	case OversizeReplyTruncate:
+		if u.MaxReplySize == 0 {
+			return fmt.Errorf("oversize_reply truncate requires max_reply_size")
+		}
+	default:
+		return fmt.Errorf("invalid oversize_reply: %s (must be drop or truncate)", u.OversizeReply)
+	}
+	if u.MaxRepliesPerRequest < 0 {
+		return fmt.Errorf("max_replies_per_request must be non-negative")
+	}
+	switch u.Oversize {
+	case "", OversizeFragment, OversizeDrop, OversizeClamp:
+	default:
+		return fmt.Errorf("invalid oversize: %s (must be fragment, drop or clamp)", u.Oversize)
+	}
+	if u.MTU != 0 && (u.MTU < MinMTU || u.MTU > 65535) {
+		return fmt.Errorf("mtu must be between %d and 65535", MinMTU)
+	}
+	if u.MTU != 0 && u.Oversize == "" {
+		return fmt.Errorf("mtu requires oversize to be set")
+	}
+	switch u.SessionKey {
+	case "", SessionKeyIPPort, SessionKeyIP, SessionKeyIPDSCP:
+		if u.SessionKeyOffset != 0 || u.SessionKeyLength != 0 {
+			return fmt.Errorf("session_key_offset and session_key_length require session_key: %s, %s or %s", SessionKeyPayload, SessionKeyDTLSCID, SessionKeyQUICCID)
+		}
+	case SessionKeyPayload:
+		if u.SessionKeyOffset < 0 || u.SessionKeyOffset >= u.BufferSize {
+			return fmt.Errorf("session_key_offset must be between 0 and buffer_size")
+		}
+		if u.SessionKeyLength <= 0 || u.SessionKeyLength > MaxSessionKeyLength {
+			return fmt.Errorf("session_key_length must be between 1 and %d", MaxSessionKeyLength)
+		}
+	case SessionKeyDTLSCID:
+		if u.SessionKeyOffset != 0 {
+			return fmt.Errorf("session_key_offset requires session_key: %s", SessionKeyPayload)
+		}
+		if u.SessionKeyLength <= 0 || u.SessionKeyLength > MaxSessionKeyLength {
+			return fmt.Errorf("session_key_length (the connection ID length) must be between 1 and %d", MaxSessionKeyLength)
+		}
+	case SessionKeyQUICCID:
+		if u.SessionKeyOffset != 0 {
+			return fmt.Errorf("session_key_offset requires session_key: %s", SessionKeyPayload)
+		}
+		if u.SessionKeyLength <= 0 || u.SessionKeyLength > MaxQUICConnectionIDLength {
+			return fmt.Errorf("session_key_length (the server connection ID length) must be between 1 and %d", MaxQUICConnectionIDLength)
+		}
+	default:
+		return fmt.Errorf("invalid session_key: %s (must be ip_port, ip, ip_dscp, payload, dtls_cid or quic_cid)", u.SessionKey)
+	}
+	if u.BatchSize < 0 || u.BatchSize > MaxUDPBatchSize {
+		return fmt.Errorf("batch_size must be between 0 and %d", MaxUDPBatchSize)
+	}
+	if u.HasAFXDP() {
+		if err := u.AFXDP.Validate(); err != nil {
+			return fmt.Errorf("af_xdp: %w", err)
+		}
+	}
+	if u.DenyResponse != nil {
+		if err := u.DenyResponse.Validate(); err != nil {
+			return fmt.Errorf("deny_response: %w", err)
+		}
+	}
+	return nil
+}
+
+// Validate validates the response to denied UDP clients
+func (d *UDPDenyResponseConfig) Validate() error {
+	switch d.Action {
+	case "", UDPDenyActionDrop, UDPDenyActionICMP:
+	case UDPDenyActionPayload:
+		if d.Payload == "" {
+			return fmt.Errorf("action payload requires a payload")
+		}
+	default:
+		return fmt.Errorf("invalid action: %s (must be drop, icmp or payload)", d.Action)
+	}
+	if len(d.Payload) > MaxUDPDenyPayloadSize {
+		return fmt.Errorf("payload must be at most %d bytes", MaxUDPDenyPayloadSize)
+	}
+	if d.MaxPerSecond < 0 {
+		return fmt.Errorf("max_per_second must be non-negative")
+	}
+	return nil
+}
+
+// Validate validates the AF_XDP configuration
+func (a *AFXDPConfig) Validate() error {
+	if a.Interface == "" {
+		return fmt.Errorf("interface is required")
+	}
+	seen := make(map[int]bool)
+	for _, queue := range a.Queues {
+		if queue < 0 {
+			return fmt.Errorf("queues must be non-negative")
+		}
+		if seen[queue] {
+			return fmt.Errorf("duplicate queue: %d", queue)
+		}
+		seen[queue] = true
+	}
+	if a.Frames != 0 && (a.Frames < MinAFXDPFrames || a.Frames > MaxAFXDPFrames || a.Frames&(a.Frames-1) != 0) {
+		return fmt.Errorf("frames must be a power of two between %d and %d", MinAFXDPFrames, MaxAFXDPFrames)
+	}
+	if a.SendBatch < 0 || a.SendBatch > MaxAFXDPSendBatch {
+		return fmt.Errorf("send_batch must be between 0 and %d", MaxAFXDPSendBatch)
+	}
+	return nil
+}
+
+// validateTags validates tag keys
+func validateTags(tags map[string]string) error {
+	for key := range tags {
+		if key == "" {
+			return fmt.Errorf("tag key must not be empty")
+		}
+	}
 	return nil
 }
 
@@ -302,6 +1741,32 @@ func validateAddress(addr string) error {
 	return nil
 }
 
+// validateTargetAddress validates a target address that may contain
+// {placeholder} references to client attributes
+func validateTargetAddress(addr string) error {
+	rest := addr
+	for {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			break
+		}
+		end := strings.Index(rest[open:], "}")
+		if end < 0 {
+			return fmt.Errorf("unterminated placeholder in %s", addr)
+		}
+		name := rest[open+1 : open+end]
+		if !TargetPlaceholders[name] {
+			return fmt.Errorf("unknown placeholder {%s}", name)
+		}
+		rest = rest[open+end+1:]
+	}
+	if strings.Contains(rest, "}") {
+		return fmt.Errorf("unbalanced braces in %s", addr)
+	}
+
+	return validateAddress(addr)
+}
+
 // validateCIDROrIP validates a CIDR range or single IP address
 func validateCIDROrIP(s string) error {
 	s = strings.TrimSpace(s)
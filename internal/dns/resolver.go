@@ -0,0 +1,169 @@
+// Package dns resolves target hostnames through configurable DNS servers,
+// caching answers and failures, so lookups behave the same on every host
+// regardless of its system resolver setup.
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// maxCacheSize bounds the number of cached hostnames
+const maxCacheSize = 10000
+
+// Resolver looks up hostnames with a positive and a negative cache
+type Resolver struct {
+	resolver    *net.Resolver
+	servers     []string
+	next        atomic.Uint64 // Server rotation
+	timeout     time.Duration
+	ttl         time.Duration
+	negativeTTL time.Duration
+	mu          sync.Mutex
+	cache       map[string]cacheEntry
+}
+
+// cacheEntry is a cached answer or failure
+type cacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// NewResolver creates a resolver. Without configured servers it queries
+// the system resolver.
+func NewResolver(cfg config.DNSConfig) *Resolver {
+	r := &Resolver{
+		resolver:    net.DefaultResolver,
+		servers:     cfg.GetServers(),
+		timeout:     cfg.GetTimeout(),
+		ttl:         cfg.GetCacheTTL(),
+		negativeTTL: cfg.GetNegativeTTL(),
+		cache:       make(map[string]cacheEntry),
+	}
+	if len(r.servers) > 0 {
+		r.resolver = &net.Resolver{PreferGo: true, Dial: r.dialServer}
+	}
+	return r
+}
+
+// dialServer connects to the next configured server, whatever server the
+// Go resolver asked for, so retries move through the list in turn
+func (r *Resolver) dialServer(ctx context.Context, network, _ string) (net.Conn, error) {
+	server := r.servers[(r.next.Add(1)-1)%uint64(len(r.servers))]
+	var d net.Dialer
+	return d.DialContext(ctx, network, server)
+}
+
+// LookupIP returns the addresses of host, from the cache while the last
+// answer or failure is fresh. IP literals are returned as is. A nil
+// resolver queries the system resolver without caching.
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if r == nil {
+		return net.LookupIP(host)
+	}
+
+	r.mu.Lock()
+	entry, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips, entry.err
+	}
+	return r.Refresh(host)
+}
+
+// Refresh looks up host bypassing the cache and caches the result
+func (r *Resolver) Refresh(host string) ([]net.IP, error) {
+	if r == nil {
+		return net.LookupIP(host)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	var ips []net.IP
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	var dnsErr *net.DNSError
+	if len(r.servers) > 0 && errors.As(err, &dnsErr) {
+		// The Go resolver names the resolv.conf server it meant to ask
+		named := *dnsErr
+		named.Server = strings.Join(r.servers, ",")
+		err = &named
+	}
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses for %s", host)
+	}
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+
+	entry := cacheEntry{ips: ips, err: err, expires: time.Now().Add(r.ttl)}
+	if err != nil {
+		entry.ips = nil
+		entry.expires = time.Now().Add(r.negativeTTL)
+	}
+	r.mu.Lock()
+	if len(r.cache) >= maxCacheSize {
+		r.cache = make(map[string]cacheEntry)
+	}
+	r.cache[host] = entry
+	r.mu.Unlock()
+
+	return entry.ips, err
+}
+
+// Dial connects to addr, resolving a hostname through the resolver. Like
+// net.Dial, the addresses are tried in order until one connects, each
+// with an equal share of the time left.
+func (r *Resolver) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	return r.DialWith(&net.Dialer{Timeout: timeout}, network, addr)
+}
+
+// DialWith is like Dial but connects with dialer, whose non-zero Timeout
+// bounds the whole dial
+func (r *Resolver) DialWith(dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.Dial(network, addr)
+	}
+
+	deadline := time.Now().Add(dialer.Timeout)
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	attempt := *dialer
+	var firstErr error
+	for i, ip := range ips {
+		if dialer.Timeout > 0 {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				break
+			}
+			attempt.Timeout = remaining / time.Duration(len(ips)-i)
+		}
+		conn, err := attempt.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("dial %s %s: timeout", network, addr)
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,196 @@
+// Package dnswire reads the header and first question of DNS messages, and
+// matches responses to the queries of a UDP session, for transaction
+// logging. Messages are never validated or modified.
+package dnswire
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrMalformed is returned for datagrams that are not DNS messages
+var ErrMalformed = errors.New("malformed DNS message")
+
+const (
+	headerLen   = 12
+	maxNameLen  = 255 // Presentation length limit of a domain name
+	maxPointers = 16  // Compression pointers followed before giving up
+)
+
+// Message is the header and first question of a DNS message
+type Message struct {
+	ID       uint16
+	Response bool
+	Opcode   uint8
+	RCode    uint8  // Header RCODE, without the EDNS extension
+	QName    string // Lower case, with a trailing dot; "." for the root
+	QType    uint16
+}
+
+// Parse reads the header and first question of b
+func Parse(b []byte) (Message, error) {
+	if len(b) < headerLen {
+		return Message{}, ErrMalformed
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	m := Message{
+		ID:       binary.BigEndian.Uint16(b),
+		Response: flags&0x8000 != 0,
+		Opcode:   uint8(flags>>11) & 0x0f,
+		RCode:    uint8(flags) & 0x0f,
+	}
+	if binary.BigEndian.Uint16(b[4:]) == 0 {
+		// No question, as in some responses and NOTIFY acknowledgements
+		return m, nil
+	}
+	name, off, err := readName(b, headerLen)
+	if err != nil {
+		return Message{}, err
+	}
+	if off+4 > len(b) {
+		return Message{}, ErrMalformed
+	}
+	m.QName = name
+	m.QType = binary.BigEndian.Uint16(b[off:])
+	return m, nil
+}
+
+// readName reads the domain name at off and returns it with the offset
+// following it. Compression pointers are followed.
+func readName(b []byte, off int) (string, int, error) {
+	var name strings.Builder
+	end := -1 // Offset after the name, once a pointer was followed
+	for pointers := 0; ; {
+		if off >= len(b) {
+			return "", 0, ErrMalformed
+		}
+		length := int(b[off])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			if name.Len() == 0 {
+				return ".", end, nil
+			}
+			return strings.ToLower(name.String()), end, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(b) || pointers == maxPointers {
+				return "", 0, ErrMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			pointers++
+		case length&0xc0 != 0:
+			return "", 0, ErrMalformed // Obsolete label types
+		default:
+			if off+1+length > len(b) || name.Len()+length+1 > maxNameLen {
+				return "", 0, ErrMalformed
+			}
+			name.Write(b[off+1 : off+1+length])
+			name.WriteByte('.')
+			off += 1 + length
+		}
+	}
+}
+
+// typeNames are the record types reported by name
+var typeNames = map[uint16]string{
+	1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 12: "PTR", 13: "HINFO", 15: "MX",
+	16: "TXT", 28: "AAAA", 33: "SRV", 35: "NAPTR", 41: "OPT", 43: "DS",
+	46: "RRSIG", 47: "NSEC", 48: "DNSKEY", 50: "NSEC3", 52: "TLSA",
+	64: "SVCB", 65: "HTTPS", 99: "SPF", 251: "IXFR", 252: "AXFR", 255: "ANY",
+	257: "CAA",
+}
+
+// TypeName returns the mnemonic of a record type, or TYPEn for types
+// without one (RFC 3597)
+func TypeName(t uint16) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// KnownType reports whether TypeName has a mnemonic for t
+func KnownType(t uint16) bool {
+	_, ok := typeNames[t]
+	return ok
+}
+
+// rcodeNames are the header response codes
+var rcodeNames = [16]string{
+	"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED",
+	"YXDOMAIN", "YXRRSET", "NXRRSET", "NOTAUTH", "NOTZONE", "DSOTYPENI",
+}
+
+// RCodeName returns the mnemonic of a header response code, or RCODEn
+// for unassigned codes
+func RCodeName(r uint8) string {
+	if int(r) < len(rcodeNames) && rcodeNames[r] != "" {
+		return rcodeNames[r]
+	}
+	return "RCODE" + strconv.Itoa(int(r))
+}
+
+// Tracker limits. Queries that are never answered are forgotten once the
+// tracker is full and they are older than staleAfter.
+const (
+	MaxPending = 1024
+	staleAfter = 10 * time.Second
+)
+
+// Query is a query waiting for its response
+type Query struct {
+	QName string
+	QType uint16
+	Sent  time.Time
+}
+
+// Tracker matches the responses of one session to its queries by message
+// ID. It is safe for concurrent use.
+type Tracker struct {
+	mu      sync.Mutex
+	pending map[uint16]Query
+}
+
+// NewTracker creates an empty tracker
+func NewTracker() *Tracker {
+	return &Tracker{pending: make(map[uint16]Query)}
+}
+
+// Query records a query sent at now. Returns false if it is not tracked
+// because too many queries are waiting.
+func (t *Tracker) Query(m Message, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) >= MaxPending {
+		for id, q := range t.pending {
+			if now.Sub(q.Sent) > staleAfter {
+				delete(t.pending, id)
+			}
+		}
+		if len(t.pending) >= MaxPending {
+			return false
+		}
+	}
+	t.pending[m.ID] = Query{QName: m.QName, QType: m.QType, Sent: now}
+	return true
+}
+
+// Answer returns and forgets the query a response answers
+func (t *Tracker) Answer(m Message) (Query, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, ok := t.pending[m.ID]
+	if ok {
+		delete(t.pending, m.ID)
+	}
+	return q, ok
+}
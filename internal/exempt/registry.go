@@ -0,0 +1,415 @@
+// Package exempt manages time-limited rate limit exemptions. An operator
+// issues a token through the admin API; presenting the token registers a
+// client IP, which is then exempt from per-client rate limits and bans until
+// the token expires. Every change is written to the audit log, and to a
+// storage.Store so instances sharing it see the same exemptions.
+package exempt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/storage"
+)
+
+const (
+	// cleanupInterval is how often expired exemptions are removed
+	cleanupInterval = 10 * time.Second
+	// syncInterval is how often exemptions issued, registered or revoked
+	// by other instances sharing the store are picked up
+	syncInterval = 5 * time.Second
+	// keyPrefix is the store key prefix of exemptions
+	keyPrefix = "exemption/"
+)
+
+// Errors returned by the registry
+var (
+	ErrUnknownToken = errors.New("unknown or expired token")
+	ErrTokenUsed    = errors.New("token is already registered to another IP")
+	ErrNotFound     = errors.New("exemption not found")
+)
+
+// Exemption is an issued exemption token. IP is empty until the token is
+// registered; Listener is empty if the exemption applies to all listeners.
+type Exemption struct {
+	ID        string    `json:"id"`
+	Listener  string    `json:"listener,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Reason    string    `json:"reason"`
+	IssuedBy  string    `json:"issued_by"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	tokenHash string
+}
+
+// storedExemption is an exemption as kept in the store
+type storedExemption struct {
+	Exemption
+	TokenHash string `json:"token_hash"`
+}
+
+// Registry holds issued exemptions
+type Registry struct {
+	mu          sync.RWMutex
+	maxTTL      time.Duration
+	byID        map[string]*Exemption
+	byToken     map[string]*Exemption // SHA-256 of the token -> exemption
+	byIP        map[string][]*Exemption
+	stored      map[string]time.Time // ID -> when it was last known to be in the store
+	store       storage.Store
+	logger      logging.Logger
+	stopCleanup chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewRegistry creates an exemption registry that refuses tokens valid for
+// longer than maxTTL. Exemptions are stored in store, and exemptions
+// already in the store are loaded.
+func NewRegistry(maxTTL time.Duration, store storage.Store, logger logging.Logger) *Registry {
+	r := &Registry{
+		maxTTL:      maxTTL,
+		byID:        make(map[string]*Exemption),
+		byToken:     make(map[string]*Exemption),
+		byIP:        make(map[string][]*Exemption),
+		stored:      make(map[string]time.Time),
+		store:       store,
+		logger:      logger,
+		stopCleanup: make(chan struct{}),
+	}
+
+	// Restore exemptions from a previous run or another instance
+	r.sync()
+
+	go r.cleanupLoop()
+
+	return r
+}
+
+// Issue creates a new exemption token valid for ttl. The token is only
+// returned here; the registry keeps a hash of it.
+func (r *Registry) Issue(listener string, ttl time.Duration, reason, issuedBy, actor string) (Exemption, string, error) {
+	if ttl <= 0 {
+		return Exemption{}, "", fmt.Errorf("ttl must be positive")
+	}
+	if ttl > r.maxTTL {
+		return Exemption{}, "", fmt.Errorf("ttl %s exceeds the maximum of %s", ttl, r.maxTTL)
+	}
+
+	token := randomHex(16)
+	now := time.Now()
+	e := &Exemption{
+		ID:        randomHex(4),
+		Listener:  listener,
+		Reason:    reason,
+		IssuedBy:  issuedBy,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(ttl),
+		tokenHash: hashToken(token),
+	}
+
+	r.mu.Lock()
+	r.byID[e.ID] = e
+	r.byToken[e.tokenHash] = e
+	r.mu.Unlock()
+
+	r.persist(*e)
+	r.audit(logging.EventExemptionIssued, e, actor)
+	return *e, token, nil
+}
+
+// Register binds a token to a client IP. Registering the same IP again is
+// allowed; a token cannot be moved to a different IP.
+func (r *Registry) Register(token, ip, actor string) (Exemption, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Exemption{}, fmt.Errorf("invalid IP address: %s", ip)
+	}
+	ip = parsed.String()
+
+	r.mu.Lock()
+	e, exists := r.byToken[hashToken(token)]
+	if !exists || !time.Now().Before(e.ExpiresAt) {
+		r.mu.Unlock()
+		return Exemption{}, ErrUnknownToken
+	}
+	if e.IP != "" && e.IP != ip {
+		r.mu.Unlock()
+		return Exemption{}, ErrTokenUsed
+	}
+	registered := e.IP == ""
+	if registered {
+		e.IP = ip
+		r.byIP[ip] = append(r.byIP[ip], e)
+	}
+	result := *e
+	r.mu.Unlock()
+
+	if registered {
+		r.persist(result)
+		r.audit(logging.EventExemptionRegistered, &result, actor)
+	}
+	return result, nil
+}
+
+// Revoke removes an exemption before it expires
+func (r *Registry) Revoke(id, actor string) error {
+	r.mu.Lock()
+	e, exists := r.byID[id]
+	if !exists {
+		r.mu.Unlock()
+		return ErrNotFound
+	}
+	r.remove(e)
+	r.mu.Unlock()
+
+	if r.store != nil {
+		if err := r.store.Delete(keyPrefix + id); err != nil {
+			r.storeError(err)
+		}
+	}
+	r.audit(logging.EventExemptionRevoked, e, actor)
+	return nil
+}
+
+// IsExempt reports whether ip holds a registered, unexpired exemption for
+// the listener
+func (r *Registry) IsExempt(listener, ip string) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	for _, e := range r.byIP[ip] {
+		if (e.Listener == "" || e.Listener == listener) && now.Before(e.ExpiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checker returns an exemption check bound to a listener, or nil if r is nil
+func (r *Registry) Checker(listener string) func(ip string) bool {
+	if r == nil {
+		return nil
+	}
+	return func(ip string) bool {
+		return r.IsExempt(listener, ip)
+	}
+}
+
+// List returns all active exemptions, oldest first
+func (r *Registry) List() []Exemption {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	result := make([]Exemption, 0, len(r.byID))
+	for _, e := range r.byID {
+		if now.Before(e.ExpiresAt) {
+			result = append(result, *e)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].IssuedAt.Before(result[j].IssuedAt)
+	})
+	return result
+}
+
+// persist writes an exemption to the store
+func (r *Registry) persist(e Exemption) {
+	if r.store == nil {
+		return
+	}
+	value, err := json.Marshal(storedExemption{Exemption: e, TokenHash: e.tokenHash})
+	if err != nil {
+		return
+	}
+	if err := r.store.Set(keyPrefix+e.ID, value, time.Until(e.ExpiresAt)); err != nil {
+		r.storeError(err)
+		return
+	}
+
+	r.mu.Lock()
+	if _, exists := r.byID[e.ID]; exists {
+		r.stored[e.ID] = time.Now()
+	}
+	r.mu.Unlock()
+}
+
+// sync merges exemptions from the store into the registry. Exemptions
+// that were in the store and are gone from it were revoked by another
+// instance.
+func (r *Registry) sync() {
+	if r.store == nil {
+		return
+	}
+
+	now := time.Now()
+	stored := make(map[string]storedExemption)
+	err := r.store.Scan(keyPrefix, func(key string, value []byte) bool {
+		var se storedExemption
+		if json.Unmarshal(value, &se) == nil && se.ID != "" && now.Before(se.ExpiresAt) {
+			stored[se.ID] = se
+		}
+		return true
+	})
+	if err != nil {
+		r.storeError(err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, se := range stored {
+		r.stored[id] = now
+		e, exists := r.byID[id]
+		if !exists {
+			copied := se.Exemption
+			copied.IP = "" // Indexed below
+			copied.tokenHash = se.TokenHash
+			e = &copied
+			r.byID[id] = e
+			r.byToken[e.tokenHash] = e
+		}
+		if e.IP == "" && se.IP != "" {
+			e.IP = se.IP
+			r.byIP[e.IP] = append(r.byIP[e.IP], e)
+		}
+	}
+
+	// Exemptions stored after the scan started may be missing from it
+	for id, seen := range r.stored {
+		if _, exists := stored[id]; exists || !seen.Before(now) {
+			continue
+		}
+		delete(r.stored, id)
+		if e, exists := r.byID[id]; exists {
+			r.remove(e)
+		}
+	}
+}
+
+// storeError logs a storage failure. Exemptions keep applying locally
+// while the store is unavailable.
+func (r *Registry) storeError(err error) {
+	r.logger.LogError(logging.EventExemptionStorageError, map[string]interface{}{
+		"error": err.Error(),
+	})
+}
+
+// remove deletes an exemption from all indexes. Caller must hold the lock.
+func (r *Registry) remove(e *Exemption) {
+	delete(r.byID, e.ID)
+	delete(r.stored, e.ID)
+	delete(r.byToken, e.tokenHash)
+	if e.IP == "" {
+		return
+	}
+
+	remaining := r.byIP[e.IP][:0]
+	for _, other := range r.byIP[e.IP] {
+		if other != e {
+			remaining = append(remaining, other)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(r.byIP, e.IP)
+	} else {
+		r.byIP[e.IP] = remaining
+	}
+}
+
+// cleanupLoop periodically removes expired exemptions and picks up
+// changes made by other instances
+func (r *Registry) cleanupLoop() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	syncTicker := time.NewTicker(syncInterval)
+	defer syncTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.cleanup()
+		case <-syncTicker.C:
+			r.sync()
+		case <-r.stopCleanup:
+			return
+		}
+	}
+}
+
+// cleanup removes expired exemptions and audits each expiry
+func (r *Registry) cleanup() {
+	now := time.Now()
+	var expired []*Exemption
+
+	r.mu.Lock()
+	for _, e := range r.byID {
+		if !now.Before(e.ExpiresAt) {
+			r.remove(e)
+			expired = append(expired, e)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, e := range expired {
+		r.audit(logging.EventExemptionExpired, e, "")
+	}
+}
+
+// audit logs an exemption lifecycle event
+func (r *Registry) audit(ev logging.Event, e *Exemption, actor string) {
+	fields := map[string]interface{}{
+		"exemption_id": e.ID,
+		"reason":       e.Reason,
+		"issued_by":    e.IssuedBy,
+		"expires_at":   e.ExpiresAt.Format(time.RFC3339),
+	}
+	if e.Listener != "" {
+		fields["listener"] = e.Listener
+	}
+	if e.IP != "" {
+		fields["client_ip"] = e.IP
+	}
+	if actor != "" {
+		fields["actor"] = actor
+	}
+	r.logger.LogWarning(ev, fields)
+}
+
+// Close stops the cleanup goroutine
+func (r *Registry) Close() {
+	if r == nil {
+		return
+	}
+	r.closeOnce.Do(func() {
+		close(r.stopCleanup)
+	})
+}
+
+// randomHex returns n random bytes hex-encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// hashToken returns the lookup key for a token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
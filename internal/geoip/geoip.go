@@ -0,0 +1,66 @@
+// Package geoip looks up the country of client addresses in a MaxMind
+// database (GeoLite2 or GeoIP2, Country or City edition).
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB is an open country database
+type DB struct {
+	reader *maxminddb.Reader
+}
+
+// countryRecord holds the fields of a lookup that matter here
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Open opens the database at path. Databases without country data, such
+// as ASN editions, are refused.
+func Open(path string) (*DB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database %s: %w", path, err)
+	}
+	dbType := reader.Metadata.DatabaseType
+	if !strings.Contains(dbType, "Country") && !strings.Contains(dbType, "City") {
+		reader.Close()
+		return nil, fmt.Errorf("GeoIP database %s is a %s database without country data", path, dbType)
+	}
+	return &DB{reader: reader}, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country ip is in, or
+// of the country it is registered to if that is unknown. Returns "" for
+// addresses not in the database. A nil database knows no addresses.
+func (d *DB) Country(ip net.IP) string {
+	if d == nil {
+		return ""
+	}
+	var record countryRecord
+	if err := d.reader.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+// Close closes the database. A nil database does nothing.
+func (d *DB) Close() error {
+	if d == nil {
+		return nil
+	}
+	return d.reader.Close()
+}
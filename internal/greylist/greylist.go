@@ -0,0 +1,232 @@
+// Package greylist holds back the flows of clients a listener has not seen
+// before. A new client is served once it has waited out a delay since its
+// first flow, so scanners that give up on a slow or refused first attempt
+// never get through, while real clients wait or retry. Clients that got
+// through are known, and served at once from then on. Known clients are
+// kept in the state storage, so that they survive restarts and are shared
+// by instances using the same store; new clients are tracked in memory.
+package greylist
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/storage"
+)
+
+// Results of checking a client
+const (
+	ResultKnown  = "known"  // Seen before, served at once
+	ResultPassed = "passed" // Waited out its delay; served, and known from now on
+	ResultNew    = "new"    // First flow of a new client
+	ResultHeld   = "held"   // Later flow of a new client still within its delay
+)
+
+// cleanupInterval is how often clients that expired are forgotten
+const cleanupInterval = time.Minute
+
+// idleTimeout is how long a known client is kept in memory after its last
+// flow. It stays in the store, and is read back when it returns.
+const idleTimeout = time.Hour
+
+// knownClient is a client that got through
+type knownClient struct {
+	lastSeen time.Time
+	stored   time.Time // When it was last written to the store
+}
+
+// List tracks the new and known clients of one listener
+type List struct {
+	store       storage.Store
+	prefix      string // Store key prefix, ending in "/"
+	delay       time.Duration
+	retryWindow time.Duration
+	remember    time.Duration
+	maxPending  int
+
+	mu      sync.Mutex
+	pending map[string]time.Time // New client -> its first flow
+	known   map[string]*knownClient
+	onError func(err error)
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates the greylist of a listener and starts forgetting expired
+// clients. Returns nil if greylisting is disabled.
+func New(listener string, cfg *config.GreylistConfig, store storage.Store) *List {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	l := &List{
+		store:       store,
+		prefix:      "greylist/" + listener + "/",
+		delay:       cfg.GetDelay(),
+		retryWindow: cfg.GetRetryWindow(),
+		remember:    cfg.GetRemember(),
+		maxPending:  cfg.GetMaxPending(),
+		pending:     make(map[string]time.Time),
+		known:       make(map[string]*knownClient),
+		stop:        make(chan struct{}),
+	}
+
+	go l.cleanupLoop()
+
+	return l
+}
+
+// OnStoreError registers a callback for failures to read or write known
+// clients. While the store is unavailable, clients it would know are
+// treated as new.
+func (l *List) OnStoreError(fn func(err error)) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onError = fn
+}
+
+// Check records a flow of the client and returns how it is treated. For
+// new clients it also returns how long their delay has left to run. A
+// client's first flow starts its delay; the first flow after the delay,
+// and within the retry window, makes it known.
+func (l *List) Check(ip string) (string, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	if k := l.known[ip]; k != nil && now.Sub(k.lastSeen) < l.remember {
+		k.lastSeen = now
+		// The store keeps the client for remember after it was written;
+		// write it again well before that runs out
+		refresh := now.Sub(k.stored) >= l.remember/4
+		if refresh {
+			k.stored = now
+		}
+		l.mu.Unlock()
+		if refresh {
+			l.persist(ip, now)
+		}
+		return ResultKnown, 0
+	}
+	if first, ok := l.pending[ip]; ok && now.Sub(first) < l.retryWindow {
+		if wait := first.Add(l.delay).Sub(now); wait > 0 {
+			l.mu.Unlock()
+			return ResultHeld, wait
+		}
+		delete(l.pending, ip)
+		l.known[ip] = &knownClient{lastSeen: now, stored: now}
+		l.mu.Unlock()
+		l.persist(ip, now)
+		return ResultPassed, 0
+	}
+	l.mu.Unlock()
+
+	// Clients may be known from before a restart, or to another instance
+	if l.lookup(ip) {
+		l.mu.Lock()
+		l.known[ip] = &knownClient{lastSeen: now, stored: now}
+		l.mu.Unlock()
+		l.persist(ip, now)
+		return ResultKnown, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Another flow of the client may have started its delay meanwhile
+	if first, ok := l.pending[ip]; ok && now.Sub(first) < l.retryWindow {
+		return ResultHeld, max(first.Add(l.delay).Sub(now), 0)
+	}
+
+	// Beyond max_pending, new clients are held back without being tracked,
+	// so each of their flows starts over
+	if len(l.pending) < l.maxPending {
+		l.pending[ip] = now
+	}
+	return ResultNew, l.delay
+}
+
+// lookup reports whether the store knows the client
+func (l *List) lookup(ip string) bool {
+	if l.store == nil {
+		return false
+	}
+	_, ok, err := l.store.Get(l.prefix + ip)
+	if err != nil {
+		l.storeError(err)
+		return false
+	}
+	return ok
+}
+
+// persist writes a known client to the store, to expire remember after
+// its last flow
+func (l *List) persist(ip string, seen time.Time) {
+	if l.store == nil {
+		return
+	}
+	value := strconv.FormatInt(seen.UnixNano(), 10)
+	if err := l.store.Set(l.prefix+ip, []byte(value), l.remember); err != nil {
+		l.storeError(err)
+	}
+}
+
+// storeError reports a storage failure to the registered callback
+func (l *List) storeError(err error) {
+	l.mu.Lock()
+	fn := l.onError
+	l.mu.Unlock()
+	if fn != nil {
+		fn(err)
+	}
+}
+
+// cleanupLoop periodically forgets expired clients
+func (l *List) cleanupLoop() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.cleanup()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// cleanup forgets new clients whose retry window has passed, and known
+// clients idle for longer than they are kept in memory
+func (l *List) cleanup() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for ip, first := range l.pending {
+		if now.Sub(first) >= l.retryWindow {
+			delete(l.pending, ip)
+		}
+	}
+	idle := min(idleTimeout, l.remember)
+	for ip, k := range l.known {
+		if now.Sub(k.lastSeen) >= idle {
+			delete(l.known, ip)
+		}
+	}
+}
+
+// Close stops the cleanup goroutine
+func (l *List) Close() {
+	if l == nil {
+		return
+	}
+	l.closeOnce.Do(func() {
+		close(l.stop)
+	})
+}
@@ -0,0 +1,342 @@
+// Package handover passes listening sockets to a new packetpony process so
+// the binary can be upgraded without dropping connections.
+//
+// Sockets are opened through Listen and ListenUDP, which reuse a socket
+// inherited from the previous process when one with the same name and
+// address exists. Upgrade re-executes the binary with all open sockets as
+// extra file descriptors and waits for the new process to call Ready.
+// Sockets passed by systemd socket activation (LISTEN_FDS) are matched to
+// listeners by name or address in the same way.
+package handover
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables used to hand sockets to the new process
+const (
+	envInheritFDs = "PACKETPONY_INHERIT_FDS" // name=fd,name=fd with query-escaped names
+	envReadyFD    = "PACKETPONY_READY_FD"
+)
+
+// filer is implemented by TCP listeners and UDP connections
+type filer interface {
+	File() (*os.File, error)
+}
+
+var (
+	mu        sync.Mutex
+	parseOnce sync.Once
+	inherited = make(map[string]*os.File) // sockets passed in by the previous process
+	active    = make(map[string]filer)    // sockets to pass on at the next upgrade
+)
+
+// unixPrefix marks an address as the path of a Unix socket
+const unixPrefix = "unix:"
+
+// Listen returns a TCP listener for addr, or a Unix socket listener for
+// unix: and a path, reusing an inherited socket registered under name if
+// its address matches, or a systemd socket
+func Listen(name, addr string) (net.Listener, error) {
+	if f := take(name); f != nil {
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err == nil {
+			if sameAddress(ln.Addr(), addr) {
+				register(name, ln.(filer))
+				return ln, nil
+			}
+			ln.Close()
+		}
+	}
+
+	if sock := takeActivated(name, addr, true); sock != nil {
+		register(name, sock.ln.(filer))
+		return sock.ln, nil
+	}
+
+	ln, err := listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	register(name, ln.(filer))
+	return ln, nil
+}
+
+// listen binds a new socket for addr. A Unix socket file left behind by
+// an earlier run is replaced unless something still accepts on it. The
+// file stays when the listener closes, so that a process it was handed to
+// remains reachable.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	return ln, nil
+}
+
+// ListenUDP returns a UDP socket for addr, reusing an inherited socket
+// registered under name if its address matches, or a systemd socket
+func ListenUDP(name, addr string) (*net.UDPConn, error) {
+	if f := take(name); f != nil {
+		pc, err := net.FilePacketConn(f)
+		f.Close()
+		if err == nil {
+			if conn, ok := pc.(*net.UDPConn); ok && sameAddress(conn.LocalAddr(), addr) {
+				register(name, conn)
+				return conn, nil
+			}
+			pc.Close()
+		}
+	}
+
+	if sock := takeActivated(name, addr, false); sock != nil {
+		if conn, ok := sock.pc.(*net.UDPConn); ok {
+			register(name, conn)
+			return conn, nil
+		}
+		sock.pc.Close()
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	register(name, conn)
+	return conn, nil
+}
+
+// Inherited reports whether this process was started by an upgrade
+func Inherited() bool {
+	return os.Getenv(envReadyFD) != ""
+}
+
+// Ready tells the previous process that startup finished, so it can begin
+// draining, and closes inherited and systemd sockets no listener claimed.
+// Signalling is a no-op when the process was not started by an upgrade.
+func Ready() error {
+	mu.Lock()
+	for name, f := range inherited {
+		f.Close()
+		delete(inherited, name)
+	}
+	closeUnclaimed()
+	mu.Unlock()
+
+	fdStr := os.Getenv(envReadyFD)
+	if fdStr == "" {
+		return nil
+	}
+	os.Unsetenv(envReadyFD)
+	os.Unsetenv(envInheritFDs)
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", envReadyFD, fdStr)
+	}
+	pipe := os.NewFile(uintptr(fd), "ready")
+	defer pipe.Close()
+
+	if _, err := pipe.Write([]byte{1}); err != nil {
+		return fmt.Errorf("failed to signal readiness: %w", err)
+	}
+	return nil
+}
+
+// Upgrade starts a new instance of the current binary with the same
+// arguments, passing it all open sockets. It waits up to timeout for the
+// new process to call Ready, killing it on failure.
+func Upgrade(timeout time.Duration) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create readiness pipe: %w", err)
+	}
+	defer readyR.Close()
+
+	// fds 0-2 are stdio; extra files start at 3
+	files := []*os.File{readyW}
+	var mapping []string
+
+	mu.Lock()
+	for name, sock := range active {
+		f, err := sock.File()
+		if err != nil {
+			continue // closed since it was registered
+		}
+		files = append(files, f)
+		mapping = append(mapping, fmt.Sprintf("%s=%d", url.QueryEscape(name), 2+len(files)))
+	}
+	mu.Unlock()
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(filterEnv(os.Environ(), envInheritFDs, envReadyFD),
+		envReadyFD+"=3",
+		envInheritFDs+"="+strings.Join(mapping, ","),
+	)
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start new process: %w", err)
+	}
+
+	// Close our copy of the write end so a crashing child yields EOF
+	readyW.Close()
+	files = files[1:]
+
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, fmt.Errorf("new process failed to start: %w", err)
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.New("timed out waiting for new process")
+	}
+
+	// The child outlives us; reap it in the background while we drain
+	go cmd.Wait()
+
+	return cmd.Process, nil
+}
+
+// take removes and returns the inherited socket for name, if any
+func take(name string) *os.File {
+	parseOnce.Do(parseInherited)
+
+	mu.Lock()
+	defer mu.Unlock()
+	f := inherited[name]
+	delete(inherited, name)
+	return f
+}
+
+// register records a socket to hand over at the next upgrade
+func register(name string, sock filer) {
+	mu.Lock()
+	defer mu.Unlock()
+	active[name] = sock
+}
+
+// parseInherited reads the socket mapping from the environment
+func parseInherited() {
+	mapping := os.Getenv(envInheritFDs)
+	if mapping == "" {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, pair := range strings.Split(mapping, ",") {
+		escaped, fdStr, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		name, err := url.QueryUnescape(escaped)
+		if err != nil {
+			continue
+		}
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			continue
+		}
+		inherited[name] = os.NewFile(uintptr(fd), name)
+	}
+}
+
+// sameAddress reports whether a bound address satisfies a configured one.
+// Unspecified hosts (0.0.0.0, ::, empty) are treated as equivalent; Unix
+// sockets match by path.
+func sameAddress(bound net.Addr, configured string) bool {
+	if path, ok := strings.CutPrefix(configured, unixPrefix); ok {
+		return bound.Network() == "unix" && bound.String() == path
+	}
+
+	host, port, err := net.SplitHostPort(configured)
+	if err != nil {
+		return false
+	}
+	boundHost, boundPort, err := net.SplitHostPort(bound.String())
+	if err != nil || boundPort != port {
+		return false
+	}
+
+	want := net.ParseIP(host)
+	have := net.ParseIP(boundHost)
+	if host == "" || (want != nil && want.IsUnspecified()) {
+		return have != nil && have.IsUnspecified()
+	}
+	if want == nil {
+		// Hostname: compare against its resolved address
+		resolved, err := net.ResolveIPAddr("ip", host)
+		return err == nil && resolved.IP.Equal(have)
+	}
+	return want.Equal(have)
+}
+
+// filterEnv returns env without the named variables
+func filterEnv(env []string, names ...string) []string {
+	filtered := make([]string, 0, len(env))
+	for _, kv := range env {
+		keep := true
+		for _, name := range names {
+			if strings.HasPrefix(kv, name+"=") {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered
+}
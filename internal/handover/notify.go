@@ -0,0 +1,28 @@
+package handover
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// Notify sends a state update to systemd (sd_notify), e.g. "READY=1" or
+// "MAINPID=1234". It is a no-op when not running under a notify-type unit.
+func Notify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:] // abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,136 @@
+package handover
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Environment variables set by systemd for socket activation (sd_listen_fds)
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+	listenFDsStart   = 3
+)
+
+// activatedSocket is a socket passed in by systemd
+type activatedSocket struct {
+	name string // FileDescriptorName= from the socket unit
+	ln   net.Listener
+	pc   net.PacketConn
+}
+
+// addr returns the socket's bound address
+func (s *activatedSocket) addr() net.Addr {
+	if s.ln != nil {
+		return s.ln.Addr()
+	}
+	return s.pc.LocalAddr()
+}
+
+var (
+	systemdOnce sync.Once
+	activated   []*activatedSocket // systemd sockets not yet claimed
+)
+
+// parseSystemd picks up sockets passed by systemd socket activation. The
+// variables are cleared so they do not leak into an upgraded process.
+func parseSystemd() {
+	pid, err := strconv.Atoi(os.Getenv(envListenPID))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv(envListenFDNames), ":")
+
+	os.Unsetenv(envListenPID)
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenFDNames)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < count; i++ {
+		sock := &activatedSocket{}
+		if i < len(names) {
+			sock.name = names[i]
+		}
+
+		// net.File* duplicate the descriptor, so the original is closed below
+		f := os.NewFile(uintptr(listenFDsStart+i), sock.name)
+		if ln, err := net.FileListener(f); err == nil {
+			sock.ln = ln
+		} else if pc, err := net.FilePacketConn(f); err == nil {
+			sock.pc = pc
+		}
+		f.Close()
+
+		if sock.ln != nil || sock.pc != nil {
+			activated = append(activated, sock)
+		}
+	}
+}
+
+// takeActivated removes and returns the systemd socket for a listener.
+// A socket whose name matches (with or without the "listener/" prefix) is
+// used as-is; otherwise an unnamed socket is matched by address.
+func takeActivated(name, addr string, stream bool) *activatedSocket {
+	systemdOnce.Do(parseSystemd)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	match := -1
+	for i, sock := range activated {
+		if (sock.ln != nil) != stream {
+			continue
+		}
+		if sock.name == name || sock.name == strings.TrimPrefix(name, "listener/") {
+			match = i
+			break
+		}
+		if match < 0 && sameAddress(sock.addr(), addr) {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil
+	}
+
+	sock := activated[match]
+	activated = append(activated[:match], activated[match+1:]...)
+	return sock
+}
+
+// Unclaimed returns the systemd sockets no listener matched, as
+// "name (address)" descriptions
+func Unclaimed() []string {
+	systemdOnce.Do(parseSystemd)
+
+	mu.Lock()
+	defer mu.Unlock()
+	result := make([]string, 0, len(activated))
+	for _, sock := range activated {
+		result = append(result, fmt.Sprintf("%s (%s)", sock.name, sock.addr()))
+	}
+	return result
+}
+
+// closeUnclaimed closes systemd sockets no listener matched. Must be called
+// with mu held.
+func closeUnclaimed() {
+	for _, sock := range activated {
+		if sock.ln != nil {
+			sock.ln.Close()
+		} else {
+			sock.pc.Close()
+		}
+	}
+	activated = nil
+}
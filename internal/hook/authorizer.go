@@ -0,0 +1,288 @@
+// Package hook implements external admission control for new connections and sessions.
+// An authorizer asks an external program, Unix-socket service or HTTP
+// endpoint whether a client may connect, with a strict timeout and a
+// decision cache.
+package hook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+const (
+	maxCacheSize = 100000
+)
+
+// Request describes a new connection or session awaiting authorization
+type Request struct {
+	Listener   string            `json:"listener"`
+	Protocol   string            `json:"protocol"`
+	ClientIP   string            `json:"client_ip"`
+	ClientPort int               `json:"client_port"`
+	Target     string            `json:"target"`
+	SNI        string            `json:"sni,omitempty"` // Server name of the TLS ClientHello, with sni set
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// maxResponseSize bounds the answer read from an HTTP endpoint
+const maxResponseSize = 64 * 1024
+
+// response is the answer expected from a Unix-socket service or HTTP
+// endpoint
+type response struct {
+	Allow    bool   `json:"allow"`
+	Reason   string `json:"reason,omitempty"`
+	Identity string `json:"identity,omitempty"` // Who the client is, such as the subject of its mTLS certificate
+}
+
+// Decision is the outcome of an authorization check
+type Decision struct {
+	Allow    bool
+	Reason   string
+	Identity string // Reported by a Unix-socket service or HTTP endpoint, for tag rules
+	Cached   bool
+}
+
+// Authorizer consults an external program, Unix-socket service or HTTP
+// endpoint
+type Authorizer struct {
+	cfg     config.PreHookConfig
+	timeout time.Duration
+	client  *http.Client // nil unless url is set
+	mu      sync.Mutex
+	cache   map[string]cacheEntry
+}
+
+// cacheEntry holds a cached decision
+type cacheEntry struct {
+	decision Decision
+	expires  time.Time
+}
+
+// NewAuthorizer creates an authorizer from the pre-hook configuration
+func NewAuthorizer(cfg config.PreHookConfig) *Authorizer {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = config.DefaultPreHookTimeout
+	}
+
+	a := &Authorizer{
+		cfg:     cfg,
+		timeout: timeout,
+		cache:   make(map[string]cacheEntry),
+	}
+	if cfg.URL != "" {
+		a.client = &http.Client{}
+	}
+	return a
+}
+
+// WantsSNI reports whether requests should carry the server name of the
+// client's TLS ClientHello. A nil authorizer wants nothing.
+func (a *Authorizer) WantsSNI() bool {
+	return a != nil && a.cfg.SNI
+}
+
+// Timeout returns the time allowed for each decision
+func (a *Authorizer) Timeout() time.Duration {
+	return a.timeout
+}
+
+// Authorize asks the external service whether the request is allowed.
+// Decisions are cached per listener, client IP and server name for
+// cache_ttl.
+// On errors or timeouts, the configured on_error policy decides and the
+// error is returned alongside the decision.
+func (a *Authorizer) Authorize(req Request) (Decision, error) {
+	key := req.Listener + "|" + req.ClientIP + "|" + req.SNI
+
+	if a.cfg.CacheTTL > 0 {
+		if decision, ok := a.cached(key); ok {
+			return decision, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	var decision Decision
+	var err error
+	switch {
+	case a.cfg.Exec != "":
+		decision, err = a.runExec(ctx, req)
+	case a.cfg.URL != "":
+		decision, err = a.askHTTP(ctx, req)
+	default:
+		decision, err = a.askSocket(ctx, req)
+	}
+
+	if err != nil {
+		return Decision{
+			Allow:  a.cfg.OnError == "allow",
+			Reason: "hook_error",
+		}, err
+	}
+
+	if a.cfg.CacheTTL > 0 {
+		a.store(key, decision)
+	}
+
+	return decision, nil
+}
+
+// cached returns a non-expired cached decision
+func (a *Authorizer) cached(key string) (Decision, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry, exists := a.cache[key]
+	if !exists || time.Now().After(entry.expires) {
+		return Decision{}, false
+	}
+
+	decision := entry.decision
+	decision.Cached = true
+	return decision, true
+}
+
+// store caches a decision, pruning expired entries when the cache is full
+func (a *Authorizer) store(key string, decision Decision) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if len(a.cache) >= maxCacheSize {
+		for k, entry := range a.cache {
+			if now.After(entry.expires) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= maxCacheSize {
+			return
+		}
+	}
+
+	a.cache[key] = cacheEntry{
+		decision: decision,
+		expires:  now.Add(a.cfg.CacheTTL),
+	}
+}
+
+// runExec runs the hook program. Exit status 0 allows, 1 denies, anything else is an error.
+// Client metadata is passed in PACKETPONY_* environment variables and as JSON on stdin.
+func (a *Authorizer) runExec(ctx context.Context, req Request) (Decision, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, a.cfg.Exec, a.cfg.Args...)
+	cmd.Env = append(os.Environ(),
+		"PACKETPONY_LISTENER="+req.Listener,
+		"PACKETPONY_PROTOCOL="+req.Protocol,
+		"PACKETPONY_CLIENT_IP="+req.ClientIP,
+		"PACKETPONY_CLIENT_PORT="+strconv.Itoa(req.ClientPort),
+		"PACKETPONY_TARGET="+req.Target,
+		"PACKETPONY_SNI="+req.SNI,
+	)
+	cmd.Stdin = bytes.NewReader(payload)
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return Decision{}, fmt.Errorf("hook timed out after %s", a.timeout)
+	}
+	if err == nil {
+		return Decision{Allow: true}, nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return Decision{Allow: false, Reason: "denied_by_hook"}, nil
+	}
+	return Decision{}, fmt.Errorf("hook failed: %w", err)
+}
+
+// askSocket sends the request as a JSON line to the Unix socket and reads a JSON line answer
+func (a *Authorizer) askSocket(ctx context.Context, req Request) (Decision, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", a.cfg.UnixSocket)
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to connect to hook socket: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return Decision{}, fmt.Errorf("failed to send hook request: %w", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return Decision{}, fmt.Errorf("failed to read hook response: %w", err)
+	}
+
+	return decide(line)
+}
+
+// askHTTP POSTs the request as JSON to the endpoint and reads a JSON
+// answer. Any status other than 200 is an error.
+func (a *Authorizer) askHTTP(ctx context.Context, req Request) (Decision, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to create hook request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Decision{}, fmt.Errorf("hook timed out after %s", a.timeout)
+		}
+		return Decision{}, fmt.Errorf("failed to reach hook endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to read hook response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("hook endpoint returned %s", resp.Status)
+	}
+	return decide(body)
+}
+
+// decide turns a JSON answer into a decision
+func decide(answer []byte) (Decision, error) {
+	var resp response
+	if err := json.Unmarshal(answer, &resp); err != nil {
+		return Decision{}, fmt.Errorf("invalid hook response: %w", err)
+	}
+
+	reason := resp.Reason
+	if !resp.Allow && reason == "" {
+		reason = "denied_by_hook"
+	}
+	return Decision{Allow: resp.Allow, Reason: reason, Identity: resp.Identity}, nil
+}
@@ -0,0 +1,39 @@
+package httpmode
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// benchRequest is a typical browser request head
+var benchRequest = []byte("GET /api/v1/items?page=2 HTTP/1.1\r\n" +
+	"Host: www.example.com\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0\r\n" +
+	"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+	"Accept-Language: en-US,en;q=0.5\r\n" +
+	"Accept-Encoding: gzip, deflate, br\r\n" +
+	"Cookie: session=0123456789abcdef0123456789abcdef\r\n" +
+	"Connection: keep-alive\r\n" +
+	"\r\n")
+
+// BenchmarkReadRequest measures parsing, rewriting and re-encoding the
+// first request head as done in HTTP-aware mode
+func BenchmarkReadRequest(b *testing.B) {
+	reader := bytes.NewReader(benchRequest)
+	br := bufio.NewReader(reader)
+
+	b.SetBytes(int64(len(benchRequest)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(benchRequest)
+		br.Reset(reader)
+		req, err := ReadRequest(br)
+		if err != nil {
+			b.Fatal(err)
+		}
+		req.SetHeader("X-PacketPony-Flow-ID", "9866145a3f4cc55b")
+		req.Bytes()
+	}
+}
@@ -0,0 +1,139 @@
+// Package httpmode inspects the first HTTP/1.x request on a TCP connection.
+// The request head is read before the proxy connects to the target, can be
+// rewritten (e.g. to inject headers), and is then forwarded verbatim; the
+// rest of the connection is spliced without further inspection.
+package httpmode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// MaxHeadSize bounds the request line plus headers
+const MaxHeadSize = 16 * 1024
+
+// ErrHeadTooLarge is returned when the request head exceeds MaxHeadSize
+var ErrHeadTooLarge = errors.New("HTTP request head too large")
+
+// Request is the parsed head of the first request on a connection
+type Request struct {
+	head
+	Method string
+	Path   string
+	Proto  string
+	Host   string
+}
+
+// head holds the raw start line and header lines without CRLF
+type head struct {
+	lines []string
+}
+
+// ReadRequest reads and parses a request head from br
+func ReadRequest(br *bufio.Reader) (*Request, error) {
+	var lines []string
+	size := 0
+
+	for {
+		line, err := br.ReadString('\n')
+		size += len(line)
+		if size > MaxHeadSize {
+			return nil, ErrHeadTooLarge
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read HTTP request head: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(lines) == 0 {
+				continue // tolerate leading blank lines (RFC 9112 2.2)
+			}
+			break
+		}
+		lines = append(lines, line)
+	}
+
+	parts := strings.Fields(lines[0])
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return nil, fmt.Errorf("malformed HTTP request line: %q", lines[0])
+	}
+
+	req := &Request{
+		head:   head{lines: lines},
+		Method: parts[0],
+		Path:   parts[1],
+		Proto:  parts[2],
+	}
+	req.Host = req.Header("Host")
+
+	return req, nil
+}
+
+// Hostname returns the Host header in lower case, without port or
+// trailing dot
+func (r *Request) Hostname() string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Header returns the first value of the named header
+func (h *head) Header(name string) string {
+	for _, line := range h.lines[1:] {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), name) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// SetHeader replaces any existing values of the named header with value.
+// Replacing rather than appending stops clients from spoofing headers the
+// backend trusts.
+func (h *head) SetHeader(name, value string) {
+	kept := h.lines[:1]
+	for _, line := range h.lines[1:] {
+		key, _, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), name) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	h.lines = append(kept, name+": "+value)
+}
+
+// Bytes returns the head as it should be forwarded
+func (h *head) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range h.lines {
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// Conn is a net.Conn whose reads drain a buffered reader first,
+// so bytes read ahead while parsing the head are not lost
+type Conn struct {
+	net.Conn
+	reader io.Reader
+}
+
+// NewConn wraps conn so reads go through reader
+func NewConn(conn net.Conn, reader io.Reader) *Conn {
+	return &Conn{Conn: conn, reader: reader}
+}
+
+// Read reads from the buffered reader
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,65 @@
+package httpmode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Response is the parsed head of the first response on a connection
+type Response struct {
+	head
+	Proto  string
+	Status string
+}
+
+// PeekResponse parses a response head from br without consuming anything
+// unless it succeeds. It returns nil if the data is not an HTTP/1.x response
+// or the head does not fit in the reader's buffer, so the caller can pass
+// the stream through unchanged. br must be at least MaxHeadSize large.
+func PeekResponse(br *bufio.Reader) *Response {
+	for n := 1; n <= MaxHeadSize; n = br.Buffered() + 1 {
+		data, err := br.Peek(n)
+		if !bytes.HasPrefix([]byte("HTTP/1."), data[:min(len(data), 7)]) {
+			return nil
+		}
+		if end := bytes.Index(data, []byte("\r\n\r\n")); end >= 0 {
+			resp := parseResponse(string(data[:end]))
+			if resp != nil {
+				br.Discard(end + 4)
+			}
+			return resp
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// parseResponse parses a response head without the final blank line
+func parseResponse(raw string) *Response {
+	lines := strings.Split(raw, "\r\n")
+	proto, status, ok := strings.Cut(lines[0], " ")
+	if !ok || !strings.HasPrefix(proto, "HTTP/1.") {
+		return nil
+	}
+	return &Response{
+		head:   head{lines: lines},
+		Proto:  proto,
+		Status: status,
+	}
+}
+
+// ErrorResponse builds a complete response with an empty body that closes
+// the connection. headers are added in order as name, value pairs.
+func ErrorResponse(code int, reason string, headers ...string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", code, reason)
+	for i := 0; i+1 < len(headers); i += 2 {
+		fmt.Fprintf(&buf, "%s: %s\r\n", headers[i], headers[i+1])
+	}
+	buf.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+	return buf.Bytes()
+}
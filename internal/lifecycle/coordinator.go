@@ -0,0 +1,71 @@
+// Package lifecycle stops the components of the process in a fixed order.
+//
+// Components register a stop step as they start. Shutdown runs the steps
+// in reverse, so the last component started is the first one stopped and
+// nothing is stopped while a component started later still depends on it.
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// step is a named stop function
+type step struct {
+	name string
+	stop func() error
+}
+
+// Coordinator runs registered stop steps once, in reverse order
+type Coordinator struct {
+	mu    sync.Mutex
+	steps []step
+
+	once sync.Once
+	err  error
+}
+
+// NewCoordinator creates an empty coordinator
+func NewCoordinator() *Coordinator {
+	return &Coordinator{}
+}
+
+// Add registers the stop step of a component that has started. Steps
+// added after Shutdown began are not run.
+func (c *Coordinator) Add(name string, stop func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.steps = append(c.steps, step{name: name, stop: stop})
+}
+
+// Shutdown runs every step, last added first. A failing or panicking step
+// does not prevent later steps from running; their errors are joined and
+// prefixed with the step name. Later calls return the first result.
+func (c *Coordinator) Shutdown() error {
+	c.once.Do(func() {
+		c.mu.Lock()
+		steps := c.steps
+		c.steps = nil
+		c.mu.Unlock()
+
+		var errs []error
+		for i := len(steps) - 1; i >= 0; i-- {
+			if err := runStep(steps[i]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", steps[i].name, err))
+			}
+		}
+		c.err = errors.Join(errs...)
+	})
+	return c.err
+}
+
+// runStep runs a stop step, turning a panic into an error
+func runStep(s step) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.stop()
+}
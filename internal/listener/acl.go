@@ -0,0 +1,90 @@
+package listener
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/espegro/packetpony/internal/acl"
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// newAllowlist creates the allowlist of a listener, including its
+// scheduled entries
+func newAllowlist(cfg *config.ListenerConfig) (*acl.Allowlist, error) {
+	allowlist, err := acl.NewAllowlist(cfg.Allowlist)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cfg.ScheduledAllowlist {
+		entry := &cfg.ScheduledAllowlist[i]
+		schedule := entry.GetSchedule()
+		if err := allowlist.AddScheduled(entry.Match, entry.Schedule, schedule.Active); err != nil {
+			return nil, fmt.Errorf("scheduled_allowlist[%d]: %w", i, err)
+		}
+	}
+	return allowlist, nil
+}
+
+// allowlist returns the allowlist of the named listener
+func (m *Manager) allowlist(name string) (*acl.Allowlist, error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown listener: %s", name)
+	}
+	return listener.Allowlist(), nil
+}
+
+// AllowlistEntries returns the entries added at runtime to the allowlist
+// of the named listener
+func (m *Manager) AllowlistEntries(name string) ([]acl.Entry, error) {
+	allowlist, err := m.allowlist(name)
+	if err != nil {
+		return nil, err
+	}
+	return allowlist.Entries(), nil
+}
+
+// AllowNetwork adds network to the allowlist of the named listener for
+// duration, or until removed if zero. Through the state storage, the
+// entry reaches other instances sharing it.
+func (m *Manager) AllowNetwork(name, network string, duration time.Duration, reason, actor string) (acl.Entry, error) {
+	allowlist, err := m.allowlist(name)
+	if err != nil {
+		return acl.Entry{}, err
+	}
+	entry, err := allowlist.Allow(network, duration, reason)
+	if err != nil {
+		return acl.Entry{}, err
+	}
+	fields := map[string]interface{}{
+		"listener": name,
+		"network":  entry.Network,
+		"reason":   reason,
+		"actor":    actor,
+	}
+	if duration > 0 {
+		fields["duration"] = duration.String()
+	}
+	m.logger.LogWarning(logging.EventAllowlistEntryAdded, fields)
+	return entry, nil
+}
+
+// DisallowNetwork removes the runtime entry for network from the
+// allowlist of the named listener, and on other instances sharing the
+// state storage. Returns false if there was none.
+func (m *Manager) DisallowNetwork(name, network, actor string) (bool, error) {
+	allowlist, err := m.allowlist(name)
+	if err != nil {
+		return false, err
+	}
+	removed, err := allowlist.Disallow(network)
+	if removed {
+		m.logger.LogWarning(logging.EventAllowlistEntryRemoved, map[string]interface{}{
+			"listener": name,
+			"network":  network,
+			"actor":    actor,
+		})
+	}
+	return removed, err
+}
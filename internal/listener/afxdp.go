@@ -0,0 +1,136 @@
+package listener
+
+import (
+	"hash/maphash"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/xdp"
+)
+
+// afxdpPollTimeout bounds how long an AF_XDP queue is waited on, and so
+// how long its reader takes to notice the listener stopping
+const afxdpPollTimeout = 100 * time.Millisecond
+
+// clientLockShards is the number of locks the clients of a listener
+// reading with AF_XDP are spread over
+const clientLockShards = 256
+
+// clientLocks serializes the datagrams of each client across the readers
+// of a listener, so that a session is set up by its first datagram before
+// another one uses it. Session keys that follow a client across
+// addresses put all clients under one lock.
+type clientLocks struct {
+	seed   maphash.Seed
+	single bool
+	shards [clientLockShards]sync.Mutex
+}
+
+// newClientLocks returns the locks for a listener's session key strategy
+func newClientLocks(sessionKey string) *clientLocks {
+	switch sessionKey {
+	case config.SessionKeyPayload, config.SessionKeyDTLSCID, config.SessionKeyQUICCID:
+		return &clientLocks{single: true}
+	}
+	return &clientLocks{seed: maphash.MakeSeed()}
+}
+
+// lock returns the lock of a client
+func (c *clientLocks) lock(ip net.IP) *sync.Mutex {
+	if c.single {
+		return &c.shards[0]
+	}
+	return &c.shards[maphash.Bytes(c.seed, ip.To16())%clientLockShards]
+}
+
+// startAFXDP binds AF_XDP sockets to the listener's receive queues and
+// starts a reader for each. If they cannot be set up the listener reads
+// all datagrams from its socket, as without af_xdp.
+func (l *UDPListener) startAFXDP() {
+	cfg := l.config.UDP.AFXDP
+	receiver, err := xdp.Listen(cfg.Interface, l.config.ListenAddress, cfg.Queues, cfg.GetFrames(), cfg.ZeroCopy)
+	if err != nil {
+		l.logger.LogError(logging.EventAFXDPFailed, map[string]interface{}{
+			"listener":  l.config.Name,
+			"interface": cfg.Interface,
+			"error":     err.Error(),
+		})
+		return
+	}
+	l.afxdp = receiver
+
+	queues := receiver.Queues()
+	for _, q := range queues {
+		l.afxdpWG.Add(1)
+		go l.afxdpLoop(q)
+	}
+
+	l.logger.LogInfo(logging.EventAFXDPStarted, map[string]interface{}{
+		"listener":  l.config.Name,
+		"interface": cfg.Interface,
+		"queues":    len(queues),
+		"zero_copy": cfg.ZeroCopy,
+	})
+}
+
+// afxdpLoop reads the datagrams of a receive queue until the listener
+// stops or is detached
+func (l *UDPListener) afxdpLoop(q *xdp.Queue) {
+	defer l.afxdpWG.Done()
+
+	queue := strconv.Itoa(q.ID())
+	received := l.metrics.AFXDPPackets.WithLabelValues(l.config.Name, queue, "received")
+	malformed := l.metrics.AFXDPPackets.WithLabelValues(l.config.Name, queue, "malformed")
+
+	handle := func(d xdp.Datagram) {
+		// The payload is in a buffer the kernel reuses
+		data := make([]byte, len(d.Payload))
+		copy(data, d.Payload)
+		l.handlePacket(data, d.Source, d.DSCP)
+	}
+
+	for l.ctx.Err() == nil && !l.detached.Load() {
+		n, bad, err := q.Receive(afxdpPollTimeout, handle)
+		received.Add(float64(n))
+		malformed.Add(float64(bad))
+		if err != nil {
+			l.logger.LogError(logging.EventAFXDPReadError, map[string]interface{}{
+				"listener": l.config.Name,
+				"queue":    q.ID(),
+				"error":    err.Error(),
+			})
+			l.status.degrade(err)
+			time.Sleep(afxdpPollTimeout)
+			continue
+		}
+		if n > 0 {
+			l.status.recover()
+		}
+	}
+}
+
+// stopAFXDP waits for the readers of the receive queues, then detaches
+// the program so that datagrams reach the listener socket again
+func (l *UDPListener) stopAFXDP() {
+	l.afxdpWG.Wait()
+	if l.afxdp != nil {
+		l.afxdp.Close()
+	}
+}
+
+// handlePacket hands a datagram to the proxy. With several readers, the
+// datagrams of a client are handled one at a time.
+func (l *UDPListener) handlePacket(data []byte, srcAddr *net.UDPAddr, dscp int) {
+	if l.clients == nil {
+		l.proxy.HandlePacket(data, srcAddr, dscp, l.conn)
+		return
+	}
+	mu := l.clients.lock(srcAddr.IP)
+	mu.Lock()
+	defer mu.Unlock()
+	l.proxy.HandlePacket(data, srcAddr, dscp, l.conn)
+}
@@ -0,0 +1,78 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/espegro/packetpony/internal/ban"
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// ErrBansDisabled is returned for ban changes on a listener without bans
+var ErrBansDisabled = errors.New("bans are not enabled on this listener")
+
+// banList returns the ban list of the named listener
+func (m *Manager) banList(name string) (*ban.BanList, error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown listener: %s", name)
+	}
+	if listener.BanList() == nil {
+		return nil, ErrBansDisabled
+	}
+	return listener.BanList(), nil
+}
+
+// Bans returns the active bans of the named listener
+func (m *Manager) Bans(name string) ([]ban.Ban, error) {
+	banList, err := m.banList(name)
+	if err != nil {
+		return nil, err
+	}
+	return banList.List(), nil
+}
+
+// BanClient bans a client IP on the named listener for duration, or for
+// its ban_duration if zero. Through the state storage, the ban reaches
+// other instances sharing it.
+func (m *Manager) BanClient(name, ip string, duration time.Duration, reason, actor string) (ban.Ban, error) {
+	banList, err := m.banList(name)
+	if err != nil {
+		return ban.Ban{}, err
+	}
+	if duration <= 0 {
+		duration = banList.Duration()
+	}
+	b := banList.Ban(ip, duration)
+	m.metrics.BansTotal.WithLabelValues(name).Inc()
+	m.metrics.BansActive.WithLabelValues(name).Set(float64(banList.ActiveBans()))
+	m.logger.LogWarning(logging.EventBanSet, map[string]interface{}{
+		"listener":     name,
+		"client_ip":    ip,
+		"reason":       reason,
+		"ban_duration": duration.String(),
+		"actor":        actor,
+	})
+	return b, nil
+}
+
+// UnbanClient lifts the ban on a client IP on the named listener, and on
+// other instances sharing the state storage. Returns false if the client
+// was not banned.
+func (m *Manager) UnbanClient(name, ip, actor string) (bool, error) {
+	banList, err := m.banList(name)
+	if err != nil {
+		return false, err
+	}
+	banned, err := banList.Unban(ip)
+	m.metrics.BansActive.WithLabelValues(name).Set(float64(banList.ActiveBans()))
+	if banned {
+		m.logger.LogWarning(logging.EventBanLifted, map[string]interface{}{
+			"listener":  name,
+			"client_ip": ip,
+			"actor":     actor,
+		})
+	}
+	return banned, err
+}
@@ -0,0 +1,270 @@
+package listener
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+// These benchmarks drive synthetic load through real listeners started by
+// a Manager in-process, so they cover the whole accept/admit/dial/copy
+// path. Run them with `make perf`.
+
+// benchMetrics is shared by all benchmarks; Prometheus collectors can only
+// be registered once per process
+var benchMetrics = sync.OnceValue(func() *metrics.ProxyMetrics {
+	return metrics.NewProxyMetrics(nil, config.ClientMetricsConfig{})
+})
+
+// discardLogger drops all log output so logging does not dominate results
+type discardLogger struct{}
+
+func (discardLogger) LogConnection(logging.ConnectionEvent)            {}
+func (discardLogger) LogDebug(logging.Event, map[string]interface{})   {}
+func (discardLogger) LogError(logging.Event, map[string]interface{})   {}
+func (discardLogger) LogInfo(logging.Event, map[string]interface{})    {}
+func (discardLogger) LogWarning(logging.Event, map[string]interface{}) {}
+func (discardLogger) Close() error                                     { return nil }
+
+// freePort returns a loopback port that is free for protocol
+func freePort(b *testing.B, protocol string) int {
+	b.Helper()
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startProxy starts a single listener forwarding to target and returns its
+// address. extra is appended to the listener's YAML, indented as a listener
+// field, to enable the feature under test.
+func startProxy(b *testing.B, protocol, target, extra string) string {
+	b.Helper()
+	listen := fmt.Sprintf("127.0.0.1:%d", freePort(b, protocol))
+
+	yaml := fmt.Sprintf(`server:
+  name: bench
+logging:
+  stdout:
+    enabled: true # Required by validation; the benchmarks log nowhere
+listeners:
+  - name: bench
+    protocol: %s
+    listen_address: %q
+    target_address: %q
+    allowlist: ["127.0.0.1"]
+`, protocol, listen, target)
+	if protocol == "udp" {
+		yaml += `    udp:
+      session_timeout: 30s
+      buffer_size: 65536
+`
+	}
+	yaml += extra
+
+	path := filepath.Join(b.TempDir(), "bench.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		b.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		b.Fatal(err)
+	}
+
+	manager, err := NewManager(cfg, discardLogger{}, benchMetrics())
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := manager.Start(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { manager.Stop() })
+	return listen
+}
+
+// tcpBackend starts a TCP server running handle for each connection
+func tcpBackend(b *testing.B, handle func(net.Conn)) string {
+	b.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// udpEchoBackend starts a UDP server echoing every datagram
+func udpEchoBackend(b *testing.B) string {
+	b.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// Listener features compared by the end-to-end benchmarks. The limits are
+// high enough never to trigger, so only their bookkeeping cost is measured;
+// short windows keep the limiter state from growing with b.N.
+var benchVariants = []struct {
+	name  string
+	extra string
+}{
+	{"plain", ""},
+	{"rate_limited", `    rate_limits:
+      max_connections_per_ip: 1000000
+      connections_window: 100ms
+      max_connection_attempts_per_ip: 100000000
+      attempts_window: 100ms
+      max_bandwidth_per_ip: "100GB"
+      bandwidth_window: 100ms
+`},
+}
+
+// BenchmarkTCPThroughput streams data through one proxied connection
+func BenchmarkTCPThroughput(b *testing.B) {
+	for _, v := range benchVariants {
+		b.Run(v.name, func(b *testing.B) {
+			const chunk = 32 * 1024
+			total := int64(b.N) * chunk
+			received := make(chan int64, 1)
+			backend := tcpBackend(b, func(conn net.Conn) {
+				n, _ := io.CopyN(io.Discard, conn, total)
+				received <- n
+			})
+			addr := startProxy(b, "tcp", backend, v.extra)
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			buf := make([]byte, chunk)
+
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if n := <-received; n != total {
+				b.Fatalf("backend received %d of %d bytes", n, total)
+			}
+		})
+	}
+}
+
+// BenchmarkTCPConnect opens a proxied connection, exchanges one byte and
+// closes it, measuring the per-connection setup cost
+func BenchmarkTCPConnect(b *testing.B) {
+	for _, v := range benchVariants {
+		b.Run(v.name, func(b *testing.B) {
+			backend := tcpBackend(b, func(conn net.Conn) {
+				buf := make([]byte, 1)
+				if _, err := io.ReadFull(conn, buf); err == nil {
+					conn.Write(buf)
+				}
+			})
+			addr := startProxy(b, "tcp", backend, v.extra)
+			buf := make([]byte, 1)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				if _, err := conn.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Fatal(err)
+				}
+				conn.Close()
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "conns/s")
+		})
+	}
+}
+
+// BenchmarkUDPRoundTrip sends datagrams through one proxied session and
+// waits for each echo. Every round trip forwards two packets.
+func BenchmarkUDPRoundTrip(b *testing.B) {
+	for _, v := range benchVariants {
+		for _, size := range []int{64, 1400} {
+			b.Run(fmt.Sprintf("%s/%dB", v.name, size), func(b *testing.B) {
+				addr := startProxy(b, "udp", udpEchoBackend(b), v.extra)
+				conn, err := net.Dial("udp", addr)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer conn.Close()
+				out := make([]byte, size)
+				in := make([]byte, 65536)
+
+				b.SetBytes(int64(2 * size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := conn.Write(out); err != nil {
+						b.Fatal(err)
+					}
+					conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					if _, err := conn.Read(in); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(2*b.N)/b.Elapsed().Seconds(), "pkts/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/espegro/packetpony/internal/capture"
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// ErrNoCapture is returned when stopping a capture on a listener that has none running
+var ErrNoCapture = errors.New("no capture running on this listener")
+
+// ErrReplayNotUDP is returned when a replay capture is requested on a TCP listener
+var ErrReplayNotUDP = errors.New("replay captures are only supported on udp listeners")
+
+// StartCapture starts recording the named listener's traffic to a pcap or
+// replay file. actor identifies the caller in the log.
+func (m *Manager) StartCapture(name string, opts capture.Options, actor string) (capture.Status, error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return capture.Status{}, fmt.Errorf("unknown listener: %s", name)
+	}
+	if _, udp := listener.(*UDPListener); opts.Format == capture.FormatReplay && !udp {
+		return capture.Status{}, ErrReplayNotUDP
+	}
+
+	c, err := listener.Tap().Start(name, opts, func(status capture.Status) {
+		m.logger.LogWarning(logging.EventCaptureStopped, map[string]interface{}{
+			"listener": name,
+			"path":     status.Path,
+			"reason":   status.StopReason,
+			"packets":  status.Packets,
+			"bytes":    status.Bytes,
+		})
+	})
+	if err != nil {
+		return capture.Status{}, err
+	}
+
+	m.logger.LogWarning(logging.EventCaptureStarted, map[string]interface{}{
+		"listener":  name,
+		"path":      opts.Path,
+		"format":    c.Status().Format,
+		"side":      opts.Side,
+		"duration":  opts.Duration.String(),
+		"max_bytes": opts.MaxBytes,
+		"actor":     actor,
+	})
+	return c.Status(), nil
+}
+
+// StopCapture stops the capture running on the named listener and returns
+// its final status
+func (m *Manager) StopCapture(name string) (capture.Status, error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return capture.Status{}, fmt.Errorf("unknown listener: %s", name)
+	}
+	status, ok := listener.Tap().Stop()
+	if !ok {
+		return capture.Status{}, ErrNoCapture
+	}
+	return status, nil
+}
+
+// Captures returns the captures currently running
+func (m *Manager) Captures() []capture.Status {
+	captures := []capture.Status{}
+	for _, name := range m.ListenerNames() {
+		if c := m.listeners[name].Tap().Current(); c != nil {
+			captures = append(captures, c.Status())
+		}
+	}
+	return captures
+}
@@ -0,0 +1,63 @@
+package listener
+
+import (
+	"fmt"
+
+	"github.com/espegro/packetpony/internal/chaos"
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// ChaosSettings returns the faults injected into each listener that has
+// chaos mode on
+func (m *Manager) ChaosSettings() map[string]chaos.Settings {
+	settings := make(map[string]chaos.Settings)
+	for name, listener := range m.listeners {
+		if s, ok := listener.Chaos().Settings(); ok {
+			settings[name] = s
+		}
+	}
+	return settings
+}
+
+// SetChaos starts injecting the faults in settings into the named
+// listener's flows, replacing any set before. actor identifies the caller
+// in the log.
+func (m *Manager) SetChaos(name string, settings chaos.Settings, actor string) error {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return fmt.Errorf("unknown listener: %s", name)
+	}
+	listener.Chaos().Set(settings)
+
+	m.logger.LogWarning(logging.EventChaosSet, map[string]interface{}{
+		"listener":     name,
+		"latency":      settings.Latency.String(),
+		"jitter":       settings.Jitter.String(),
+		"distribution": settings.Distribution,
+		"loss":         settings.Loss,
+		"bandwidth":    settings.Bandwidth,
+		"actor":        actor,
+	})
+	return nil
+}
+
+// ClearChaos stops injecting faults into the named listener's flows and
+// reports whether any were being injected. actor identifies the caller in
+// the log.
+func (m *Manager) ClearChaos(name string, actor string) (bool, error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return false, fmt.Errorf("unknown listener: %s", name)
+	}
+	injector := listener.Chaos()
+	if _, ok := injector.Settings(); !ok {
+		return false, nil
+	}
+	injector.Clear()
+
+	m.logger.LogWarning(logging.EventChaosCleared, map[string]interface{}{
+		"listener": name,
+		"actor":    actor,
+	})
+	return true, nil
+}
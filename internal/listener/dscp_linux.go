@@ -0,0 +1,49 @@
+//go:build linux
+
+package listener
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// enableDSCP asks the kernel to report the TOS / traffic class byte of
+// each datagram received on conn. Dual-stack sockets need both options;
+// the one that does not apply to the socket's family may fail.
+func enableDSCP(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errV4, errV6 error
+	if err := raw.Control(func(fd uintptr) {
+		errV4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+		errV6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1)
+	}); err != nil {
+		return err
+	}
+	if errV4 != nil && errV6 != nil {
+		return errV4
+	}
+	return nil
+}
+
+// parseDSCP extracts the DSCP value from the control messages of a
+// datagram, or 0 if there are none
+func parseDSCP(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_TOS && len(msg.Data) >= 1:
+			return int(msg.Data[0] >> 2)
+		case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_TCLASS && len(msg.Data) >= 4:
+			tclass := binary.NativeEndian.Uint32(msg.Data)
+			return int(tclass&0xff) >> 2
+		}
+	}
+	return 0
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package listener
+
+import "net"
+
+// enableDSCP is not supported on this platform; the config linter warns
+// that ip_dscp session keys behave like ip keys here
+func enableDSCP(conn *net.UDPConn) error {
+	return nil
+}
+
+// parseDSCP always returns 0 on this platform
+func parseDSCP(oob []byte) int {
+	return 0
+}
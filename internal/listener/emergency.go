@@ -0,0 +1,94 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// ErrEmergencyInactive is returned when releasing emergency mode that is not engaged
+var ErrEmergencyInactive = errors.New("emergency mode is not engaged")
+
+// EmergencyState describes the global emergency mode
+type EmergencyState struct {
+	Active bool       `json:"active"`
+	Factor float64    `json:"factor"`          // Share of each bandwidth limit in force while active
+	Since  *time.Time `json:"since,omitempty"` // When emergency mode was engaged
+	Actor  string     `json:"actor,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+// emergency holds the emergency mode state of a manager
+type emergency struct {
+	mu            sync.Mutex
+	defaultFactor float64
+	state         EmergencyState
+}
+
+// EngageEmergency clamps every listener's per-client bandwidth limit to
+// factor of its configured value (0 = the configured bandwidth_factor).
+// Engaging again replaces the factor and reason. actor identifies the
+// caller in the audit log.
+func (m *Manager) EngageEmergency(factor float64, reason, actor string) (EmergencyState, error) {
+	if factor < 0 || factor > 1 {
+		return EmergencyState{}, fmt.Errorf("factor must be between 0 and 1")
+	}
+	if factor == 0 {
+		factor = m.emergency.defaultFactor
+	}
+
+	m.emergency.mu.Lock()
+	defer m.emergency.mu.Unlock()
+
+	now := time.Now()
+	m.emergency.state = EmergencyState{
+		Active: true,
+		Factor: factor,
+		Since:  &now,
+		Actor:  actor,
+		Reason: reason,
+	}
+	for _, listener := range m.listeners {
+		listener.RateLimiter().SetBandwidthScale(factor)
+	}
+	m.metrics.EmergencyActive.Set(1)
+
+	m.logger.LogWarning(logging.EventEmergencyEngaged, map[string]interface{}{
+		"factor": factor,
+		"reason": reason,
+		"actor":  actor,
+	})
+	return m.emergency.state, nil
+}
+
+// ReleaseEmergency restores every listener's configured bandwidth limit
+func (m *Manager) ReleaseEmergency(actor string) (EmergencyState, error) {
+	m.emergency.mu.Lock()
+	defer m.emergency.mu.Unlock()
+
+	if !m.emergency.state.Active {
+		return EmergencyState{}, ErrEmergencyInactive
+	}
+	engaged := m.emergency.state
+	m.emergency.state = EmergencyState{Factor: 1}
+	for _, listener := range m.listeners {
+		listener.RateLimiter().SetBandwidthScale(1)
+	}
+	m.metrics.EmergencyActive.Set(0)
+
+	m.logger.LogWarning(logging.EventEmergencyReleased, map[string]interface{}{
+		"actor":    actor,
+		"duration": time.Since(*engaged.Since).Round(time.Second).String(),
+	})
+	return m.emergency.state, nil
+}
+
+// Emergency returns the current emergency mode state
+func (m *Manager) Emergency() EmergencyState {
+	m.emergency.mu.Lock()
+	defer m.emergency.mu.Unlock()
+	return m.emergency.state
+}
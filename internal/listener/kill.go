@@ -0,0 +1,55 @@
+package listener
+
+import (
+	"fmt"
+
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/proxy"
+)
+
+// KilledFlows is the number of flows of one listener matched by a kill
+type KilledFlows struct {
+	Listener string `json:"listener"`
+	Protocol string `json:"protocol"`
+	Flows    int    `json:"flows"`
+}
+
+// KillFlows closes the TCP connections and UDP sessions matching filter on
+// the named listener, or on every listener if name is empty. With dryRun,
+// matching flows are only counted. actor identifies the caller in the log.
+func (m *Manager) KillFlows(name string, filter proxy.FlowFilter, dryRun bool, actor string) ([]KilledFlows, error) {
+	names := m.ListenerNames()
+	if name != "" {
+		if _, exists := m.listeners[name]; !exists {
+			return nil, fmt.Errorf("unknown listener: %s", name)
+		}
+		names = []string{name}
+	}
+
+	results := make([]KilledFlows, 0, len(names))
+	for _, name := range names {
+		listener := m.listeners[name]
+		flows := listener.KillFlows(filter, dryRun)
+		results = append(results, KilledFlows{
+			Listener: name,
+			Protocol: listener.Status().Protocol,
+			Flows:    flows,
+		})
+		if dryRun || flows == 0 {
+			continue
+		}
+
+		fields := map[string]interface{}{
+			"listener":  name,
+			"flows":     flows,
+			"min_idle":  filter.MinIdle.String(),
+			"min_bytes": filter.MinBytes,
+			"actor":     actor,
+		}
+		if filter.Source != nil {
+			fields["source"] = filter.Source.String()
+		}
+		m.logger.LogWarning(logging.EventFlowsKilled, fields)
+	}
+	return results, nil
+}
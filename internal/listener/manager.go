@@ -5,44 +5,144 @@ package listener
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/espegro/packetpony/internal/accounting"
+	"github.com/espegro/packetpony/internal/acl"
+	"github.com/espegro/packetpony/internal/ban"
+	"github.com/espegro/packetpony/internal/chaos"
 	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/dns"
+	"github.com/espegro/packetpony/internal/exempt"
+	"github.com/espegro/packetpony/internal/geoip"
 	"github.com/espegro/packetpony/internal/logging"
 	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/proxy"
+	"github.com/espegro/packetpony/internal/quota"
+	"github.com/espegro/packetpony/internal/ratelimit"
+	"github.com/espegro/packetpony/internal/storage"
+	"github.com/espegro/packetpony/internal/target"
+	"github.com/espegro/packetpony/internal/tracing"
 )
 
 // Listener defines the interface for all listener types
 type Listener interface {
 	Start() error
 	Stop() error
+	Drain()
+	Detach()
+	Active() int
 	Name() string
+	Status() metrics.ListenerHealth
+	RateLimiter() *ratelimit.RateLimitManager
+	Allowlist() *acl.Allowlist
+	BanList() *ban.BanList
+	Quota() *quota.Tracker
+	Targets() *target.Selector
+	KillFlows(filter proxy.FlowFilter, dryRun bool) int
+	Sampler() *proxy.Sampler
+	Tap() *proxy.Tap
+	Chaos() *chaos.Injector
 }
 
+const (
+	// restartInitialDelay is the first delay before retrying a failed listener
+	restartInitialDelay = 5 * time.Second
+	// restartMaxDelay caps the exponential backoff between retries
+	restartMaxDelay = 5 * time.Minute
+	// drainPollInterval is how often draining progress is checked
+	drainPollInterval = 100 * time.Millisecond
+	// throughputSampleInterval is how often per-client throughput is observed
+	throughputSampleInterval = 10 * time.Second
+)
+
 // Manager manages all listeners
 type Manager struct {
-	listeners map[string]Listener
-	logger    logging.Logger
-	metrics   *metrics.ProxyMetrics
-	wg        sync.WaitGroup
-	ctx       context.Context
-	cancel    context.CancelFunc
+	listeners    map[string]Listener
+	logger       logging.Logger
+	metrics      *metrics.ProxyMetrics
+	store        storage.Store
+	ledger       *accounting.Ledger // nil unless accounting is enabled
+	exemptions   *exempt.Registry
+	tracer       *tracing.Tracer // nil unless tracing is enabled
+	geo          *geoip.DB       // nil unless geoip.database is set
+	xdp          []*xdpInterface
+	emergency    emergency
+	partialStart bool
+	draining     bool       // set once shutdown begins; guarded by startMu
+	startMu      sync.Mutex // serializes background restarts with Drain and Stop
+	wg           sync.WaitGroup
+	stopOnce     sync.Once
+	stopErr      error
+	shutdownOnce sync.Once
+	shutdownErr  error
+	ctx          context.Context
+	cancel       context.CancelFunc
 }
 
 // NewManager creates a new listener manager
 func NewManager(cfg *config.Config, logger logging.Logger, metricsCollector *metrics.ProxyMetrics) (*Manager, error) {
+	// Country database for tag rules
+	var geo *geoip.DB
+	if cfg.GeoIP.Database != "" {
+		var err error
+		if geo, err = geoip.Open(cfg.GeoIP.Database); err != nil {
+			return nil, err
+		}
+	}
+
+	// Shared state for bans
+	store, err := storage.Open(cfg.Storage)
+	if err != nil {
+		geo.Close()
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+
+	// Persistent traffic totals for billing
+	var ledger *accounting.Ledger
+	if cfg.Accounting.Enabled {
+		ledger, err = accounting.Open(cfg.Accounting, cfg.Server.Name, store, logger)
+		if err != nil {
+			store.Close()
+			geo.Close()
+			return nil, err
+		}
+	}
+
+	// Rate limit exemptions issued through the admin API
+	exemptions := exempt.NewRegistry(cfg.Admin.GetMaxExemptionTTL(), store, logger)
+
+	// Span exporter shared by all listeners, nil unless tracing is enabled
+	tracer := tracing.NewTracer(cfg.Tracing, cfg.Server.Name, logger)
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	manager := &Manager{
-		listeners: make(map[string]Listener),
-		logger:    logger,
-		metrics:   metricsCollector,
-		ctx:       ctx,
-		cancel:    cancel,
+		listeners:    make(map[string]Listener),
+		logger:       logger,
+		metrics:      metricsCollector,
+		store:        store,
+		ledger:       ledger,
+		exemptions:   exemptions,
+		tracer:       tracer,
+		geo:          geo,
+		partialStart: cfg.Server.PartialStart,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 
+	// Emergency mode starts released
+	manager.emergency.defaultFactor = cfg.Emergency.GetBandwidthFactor()
+	manager.emergency.state.Factor = 1
+
+	// Shared resolver for target hostnames and runtime guard against
+	// forwarding loops
+	dnsResolver := dns.NewResolver(cfg.DNS)
+	guard := target.NewLoopGuard(cfg.Listeners, dnsResolver)
+
 	// Create listeners from config
 	for i := range cfg.Listeners {
 		listenerCfg := &cfg.Listeners[i]
@@ -50,12 +150,18 @@ func NewManager(cfg *config.Config, logger logging.Logger, metricsCollector *met
 		var listener Listener
 		var err error
 
+		listenerLogger := logger
+		if listenerCfg.LogLevel != "" {
+			level, _ := logging.ParseLevel(listenerCfg.LogLevel) // checked by Validate
+			listenerLogger = logging.WithLevel(logger, level)
+		}
+
 		protocol := strings.ToLower(listenerCfg.Protocol)
 		switch protocol {
 		case "tcp":
-			listener, err = NewTCPListener(ctx, listenerCfg, logger, metricsCollector)
+			listener, err = NewTCPListener(ctx, listenerCfg, guard, dnsResolver, store, ledger, exemptions, tracer, geo, listenerLogger, metricsCollector)
 		case "udp":
-			listener, err = NewUDPListener(ctx, listenerCfg, logger, metricsCollector)
+			listener, err = NewUDPListener(ctx, cfg.Server.Name, listenerCfg, guard, dnsResolver, store, ledger, exemptions, tracer, geo, listenerLogger, metricsCollector)
 		default:
 			return nil, fmt.Errorf("unsupported protocol %s for listener %s", listenerCfg.Protocol, listenerCfg.Name)
 		}
@@ -67,44 +173,153 @@ func NewManager(cfg *config.Config, logger logging.Logger, metricsCollector *met
 		manager.listeners[listenerCfg.Name] = listener
 	}
 
+	// Kernel fast path dropping denied and banned clients
+	if manager.xdp, err = newXDPInterfaces(cfg.Listeners); err != nil {
+		return nil, err
+	}
+
 	return manager, nil
 }
 
-// Start starts all listeners
+// Start starts all listeners.
+// With partial_start enabled, listeners that fail to bind are retried in the
+// background and Start only fails if no listener could be started.
 func (m *Manager) Start() error {
-	m.logger.LogInfo("Starting all listeners", map[string]interface{}{
+	m.logger.LogInfo(logging.EventListenersStarting, map[string]interface{}{
 		"count": len(m.listeners),
 	})
 
-	for name, listener := range m.listeners {
+	var failed []string
+	for _, name := range m.ListenerNames() {
+		listener := m.listeners[name]
 		if err := listener.Start(); err != nil {
-			// Stop any listeners that were already started
-			m.Stop()
-			return fmt.Errorf("failed to start listener %s: %w", name, err)
+			if !m.partialStart {
+				// Stop any listeners that were already started
+				m.Stop()
+				return fmt.Errorf("failed to start listener %s: %w", name, err)
+			}
+			m.logger.LogError(logging.EventListenerStartFailed, map[string]interface{}{
+				"listener": name,
+				"error":    err.Error(),
+			})
+			failed = append(failed, name)
 		}
 	}
 
-	m.logger.LogInfo("All listeners started successfully", map[string]interface{}{
-		"count": len(m.listeners),
+	if len(failed) > 0 && len(failed) == len(m.listeners) {
+		m.Stop()
+		return fmt.Errorf("failed to start any listener")
+	}
+
+	for _, name := range failed {
+		m.wg.Add(1)
+		go m.restartLoop(m.listeners[name])
+	}
+
+	if m.attachXDP() {
+		m.wg.Add(1)
+		go m.xdpSyncLoop()
+	}
+
+	m.wg.Add(1)
+	go m.throughputLoop()
+
+	m.logger.LogInfo(logging.EventListenersStarted, map[string]interface{}{
+		"count":  len(m.listeners) - len(failed),
+		"failed": len(failed),
 	})
 
 	return nil
 }
 
-// Stop stops all listeners
+// restartLoop retries starting a listener with exponential backoff until it
+// binds or the manager shuts down
+func (m *Manager) restartLoop(listener Listener) {
+	defer m.wg.Done()
+
+	delay := restartInitialDelay
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		m.startMu.Lock()
+		if m.ctx.Err() != nil || m.draining {
+			m.startMu.Unlock()
+			return
+		}
+		err := listener.Start()
+		m.startMu.Unlock()
+
+		if err == nil {
+			m.logger.LogInfo(logging.EventListenerRetryStarted, map[string]interface{}{
+				"listener": listener.Name(),
+			})
+			return
+		}
+
+		m.logger.LogWarning(logging.EventListenerRetryFailed, map[string]interface{}{
+			"listener": listener.Name(),
+			"error":    err.Error(),
+			"retry_in": (delay * 2).String(),
+		})
+
+		delay *= 2
+		if delay > restartMaxDelay {
+			delay = restartMaxDelay
+		}
+	}
+}
+
+// throughputLoop periodically observes the throughput of every client
+// within each listener's bandwidth window until the manager stops
+func (m *Manager) throughputLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(throughputSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, name := range m.ListenerNames() {
+				for _, rate := range m.listeners[name].RateLimiter().Throughput() {
+					m.metrics.ClientThroughput.WithLabelValues(name).Observe(rate)
+				}
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop stops all listeners and closes shared state. Only the first call
+// has any effect; later calls return its result.
 func (m *Manager) Stop() error {
-	m.logger.LogInfo("Stopping all listeners", map[string]interface{}{
+	m.stopOnce.Do(func() {
+		m.stopErr = m.stop()
+	})
+	return m.stopErr
+}
+
+// stop stops every listener, then the state they share
+func (m *Manager) stop() error {
+	m.logger.LogInfo(logging.EventListenersStopping, map[string]interface{}{
 		"count": len(m.listeners),
 	})
 
-	// Cancel context to signal shutdown
+	// Cancel context to signal shutdown and wait out any in-flight restart
 	m.cancel()
+	m.startMu.Lock()
+	defer m.startMu.Unlock()
 
 	// Stop all listeners
 	var lastErr error
 	for name, listener := range m.listeners {
 		if err := listener.Stop(); err != nil {
-			m.logger.LogError("Failed to stop listener", map[string]interface{}{
+			m.logger.LogError(logging.EventListenerStopFailed, map[string]interface{}{
 				"listener": name,
 				"error":    err.Error(),
 			})
@@ -112,42 +327,264 @@ func (m *Manager) Stop() error {
 		}
 	}
 
-	m.logger.LogInfo("All listeners stopped", nil)
+	// Hand the listeners' traffic back to the network stack
+	m.detachXDP()
+
+	// Flush captures now that their traffic has ended
+	for _, listener := range m.listeners {
+		listener.Tap().Stop()
+	}
+
+	m.exemptions.Close()
+	m.geo.Close()
+
+	// Export the spans of the flows that just ended
+	m.tracer.Close()
+
+	// Persist final accounting totals while the store is still open
+	if err := m.ledger.Close(); err != nil {
+		lastErr = err
+	}
+
+	// Flush and close shared state once no listener uses it
+	if err := m.store.Close(); err != nil {
+		m.logger.LogError(logging.EventStorageCloseFailed, map[string]interface{}{
+			"error": err.Error(),
+		})
+		lastErr = err
+	}
+
+	m.logger.LogInfo(logging.EventListenersStopped, nil)
 
 	return lastErr
 }
 
+// TopTalkers returns the top n rate limit keys by bandwidth and connection
+// count for the named listener
+func (m *Manager) TopTalkers(name string, n int) (byBytes, byConnections []ratelimit.Talker, err error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return nil, nil, fmt.Errorf("unknown listener: %s", name)
+	}
+	byBytes, byConnections = listener.RateLimiter().TopTalkers(n)
+	return byBytes, byConnections, nil
+}
+
+// Targets returns the state of the named listener's balanced targets
+func (m *Manager) Targets(name string) ([]target.TargetStatus, error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown listener: %s", name)
+	}
+	return listener.Targets().Targets(), nil
+}
+
+// DrainTarget takes a balanced target of the named listener out of
+// rotation, keeping existing flows until they end or grace passes
+// (0 = no deadline). actor identifies the caller in the log.
+func (m *Manager) DrainTarget(name, addr string, grace time.Duration, actor string) (target.TargetStatus, error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return target.TargetStatus{}, fmt.Errorf("unknown listener: %s", name)
+	}
+	status, err := listener.Targets().Drain(addr, grace)
+	if err != nil {
+		return target.TargetStatus{}, err
+	}
+
+	fields := map[string]interface{}{
+		"listener": name,
+		"target":   addr,
+		"active":   status.Active,
+		"actor":    actor,
+	}
+	if status.DrainDeadline != nil {
+		fields["deadline"] = status.DrainDeadline.Format(time.RFC3339)
+	}
+	m.logger.LogWarning(logging.EventTargetDraining, fields)
+	return status, nil
+}
+
+// UndrainTarget puts a draining target of the named listener back into rotation
+func (m *Manager) UndrainTarget(name, addr, actor string) (target.TargetStatus, error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return target.TargetStatus{}, fmt.Errorf("unknown listener: %s", name)
+	}
+	status, err := listener.Targets().Undrain(addr)
+	if err != nil {
+		return target.TargetStatus{}, err
+	}
+
+	m.logger.LogWarning(logging.EventTargetUndrained, map[string]interface{}{
+		"listener": name,
+		"target":   addr,
+		"actor":    actor,
+	})
+	return status, nil
+}
+
+// Accounting returns the accounting ledger, or nil if accounting is disabled
+func (m *Manager) Accounting() *accounting.Ledger {
+	return m.ledger
+}
+
+// Exemptions returns the rate limit exemption registry
+func (m *Manager) Exemptions() *exempt.Registry {
+	return m.exemptions
+}
+
+// ListenerNames returns the names of all configured listeners, sorted
+func (m *Manager) ListenerNames() []string {
+	names := make([]string, 0, len(m.listeners))
+	for name := range m.listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CollectTopTalkers gathers top talkers across all listeners for the metrics collector
+func (m *Manager) CollectTopTalkers(n int) []metrics.TopTalker {
+	var result []metrics.TopTalker
+	for _, name := range m.ListenerNames() {
+		byBytes, byConnections, _ := m.TopTalkers(name, n)
+		for rank, t := range byBytes {
+			result = append(result, metrics.TopTalker{
+				Listener: name,
+				Client:   t.Key,
+				Rank:     rank + 1,
+				Kind:     metrics.TopTalkerBytes,
+				Value:    float64(t.Bytes),
+			})
+		}
+		for rank, t := range byConnections {
+			result = append(result, metrics.TopTalker{
+				Listener: name,
+				Client:   t.Key,
+				Rank:     rank + 1,
+				Kind:     metrics.TopTalkerConnections,
+				Value:    float64(t.Connections),
+			})
+		}
+	}
+	return result
+}
+
+// Health reports the state of every listener. The overall status is healthy
+// when all listeners are listening, degraded when only some are, and
+// unhealthy when none are.
+func (m *Manager) Health() metrics.HealthReport {
+	report := metrics.HealthReport{Status: metrics.HealthHealthy}
+
+	listening := 0
+	for _, name := range m.ListenerNames() {
+		status := m.listeners[name].Status()
+		if status.State == StateListening {
+			listening++
+		}
+		report.Listeners = append(report.Listeners, status)
+	}
+
+	switch {
+	case listening == len(report.Listeners):
+		report.Status = metrics.HealthHealthy
+	case listening == 0:
+		report.Status = metrics.HealthUnhealthy
+	default:
+		report.Status = metrics.HealthDegraded
+	}
+
+	return report
+}
+
 // WaitForShutdown blocks until shutdown is requested
 func (m *Manager) WaitForShutdown() {
 	<-m.ctx.Done()
 }
 
-// GracefulShutdown performs a graceful shutdown with a timeout
+// GracefulShutdown stops accepting new connections and UDP sessions, lets
+// in-flight ones drain for up to timeout, then stops all listeners.
 func (m *Manager) GracefulShutdown(timeout time.Duration) error {
-	m.logger.LogInfo("Starting graceful shutdown", map[string]interface{}{
+	return m.shutdown(timeout, Listener.Drain)
+}
+
+// HandoverShutdown is GracefulShutdown after the listening sockets were
+// passed to a new process: listeners stop reading from the shared sockets
+// entirely so the new process receives all new traffic.
+func (m *Manager) HandoverShutdown(timeout time.Duration) error {
+	return m.shutdown(timeout, Listener.Detach)
+}
+
+// shutdown runs the first graceful or handover shutdown; later calls
+// return its result
+func (m *Manager) shutdown(timeout time.Duration, stopIntake func(Listener)) error {
+	m.shutdownOnce.Do(func() {
+		m.shutdownErr = m.drainAndStop(timeout, stopIntake)
+	})
+	return m.shutdownErr
+}
+
+// drainAndStop stops intake on every listener, drains, then stops everything
+func (m *Manager) drainAndStop(timeout time.Duration, stopIntake func(Listener)) error {
+	m.logger.LogInfo(logging.EventDrainStarted, map[string]interface{}{
 		"timeout": timeout.String(),
 	})
 
 	// Stop accepting new connections
-	if err := m.Stop(); err != nil {
-		return fmt.Errorf("error during shutdown: %w", err)
+	m.startMu.Lock()
+	m.draining = true
+	for _, listener := range m.listeners {
+		stopIntake(listener)
 	}
+	m.startMu.Unlock()
 
-	// Wait for active connections with timeout
-	done := make(chan struct{})
-	go func() {
-		m.wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		m.logger.LogInfo("Graceful shutdown completed", nil)
-		return nil
-	case <-time.After(timeout):
-		m.logger.LogWarning("Graceful shutdown timeout exceeded", map[string]interface{}{
+	// Wait for in-flight connections and sessions to finish
+	drained := m.waitForDrain(timeout)
+	if drained {
+		m.logger.LogInfo(logging.EventDrainCompleted, nil)
+	} else {
+		m.logger.LogWarning(logging.EventDrainTimeout, map[string]interface{}{
 			"timeout": timeout.String(),
+			"active":  m.activeCount(),
 		})
+	}
+
+	// Close anything left and wait for background goroutines
+	if err := m.Stop(); err != nil {
+		return fmt.Errorf("error during shutdown: %w", err)
+	}
+	m.wg.Wait()
+
+	if !drained {
 		return fmt.Errorf("shutdown timeout exceeded")
 	}
+
+	m.logger.LogInfo(logging.EventShutdownCompleted, nil)
+	return nil
+}
+
+// waitForDrain polls until no listener has active connections or the timeout
+// expires. Returns true if everything drained.
+func (m *Manager) waitForDrain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for m.activeCount() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		<-ticker.C
+	}
+	return true
+}
+
+// activeCount returns the total in-flight connections and sessions
+func (m *Manager) activeCount() int {
+	total := 0
+	for _, listener := range m.listeners {
+		total += listener.Active()
+	}
+	return total
 }
@@ -0,0 +1,62 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/quota"
+)
+
+// ErrQuotaDisabled is returned for quota requests on a listener without
+// quotas
+var ErrQuotaDisabled = errors.New("quotas are not enabled on this listener")
+
+// quotaTracker returns the quota tracker of the named listener
+func (m *Manager) quotaTracker(name string) (*quota.Tracker, error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown listener: %s", name)
+	}
+	if listener.Quota() == nil {
+		return nil, ErrQuotaDisabled
+	}
+	return listener.Quota(), nil
+}
+
+// Quotas returns the usage of every client with usage in the current
+// quota periods of the named listener
+func (m *Manager) Quotas(name string) ([]quota.Usage, error) {
+	quotas, err := m.quotaTracker(name)
+	if err != nil {
+		return nil, err
+	}
+	return quotas.List()
+}
+
+// ClientQuota returns the usage of a client IP on the named listener
+func (m *Manager) ClientQuota(name, ip string) ([]quota.Usage, error) {
+	quotas, err := m.quotaTracker(name)
+	if err != nil {
+		return nil, err
+	}
+	return quotas.Client(ip)
+}
+
+// ResetQuota clears the usage of a client IP in the current quota periods
+// of the named listener, so an exhausted client is let back in
+func (m *Manager) ResetQuota(name, ip, actor string) error {
+	quotas, err := m.quotaTracker(name)
+	if err != nil {
+		return err
+	}
+	if err := quotas.Reset(ip); err != nil {
+		return err
+	}
+	m.logger.LogWarning(logging.EventQuotaReset, map[string]interface{}{
+		"listener":  name,
+		"client_ip": ip,
+		"actor":     actor,
+	})
+	return nil
+}
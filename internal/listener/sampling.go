@@ -0,0 +1,40 @@
+package listener
+
+import (
+	"fmt"
+
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// SampleRates returns the flow sample rate of every listener
+func (m *Manager) SampleRates() map[string]int {
+	rates := make(map[string]int, len(m.listeners))
+	for name, listener := range m.listeners {
+		rates[name] = listener.Sampler().Rate()
+	}
+	return rates
+}
+
+// SetSampleRate makes the named listener log and time 1 in rate of the
+// flows that start from now on, and returns the previous rate. actor
+// identifies the caller in the log.
+func (m *Manager) SetSampleRate(name string, rate int, actor string) (int, error) {
+	listener, exists := m.listeners[name]
+	if !exists {
+		return 0, fmt.Errorf("unknown listener: %s", name)
+	}
+	if rate < 1 {
+		return 0, fmt.Errorf("rate must be at least 1")
+	}
+	sampler := listener.Sampler()
+	previous := sampler.Rate()
+	sampler.SetRate(rate)
+
+	m.logger.LogWarning(logging.EventSampleRateChanged, map[string]interface{}{
+		"listener": name,
+		"rate":     rate,
+		"previous": previous,
+		"actor":    actor,
+	})
+	return previous, nil
+}
@@ -0,0 +1,102 @@
+package listener
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+// Listener states reported by the health subsystem
+const (
+	StateStarting  = "starting"
+	StateListening = "listening"
+	StateDegraded  = "degraded"
+	StateDraining  = "draining"
+	StateError     = "error"
+	StateStopped   = "stopped"
+)
+
+// statusTracker records a listener's lifecycle state.
+// The degraded flag is checked atomically so the packet path can clear it
+// cheaply after recovering from runtime errors.
+type statusTracker struct {
+	mu       sync.Mutex
+	state    string
+	lastErr  string
+	since    time.Time
+	attempts int
+	degraded int32
+}
+
+// newStatusTracker creates a tracker in the starting state
+func newStatusTracker() *statusTracker {
+	return &statusTracker{
+		state: StateStarting,
+		since: time.Now(),
+	}
+}
+
+// set records a state transition
+func (t *statusTracker) set(state string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.state != state {
+		t.since = time.Now()
+	}
+	t.state = state
+	if err != nil {
+		t.lastErr = err.Error()
+	} else if state == StateListening {
+		t.lastErr = ""
+	}
+
+	if state == StateDegraded {
+		atomic.StoreInt32(&t.degraded, 1)
+	} else {
+		atomic.StoreInt32(&t.degraded, 0)
+	}
+}
+
+// begin records a start attempt
+func (t *statusTracker) begin() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts++
+}
+
+// degrade marks the listener degraded after a runtime error
+func (t *statusTracker) degrade(err error) {
+	t.set(StateDegraded, err)
+}
+
+// recover returns a degraded listener to listening after successful I/O
+func (t *statusTracker) recover() {
+	if atomic.LoadInt32(&t.degraded) == 0 {
+		return
+	}
+	t.set(StateListening, nil)
+}
+
+// status returns the current status
+func (t *statusTracker) status(name, protocol, address string) metrics.ListenerHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	restarts := 0
+	if t.attempts > 1 {
+		restarts = t.attempts - 1
+	}
+
+	return metrics.ListenerHealth{
+		Name:     name,
+		Protocol: protocol,
+		Address:  address,
+		State:    t.state,
+		Error:    t.lastErr,
+		Since:    t.since,
+		Restarts: restarts,
+	}
+}
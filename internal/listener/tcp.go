@@ -4,76 +4,210 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/espegro/packetpony/internal/accounting"
 	"github.com/espegro/packetpony/internal/acl"
+	"github.com/espegro/packetpony/internal/ban"
+	"github.com/espegro/packetpony/internal/chaos"
 	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/dns"
+	"github.com/espegro/packetpony/internal/exempt"
+	"github.com/espegro/packetpony/internal/geoip"
+	"github.com/espegro/packetpony/internal/greylist"
+	"github.com/espegro/packetpony/internal/handover"
+	"github.com/espegro/packetpony/internal/hook"
 	"github.com/espegro/packetpony/internal/logging"
 	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/mirror"
 	"github.com/espegro/packetpony/internal/proxy"
+	"github.com/espegro/packetpony/internal/quota"
 	"github.com/espegro/packetpony/internal/ratelimit"
+	"github.com/espegro/packetpony/internal/script"
+	"github.com/espegro/packetpony/internal/sockopt"
+	"github.com/espegro/packetpony/internal/storage"
+	"github.com/espegro/packetpony/internal/tagging"
+	"github.com/espegro/packetpony/internal/target"
+	"github.com/espegro/packetpony/internal/tracing"
+	"github.com/espegro/packetpony/internal/upstream"
 )
 
+// acceptPauseLogInterval is the minimum time between logged accept pauses
+const acceptPauseLogInterval = 10 * time.Second
+
 // TCPListener manages a TCP listening socket and handles connections
 type TCPListener struct {
-	config         *config.ListenerConfig
-	listener       net.Listener
-	proxy          *proxy.TCPProxy
-	logger         logging.Logger
-	ctx            context.Context
-	cancel         context.CancelFunc
-	wg             sync.WaitGroup
-	rateLimiter    *ratelimit.RateLimitManager
-	activeConnsMu  sync.Mutex
-	activeConns    []net.Conn
+	config        *config.ListenerConfig
+	listener      net.Listener
+	proxy         *proxy.TCPProxy
+	logger        logging.Logger
+	metrics       *metrics.ProxyMetrics
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+	rateLimiter   *ratelimit.RateLimitManager
+	allowlist     *acl.Allowlist
+	banList       *ban.BanList
+	targets       *target.Selector
+	quotas        *quota.Tracker
+	greyList      *greylist.List
+	status        *statusTracker
+	draining      atomic.Bool
+	stopOnce      sync.Once
+	activeConnsMu sync.Mutex
+	activeConns   []net.Conn
+	sockOpts      *sockopt.Options
+	slots         chan struct{} // One per handled connection, nil = no accept_pause_threshold
+	pauses        int           // Accept pauses since the last logged one, accept loop only
+	pauseLogged   time.Time
 }
 
 // NewTCPListener creates a new TCP listener
 func NewTCPListener(
 	ctx context.Context,
 	cfg *config.ListenerConfig,
+	guard *target.LoopGuard,
+	dnsResolver *dns.Resolver,
+	store storage.Store,
+	ledger *accounting.Ledger,
+	exemptions *exempt.Registry,
+	tracer *tracing.Tracer,
+	geo *geoip.DB,
 	logger logging.Logger,
 	metricsCollector *metrics.ProxyMetrics,
 ) (*TCPListener, error) {
 	// Create allowlist
-	allowlist, err := acl.NewAllowlist(cfg.Allowlist)
+	allowlist, err := newAllowlist(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create allowlist: %w", err)
 	}
 
+	// Create ban list if enabled
+	var banList *ban.BanList
+	if cfg.Ban != nil && cfg.Ban.Enabled {
+		banList = ban.NewBanList(cfg.Ban.MaxViolations, cfg.Ban.ViolationWindow, cfg.Ban.BanDuration, store, "ban/"+cfg.Name+"/")
+	}
+
+	// Create tagger
+	tagger, err := tagging.NewTagger(cfg.Tags, cfg.TagRules, geo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tagger: %w", err)
+	}
+
+	// Create target selector
+	targets, err := target.NewSelector(cfg, guard, dnsResolver)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create target selector: %w", err)
+	}
+
+	// Create pre-hook authorizer if enabled
+	var authorizer *hook.Authorizer
+	if cfg.PreHook != nil && cfg.PreHook.Enabled {
+		authorizer = hook.NewAuthorizer(*cfg.PreHook)
+	}
+
+	// Create upstream proxy dialer if targets sit behind one
+	var upstreamDialer *upstream.Dialer
+	if cfg.TargetProxy != "" {
+		upstreamDialer, err = upstream.New(cfg.TargetProxy, dnsResolver)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create target proxy dialer: %w", err)
+		}
+	}
+
+	// Create mirror target if client traffic is copied to a second backend
+	mirrorTarget := mirror.NewTarget(cfg.Name, "tcp", cfg.MirrorTarget, dnsResolver, metricsCollector)
+
 	// Create rate limiter
-	rateLimiter := ratelimit.NewRateLimitManager(cfg.RateLimits)
+	rateLimiter := ratelimit.NewRateLimitManager(cfg.RateLimits, exemptions.Checker(cfg.Name))
+	if cfg.RateLimits.Shared {
+		rateLimiter.Share(store, "ratelimit/"+cfg.Name+"/")
+	}
+	if cfg.Audit() {
+		rateLimiter.Audit()
+	}
+
+	// Create quota tracker if enabled
+	quotas, err := quota.New(cfg.Name, cfg.Quota, store, metricsCollector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create quota tracker: %w", err)
+	}
+
+	// Create greylist if enabled
+	greyList := greylist.New(cfg.Name, cfg.Greylist, store)
+
+	// Load script if enabled
+	scriptEngine, err := script.New(cfg.Name, cfg.Script, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load script: %w", err)
+	}
 
 	// Create proxy
-	tcpProxy := proxy.NewTCPProxy(cfg, logger, rateLimiter, allowlist, metricsCollector)
+	tcpProxy := proxy.NewTCPProxy(cfg, logger, rateLimiter, allowlist, banList, tagger, targets, authorizer, ledger, quotas, greyList, scriptEngine, dnsResolver, upstreamDialer, mirrorTarget, tracer, metricsCollector)
+
+	// Share runtime allowlist entries once the proxy logs store failures
+	allowlist.Share(store, "allow/"+cfg.Name+"/")
 
 	// Create context with cancel
 	listenerCtx, cancel := context.WithCancel(ctx)
 
+	// Accept pauses while every slot is taken
+	var slots chan struct{}
+	if cfg.TCP != nil && cfg.TCP.AcceptPauseThreshold > 0 {
+		slots = make(chan struct{}, cfg.TCP.AcceptPauseThreshold)
+	}
+
 	return &TCPListener{
 		config:      cfg,
 		proxy:       tcpProxy,
 		logger:      logger,
+		metrics:     metricsCollector,
 		ctx:         listenerCtx,
 		cancel:      cancel,
 		rateLimiter: rateLimiter,
+		allowlist:   allowlist,
+		banList:     banList,
+		targets:     targets,
+		quotas:      quotas,
+		greyList:    greyList,
+		status:      newStatusTracker(),
 		activeConns: make([]net.Conn, 0),
+		sockOpts:    sockopt.FromConfig(cfg.Socket),
+		slots:       slots,
 	}, nil
 }
 
 // Start starts the TCP listener
 func (l *TCPListener) Start() error {
-	listener, err := net.Listen("tcp", l.config.ListenAddress)
+	l.status.begin()
+
+	listener, err := handover.Listen("listener/"+l.config.Name, l.config.ListenAddress)
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", l.config.ListenAddress, err)
+		err = fmt.Errorf("failed to listen on %s: %w", l.config.ListenAddress, err)
+		l.status.set(StateError, err)
+		return err
+	}
+
+	if sc, ok := listener.(syscall.Conn); ok {
+		if err := l.sockOpts.Apply(sc); err != nil {
+			listener.Close()
+			err = fmt.Errorf("failed to set socket options on %s: %w", l.config.ListenAddress, err)
+			l.status.set(StateError, err)
+			return err
+		}
 	}
 
 	l.listener = listener
+	l.status.set(StateListening, nil)
 
-	l.logger.LogInfo("TCP listener started", map[string]interface{}{
+	l.logger.LogInfo(logging.EventTCPListenerStarted, map[string]interface{}{
 		"listener": l.config.Name,
 		"address":  l.config.ListenAddress,
-		"target":   l.config.TargetAddress,
+		"target":   strings.Join(l.config.TargetAddresses(), ","),
 	})
 
 	// Start accept loop in a goroutine
@@ -83,9 +217,44 @@ func (l *TCPListener) Start() error {
 	return nil
 }
 
-// Stop stops the TCP listener
+// Drain stops accepting new connections. In-flight connections continue
+// until they finish or Stop is called; denied ones held in the tarpit are
+// closed.
+func (l *TCPListener) Drain() {
+	l.draining.Store(true)
+	if l.listener != nil {
+		l.listener.Close()
+	}
+	l.proxy.Drain()
+	l.status.set(StateDraining, nil)
+
+	l.logger.LogInfo(logging.EventTCPListenerDraining, map[string]interface{}{
+		"listener": l.config.Name,
+		"active":   l.Active(),
+	})
+}
+
+// Detach stops accepting after the socket was handed to a new process
+func (l *TCPListener) Detach() {
+	l.Drain()
+}
+
+// Active returns the number of in-flight connections
+func (l *TCPListener) Active() int {
+	l.activeConnsMu.Lock()
+	defer l.activeConnsMu.Unlock()
+	return len(l.activeConns)
+}
+
+// Stop stops the TCP listener. Only the first call has any effect.
 func (l *TCPListener) Stop() error {
-	l.logger.LogInfo("Stopping TCP listener", map[string]interface{}{
+	l.stopOnce.Do(l.stop)
+	return nil
+}
+
+// stop closes the socket and every connection, then waits for the handlers
+func (l *TCPListener) stop() {
+	l.logger.LogInfo(logging.EventTCPListenerStopping, map[string]interface{}{
 		"listener": l.config.Name,
 	})
 
@@ -99,18 +268,24 @@ func (l *TCPListener) Stop() error {
 
 	// Close all active connections to force Read() calls to return
 	l.closeAllConnections()
+	l.proxy.Close()
 
-	// Close rate limiter cleanup goroutines
+	// Close rate limiter, allowlist, ban list, resolver, quota and greylist goroutines
 	l.rateLimiter.Close()
+	l.allowlist.Close()
+	l.banList.Close()
+	l.targets.Close()
+	l.quotas.Close()
+	l.greyList.Close()
 
 	// Wait for all connection handlers to finish
 	l.wg.Wait()
 
-	l.logger.LogInfo("TCP listener stopped", map[string]interface{}{
+	l.status.set(StateStopped, nil)
+
+	l.logger.LogInfo(logging.EventTCPListenerStopped, map[string]interface{}{
 		"listener": l.config.Name,
 	})
-
-	return nil
 }
 
 // trackConnection adds a connection to the active connections list
@@ -148,25 +323,88 @@ func (l *TCPListener) Name() string {
 	return l.config.Name
 }
 
+// Status returns the listener's current health status
+func (l *TCPListener) Status() metrics.ListenerHealth {
+	return l.status.status(l.config.Name, "tcp", l.config.ListenAddress)
+}
+
+// Targets returns the listener's target selector
+func (l *TCPListener) Targets() *target.Selector {
+	return l.targets
+}
+
+// KillFlows closes the open connections matching filter
+func (l *TCPListener) KillFlows(filter proxy.FlowFilter, dryRun bool) int {
+	return l.proxy.KillFlows(filter, dryRun)
+}
+
+// Sampler returns the sampler picking the connections that are logged and timed
+func (l *TCPListener) Sampler() *proxy.Sampler {
+	return l.proxy.Sampler()
+}
+
+// Chaos returns the listener's fault injector
+func (l *TCPListener) Chaos() *chaos.Injector {
+	return l.proxy.Chaos()
+}
+
+// Tap returns the listener's packet capture slot
+func (l *TCPListener) Tap() *proxy.Tap {
+	return l.proxy.Tap()
+}
+
+// RateLimiter returns the listener's rate limit manager
+func (l *TCPListener) RateLimiter() *ratelimit.RateLimitManager {
+	return l.rateLimiter
+}
+
+// Allowlist returns the listener's allowlist
+func (l *TCPListener) Allowlist() *acl.Allowlist {
+	return l.allowlist
+}
+
+// BanList returns the listener's ban list, or nil if bans are disabled
+func (l *TCPListener) BanList() *ban.BanList {
+	return l.banList
+}
+
+// Quota returns the listener's quota tracker, or nil if quotas are disabled
+func (l *TCPListener) Quota() *quota.Tracker {
+	return l.quotas
+}
+
 // acceptLoop accepts incoming connections
 func (l *TCPListener) acceptLoop() {
 	defer l.wg.Done()
 
 	for {
+		if !l.acquireSlot() {
+			return
+		}
 		conn, err := l.listener.Accept()
 		if err != nil {
+			l.releaseSlot()
+			if l.draining.Load() {
+				return
+			}
 			select {
 			case <-l.ctx.Done():
 				// Shutdown requested
 				return
 			default:
-				l.logger.LogError("Accept error", map[string]interface{}{
+				l.logger.LogError(logging.EventTCPAcceptError, map[string]interface{}{
 					"listener": l.config.Name,
 					"error":    err.Error(),
 				})
+				l.status.degrade(err)
 				continue
 			}
 		}
+		l.status.recover()
+		proxy.SetTCPOptions(conn, l.config.TCP, l.config.TCP.GetClientKeepalive())
+		if sc, ok := conn.(syscall.Conn); ok {
+			l.sockOpts.Apply(sc)
+		}
 
 		// Track connection
 		l.trackConnection(conn)
@@ -175,8 +413,62 @@ func (l *TCPListener) acceptLoop() {
 		l.wg.Add(1)
 		go func(c net.Conn) {
 			defer l.wg.Done()
+			defer l.releaseSlot()
 			defer l.untrackConnection(c)
 			l.proxy.HandleConnection(c)
 		}(conn)
 	}
 }
+
+// acquireSlot takes a slot for the next connection, waiting while
+// accept_pause_threshold connections are handled. Meanwhile new
+// connections queue in the kernel backlog instead of each getting a
+// goroutine. It reports false if the listener stops while waiting.
+func (l *TCPListener) acquireSlot() bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	// Under a sustained flood accept pauses at every connection, so only
+	// one pause per acceptPauseLogInterval is logged
+	paused := time.Now()
+	l.pauses++
+	logged := paused.Sub(l.pauseLogged) >= acceptPauseLogInterval
+	if logged {
+		l.logger.LogWarning(logging.EventTCPAcceptPaused, map[string]interface{}{
+			"listener":  l.config.Name,
+			"active":    l.Active(),
+			"threshold": cap(l.slots),
+			"pauses":    l.pauses,
+		})
+		l.pauses = 0
+		l.pauseLogged = paused
+	}
+	l.metrics.AcceptPaused.WithLabelValues(l.config.Name).Set(1)
+	defer l.metrics.AcceptPaused.WithLabelValues(l.config.Name).Set(0)
+
+	select {
+	case l.slots <- struct{}{}:
+		if logged {
+			l.logger.LogInfo(logging.EventTCPAcceptResumed, map[string]interface{}{
+				"listener":  l.config.Name,
+				"paused_ms": time.Since(paused).Milliseconds(),
+			})
+		}
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+// releaseSlot frees the slot of a finished connection
+func (l *TCPListener) releaseSlot() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
@@ -4,16 +4,36 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/espegro/packetpony/internal/accounting"
 	"github.com/espegro/packetpony/internal/acl"
+	"github.com/espegro/packetpony/internal/ban"
+	"github.com/espegro/packetpony/internal/chaos"
 	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/dns"
+	"github.com/espegro/packetpony/internal/exempt"
+	"github.com/espegro/packetpony/internal/geoip"
+	"github.com/espegro/packetpony/internal/greylist"
+	"github.com/espegro/packetpony/internal/handover"
+	"github.com/espegro/packetpony/internal/hook"
 	"github.com/espegro/packetpony/internal/logging"
 	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/mirror"
 	"github.com/espegro/packetpony/internal/proxy"
+	"github.com/espegro/packetpony/internal/quota"
 	"github.com/espegro/packetpony/internal/ratelimit"
+	"github.com/espegro/packetpony/internal/script"
 	"github.com/espegro/packetpony/internal/session"
+	"github.com/espegro/packetpony/internal/sockopt"
+	"github.com/espegro/packetpony/internal/storage"
+	"github.com/espegro/packetpony/internal/tagging"
+	"github.com/espegro/packetpony/internal/target"
+	"github.com/espegro/packetpony/internal/tracing"
+	"github.com/espegro/packetpony/internal/xdp"
 )
 
 // UDPListener manages a UDP listening socket and handles packets
@@ -27,33 +47,129 @@ type UDPListener struct {
 	cancel         context.CancelFunc
 	wg             sync.WaitGroup
 	rateLimiter    *ratelimit.RateLimitManager
+	allowlist      *acl.Allowlist
+	banList        *ban.BanList
+	targets        *target.Selector
+	quotas         *quota.Tracker
+	greyList       *greylist.List
+	status         *statusTracker
+	metrics        *metrics.ProxyMetrics
+	store          storage.Store
+	sessionPrefix  string         // Store key prefix of saved sessions, empty unless persist_sessions is set
+	afxdp          *xdp.Receiver  // nil unless datagrams are read with AF_XDP
+	afxdpWG        sync.WaitGroup // Readers of the AF_XDP queues
+	clients        *clientLocks   // nil unless several goroutines read datagrams
+	draining       atomic.Bool
+	detached       atomic.Bool
+	stopOnce       sync.Once
 }
 
 // NewUDPListener creates a new UDP listener
 func NewUDPListener(
 	ctx context.Context,
+	instance string,
 	cfg *config.ListenerConfig,
+	guard *target.LoopGuard,
+	dnsResolver *dns.Resolver,
+	store storage.Store,
+	ledger *accounting.Ledger,
+	exemptions *exempt.Registry,
+	tracer *tracing.Tracer,
+	geo *geoip.DB,
 	logger logging.Logger,
 	metricsCollector *metrics.ProxyMetrics,
 ) (*UDPListener, error) {
 	// Create allowlist
-	allowlist, err := acl.NewAllowlist(cfg.Allowlist)
+	allowlist, err := newAllowlist(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create allowlist: %w", err)
 	}
 
+	// Create ban list if enabled
+	var banList *ban.BanList
+	if cfg.Ban != nil && cfg.Ban.Enabled {
+		banList = ban.NewBanList(cfg.Ban.MaxViolations, cfg.Ban.ViolationWindow, cfg.Ban.BanDuration, store, "ban/"+cfg.Name+"/")
+	}
+
+	// Create tagger
+	tagger, err := tagging.NewTagger(cfg.Tags, cfg.TagRules, geo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tagger: %w", err)
+	}
+
+	// Create target selector
+	targets, err := target.NewSelector(cfg, guard, dnsResolver)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create target selector: %w", err)
+	}
+
+	// Create pre-hook authorizer if enabled
+	var authorizer *hook.Authorizer
+	if cfg.PreHook != nil && cfg.PreHook.Enabled {
+		authorizer = hook.NewAuthorizer(*cfg.PreHook)
+	}
+
+	// Create mirror target if client traffic is copied to a second backend
+	mirrorTarget := mirror.NewTarget(cfg.Name, "udp", cfg.MirrorTarget, dnsResolver, metricsCollector)
+
 	// Create rate limiter
-	rateLimiter := ratelimit.NewRateLimitManager(cfg.RateLimits)
+	rateLimiter := ratelimit.NewRateLimitManager(cfg.RateLimits, exemptions.Checker(cfg.Name))
+	if cfg.RateLimits.Shared {
+		rateLimiter.Share(store, "ratelimit/"+cfg.Name+"/")
+	}
+	if cfg.Audit() {
+		rateLimiter.Audit()
+	}
+
+	// Create quota tracker if enabled
+	quotas, err := quota.New(cfg.Name, cfg.Quota, store, metricsCollector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create quota tracker: %w", err)
+	}
+
+	// Create greylist if enabled
+	greyList := greylist.New(cfg.Name, cfg.Greylist, store)
+
+	// Load script if enabled
+	scriptEngine, err := script.New(cfg.Name, cfg.Script, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load script: %w", err)
+	}
 
 	// Create session manager
-	sessionTimeout := 30 * time.Second
+	sessionTimeout := config.DefaultUDPSessionTimeout
 	if cfg.UDP != nil && cfg.UDP.SessionTimeout > 0 {
 		sessionTimeout = cfg.UDP.SessionTimeout
 	}
-	sessionManager := session.NewSessionManager(sessionTimeout)
+	var maxSessions, maxSessionsPerIP, dialRetries int
+	if cfg.UDP != nil {
+		maxSessions = cfg.UDP.MaxSessions
+		maxSessionsPerIP = cfg.UDP.MaxSessionsPerIP
+		dialRetries = cfg.UDP.DialRetries
+	}
+	sessionManager := session.NewSessionManager(sessionTimeout, maxSessions, maxSessionsPerIP, dnsResolver, cfg.GetTargetDialTimeout(), cfg.Transparent, cfg.BindSourceIP(), sockopt.FromConfig(cfg.Socket))
+	sessionManager.SetDialPolicy(session.DialPolicy{
+		Retries:           dialRetries,
+		RetryBackoff:      cfg.UDP.GetDialRetryBackoff(),
+		FailureBackoff:    cfg.UDP.GetDialFailureBackoff(),
+		FailureBackoffMax: cfg.UDP.GetDialFailureBackoffMax(),
+	})
+	sessionManager.OnResize(func(entries int) {
+		metricsCollector.SessionMapEntries.WithLabelValues(cfg.Name).Set(float64(entries))
+	})
 
 	// Create proxy
-	udpProxy := proxy.NewUDPProxy(cfg, logger, rateLimiter, allowlist, sessionManager, metricsCollector)
+	udpProxy := proxy.NewUDPProxy(cfg, logger, rateLimiter, allowlist, banList, sessionManager, tagger, targets, authorizer, ledger, quotas, greyList, scriptEngine, mirrorTarget, tracer, metricsCollector)
+
+	// Share runtime allowlist entries once the proxy logs store failures
+	allowlist.Share(store, "allow/"+cfg.Name+"/")
+
+	// Saved sessions are keyed by instance so instances sharing a Redis
+	// backend restore only their own
+	var sessionPrefix string
+	if cfg.UDP != nil && cfg.UDP.PersistSessions {
+		sessionPrefix = "session/" + instance + "/" + cfg.Name + "/"
+	}
 
 	// Create context with cancel
 	listenerCtx, cancel := context.WithCancel(ctx)
@@ -66,64 +182,162 @@ func NewUDPListener(
 		ctx:            listenerCtx,
 		cancel:         cancel,
 		rateLimiter:    rateLimiter,
+		allowlist:      allowlist,
+		banList:        banList,
+		targets:        targets,
+		quotas:         quotas,
+		greyList:       greyList,
+		status:         newStatusTracker(),
+		metrics:        metricsCollector,
+		store:          store,
+		sessionPrefix:  sessionPrefix,
 	}, nil
 }
 
 // Start starts the UDP listener
 func (l *UDPListener) Start() error {
-	addr, err := net.ResolveUDPAddr("udp", l.config.ListenAddress)
+	l.status.begin()
+
+	conn, err := handover.ListenUDP("listener/"+l.config.Name, l.config.ListenAddress)
 	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address %s: %w", l.config.ListenAddress, err)
+		err = fmt.Errorf("failed to listen on %s: %w", l.config.ListenAddress, err)
+		l.status.set(StateError, err)
+		return err
 	}
 
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", l.config.ListenAddress, err)
+	if err := sockopt.FromConfig(l.config.Socket).Apply(conn); err != nil {
+		conn.Close()
+		err = fmt.Errorf("failed to set socket options on %s: %w", l.config.ListenAddress, err)
+		l.status.set(StateError, err)
+		return err
+	}
+
+	if l.config.UDP.GetSessionKey() == config.SessionKeyIPDSCP {
+		if err := enableDSCP(conn); err != nil {
+			conn.Close()
+			err = fmt.Errorf("failed to enable DSCP reception on %s: %w", l.config.ListenAddress, err)
+			l.status.set(StateError, err)
+			return err
+		}
 	}
 
 	l.conn = conn
 
-	l.logger.LogInfo("UDP listener started", map[string]interface{}{
+	if size := l.config.UDP.GetReplyBatch(); size > 0 {
+		l.proxy.BatchReplies(conn, size, l.config.UDP.Offload)
+	}
+
+	// Listeners reading with AF_XDP hand datagrams to the proxy from
+	// several goroutines
+	if l.config.UDP.HasAFXDP() {
+		l.clients = newClientLocks(l.config.UDP.GetSessionKey())
+	}
+
+	// Pick up the sessions saved by the previous run
+	if l.sessionPrefix != "" {
+		l.proxy.RestoreSessions(l.store, l.sessionPrefix, conn)
+	}
+
+	l.status.set(StateListening, nil)
+
+	l.logger.LogInfo(logging.EventUDPListenerStarted, map[string]interface{}{
 		"listener": l.config.Name,
 		"address":  l.config.ListenAddress,
-		"target":   l.config.TargetAddress,
+		"target":   strings.Join(l.config.TargetAddresses(), ","),
 	})
 
-	// Start read loop in a goroutine
+	// Start read loop in a goroutine. With AF_XDP it reads the datagrams
+	// the program leaves to the socket.
 	l.wg.Add(1)
 	go l.readLoop()
+	if l.config.UDP.HasAFXDP() {
+		l.startAFXDP()
+	}
 
 	return nil
 }
 
-// Stop stops the UDP listener
+// Drain stops creating new sessions. Packets for existing sessions are still
+// forwarded until the sessions expire or Stop is called.
+func (l *UDPListener) Drain() {
+	l.draining.Store(true)
+	l.sessionManager.Drain()
+	l.status.set(StateDraining, nil)
+
+	l.logger.LogInfo(logging.EventUDPListenerDraining, map[string]interface{}{
+		"listener": l.config.Name,
+		"active":   l.Active(),
+	})
+}
+
+// Detach stops reading from the socket after it was handed to a new
+// process, which then receives all client packets. Existing sessions keep
+// delivering replies until they expire or Stop is called.
+func (l *UDPListener) Detach() {
+	l.Drain()
+	l.detached.Store(true)
+	if l.conn != nil {
+		l.conn.SetReadDeadline(time.Now())
+	}
+	l.stopAFXDP()
+}
+
+// Active returns the number of active sessions. Sessions that are saved
+// on shutdown are not waited for, so they count as none while draining.
+func (l *UDPListener) Active() int {
+	if l.sessionPrefix != "" && l.draining.Load() && !l.detached.Load() {
+		return 0
+	}
+	return l.sessionManager.Count()
+}
+
+// Stop stops the UDP listener. Only the first call has any effect.
 func (l *UDPListener) Stop() error {
-	l.logger.LogInfo("Stopping UDP listener", map[string]interface{}{
+	l.stopOnce.Do(l.stop)
+	return nil
+}
+
+// stop closes the socket and every session, then waits for the read loop
+func (l *UDPListener) stop() {
+	l.logger.LogInfo(logging.EventUDPListenerStopping, map[string]interface{}{
 		"listener": l.config.Name,
 	})
 
 	// Cancel context to signal shutdown
 	l.cancel()
+	l.stopAFXDP()
 
 	// Close connection to stop reading
 	if l.conn != nil {
 		l.conn.Close()
 	}
 
+	// Save sessions for the next run, unless the socket was handed to a
+	// process that is already serving
+	if l.sessionPrefix != "" && !l.detached.Load() {
+		l.proxy.SaveSessions(l.store, l.sessionPrefix)
+	}
+
 	// Close session manager
 	l.sessionManager.Close()
+	l.proxy.Close()
 
-	// Close rate limiter cleanup goroutines
+	// Close rate limiter, allowlist, ban list, resolver, quota and greylist goroutines
 	l.rateLimiter.Close()
+	l.allowlist.Close()
+	l.banList.Close()
+	l.targets.Close()
+	l.quotas.Close()
+	l.greyList.Close()
 
 	// Wait for read loop to finish
 	l.wg.Wait()
 
-	l.logger.LogInfo("UDP listener stopped", map[string]interface{}{
+	l.status.set(StateStopped, nil)
+
+	l.logger.LogInfo(logging.EventUDPListenerStopped, map[string]interface{}{
 		"listener": l.config.Name,
 	})
-
-	return nil
 }
 
 // Name returns the listener name
@@ -131,16 +345,108 @@ func (l *UDPListener) Name() string {
 	return l.config.Name
 }
 
+// Status returns the listener's current health status
+func (l *UDPListener) Status() metrics.ListenerHealth {
+	return l.status.status(l.config.Name, "udp", l.config.ListenAddress)
+}
+
+// Targets returns the listener's target selector
+func (l *UDPListener) Targets() *target.Selector {
+	return l.targets
+}
+
+// KillFlows closes the open sessions matching filter
+func (l *UDPListener) KillFlows(filter proxy.FlowFilter, dryRun bool) int {
+	return l.proxy.KillFlows(filter, dryRun)
+}
+
+// Sampler returns the sampler picking the sessions that are logged and timed
+func (l *UDPListener) Sampler() *proxy.Sampler {
+	return l.proxy.Sampler()
+}
+
+// Chaos returns the listener's fault injector
+func (l *UDPListener) Chaos() *chaos.Injector {
+	return l.proxy.Chaos()
+}
+
+// Tap returns the listener's packet capture slot
+func (l *UDPListener) Tap() *proxy.Tap {
+	return l.proxy.Tap()
+}
+
+// RateLimiter returns the listener's rate limit manager
+func (l *UDPListener) RateLimiter() *ratelimit.RateLimitManager {
+	return l.rateLimiter
+}
+
+// Allowlist returns the listener's allowlist
+func (l *UDPListener) Allowlist() *acl.Allowlist {
+	return l.allowlist
+}
+
+// BanList returns the listener's ban list, or nil if bans are disabled
+func (l *UDPListener) BanList() *ban.BanList {
+	return l.banList
+}
+
+// Quota returns the listener's quota tracker, or nil if quotas are disabled
+func (l *UDPListener) Quota() *quota.Tracker {
+	return l.quotas
+}
+
 // readLoop reads packets from the UDP socket
 func (l *UDPListener) readLoop() {
 	defer l.wg.Done()
 
-	bufferSize := 4096
+	bufferSize := config.DefaultUDPBufferSize
 	if l.config.UDP != nil && l.config.UDP.BufferSize > 0 {
 		bufferSize = l.config.UDP.BufferSize
 	}
 
-	buf := make([]byte, bufferSize)
+	// DSCP session keys need the TOS byte from the control messages
+	oobSize := 0
+	if l.config.UDP.GetSessionKey() == config.SessionKeyIPDSCP {
+		oobSize = 64
+	}
+
+	// read returns the next datagram, in a buffer reused by the read after
+	var read func() ([]byte, *net.UDPAddr, int, error)
+	if size := l.config.UDP.GetBatchSize(); size > 1 || l.config.UDP.Offload {
+		batchSize := l.metrics.ReceiveBatchSize.WithLabelValues(l.config.Name, "listener")
+		reader := proxy.NewBatchReader(l.conn, size, bufferSize, oobSize, func(n int) {
+			batchSize.Observe(float64(n))
+		})
+		if l.config.UDP.Offload {
+			segments := l.metrics.GROSegments.WithLabelValues(l.config.Name, "listener")
+			if err := reader.EnableGRO(func(n int) {
+				segments.Observe(float64(n))
+			}); err != nil {
+				l.logger.LogWarning(logging.EventUDPOffloadFailed, map[string]interface{}{
+					"listener": l.config.Name,
+					"error":    err.Error(),
+				})
+			}
+		}
+		read = func() ([]byte, *net.UDPAddr, int, error) {
+			data, oob, srcAddr, err := reader.Read()
+			if oobSize == 0 {
+				return data, srcAddr, 0, err
+			}
+			return data, srcAddr, parseDSCP(oob), err
+		}
+	} else {
+		buf := make([]byte, bufferSize)
+		oob := make([]byte, oobSize)
+		read = func() ([]byte, *net.UDPAddr, int, error) {
+			if oobSize == 0 {
+				n, srcAddr, err := l.conn.ReadFromUDP(buf)
+				return buf[:n], srcAddr, 0, err
+			}
+			n, oobn, _, srcAddr, err := l.conn.ReadMsgUDP(buf, oob)
+			return buf[:n], srcAddr, parseDSCP(oob[:oobn]), err
+		}
+	}
 
 	for {
 		select {
@@ -149,28 +455,33 @@ func (l *UDPListener) readLoop() {
 		default:
 		}
 
-		n, srcAddr, err := l.conn.ReadFromUDP(buf)
+		received, srcAddr, dscp, err := read()
 		if err != nil {
+			if l.detached.Load() {
+				return
+			}
 			select {
 			case <-l.ctx.Done():
 				// Shutdown requested
 				return
 			default:
-				l.logger.LogError("UDP read error", map[string]interface{}{
+				l.logger.LogError(logging.EventUDPReadError, map[string]interface{}{
 					"listener": l.config.Name,
 					"error":    err.Error(),
 				})
+				l.status.degrade(err)
 				continue
 			}
 		}
+		l.status.recover()
 
-		if n > 0 {
+		if len(received) > 0 {
 			// Make a copy of the data for processing
-			data := make([]byte, n)
-			copy(data, buf[:n])
+			data := make([]byte, len(received))
+			copy(data, received)
 
 			// Handle packet inline (UDP is fast, no need for goroutine per packet)
-			l.proxy.HandlePacket(data, srcAddr, l.conn)
+			l.handlePacket(data, srcAddr, dscp)
 		}
 	}
 }
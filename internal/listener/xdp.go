@@ -0,0 +1,176 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/xdp"
+)
+
+const (
+	// xdpSyncInterval is how often bans, runtime allowlist entries and drop
+	// counters are synced with the XDP programs
+	xdpSyncInterval = time.Second
+	// xdpFailureLogInterval limits how often failing syncs are logged
+	xdpFailureLogInterval = time.Minute
+)
+
+// everyNetwork is what the XDP program allows of a listener in audit mode
+var everyNetwork = []*net.IPNet{
+	{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+	{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+}
+
+// xdpInterface is a network interface whose XDP program filters the
+// packets of some listeners
+type xdpInterface struct {
+	name        string
+	mode        string
+	listeners   []xdp.Listener
+	filter      *xdp.Filter // nil unless attached
+	lastFailure time.Time   // Of the last logged sync failure
+}
+
+// newXDPInterfaces groups the listeners with xdp enabled by interface
+func newXDPInterfaces(listeners []config.ListenerConfig) ([]*xdpInterface, error) {
+	var ifaces []*xdpInterface
+	byName := make(map[string]*xdpInterface)
+	for i := range listeners {
+		cfg := &listeners[i]
+		if !cfg.HasXDP() {
+			continue
+		}
+		allowlist, err := newAllowlist(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", cfg.Name, err)
+		}
+		allow := allowlist.Networks()
+		if cfg.Audit() {
+			// Denied clients reach the listener to be logged
+			allow = everyNetwork
+		}
+
+		iface := byName[cfg.XDP.Interface]
+		if iface == nil {
+			iface = &xdpInterface{name: cfg.XDP.Interface, mode: cfg.XDP.GetMode()}
+			byName[iface.name] = iface
+			ifaces = append(ifaces, iface)
+		}
+		iface.listeners = append(iface.listeners, xdp.Listener{
+			Name:     cfg.Name,
+			Protocol: cfg.Protocol,
+			Address:  cfg.ListenAddress,
+			Allow:    allow,
+		})
+	}
+	return ifaces, nil
+}
+
+// attachXDP attaches the XDP program of every interface and syncs their
+// bans. An interface whose program fails to attach leaves its listeners
+// to drop in userspace, as without xdp. Returns false if none attached.
+func (m *Manager) attachXDP() bool {
+	attached := false
+	for _, iface := range m.xdp {
+		filter, err := xdp.Attach(iface.name, iface.mode, iface.listeners)
+		if err != nil {
+			m.logger.LogError(logging.EventXDPAttachFailed, map[string]interface{}{
+				"interface": iface.name,
+				"mode":      iface.mode,
+				"error":     err.Error(),
+			})
+			continue
+		}
+		iface.filter = filter
+		attached = true
+		m.logger.LogInfo(logging.EventXDPAttached, map[string]interface{}{
+			"interface": iface.name,
+			"mode":      iface.mode,
+			"listeners": len(iface.listeners),
+		})
+	}
+	if attached {
+		m.syncXDP()
+	}
+	return attached
+}
+
+// xdpSyncLoop periodically syncs the XDP programs until the manager stops
+func (m *Manager) xdpSyncLoop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(xdpSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.syncXDP()
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// syncXDP hands each attached program the runtime allowlist entries and
+// active bans of its listeners, leaving out exempt clients, and counts the
+// packets it dropped since the last sync
+func (m *Manager) syncXDP() {
+	for _, iface := range m.xdp {
+		if iface.filter == nil {
+			continue
+		}
+
+		var syncErr error
+		for _, l := range iface.listeners {
+			listener := m.listeners[l.Name]
+			if err := iface.filter.SetAllowed(l.Name, listener.Allowlist().RuntimeNetworks()); err != nil && syncErr == nil {
+				syncErr = fmt.Errorf("listener %s: %w", l.Name, err)
+			}
+			if listener.BanList() == nil {
+				continue
+			}
+			var ips []string
+			for _, b := range listener.BanList().List() {
+				if !listener.RateLimiter().IsExempt(b.IP) {
+					ips = append(ips, b.IP)
+				}
+			}
+			if err := iface.filter.SetBans(l.Name, ips); err != nil && syncErr == nil {
+				syncErr = fmt.Errorf("listener %s: %w", l.Name, err)
+			}
+		}
+
+		drops, err := iface.filter.Drops()
+		for _, d := range drops {
+			m.metrics.XDPDrops.WithLabelValues(d.Listener, d.Reason).Add(float64(d.Packets))
+		}
+		if err != nil && syncErr == nil {
+			syncErr = err
+		}
+
+		if syncErr != nil && time.Since(iface.lastFailure) >= xdpFailureLogInterval {
+			iface.lastFailure = time.Now()
+			m.logger.LogWarning(logging.EventXDPSyncFailed, map[string]interface{}{
+				"interface": iface.name,
+				"error":     syncErr.Error(),
+			})
+		}
+	}
+}
+
+// detachXDP detaches the attached XDP programs
+func (m *Manager) detachXDP() {
+	for _, iface := range m.xdp {
+		if iface.filter == nil {
+			continue
+		}
+		iface.filter.Close()
+		m.logger.LogInfo(logging.EventXDPDetached, map[string]interface{}{
+			"interface": iface.name,
+		})
+	}
+}
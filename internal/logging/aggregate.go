@@ -0,0 +1,197 @@
+package logging
+
+import (
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// denialKey identifies what a denial is counted under. The client is
+// empty for denials beyond the clients tracked.
+type denialKey struct {
+	code     string
+	listener string
+	client   string
+}
+
+// denialCount is what a key has seen in the current interval
+type denialCount struct {
+	ev         Event
+	warning    bool  // Logged as a warning rather than info
+	logged     int   // Denials logged as they happened
+	suppressed int64 // Denials counted into the summary
+}
+
+// DenyAggregator logs the first denials of each client by a listener and
+// counts the rest, so that a scan or a flood logs one summary per client
+// and interval instead of a line per denial. Messages of other events,
+// and those without a client_ip field, pass through.
+type DenyAggregator struct {
+	Logger
+	interval   time.Duration
+	burst      int
+	maxClients int
+	events     map[string]bool
+
+	mu         sync.Mutex
+	counts     map[denialKey]*denialCount
+	clients    int              // Keys with a client in counts
+	aggregated map[string]int64 // Denials counted into summaries since start, by event code
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDenyAggregator wraps logger and starts writing a summary every
+// interval
+func NewDenyAggregator(logger Logger, cfg config.DenyAggregationConfig) *DenyAggregator {
+	a := &DenyAggregator{
+		Logger:     logger,
+		interval:   cfg.GetInterval(),
+		burst:      cfg.GetBurst(),
+		maxClients: cfg.GetMaxClients(),
+		events:     make(map[string]bool),
+		counts:     make(map[denialKey]*denialCount),
+		aggregated: make(map[string]int64),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, code := range cfg.GetEvents() {
+		a.events[code] = true
+	}
+
+	go a.flushLoop()
+
+	return a
+}
+
+// LogInfo logs or counts an informational message
+func (a *DenyAggregator) LogInfo(ev Event, fields map[string]interface{}) {
+	if a.admit(ev, fields, false) {
+		a.Logger.LogInfo(ev, fields)
+	}
+}
+
+// LogWarning logs or counts a warning
+func (a *DenyAggregator) LogWarning(ev Event, fields map[string]interface{}) {
+	if a.admit(ev, fields, true) {
+		a.Logger.LogWarning(ev, fields)
+	}
+}
+
+// admit reports whether a message is logged now. Denials past the burst
+// of their client, and all denials of clients beyond those tracked, are
+// counted instead.
+func (a *DenyAggregator) admit(ev Event, fields map[string]interface{}, warning bool) bool {
+	if !a.events[ev.Code] {
+		return true
+	}
+	client, ok := fields["client_ip"].(string)
+	if !ok {
+		return true
+	}
+	listener, _ := fields["listener"].(string)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := denialKey{code: ev.Code, listener: listener, client: client}
+	count := a.counts[key]
+	if count == nil {
+		if a.clients >= a.maxClients {
+			key.client = ""
+			count = a.counts[key]
+		}
+		if count == nil {
+			count = &denialCount{ev: ev, warning: warning}
+			a.counts[key] = count
+			if key.client != "" {
+				a.clients++
+			}
+		}
+	}
+	if key.client != "" && count.logged < a.burst {
+		count.logged++
+		return true
+	}
+	count.suppressed++
+	a.aggregated[ev.Code]++
+	return false
+}
+
+// flushLoop writes the summaries of each interval until the aggregator
+// is closed
+func (a *DenyAggregator) flushLoop() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// flush writes a summary for every key with denials counted and starts a
+// new interval
+func (a *DenyAggregator) flush() {
+	a.mu.Lock()
+	counts := a.counts
+	a.counts = make(map[denialKey]*denialCount, len(counts))
+	a.clients = 0
+	a.mu.Unlock()
+
+	for key, count := range counts {
+		if count.suppressed == 0 {
+			continue
+		}
+		fields := map[string]interface{}{
+			"listener":     key.listener,
+			"denied_event": key.code,
+			"denial":       count.ev.Text,
+			"suppressed":   count.suppressed,
+			"interval":     a.interval.String(),
+		}
+		if key.client != "" {
+			fields["client_ip"] = key.client
+		} else {
+			fields["overflow"] = true
+		}
+		if count.warning {
+			a.Logger.LogWarning(EventDenialsAggregated, fields)
+		} else {
+			a.Logger.LogInfo(EventDenialsAggregated, fields)
+		}
+	}
+}
+
+// Aggregated returns the denials counted into summaries instead of logged
+// since start, keyed by event code
+func (a *DenyAggregator) Aggregated() map[string]int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	aggregated := make(map[string]int64, len(a.aggregated))
+	for code, n := range a.aggregated {
+		aggregated[code] = n
+	}
+	return aggregated
+}
+
+// Close writes the summaries of the current interval and closes the
+// wrapped logger. It is safe to call more than once.
+func (a *DenyAggregator) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.stop)
+		<-a.done
+		a.flush()
+	})
+	return a.Logger.Close()
+}
@@ -0,0 +1,179 @@
+package logging
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// asyncDropReportInterval is the shortest time between two warnings about
+// messages dropped by the same backend
+const asyncDropReportInterval = 10 * time.Second
+
+// asyncKind identifies which Logger method a queued record is for
+type asyncKind int
+
+const (
+	asyncConnection asyncKind = iota
+	asyncDebug
+	asyncError
+	asyncInfo
+	asyncWarning
+)
+
+// asyncRecord is one queued log call
+type asyncRecord struct {
+	kind   asyncKind
+	event  ConnectionEvent // asyncConnection only
+	ev     Event
+	fields map[string]interface{}
+}
+
+// asyncLogger puts a bounded queue and a writer goroutine in front of a
+// backend, so a slow syslog server or disk never stalls the goroutine that
+// logs. When the queue is full, new records are dropped and counted, and
+// the backend is told how many were lost once it catches up.
+type asyncLogger struct {
+	name     string
+	logger   Logger
+	queue    chan asyncRecord
+	dropped  atomic.Int64
+	reported int64 // Drops already reported; owned by the writer goroutine
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error // Result of Close
+}
+
+// newAsyncLogger starts a writer goroutine for logger with room for
+// queueSize records
+func newAsyncLogger(name string, logger Logger, queueSize int) *asyncLogger {
+	a := &asyncLogger{
+		name:   name,
+		logger: logger,
+		queue:  make(chan asyncRecord, queueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go a.run()
+
+	return a
+}
+
+// enqueue queues a record, dropping it if the queue is full
+func (a *asyncLogger) enqueue(r asyncRecord) {
+	select {
+	case a.queue <- r:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// LogConnection queues a connection event
+func (a *asyncLogger) LogConnection(event ConnectionEvent) {
+	a.enqueue(asyncRecord{kind: asyncConnection, event: event})
+}
+
+// LogDebug queues a diagnostic message
+func (a *asyncLogger) LogDebug(ev Event, fields map[string]interface{}) {
+	a.enqueue(asyncRecord{kind: asyncDebug, ev: ev, fields: fields})
+}
+
+// LogError queues an error message
+func (a *asyncLogger) LogError(ev Event, fields map[string]interface{}) {
+	a.enqueue(asyncRecord{kind: asyncError, ev: ev, fields: fields})
+}
+
+// LogInfo queues an informational message
+func (a *asyncLogger) LogInfo(ev Event, fields map[string]interface{}) {
+	a.enqueue(asyncRecord{kind: asyncInfo, ev: ev, fields: fields})
+}
+
+// LogWarning queues a warning message
+func (a *asyncLogger) LogWarning(ev Event, fields map[string]interface{}) {
+	a.enqueue(asyncRecord{kind: asyncWarning, ev: ev, fields: fields})
+}
+
+// Dropped returns the number of records dropped because the queue was full
+func (a *asyncLogger) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Reopen reopens the backend if it writes to a file
+func (a *asyncLogger) Reopen() error {
+	if r, ok := a.logger.(reopener); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// Close writes what is queued and closes the backend. Later calls do nothing.
+func (a *asyncLogger) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.stop)
+		<-a.done
+		a.err = a.logger.Close()
+	})
+	return a.err
+}
+
+// run writes queued records to the backend until the logger is closed,
+// then writes what is left
+func (a *asyncLogger) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(asyncDropReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case r := <-a.queue:
+			a.write(r)
+		case <-ticker.C:
+			a.reportDropped()
+		case <-a.stop:
+			for {
+				select {
+				case r := <-a.queue:
+					a.write(r)
+				default:
+					a.reportDropped()
+					return
+				}
+			}
+		}
+	}
+}
+
+// write passes a record to the backend
+func (a *asyncLogger) write(r asyncRecord) {
+	switch r.kind {
+	case asyncConnection:
+		a.logger.LogConnection(r.event)
+	case asyncDebug:
+		a.logger.LogDebug(r.ev, r.fields)
+	case asyncError:
+		a.logger.LogError(r.ev, r.fields)
+	case asyncInfo:
+		a.logger.LogInfo(r.ev, r.fields)
+	case asyncWarning:
+		a.logger.LogWarning(r.ev, r.fields)
+	}
+}
+
+// reportDropped warns through the backend about records dropped since the
+// last report
+func (a *asyncLogger) reportDropped() {
+	dropped := a.dropped.Load()
+	if dropped == a.reported {
+		return
+	}
+	a.logger.LogWarning(EventLogQueueFull, map[string]interface{}{
+		"backend":       a.name,
+		"dropped":       dropped - a.reported,
+		"dropped_total": dropped,
+	})
+	a.reported = dropped
+}
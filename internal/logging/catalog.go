@@ -0,0 +1,171 @@
+package logging
+
+// Event is a catalogued daemon message. Code is stable across releases so
+// runbooks and alerting can match on it; Text may be reworded.
+type Event struct {
+	Code string
+	Text string
+}
+
+// String returns the event as "CODE Text"
+func (e Event) String() string {
+	return e.Code + " " + e.Text
+}
+
+// Message catalog. Codes are grouped by area:
+//
+//	PP1xxx  process lifecycle, signals, upgrades and configuration
+//	PP2xxx  listeners
+//	PP3xxx  connection policy: ACL, rate limits, bans, pre-hook, exemptions
+//	PP4xxx  forwarding: target selection, connect, read/write, DNS
+//	PP5xxx  subsystems: logging backends, metrics, admin API, storage
+//
+// Codes are never reused; a retired message keeps its code reserved.
+var (
+	EventStarting             = Event{"PP1001", "PacketPony starting"}
+	EventRunning              = Event{"PP1002", "PacketPony is running"}
+	EventStopped              = Event{"PP1003", "PacketPony stopped gracefully"}
+	EventShutdownSignal       = Event{"PP1004", "Received shutdown signal"}
+	EventShutdownError        = Event{"PP1005", "Error during graceful shutdown"}
+	EventConfigWarning        = Event{"PP1006", "Configuration warning"}
+	EventUpgradeSignal        = Event{"PP1007", "Received upgrade signal, starting new process"}
+	EventUpgradeFailed        = Event{"PP1008", "Upgrade failed, continuing with current process"}
+	EventUpgradeReady         = Event{"PP1009", "New process ready, draining current process"}
+	EventUpgradeSignalFailed  = Event{"PP1010", "Failed to signal readiness to previous process"}
+	EventSystemdSocketIgnored = Event{"PP1011", "Ignoring unmatched systemd socket"}
+	EventStartupAborted       = Event{"PP1012", "Startup failed, exiting"}
+	EventPrivilegesDropped    = Event{"PP1013", "Privileges dropped"}
+	EventPrivilegeDropFailed  = Event{"PP1014", "Failed to drop privileges"}
+
+	EventManagerCreateFailed   = Event{"PP2001", "Failed to create listener manager"}
+	EventListenersStartFailed  = Event{"PP2002", "Failed to start listeners"}
+	EventListenersStarting     = Event{"PP2003", "Starting all listeners"}
+	EventListenersStarted      = Event{"PP2004", "Listeners started"}
+	EventListenerStartFailed   = Event{"PP2005", "Failed to start listener, will retry"}
+	EventListenerRetryStarted  = Event{"PP2006", "Listener started after retry"}
+	EventListenerRetryFailed   = Event{"PP2007", "Listener restart failed"}
+	EventListenersStopping     = Event{"PP2008", "Stopping all listeners"}
+	EventListenerStopFailed    = Event{"PP2009", "Failed to stop listener"}
+	EventListenersStopped      = Event{"PP2010", "All listeners stopped"}
+	EventDrainStarted          = Event{"PP2011", "Starting graceful shutdown"}
+	EventDrainCompleted        = Event{"PP2012", "All connections drained"}
+	EventDrainTimeout          = Event{"PP2013", "Graceful shutdown timeout exceeded, closing remaining connections"}
+	EventShutdownCompleted     = Event{"PP2014", "Graceful shutdown completed"}
+	EventTCPListenerStarted    = Event{"PP2015", "TCP listener started"}
+	EventTCPListenerDraining   = Event{"PP2016", "TCP listener draining"}
+	EventTCPListenerStopping   = Event{"PP2017", "Stopping TCP listener"}
+	EventTCPListenerStopped    = Event{"PP2018", "TCP listener stopped"}
+	EventTCPAcceptError        = Event{"PP2019", "Accept error"}
+	EventUDPListenerStarted    = Event{"PP2020", "UDP listener started"}
+	EventUDPListenerDraining   = Event{"PP2021", "UDP listener draining"}
+	EventUDPListenerStopping   = Event{"PP2022", "Stopping UDP listener"}
+	EventUDPListenerStopped    = Event{"PP2023", "UDP listener stopped"}
+	EventUDPReadError          = Event{"PP2024", "UDP read error"}
+	EventUDPSessionCreateError = Event{"PP2025", "Failed to create UDP session"}
+	EventSampleRateChanged     = Event{"PP2026", "Listener flow sample rate changed"}
+	EventTCPAcceptPaused       = Event{"PP2027", "TCP accept paused, too many active connections"}
+	EventTCPAcceptResumed      = Event{"PP2028", "TCP accept resumed"}
+	EventCaptureStarted        = Event{"PP2029", "Packet capture started"}
+	EventCaptureStopped        = Event{"PP2030", "Packet capture stopped"}
+	EventChaosSet              = Event{"PP2031", "Chaos mode faults set"}
+	EventChaosCleared          = Event{"PP2032", "Chaos mode faults cleared"}
+	EventUDPSessionsSaved      = Event{"PP2033", "UDP sessions saved for restart"}
+	EventUDPSessionsRestored   = Event{"PP2034", "UDP sessions restored"}
+	EventXDPAttached           = Event{"PP2035", "XDP program attached"}
+	EventXDPAttachFailed       = Event{"PP2036", "Failed to attach XDP program, filtering in userspace only"}
+	EventXDPDetached           = Event{"PP2037", "XDP program detached"}
+	EventXDPSyncFailed         = Event{"PP2038", "Failed to sync bans to XDP program"}
+	EventAFXDPStarted          = Event{"PP2039", "AF_XDP receive started"}
+	EventAFXDPFailed           = Event{"PP2040", "Failed to set up AF_XDP receive, reading from the socket only"}
+	EventAFXDPReadError        = Event{"PP2041", "AF_XDP read error"}
+	EventUDPOffloadFailed      = Event{"PP2042", "Failed to enable UDP receive offload, reading datagrams one at a time"}
+	EventUDPSegmentationFailed = Event{"PP2043", "UDP segmentation offload failed, sending replies one at a time"}
+	EventICMPSocketFailed      = Event{"PP2044", "Failed to open ICMP socket, denied UDP clients get no unreachable"}
+
+	EventDeniedACL              = Event{"PP3001", "Connection denied by ACL"}
+	EventDeniedRateLimit        = Event{"PP3002", "Connection denied by rate limit"}
+	EventDeniedBanned           = Event{"PP3003", "Connection denied: client is banned"}
+	EventUDPDeniedRateLimit     = Event{"PP3004", "UDP session denied by rate limit"}
+	EventBandwidthLogOnly       = Event{"PP3005", "Bandwidth limit exceeded (log_only mode)"}
+	EventBandwidthReturnLogOnly = Event{"PP3006", "Bandwidth limit exceeded on return traffic (log_only mode)"}
+	EventBandwidthDropped       = Event{"PP3007", "Connection dropped: bandwidth limit exceeded"}
+	EventPacketDropped          = Event{"PP3008", "Packet dropped: bandwidth limit exceeded"}
+	EventPacketReturnDropped    = Event{"PP3009", "Packet dropped: bandwidth limit exceeded on return traffic"}
+	EventClientBanned           = Event{"PP3010", "Client banned for repeated rate limit violations"}
+	EventBanExpired             = Event{"PP3011", "Client ban expired"}
+	EventHookFailed             = Event{"PP3012", "Pre-hook failed"}
+	EventDeniedHook             = Event{"PP3013", "Connection denied by pre-hook"}
+	EventExemptionIssued        = Event{"PP3014", "Rate limit exemption issued"}
+	EventExemptionRegistered    = Event{"PP3015", "Rate limit exemption registered"}
+	EventExemptionRevoked       = Event{"PP3016", "Rate limit exemption revoked"}
+	EventExemptionExpired       = Event{"PP3017", "Rate limit exemption expired"}
+	EventHTTPReadFailed         = Event{"PP3018", "Failed to read HTTP request"}
+	EventEmergencyEngaged       = Event{"PP3019", "Emergency mode engaged, bandwidth limits clamped"}
+	EventEmergencyReleased      = Event{"PP3020", "Emergency mode released, bandwidth limits restored"}
+	EventFlowsKilled            = Event{"PP3021", "Flows killed through the admin API"}
+	EventSniffReadFailed        = Event{"PP3022", "Failed to read client bytes for protocol sniffing"}
+	EventDeniedConcurrency      = Event{"PP3023", "Connection denied: listener concurrency limit reached"}
+	EventBanLifted              = Event{"PP3024", "Client ban lifted"}
+	EventBanSet                 = Event{"PP3025", "Client banned through the admin API"}
+	EventUDPDeniedSchedule      = Event{"PP3026", "UDP session denied outside the access schedule"}
+	EventQuotaExhausted         = Event{"PP3027", "Client quota exhausted"}
+	EventDeniedQuota            = Event{"PP3028", "Connection denied: client quota exhausted"}
+	EventQuotaReset             = Event{"PP3029", "Client quota reset through the admin API"}
+	EventScriptFailed           = Event{"PP3030", "Script hook failed"}
+	EventDeniedScript           = Event{"PP3031", "Connection denied by script"}
+	EventScriptLog              = Event{"PP3032", "Script log message"}
+	EventDenialsAggregated      = Event{"PP3033", "Denials aggregated"}
+	EventAuditDeniedACL         = Event{"PP3034", "Connection would be denied by ACL (audit mode)"}
+	EventAuditDeniedRateLimit   = Event{"PP3035", "Connection would be denied by rate limit (audit mode)"}
+	EventGreylisted             = Event{"PP3036", "New client greylisted"}
+	EventSignatureMatched       = Event{"PP3037", "Client payload matched a signature"}
+	EventAllowlistEntryAdded    = Event{"PP3038", "Allowlist entry added through the admin API"}
+	EventAllowlistEntryRemoved  = Event{"PP3039", "Allowlist entry removed through the admin API"}
+
+	EventTargetSelectFailed  = Event{"PP4001", "Failed to select target"}
+	EventTargetInvalid       = Event{"PP4002", "Invalid target address"}
+	EventTargetConnectFailed = Event{"PP4003", "Failed to connect to target"}
+	EventTargetWriteFailed   = Event{"PP4004", "Failed to write to target"}
+	EventTargetReadFailed    = Event{"PP4005", "Failed to read from target"}
+	EventClientWriteFailed   = Event{"PP4006", "Failed to write to client"}
+	EventResolveFailed       = Event{"PP4007", "Target re-resolution failed, keeping last known addresses"}
+	EventTargetsRemoved      = Event{"PP4008", "Target addresses removed from DNS"}
+	EventOversizeDropped     = Event{"PP4009", "Datagram dropped: larger than the path MTU"}
+	EventPathMTUFailed       = Event{"PP4010", "Failed to set up path MTU handling"}
+	EventTargetFailover      = Event{"PP4011", "Failed to connect to target, trying the next target"}
+	EventTargetDraining      = Event{"PP4012", "Target draining, new flows go to other targets"}
+	EventTargetUndrained     = Event{"PP4013", "Target back in service"}
+	EventDrainDeadline       = Event{"PP4014", "Target drain deadline reached, closing remaining flows"}
+	EventCircuitOpened       = Event{"PP4015", "Target circuit opened, no new flows until cooldown ends"}
+	EventCircuitHalfOpen     = Event{"PP4016", "Target circuit half-open, sending a trial flow"}
+	EventCircuitClosed       = Event{"PP4017", "Target circuit closed, target back in rotation"}
+	EventTargetConnected     = Event{"PP4018", "Connected to target"}
+	EventDatagramForwarded   = Event{"PP4019", "Datagram forwarded to target"}
+	EventDatagramReturned    = Event{"PP4020", "Datagram returned to client"}
+	EventReplyInvalid        = Event{"PP4021", "Reply from target failed validation"}
+	EventSIPRelayOpened      = Event{"PP4022", "SIP call media relay opened"}
+	EventSIPRelayClosed      = Event{"PP4023", "SIP call media relay closed"}
+	EventSIPRelayFailed      = Event{"PP4024", "SIP call media not relayed"}
+	EventScriptRouted        = Event{"PP4025", "Flow routed to another target by script"}
+
+	EventBackendUnavailable    = Event{"PP5001", "Optional logging backend unavailable, retrying in background"}
+	EventMetricsStarted        = Event{"PP5002", "Prometheus metrics server started"}
+	EventMetricsFailed         = Event{"PP5003", "Failed to start metrics server"}
+	EventAdminStarted          = Event{"PP5004", "Admin API started"}
+	EventAdminStartFailed      = Event{"PP5005", "Failed to start admin API"}
+	EventAdminFailed           = Event{"PP5006", "Admin API server failed"}
+	EventStorageCloseFailed    = Event{"PP5007", "Failed to close storage"}
+	EventBanStorageError       = Event{"PP5008", "Ban storage error"}
+	EventSyslogRestored        = Event{"PP5009", "Syslog connection restored"}
+	EventAccountingFlushFailed = Event{"PP5010", "Failed to persist accounting totals"}
+	EventMetricsServeFailed    = Event{"PP5011", "Metrics server failed"}
+	EventTraceExportFailed     = Event{"PP5012", "Failed to export trace spans"}
+	EventLogsReopened          = Event{"PP5013", "Log files reopened"}
+	EventLogsReopenFailed      = Event{"PP5014", "Failed to reopen log files"}
+	EventLogQueueFull          = Event{"PP5015", "Logging backend queue full, messages dropped"}
+	EventRateLimitStorageError = Event{"PP5016", "Shared rate limit storage error"}
+	EventExemptionStorageError = Event{"PP5017", "Exemption storage error"}
+	EventQuotaStorageError     = Event{"PP5018", "Quota storage error"}
+	EventGreylistStorageError  = Event{"PP5019", "Greylist storage error"}
+	EventAllowlistStorageError = Event{"PP5020", "Allowlist storage error"}
+)
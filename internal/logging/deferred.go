@@ -0,0 +1,144 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	deferredInitialBackoff = 1 * time.Second
+	deferredMaxBackoff     = 1 * time.Minute
+)
+
+// deferredLogger stands in for an optional backend that failed to initialize.
+// It retries initialization in the background with exponential backoff and
+// discards messages until the backend becomes available.
+type deferredLogger struct {
+	name    string
+	factory func() (Logger, error)
+	mu      sync.RWMutex
+	logger  Logger
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+	closed  sync.Once
+	err     error // Result of Close
+}
+
+// newDeferredLogger creates a deferred logger and starts the retry loop
+func newDeferredLogger(name string, factory func() (Logger, error)) *deferredLogger {
+	d := &deferredLogger{
+		name:    name,
+		factory: factory,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go d.retryLoop()
+
+	return d
+}
+
+// retryLoop retries backend initialization until it succeeds or the logger is closed
+func (d *deferredLogger) retryLoop() {
+	defer close(d.done)
+
+	backoff := deferredInitialBackoff
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		logger, err := d.factory()
+		if err != nil {
+			backoff *= 2
+			if backoff > deferredMaxBackoff {
+				backoff = deferredMaxBackoff
+			}
+			continue
+		}
+
+		d.mu.Lock()
+		d.logger = logger
+		d.mu.Unlock()
+
+		fmt.Fprintf(os.Stderr, "Logging backend %s initialized (%d messages dropped while unavailable)\n",
+			d.name, d.dropped.Load())
+		return
+	}
+}
+
+// current returns the underlying logger, or nil if not yet available
+func (d *deferredLogger) current() Logger {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.logger == nil {
+		d.dropped.Add(1)
+	}
+	return d.logger
+}
+
+// LogConnection logs a connection event if the backend is available
+func (d *deferredLogger) LogConnection(event ConnectionEvent) {
+	if logger := d.current(); logger != nil {
+		logger.LogConnection(event)
+	}
+}
+
+// LogDebug logs a diagnostic message if the backend is available
+func (d *deferredLogger) LogDebug(ev Event, fields map[string]interface{}) {
+	if logger := d.current(); logger != nil {
+		logger.LogDebug(ev, fields)
+	}
+}
+
+// LogError logs an error message if the backend is available
+func (d *deferredLogger) LogError(ev Event, fields map[string]interface{}) {
+	if logger := d.current(); logger != nil {
+		logger.LogError(ev, fields)
+	}
+}
+
+// LogInfo logs an informational message if the backend is available
+func (d *deferredLogger) LogInfo(ev Event, fields map[string]interface{}) {
+	if logger := d.current(); logger != nil {
+		logger.LogInfo(ev, fields)
+	}
+}
+
+// LogWarning logs a warning message if the backend is available
+func (d *deferredLogger) LogWarning(ev Event, fields map[string]interface{}) {
+	if logger := d.current(); logger != nil {
+		logger.LogWarning(ev, fields)
+	}
+}
+
+// Reopen reopens the backend if it is available and writes to a file
+func (d *deferredLogger) Reopen() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if r, ok := d.logger.(reopener); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// Close stops the retry loop and closes the backend if it was initialized
+func (d *deferredLogger) Close() error {
+	d.closed.Do(func() {
+		close(d.stop)
+		<-d.done
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.logger != nil {
+			d.err = d.logger.Close()
+		}
+	})
+	return d.err
+}
@@ -1,32 +1,59 @@
 package logging
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
 )
 
-// JSONLogger implements logging to a JSON file
+// JSONLogger implements logging to a JSON file. The file is rotated by
+// size or age when configured, and can be reopened after an external
+// rotation such as logrotate.
 type JSONLogger struct {
+	cfg     config.JSONLogConfig
 	file    *os.File
-	encoder *json.Encoder
+	size    int64     // Bytes in the current file
+	opened  time.Time // When the current file was opened
+	buf     bytes.Buffer
+	encoder *json.Encoder // Encodes into buf
 	mu      sync.Mutex
+	closed  bool           // Writes after Close are dropped
+	rotated sync.WaitGroup // Background compression of rotated files
+	tidy    sync.Mutex     // Serializes compression and pruning of backups
 }
 
 // NewJSONLogger creates a new JSON file logger
-func NewJSONLogger(path string) (*JSONLogger, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open log file: %w", err)
+func NewJSONLogger(cfg config.JSONLogConfig) (*JSONLogger, error) {
+	j := &JSONLogger{cfg: cfg}
+	j.encoder = json.NewEncoder(&j.buf)
+	if err := j.open(); err != nil {
+		return nil, err
 	}
+	return j, nil
+}
 
-	encoder := json.NewEncoder(file)
+// open opens the log file for appending. Must be called with j.mu held
+// or before the logger is shared.
+func (j *JSONLogger) open() error {
+	file, err := os.OpenFile(j.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
 
-	return &JSONLogger{
-		file:    file,
-		encoder: encoder,
-	}, nil
+	j.file = file
+	j.size = info.Size()
+	j.opened = time.Now()
+	return nil
 }
 
 // LogConnection logs a connection event as JSON
@@ -34,41 +61,81 @@ func (j *JSONLogger) LogConnection(event ConnectionEvent) {
 	j.mu.Lock()
 	defer j.mu.Unlock()
 
-	if err := j.encoder.Encode(event); err != nil {
+	if j.closed {
+		return
+	}
+	if err := j.write(event); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to write connection event to JSON log: %v\n", err)
 	}
 }
 
+// LogDebug logs a diagnostic message as JSON
+func (j *JSONLogger) LogDebug(ev Event, fields map[string]interface{}) {
+	j.logMessage("debug", ev, fields)
+}
+
 // LogError logs an error message as JSON
-func (j *JSONLogger) LogError(msg string, fields map[string]interface{}) {
-	j.logMessage("error", msg, fields)
+func (j *JSONLogger) LogError(ev Event, fields map[string]interface{}) {
+	j.logMessage("error", ev, fields)
 }
 
 // LogInfo logs an informational message as JSON
-func (j *JSONLogger) LogInfo(msg string, fields map[string]interface{}) {
-	j.logMessage("info", msg, fields)
+func (j *JSONLogger) LogInfo(ev Event, fields map[string]interface{}) {
+	j.logMessage("info", ev, fields)
 }
 
 // LogWarning logs a warning message as JSON
-func (j *JSONLogger) LogWarning(msg string, fields map[string]interface{}) {
-	j.logMessage("warning", msg, fields)
+func (j *JSONLogger) LogWarning(ev Event, fields map[string]interface{}) {
+	j.logMessage("warning", ev, fields)
 }
 
-// Close closes the log file
-func (j *JSONLogger) Close() error {
+// Reopen closes and reopens the log file by path, so writes go to a new
+// file after logrotate has moved the old one away
+func (j *JSONLogger) Reopen() error {
 	j.mu.Lock()
 	defer j.mu.Unlock()
-	return j.file.Close()
+
+	if j.closed {
+		return nil
+	}
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	return j.open()
+}
+
+// Close closes the log file and waits for rotated files to be compressed.
+// Later calls do nothing.
+func (j *JSONLogger) Close() error {
+	j.mu.Lock()
+	if j.closed {
+		j.mu.Unlock()
+		return nil
+	}
+	j.closed = true
+	var err error
+	if j.file != nil {
+		err = j.file.Close()
+	}
+	j.mu.Unlock()
+
+	j.rotated.Wait()
+	return err
 }
 
 // logMessage logs a general message as JSON
-func (j *JSONLogger) logMessage(level, msg string, fields map[string]interface{}) {
+func (j *JSONLogger) logMessage(level string, ev Event, fields map[string]interface{}) {
 	j.mu.Lock()
 	defer j.mu.Unlock()
 
+	if j.closed {
+		return
+	}
 	logEntry := map[string]interface{}{
 		"level":   level,
-		"message": msg,
+		"code":    ev.Code,
+		"message": ev.Text,
 	}
 
 	// Merge fields into log entry
@@ -76,7 +143,33 @@ func (j *JSONLogger) logMessage(level, msg string, fields map[string]interface{}
 		logEntry[key] = value
 	}
 
-	if err := j.encoder.Encode(logEntry); err != nil {
+	if err := j.write(logEntry); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to write log message to JSON log: %v\n", err)
 	}
 }
+
+// write encodes v as one line, rotating first if the line would take the
+// file past max_size or the file is older than max_age. Must be called
+// with j.mu held.
+func (j *JSONLogger) write(v interface{}) error {
+	j.buf.Reset()
+	if err := j.encoder.Encode(v); err != nil {
+		return err
+	}
+
+	if j.shouldRotate(int64(j.buf.Len())) {
+		if err := j.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate JSON log: %v\n", err)
+		}
+	}
+	if j.file == nil {
+		// A failed rotation or reopen left no file; retry on every write
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := j.file.Write(j.buf.Bytes())
+	j.size += int64(n)
+	return err
+}
@@ -0,0 +1,122 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat names rotated files; it sorts chronologically
+const backupTimeFormat = "20060102-150405.000"
+
+// shouldRotate reports whether writing n more bytes calls for a new file.
+// A single line larger than max_size still goes into an empty file.
+// Must be called with j.mu held.
+func (j *JSONLogger) shouldRotate(n int64) bool {
+	if j.file == nil || j.size == 0 {
+		return false
+	}
+	if maxSize := j.cfg.GetMaxSize(); maxSize > 0 && j.size+n > maxSize {
+		return true
+	}
+	return j.cfg.MaxAge > 0 && time.Since(j.opened) >= j.cfg.MaxAge
+}
+
+// rotate renames the current file to a timestamped backup and opens a new
+// one. Compression and pruning of old backups run in the background.
+// Must be called with j.mu held.
+func (j *JSONLogger) rotate() error {
+	j.file.Close()
+	j.file = nil
+
+	backup := j.cfg.Path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(j.cfg.Path, backup); err != nil {
+		return fmt.Errorf("failed to rename log file: %w", err)
+	}
+	if err := j.open(); err != nil {
+		return err
+	}
+
+	j.rotated.Add(1)
+	go func() {
+		defer j.rotated.Done()
+		j.tidy.Lock()
+		defer j.tidy.Unlock()
+		if j.cfg.Compress {
+			if err := compressFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to compress rotated JSON log %s: %v\n", backup, err)
+			}
+		}
+		if err := pruneBackups(j.cfg.Path, j.cfg.MaxBackups); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove old JSON logs: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// compressFile gzips path to path.gz and removes the original
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// pruneBackups deletes all but the newest keep rotated files of path.
+// keep 0 keeps every backup.
+func pruneBackups(path string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(match, path+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+
+	// Timestamps sort chronologically, oldest first
+	sort.Strings(backups)
+	for _, old := range backups[:len(backups)-keep] {
+		if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,513 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Kafka API keys and the versions used. Produce v3 and Metadata v4 are
+// supported by every broker since Kafka 1.0, including Kafka 4.
+const (
+	kafkaAPIProduce       = 0
+	kafkaAPIMetadata      = 3
+	kafkaProduceVersion   = 3
+	kafkaMetadataVersion  = 4
+	kafkaDefaultPort      = "9092"
+	kafkaClientID         = "packetpony"
+	kafkaMaxResponseBytes = 64 << 20
+	kafkaAcksAll          = -1
+	kafkaRecordBatchMagic = 2
+)
+
+// Kafka error codes that reject the records rather than fail the batch
+const (
+	kafkaErrCorruptMessage  = 2
+	kafkaErrMessageTooLarge = 10
+	kafkaErrRecordListLarge = 18
+	kafkaErrInvalidRecord   = 87
+)
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaPublisher produces records to the partitions of a Kafka topic over
+// the Kafka protocol, without compression, transactions or idempotence.
+// Partition leaders are looked up once when connecting; any failure,
+// such as a leader that moved, fails the batch so the stream logger
+// reconnects and looks them up again.
+type kafkaPublisher struct {
+	bootstrap *kafkaConn
+	topic     string
+	timeout   time.Duration
+	brokers   map[int32]string     // Node ID to host:port
+	leaders   []int32              // Leader node ID per partition
+	conns     map[int32]*kafkaConn // Open connections to leaders
+	next      int                  // Partition for the next record without a key
+}
+
+// kafkaConn is a connection to one broker
+type kafkaConn struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	timeout       time.Duration
+	correlationID int32
+}
+
+// dialKafka connects to a kafka:// URL and looks up the brokers leading
+// the partitions of topic, which must exist
+func dialKafka(broker, topic string, timeout time.Duration) (*kafkaPublisher, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), kafkaDefaultPort)
+	}
+
+	bootstrap, err := dialKafkaConn(host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	k := &kafkaPublisher{
+		bootstrap: bootstrap,
+		topic:     topic,
+		timeout:   timeout,
+		conns:     make(map[int32]*kafkaConn),
+	}
+	if err := k.lookup(); err != nil {
+		bootstrap.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+// lookup reads the brokers and partition leaders of the topic
+func (k *kafkaPublisher) lookup() error {
+	e := &kafkaEncoder{}
+	e.int32(1)
+	e.string(k.topic)
+	e.int8(0) // allow_auto_topic_creation
+	resp, err := k.bootstrap.roundTrip(kafkaAPIMetadata, kafkaMetadataVersion, e.b)
+	if err != nil {
+		return fmt.Errorf("metadata request failed: %w", err)
+	}
+
+	d := &kafkaDecoder{b: resp}
+	d.int32() // throttle_time_ms
+	k.brokers = make(map[int32]string)
+	for n := d.count(); n > 0; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.nullableString() // rack
+		k.brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.nullableString() // cluster_id
+	d.int32()          // controller_id
+
+	found := false
+	for n := d.count(); n > 0; n-- {
+		errorCode := d.int16()
+		name := d.string()
+		d.int8() // is_internal
+		partitions := make(map[int32]int32)
+		for p := d.count(); p > 0; p-- {
+			d.int16() // error_code
+			index := d.int32()
+			partitions[index] = d.int32()
+			d.skipInt32s() // replica_nodes
+			d.skipInt32s() // isr_nodes
+		}
+		if d.err != nil || name != k.topic {
+			continue
+		}
+		if errorCode != 0 {
+			return fmt.Errorf("topic %q: %s", k.topic, kafkaError(errorCode))
+		}
+		k.leaders = make([]int32, len(partitions))
+		for index, leader := range partitions {
+			if index < 0 || int(index) >= len(k.leaders) {
+				return fmt.Errorf("topic %q: invalid partition %d", k.topic, index)
+			}
+			k.leaders[index] = leader
+		}
+		found = true
+	}
+	if d.err != nil {
+		return fmt.Errorf("invalid metadata response: %w", d.err)
+	}
+	if !found || len(k.leaders) == 0 {
+		return fmt.Errorf("topic %q not found", k.topic)
+	}
+	return nil
+}
+
+// partition picks the partition of a record. Keys are hashed like the
+// Java client does, so events of a flow share a partition with anything
+// else keyed by the flow ID; records without a key are spread in turn.
+func (k *kafkaPublisher) partition(key string) int32 {
+	if key == "" {
+		k.next = (k.next + 1) % len(k.leaders)
+		return int32(k.next)
+	}
+	return int32(murmur2([]byte(key))&0x7fffffff) % int32(len(k.leaders))
+}
+
+// publish produces a batch with one request per partition leader and waits
+// for all in-sync replicas to acknowledge it. Records the broker refuses
+// as invalid or too large are counted as rejected; any other error fails
+// the batch, and a retry may produce partitions that did succeed twice.
+func (k *kafkaPublisher) publish(records []streamRecord) (int, error) {
+	byLeader := make(map[int32]map[int32][]streamRecord)
+	for _, r := range records {
+		p := k.partition(r.key)
+		leader := k.leaders[p]
+		if byLeader[leader] == nil {
+			byLeader[leader] = make(map[int32][]streamRecord)
+		}
+		byLeader[leader][p] = append(byLeader[leader][p], r)
+	}
+
+	rejected := 0
+	for leader, partitions := range byLeader {
+		conn, err := k.leaderConn(leader)
+		if err != nil {
+			return 0, err
+		}
+		n, err := k.produce(conn, partitions)
+		if err != nil {
+			return 0, err
+		}
+		rejected += n
+	}
+	return rejected, nil
+}
+
+// leaderConn returns the connection to a partition leader, dialing it the
+// first time
+func (k *kafkaPublisher) leaderConn(leader int32) (*kafkaConn, error) {
+	if conn, ok := k.conns[leader]; ok {
+		return conn, nil
+	}
+	addr, ok := k.brokers[leader]
+	if !ok {
+		return nil, fmt.Errorf("no leader for a partition of topic %q", k.topic)
+	}
+	conn, err := dialKafkaConn(addr, k.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("broker %d (%s): %w", leader, addr, err)
+	}
+	k.conns[leader] = conn
+	return conn, nil
+}
+
+// produce sends the records of one leader's partitions in a single
+// request and returns the number of records rejected
+func (k *kafkaPublisher) produce(conn *kafkaConn, partitions map[int32][]streamRecord) (int, error) {
+	e := &kafkaEncoder{}
+	e.int16(-1) // transactional_id
+	e.int16(kafkaAcksAll)
+	e.int32(int32(k.timeout / time.Millisecond))
+	e.int32(1)
+	e.string(k.topic)
+	e.int32(int32(len(partitions)))
+	for p, records := range partitions {
+		e.int32(p)
+		batch := encodeRecordBatch(records, time.Now())
+		e.int32(int32(len(batch)))
+		e.b = append(e.b, batch...)
+	}
+	resp, err := conn.roundTrip(kafkaAPIProduce, kafkaProduceVersion, e.b)
+	if err != nil {
+		return 0, err
+	}
+
+	rejected := 0
+	d := &kafkaDecoder{b: resp}
+	for n := d.count(); n > 0; n-- {
+		d.string() // name
+		for p := d.count(); p > 0; p-- {
+			index := d.int32()
+			errorCode := d.int16()
+			d.int64() // base_offset
+			d.int64() // log_append_time_ms
+			if d.err != nil {
+				break
+			}
+			switch errorCode {
+			case 0:
+			case kafkaErrCorruptMessage, kafkaErrMessageTooLarge, kafkaErrRecordListLarge, kafkaErrInvalidRecord:
+				rejected += len(partitions[index])
+			default:
+				return 0, fmt.Errorf("partition %d: %s", index, kafkaError(errorCode))
+			}
+		}
+	}
+	if d.err != nil {
+		return 0, fmt.Errorf("invalid produce response: %w", d.err)
+	}
+	return rejected, nil
+}
+
+// Close closes the connections to all brokers
+func (k *kafkaPublisher) Close() error {
+	for _, conn := range k.conns {
+		conn.Close()
+	}
+	return k.bootstrap.Close()
+}
+
+// encodeRecordBatch encodes records as an uncompressed record batch
+// (message format v2), all stamped with now
+func encodeRecordBatch(records []streamRecord, now time.Time) []byte {
+	ts := now.UnixMilli()
+
+	body := &kafkaEncoder{}
+	body.int16(0) // attributes: no compression, create time
+	body.int32(int32(len(records) - 1))
+	body.int64(ts)
+	body.int64(ts)
+	body.int64(-1) // producer_id
+	body.int16(-1) // producer_epoch
+	body.int32(-1) // base_sequence
+	body.int32(int32(len(records)))
+	record := &kafkaEncoder{}
+	for i, r := range records {
+		record.b = record.b[:0]
+		record.int8(0)   // attributes
+		record.varint(0) // timestamp_delta
+		record.varint(int64(i))
+		if r.key == "" {
+			record.varint(-1)
+		} else {
+			record.varint(int64(len(r.key)))
+			record.b = append(record.b, r.key...)
+		}
+		record.varint(int64(len(r.value)))
+		record.b = append(record.b, r.value...)
+		record.varint(0) // headers
+		body.varint(int64(len(record.b)))
+		body.b = append(body.b, record.b...)
+	}
+
+	batch := &kafkaEncoder{b: make([]byte, 0, 21+len(body.b))}
+	batch.int64(0)                      // base_offset, assigned by the broker
+	batch.int32(int32(9 + len(body.b))) // batch_length, from the leader epoch on
+	batch.int32(-1)                     // partition_leader_epoch
+	batch.int8(kafkaRecordBatchMagic)
+	batch.int32(int32(crc32.Checksum(body.b, kafkaCRCTable)))
+	batch.b = append(batch.b, body.b...)
+	return batch.b
+}
+
+// murmur2 is the hash the Java client partitions keys with
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+		data = data[4:]
+	}
+	switch len(data) {
+	case 3:
+		h ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// kafkaError describes a Kafka error code
+func kafkaError(code int16) string {
+	switch code {
+	case 3:
+		return "unknown topic or partition"
+	case 5:
+		return "leader not available"
+	case 6:
+		return "not the leader for the partition"
+	case 7:
+		return "request timed out"
+	case 19, 20:
+		return "not enough in-sync replicas"
+	case 29:
+		return "not authorized to write to the topic"
+	case 31:
+		return "authentication required"
+	default:
+		return "error code " + strconv.Itoa(int(code))
+	}
+}
+
+// dialKafkaConn connects to a broker at host:port
+func dialKafkaConn(addr string, timeout time.Duration) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaConn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// roundTrip sends a request and returns the response body after its
+// header
+func (c *kafkaConn) roundTrip(apiKey, version int16, body []byte) ([]byte, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	c.correlationID++
+	e := &kafkaEncoder{b: make([]byte, 4, 4+10+len(kafkaClientID)+len(body))}
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(c.correlationID)
+	e.string(kafkaClientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	if _, err := c.conn.Write(e.b); err != nil {
+		return nil, err
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > kafkaMaxResponseBytes {
+		return nil, fmt.Errorf("invalid response size %d", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	if id := int32(binary.BigEndian.Uint32(resp)); id != c.correlationID {
+		return nil, fmt.Errorf("response to request %d, expected %d", id, c.correlationID)
+	}
+	return resp[4:], nil
+}
+
+// Close closes the connection
+func (c *kafkaConn) Close() error {
+	return c.conn.Close()
+}
+
+// kafkaEncoder appends Kafka protocol primitives
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8)    { e.b = append(e.b, byte(v)) }
+func (e *kafkaEncoder) int16(v int16)  { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32)  { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64)  { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+func (e *kafkaEncoder) varint(v int64) { e.b = binary.AppendVarint(e.b, v) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// kafkaDecoder reads Kafka protocol primitives. The first error sticks,
+// and later reads return zero values.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+var errKafkaShort = errors.New("response too short")
+
+// take returns the next n bytes
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.b) {
+		if d.err == nil {
+			d.err = errKafkaShort
+		}
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	return string(d.take(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// count reads an array length; a null array counts as empty
+func (d *kafkaDecoder) count() int {
+	n := d.int32()
+	if n < 0 || d.err != nil {
+		return 0
+	}
+	// Every element takes at least a byte
+	if int(n) > len(d.b) {
+		d.err = errKafkaShort
+		return 0
+	}
+	return int(n)
+}
+
+// skipInt32s skips an array of int32
+func (d *kafkaDecoder) skipInt32s() {
+	d.take(4 * d.count())
+}
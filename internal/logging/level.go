@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is the severity of a daemon message
+type Level int
+
+// Levels in increasing severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+// ParseLevel converts a configured level name to a Level. An empty name
+// means info.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warning":
+		return LevelWarning, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+// String returns the level name
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarning:
+		return "warning"
+	case LevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// LeveledLogger drops daemon messages below its level. Connection events
+// are not filtered; they have their own logging settings.
+type LeveledLogger struct {
+	Logger
+	level Level
+}
+
+// NewLeveledLogger filters logger at level
+func NewLeveledLogger(logger Logger, level Level) *LeveledLogger {
+	return &LeveledLogger{Logger: logger, level: level}
+}
+
+// WithLevel returns logger filtered at level instead of its current level,
+// so a listener can log more or less than the rest of the process. Loggers
+// that are not filtered are wrapped.
+func WithLevel(logger Logger, level Level) Logger {
+	if l, ok := logger.(*LeveledLogger); ok {
+		return NewLeveledLogger(l.Logger, level)
+	}
+	return NewLeveledLogger(logger, level)
+}
+
+// DebugEnabled reports whether logger emits debug messages. Debug output is
+// opt-in: only a LeveledLogger at debug level reports true, so callers can
+// skip building per-packet fields otherwise.
+func DebugEnabled(logger Logger) bool {
+	l, ok := logger.(*LeveledLogger)
+	return ok && l.level <= LevelDebug
+}
+
+// LogDebug forwards a debug message if the level allows it
+func (l *LeveledLogger) LogDebug(ev Event, fields map[string]interface{}) {
+	if l.level <= LevelDebug {
+		l.Logger.LogDebug(ev, fields)
+	}
+}
+
+// LogInfo forwards an informational message if the level allows it
+func (l *LeveledLogger) LogInfo(ev Event, fields map[string]interface{}) {
+	if l.level <= LevelInfo {
+		l.Logger.LogInfo(ev, fields)
+	}
+}
+
+// LogWarning forwards a warning if the level allows it
+func (l *LeveledLogger) LogWarning(ev Event, fields map[string]interface{}) {
+	if l.level <= LevelWarning {
+		l.Logger.LogWarning(ev, fields)
+	}
+}
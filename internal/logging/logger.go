@@ -3,7 +3,10 @@
 package logging
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/espegro/packetpony/internal/config"
@@ -12,70 +15,149 @@ import (
 // Logger defines the interface for logging connection events and messages
 type Logger interface {
 	LogConnection(event ConnectionEvent)
-	LogError(msg string, fields map[string]interface{})
-	LogInfo(msg string, fields map[string]interface{})
-	LogWarning(msg string, fields map[string]interface{})
+	LogDebug(ev Event, fields map[string]interface{})
+	LogError(ev Event, fields map[string]interface{})
+	LogInfo(ev Event, fields map[string]interface{})
+	LogWarning(ev Event, fields map[string]interface{})
 	Close() error
 }
 
 // ConnectionEvent represents a connection lifecycle event
 type ConnectionEvent struct {
-	Timestamp       time.Time `json:"timestamp"`
-	ListenerName    string    `json:"listener_name"`
-	Protocol        string    `json:"protocol"`
-	SourceIP        string    `json:"source_ip"`
-	SourcePort      int       `json:"source_port"`
-	TargetIP        string    `json:"target_ip"`
-	TargetPort      int       `json:"target_port"`
-	EventType       string    `json:"event_type"` // "open", "close"
-	BytesSent       int64     `json:"bytes_sent"`
-	BytesReceived   int64     `json:"bytes_received"`
-	PacketsSent     int64     `json:"packets_sent,omitempty"`     // UDP only
-	PacketsReceived int64     `json:"packets_received,omitempty"` // UDP only
-	Duration        int64     `json:"duration_ms"`                // milliseconds
-	Error           string    `json:"error,omitempty"`
+	Timestamp       time.Time         `json:"timestamp"`
+	FlowID          string            `json:"flow_id,omitempty"`
+	ListenerName    string            `json:"listener_name"`
+	Protocol        string            `json:"protocol"`
+	SourceIP        string            `json:"source_ip"`
+	SourcePort      int               `json:"source_port"`
+	TargetIP        string            `json:"target_ip"`
+	TargetPort      int               `json:"target_port"`
+	EventType       string            `json:"event_type"` // "open", "update", "close" or "dns"
+	BytesSent       int64             `json:"bytes_sent"`
+	BytesReceived   int64             `json:"bytes_received"`
+	PacketsSent     int64             `json:"packets_sent,omitempty"`     // UDP only
+	PacketsReceived int64             `json:"packets_received,omitempty"` // UDP only
+	Duration        int64             `json:"duration_ms"`                // milliseconds
+	SampleRate      int               `json:"sample_rate,omitempty"`      // set when 1 in N flows is logged
+	Error           string            `json:"error,omitempty"`
+	CloseReason     string            `json:"close_reason,omitempty"` // set when packetpony forcibly closed the flow
+	AppProtocol     string            `json:"app_protocol,omitempty"` // detected application protocol (classify)
+	JA3             string            `json:"ja3,omitempty"`          // JA3 hash of the client's TLS ClientHello (fingerprint)
+	SSHClient       string            `json:"ssh_client,omitempty"`   // SSH client identification string (fingerprint)
+	HTTPMethod      string            `json:"http_method,omitempty"`  // first request in HTTP-aware mode
+	HTTPHost        string            `json:"http_host,omitempty"`
+	HTTPPath        string            `json:"http_path,omitempty"` // without query string
+	DNSQName        string            `json:"dns_qname,omitempty"` // DNS transaction with protocol_hint dns
+	DNSQType        string            `json:"dns_qtype,omitempty"`
+	DNSRCode        string            `json:"dns_rcode,omitempty"`
+	ConnectionID    string            `json:"connection_id,omitempty"` // DTLS or QUIC connection ID keying a UDP session
+	Rebinds         int64             `json:"rebinds,omitempty"`       // Times a UDP session followed its client to a new address
+	Tags            map[string]string `json:"tags,omitempty"`
 }
 
 // MultiLogger supports multiple logging backends simultaneously
 type MultiLogger struct {
 	loggers []Logger
+	names   []string // Backend name of each logger, for Dropped
 }
 
-// NewMultiLogger creates a logger that writes to multiple backends
+// NewMultiLogger creates a logger that writes to multiple backends.
+// Backends marked as not required degrade to a warning when they fail to
+// initialize and keep retrying in the background. Each backend is written
+// by its own goroutine from a bounded queue, so logging never blocks.
 func NewMultiLogger(cfg config.LoggingConfig) (*MultiLogger, error) {
 	var loggers []Logger
+	var names []string
+	var warnings []map[string]interface{}
+	queueSize := cfg.GetQueueSize()
+
+	// add queues writes to a backend unless it queues them itself
+	add := func(name string, logger Logger) {
+		if _, ok := logger.(*StreamLogger); !ok {
+			logger = newAsyncLogger(name, logger, queueSize)
+		}
+		loggers = append(loggers, logger)
+		names = append(names, name)
+	}
+
+	// addBackend initializes a backend, deferring it if it is optional and fails
+	addBackend := func(name string, required bool, factory func() (Logger, error)) error {
+		logger, err := factory()
+		if err == nil {
+			add(name, logger)
+			return nil
+		}
+		if required {
+			return fmt.Errorf("failed to create %s logger: %w", name, err)
+		}
+		fmt.Fprintf(os.Stderr, "Optional logging backend %s unavailable, retrying in background: %v\n", name, err)
+		warnings = append(warnings, map[string]interface{}{
+			"backend": name,
+			"error":   err.Error(),
+		})
+		add(name, newDeferredLogger(name, factory))
+		return nil
+	}
 
 	// Setup syslog if enabled
 	if cfg.Syslog.Enabled {
-		syslogger, err := NewSyslogLogger(cfg.Syslog)
+		err := addBackend("syslog", cfg.Syslog.IsRequired(), func() (Logger, error) {
+			return NewSyslogLogger(cfg.Syslog)
+		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to create syslog logger: %w", err)
+			return nil, err
 		}
-		loggers = append(loggers, syslogger)
 	}
 
 	// Setup JSON file logging if enabled
 	if cfg.JSONLog.Enabled {
-		jsonLogger, err := NewJSONLogger(cfg.JSONLog.Path)
+		err := addBackend("JSON", cfg.JSONLog.IsRequired(), func() (Logger, error) {
+			return NewJSONLogger(cfg.JSONLog)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Setup event streaming if enabled
+	if cfg.Stream.Enabled {
+		err := addBackend("stream", cfg.Stream.IsRequired(), func() (Logger, error) {
+			return NewStreamLogger(cfg.Stream)
+		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to create JSON logger: %w", err)
+			return nil, err
+		}
+	}
+
+	// Setup webhook if enabled
+	if cfg.Webhook.Enabled {
+		err := addBackend("webhook", true, func() (Logger, error) {
+			return NewWebhookLogger(cfg.Webhook)
+		})
+		if err != nil {
+			return nil, err
 		}
-		loggers = append(loggers, jsonLogger)
 	}
 
 	// Setup stdout logging if enabled
 	if cfg.Stdout.Enabled {
-		stdoutLogger := NewStdoutLogger(cfg.Stdout.UseJSON)
-		loggers = append(loggers, stdoutLogger)
+		add("stdout", NewStdoutLogger(cfg.Stdout.UseJSON))
 	}
 
 	if len(loggers) == 0 {
 		return nil, fmt.Errorf("no logging backends enabled")
 	}
 
-	return &MultiLogger{
+	multi := &MultiLogger{
 		loggers: loggers,
-	}, nil
+		names:   names,
+	}
+
+	for _, fields := range warnings {
+		multi.LogWarning(EventBackendUnavailable, fields)
+	}
+
+	return multi, nil
 }
 
 // LogConnection logs a connection event to all backends
@@ -85,28 +167,73 @@ func (m *MultiLogger) LogConnection(event ConnectionEvent) {
 	}
 }
 
+// LogDebug logs a diagnostic message to all backends
+func (m *MultiLogger) LogDebug(ev Event, fields map[string]interface{}) {
+	for _, logger := range m.loggers {
+		logger.LogDebug(ev, fields)
+	}
+}
+
 // LogError logs an error message to all backends
-func (m *MultiLogger) LogError(msg string, fields map[string]interface{}) {
+func (m *MultiLogger) LogError(ev Event, fields map[string]interface{}) {
 	for _, logger := range m.loggers {
-		logger.LogError(msg, fields)
+		logger.LogError(ev, fields)
 	}
 }
 
 // LogInfo logs an informational message to all backends
-func (m *MultiLogger) LogInfo(msg string, fields map[string]interface{}) {
+func (m *MultiLogger) LogInfo(ev Event, fields map[string]interface{}) {
 	for _, logger := range m.loggers {
-		logger.LogInfo(msg, fields)
+		logger.LogInfo(ev, fields)
 	}
 }
 
 // LogWarning logs a warning message to all backends
-func (m *MultiLogger) LogWarning(msg string, fields map[string]interface{}) {
+func (m *MultiLogger) LogWarning(ev Event, fields map[string]interface{}) {
+	for _, logger := range m.loggers {
+		logger.LogWarning(ev, fields)
+	}
+}
+
+// dropCounter is implemented by backends that drop messages they cannot
+// keep up with
+type dropCounter interface {
+	Dropped() int64
+}
+
+// Dropped returns the number of messages and events each backend has
+// dropped because its queue was full, keyed by backend name
+func (m *MultiLogger) Dropped() map[string]int64 {
+	dropped := make(map[string]int64, len(m.loggers))
+	for i, logger := range m.loggers {
+		if d, ok := logger.(dropCounter); ok {
+			dropped[strings.ToLower(m.names[i])] = d.Dropped()
+		}
+	}
+	return dropped
+}
+
+// reopener is implemented by backends that write to a file
+type reopener interface {
+	Reopen() error
+}
+
+// Reopen reopens file backends by path, for use after logrotate has
+// moved their files away. Backends without files are unaffected.
+func (m *MultiLogger) Reopen() error {
+	var errs []error
 	for _, logger := range m.loggers {
-		logger.LogWarning(msg, fields)
+		if r, ok := logger.(reopener); ok {
+			if err := r.Reopen(); err != nil {
+				errs = append(errs, err)
+			}
+		}
 	}
+	return errors.Join(errs...)
 }
 
-// Close closes all logging backends
+// Close closes all logging backends. Every backend tolerates being closed
+// more than once.
 func (m *MultiLogger) Close() error {
 	var lastErr error
 	for _, logger := range m.loggers {
@@ -116,3 +243,17 @@ func (m *MultiLogger) Close() error {
 	}
 	return lastErr
 }
+
+// formatTags renders flow tags as sorted "tag.key=value" pairs for text output
+func formatTags(tags map[string]string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	keys := sortedKeys(tags)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("tag.%s=%q", key, tags[key]))
+	}
+	return parts
+}
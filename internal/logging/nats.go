@@ -0,0 +1,182 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// natsPublisher publishes records to a NATS subject over the NATS text
+// protocol. Each batch ends with a PING so the PONG confirms the server
+// has processed every PUB before it.
+type natsPublisher struct {
+	conn       net.Conn
+	r          *bufio.Reader
+	subject    string
+	timeout    time.Duration
+	maxPayload int64
+}
+
+// natsInfo holds the fields of the server INFO message that matter here
+type natsInfo struct {
+	MaxPayload  int64 `json:"max_payload"`
+	TLSRequired bool  `json:"tls_required"`
+}
+
+// natsConnect is the CONNECT message sent after INFO
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// dialNATS connects to a nats:// URL and completes the handshake. A user
+// and password, or a bare token, in the URL are used for authentication.
+func dialNATS(broker, subject string, timeout time.Duration) (*natsPublisher, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	n := &natsPublisher{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		subject: subject,
+		timeout: timeout,
+	}
+	if err := n.handshake(u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// handshake reads INFO, sends CONNECT and waits for the PONG to a PING,
+// which the server only sends once the connection is accepted
+func (n *natsPublisher) handshake(u *url.URL) error {
+	n.conn.SetDeadline(time.Now().Add(n.timeout))
+	defer n.conn.SetDeadline(time.Time{})
+
+	line, err := n.readLine()
+	if err != nil {
+		return fmt.Errorf("failed to read server info: %w", err)
+	}
+	payload, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		return fmt.Errorf("unexpected greeting %q", line)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(payload), &info); err != nil {
+		return fmt.Errorf("invalid server info: %w", err)
+	}
+	if info.TLSRequired {
+		return errors.New("server requires TLS, which is not supported")
+	}
+	n.maxPayload = info.MaxPayload
+
+	connect := natsConnect{Name: "packetpony", Lang: "go", Version: "1"}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			connect.User = u.User.Username()
+			connect.Pass = pass
+		} else {
+			connect.AuthToken = u.User.Username()
+		}
+	}
+	data, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(n.conn, "CONNECT %s\r\nPING\r\n", data); err != nil {
+		return err
+	}
+	return n.awaitPong()
+}
+
+// publish sends a PUB per record and waits for the PONG to the PING that
+// follows them. Records larger than the server's max_payload are rejected.
+func (n *natsPublisher) publish(records []streamRecord) (int, error) {
+	n.conn.SetDeadline(time.Now().Add(n.timeout))
+	defer n.conn.SetDeadline(time.Time{})
+
+	rejected := 0
+	w := bufio.NewWriter(n.conn)
+	for _, r := range records {
+		if n.maxPayload > 0 && int64(len(r.value)) > n.maxPayload {
+			rejected++
+			continue
+		}
+		w.WriteString("PUB " + n.subject + " " + strconv.Itoa(len(r.value)) + "\r\n")
+		w.Write(r.value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return rejected, n.awaitPong()
+}
+
+// awaitPong reads until PONG, answering server PINGs on the way
+func (n *natsPublisher) awaitPong() error {
+	for {
+		line, err := n.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// +OK and INFO updates need no reply
+	}
+}
+
+// readLine reads one protocol line without its CRLF
+func (n *natsPublisher) readLine() (string, error) {
+	line, err := n.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Close closes the connection
+func (n *natsPublisher) Close() error {
+	return n.conn.Close()
+}
+
+// redactURL removes credentials from a broker URL so it can be logged
+func redactURL(broker string) string {
+	u, err := url.Parse(broker)
+	if err != nil || u.User == nil {
+		return broker
+	}
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,249 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdEnterpriseID is the private enterprise number in structured-data IDs.
+// 32473 is reserved for documentation and examples (RFC 5612).
+const sdEnterpriseID = "32473"
+
+// syslogWriteTimeout bounds a write to a TCP syslog server, so a stalled
+// server triggers a reconnect instead of blocking logging
+const syslogWriteTimeout = 5 * time.Second
+
+// rfc5424Header holds the parts of the RFC 5424 header that do not change
+type rfc5424Header struct {
+	hostname string
+	appName  string
+	procID   string
+}
+
+// newRFC5424Header creates the header for messages tagged with tag
+func newRFC5424Header(tag string) *rfc5424Header {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	if tag == "" {
+		tag = "packetpony"
+	}
+	return &rfc5424Header{
+		hostname: hostname,
+		appName:  tag,
+		procID:   strconv.Itoa(os.Getpid()),
+	}
+}
+
+// format builds a message without the PRI part, which the sender adds
+func (h *rfc5424Header) format(msgID, data, msg string) string {
+	return fmt.Sprintf("1 %s %s %s %s %s %s %s",
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		h.hostname, h.appName, h.procID, msgID, data, msg)
+}
+
+// connection formats a connection event with its fields in a "conn"
+// structured-data element and its flow tags in a "tags" element
+func (h *rfc5424Header) connection(event ConnectionEvent) string {
+	conn := newSDElement("conn")
+	conn.add("listener", event.ListenerName)
+	conn.add("proto", event.Protocol)
+	conn.add("event", event.EventType)
+	conn.add("src_ip", event.SourceIP)
+	conn.add("src_port", strconv.Itoa(event.SourcePort))
+	conn.add("dst_ip", event.TargetIP)
+	conn.add("dst_port", strconv.Itoa(event.TargetPort))
+	conn.addIf("flow_id", event.FlowID)
+	conn.addIf("http_method", event.HTTPMethod)
+	conn.addIf("http_host", event.HTTPHost)
+	conn.addIf("http_path", event.HTTPPath)
+	conn.addIf("connection_id", event.ConnectionID)
+	if event.Rebinds > 0 {
+		conn.add("rebinds", strconv.FormatInt(event.Rebinds, 10))
+	}
+	if event.EventType == "dns" {
+		conn.add("dns_qname", event.DNSQName)
+		conn.add("dns_qtype", event.DNSQType)
+		conn.add("dns_rcode", event.DNSRCode)
+		conn.add("duration_ms", strconv.FormatInt(event.Duration, 10))
+	}
+
+	if event.EventType == "close" {
+		conn.add("duration_ms", strconv.FormatInt(event.Duration, 10))
+		conn.add("bytes_sent", strconv.FormatInt(event.BytesSent, 10))
+		conn.add("bytes_recv", strconv.FormatInt(event.BytesReceived, 10))
+		if event.Protocol == "udp" {
+			conn.add("pkts_sent", strconv.FormatInt(event.PacketsSent, 10))
+			conn.add("pkts_recv", strconv.FormatInt(event.PacketsReceived, 10))
+		}
+		conn.addIf("error", event.Error)
+		conn.addIf("close_reason", event.CloseReason)
+		conn.addIf("app_protocol", event.AppProtocol)
+		conn.addIf("ja3", event.JA3)
+		conn.addIf("ssh_client", event.SSHClient)
+	}
+	if event.SampleRate > 0 {
+		conn.add("sample_rate", strconv.Itoa(event.SampleRate))
+	}
+
+	data := conn.String()
+	if len(event.Tags) > 0 {
+		tags := newSDElement("tags")
+		for _, key := range sortedKeys(event.Tags) {
+			tags.add(key, event.Tags[key])
+		}
+		data += tags.String()
+	}
+
+	return h.format("connection", data, "connection "+event.EventType)
+}
+
+// message formats a daemon message. The event code is the MSGID and the
+// fields go in a "fields" structured-data element.
+func (h *rfc5424Header) message(ev Event, fields map[string]interface{}) string {
+	data := "-"
+	if len(fields) > 0 {
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		elem := newSDElement("fields")
+		for _, key := range keys {
+			elem.add(key, fmt.Sprint(fields[key]))
+		}
+		data = elem.String()
+	}
+	return h.format(ev.Code, data, ev.Text)
+}
+
+// sdElement builds one structured-data element
+type sdElement struct {
+	b strings.Builder
+}
+
+// newSDElement starts an element named name@sdEnterpriseID
+func newSDElement(name string) *sdElement {
+	e := &sdElement{}
+	e.b.WriteString("[" + name + "@" + sdEnterpriseID)
+	return e
+}
+
+// add appends a parameter, replacing characters not allowed in names and
+// escaping the value
+func (e *sdElement) add(name, value string) {
+	e.b.WriteString(" " + sdParamName(name) + `="`)
+	for _, r := range value {
+		if r == '"' || r == '\\' || r == ']' {
+			e.b.WriteByte('\\')
+		}
+		e.b.WriteRune(r)
+	}
+	e.b.WriteByte('"')
+}
+
+// addIf appends a parameter unless value is empty
+func (e *sdElement) addIf(name, value string) {
+	if value != "" {
+		e.add(name, value)
+	}
+}
+
+// String closes the element
+func (e *sdElement) String() string {
+	return e.b.String() + "]"
+}
+
+// sdParamName makes name a valid SD-NAME: printable ASCII other than
+// '=', ' ', ']' and '"', at most 32 characters
+func sdParamName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if c <= ' ' || c > '~' || c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 32 {
+		b = b[:32]
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rfc5424Sender sends RFC 5424 messages over a raw connection. TCP uses
+// octet-counting framing (RFC 6587); datagrams carry one message each.
+type rfc5424Sender struct {
+	conn     net.Conn
+	facility syslog.Priority
+	framed   bool // TCP: prefix each message with its length
+	newline  bool // Unix stream socket: terminate each message with a newline
+}
+
+// dialRFC5424 connects to a syslog destination. An empty network or
+// "unix" uses the local syslog socket.
+func dialRFC5424(network, address string, facility syslog.Priority) (*rfc5424Sender, error) {
+	switch network {
+	case "", "unix":
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			if conn, err := net.Dial("unixgram", path); err == nil {
+				return &rfc5424Sender{conn: conn, facility: facility}, nil
+			}
+			if conn, err := net.Dial("unix", path); err == nil {
+				return &rfc5424Sender{conn: conn, facility: facility, newline: true}, nil
+			}
+		}
+		return nil, errors.New("no local syslog socket found")
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", address, syslogWriteTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return &rfc5424Sender{conn: conn, facility: facility, framed: true}, nil
+	default:
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &rfc5424Sender{conn: conn, facility: facility}, nil
+	}
+}
+
+// send writes one message at the given severity
+func (r *rfc5424Sender) send(severity syslog.Priority, msg string) error {
+	line := fmt.Sprintf("<%d>%s", r.facility|severity, msg)
+	switch {
+	case r.framed:
+		line = strconv.Itoa(len(line)) + " " + line
+		r.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	case r.newline:
+		line += "\n"
+	}
+	_, err := r.conn.Write([]byte(line))
+	return err
+}
+
+// Close closes the connection
+func (r *rfc5424Sender) Close() error {
+	return r.conn.Close()
+}
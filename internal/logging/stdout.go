@@ -33,19 +33,24 @@ func (s *StdoutLogger) LogConnection(event ConnectionEvent) {
 	}
 }
 
+// LogDebug logs a diagnostic message
+func (s *StdoutLogger) LogDebug(ev Event, fields map[string]interface{}) {
+	s.logMessage("DEBUG", ev, fields, os.Stdout)
+}
+
 // LogError logs an error message
-func (s *StdoutLogger) LogError(msg string, fields map[string]interface{}) {
-	s.logMessage("ERROR", msg, fields, os.Stderr)
+func (s *StdoutLogger) LogError(ev Event, fields map[string]interface{}) {
+	s.logMessage("ERROR", ev, fields, os.Stderr)
 }
 
 // LogInfo logs an informational message
-func (s *StdoutLogger) LogInfo(msg string, fields map[string]interface{}) {
-	s.logMessage("INFO", msg, fields, os.Stdout)
+func (s *StdoutLogger) LogInfo(ev Event, fields map[string]interface{}) {
+	s.logMessage("INFO", ev, fields, os.Stdout)
 }
 
 // LogWarning logs a warning message
-func (s *StdoutLogger) LogWarning(msg string, fields map[string]interface{}) {
-	s.logMessage("WARNING", msg, fields, os.Stderr)
+func (s *StdoutLogger) LogWarning(ev Event, fields map[string]interface{}) {
+	s.logMessage("WARNING", ev, fields, os.Stderr)
 }
 
 // Close is a no-op for stdout logger
@@ -56,7 +61,15 @@ func (s *StdoutLogger) Close() error {
 // logConnectionText logs a connection event in text format
 func (s *StdoutLogger) logConnectionText(event ConnectionEvent) {
 	var msg string
-	if event.EventType == "open" {
+	if event.EventType == "dns" {
+		msg = fmt.Sprintf("[%s] DNS transaction: listener=%s src=%s:%d dst=%s:%d qname=%q qtype=%s rcode=%s duration=%dms",
+			event.Timestamp.Format("2006-01-02 15:04:05"),
+			event.ListenerName,
+			event.SourceIP, event.SourcePort,
+			event.TargetIP, event.TargetPort,
+			event.DNSQName, event.DNSQType, event.DNSRCode,
+			event.Duration)
+	} else if event.EventType == "open" {
 		msg = fmt.Sprintf("[%s] Connection opened: listener=%s protocol=%s src=%s:%d dst=%s:%d",
 			event.Timestamp.Format("2006-01-02 15:04:05"),
 			event.ListenerName,
@@ -80,27 +93,62 @@ func (s *StdoutLogger) logConnectionText(event ConnectionEvent) {
 		if event.Error != "" {
 			msg += fmt.Sprintf(" error=%q", event.Error)
 		}
+		if event.CloseReason != "" {
+			msg += fmt.Sprintf(" close_reason=%s", event.CloseReason)
+		}
+		if event.AppProtocol != "" {
+			msg += " app_protocol=" + event.AppProtocol
+		}
+		if event.JA3 != "" {
+			msg += " ja3=" + event.JA3
+		}
+		if event.SSHClient != "" {
+			msg += fmt.Sprintf(" ssh_client=%q", event.SSHClient)
+		}
+	}
+
+	if event.HTTPMethod != "" {
+		msg += fmt.Sprintf(" http_method=%s http_host=%q http_path=%q", event.HTTPMethod, event.HTTPHost, event.HTTPPath)
+	}
+
+	if event.ConnectionID != "" {
+		msg += " connection_id=" + event.ConnectionID
+	}
+	if event.Rebinds > 0 {
+		msg += fmt.Sprintf(" rebinds=%d", event.Rebinds)
+	}
+
+	if event.FlowID != "" {
+		msg += " flow_id=" + event.FlowID
+	}
+	if event.SampleRate > 0 {
+		msg += fmt.Sprintf(" sample_rate=%d", event.SampleRate)
+	}
+
+	for _, tag := range formatTags(event.Tags) {
+		msg += " " + tag
 	}
 
 	fmt.Fprintln(os.Stdout, msg)
 }
 
 // logMessage logs a general message
-func (s *StdoutLogger) logMessage(level, msg string, fields map[string]interface{}, output *os.File) {
+func (s *StdoutLogger) logMessage(level string, ev Event, fields map[string]interface{}, output *os.File) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.useJSON {
 		logEntry := map[string]interface{}{
 			"level":   level,
-			"message": msg,
+			"code":    ev.Code,
+			"message": ev.Text,
 		}
 		for key, value := range fields {
 			logEntry[key] = value
 		}
 		json.NewEncoder(output).Encode(logEntry)
 	} else {
-		formatted := fmt.Sprintf("[%s] %s", level, msg)
+		formatted := fmt.Sprintf("[%s] %s", level, ev)
 		if len(fields) > 0 {
 			formatted += " "
 			for key, value := range fields {
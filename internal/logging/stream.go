@@ -0,0 +1,254 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+const (
+	streamInitialBackoff = 1 * time.Second
+	streamMaxBackoff     = 1 * time.Minute
+)
+
+// streamRecord is one encoded connection event
+type streamRecord struct {
+	key   string // Flow ID, used as the Kafka message key
+	value []byte // JSON-encoded ConnectionEvent
+}
+
+// publisher sends batches of records to a broker. publish returns the
+// number of records the broker rejected; an error means the batch may not
+// have been delivered and should be retried.
+type publisher interface {
+	publish(records []streamRecord) (int, error)
+	Close() error
+}
+
+// StreamLogger publishes connection events to NATS, Kafka or a webhook.
+// Events are queued and published in batches by a background goroutine;
+// while the broker is unreachable the queue holds them, and once it is
+// full new events are dropped rather than slowing down forwarding. Daemon
+// messages are not published.
+type StreamLogger struct {
+	kind          string   // nats, kafka or webhook, for messages
+	brokers       []string // Tried in order
+	dial          func(broker string) (publisher, error)
+	batchSize     int
+	flushInterval time.Duration
+	pub           publisher // Owned by the publish goroutine; nil while disconnected
+	broker        int       // Index of the broker to try next
+	queue         chan streamRecord
+	dropped       atomic.Int64
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewStreamLogger connects to the first reachable broker and starts
+// publishing in the background
+func NewStreamLogger(cfg config.StreamConfig) (*StreamLogger, error) {
+	dial := func(broker string) (publisher, error) {
+		if cfg.Type == config.StreamTypeKafka {
+			return dialKafka(broker, cfg.Topic, cfg.GetTimeout())
+		}
+		return dialNATS(broker, cfg.Topic, cfg.GetTimeout())
+	}
+	return newStreamLogger(cfg.Type, cfg.Brokers, cfg.GetBatchSize(), cfg.GetQueueSize(), cfg.GetFlushInterval(), dial)
+}
+
+// newStreamLogger connects through dial to the first reachable broker and
+// starts publishing in the background
+func newStreamLogger(kind string, brokers []string, batchSize, queueSize int, flushInterval time.Duration, dial func(broker string) (publisher, error)) (*StreamLogger, error) {
+	s := &StreamLogger{
+		kind:          kind,
+		brokers:       brokers,
+		dial:          dial,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		queue:         make(chan streamRecord, queueSize),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	pub, err := s.connect()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", kind, err)
+	}
+	s.pub = pub
+
+	go s.run()
+	return s, nil
+}
+
+// connect tries each broker once, starting with the one after the last
+// that failed
+func (s *StreamLogger) connect() (publisher, error) {
+	var lastErr error
+	for range s.brokers {
+		broker := s.brokers[s.broker]
+		pub, err := s.dial(broker)
+		if err == nil {
+			return pub, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", redactURL(broker), err)
+		s.broker = (s.broker + 1) % len(s.brokers)
+	}
+	return nil, lastErr
+}
+
+// LogConnection queues a connection event, dropping it if the queue is full
+func (s *StreamLogger) LogConnection(event ConnectionEvent) {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	select {
+	case s.queue <- streamRecord{key: event.FlowID, value: value}:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// LogDebug does nothing; only connection events are published
+func (s *StreamLogger) LogDebug(ev Event, fields map[string]interface{}) {}
+
+// LogError does nothing; only connection events are published
+func (s *StreamLogger) LogError(ev Event, fields map[string]interface{}) {}
+
+// LogInfo does nothing; only connection events are published
+func (s *StreamLogger) LogInfo(ev Event, fields map[string]interface{}) {}
+
+// LogWarning does nothing; only connection events are published
+func (s *StreamLogger) LogWarning(ev Event, fields map[string]interface{}) {}
+
+// Dropped returns the number of events dropped because the queue was full
+// or the broker rejected them
+func (s *StreamLogger) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close publishes what is queued, giving up after one failed attempt, and
+// disconnects. Later calls do nothing.
+func (s *StreamLogger) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		if s.pub != nil {
+			err = s.pub.Close()
+		}
+	})
+	return err
+}
+
+// run publishes queued events whenever a batch is full or the flush
+// interval passes, and what is left once the logger is closed
+func (s *StreamLogger) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	batchSize := s.batchSize
+	batch := make([]streamRecord, 0, batchSize)
+	flush := func() bool {
+		ok := s.flush(batch)
+		batch = batch[:0]
+		return ok
+	}
+
+	for {
+		select {
+		case r := <-s.queue:
+			batch = append(batch, r)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.stop:
+			// Give up on the rest after a failure so an unreachable
+			// broker does not hold up shutdown
+			for {
+				select {
+				case r := <-s.queue:
+					batch = append(batch, r)
+					if len(batch) >= batchSize && !flush() {
+						s.dropped.Add(int64(len(s.queue)))
+						return
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush publishes a batch, reconnecting with backoff until it is delivered
+// or the logger is closed. Once closed, a batch gets a single attempt.
+// Reports whether the batch was delivered.
+func (s *StreamLogger) flush(batch []streamRecord) bool {
+	if len(batch) == 0 {
+		return true
+	}
+
+	backoff := streamInitialBackoff
+	reconnected := false
+	for {
+		err := s.attempt(batch)
+		if err == nil {
+			if reconnected {
+				fmt.Fprintf(os.Stderr, "Stream connection to %s restored (%d events dropped so far)\n",
+					s.kind, s.dropped.Load())
+			}
+			return true
+		}
+
+		if !reconnected {
+			fmt.Fprintf(os.Stderr, "Stream publish to %s failed, reconnecting: %v\n", s.kind, err)
+		}
+		reconnected = true
+
+		select {
+		case <-s.stop:
+			s.dropped.Add(int64(len(batch)))
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+// attempt publishes a batch once, connecting first if needed. A failed
+// connection is closed so the next attempt reconnects.
+func (s *StreamLogger) attempt(batch []streamRecord) error {
+	if s.pub == nil {
+		pub, err := s.connect()
+		if err != nil {
+			return err
+		}
+		s.pub = pub
+	}
+
+	rejected, err := s.pub.publish(batch)
+	if err != nil {
+		s.pub.Close()
+		s.pub = nil
+		s.broker = (s.broker + 1) % len(s.brokers)
+		return err
+	}
+	s.dropped.Add(int64(rejected))
+	return nil
+}
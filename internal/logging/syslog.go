@@ -3,43 +3,123 @@ package logging
 import (
 	"fmt"
 	"log/syslog"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/espegro/packetpony/internal/config"
 )
 
-// SyslogLogger implements logging to syslog
+const (
+	syslogInitialBackoff = 1 * time.Second
+	syslogMaxBackoff     = 1 * time.Minute
+)
+
+// SyslogLogger implements logging to syslog.
+// When a write fails, the writer is dropped and a background goroutine
+// reconnects with exponential backoff. Messages written while disconnected
+// are buffered (bounded) or dropped, depending on configuration.
 type SyslogLogger struct {
-	writer   *syslog.Writer
-	tag      string
-	priority syslog.Priority
+	cfg        config.SyslogConfig
+	tag        string
+	priority   syslog.Priority
+	rfc5424    *rfc5424Header // nil for RFC 3164 messages
+	mu         sync.Mutex
+	writer     syslogSender // nil while disconnected
+	buffer     []syslogMessage
+	bufferSize int
+	dropOnly   bool
+	closed     bool
+	stop       chan struct{}
+	dropped    atomic.Int64
+	reconnects atomic.Int64
+}
+
+// syslogSender delivers formatted messages to a syslog destination
+type syslogSender interface {
+	send(severity syslog.Priority, msg string) error
+	Close() error
+}
+
+// stdSyslog sends RFC 3164 messages through log/syslog
+type stdSyslog struct {
+	w *syslog.Writer
+}
+
+// send writes a message at the given severity
+func (s stdSyslog) send(severity syslog.Priority, msg string) error {
+	switch severity {
+	case syslog.LOG_ERR:
+		return s.w.Err(msg)
+	case syslog.LOG_WARNING:
+		return s.w.Warning(msg)
+	case syslog.LOG_DEBUG:
+		return s.w.Debug(msg)
+	default:
+		return s.w.Info(msg)
+	}
+}
+
+// Close closes the connection
+func (s stdSyslog) Close() error {
+	return s.w.Close()
+}
+
+// syslogMessage is a message held while the syslog connection is down
+type syslogMessage struct {
+	severity syslog.Priority
+	msg      string
 }
 
 // NewSyslogLogger creates a new syslog logger
 func NewSyslogLogger(cfg config.SyslogConfig) (*SyslogLogger, error) {
 	priority := parseSyslogPriority(cfg.Priority)
 
-	var writer *syslog.Writer
-	var err error
+	s := &SyslogLogger{
+		cfg:        cfg,
+		tag:        cfg.Tag,
+		priority:   priority,
+		bufferSize: cfg.BufferSize,
+		dropOnly:   strings.ToLower(cfg.OnDisconnect) == "drop",
+		stop:       make(chan struct{}),
+	}
+	if s.bufferSize <= 0 {
+		s.bufferSize = config.DefaultSyslogBufferSize
+	}
+	if cfg.GetFormat() == config.SyslogFormatRFC5424 {
+		s.rfc5424 = newRFC5424Header(cfg.Tag)
+	}
+
+	writer, err := s.dial()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	s.writer = writer
+
+	return s, nil
+}
 
-	// Connect to syslog
-	if cfg.Network == "" || cfg.Network == "unix" {
+// dial connects to the configured syslog destination
+func (s *SyslogLogger) dial() (syslogSender, error) {
+	if s.rfc5424 != nil {
+		return dialRFC5424(s.cfg.Network, s.cfg.Address, syslog.LOG_DAEMON)
+	}
+
+	var w *syslog.Writer
+	var err error
+	if s.cfg.Network == "" || s.cfg.Network == "unix" {
 		// Local syslog
-		writer, err = syslog.New(priority|syslog.LOG_DAEMON, cfg.Tag)
+		w, err = syslog.New(s.priority|syslog.LOG_DAEMON, s.cfg.Tag)
 	} else {
 		// Remote syslog
-		writer, err = syslog.Dial(cfg.Network, cfg.Address, priority|syslog.LOG_DAEMON, cfg.Tag)
+		w, err = syslog.Dial(s.cfg.Network, s.cfg.Address, s.priority|syslog.LOG_DAEMON, s.cfg.Tag)
 	}
-
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		return nil, err
 	}
-
-	return &SyslogLogger{
-		writer:   writer,
-		tag:      cfg.Tag,
-		priority: priority,
-	}, nil
+	return stdSyslog{w: w}, nil
 }
 
 // LogConnection logs a connection event
@@ -48,43 +128,167 @@ func (s *SyslogLogger) LogConnection(event ConnectionEvent) {
 
 	switch event.EventType {
 	case "open":
-		s.writer.Info(msg)
+		s.write(syslog.LOG_INFO, msg)
 	case "close":
 		if event.Error != "" {
-			s.writer.Warning(msg)
+			s.write(syslog.LOG_WARNING, msg)
 		} else {
-			s.writer.Info(msg)
+			s.write(syslog.LOG_INFO, msg)
 		}
 	default:
-		s.writer.Info(msg)
+		s.write(syslog.LOG_INFO, msg)
 	}
 }
 
+// LogDebug logs a diagnostic message
+func (s *SyslogLogger) LogDebug(ev Event, fields map[string]interface{}) {
+	formatted := s.formatMessage(ev, fields)
+	s.write(syslog.LOG_DEBUG, formatted)
+}
+
 // LogError logs an error message
-func (s *SyslogLogger) LogError(msg string, fields map[string]interface{}) {
-	formatted := s.formatMessage(msg, fields)
-	s.writer.Err(formatted)
+func (s *SyslogLogger) LogError(ev Event, fields map[string]interface{}) {
+	formatted := s.formatMessage(ev, fields)
+	s.write(syslog.LOG_ERR, formatted)
 }
 
 // LogInfo logs an informational message
-func (s *SyslogLogger) LogInfo(msg string, fields map[string]interface{}) {
-	formatted := s.formatMessage(msg, fields)
-	s.writer.Info(formatted)
+func (s *SyslogLogger) LogInfo(ev Event, fields map[string]interface{}) {
+	formatted := s.formatMessage(ev, fields)
+	s.write(syslog.LOG_INFO, formatted)
 }
 
 // LogWarning logs a warning message
-func (s *SyslogLogger) LogWarning(msg string, fields map[string]interface{}) {
-	formatted := s.formatMessage(msg, fields)
-	s.writer.Warning(formatted)
+func (s *SyslogLogger) LogWarning(ev Event, fields map[string]interface{}) {
+	formatted := s.formatMessage(ev, fields)
+	s.write(syslog.LOG_WARNING, formatted)
 }
 
-// Close closes the syslog connection
+// Close closes the syslog connection and stops any reconnect attempts
 func (s *SyslogLogger) Close() error {
-	return s.writer.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+
+	if s.writer != nil {
+		return s.writer.Close()
+	}
+	return nil
+}
+
+// Stats returns the number of messages dropped while disconnected and the
+// number of successful reconnects
+func (s *SyslogLogger) Stats() (dropped, reconnects int64) {
+	return s.dropped.Load(), s.reconnects.Load()
+}
+
+// write sends a message, falling back to the buffer when disconnected
+func (s *SyslogLogger) write(severity syslog.Priority, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if s.writer != nil {
+		err := s.writer.send(severity, msg)
+		if err == nil {
+			return
+		}
+
+		// Connection is broken: drop the writer and reconnect in the background
+		s.writer.Close()
+		s.writer = nil
+		fmt.Fprintf(os.Stderr, "Syslog connection lost, reconnecting: %v\n", err)
+		go s.reconnectLoop()
+	}
+
+	s.hold(syslogMessage{severity: severity, msg: msg})
+}
+
+// hold buffers a message while disconnected, dropping the oldest when full.
+// Must be called with s.mu held.
+func (s *SyslogLogger) hold(m syslogMessage) {
+	if s.dropOnly {
+		s.dropped.Add(1)
+		return
+	}
+
+	if len(s.buffer) >= s.bufferSize {
+		s.buffer = s.buffer[1:]
+		s.dropped.Add(1)
+	}
+	s.buffer = append(s.buffer, m)
+}
+
+// reconnectLoop reconnects to syslog with exponential backoff and flushes buffered messages
+func (s *SyslogLogger) reconnectLoop() {
+	backoff := syslogInitialBackoff
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+
+		writer, err := s.dial()
+		if err == nil {
+			if s.restore(writer) {
+				return
+			}
+		}
+
+		backoff *= 2
+		if backoff > syslogMaxBackoff {
+			backoff = syslogMaxBackoff
+		}
+	}
+}
+
+// restore flushes buffered messages to a fresh writer and installs it.
+// Returns false if the flush failed and the connection must be retried.
+func (s *SyslogLogger) restore(writer syslogSender) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		writer.Close()
+		return true
+	}
+
+	for len(s.buffer) > 0 {
+		m := s.buffer[0]
+		if err := writer.send(m.severity, m.msg); err != nil {
+			writer.Close()
+			return false
+		}
+		s.buffer = s.buffer[1:]
+	}
+	s.buffer = nil
+	s.writer = writer
+	s.reconnects.Add(1)
+
+	dropped := s.dropped.Load()
+	fmt.Fprintf(os.Stderr, "Syslog connection restored (%d messages dropped so far)\n", dropped)
+	writer.send(syslog.LOG_WARNING, s.formatMessage(EventSyslogRestored, map[string]interface{}{
+		"dropped_total": dropped,
+	}))
+
+	return true
 }
 
 // formatConnectionEvent formats a connection event for syslog
 func (s *SyslogLogger) formatConnectionEvent(event ConnectionEvent) string {
+	if s.rfc5424 != nil {
+		return s.rfc5424.connection(event)
+	}
+
 	var parts []string
 
 	parts = append(parts, fmt.Sprintf("listener=%s", event.ListenerName))
@@ -92,6 +296,26 @@ func (s *SyslogLogger) formatConnectionEvent(event ConnectionEvent) string {
 	parts = append(parts, fmt.Sprintf("event=%s", event.EventType))
 	parts = append(parts, fmt.Sprintf("src=%s:%d", event.SourceIP, event.SourcePort))
 	parts = append(parts, fmt.Sprintf("dst=%s:%d", event.TargetIP, event.TargetPort))
+	if event.FlowID != "" {
+		parts = append(parts, fmt.Sprintf("flow_id=%s", event.FlowID))
+	}
+	if event.HTTPMethod != "" {
+		parts = append(parts, fmt.Sprintf("http_method=%s", event.HTTPMethod))
+		parts = append(parts, fmt.Sprintf("http_host=%q", event.HTTPHost))
+		parts = append(parts, fmt.Sprintf("http_path=%q", event.HTTPPath))
+	}
+	if event.ConnectionID != "" {
+		parts = append(parts, fmt.Sprintf("connection_id=%s", event.ConnectionID))
+	}
+	if event.Rebinds > 0 {
+		parts = append(parts, fmt.Sprintf("rebinds=%d", event.Rebinds))
+	}
+	if event.EventType == "dns" {
+		parts = append(parts, fmt.Sprintf("dns_qname=%q", event.DNSQName))
+		parts = append(parts, fmt.Sprintf("dns_qtype=%s", event.DNSQType))
+		parts = append(parts, fmt.Sprintf("dns_rcode=%s", event.DNSRCode))
+		parts = append(parts, fmt.Sprintf("duration=%dms", event.Duration))
+	}
 
 	if event.EventType == "close" {
 		parts = append(parts, fmt.Sprintf("duration=%dms", event.Duration))
@@ -106,19 +330,39 @@ func (s *SyslogLogger) formatConnectionEvent(event ConnectionEvent) string {
 		if event.Error != "" {
 			parts = append(parts, fmt.Sprintf("error=%q", event.Error))
 		}
+		if event.CloseReason != "" {
+			parts = append(parts, fmt.Sprintf("close_reason=%s", event.CloseReason))
+		}
+		if event.AppProtocol != "" {
+			parts = append(parts, fmt.Sprintf("app_protocol=%s", event.AppProtocol))
+		}
+		if event.JA3 != "" {
+			parts = append(parts, fmt.Sprintf("ja3=%s", event.JA3))
+		}
+		if event.SSHClient != "" {
+			parts = append(parts, fmt.Sprintf("ssh_client=%q", event.SSHClient))
+		}
 	}
 
+	if event.SampleRate > 0 {
+		parts = append(parts, fmt.Sprintf("sample_rate=%d", event.SampleRate))
+	}
+	parts = append(parts, formatTags(event.Tags)...)
+
 	return strings.Join(parts, " ")
 }
 
 // formatMessage formats a general log message
-func (s *SyslogLogger) formatMessage(msg string, fields map[string]interface{}) string {
+func (s *SyslogLogger) formatMessage(ev Event, fields map[string]interface{}) string {
+	if s.rfc5424 != nil {
+		return s.rfc5424.message(ev, fields)
+	}
 	if len(fields) == 0 {
-		return msg
+		return ev.String()
 	}
 
 	var parts []string
-	parts = append(parts, msg)
+	parts = append(parts, ev.String())
 
 	for key, value := range fields {
 		parts = append(parts, fmt.Sprintf("%s=%v", key, value))
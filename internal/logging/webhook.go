@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// Headers of webhook requests
+const (
+	webhookTimestampHeader = "X-PacketPony-Timestamp"
+	webhookSignatureHeader = "X-PacketPony-Signature"
+	webhookDeliveryHeader  = "X-PacketPony-Delivery"
+)
+
+// webhookPublisher POSTs batches of records to an HTTP endpoint as a JSON
+// array of connection events
+type webhookPublisher struct {
+	client *http.Client
+	url    string
+	secret []byte // nil = requests are not signed
+}
+
+// NewWebhookLogger starts posting connection events to the webhook URL in
+// the background. Batching, queueing and retries work as for the stream.
+func NewWebhookLogger(cfg config.WebhookConfig) (*StreamLogger, error) {
+	w := &webhookPublisher{
+		client: &http.Client{Timeout: cfg.GetTimeout()},
+		url:    cfg.URL,
+	}
+	if cfg.Secret != "" {
+		w.secret = []byte(cfg.Secret)
+	}
+	// The endpoint is only contacted with events; there is no connection
+	// to check up front
+	dial := func(string) (publisher, error) {
+		return w, nil
+	}
+	return newStreamLogger("webhook", []string{cfg.URL}, cfg.GetBatchSize(), cfg.GetQueueSize(), cfg.GetFlushInterval(), dial)
+}
+
+// publish posts a batch in one request. The delivery ID is derived from
+// the body, so a batch retried after a lost response carries the same one
+// and the receiver can discard the duplicate.
+func (w *webhookPublisher) publish(records []streamRecord) (int, error) {
+	events := make([]json.RawMessage, len(records))
+	for i, r := range records {
+		events[i] = r.value
+	}
+	body, err := json.Marshal(events)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(body)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookDeliveryHeader, hex.EncodeToString(sum[:16]))
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	if w.secret != nil {
+		req.Header.Set(webhookSignatureHeader, "sha256="+w.sign(timestamp, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout:
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		// The endpoint refused the batch itself; sending it again would
+		// only be refused again
+		fmt.Fprintf(os.Stderr, "Webhook refused %d events: %s\n", len(records), resp.Status)
+		return len(records), nil
+	}
+}
+
+// sign returns the hex HMAC-SHA256 of the timestamp and body, joined by a
+// dot. Signing the timestamp lets the receiver reject replayed requests.
+func (w *webhookPublisher) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close releases idle connections
+func (w *webhookPublisher) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"container/list"
+	"net"
+	"sync"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clientMetrics exports counters labeled with the client IP for a bounded
+// set of clients. Once max_clients addresses have series, the series of
+// the least recently active client are deleted to make room for a new one.
+type clientMetrics struct {
+	cfg        config.ClientMetricsConfig
+	maxClients int
+
+	// mu guards the LRU and is held while series are updated, so an
+	// evicted client's series cannot be recreated behind its back
+	mu      sync.Mutex
+	lru     *list.List               // client IPs, most recently active first
+	entries map[string]*list.Element // client IP -> its LRU element
+
+	bytes       *prometheus.CounterVec
+	connections *prometheus.CounterVec
+	drops       *prometheus.CounterVec
+	evictions   prometheus.Counter
+}
+
+// newClientMetrics creates and registers the per-client counters
+func newClientMetrics(cfg config.ClientMetricsConfig) *clientMetrics {
+	c := &clientMetrics{
+		cfg:        cfg,
+		maxClients: cfg.GetMaxClients(),
+		lru:        list.New(),
+		entries:    make(map[string]*list.Element),
+		bytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_client_bytes_transferred_total",
+				Help: "Bytes transferred per client IP (client_metrics)",
+			},
+			[]string{"listener", "client", "direction"},
+		),
+		connections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_client_connections_total",
+				Help: "Accepted connections and UDP sessions per client IP (client_metrics)",
+			},
+			[]string{"listener", "client"},
+		),
+		drops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_client_drops_total",
+				Help: "Connections, sessions and packets dropped per client IP (client_metrics)",
+			},
+			[]string{"listener", "client", "reason"},
+		),
+		evictions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "packetpony_client_metrics_evictions_total",
+				Help: "Client IPs whose series were deleted to stay within client_metrics max_clients",
+			},
+		),
+	}
+
+	prometheus.MustRegister(c.bytes)
+	prometheus.MustRegister(c.connections)
+	prometheus.MustRegister(c.drops)
+	prometheus.MustRegister(c.evictions)
+
+	return c
+}
+
+// update runs fn with the normalized address of a client that gets series,
+// marking it most recently active and evicting the least recently active
+// client when over the cap
+func (c *clientMetrics) update(clientIP string, fn func(client string)) {
+	ip := net.ParseIP(clientIP)
+	if ip == nil || !c.cfg.Matches(ip) {
+		return
+	}
+	key := ip.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.lru.PushFront(key)
+		if c.lru.Len() > c.maxClients {
+			c.evict(c.lru.Back())
+		}
+	}
+	fn(key)
+}
+
+// evict deletes every series of the client at elem. Must be called with
+// c.mu held.
+func (c *clientMetrics) evict(elem *list.Element) {
+	key := c.lru.Remove(elem).(string)
+	delete(c.entries, key)
+
+	labels := prometheus.Labels{"client": key}
+	c.bytes.DeletePartialMatch(labels)
+	c.connections.DeletePartialMatch(labels)
+	c.drops.DeletePartialMatch(labels)
+	c.evictions.Inc()
+}
+
+// AddClientBytes counts bytes transferred by a client. No-op unless
+// client_metrics is enabled and the client matches.
+func (m *ProxyMetrics) AddClientBytes(listener, clientIP, direction string, bytes int64) {
+	if m.clients == nil || bytes <= 0 {
+		return
+	}
+	m.clients.update(clientIP, func(client string) {
+		m.clients.bytes.WithLabelValues(listener, client, direction).Add(float64(bytes))
+	})
+}
+
+// IncClientConnections counts an accepted connection or UDP session of a client
+func (m *ProxyMetrics) IncClientConnections(listener, clientIP string) {
+	if m.clients == nil {
+		return
+	}
+	m.clients.update(clientIP, func(client string) {
+		m.clients.connections.WithLabelValues(listener, client).Inc()
+	})
+}
+
+// IncClientDrops counts a connection, session or packet of a client
+// dropped for reason
+func (m *ProxyMetrics) IncClientDrops(listener, clientIP, reason string) {
+	if m.clients == nil {
+		return
+	}
+	m.clients.update(clientIP, func(client string) {
+		m.clients.drops.WithLabelValues(listener, client, reason).Inc()
+	})
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Overall health statuses reported by /health
+const (
+	HealthHealthy   = "healthy"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+)
+
+// ListenerHealth describes the state of a single listener
+type ListenerHealth struct {
+	Name     string    `json:"name"`
+	Protocol string    `json:"protocol"`
+	Address  string    `json:"address"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Since    time.Time `json:"since"`
+	Restarts int       `json:"restarts,omitempty"`
+}
+
+// HealthReport is the body returned by the health endpoints
+type HealthReport struct {
+	Status    string           `json:"status"`
+	Service   string           `json:"service"`
+	Listeners []ListenerHealth `json:"listeners,omitempty"`
+}
+
+// HealthSource produces the current health report
+type HealthSource func() HealthReport
+
+// healthHandler serves liveness checks with listener detail.
+// The process is alive as long as it can answer, so this always returns 200.
+func healthHandler(source HealthSource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, report(source))
+	}
+}
+
+// readyHandler serves readiness checks. It fails when no listener is
+// serving traffic, or when any listener is not listening and strict is set.
+func readyHandler(source HealthSource, strict bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep := report(source)
+
+		code := http.StatusOK
+		if rep.Status == HealthUnhealthy || (strict && rep.Status != HealthHealthy) {
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, rep)
+	}
+}
+
+// report calls the health source, falling back to a static healthy report
+func report(source HealthSource) HealthReport {
+	if source == nil {
+		return HealthReport{Status: HealthHealthy, Service: "packetpony"}
+	}
+	rep := source()
+	rep.Service = "packetpony"
+	return rep
+}
+
+// writeHealth writes a health report as JSON
+func writeHealth(w http.ResponseWriter, code int, rep HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(rep)
+}
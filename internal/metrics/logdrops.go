@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LogDropsFunc returns the number of messages each logging backend has
+// dropped, keyed by backend name
+type LogDropsFunc func() map[string]int64
+
+// logDropsCollector exports logging counters read at scrape time, such as
+// the drops of each backend
+type logDropsCollector struct {
+	source LogDropsFunc
+	desc   *prometheus.Desc
+}
+
+// RegisterLogDrops registers a collector exporting messages dropped by
+// logging backends that could not keep up
+func RegisterLogDrops(source LogDropsFunc) {
+	prometheus.MustRegister(&logDropsCollector{
+		source: source,
+		desc: prometheus.NewDesc(
+			"packetpony_log_dropped_total",
+			"Log messages and connection events dropped because a logging backend's queue was full",
+			[]string{"backend"}, nil,
+		),
+	})
+}
+
+// RegisterDenialsAggregated registers a collector exporting the denials
+// counted into summaries instead of logged, by event code
+func RegisterDenialsAggregated(source func() map[string]int64) {
+	prometheus.MustRegister(&logDropsCollector{
+		source: source,
+		desc: prometheus.NewDesc(
+			"packetpony_log_denials_aggregated_total",
+			"Denials counted into a summary instead of logged one by one (logging.deny_aggregation)",
+			[]string{"event"}, nil,
+		),
+	})
+}
+
+// Describe implements prometheus.Collector
+func (c *logDropsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c *logDropsCollector) Collect(ch chan<- prometheus.Metric) {
+	for backend, dropped := range c.source() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(dropped), backend)
+	}
+}
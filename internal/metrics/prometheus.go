@@ -4,29 +4,91 @@
 package metrics
 
 import (
-	"fmt"
-	"net/http"
+	"time"
 
 	"github.com/espegro/packetpony/internal/config"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // ProxyMetrics holds all Prometheus metrics for the proxy
 type ProxyMetrics struct {
 	ConnectionsTotal   *prometheus.CounterVec
 	ConnectionsActive  *prometheus.GaugeVec
+	PendingAccepts     *prometheus.GaugeVec
+	AcceptPaused       *prometheus.GaugeVec
+	HandlerGoroutines  *prometheus.GaugeVec
+	BufferBytes        *prometheus.GaugeVec
+	SessionMapEntries  *prometheus.GaugeVec
+	BackendConnections *prometheus.GaugeVec
+	BackendFailures    *prometheus.CounterVec
+	CircuitState       *prometheus.GaugeVec
+	BackendFailovers   *prometheus.CounterVec
 	BytesTransferred   *prometheus.CounterVec
 	PacketsTransferred *prometheus.CounterVec
 	ConnectionDuration *prometheus.HistogramVec
+	PhaseDuration      *prometheus.HistogramVec
+	FlowBytes          *prometheus.HistogramVec
+	SessionPackets     *prometheus.HistogramVec
+	ClientThroughput   *prometheus.HistogramVec
+	SampleRate         *prometheus.GaugeVec
 	RateLimitDrops     *prometheus.CounterVec
 	ACLDrops           *prometheus.CounterVec
+	AuditDenials       *prometheus.CounterVec
 	Errors             *prometheus.CounterVec
+	BansTotal          *prometheus.CounterVec
+	BansActive         *prometheus.GaugeVec
+	BanDrops           *prometheus.CounterVec
+	XDPDrops           *prometheus.CounterVec
+	AFXDPPackets       *prometheus.CounterVec
+	SendBatchSize      *prometheus.HistogramVec
+	ReceiveBatchSize   *prometheus.HistogramVec
+	GROSegments        *prometheus.HistogramVec
+	GSOSegments        *prometheus.HistogramVec
+	ExemptFlows        *prometheus.CounterVec
+	QuotaExhausted     *prometheus.GaugeVec
+	QuotaDrops         *prometheus.CounterVec
+	Greylist           *prometheus.CounterVec
+	EmergencyActive    prometheus.Gauge
+	HookDecisions      *prometheus.CounterVec
+	ScriptCalls        *prometheus.CounterVec
+	SessionsRejected   *prometheus.CounterVec
+	RepliesInvalid     *prometheus.CounterVec
+	DNSQueries         *prometheus.CounterVec
+	DNSResponses       *prometheus.CounterVec
+	DNSResponseTime    *prometheus.HistogramVec
+	SIPCallsActive     *prometheus.GaugeVec
+	SIPCalls           *prometheus.CounterVec
+	SIPMediaPackets    *prometheus.CounterVec
+	SIPMediaDropped    *prometheus.CounterVec
+	UDPOversize        *prometheus.CounterVec
+	UDPSessionRebinds  *prometheus.CounterVec
+	SessionsPersisted  *prometheus.CounterVec
+	PacketRuleMatches  *prometheus.CounterVec
+	SignatureMatches   *prometheus.CounterVec
+	Terminated         *prometheus.CounterVec
+	ClassifiedFlows    *prometheus.CounterVec
+	ClassifiedBytes    *prometheus.CounterVec
+	MirrorBytes        *prometheus.CounterVec
+	ChaosActive        *prometheus.GaugeVec
+	ChaosDrops         *prometheus.CounterVec
+	ConcurrencyQueued  *prometheus.GaugeVec
+	ConcurrencyDenied  *prometheus.CounterVec
+	DenyResponses      *prometheus.CounterVec
+	Tarpitted          *prometheus.GaugeVec
+	UDPDenyResponses   *prometheus.CounterVec
+	TaggedConnections  *prometheus.CounterVec // nil unless tag labels are configured
+	TaggedBytes        *prometheus.CounterVec // nil unless tag labels are configured
+	tagLabels          []string
+	clients            *clientMetrics // nil unless client_metrics is enabled
 }
 
-// NewProxyMetrics creates and registers Prometheus metrics
-func NewProxyMetrics() *ProxyMetrics {
+// NewProxyMetrics creates and registers Prometheus metrics.
+// tagLabels lists the flow tag keys exported as labels on the tagged metrics;
+// values are taken from configuration, which keeps cardinality bounded.
+// clients configures the optional per-client-IP counters.
+func NewProxyMetrics(tagLabels []string, clients config.ClientMetricsConfig) *ProxyMetrics {
 	metrics := &ProxyMetrics{
+		tagLabels: tagLabels,
 		ConnectionsTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "packetpony_connections_total",
@@ -41,6 +103,69 @@ func NewProxyMetrics() *ProxyMetrics {
 			},
 			[]string{"listener", "protocol"},
 		),
+		PendingAccepts: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_pending_accepts",
+				Help: "TCP connections accepted and still being admitted, not yet forwarding",
+			},
+			[]string{"listener"},
+		),
+		AcceptPaused: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_accept_paused",
+				Help: "1 while a TCP listener stops accepting because accept_pause_threshold connections are active",
+			},
+			[]string{"listener"},
+		),
+		HandlerGoroutines: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_handler_goroutines",
+				Help: "Goroutines serving connections and UDP sessions, including TCP copy goroutines",
+			},
+			[]string{"listener"},
+		),
+		BufferBytes: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_buffer_bytes",
+				Help: "Bytes held in per-flow copy buffers",
+			},
+			[]string{"listener"},
+		),
+		SessionMapEntries: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_session_map_entries",
+				Help: "Entries in a UDP listener's session map, including aliases of migrated sessions",
+			},
+			[]string{"listener"},
+		),
+		BackendConnections: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_backend_connections_active",
+				Help: "Number of active connections and UDP sessions per balanced target",
+			},
+			[]string{"listener", "target"},
+		),
+		BackendFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_backend_failures_total",
+				Help: "Total failed connects per balanced target",
+			},
+			[]string{"listener", "target"},
+		),
+		CircuitState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_circuit_state",
+				Help: "Circuit breaker state per balanced target (0 = closed, 1 = half-open, 2 = open)",
+			},
+			[]string{"listener", "target"},
+		),
+		BackendFailovers: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_backend_failovers_total",
+				Help: "Total connections retried against another target after a failed connect",
+			},
+			[]string{"listener"},
+		),
 		BytesTransferred: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "packetpony_bytes_transferred_total",
@@ -63,6 +188,45 @@ func NewProxyMetrics() *ProxyMetrics {
 			},
 			[]string{"listener", "protocol"},
 		),
+		PhaseDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "packetpony_phase_duration_seconds",
+				Help:    "Duration of connection phases: admission, dial, first_byte and total",
+				Buckets: prometheus.ExponentialBuckets(0.0001, 2, 18), // 100us to ~13s
+			},
+			[]string{"listener", "protocol", "phase"},
+		),
+		FlowBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "packetpony_flow_bytes",
+				Help:    "Bytes transferred per closed connection or UDP session, by direction",
+				Buckets: prometheus.ExponentialBuckets(64, 4, 12), // 64B to ~268MB
+			},
+			[]string{"listener", "protocol", "direction"},
+		),
+		SessionPackets: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "packetpony_session_packets",
+				Help:    "Packets per closed UDP session, by direction",
+				Buckets: prometheus.ExponentialBuckets(1, 4, 10), // 1 to ~262k
+			},
+			[]string{"listener", "direction"},
+		),
+		ClientThroughput: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "packetpony_client_throughput_bytes_per_second",
+				Help:    "Per-client throughput over the bandwidth window, sampled periodically (listeners with a bandwidth limit)",
+				Buckets: prometheus.ExponentialBuckets(1024, 4, 10), // 1KB/s to ~268MB/s
+			},
+			[]string{"listener"},
+		),
+		SampleRate: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_sample_rate",
+				Help: "Flow sample rate N: 1 in N flows is logged and observed in the duration histograms",
+			},
+			[]string{"listener"},
+		),
 		RateLimitDrops: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "packetpony_rate_limit_drops_total",
@@ -77,6 +241,13 @@ func NewProxyMetrics() *ProxyMetrics {
 			},
 			[]string{"listener"},
 		),
+		AuditDenials: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_audit_denials_total",
+				Help: "Total connections and UDP sessions admitted in audit mode that the allowlist or rate limits would have denied",
+			},
+			[]string{"listener", "reason"},
+		),
 		Errors: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "packetpony_errors_total",
@@ -84,44 +255,441 @@ func NewProxyMetrics() *ProxyMetrics {
 			},
 			[]string{"listener", "type"},
 		),
+		BansTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_bans_total",
+				Help: "Total temporary bans issued",
+			},
+			[]string{"listener"},
+		),
+		BansActive: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_bans_active",
+				Help: "Number of currently banned IPs",
+			},
+			[]string{"listener"},
+		),
+		BanDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_ban_drops_total",
+				Help: "Total connections dropped because the source is banned",
+			},
+			[]string{"listener"},
+		),
+		XDPDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_xdp_drops_total",
+				Help: "Total packets dropped in the kernel by the XDP program, by reason (acl_denied or banned)",
+			},
+			[]string{"listener", "reason"},
+		),
+		AFXDPPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_af_xdp_packets_total",
+				Help: "Total frames read from AF_XDP sockets, by receive queue and result (received or malformed)",
+			},
+			[]string{"listener", "queue", "result"},
+		),
+		SendBatchSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "packetpony_udp_send_batch_size",
+				Help:    "Replies sent to clients per batched write",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 11), // 1 to 1024
+			},
+			[]string{"listener"},
+		),
+		ReceiveBatchSize: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "packetpony_udp_receive_batch_size",
+				Help:    "Datagrams read per batched read, from the listener socket or a session's target socket",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 11), // 1 to 1024
+			},
+			[]string{"listener", "socket"},
+		),
+		GROSegments: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "packetpony_udp_gro_segments",
+				Help:    "Datagrams the kernel coalesced into one read, from the listener socket or a session's target socket",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 7), // 1 to 64
+			},
+			[]string{"listener", "socket"},
+		),
+		GSOSegments: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "packetpony_udp_gso_segments",
+				Help:    "Replies the kernel cut out of one segmented write",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 7), // 1 to 64
+			},
+			[]string{"listener"},
+		),
+		ExemptFlows: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_rate_limit_exempt_total",
+				Help: "Total connections and UDP sessions admitted under a rate limit exemption",
+			},
+			[]string{"listener"},
+		),
+		QuotaExhausted: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_quota_exhausted_clients",
+				Help: "Clients seen recently that have exhausted their daily or monthly quota",
+			},
+			[]string{"listener", "period"},
+		),
+		QuotaDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_quota_drops_total",
+				Help: "Total connections refused or cut, and datagrams dropped, because the client's quota is exhausted",
+			},
+			[]string{"listener", "period"},
+		),
+		Greylist: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_greylist_total",
+				Help: "Total flows checked against the greylist, by result: known, passed, delayed or rejected",
+			},
+			[]string{"listener", "result"},
+		),
+		EmergencyActive: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "packetpony_emergency_active",
+				Help: "1 while emergency mode clamps bandwidth limits, 0 otherwise",
+			},
+		),
+		HookDecisions: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_hook_decisions_total",
+				Help: "Total pre-hook authorization decisions",
+			},
+			[]string{"listener", "result"},
+		),
+		ScriptCalls: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_script_calls_total",
+				Help: "Total script hook calls by hook and outcome",
+			},
+			[]string{"listener", "hook", "result"},
+		),
+		ChaosActive: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_chaos_active",
+				Help: "1 while faults are injected into the listener's flows (chaos mode)",
+			},
+			[]string{"listener"},
+		),
+		ChaosDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_chaos_drops_total",
+				Help: "Total datagrams dropped by chaos mode, by reason (loss or bandwidth)",
+			},
+			[]string{"listener", "reason"},
+		),
+		ConcurrencyQueued: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_concurrency_queued",
+				Help: "Connections waiting for a max_concurrent_connections slot",
+			},
+			[]string{"listener"},
+		),
+		ConcurrencyDenied: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_concurrency_denied_total",
+				Help: "Total connections denied by max_concurrent_connections, by reason (full, timeout or closed)",
+			},
+			[]string{"listener", "reason"},
+		),
+		DenyResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_tcp_deny_responses_total",
+				Help: "Total denied TCP connections by the response they got (close, reset, banner or tarpit)",
+			},
+			[]string{"listener", "action"},
+		),
+		Tarpitted: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_tcp_tarpitted",
+				Help: "Denied TCP connections currently held in the tarpit",
+			},
+			[]string{"listener"},
+		),
+		UDPDenyResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_udp_deny_responses_total",
+				Help: "Total answers to denied UDP datagrams, by result (sent, rate_limited or failed)",
+			},
+			[]string{"listener", "result"},
+		),
+		SessionsRejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_udp_sessions_rejected_total",
+				Help: "Total UDP sessions rejected due to session limits",
+			},
+			[]string{"listener", "reason"},
+		),
+		RepliesInvalid: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_udp_replies_invalid_total",
+				Help: "Total UDP replies from targets failing validation, by reason (source, oversize, truncated or unsolicited)",
+			},
+			[]string{"listener", "reason"},
+		),
+		DNSQueries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_dns_queries_total",
+				Help: "Total DNS queries from clients of protocol_hint dns listeners, by query type (other for unnamed types, malformed for non-DNS datagrams)",
+			},
+			[]string{"listener", "qtype"},
+		),
+		DNSResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_dns_responses_total",
+				Help: "Total DNS responses from targets of protocol_hint dns listeners, by response code",
+			},
+			[]string{"listener", "rcode"},
+		),
+		DNSResponseTime: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "packetpony_dns_response_seconds",
+				Help:    "Time from a DNS query to its response on protocol_hint dns listeners",
+				Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16), // 100us to ~3s
+			},
+			[]string{"listener"},
+		),
+		SIPCallsActive: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "packetpony_sip_calls_active",
+				Help: "SIP calls with an open media relay",
+			},
+			[]string{"listener"},
+		),
+		SIPCalls: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_sip_calls_total",
+				Help: "Total SIP calls seen with SDP, by result (relayed, max_calls or no_ports)",
+			},
+			[]string{"listener", "result"},
+		),
+		SIPMediaPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_sip_media_packets_total",
+				Help: "Total RTP and RTCP packets relayed for SIP calls, by direction (sent = client to target)",
+			},
+			[]string{"listener", "direction"},
+		),
+		SIPMediaDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_sip_media_dropped_total",
+				Help: "Total RTP and RTCP packets dropped by SIP media relays, by reason (unknown_source, no_peer or write_error)",
+			},
+			[]string{"listener", "reason"},
+		),
+		UDPOversize: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_udp_oversize_total",
+				Help: "Total UDP datagrams larger than the path MTU toward the target, by outcome: fragmented, dropped or clamped",
+			},
+			[]string{"listener", "action"},
+		),
+		UDPSessionRebinds: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_udp_session_rebinds_total",
+				Help: "Total UDP sessions that moved to a new client source address",
+			},
+			[]string{"listener"},
+		),
+		SessionsPersisted: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_udp_sessions_persisted_total",
+				Help: "Total UDP sessions saved on shutdown and restored on start, by result: saved, save_failed, restored or restore_failed",
+			},
+			[]string{"listener", "result"},
+		),
+		PacketRuleMatches: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_udp_packet_rule_matches_total",
+				Help: "Total UDP datagrams matching each packet rule, by rule index and action",
+			},
+			[]string{"listener", "rule", "action"},
+		),
+		SignatureMatches: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_signature_matches_total",
+				Help: "Total TCP connections and UDP datagrams whose payload matched each signature, by action",
+			},
+			[]string{"listener", "protocol", "signature", "action"},
+		),
+		Terminated: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_connections_terminated_total",
+				Help: "Total connections and UDP sessions forcibly closed by per-connection caps, target changes or target drains",
+			},
+			[]string{"listener", "protocol", "reason"},
+		),
+		ClassifiedFlows: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_classified_flows_total",
+				Help: "Total closed flows by detected application protocol (listeners with classify enabled)",
+			},
+			[]string{"listener", "protocol", "app_protocol"},
+		),
+		ClassifiedBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_classified_bytes_total",
+				Help: "Total bytes of closed flows by detected application protocol (listeners with classify enabled)",
+			},
+			[]string{"listener", "protocol", "app_protocol"},
+		),
+		MirrorBytes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_mirror_bytes_total",
+				Help: "Total client bytes copied to mirror_target, by result (sent or dropped)",
+			},
+			[]string{"listener", "result"},
+		),
 	}
 
 	// Register all metrics
 	prometheus.MustRegister(metrics.ConnectionsTotal)
 	prometheus.MustRegister(metrics.ConnectionsActive)
+	prometheus.MustRegister(metrics.PendingAccepts)
+	prometheus.MustRegister(metrics.AcceptPaused)
+	prometheus.MustRegister(metrics.HandlerGoroutines)
+	prometheus.MustRegister(metrics.BufferBytes)
+	prometheus.MustRegister(metrics.SessionMapEntries)
+	prometheus.MustRegister(metrics.BackendConnections)
+	prometheus.MustRegister(metrics.BackendFailures)
+	prometheus.MustRegister(metrics.CircuitState)
+	prometheus.MustRegister(metrics.BackendFailovers)
 	prometheus.MustRegister(metrics.BytesTransferred)
 	prometheus.MustRegister(metrics.PacketsTransferred)
 	prometheus.MustRegister(metrics.ConnectionDuration)
+	prometheus.MustRegister(metrics.PhaseDuration)
+	prometheus.MustRegister(metrics.FlowBytes)
+	prometheus.MustRegister(metrics.SessionPackets)
+	prometheus.MustRegister(metrics.ClientThroughput)
+	prometheus.MustRegister(metrics.SampleRate)
 	prometheus.MustRegister(metrics.RateLimitDrops)
 	prometheus.MustRegister(metrics.ACLDrops)
+	prometheus.MustRegister(metrics.AuditDenials)
 	prometheus.MustRegister(metrics.Errors)
+	prometheus.MustRegister(metrics.BansTotal)
+	prometheus.MustRegister(metrics.BansActive)
+	prometheus.MustRegister(metrics.BanDrops)
+	prometheus.MustRegister(metrics.XDPDrops)
+	prometheus.MustRegister(metrics.AFXDPPackets)
+	prometheus.MustRegister(metrics.SendBatchSize)
+	prometheus.MustRegister(metrics.ReceiveBatchSize)
+	prometheus.MustRegister(metrics.GROSegments)
+	prometheus.MustRegister(metrics.GSOSegments)
+	prometheus.MustRegister(metrics.ExemptFlows)
+	prometheus.MustRegister(metrics.QuotaExhausted)
+	prometheus.MustRegister(metrics.QuotaDrops)
+	prometheus.MustRegister(metrics.Greylist)
+	prometheus.MustRegister(metrics.EmergencyActive)
+	prometheus.MustRegister(metrics.HookDecisions)
+	prometheus.MustRegister(metrics.ScriptCalls)
+	prometheus.MustRegister(metrics.SessionsRejected)
+	prometheus.MustRegister(metrics.RepliesInvalid)
+	prometheus.MustRegister(metrics.DNSQueries)
+	prometheus.MustRegister(metrics.DNSResponses)
+	prometheus.MustRegister(metrics.DNSResponseTime)
+	prometheus.MustRegister(metrics.SIPCallsActive)
+	prometheus.MustRegister(metrics.SIPCalls)
+	prometheus.MustRegister(metrics.SIPMediaPackets)
+	prometheus.MustRegister(metrics.SIPMediaDropped)
+	prometheus.MustRegister(metrics.UDPOversize)
+	prometheus.MustRegister(metrics.UDPSessionRebinds)
+	prometheus.MustRegister(metrics.SessionsPersisted)
+	prometheus.MustRegister(metrics.PacketRuleMatches)
+	prometheus.MustRegister(metrics.SignatureMatches)
+	prometheus.MustRegister(metrics.Terminated)
+	prometheus.MustRegister(metrics.ClassifiedFlows)
+	prometheus.MustRegister(metrics.ClassifiedBytes)
+	prometheus.MustRegister(metrics.MirrorBytes)
+	prometheus.MustRegister(metrics.ChaosActive)
+	prometheus.MustRegister(metrics.ChaosDrops)
+	prometheus.MustRegister(metrics.ConcurrencyQueued)
+	prometheus.MustRegister(metrics.ConcurrencyDenied)
+	prometheus.MustRegister(metrics.DenyResponses)
+	prometheus.MustRegister(metrics.Tarpitted)
+	prometheus.MustRegister(metrics.UDPDenyResponses)
+	registerRuntimeCollector()
+
+	if clients.Enabled {
+		metrics.clients = newClientMetrics(clients)
+	}
+
+	if len(tagLabels) > 0 {
+		metrics.TaggedConnections = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_tagged_connections_total",
+				Help: "Total accepted connections by flow tag",
+			},
+			append([]string{"listener"}, tagLabels...),
+		)
+		metrics.TaggedBytes = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "packetpony_tagged_bytes_transferred_total",
+				Help: "Total bytes transferred by flow tag",
+			},
+			append([]string{"listener", "direction"}, tagLabels...),
+		)
+		prometheus.MustRegister(metrics.TaggedConnections)
+		prometheus.MustRegister(metrics.TaggedBytes)
+	}
 
 	return metrics
 }
 
-// StartMetricsServer starts the HTTP server for Prometheus metrics and health endpoint
-func StartMetricsServer(cfg config.PrometheusConfig) error {
-	if !cfg.Enabled {
-		return nil
-	}
+// Connection phases reported by PhaseDuration
+const (
+	PhaseAdmission = "admission"  // Accept to policy decision (bans, ACL, rate limits, pre-hook)
+	PhaseDial      = "dial"       // Connecting to the target
+	PhaseFirstByte = "first_byte" // Target connected (or session opened) to first byte from the target
+	PhaseTotal     = "total"      // Whole flow
+)
 
-	http.Handle(cfg.Path, promhttp.Handler())
-	http.HandleFunc("/health", healthHandler)
-	http.HandleFunc("/healthz", healthHandler)
-	http.HandleFunc("/ready", healthHandler)
+// ObservePhase records the duration of a connection phase
+func (m *ProxyMetrics) ObservePhase(listener, protocol, phase string, d time.Duration) {
+	m.PhaseDuration.WithLabelValues(listener, protocol, phase).Observe(d.Seconds())
+}
 
-	go func() {
-		if err := http.ListenAndServe(cfg.ListenAddress, nil); err != nil {
-			fmt.Printf("Failed to start metrics server: %v\n", err)
-		}
-	}()
+// ObserveFlowSize records the bytes a closed flow transferred in each direction
+func (m *ProxyMetrics) ObserveFlowSize(listener, protocol string, sent, received int64) {
+	m.FlowBytes.WithLabelValues(listener, protocol, "sent").Observe(float64(sent))
+	m.FlowBytes.WithLabelValues(listener, protocol, "received").Observe(float64(received))
+}
 
-	return nil
+// ObserveClassified counts a closed flow and its bytes under its
+// application protocol
+func (m *ProxyMetrics) ObserveClassified(listener, protocol, appProtocol string, bytes int64) {
+	m.ClassifiedFlows.WithLabelValues(listener, protocol, appProtocol).Inc()
+	m.ClassifiedBytes.WithLabelValues(listener, protocol, appProtocol).Add(float64(bytes))
 }
 
-// healthHandler responds to health check requests
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"status":"healthy","service":"packetpony"}`)
+// IncTaggedConnections counts an accepted connection under its flow tags
+func (m *ProxyMetrics) IncTaggedConnections(listener string, tags map[string]string) {
+	if m.TaggedConnections == nil {
+		return
+	}
+	m.TaggedConnections.WithLabelValues(m.tagLabelValues(tags, listener)...).Inc()
+}
+
+// AddTaggedBytes counts transferred bytes under the flow tags
+func (m *ProxyMetrics) AddTaggedBytes(listener, direction string, tags map[string]string, bytes int64) {
+	if m.TaggedBytes == nil {
+		return
+	}
+	m.TaggedBytes.WithLabelValues(m.tagLabelValues(tags, listener, direction)...).Add(float64(bytes))
+}
+
+// tagLabelValues builds label values: the fixed prefix followed by one value per tag label.
+// Missing tags produce an empty label value.
+func (m *ProxyMetrics) tagLabelValues(tags map[string]string, prefix ...string) []string {
+	values := make([]string, 0, len(prefix)+len(m.tagLabels))
+	values = append(values, prefix...)
+	for _, label := range m.tagLabels {
+		values = append(values, tags[label])
+	}
+	return values
 }
@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// registerRuntimeCollector replaces the default Go collector with one that
+// also exports the runtime's GC, heap and scheduler metrics (go_gc_*,
+// go_memory_classes_*, go_sched_*), alongside go_goroutines and the
+// process_* metrics that are always exported.
+func registerRuntimeCollector() {
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.MustRegister(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(
+			collectors.MetricsGC,
+			collectors.MetricsMemory,
+			collectors.MetricsScheduler,
+		),
+	))
+}
@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/handover"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unixSocketMode is the permission of the Unix sockets the server binds
+const unixSocketMode = 0660
+
+// Server serves the Prometheus metrics and health endpoints
+type Server struct {
+	cfg     config.PrometheusConfig
+	mux     *http.ServeMux
+	server  *http.Server
+	started bool
+	onError func(err error)
+	owner   []int // uid and gid given the Unix sockets, nil = the process's
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+// NewServer creates the metrics server. health supplies per-listener
+// state for /health and /ready. With basic_auth set, the metrics path
+// requires credentials; the health endpoints stay open for probes.
+func NewServer(cfg config.PrometheusConfig, health HealthSource) *Server {
+	if !cfg.Enabled {
+		return &Server{cfg: cfg}
+	}
+
+	var handler http.Handler = promhttp.Handler()
+	if cfg.BasicAuth.Enabled() {
+		handler = basicAuth(handler, cfg.BasicAuth.Username, cfg.BasicAuth.Password)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, handler)
+	mux.HandleFunc("/health", healthHandler(health))
+	mux.HandleFunc("/healthz", healthHandler(health))
+	mux.HandleFunc("/ready", readyHandler(health, cfg.StrictHealth))
+
+	return &Server{
+		cfg:    cfg,
+		mux:    mux,
+		server: &http.Server{Handler: mux},
+	}
+}
+
+// Handler returns the handler of the metrics and health endpoints, for
+// serving them on another server. It is nil when metrics are disabled.
+func (s *Server) Handler() http.Handler {
+	if s.mux == nil {
+		return nil
+	}
+	return s.mux
+}
+
+// Paths returns the paths Handler serves
+func (s *Server) Paths() []string {
+	return []string{s.cfg.Path, "/health", "/healthz", "/ready"}
+}
+
+// OwnSockets gives the Unix sockets bound by Start to uid and gid, so
+// that they stay the process's after it drops privileges
+func (s *Server) OwnSockets(uid, gid int) {
+	s.owner = []int{uid, gid}
+}
+
+// OnError sets a callback for errors that stop the server after Start
+func (s *Server) OnError(fn func(err error)) {
+	s.onError = fn
+}
+
+// Start binds the listen addresses and serves in the background, over
+// HTTPS when tls is set. It does nothing when metrics are disabled.
+func (s *Server) Start() error {
+	if !s.cfg.Enabled {
+		return nil
+	}
+
+	var tlsConfig *tls.Config
+	if s.cfg.TLS.Enabled() {
+		cert, err := tls.LoadX509KeyPair(s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	var listeners []net.Listener
+	for _, addr := range s.cfg.Addresses() {
+		// The first address keeps the name it had before there were more
+		name := "metrics"
+		if addr != s.cfg.ListenAddress {
+			name = "metrics/" + addr
+		}
+		ln, err := handover.Listen(name, addr)
+		if err == nil {
+			if err = s.ownSocket(addr); err != nil {
+				ln.Close()
+			}
+		}
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		listeners = append(listeners, ln)
+	}
+	s.started = len(listeners) > 0
+
+	for _, ln := range listeners {
+		go func() {
+			if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed && s.onError != nil {
+				s.onError(err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// ownSocket sets the permission and owner of the socket file of a Unix
+// socket address
+func (s *Server) ownSocket(addr string) error {
+	path, ok := strings.CutPrefix(addr, config.UnixAddressPrefix)
+	if !ok {
+		return nil
+	}
+	if err := os.Chmod(path, unixSocketMode); err != nil {
+		return err
+	}
+	if s.owner != nil {
+		return os.Chown(path, s.owner[0], s.owner[1])
+	}
+	return nil
+}
+
+// Shutdown gracefully stops the server and releases the listen address.
+// It is safe to call more than once and before Start.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s == nil || !s.started {
+		return nil
+	}
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.server.Shutdown(ctx)
+	})
+	return s.shutdownErr
+}
+
+// basicAuth requires the given credentials before calling next. The
+// comparison is constant time and does not leak their lengths.
+func basicAuth(next http.Handler, username, password string) http.Handler {
+	wantUser := sha256.Sum256([]byte(username))
+	wantPass := sha256.Sum256([]byte(password))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		gotUser := sha256.Sum256([]byte(user))
+		gotPass := sha256.Sum256([]byte(pass))
+		userOK := subtle.ConstantTimeCompare(gotUser[:], wantUser[:]) == 1
+		passOK := subtle.ConstantTimeCompare(gotPass[:], wantPass[:]) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="packetpony", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Top talker ranking kinds
+const (
+	TopTalkerBytes       = "bytes"
+	TopTalkerConnections = "connections"
+)
+
+// TopTalker is a single ranked client in a listener's top talker list
+type TopTalker struct {
+	Listener string
+	Client   string
+	Rank     int
+	Kind     string // TopTalkerBytes or TopTalkerConnections
+	Value    float64
+}
+
+// TopTalkersFunc returns the current top talkers across all listeners
+type TopTalkersFunc func() []TopTalker
+
+// topTalkersCollector exports top talkers computed at scrape time.
+// Series are rebuilt on every scrape, so clients that drop out of the
+// top N disappear instead of leaving stale series behind.
+type topTalkersCollector struct {
+	source    TopTalkersFunc
+	bytesDesc *prometheus.Desc
+	connsDesc *prometheus.Desc
+}
+
+// RegisterTopTalkers registers a collector exporting per-listener top talkers
+func RegisterTopTalkers(source TopTalkersFunc) {
+	prometheus.MustRegister(&topTalkersCollector{
+		source: source,
+		bytesDesc: prometheus.NewDesc(
+			"packetpony_top_talker_bytes",
+			"Bytes used in the current bandwidth window by the top clients per listener",
+			[]string{"listener", "rank", "client"}, nil,
+		),
+		connsDesc: prometheus.NewDesc(
+			"packetpony_top_talker_connections",
+			"Tracked connections of the top clients per listener",
+			[]string{"listener", "rank", "client"}, nil,
+		),
+	})
+}
+
+// Describe implements prometheus.Collector
+func (c *topTalkersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.bytesDesc
+	ch <- c.connsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *topTalkersCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range c.source() {
+		desc := c.bytesDesc
+		if t.Kind == TopTalkerConnections {
+			desc = c.connsDesc
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, t.Value,
+			t.Listener, strconv.Itoa(t.Rank), t.Client)
+	}
+}
@@ -0,0 +1,171 @@
+// Package mirror copies client traffic to a secondary target, so a new
+// backend can be tested with production traffic. Mirroring is
+// fire-and-forget: the mirror's responses are read and discarded, and a
+// slow or unreachable mirror loses data rather than slowing down the flow
+// it copies.
+package mirror
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/dns"
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+const (
+	// queueSize is how many writes wait for a slow mirror before more are dropped
+	queueSize = 64
+	// dialTimeout bounds connecting to the mirror target
+	dialTimeout = 5 * time.Second
+	// writeTimeout bounds a single write to the mirror target
+	writeTimeout = 5 * time.Second
+)
+
+// Results counted in packetpony_mirror_bytes_total
+const (
+	resultSent    = "sent"
+	resultDropped = "dropped"
+)
+
+// Target is the mirror target of a listener
+type Target struct {
+	listener string
+	network  string
+	addr     string
+	dns      *dns.Resolver
+	metrics  *metrics.ProxyMetrics
+}
+
+// NewTarget creates the mirror target of a listener, or returns nil when
+// addr is empty. Hostnames are resolved through dnsResolver.
+func NewTarget(listener, network, addr string, dnsResolver *dns.Resolver, metricsCollector *metrics.ProxyMetrics) *Target {
+	if addr == "" {
+		return nil
+	}
+	return &Target{
+		listener: listener,
+		network:  network,
+		addr:     addr,
+		dns:      dnsResolver,
+		metrics:  metricsCollector,
+	}
+}
+
+// Open starts mirroring one connection or UDP session. The mirror is
+// connected in the background. Open on a nil Target returns nil, and
+// writes to a nil Conn do nothing.
+func (t *Target) Open() *Conn {
+	if t == nil {
+		return nil
+	}
+	c := &Conn{
+		target: t,
+		queue:  make(chan []byte, queueSize),
+		stop:   make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Conn mirrors one connection or UDP session. For UDP, each write is sent
+// as one datagram.
+type Conn struct {
+	target    *Target
+	queue     chan []byte
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// Write queues a copy of b for the mirror, dropping it if the queue is full
+func (c *Conn) Write(b []byte) {
+	if c == nil || len(b) == 0 {
+		return
+	}
+	select {
+	case c.queue <- append([]byte(nil), b...):
+	default:
+		c.target.count(resultDropped, len(b))
+	}
+}
+
+// Close stops mirroring once the queued writes are sent
+func (c *Conn) Close() {
+	if c == nil {
+		return
+	}
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// run connects to the mirror and sends queued writes until closed
+func (c *Conn) run() {
+	conn, err := c.target.dns.Dial(c.target.network, c.target.addr, dialTimeout)
+	if err != nil {
+		c.target.metrics.Errors.WithLabelValues(c.target.listener, "mirror_connect").Inc()
+		c.discard()
+		return
+	}
+	defer conn.Close()
+
+	// Responses are not needed; reading them keeps the mirror from
+	// stalling on a full window. The reader ends when conn is closed.
+	go io.Copy(io.Discard, conn)
+
+	for {
+		select {
+		case b := <-c.queue:
+			if !c.send(conn, b) {
+				c.discard()
+				return
+			}
+		case <-c.stop:
+			for {
+				select {
+				case b := <-c.queue:
+					if !c.send(conn, b) {
+						c.discard()
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send writes b to the mirror, reporting false if the mirror failed
+func (c *Conn) send(conn net.Conn, b []byte) bool {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	n, err := conn.Write(b)
+	c.target.count(resultSent, n)
+	if err != nil {
+		c.target.count(resultDropped, len(b)-n)
+		c.target.metrics.Errors.WithLabelValues(c.target.listener, "mirror_write").Inc()
+		return false
+	}
+	return true
+}
+
+// discard drops queued and future writes until the Conn is closed
+func (c *Conn) discard() {
+	for {
+		select {
+		case b := <-c.queue:
+			c.target.count(resultDropped, len(b))
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// count adds n bytes to the mirror byte counter with result
+func (t *Target) count(result string, n int) {
+	if n > 0 {
+		t.metrics.MirrorBytes.WithLabelValues(t.listener, result).Add(float64(n))
+	}
+}
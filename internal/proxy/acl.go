@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"github.com/espegro/packetpony/internal/acl"
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+// watchAllowlist logs failures to read or write the runtime entries of the
+// allowlist
+func watchAllowlist(
+	allowlist *acl.Allowlist,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+) {
+	allowlist.OnStoreError(func(err error) {
+		logger.LogError(logging.EventAllowlistStorageError, map[string]interface{}{
+			"listener": cfg.Name,
+			"error":    err.Error(),
+		})
+		metricsCollector.Errors.WithLabelValues(cfg.Name, "storage").Inc()
+	})
+}
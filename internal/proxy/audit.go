@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+// Reason of audit denials by the allowlist; rate limits use the limit hit
+const auditReasonACL = "acl_denied"
+
+// auditDenial logs and counts a flow admitted in audit mode that the
+// allowlist or a rate limit would have denied for reason
+func auditDenial(
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+	clientIP string,
+	reason string,
+	schedule string,
+) {
+	fields := map[string]interface{}{
+		"listener":  cfg.Name,
+		"client_ip": clientIP,
+	}
+	if schedule != "" {
+		fields["schedule"] = schedule
+	}
+	if reason == auditReasonACL {
+		logger.LogWarning(logging.EventAuditDeniedACL, fields)
+	} else {
+		fields["limit"] = reason
+		logger.LogWarning(logging.EventAuditDeniedRateLimit, fields)
+	}
+	metricsCollector.AuditDenials.WithLabelValues(cfg.Name, reason).Inc()
+}
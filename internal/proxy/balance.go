@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/target"
+)
+
+// backendConns counts active flows per balanced target. The least_conn
+// policy reads the counts; they are also exported as a gauge.
+type backendConns struct {
+	listener string
+	counts   map[string]*atomic.Int64
+	metrics  *metrics.ProxyMetrics
+}
+
+// trackBackends creates per-target counters for a listener with multiple
+// targets and hands them to the selector. Returns nil otherwise.
+func trackBackends(targets *target.Selector, cfg *config.ListenerConfig, metricsCollector *metrics.ProxyMetrics) *backendConns {
+	if len(cfg.Targets) == 0 {
+		return nil
+	}
+
+	b := &backendConns{
+		listener: cfg.Name,
+		counts:   make(map[string]*atomic.Int64, len(cfg.Targets)),
+		metrics:  metricsCollector,
+	}
+	for _, t := range cfg.Targets {
+		b.counts[t.Address] = new(atomic.Int64)
+	}
+	targets.SetLoad(b.active)
+	return b
+}
+
+// acquire counts a new flow to backend
+func (b *backendConns) acquire(backend string) {
+	if b == nil || backend == "" {
+		return
+	}
+	b.counts[backend].Add(1)
+	b.metrics.BackendConnections.WithLabelValues(b.listener, backend).Inc()
+}
+
+// release counts a closed flow to backend
+func (b *backendConns) release(backend string) {
+	if b == nil || backend == "" {
+		return
+	}
+	b.counts[backend].Add(-1)
+	b.metrics.BackendConnections.WithLabelValues(b.listener, backend).Dec()
+}
+
+// active returns the number of open flows to backend
+func (b *backendConns) active(backend string) int64 {
+	if count, ok := b.counts[backend]; ok {
+		return count.Load()
+	}
+	return 0
+}
+
+// circuitStates maps circuit states to packetpony_circuit_state values
+var circuitStates = map[string]float64{
+	target.CircuitClosed:   0,
+	target.CircuitHalfOpen: 1,
+	target.CircuitOpen:     2,
+}
+
+// watchCircuit logs circuit breaker state changes of balanced targets and
+// exports the state as a gauge
+func watchCircuit(
+	targets *target.Selector,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+) {
+	if len(cfg.Targets) == 0 || !cfg.HasCircuitBreaker() {
+		return
+	}
+
+	for _, t := range cfg.Targets {
+		metricsCollector.CircuitState.WithLabelValues(cfg.Name, t.Address).Set(0)
+	}
+	targets.OnCircuitChange(func(backend, state string) {
+		metricsCollector.CircuitState.WithLabelValues(cfg.Name, backend).Set(circuitStates[state])
+
+		fields := map[string]interface{}{
+			"listener": cfg.Name,
+			"target":   backend,
+		}
+		switch state {
+		case target.CircuitOpen:
+			fields["cooldown"] = cfg.CircuitBreaker.GetCooldown().String()
+			logger.LogWarning(logging.EventCircuitOpened, fields)
+		case target.CircuitHalfOpen:
+			logger.LogInfo(logging.EventCircuitHalfOpen, fields)
+		default:
+			logger.LogInfo(logging.EventCircuitClosed, fields)
+		}
+	})
+}
+
+// flowClosers holds a close function for each open TCP connection to a
+// balanced target, so connections can be cut when a drain deadline passes
+type flowClosers struct {
+	mu        sync.Mutex
+	next      uint64
+	byBackend map[string]map[uint64]func()
+}
+
+// add registers closeFlow for a connection to backend and returns a
+// function that unregisters it
+func (f *flowClosers) add(backend string, closeFlow func()) func() {
+	if backend == "" {
+		return func() {}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.byBackend == nil {
+		f.byBackend = make(map[string]map[uint64]func())
+	}
+	if f.byBackend[backend] == nil {
+		f.byBackend[backend] = make(map[uint64]func())
+	}
+	id := f.next
+	f.next++
+	f.byBackend[backend][id] = closeFlow
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.byBackend[backend], id)
+	}
+}
+
+// closeAll closes every connection to backend
+func (f *flowClosers) closeAll(backend string) {
+	f.mu.Lock()
+	closers := make([]func(), 0, len(f.byBackend[backend]))
+	for _, closeFlow := range f.byBackend[backend] {
+		closers = append(closers, closeFlow)
+	}
+	f.mu.Unlock()
+
+	for _, closeFlow := range closers {
+		closeFlow()
+	}
+}
+
+// watchDrainDeadline closes the remaining flows of a draining target once
+// its grace period ends
+func watchDrainDeadline(
+	targets *target.Selector,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	closeFlows func(backend string),
+) {
+	targets.OnDrainDeadline(func(backend string) {
+		logger.LogInfo(logging.EventDrainDeadline, map[string]interface{}{
+			"listener": cfg.Name,
+			"target":   backend,
+		})
+		closeFlows(backend)
+	})
+}
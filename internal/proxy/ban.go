@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"github.com/espegro/packetpony/internal/ban"
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+// recordViolation records a rate limit violation against the ban list,
+// logging and counting the ban if the client crossed the threshold
+func recordViolation(
+	banList *ban.BanList,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+	clientIP string,
+	reason string,
+) {
+	if !banList.RecordViolation(clientIP) {
+		return
+	}
+
+	logger.LogWarning(logging.EventClientBanned, map[string]interface{}{
+		"listener":     cfg.Name,
+		"client_ip":    clientIP,
+		"reason":       reason,
+		"ban_duration": banList.Duration().String(),
+	})
+	metricsCollector.BansTotal.WithLabelValues(cfg.Name).Inc()
+	metricsCollector.BansActive.WithLabelValues(cfg.Name).Set(float64(banList.ActiveBans()))
+}
+
+// watchBanExpiry logs expired bans, bans lifted by other instances and ban
+// storage failures, and keeps the active ban gauge current
+func watchBanExpiry(
+	banList *ban.BanList,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+) {
+	banList.OnExpire(func(ip string) {
+		logger.LogInfo(logging.EventBanExpired, map[string]interface{}{
+			"listener":  cfg.Name,
+			"client_ip": ip,
+		})
+		metricsCollector.BansActive.WithLabelValues(cfg.Name).Set(float64(banList.ActiveBans()))
+	})
+	banList.OnLift(func(ip string) {
+		logger.LogInfo(logging.EventBanLifted, map[string]interface{}{
+			"listener":  cfg.Name,
+			"client_ip": ip,
+		})
+		metricsCollector.BansActive.WithLabelValues(cfg.Name).Set(float64(banList.ActiveBans()))
+	})
+	banList.OnStoreError(func(err error) {
+		logger.LogError(logging.EventBanStorageError, map[string]interface{}{
+			"listener": cfg.Name,
+			"error":    err.Error(),
+		})
+		metricsCollector.Errors.WithLabelValues(cfg.Name, "storage").Inc()
+	})
+}
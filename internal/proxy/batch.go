@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+
+	"github.com/espegro/packetpony/internal/config"
+	"golang.org/x/net/ipv4"
+)
+
+// replyBatchQueue is how many batches of replies may wait for the writer
+// before session readers block
+const replyBatchQueue = 4
+
+// Limits of one segmented write: UDP_MAX_SEGMENTS, and the largest UDP
+// payload of an IPv4 packet
+const (
+	maxGSOSegments = 64
+	maxGSOBytes    = 65507
+)
+
+// reply is a datagram on its way to a client
+type reply struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// replyBatch sends replies to clients through the listener socket from a
+// single goroutine, as many per write as have queued up to its size: one
+// sendmmsg call on Linux, a write each elsewhere. With segmentation
+// offload, consecutive replies to the same client go in one message the
+// kernel cuts apart. A nil batch is not used; session readers write their
+// replies themselves.
+type replyBatch struct {
+	conn      *ipv4.PacketConn
+	queue     chan reply
+	done      chan struct{}
+	size      int
+	gso       bool                      // Segment replies to the same client; cleared if the kernel cannot
+	sent      func(n int)               // Called with the size of each batch
+	segmented func(n int)               // Called with the replies of each segmented message
+	failed    func(*net.UDPAddr, error) // Called for each reply that could not be sent
+	gsoFailed func(error)               // Called when segmentation is turned off
+}
+
+// newReplyBatch starts a writer sending batches of up to size replies
+// through conn. segmented and gsoFailed are only called with gso.
+func newReplyBatch(conn *net.UDPConn, size int, gso bool, sent, segmented func(int), failed func(*net.UDPAddr, error), gsoFailed func(error)) *replyBatch {
+	b := &replyBatch{
+		conn:      ipv4.NewPacketConn(conn),
+		queue:     make(chan reply, size*replyBatchQueue),
+		done:      make(chan struct{}),
+		size:      size,
+		gso:       gso && offloadSupported,
+		sent:      sent,
+		segmented: segmented,
+		failed:    failed,
+		gsoFailed: gsoFailed,
+	}
+	go b.run()
+	return b
+}
+
+// write queues a copy of data for addr, waiting while the queue is full.
+// Replies written after the batch is closed are dropped.
+func (b *replyBatch) write(data []byte, addr *net.UDPAddr) {
+	r := reply{data: append([]byte(nil), data...), addr: addr}
+	select {
+	case b.queue <- r:
+	case <-b.done:
+	}
+}
+
+// run sends the queued replies until the batch is closed
+func (b *replyBatch) run() {
+	replies := make([]reply, 0, b.size)
+	msgs := make([]ipv4.Message, 0, b.size)
+
+	for {
+		var r reply
+		select {
+		case r = <-b.queue:
+		case <-b.done:
+			return
+		}
+
+		// Take what else has queued, without waiting for more
+		replies = append(replies[:0], r)
+	collect:
+		for len(replies) < b.size {
+			select {
+			case r = <-b.queue:
+				replies = append(replies, r)
+			default:
+				break collect
+			}
+		}
+		b.sent(len(replies))
+		msgs = b.messages(msgs[:0], replies)
+		b.send(msgs)
+
+		// Let the replies be collected
+		clear(replies)
+		clear(msgs)
+	}
+}
+
+// messages appends the messages sending replies to msgs: one per reply,
+// or with segmentation one per run of replies the kernel can cut apart
+func (b *replyBatch) messages(msgs []ipv4.Message, replies []reply) []ipv4.Message {
+	for len(replies) > 0 {
+		n := 1
+		if b.gso {
+			n = gsoRun(replies)
+		}
+		m := ipv4.Message{Buffers: make([][]byte, n), Addr: replies[0].addr}
+		for i, r := range replies[:n] {
+			m.Buffers[i] = r.data
+		}
+		if n > 1 {
+			m.OOB = gsoControl(len(replies[0].data))
+			b.segmented(n)
+		}
+		msgs = append(msgs, m)
+		replies = replies[n:]
+	}
+	return msgs
+}
+
+// gsoRun returns how many replies from the first can go in one segmented
+// message: those to the same client, of the size of the first except for
+// a shorter last one, within the kernel's limits
+func gsoRun(replies []reply) int {
+	first := replies[0]
+	size := len(first.data)
+	if size == 0 {
+		return 1
+	}
+	n, total := 1, size
+	for n < len(replies) && n < maxGSOSegments {
+		r := replies[n]
+		if len(r.data) == 0 || len(r.data) > size || total+len(r.data) > maxGSOBytes ||
+			r.addr.Port != first.addr.Port || !r.addr.IP.Equal(first.addr.IP) {
+			break
+		}
+		n++
+		total += len(r.data)
+		if len(r.data) < size {
+			break
+		}
+	}
+	return n
+}
+
+// send writes msgs, skipping past each message the socket refuses. A
+// write fails for its first message only; it stops short of a later one.
+// A segmented message the kernel cannot segment is sent a reply at a
+// time, as are all replies from then on.
+func (b *replyBatch) send(msgs []ipv4.Message) {
+	for len(msgs) > 0 {
+		n, err := b.conn.WriteBatch(msgs, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			m := msgs[0]
+			if len(m.Buffers) > 1 && gsoUnsupported(err) {
+				if b.gso {
+					b.gso = false
+					b.gsoFailed(err)
+				}
+				each := make([]ipv4.Message, len(m.Buffers))
+				for i, data := range m.Buffers {
+					each[i] = ipv4.Message{Buffers: [][]byte{data}, Addr: m.Addr}
+				}
+				b.send(each)
+			} else {
+				for range m.Buffers {
+					b.failed(m.Addr.(*net.UDPAddr), err)
+				}
+			}
+			n = 1
+		}
+		msgs = msgs[n:]
+	}
+}
+
+// close stops the writer; queued replies are dropped
+func (b *replyBatch) close() {
+	if b != nil {
+		close(b.done)
+	}
+}
+
+// BatchReader reads datagrams from a socket as many per call as have
+// arrived, up to its size: one recvmmsg call on Linux, a read each
+// elsewhere. With receive offload a read may hold several datagrams of a
+// flow, which it splits again. It hands them out one at a time.
+type BatchReader struct {
+	conn      *net.UDPConn
+	batch     *ipv4.PacketConn
+	msgs      []ipv4.Message
+	n, next   int
+	observed  func(n int) // Called with the size of each batch read
+	segments  func(n int) // Called with the datagrams of each read with offload
+	coalesced []byte      // Datagrams left of the current read
+	segment   int         // Their size
+	oob       []byte      // Control messages of the current read
+	src       *net.UDPAddr
+}
+
+// NewBatchReader returns a reader of up to size datagrams of bufferSize
+// bytes per call, with oobSize bytes of control messages each
+func NewBatchReader(conn *net.UDPConn, size, bufferSize, oobSize int, observed func(int)) *BatchReader {
+	r := &BatchReader{
+		conn:     conn,
+		batch:    ipv4.NewPacketConn(conn),
+		msgs:     make([]ipv4.Message, size),
+		observed: observed,
+	}
+	r.allocate(bufferSize, oobSize)
+	return r
+}
+
+// allocate gives each message of the batch its buffers
+func (r *BatchReader) allocate(bufferSize, oobSize int) {
+	for i := range r.msgs {
+		r.msgs[i].Buffers = [][]byte{make([]byte, bufferSize)}
+		r.msgs[i].OOB = nil
+		if oobSize > 0 {
+			r.msgs[i].OOB = make([]byte, oobSize)
+		}
+	}
+}
+
+// EnableGRO has the kernel coalesce the datagrams of a flow into one
+// read, growing the buffers to hold the largest. segments is called with
+// the datagrams of each read. It must be called before the first Read.
+func (r *BatchReader) EnableGRO(segments func(int)) error {
+	if err := enableGRO(r.conn); err != nil {
+		return err
+	}
+	bufferSize := max(len(r.msgs[0].Buffers[0]), config.UDPOffloadBufferSize)
+	r.allocate(bufferSize, len(r.msgs[0].OOB)+groOOBSize)
+	r.segments = segments
+	return nil
+}
+
+// Read returns the next datagram, its control messages and its source,
+// reading a batch once those of the last are handed out. The data is
+// valid until the next batch is read.
+func (r *BatchReader) Read() ([]byte, []byte, *net.UDPAddr, error) {
+	if len(r.coalesced) > 0 {
+		data := r.coalesced[:min(r.segment, len(r.coalesced))]
+		r.coalesced = r.coalesced[len(data):]
+		return data, r.oob, r.src, nil
+	}
+
+	if r.next == r.n {
+		n, err := r.batch.ReadBatch(r.msgs, 0)
+		if err != nil {
+			r.n, r.next = 0, 0
+			return nil, nil, nil, err
+		}
+		r.n, r.next = n, 0
+		r.observed(n)
+	}
+	m := &r.msgs[r.next]
+	r.next++
+	data, oob := m.Buffers[0][:m.N], m.OOB[:m.NN]
+	src, _ := m.Addr.(*net.UDPAddr)
+
+	if r.segments != nil {
+		segment := groSegmentSize(oob)
+		if segment <= 0 || segment >= len(data) {
+			r.segments(1)
+			return data, oob, src, nil
+		}
+		r.segments((len(data) + segment - 1) / segment)
+		r.coalesced, r.segment, r.oob, r.src = data[segment:], segment, oob, src
+		data = data[:segment]
+	}
+	return data, oob, src, nil
+}
+
+// Size returns the bytes of datagram buffers the reader holds
+func (r *BatchReader) Size() int {
+	return len(r.msgs) * len(r.msgs[0].Buffers[0])
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/espegro/packetpony/internal/capture"
+)
+
+// ErrCaptureRunning is returned when a listener already has a capture running
+var ErrCaptureRunning = errors.New("a capture is already running on this listener")
+
+// Tap holds the packet capture running on a listener, if any. Flows look
+// the capture up for every payload, so one started or stopped mid-flow
+// takes effect right away.
+type Tap struct {
+	mu      sync.Mutex // Serializes starting with removal of a stopped capture
+	current atomic.Pointer[capture.Capture]
+}
+
+// Current returns the running capture, or nil
+func (t *Tap) Current() *capture.Capture {
+	return t.current.Load()
+}
+
+// Start starts a capture with opts. The capture is removed from the tap
+// when it stops, after which onStop is called.
+func (t *Tap) Start(listener string, opts capture.Options, onStop func(capture.Status)) (*capture.Capture, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current.Load() != nil {
+		return nil, ErrCaptureRunning
+	}
+
+	var c *capture.Capture
+	c, err := capture.Start(listener, opts, func(status capture.Status) {
+		t.mu.Lock()
+		t.current.CompareAndSwap(c, nil)
+		t.mu.Unlock()
+		onStop(status)
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.current.Store(c)
+	return c, nil
+}
+
+// Stop stops the running capture and returns its final status. It reports
+// false if no capture is running.
+func (t *Tap) Stop() (capture.Status, bool) {
+	c := t.current.Load()
+	if c == nil {
+		return capture.Status{}, false
+	}
+	c.Stop()
+	return c.Status(), true
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/espegro/packetpony/internal/chaos"
+)
+
+// Chaos returns the listener's fault injector
+func (p *TCPProxy) Chaos() *chaos.Injector {
+	return p.chaos
+}
+
+// Chaos returns the listener's fault injector
+func (p *UDPProxy) Chaos() *chaos.Injector {
+	return p.chaos
+}
+
+// sendLater writes a copy of a datagram held back by chaos mode once delay
+// has passed. A failed write is counted as errType but, unlike an
+// immediate one, does not end the session; a session closed in the
+// meantime just loses the datagram.
+func (p *UDPProxy) sendLater(delay time.Duration, data []byte, errType string, write func([]byte) error) {
+	payload := append([]byte(nil), data...)
+	time.AfterFunc(delay, func() {
+		if err := write(payload); err != nil && !errors.Is(err, net.ErrClosed) {
+			p.metrics.Errors.WithLabelValues(p.config.Name, errType).Inc()
+		}
+	})
+}
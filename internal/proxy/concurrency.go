@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// Reasons a connection gets no concurrency slot
+const (
+	concurrencyFull    = "full"    // Every slot and queue place taken
+	concurrencyTimeout = "timeout" // Waited concurrency_queue_timeout in the queue
+	concurrencyClosed  = "closed"  // Listener stopped while waiting
+)
+
+// concurrencyLimiter caps how many connections a listener forwards at
+// once, for every client alike, so a small backend is not overrun by
+// bursts from allowlisted or exempt clients. Connections over the cap
+// wait in a bounded queue for a slot, or are refused without one.
+type concurrencyLimiter struct {
+	slots   chan struct{}
+	queue   chan struct{} // Places to wait for a slot, nil = refuse right away
+	timeout time.Duration
+	stop    chan struct{}
+}
+
+// newConcurrencyLimiter returns the limiter of a tcp block, or nil if
+// max_concurrent_connections is not set
+func newConcurrencyLimiter(cfg *config.TCPConfig) *concurrencyLimiter {
+	if cfg == nil || cfg.MaxConcurrentConnections <= 0 {
+		return nil
+	}
+	c := &concurrencyLimiter{
+		slots:   make(chan struct{}, cfg.MaxConcurrentConnections),
+		timeout: cfg.GetConcurrencyQueueTimeout(),
+		stop:    make(chan struct{}),
+	}
+	if cfg.ConcurrencyQueue > 0 {
+		c.queue = make(chan struct{}, cfg.ConcurrencyQueue)
+	}
+	return c
+}
+
+// acquire takes a slot, waiting in the queue if all are taken. It returns
+// how long it waited and, without a slot, the reason.
+func (c *concurrencyLimiter) acquire(queued func(delta float64)) (time.Duration, string) {
+	if c == nil {
+		return 0, ""
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return 0, ""
+	default:
+	}
+
+	select {
+	case c.queue <- struct{}{}: // Never ready on a nil queue
+	default:
+		return 0, concurrencyFull
+	}
+	queued(1)
+	defer func() {
+		<-c.queue
+		queued(-1)
+	}()
+
+	start := time.Now()
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case c.slots <- struct{}{}:
+		return time.Since(start), ""
+	case <-timer.C:
+		return time.Since(start), concurrencyTimeout
+	case <-c.stop:
+		return time.Since(start), concurrencyClosed
+	}
+}
+
+// release frees a slot taken by acquire
+func (c *concurrencyLimiter) release() {
+	if c != nil {
+		<-c.slots
+	}
+}
+
+// close turns away connections waiting in the queue
+func (c *concurrencyLimiter) close() {
+	if c != nil {
+		close(c.stop)
+	}
+}
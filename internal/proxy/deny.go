@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// Reasons a denied client is answered for, filled in for {reason}
+const (
+	denyReasonBanned      = "banned"
+	denyReasonACL         = "acl_denied"
+	denyReasonRateLimited = "rate_limited"
+	denyReasonGreylisted  = "greylisted"
+	denyReasonQuota       = "quota_exhausted"
+)
+
+// denyWriteTimeout bounds how long a banner may take to write, and how
+// long the client's data is read afterwards so that it sees the banner
+// rather than a reset
+const denyWriteTimeout = time.Second
+
+// denyResponder answers clients denied by the ban list, the allowlist or
+// a connection rate limit as tcp.deny_response says. Tarpitted
+// connections are held until their time is up, the client gives up or
+// the listener drains.
+type denyResponder struct {
+	action   string
+	banner   string
+	duration time.Duration
+	interval time.Duration
+	max      int
+
+	mu       sync.Mutex
+	tarpit   map[net.Conn]struct{}
+	released bool // Tarpit closed by draining; denied connections are closed
+}
+
+// newDenyResponder returns the responder of a tcp block, or nil if
+// denied connections are just closed
+func newDenyResponder(cfg *config.TCPConfig) *denyResponder {
+	if cfg == nil || cfg.DenyResponse.GetAction() == config.DenyActionClose {
+		return nil
+	}
+	d := cfg.DenyResponse
+	return &denyResponder{
+		action:   d.Action,
+		banner:   d.Banner,
+		duration: d.GetTarpitDuration(),
+		interval: d.GetTarpitInterval(),
+		max:      d.GetMaxTarpitted(),
+		tarpit:   make(map[net.Conn]struct{}),
+	}
+}
+
+// bannerFor returns the banner with the client's IP and the reason it was
+// denied filled in
+func (d *denyResponder) bannerFor(clientIP, reason string) []byte {
+	return []byte(strings.NewReplacer("{client_ip}", clientIP, "{reason}", reason).Replace(d.banner))
+}
+
+// enter adds a connection to the tarpit. It reports false when the
+// tarpit is full or released.
+func (d *denyResponder) enter(conn net.Conn) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.released || len(d.tarpit) >= d.max {
+		return false
+	}
+	d.tarpit[conn] = struct{}{}
+	return true
+}
+
+// leave removes a connection from the tarpit
+func (d *denyResponder) leave(conn net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.tarpit, conn)
+}
+
+// release closes the tarpitted connections and refuses further ones
+func (d *denyResponder) release() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.released = true
+	for conn := range d.tarpit {
+		conn.Close()
+	}
+}
+
+// denyConnection answers a denied client before HandleConnection closes
+// its connection. admitted is called before the connection is held in the
+// tarpit, so that it does not take up a pending accept.
+func (p *TCPProxy) denyConnection(clientConn net.Conn, clientIP, reason string, admitted func()) {
+	d := p.deny
+	action := config.DenyActionClose
+	if d != nil {
+		action = d.action
+	}
+	if action == config.DenyActionTarpit && !d.enter(clientConn) {
+		action = config.DenyActionClose
+	}
+	p.metrics.DenyResponses.WithLabelValues(p.config.Name, action).Inc()
+
+	switch action {
+	case config.DenyActionReset:
+		// Closing with a zero linger time aborts the connection
+		if conn, ok := clientConn.(interface{ SetLinger(int) error }); ok {
+			conn.SetLinger(0)
+		}
+	case config.DenyActionBanner:
+		clientConn.SetWriteDeadline(time.Now().Add(denyWriteTimeout))
+		if _, err := clientConn.Write(d.bannerFor(clientIP, reason)); err == nil {
+			lingerClose(clientConn)
+		}
+	case config.DenyActionTarpit:
+		admitted()
+		gauge := p.metrics.Tarpitted.WithLabelValues(p.config.Name)
+		gauge.Inc()
+		d.hold(clientConn, d.bannerFor(clientIP, reason))
+		gauge.Dec()
+		d.leave(clientConn)
+	}
+}
+
+// hold keeps a connection open for the tarpit duration, writing a byte of
+// banner every interval and discarding what the client sends. It returns
+// early when the client goes away or the connection is closed.
+func (d *denyResponder) hold(conn net.Conn, banner []byte) {
+	buf := make([]byte, 512)
+	end := time.Now().Add(d.duration)
+	tick := time.Now().Add(d.interval)
+	next := 0
+	for time.Now().Before(end) {
+		conn.SetReadDeadline(minTime(tick, end))
+		_, err := conn.Read(buf)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+		if len(banner) > 0 && time.Now().Before(end) {
+			conn.SetWriteDeadline(time.Now().Add(d.interval))
+			if _, err := conn.Write(banner[next : next+1]); err != nil {
+				return
+			}
+			next = (next + 1) % len(banner)
+		}
+		tick = tick.Add(d.interval)
+	}
+}
+
+// lingerClose shuts the sending side of a connection and reads what the
+// client still sends for a moment. Closing a connection with unread data
+// resets it, and the client may then lose what was written to it.
+func lingerClose(conn net.Conn) {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok || cw.CloseWrite() != nil {
+		return
+	}
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(denyWriteTimeout))
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// minTime returns the earlier of two times
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/espegro/packetpony/internal/dnswire"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/session"
+)
+
+// dnsQuery counts and remembers a client datagram of a protocol_hint dns
+// session. The datagram is forwarded as is, whether it parses or not.
+func (p *UDPProxy) dnsQuery(sess *session.Session, data []byte) {
+	if sess.DNS == nil {
+		return
+	}
+	m, err := dnswire.Parse(data)
+	if err != nil || m.Response {
+		p.metrics.DNSQueries.WithLabelValues(p.config.Name, "malformed").Inc()
+		return
+	}
+	// Unnamed types are lumped together to bound the label values
+	qtype := "other"
+	if dnswire.KnownType(m.QType) {
+		qtype = dnswire.TypeName(m.QType)
+	}
+	p.metrics.DNSQueries.WithLabelValues(p.config.Name, qtype).Inc()
+	sess.DNS.Query(m, time.Now())
+}
+
+// dnsResponse counts a datagram returned to the client of a protocol_hint
+// dns session, and logs the transaction it completes if the session is
+// sampled
+func (p *UDPProxy) dnsResponse(sess *session.Session, data []byte) {
+	if sess.DNS == nil {
+		return
+	}
+	m, err := dnswire.Parse(data)
+	if err != nil || !m.Response {
+		return
+	}
+	rcode := dnswire.RCodeName(m.RCode)
+	p.metrics.DNSResponses.WithLabelValues(p.config.Name, rcode).Inc()
+
+	q, ok := sess.DNS.Answer(m)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(q.Sent)
+	p.metrics.DNSResponseTime.WithLabelValues(p.config.Name).Observe(elapsed.Seconds())
+	if sess.SampleRate == 0 {
+		return
+	}
+
+	targetHost, targetPort, _ := net.SplitHostPort(sess.TargetAddress)
+	p.logger.LogConnection(logging.ConnectionEvent{
+		Timestamp:    time.Now(),
+		FlowID:       sess.FlowID,
+		ListenerName: p.config.Name,
+		Protocol:     "udp",
+		SourceIP:     sess.SourceAddr.IP.String(),
+		SourcePort:   sess.SourceAddr.Port,
+		TargetIP:     targetHost,
+		TargetPort:   parsePort(targetPort),
+		EventType:    "dns",
+		Duration:     elapsed.Milliseconds(),
+		SampleRate:   eventSampleRate(sess.SampleRate),
+		DNSQName:     q.QName,
+		DNSQType:     dnswire.TypeName(q.QType),
+		DNSRCode:     rcode,
+		Tags:         sess.Tags,
+	})
+}
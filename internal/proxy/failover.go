@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/transparent"
+)
+
+// dialTarget connects to the selected target. With failover enabled, a
+// failed connect is retried against the next balanced targets, up to
+// failover.max_attempts targets in total. It returns the connection and the
+// target actually used; on failure, the error of the first attempt.
+func (p *TCPProxy) dialTarget(clientIP net.IP, clientPort int, addr, backend string) (net.Conn, string, string, error) {
+	maxAttempts := 1
+	if p.config.Failover != nil && p.config.Failover.Enabled && backend != "" {
+		maxAttempts = p.config.Failover.GetMaxAttempts(len(p.config.Targets))
+	}
+
+	tried := []string{backend}
+	var firstErr error
+	for {
+		conn, err := p.dial(clientIP, addr)
+		if err == nil {
+			p.targets.ReportSuccess(backend)
+			return conn, addr, backend, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if backend != "" {
+			p.metrics.BackendFailures.WithLabelValues(p.config.Name, backend).Inc()
+			p.targets.ReportFailure(backend)
+		}
+		if len(tried) >= maxAttempts {
+			return nil, addr, backend, firstErr
+		}
+
+		nextAddr, nextBackend, nextErr := p.targets.Failover(clientIP, clientPort, tried)
+		if nextErr != nil {
+			return nil, addr, backend, firstErr
+		}
+		p.logger.LogWarning(logging.EventTargetFailover, map[string]interface{}{
+			"listener":  p.config.Name,
+			"client_ip": clientIP.String(),
+			"target":    addr,
+			"next":      nextAddr,
+			"error":     err.Error(),
+		})
+		p.metrics.BackendFailovers.WithLabelValues(p.config.Name).Inc()
+
+		addr, backend = nextAddr, nextBackend
+		tried = append(tried, backend)
+	}
+}
+
+// dial connects to a target, through the target_proxy if one is set, or
+// from the client's address in transparent mode
+func (p *TCPProxy) dial(clientIP net.IP, addr string) (net.Conn, error) {
+	timeout := p.config.GetTargetDialTimeout()
+	dialer := &net.Dialer{Timeout: timeout}
+	if p.config.Transparent {
+		dialer = transparent.Dialer("tcp", clientIP, timeout)
+	} else if ip := p.config.BindSourceIP(); ip != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	dialer.KeepAlive = p.config.TargetKeepalive
+	p.sockOpts.Dialer(dialer)
+
+	var conn net.Conn
+	var err error
+	if p.upstream != nil {
+		conn, err = p.upstream.Dial(dialer, addr)
+	} else {
+		conn, err = p.dns.DialWith(dialer, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	SetTCPOptions(conn, p.config.TCP, p.config.TargetKeepalive)
+	return conn, nil
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"github.com/espegro/packetpony/internal/classify"
+)
+
+// fingerprinter picks the JA3 hash of a TLS ClientHello or the SSH
+// identification string out of the first bytes a client sends. It only
+// watches the stream: the bytes are forwarded as they arrive, and at most
+// one ClientHello is buffered while it is split over several reads.
+type fingerprinter struct {
+	buf  []byte
+	done bool
+	ja3  string
+	ssh  string
+}
+
+// observe feeds the next bytes from the client. It is called from the
+// goroutine copying the client's data only.
+func (f *fingerprinter) observe(data []byte) {
+	if f == nil || f.done {
+		return
+	}
+	payload := data
+	if len(f.buf) > 0 {
+		f.buf = append(f.buf, data[:min(len(data), classify.MaxClientHelloBytes-len(f.buf))]...)
+		payload = f.buf
+	}
+
+	banner, sshIncomplete := classify.SSHBanner(payload)
+	full := len(payload) >= classify.MaxClientHelloBytes
+	if !full && (sshIncomplete || classify.HelloIncomplete(payload)) {
+		if len(f.buf) == 0 {
+			f.buf = append(make([]byte, 0, len(data)), data...)
+		}
+		return
+	}
+
+	f.ssh = banner
+	if banner == "" {
+		f.ja3 = classify.JA3(payload)
+	}
+	f.done = true
+	f.buf = nil
+}
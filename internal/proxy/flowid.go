@@ -0,0 +1,15 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// newFlowID returns a random identifier for a connection or UDP session.
+// It is logged with every event and can be forwarded to backends so their
+// logs can be joined with packetpony's.
+func newFlowID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
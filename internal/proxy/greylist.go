@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/greylist"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+// Results of greylisting a flow, as counted; known and passed are those of
+// the greylist
+const (
+	greylistDelayed  = "delayed"
+	greylistRejected = "rejected"
+)
+
+// watchGreylist logs failures to read or write the known clients of the
+// greylist
+func watchGreylist(
+	list *greylist.List,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+) {
+	list.OnStoreError(func(err error) {
+		logger.LogError(logging.EventGreylistStorageError, map[string]interface{}{
+			"listener": cfg.Name,
+			"error":    err.Error(),
+		})
+		metricsCollector.Errors.WithLabelValues(cfg.Name, "storage").Inc()
+	})
+}
+
+// checkGreylist checks a flow of the client against the greylist. It
+// reports whether the client is new and held back, and for how long.
+// Held back clients are logged at their first flow.
+func checkGreylist(
+	list *greylist.List,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+	clientIP string,
+) (bool, time.Duration) {
+	result, wait := list.Check(clientIP)
+	switch result {
+	case greylist.ResultKnown, greylist.ResultPassed:
+		metricsCollector.Greylist.WithLabelValues(cfg.Name, result).Inc()
+		return false, 0
+	case greylist.ResultNew:
+		logger.LogInfo(logging.EventGreylisted, map[string]interface{}{
+			"listener":  cfg.Name,
+			"client_ip": clientIP,
+			"action":    cfg.Greylist.GetAction(),
+			"delay_ms":  wait.Milliseconds(),
+		})
+	}
+	return true, wait
+}
+
+// greylistConnection holds back a connection of a client new to the
+// greylist, as greylist.action says: it waits out the client's delay, or
+// is refused. It reports whether the connection goes on.
+func (p *TCPProxy) greylistConnection(clientConn net.Conn, clientIP string, admitted func()) bool {
+	if p.greylist == nil {
+		return true
+	}
+	held, wait := checkGreylist(p.greylist, p.config, p.logger, p.metrics, clientIP)
+	if !held {
+		return true
+	}
+
+	if p.config.Greylist.GetAction() == config.GreylistActionReject {
+		p.metrics.Greylist.WithLabelValues(p.config.Name, greylistRejected).Inc()
+		p.metrics.IncClientDrops(p.config.Name, clientIP, "greylisted")
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "tcp", "greylisted").Inc()
+		p.denyConnection(clientConn, clientIP, denyReasonGreylisted, admitted)
+		return false
+	}
+
+	p.metrics.Greylist.WithLabelValues(p.config.Name, greylistDelayed).Inc()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-p.released:
+		return false
+	}
+
+	// The client has waited out its delay, which makes it known
+	if result, _ := p.greylist.Check(clientIP); result == greylist.ResultPassed {
+		p.metrics.Greylist.WithLabelValues(p.config.Name, result).Inc()
+	}
+	return true
+}
+
+// greylistSession reports whether a new session of the client goes on.
+// Datagrams cannot be held back, so those of a client new to the greylist
+// are dropped until its delay is up, whatever greylist.action says.
+func (p *UDPProxy) greylistSession(data []byte, srcAddr *net.UDPAddr, clientIP string, listenerConn *net.UDPConn) bool {
+	if p.greylist == nil {
+		return true
+	}
+	if held, _ := checkGreylist(p.greylist, p.config, p.logger, p.metrics, clientIP); !held {
+		return true
+	}
+	p.metrics.Greylist.WithLabelValues(p.config.Name, greylistRejected).Inc()
+	p.metrics.IncClientDrops(p.config.Name, clientIP, "greylisted")
+	p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "greylisted").Inc()
+	p.denyDatagram(data, srcAddr, denyReasonGreylisted, listenerConn)
+	return false
+}
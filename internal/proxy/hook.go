@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/hook"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+// authorize consults the pre-hook for a new connection or session.
+// Returns the client identity the hook reported, if any, and true if the
+// flow may proceed.
+func authorize(
+	authorizer *hook.Authorizer,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+	req hook.Request,
+) (string, bool) {
+	if authorizer == nil {
+		return "", true
+	}
+
+	decision, err := authorizer.Authorize(req)
+	if err != nil {
+		logger.LogWarning(logging.EventHookFailed, map[string]interface{}{
+			"listener":  cfg.Name,
+			"client_ip": req.ClientIP,
+			"error":     err.Error(),
+			"allowed":   decision.Allow,
+		})
+		metricsCollector.HookDecisions.WithLabelValues(cfg.Name, "error").Inc()
+	} else if decision.Allow {
+		metricsCollector.HookDecisions.WithLabelValues(cfg.Name, "allow").Inc()
+	} else {
+		metricsCollector.HookDecisions.WithLabelValues(cfg.Name, "deny").Inc()
+	}
+
+	if !decision.Allow {
+		fields := map[string]interface{}{
+			"listener":  cfg.Name,
+			"protocol":  req.Protocol,
+			"client_ip": req.ClientIP,
+			"reason":    decision.Reason,
+			"cached":    decision.Cached,
+		}
+		if req.SNI != "" {
+			fields["sni"] = req.SNI
+		}
+		logger.LogInfo(logging.EventDeniedHook, fields)
+		metricsCollector.ConnectionsTotal.WithLabelValues(cfg.Name, req.Protocol, "hook_denied").Inc()
+	}
+
+	return decision.Identity, decision.Allow
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/httpmode"
+	"github.com/espegro/packetpony/internal/ratelimit"
+)
+
+// rateLimitHeadersMode returns the HTTP rate limit header mode, "off" unless
+// HTTP-aware mode is enabled
+func (p *TCPProxy) rateLimitHeadersMode() string {
+	if p.config.HTTP == nil || !p.config.HTTP.Enabled || p.config.HTTP.RateLimitHeaders == "" {
+		return "off"
+	}
+	return p.config.HTTP.RateLimitHeaders
+}
+
+// quotaHeaders returns the RateLimit-* headers to add to the first response
+// for an admitted client, or nil if none should be sent
+func (p *TCPProxy) quotaHeaders(clientIP string) []string {
+	mode := p.rateLimitHeadersMode()
+	if mode == "off" {
+		return nil
+	}
+	quota, ok := p.rateLimiter.AttemptQuota(clientIP)
+	if !ok {
+		return nil
+	}
+	used := quota.Limit - quota.Remaining
+	if mode == "warn" && float64(used) < config.RateLimitWarnRatio*float64(quota.Limit) {
+		return nil
+	}
+	return rateLimitHeaders(quota)
+}
+
+// rejectHTTP answers a client over its request budget with 429 Too Many
+// Requests instead of closing the connection silently. The request head is
+// read first so the client sees the response rather than a reset.
+func (p *TCPProxy) rejectHTTP(clientConn net.Conn, clientIP string) {
+	quota, ok := p.rateLimiter.AttemptQuota(clientIP)
+	if !ok {
+		return
+	}
+
+	br := bufio.NewReader(clientConn)
+	clientConn.SetReadDeadline(time.Now().Add(httpHeadTimeout))
+	_, err := httpmode.ReadRequest(br)
+	clientConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+
+	headers := append(rateLimitHeaders(quota), "Retry-After", seconds(quota.Reset))
+	clientConn.SetWriteDeadline(time.Now().Add(httpHeadTimeout))
+	clientConn.Write(httpmode.ErrorResponse(429, "Too Many Requests", headers...))
+}
+
+// injectResponseHeaders returns a reader for the target side that adds
+// headers to the first response head. Non-HTTP data passes through unchanged.
+func injectResponseHeaders(targetConn net.Conn, headers []string) net.Conn {
+	br := bufio.NewReaderSize(targetConn, httpmode.MaxHeadSize)
+	resp := httpmode.PeekResponse(br)
+	if resp == nil {
+		return httpmode.NewConn(targetConn, br)
+	}
+
+	for i := 0; i+1 < len(headers); i += 2 {
+		resp.SetHeader(headers[i], headers[i+1])
+	}
+	return httpmode.NewConn(targetConn, io.MultiReader(bytes.NewReader(resp.Bytes()), br))
+}
+
+// rateLimitHeaders formats a quota as RateLimit-* header name, value pairs
+// (draft-ietf-httpapi-ratelimit-headers)
+func rateLimitHeaders(quota ratelimit.Quota) []string {
+	return []string{
+		"RateLimit-Limit", strconv.Itoa(quota.Limit),
+		"RateLimit-Remaining", strconv.Itoa(quota.Remaining),
+		"RateLimit-Reset", seconds(quota.Reset),
+		"RateLimit-Policy", fmt.Sprintf("%d;w=%s", quota.Limit, seconds(quota.Window)),
+	}
+}
+
+// seconds formats a duration as whole seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
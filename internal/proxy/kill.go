@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// FlowFilter selects open flows to kill. Zero fields match every flow.
+type FlowFilter struct {
+	Source   *net.IPNet    // Client address range, nil = any client
+	MinIdle  time.Duration // Minimum time since the flow last carried data
+	MinBytes int64         // Minimum bytes transferred in both directions
+}
+
+// matches reports whether a flow from clientIP that has been idle for idle
+// and transferred bytes in total is selected by the filter
+func (f FlowFilter) matches(clientIP net.IP, idle time.Duration, bytes int64) bool {
+	if f.Source != nil && !f.Source.Contains(clientIP) {
+		return false
+	}
+	return idle >= f.MinIdle && bytes >= f.MinBytes
+}
+
+// liveConns tracks the open connections of a TCP proxy so they can be
+// killed by filter
+type liveConns struct {
+	mu    sync.Mutex
+	conns map[*connStats]func()
+}
+
+// add registers kill for a connection and returns a function that
+// unregisters it
+func (l *liveConns) add(stats *connStats, kill func()) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns == nil {
+		l.conns = make(map[*connStats]func())
+	}
+	l.conns[stats] = kill
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.conns, stats)
+	}
+}
+
+// KillFlows closes every open connection matching filter and returns how
+// many matched. With dryRun, matching connections are only counted.
+func (p *TCPProxy) KillFlows(filter FlowFilter, dryRun bool) int {
+	p.live.mu.Lock()
+	var kills []func()
+	now := time.Now()
+	for stats, kill := range p.live.conns {
+		idle := now.Sub(time.Unix(0, stats.lastActive.Load()))
+		if filter.matches(stats.clientIP, idle, stats.bytesSent.Load()+stats.bytesReceived.Load()) {
+			kills = append(kills, kill)
+		}
+	}
+	p.live.mu.Unlock()
+
+	if !dryRun {
+		for _, kill := range kills {
+			kill()
+		}
+	}
+	return len(kills)
+}
+
+// KillFlows closes every session matching filter and returns how many
+// matched. With dryRun, matching sessions are only counted.
+func (p *UDPProxy) KillFlows(filter FlowFilter, dryRun bool) int {
+	matched := 0
+	now := time.Now()
+	for _, sess := range p.sessionManager.Sessions() {
+		bytesSent, bytesReceived, _, _ := sess.GetStats()
+		if !filter.matches(sess.SourceAddr.IP, now.Sub(sess.GetLastActivity()), bytesSent+bytesReceived) {
+			continue
+		}
+		matched++
+		if !dryRun {
+			p.terminateSession(sess, closeReasonKilled)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/session"
+)
+
+// errPathMTUUnsupported is returned where path MTU discovery is not available
+var errPathMTUUnsupported = errors.New("path MTU discovery is not supported on this platform")
+
+// Outcomes of oversize datagram handling, the action label of
+// packetpony_udp_oversize_total
+const (
+	oversizeFragmented = "fragmented"
+	oversizeDropped    = "dropped"
+	oversizeClamped    = "clamped"
+)
+
+// setupPathMTU prepares a new session's target socket for the oversize
+// policy and records the largest datagram that fits the path MTU. With
+// fragment the kernel may fragment (DF clear); with drop or clamp DF is set
+// so nothing is fragmented behind our back.
+func (p *UDPProxy) setupPathMTU(sess *session.Session) {
+	policy := p.config.UDP.Oversize
+	if policy == "" {
+		return
+	}
+
+	// Unsupported platforms are reported once by the config linter
+	err := setDontFragment(sess.TargetConn, policy != config.OversizeFragment)
+	if err != nil && !errors.Is(err, errPathMTUUnsupported) {
+		p.logger.LogWarning(logging.EventPathMTUFailed, map[string]interface{}{
+			"listener": p.config.Name,
+			"target":   sess.TargetAddress,
+			"error":    err.Error(),
+		})
+	}
+	p.refreshPathMTU(sess)
+}
+
+// refreshPathMTU updates the session's payload limit from the configured or
+// detected path MTU. The limit is left unchanged if detection fails.
+func (p *UDPProxy) refreshPathMTU(sess *session.Session) {
+	mtu := p.config.UDP.MTU
+	if mtu == 0 {
+		detected, err := pathMTU(sess.TargetConn)
+		if errors.Is(err, errPathMTUUnsupported) {
+			return
+		}
+		if err != nil {
+			p.logger.LogWarning(logging.EventPathMTUFailed, map[string]interface{}{
+				"listener": p.config.Name,
+				"target":   sess.TargetAddress,
+				"error":    err.Error(),
+			})
+			return
+		}
+		mtu = detected
+	}
+
+	overhead := 20 + 8 // IPv4 and UDP headers
+	if isIPv6(sess.TargetConn) {
+		overhead = 40 + 8
+	}
+	sess.MaxPayload = mtu - overhead
+}
+
+// fitDatagram applies the oversize policy to a datagram headed for the
+// target. It returns the datagram to send, or nil if it was dropped.
+func (p *UDPProxy) fitDatagram(sess *session.Session, data []byte) []byte {
+	if sess.MaxPayload <= 0 || len(data) <= sess.MaxPayload {
+		return data
+	}
+
+	switch p.config.UDP.Oversize {
+	case config.OversizeDrop:
+		p.metrics.UDPOversize.WithLabelValues(p.config.Name, oversizeDropped).Inc()
+		p.logger.LogInfo(logging.EventOversizeDropped, map[string]interface{}{
+			"listener":    p.config.Name,
+			"client_ip":   sess.SourceAddr.IP.String(),
+			"target":      sess.TargetAddress,
+			"bytes":       len(data),
+			"max_payload": sess.MaxPayload,
+		})
+		return nil
+	case config.OversizeClamp:
+		p.metrics.UDPOversize.WithLabelValues(p.config.Name, oversizeClamped).Inc()
+		return data[:sess.MaxPayload]
+	default:
+		p.metrics.UDPOversize.WithLabelValues(p.config.Name, oversizeFragmented).Inc()
+		return data
+	}
+}
+
+// writeTarget forwards a datagram to the target under the oversize policy
+// and returns 0 bytes written if the datagram was dropped. If the path MTU
+// shrank since it was last read (DF set and the kernel refuses the
+// datagram), the limit is refreshed and the policy applied again.
+func (p *UDPProxy) writeTarget(sess *session.Session, data []byte) (int, error) {
+	if p.config.UDP.Oversize == "" {
+		return sess.TargetConn.Write(data)
+	}
+
+	data = p.fitDatagram(sess, data)
+	if data == nil {
+		return 0, nil
+	}
+
+	n, err := sess.TargetConn.Write(data)
+	if errors.Is(err, syscall.EMSGSIZE) {
+		p.refreshPathMTU(sess)
+		if data = p.fitDatagram(sess, data); data == nil {
+			return 0, nil
+		}
+		n, err = sess.TargetConn.Write(data)
+	}
+	return n, err
+}
+
+// isIPv6 reports whether conn is connected to an IPv6 address
+func isIPv6(conn *net.UDPConn) bool {
+	addr, ok := conn.RemoteAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment sets (df) or clears the DF bit on datagrams sent on conn
+func setDontFragment(conn *net.UDPConn, df bool) error {
+	level, opt, value := syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT
+	if df {
+		value = syscall.IP_PMTUDISC_DO
+	}
+	if isIPv6(conn) {
+		level, opt, value = syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DONT
+		if df {
+			value = syscall.IPV6_PMTUDISC_DO
+		}
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, value)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// pathMTU returns the kernel's current path MTU for the connected socket
+func pathMTU(conn *net.UDPConn) (int, error) {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_MTU
+	if isIPv6(conn) {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_MTU
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var mtu int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		mtu, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		return 0, err
+	}
+	return mtu, sockErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package proxy
+
+import "net"
+
+// setDontFragment is not supported on this platform
+func setDontFragment(conn *net.UDPConn, df bool) error {
+	return errPathMTUUnsupported
+}
+
+// pathMTU is not supported on this platform; configure udp.mtu instead
+func pathMTU(conn *net.UDPConn) (int, error) {
+	return 0, errPathMTUUnsupported
+}
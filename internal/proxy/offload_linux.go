@@ -0,0 +1,74 @@
+//go:build linux
+
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// UDP offload socket options and control messages, which the syscall
+// package lacks
+const (
+	udpSegment = 103 // UDP_SEGMENT
+	udpGRO     = 104 // UDP_GRO
+)
+
+// offloadSupported reports whether the platform has UDP offload
+const offloadSupported = true
+
+// groOOBSize is the control message space the segment size of a
+// coalesced read takes
+var groOOBSize = syscall.CmsgSpace(4)
+
+// enableGRO asks the kernel to coalesce datagrams of a flow arriving on
+// conn into one read
+func enableGRO(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpGRO, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// groSegmentSize returns the size of the datagrams coalesced into a read,
+// or 0 if its control messages do not say
+func groSegmentSize(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.IPPROTO_UDP && msg.Header.Type == udpGRO && len(msg.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(msg.Data))
+		}
+	}
+	return 0
+}
+
+// gsoControl returns the control message having the kernel cut a write
+// into datagrams of size bytes
+func gsoControl(size int) []byte {
+	b := make([]byte, syscall.CmsgSpace(2))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = syscall.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	binary.NativeEndian.PutUint16(b[syscall.CmsgLen(0):], uint16(size))
+	return b
+}
+
+// gsoUnsupported reports whether a segmented write failed because the
+// kernel or the interface cannot segment it
+func gsoUnsupported(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EINVAL)
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// offloadSupported reports whether the platform has UDP offload
+const offloadSupported = false
+
+// groOOBSize is not used on this platform
+var groOOBSize = 0
+
+// enableGRO is not supported on this platform
+func enableGRO(conn *net.UDPConn) error {
+	return errors.New("UDP offload is only supported on Linux")
+}
+
+// groSegmentSize is not supported on this platform
+func groSegmentSize(oob []byte) int {
+	return 0
+}
+
+// gsoControl is not supported on this platform
+func gsoControl(size int) []byte {
+	return nil
+}
+
+// gsoUnsupported is always false: no segmented writes are made on this
+// platform
+func gsoUnsupported(err error) bool {
+	return false
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"slices"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/dnswire"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/session"
+	"github.com/espegro/packetpony/internal/storage"
+	"github.com/espegro/packetpony/internal/target"
+)
+
+// errRestoreRateLimited is reported for saved sessions the connection
+// limits no longer admit
+var errRestoreRateLimited = errors.New("connection limit reached")
+
+// SaveSessions writes every session to store under prefix, to be picked
+// up by RestoreSessions after a restart. Saved sessions expire from the
+// store after the session timeout, as they would have while idle.
+func (p *UDPProxy) SaveSessions(store storage.Store, prefix string) {
+	ttl := config.DefaultUDPSessionTimeout
+	if p.config.UDP != nil && p.config.UDP.SessionTimeout > 0 {
+		ttl = p.config.UDP.SessionTimeout
+	}
+
+	var saved, failed int
+	var lastErr error
+	for _, s := range p.sessionManager.Save() {
+		value, err := json.Marshal(s)
+		if err == nil {
+			err = store.Set(prefix+s.Key, value, ttl)
+		}
+		if err != nil {
+			failed++
+			lastErr = err
+			continue
+		}
+		saved++
+	}
+
+	p.metrics.SessionsPersisted.WithLabelValues(p.config.Name, "saved").Add(float64(saved))
+	p.metrics.SessionsPersisted.WithLabelValues(p.config.Name, "save_failed").Add(float64(failed))
+	fields := map[string]interface{}{
+		"listener": p.config.Name,
+		"saved":    saved,
+		"failed":   failed,
+	}
+	if lastErr != nil {
+		fields["error"] = lastErr.Error()
+	}
+	p.logger.LogInfo(logging.EventUDPSessionsSaved, fields)
+}
+
+// RestoreSessions recreates the sessions a previous run saved to store
+// under prefix and starts relaying their replies through listenerConn.
+// Each saved session is removed from the store, restored or not.
+func (p *UDPProxy) RestoreSessions(store storage.Store, prefix string, listenerConn *net.UDPConn) {
+	var keys []string
+	var values [][]byte
+	err := store.Scan(prefix, func(key string, value []byte) bool {
+		keys = append(keys, key)
+		values = append(values, value)
+		return true
+	})
+	if err == nil && len(keys) == 0 {
+		return
+	}
+
+	var restored, failed int
+	lastErr := err
+	for i, key := range keys {
+		store.Delete(key)
+		if err := p.restoreSession(values[i], listenerConn); err != nil {
+			failed++
+			lastErr = err
+			continue
+		}
+		restored++
+	}
+
+	p.metrics.SessionsPersisted.WithLabelValues(p.config.Name, "restored").Add(float64(restored))
+	p.metrics.SessionsPersisted.WithLabelValues(p.config.Name, "restore_failed").Add(float64(failed))
+	fields := map[string]interface{}{
+		"listener": p.config.Name,
+		"restored": restored,
+		"failed":   failed,
+	}
+	if lastErr != nil {
+		fields["error"] = lastErr.Error()
+	}
+	p.logger.LogInfo(logging.EventUDPSessionsRestored, fields)
+}
+
+// restoreSession recreates one saved session. Sessions of a balanced
+// target that is no longer configured are dropped, as are sessions the
+// connection limits refuse.
+func (p *UDPProxy) restoreSession(value []byte, listenerConn *net.UDPConn) error {
+	var saved session.Saved
+	if err := json.Unmarshal(value, &saved); err != nil {
+		return err
+	}
+	if saved.Backend != "" && !slices.ContainsFunc(p.targets.Targets(), func(t target.TargetStatus) bool {
+		return t.Address == saved.Backend
+	}) {
+		return target.ErrUnknownTarget
+	}
+
+	sess, err := p.sessionManager.Restore(saved)
+	if err != nil {
+		return err
+	}
+	clientIP := sess.SourceAddr.IP.String()
+	if allowed, _ := p.rateLimiter.CheckConnection(clientIP); !allowed {
+		p.sessionManager.Discard(sess.ID)
+		return errRestoreRateLimited
+	}
+
+	if p.config.ProtocolHint == config.ProtocolHintDNS {
+		sess.DNS = dnswire.NewTracker()
+	}
+	sess.Meter = p.ledger.Meter(p.config.Name, sess.Tags)
+	sess.Mirror = p.mirror.Open()
+	p.metrics.ConnectionsActive.WithLabelValues(p.config.Name, "udp").Inc()
+	p.backends.acquire(sess.Backend)
+	p.setupPathMTU(sess)
+
+	go p.startSessionReader(sess, listenerConn)
+	return nil
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/quota"
+)
+
+// watchQuota logs clients exhausting their quota, and failures to sync
+// quota usage with the store. Until syncing recovers, quotas see only
+// local usage and what was stored before.
+func watchQuota(
+	quotas *quota.Tracker,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+) {
+	quotas.OnExhausted(func(ip, period string, used, limit int64) {
+		logger.LogWarning(logging.EventQuotaExhausted, map[string]interface{}{
+			"listener":    cfg.Name,
+			"client_ip":   ip,
+			"period":      period,
+			"used_bytes":  used,
+			"limit_bytes": limit,
+			"action":      quotas.Action(),
+		})
+	})
+	quotas.OnStoreError(func(err error) {
+		logger.LogError(logging.EventQuotaStorageError, map[string]interface{}{
+			"listener": cfg.Name,
+			"error":    err.Error(),
+		})
+		metricsCollector.Errors.WithLabelValues(cfg.Name, "storage").Inc()
+	})
+}
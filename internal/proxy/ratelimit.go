@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/ratelimit"
+)
+
+// watchSharedLimits logs failures to share rate limit usage with other
+// instances. Until sharing recovers, limits see only local usage and
+// what the others had shared before.
+func watchSharedLimits(
+	rateLimiter *ratelimit.RateLimitManager,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+) {
+	rateLimiter.OnStoreError(func(err error) {
+		logger.LogError(logging.EventRateLimitStorageError, map[string]interface{}{
+			"listener": cfg.Name,
+			"error":    err.Error(),
+		})
+		metricsCollector.Errors.WithLabelValues(cfg.Name, "storage").Inc()
+	})
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/session"
+)
+
+// Reasons a reply from the target fails validation
+const (
+	replySource      = "source"      // Not sent by the dialed target address
+	replyOversize    = "oversize"    // Larger than max_reply_size
+	replyTruncated   = "truncated"   // Larger than max_reply_size, cut and delivered
+	replyUnsolicited = "unsolicited" // Beyond max_replies_per_request
+)
+
+// replyValidator checks datagrams read from a session's target before they
+// are returned to the client. A nil validator accepts every reply.
+type replyValidator struct {
+	strict     bool  // Drop replies whose source is not the dialed target
+	maxSize    int   // Largest reply, 0 = unlimited
+	truncate   bool  // Cut oversize replies to maxSize instead of dropping them
+	perRequest int64 // Replies allowed per client datagram, 0 = unlimited
+}
+
+// newReplyValidator returns nil unless the listener validates replies
+func newReplyValidator(cfg *config.UDPConfig) *replyValidator {
+	if cfg == nil || (!cfg.StrictReplies && cfg.MaxReplySize == 0 && cfg.MaxRepliesPerRequest == 0) {
+		return nil
+	}
+	return &replyValidator{
+		strict:     cfg.StrictReplies,
+		maxSize:    cfg.MaxReplySize,
+		truncate:   cfg.GetOversizeReply() == config.OversizeReplyTruncate,
+		perRequest: int64(cfg.MaxRepliesPerRequest),
+	}
+}
+
+// read reads the next reply from the target. The source of each datagram
+// is only looked up in strict mode.
+func (v *replyValidator) read(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, error) {
+	if v == nil || !v.strict {
+		n, err := conn.Read(buf)
+		return n, nil, err
+	}
+	return conn.ReadFromUDP(buf)
+}
+
+// request records a client datagram about to be forwarded, allowing the
+// target to answer it
+func (v *replyValidator) request(sess *session.Session) {
+	if v == nil || v.perRequest == 0 {
+		return
+	}
+	sess.GrantReplies(v.perRequest, v.perRequest*config.MaxPendingReplyRequests)
+}
+
+// check validates a reply of n bytes from src. It returns how many bytes
+// to return to the client, 0 if the reply is dropped, and the reason if
+// the reply failed validation.
+func (v *replyValidator) check(sess *session.Session, src *net.UDPAddr, n int) (int, string) {
+	if v == nil {
+		return n, ""
+	}
+	if v.strict {
+		target, _ := sess.TargetConn.RemoteAddr().(*net.UDPAddr)
+		if src == nil || target == nil || !src.IP.Equal(target.IP) || src.Port != target.Port {
+			return 0, replySource
+		}
+	}
+	reason := ""
+	if v.maxSize > 0 && n > v.maxSize {
+		if !v.truncate {
+			return 0, replyOversize
+		}
+		n, reason = v.maxSize, replyTruncated
+	}
+	if v.perRequest > 0 && !sess.TakeReply() {
+		return 0, replyUnsolicited
+	}
+	return n, reason
+}
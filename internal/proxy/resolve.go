@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/target"
+)
+
+// watchTargetResolution logs target DNS changes and refresh failures.
+// onRemoved, if non-nil, is called with addresses a hostname no longer
+// resolves to.
+func watchTargetResolution(
+	targets *target.Selector,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+	onRemoved func(removed []net.IP),
+) {
+	resolver := targets.Resolver()
+	resolver.OnError(func(host string, err error) {
+		logger.LogWarning(logging.EventResolveFailed, map[string]interface{}{
+			"listener": cfg.Name,
+			"host":     host,
+			"error":    err.Error(),
+		})
+		metricsCollector.Errors.WithLabelValues(cfg.Name, "resolve").Inc()
+	})
+	resolver.OnChange(func(host string, removed []net.IP) {
+		addrs := make([]string, len(removed))
+		for i, ip := range removed {
+			addrs[i] = ip.String()
+		}
+		logger.LogInfo(logging.EventTargetsRemoved, map[string]interface{}{
+			"listener": cfg.Name,
+			"host":     host,
+			"removed":  strings.Join(addrs, ","),
+		})
+		if onRemoved != nil {
+			onRemoved(removed)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"sync/atomic"
+
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+// Sampler picks 1 in N flows of a listener for connection events and the
+// duration histograms. Byte, packet and connection counters always count
+// every flow.
+type Sampler struct {
+	listener string
+	rate     atomic.Int64
+	seq      atomic.Uint64
+	metrics  *metrics.ProxyMetrics
+}
+
+// newSampler creates a sampler with the listener's configured sample rate
+func newSampler(listener string, rate int, metricsCollector *metrics.ProxyMetrics) *Sampler {
+	s := &Sampler{listener: listener, metrics: metricsCollector}
+	s.SetRate(rate)
+	return s
+}
+
+// Rate returns the current sample rate, 1 when every flow is sampled
+func (s *Sampler) Rate() int {
+	if s == nil {
+		return 1
+	}
+	return int(s.rate.Load())
+}
+
+// SetRate changes the sample rate for flows that start from now on.
+// Rates below 1 sample every flow.
+func (s *Sampler) SetRate(rate int) {
+	if rate < 1 {
+		rate = 1
+	}
+	s.rate.Store(int64(rate))
+	s.metrics.SampleRate.WithLabelValues(s.listener).Set(float64(rate))
+}
+
+// sample decides whether a new flow is sampled and returns the rate it
+// was sampled at, or 0 if it is not. The first flow is always sampled,
+// then every Nth.
+func (s *Sampler) sample() int {
+	if s == nil {
+		return 1
+	}
+	rate := s.rate.Load()
+	if rate > 1 && (s.seq.Add(1)-1)%uint64(rate) != 0 {
+		return 0
+	}
+	return int(rate)
+}
+
+// eventSampleRate is the sample rate recorded on connection events: the
+// rate of a sampled flow, or 0 (omitted) when every flow is logged
+func eventSampleRate(rate int) int {
+	if rate > 1 {
+		return rate
+	}
+	return 0
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/script"
+	"github.com/espegro/packetpony/internal/target"
+)
+
+// errScriptDenied fails the creation of a UDP session denied by the
+// script, which has been logged and counted already
+var errScriptDenied = errors.New("denied by script")
+
+// connectScript runs the script's on_connect hook for a new flow. Returns
+// the target and backend of the flow, which are the selected ones unless
+// the script routed it elsewhere, and false if the flow must be closed.
+// Denials and failures are logged and counted.
+func connectScript(
+	engine *script.Engine,
+	targets *target.Selector,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+	flow script.Flow,
+	clientIP net.IP,
+	backend string,
+) (string, string, bool) {
+	if !engine.Has(script.HookConnect) {
+		return flow.Target, backend, true
+	}
+
+	verdict, err := engine.OnConnect(flow)
+	switch {
+	case err != nil:
+		logScriptFailure(cfg, logger, metricsCollector, flow, script.HookConnect, err, verdict.Allow)
+	case !verdict.Allow:
+		metricsCollector.ScriptCalls.WithLabelValues(cfg.Name, script.HookConnect, "deny").Inc()
+	case verdict.Target != "":
+		metricsCollector.ScriptCalls.WithLabelValues(cfg.Name, script.HookConnect, "route").Inc()
+	default:
+		metricsCollector.ScriptCalls.WithLabelValues(cfg.Name, script.HookConnect, "allow").Inc()
+	}
+
+	if !verdict.Allow {
+		logger.LogInfo(logging.EventDeniedScript, map[string]interface{}{
+			"listener":  cfg.Name,
+			"protocol":  flow.Protocol,
+			"client_ip": flow.ClientIP,
+			"reason":    verdict.Reason,
+		})
+		metricsCollector.IncClientDrops(cfg.Name, flow.ClientIP, "script_denied")
+		metricsCollector.ConnectionsTotal.WithLabelValues(cfg.Name, flow.Protocol, "script_denied").Inc()
+		return "", "", false
+	}
+	if verdict.Target == "" {
+		return flow.Target, backend, true
+	}
+
+	// Routed flows are not balanced, like those matching a host route
+	addr, err := targets.Route(verdict.Target, clientIP, flow.ClientPort)
+	if err != nil {
+		logger.LogError(logging.EventTargetSelectFailed, map[string]interface{}{
+			"listener":  cfg.Name,
+			"client_ip": flow.ClientIP,
+			"target":    verdict.Target,
+			"error":     err.Error(),
+		})
+		if errors.Is(err, target.ErrForwardingLoop) {
+			metricsCollector.Errors.WithLabelValues(cfg.Name, "forwarding_loop").Inc()
+			metricsCollector.ConnectionsTotal.WithLabelValues(cfg.Name, flow.Protocol, "loop_detected").Inc()
+		} else {
+			metricsCollector.Errors.WithLabelValues(cfg.Name, "invalid_target").Inc()
+		}
+		return "", "", false
+	}
+	if logging.DebugEnabled(logger) {
+		logger.LogDebug(logging.EventScriptRouted, map[string]interface{}{
+			"listener":  cfg.Name,
+			"flow_id":   flow.FlowID,
+			"client_ip": flow.ClientIP,
+			"selected":  flow.Target,
+			"target":    addr,
+		})
+	}
+	return addr, "", true
+}
+
+// closeScript runs the script's on_close hook for a finished flow
+func closeScript(
+	engine *script.Engine,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+	flow script.Flow,
+	stats script.Stats,
+) {
+	if !engine.Has(script.HookClose) {
+		return
+	}
+	if err := engine.OnClose(flow, stats); err != nil {
+		logScriptFailure(cfg, logger, metricsCollector, flow, script.HookClose, err, true)
+		return
+	}
+	metricsCollector.ScriptCalls.WithLabelValues(cfg.Name, script.HookClose, "done").Inc()
+}
+
+// logScriptFailure logs and counts a failed hook call. allowed is whether
+// the flow or datagram went ahead regardless.
+func logScriptFailure(cfg *config.ListenerConfig, logger logging.Logger, metricsCollector *metrics.ProxyMetrics, flow script.Flow, hook string, err error, allowed bool) {
+	logger.LogWarning(logging.EventScriptFailed, map[string]interface{}{
+		"listener":  cfg.Name,
+		"hook":      hook,
+		"client_ip": flow.ClientIP,
+		"error":     err.Error(),
+		"allowed":   allowed,
+	})
+	metricsCollector.ScriptCalls.WithLabelValues(cfg.Name, hook, "error").Inc()
+}
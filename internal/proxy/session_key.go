@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// sessionKey returns the key of the session a datagram from srcAddr
+// belongs to, following the listener's session_key strategy. Datagrams too
+// short to hold a payload key, and DTLS records or QUIC packets without a
+// usable connection ID, are keyed by source IP:port. Datagrams matching packet rule index rule
+// (-1 for none) get a session of their own.
+func (p *UDPProxy) sessionKey(data []byte, srcAddr *net.UDPAddr, dscp int, rule int) string {
+	return withRule(p.baseSessionKey(data, srcAddr, dscp), rule)
+}
+
+// withRule scopes a session key to a packet rule
+func withRule(key string, rule int) string {
+	if rule < 0 {
+		return key
+	}
+	return key + "|rule" + strconv.Itoa(rule)
+}
+
+// baseSessionKey derives the session key of a datagram from the session_key
+// strategy alone
+func (p *UDPProxy) baseSessionKey(data []byte, srcAddr *net.UDPAddr, dscp int) string {
+	switch p.config.UDP.GetSessionKey() {
+	case config.SessionKeyIP:
+		return srcAddr.IP.String()
+	case config.SessionKeyIPDSCP:
+		return srcAddr.IP.String() + "/dscp" + strconv.Itoa(dscp)
+	case config.SessionKeyPayload:
+		start := p.config.UDP.SessionKeyOffset
+		end := start + p.config.UDP.SessionKeyLength
+		if len(data) >= end {
+			return "token:" + hex.EncodeToString(data[start:end])
+		}
+	case config.SessionKeyDTLSCID:
+		if cid := dtlsConnectionID(data, p.config.UDP.SessionKeyLength); cid != nil {
+			return connectionIDPrefixDTLS + hex.EncodeToString(cid)
+		}
+	case config.SessionKeyQUICCID:
+		if cid := quicConnectionID(data, p.config.UDP.SessionKeyLength); cid != nil {
+			return connectionIDPrefixQUIC + hex.EncodeToString(cid)
+		}
+	}
+	return srcAddr.String()
+}
+
+// Prefixes of session keys that are connection IDs
+const (
+	connectionIDPrefixDTLS = "dtls:"
+	connectionIDPrefixQUIC = "quic:"
+)
+
+// keyConnectionID returns the hex connection ID of a session key, or "" if
+// it is not keyed by one
+func keyConnectionID(key string) string {
+	key, _, _ = strings.Cut(key, "|")
+	if id, ok := strings.CutPrefix(key, connectionIDPrefixDTLS); ok {
+		return id
+	}
+	if id, ok := strings.CutPrefix(key, connectionIDPrefixQUIC); ok {
+		return id
+	}
+	return ""
+}
+
+// adoptSession makes a DTLS or QUIC connection ID seen for the first time a
+// key of the session its handshake opened from the same address. The client
+// then keeps the session, and its target, when it moves to another address.
+func (p *UDPProxy) adoptSession(key string, srcAddr *net.UDPAddr, rule int) {
+	addrKey := withRule(srcAddr.String(), rule)
+	switch p.config.UDP.GetSessionKey() {
+	case config.SessionKeyDTLSCID, config.SessionKeyQUICCID:
+	default:
+		return
+	}
+	if key == addrKey {
+		return
+	}
+	if _, exists := p.sessionManager.Get(key); exists {
+		return
+	}
+	if sess, exists := p.sessionManager.Get(addrKey); exists {
+		p.sessionManager.Alias(key, sess)
+		sess.SetConnectionID(keyConnectionID(key))
+	}
+}
+
+// DTLS record framing
+const (
+	dtlsContentTypeCID = 25   // tls12_cid, RFC 9146
+	dtlsCIDHeaderLen   = 11   // Content type, version, epoch and sequence number before the ID
+	dtlsUnifiedMask    = 0xe0 // Fixed bits of a DTLS 1.3 unified header, RFC 9147
+	dtlsUnifiedBits    = 0x20
+	dtlsUnifiedCIDFlag = 0x10
+)
+
+// dtlsConnectionID returns the connection ID of the DTLS record at the
+// start of data, or nil if it carries none. The ID length is negotiated in
+// the handshake and not sent in records, so it must be configured.
+func dtlsConnectionID(data []byte, length int) []byte {
+	switch {
+	case len(data) >= dtlsCIDHeaderLen+length+2 && data[0] == dtlsContentTypeCID && data[1] == 0xfe && data[2] == 0xfd:
+		// DTLS 1.2: the ID follows the sequence number
+		return data[dtlsCIDHeaderLen : dtlsCIDHeaderLen+length]
+	case len(data) > length && data[0]&dtlsUnifiedMask == dtlsUnifiedBits && data[0]&dtlsUnifiedCIDFlag != 0:
+		// DTLS 1.3: the ID follows the first byte
+		return data[1 : 1+length]
+	}
+	return nil
+}
+
+// QUIC packet framing (RFC 8999, RFC 9000, RFC 9369)
+const (
+	quicLongHeader      = 0x80
+	quicVersion1        = 0x00000001
+	quicVersion2        = 0x6b3343cf
+	quicHandshakeV1     = 2 // Long packet type of Handshake packets in QUIC v1
+	quicHandshakeV2     = 3 // and in QUIC v2
+	quicLongHeaderFixed = 6 // First byte, version and DCID length before the DCID
+)
+
+// quicConnectionID returns the connection ID the server chose for the QUIC
+// packet at the start of data, or nil if it carries none. Short header
+// packets carry it without its length, so the length must be configured.
+// Of the long header packets only Handshake packets are used: Initial and
+// 0-RTT packets may still carry the DCID the client picked before the
+// server answered, so those stay keyed by source address.
+func quicConnectionID(data []byte, length int) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	if data[0]&quicLongHeader == 0 {
+		if len(data) <= length {
+			return nil
+		}
+		return data[1 : 1+length]
+	}
+	if len(data) < quicLongHeaderFixed+length || int(data[5]) != length {
+		return nil
+	}
+	packetType := (data[0] & 0x30) >> 4
+	switch binary.BigEndian.Uint32(data[1:5]) {
+	case quicVersion1:
+		if packetType != quicHandshakeV1 {
+			return nil
+		}
+	case quicVersion2:
+		if packetType != quicHandshakeV2 {
+			return nil
+		}
+	default:
+		return nil // Version negotiation and unknown versions
+	}
+	return data[quicLongHeaderFixed : quicLongHeaderFixed+length]
+}
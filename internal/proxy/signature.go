@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/signature"
+)
+
+// reportSignatures logs and counts the signatures a client's data matched.
+// It reports false if one of them drops the flow or datagram.
+func reportSignatures(
+	matched []*signature.Rule,
+	cfg *config.ListenerConfig,
+	logger logging.Logger,
+	metricsCollector *metrics.ProxyMetrics,
+	protocol, clientIP, flowID string,
+) bool {
+	for _, rule := range matched {
+		action := config.SignatureActionLog
+		if rule.Drop {
+			action = config.SignatureActionDrop
+		}
+		fields := map[string]interface{}{
+			"listener":  cfg.Name,
+			"protocol":  protocol,
+			"client_ip": clientIP,
+			"signature": rule.Name,
+			"action":    action,
+		}
+		if flowID != "" {
+			fields["flow_id"] = flowID
+		}
+		logger.LogWarning(logging.EventSignatureMatched, fields)
+		metricsCollector.SignatureMatches.WithLabelValues(cfg.Name, protocol, rule.Name, action).Inc()
+		if rule.Drop {
+			metricsCollector.IncClientDrops(cfg.Name, clientIP, "signature")
+			return false
+		}
+	}
+	return true
+}
+
+// scanStream matches data the client sent on the connection against the
+// listener's signatures. It reports false if the connection is dropped.
+func (p *TCPProxy) scanStream(stats *connStats, clientIP string, data []byte) bool {
+	matched := stats.signatures.Scan(data)
+	if len(matched) == 0 {
+		return true
+	}
+	return reportSignatures(matched, p.config, p.logger, p.metrics, "tcp", clientIP, stats.flowID)
+}
+
+// scanDatagram matches a datagram of the client against the listener's
+// signatures. It reports false if the datagram is dropped.
+func (p *UDPProxy) scanDatagram(data []byte, clientIP string) bool {
+	matched := p.signatures.Match(data)
+	if len(matched) == 0 {
+		return true
+	}
+	return reportSignatures(matched, p.config, p.logger, p.metrics, "udp", clientIP, "")
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// SetTCPOptions applies a listener's tcp block to a client or target
+// connection: TCP_NODELAY, keepalive probing after idle of inactivity
+// (0 = 15s, negative disables keepalives) and TCP_USER_TIMEOUT. Options
+// the platform lacks are skipped; the connection works without them.
+func SetTCPOptions(conn net.Conn, cfg *config.TCPConfig, idle time.Duration) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if !cfg.GetNoDelay() {
+		tcpConn.SetNoDelay(false)
+	}
+	if cfg == nil {
+		return
+	}
+
+	if idle < 0 {
+		tcpConn.SetKeepAlive(false)
+	} else {
+		tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     idle,
+			Interval: cfg.KeepaliveInterval,
+			Count:    cfg.KeepaliveCount,
+		})
+	}
+	if cfg.UserTimeout > 0 {
+		setUserTimeout(tcpConn, cfg.UserTimeout)
+	}
+}
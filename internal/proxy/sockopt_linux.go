@@ -0,0 +1,28 @@
+//go:build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT, which the syscall package lacks
+const tcpUserTimeout = 18
+
+// setUserTimeout sets how long sent data may stay unacknowledged before
+// the kernel drops conn
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(timeout.Milliseconds()))
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// setUserTimeout is not supported on this platform
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	return errors.New("TCP_USER_TIMEOUT is only supported on Linux")
+}
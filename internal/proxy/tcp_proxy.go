@@ -2,17 +2,40 @@
 package proxy
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/espegro/packetpony/internal/accounting"
 	"github.com/espegro/packetpony/internal/acl"
+	"github.com/espegro/packetpony/internal/ban"
+	"github.com/espegro/packetpony/internal/capture"
+	"github.com/espegro/packetpony/internal/chaos"
+	"github.com/espegro/packetpony/internal/classify"
 	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/dns"
+	"github.com/espegro/packetpony/internal/greylist"
+	"github.com/espegro/packetpony/internal/hook"
+	"github.com/espegro/packetpony/internal/httpmode"
 	"github.com/espegro/packetpony/internal/logging"
 	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/mirror"
+	"github.com/espegro/packetpony/internal/proxyproto"
+	"github.com/espegro/packetpony/internal/quota"
 	"github.com/espegro/packetpony/internal/ratelimit"
+	"github.com/espegro/packetpony/internal/script"
+	"github.com/espegro/packetpony/internal/signature"
+	"github.com/espegro/packetpony/internal/sockopt"
+	"github.com/espegro/packetpony/internal/tagging"
+	"github.com/espegro/packetpony/internal/target"
+	"github.com/espegro/packetpony/internal/tracing"
+	"github.com/espegro/packetpony/internal/upstream"
 )
 
 // TCPProxy handles TCP connection proxying with rate limiting and access control.
@@ -21,14 +44,125 @@ type TCPProxy struct {
 	logger      logging.Logger
 	rateLimiter *ratelimit.RateLimitManager
 	allowlist   *acl.Allowlist
+	banList     *ban.BanList
 	metrics     *metrics.ProxyMetrics
+	tagger      *tagging.Tagger
+	targets     *target.Selector
+	backends    *backendConns
+	flows       flowClosers
+	live        liveConns
+	authorizer  *hook.Authorizer
+	ledger      *accounting.Ledger
+	quotas      *quota.Tracker
+	greylist    *greylist.List // nil unless greylisting is enabled
+	signatures  *signature.Set // nil unless the listener has signatures
+	script      *script.Engine // nil unless a script is enabled
+	dns         *dns.Resolver
+	upstream    *upstream.Dialer // nil = connect to targets directly
+	sampler     *Sampler
+	tracer      *tracing.Tracer     // nil unless tracing is enabled
+	tap         Tap                 // Packet capture started through the admin API
+	mirror      *mirror.Target      // nil unless mirror_target is set
+	chaos       *chaos.Injector     // Faults injected in chaos mode
+	sockOpts    *sockopt.Options    // nil unless the socket block is set
+	concurrency *concurrencyLimiter // nil unless max_concurrent_connections is set
+	deny        *denyResponder      // nil = denied connections are closed
+	pending     atomic.Int64        // Connections not yet forwarding
+	debug       bool                // logger emits debug messages
+
+	// released is closed when the listener drains or stops, ending the
+	// greylist delays of held connections
+	released    chan struct{}
+	releaseOnce sync.Once
+}
+
+// httpHeadTimeout bounds how long a client may take to send its first request head
+const httpHeadTimeout = 10 * time.Second
+
+// Close reasons for flows terminated by the proxy
+const (
+	closeReasonMaxDuration = "max_duration"
+	closeReasonMaxBytes    = "max_bytes"
+	closeReasonTargetGone  = "target_changed"
+	closeReasonDrained     = "target_drained"
+	closeReasonKilled      = "killed"
+	closeReasonQuota       = "quota_exhausted"
+	closeReasonSignature   = "signature"
+)
+
+// closeReasonErrors maps close reasons to the error recorded on the close event
+var closeReasonErrors = map[string]string{
+	closeReasonMaxDuration: "max connection duration exceeded",
+	closeReasonMaxBytes:    "max bytes per connection exceeded",
+	closeReasonTargetGone:  "target address removed from DNS",
+	closeReasonDrained:     "target drained from the pool",
+	closeReasonKilled:      "killed through the admin API",
+	closeReasonQuota:       "client quota exhausted",
+	closeReasonSignature:   "payload matched a signature",
 }
 
 // connStats tracks connection statistics
 type connStats struct {
+	flowID        string
+	sampleRate    int // Rate the flow was sampled at, 0 = not logged or timed
 	startTime     time.Time
-	bytesSent     int64
-	bytesReceived int64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	tags          map[string]string
+	meter         *accounting.Meter
+	closeOnce     sync.Once
+	closeReason   string
+	classifyOnce  sync.Once
+	appProtocol   string
+	clientIP      net.IP
+	span          *tracing.Span // nil unless the flow is traced
+	lastActive    atomic.Int64  // Unix nanoseconds of the last data in either direction
+	httpMethod    string        // First request in HTTP-aware mode
+	httpHost      string
+	httpPath      string
+	clientStream  *capture.Stream // Client side, for packet captures
+	targetStream  *capture.Stream // Target side, for packet captures
+	mirror        *mirror.Conn    // Copy of client data for mirror_target; nil if unset
+	fingerprint   *fingerprinter  // nil unless fingerprinting a sampled flow
+
+	// signatures matches the data the client sends, nil unless the
+	// listener has signatures
+	signatures *signature.Stream
+}
+
+// classify records the application protocol from the first payload seen
+// in either direction. Only the first call has any effect.
+func (s *connStats) classify(payload []byte) {
+	s.classifyOnce.Do(func() {
+		s.appProtocol = classify.TCP(payload)
+	})
+}
+
+// app returns the detected application protocol once the connection has
+// finished, or unknown if no data was exchanged
+func (s *connStats) app() string {
+	s.classifyOnce.Do(func() {
+		s.appProtocol = classify.Unknown
+	})
+	return s.appProtocol
+}
+
+// terminate force-closes the connection pair with the given reason.
+// Only the first call has any effect.
+func (s *connStats) terminate(reason string, conns ...net.Conn) {
+	s.closeOnce.Do(func() {
+		s.closeReason = reason
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+}
+
+// reason returns the close reason once the connection has finished,
+// waiting for any in-flight terminate call
+func (s *connStats) reason() string {
+	s.closeOnce.Do(func() {})
+	return s.closeReason
 }
 
 // NewTCPProxy creates a new TCP proxy
@@ -37,94 +171,411 @@ func NewTCPProxy(
 	logger logging.Logger,
 	rateLimiter *ratelimit.RateLimitManager,
 	allowlist *acl.Allowlist,
+	banList *ban.BanList,
+	tagger *tagging.Tagger,
+	targets *target.Selector,
+	authorizer *hook.Authorizer,
+	ledger *accounting.Ledger,
+	quotas *quota.Tracker,
+	greyList *greylist.List,
+	scriptEngine *script.Engine,
+	dnsResolver *dns.Resolver,
+	upstreamDialer *upstream.Dialer,
+	mirrorTarget *mirror.Target,
+	tracer *tracing.Tracer,
 	metricsCollector *metrics.ProxyMetrics,
 ) *TCPProxy {
-	return &TCPProxy{
+	watchAllowlist(allowlist, cfg, logger, metricsCollector)
+	watchBanExpiry(banList, cfg, logger, metricsCollector)
+	watchSharedLimits(rateLimiter, cfg, logger, metricsCollector)
+	watchQuota(quotas, cfg, logger, metricsCollector)
+	watchGreylist(greyList, cfg, logger, metricsCollector)
+	watchTargetResolution(targets, cfg, logger, metricsCollector, nil)
+	watchCircuit(targets, cfg, logger, metricsCollector)
+
+	p := &TCPProxy{
 		config:      cfg,
 		logger:      logger,
 		rateLimiter: rateLimiter,
 		allowlist:   allowlist,
+		banList:     banList,
 		metrics:     metricsCollector,
+		tagger:      tagger,
+		targets:     targets,
+		backends:    trackBackends(targets, cfg, metricsCollector),
+		authorizer:  authorizer,
+		ledger:      ledger,
+		quotas:      quotas,
+		greylist:    greyList,
+		signatures:  signature.New(cfg.Signatures),
+		script:      scriptEngine,
+		dns:         dnsResolver,
+		upstream:    upstreamDialer,
+		mirror:      mirrorTarget,
+		sampler:     newSampler(cfg.Name, cfg.GetSampleRate(), metricsCollector),
+		chaos:       chaos.NewInjector(cfg.Name, cfg.Chaos, metricsCollector),
+		sockOpts:    sockopt.FromConfig(cfg.Socket),
+		concurrency: newConcurrencyLimiter(cfg.TCP),
+		deny:        newDenyResponder(cfg.TCP),
+		tracer:      tracer,
+		debug:       logging.DebugEnabled(logger),
+		released:    make(chan struct{}),
 	}
+
+	// Connections to a drained target are cut when its grace period ends
+	watchDrainDeadline(targets, cfg, logger, p.flows.closeAll)
+
+	return p
 }
 
 // HandleConnection handles a single TCP connection
 func (p *TCPProxy) HandleConnection(clientConn net.Conn) {
+	defer p.trackGoroutine()()
 	defer clientConn.Close()
 
 	stats := &connStats{
-		startTime: time.Now(),
+		flowID:     newFlowID(),
+		startTime:  time.Now(),
+		signatures: p.signatures.Stream(),
+	}
+
+	// Shed the connection while max_pending_accepts others are still
+	// being admitted
+	if !p.enterPending() {
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "tcp", "overloaded").Inc()
+		return
 	}
+	admitted := sync.OnceFunc(p.leavePending)
+	defer admitted()
 
 	// Extract client IP
 	clientAddr := clientConn.RemoteAddr().(*net.TCPAddr)
 	clientIP := clientAddr.IP.String()
 	clientPort := clientAddr.Port
+	stats.clientIP = clientAddr.IP
 
-	// Parse target address
-	targetHost, targetPort, err := net.SplitHostPort(p.config.TargetAddress)
-	if err != nil {
-		p.logger.LogError("Invalid target address", map[string]interface{}{
-			"listener": p.config.Name,
-			"error":    err.Error(),
+	// Check ban list before the ACL; exempt clients are not held to bans
+	exempt := p.rateLimiter.IsExempt(clientIP)
+	if p.banList.IsBanned(clientIP) && !exempt {
+		p.logger.LogInfo(logging.EventDeniedBanned, map[string]interface{}{
+			"listener":  p.config.Name,
+			"client_ip": clientIP,
 		})
-		p.metrics.Errors.WithLabelValues(p.config.Name, "invalid_target").Inc()
+		p.metrics.BanDrops.WithLabelValues(p.config.Name).Inc()
+		p.metrics.IncClientDrops(p.config.Name, clientIP, "banned")
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "tcp", "banned").Inc()
+		p.denyConnection(clientConn, clientIP, denyReasonBanned, admitted)
 		return
 	}
 
-	// Check ACL
-	if !p.allowlist.IsAllowed(clientAddr.IP) {
-		p.logger.LogInfo("Connection denied by ACL", map[string]interface{}{
+	// Check ACL; in audit mode a denied client is only logged
+	allowed, schedule := p.allowlist.Check(clientAddr.IP)
+	if !allowed && p.config.Audit() {
+		auditDenial(p.config, p.logger, p.metrics, clientIP, auditReasonACL, schedule)
+	} else if !allowed {
+		fields := map[string]interface{}{
 			"listener":  p.config.Name,
 			"client_ip": clientIP,
-		})
+		}
+		if schedule != "" {
+			fields["schedule"] = schedule
+		}
+		p.logger.LogInfo(logging.EventDeniedACL, fields)
 		p.metrics.ACLDrops.WithLabelValues(p.config.Name).Inc()
+		p.metrics.IncClientDrops(p.config.Name, clientIP, "acl_denied")
 		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "tcp", "acl_denied").Inc()
+		p.denyConnection(clientConn, clientIP, denyReasonACL, admitted)
+		return
+	}
+
+	// Clients whose quota is exhausted get no new connections, unless
+	// they are throttled instead
+	if period := p.quotas.Exhausted(clientIP); period != "" && p.quotas.Action() == config.QuotaActionDrop {
+		p.logger.LogInfo(logging.EventDeniedQuota, map[string]interface{}{
+			"listener":  p.config.Name,
+			"client_ip": clientIP,
+			"period":    period,
+		})
+		p.metrics.QuotaDrops.WithLabelValues(p.config.Name, period).Inc()
+		p.metrics.IncClientDrops(p.config.Name, clientIP, "quota_exhausted")
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "tcp", "quota_exhausted").Inc()
+		return
+	}
+
+	// Hold back or refuse clients new to the greylist; exempt clients are
+	// not greylisted
+	if !exempt && !p.greylistConnection(clientConn, clientIP, admitted) {
 		return
 	}
 
-	// Check rate limits
-	if !p.rateLimiter.AllowConnection(clientIP) {
-		p.logger.LogInfo("Connection denied by rate limit", map[string]interface{}{
+	// Check rate limits. In audit mode they admit every client, and
+	// report the limit one would have hit.
+	allowed, reason := p.rateLimiter.CheckConnection(clientIP)
+	if !allowed {
+		p.logger.LogInfo(logging.EventDeniedRateLimit, map[string]interface{}{
 			"listener":  p.config.Name,
 			"client_ip": clientIP,
 		})
 		p.metrics.RateLimitDrops.WithLabelValues(p.config.Name, "connection_limit").Inc()
+		p.metrics.IncClientDrops(p.config.Name, clientIP, "connection_limit")
 		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "tcp", "rate_limited").Inc()
+		if reason == ratelimit.ReasonAttemptLimit {
+			recordViolation(p.banList, p.config, p.logger, p.metrics, clientIP, reason)
+			if p.rateLimitHeadersMode() != "off" {
+				p.rejectHTTP(clientConn, clientIP)
+				return
+			}
+		}
+		p.denyConnection(clientConn, clientIP, denyReasonRateLimited, admitted)
 		return
 	}
+	if reason != "" {
+		auditDenial(p.config, p.logger, p.metrics, clientIP, reason, "")
+	}
 	defer p.rateLimiter.ReleaseConnection(clientIP)
-	defer p.rateLimiter.ReleaseTotalConnection()
+	defer p.rateLimiter.ReleaseTotalConnection(clientIP)
+	if exempt {
+		p.metrics.ExemptFlows.WithLabelValues(p.config.Name).Inc()
+	}
 
-	// Log connection open
-	p.logger.LogConnection(logging.ConnectionEvent{
-		Timestamp:    time.Now(),
-		ListenerName: p.config.Name,
-		Protocol:     "tcp",
-		SourceIP:     clientIP,
-		SourcePort:   clientPort,
-		TargetIP:     targetHost,
-		TargetPort:   parsePort(targetPort),
-		EventType:    "open",
+	stats.tags = p.tagger.Tags(clientAddr.IP, "")
+
+	// In HTTP-aware mode, read the first request head before selecting
+	// the target, so it can be routed by its Host header
+	var request *httpmode.Request
+	var clientReader net.Conn = clientConn
+	var headRead time.Duration
+	if p.config.HTTP != nil && p.config.HTTP.Enabled {
+		headStart := time.Now()
+		br := bufio.NewReader(clientConn)
+		clientConn.SetReadDeadline(time.Now().Add(httpHeadTimeout))
+		var err error
+		request, err = httpmode.ReadRequest(br)
+		clientConn.SetReadDeadline(time.Time{})
+		headRead = time.Since(headStart)
+		if err != nil {
+			p.logger.LogInfo(logging.EventHTTPReadFailed, map[string]interface{}{
+				"listener":  p.config.Name,
+				"client_ip": clientIP,
+				"error":     err.Error(),
+			})
+			p.metrics.Errors.WithLabelValues(p.config.Name, "http_request").Inc()
+			return
+		}
+		if p.config.Classify {
+			stats.classify(request.Bytes())
+		}
+		if !p.scanStream(stats, clientIP, request.Bytes()) {
+			return
+		}
+		stats.httpMethod = request.Method
+		stats.httpHost = request.Hostname()
+		stats.httpPath, _, _ = strings.Cut(request.Path, "?")
+		p.rewriteRequest(request, stats)
+		clientReader = httpmode.NewConn(clientConn, br)
+	}
+
+	// With protocol sniffing, peek at the first client bytes to pick the
+	// target; they are replayed to it from the buffer
+	var sniffed []byte
+	var br *bufio.Reader
+	if p.targets.Sniffing() {
+		sniffStart := time.Now()
+		br = bufio.NewReaderSize(clientConn, max(config.MaxSniffBytes, p.helloBufferSize()))
+		var err error
+		sniffed, err = p.sniff(clientConn, br)
+		headRead = time.Since(sniffStart)
+		if err != nil {
+			p.logger.LogInfo(logging.EventSniffReadFailed, map[string]interface{}{
+				"listener":  p.config.Name,
+				"client_ip": clientIP,
+				"error":     err.Error(),
+			})
+			p.metrics.Errors.WithLabelValues(p.config.Name, "sniff").Inc()
+			return
+		}
+		clientReader = httpmode.NewConn(clientConn, br)
+	}
+
+	// For the pre-hook, peek at the TLS ClientHello for its server name
+	var sni string
+	if p.authorizer.WantsSNI() {
+		if br == nil {
+			br = bufio.NewReaderSize(clientConn, p.helloBufferSize())
+			clientReader = httpmode.NewConn(clientConn, br)
+		}
+		helloStart := time.Now()
+		sni = p.readServerName(clientConn, br)
+		headRead += time.Since(helloStart)
+	}
+
+	// Select and parse target address. The script may deny the flow or
+	// route it elsewhere.
+	targetAddr, backend, ok := p.selectTarget(clientAddr.IP, clientPort, request, sniffed)
+	if !ok {
+		return
+	}
+	targetAddr, backend, ok = connectScript(p.script, p.targets, p.config, p.logger, p.metrics, p.scriptFlow(stats, clientPort, targetAddr, sni), clientAddr.IP, backend)
+	if !ok {
+		return
+	}
+	targetHost, targetPort, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		p.logger.LogError(logging.EventTargetInvalid, map[string]interface{}{
+			"listener": p.config.Name,
+			"error":    err.Error(),
+		})
+		p.metrics.Errors.WithLabelValues(p.config.Name, "invalid_target").Inc()
+		return
+	}
+
+	// Consult external pre-hook, whose answer may name the client for
+	// tag rules
+	identity, ok := authorize(p.authorizer, p.config, p.logger, p.metrics, hook.Request{
+		Listener:   p.config.Name,
+		Protocol:   "tcp",
+		ClientIP:   clientIP,
+		ClientPort: clientPort,
+		Target:     targetAddr,
+		SNI:        sni,
+		Tags:       stats.tags,
 	})
+	if !ok {
+		return
+	}
+	if identity != "" {
+		stats.tags = p.tagger.Tags(clientAddr.IP, identity)
+	}
+
+	// Wait for one of the listener's max_concurrent_connections slots
+	if waited, reason := p.concurrency.acquire(p.metrics.ConcurrencyQueued.WithLabelValues(p.config.Name).Add); reason != "" {
+		p.logger.LogInfo(logging.EventDeniedConcurrency, map[string]interface{}{
+			"listener":  p.config.Name,
+			"client_ip": clientIP,
+			"reason":    reason,
+			"waited_ms": waited.Milliseconds(),
+		})
+		p.metrics.ConcurrencyDenied.WithLabelValues(p.config.Name, reason).Inc()
+		p.metrics.IncClientDrops(p.config.Name, clientIP, "concurrency_limit")
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "tcp", "concurrency_limited").Inc()
+		return
+	}
+	defer p.concurrency.release()
+
+	// Only sampled flows are logged and timed
+	stats.sampleRate = p.sampler.sample()
+	sampled := stats.sampleRate > 0
+
+	if sampled {
+		// Time spent waiting for the request head or sniffed bytes is not
+		// admission latency
+		p.metrics.ObservePhase(p.config.Name, "tcp", metrics.PhaseAdmission, time.Since(stats.startTime)-headRead)
+
+		// Log connection open
+		p.logger.LogConnection(logging.ConnectionEvent{
+			Timestamp:    time.Now(),
+			FlowID:       stats.flowID,
+			ListenerName: p.config.Name,
+			Protocol:     "tcp",
+			SourceIP:     clientIP,
+			SourcePort:   clientPort,
+			TargetIP:     targetHost,
+			TargetPort:   parsePort(targetPort),
+			EventType:    "open",
+			SampleRate:   eventSampleRate(stats.sampleRate),
+			HTTPMethod:   stats.httpMethod,
+			HTTPHost:     stats.httpHost,
+			HTTPPath:     stats.httpPath,
+			Tags:         stats.tags,
+		})
+
+		p.startTrace(stats, clientPort, targetAddr, request)
+
+		if p.config.Fingerprint {
+			stats.fingerprint = &fingerprinter{}
+		}
+	}
 
 	p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "tcp", "accepted").Inc()
+	p.metrics.IncTaggedConnections(p.config.Name, stats.tags)
+	p.metrics.IncClientConnections(p.config.Name, clientIP)
+	stats.meter = p.ledger.Meter(p.config.Name, stats.tags)
 	p.metrics.ConnectionsActive.WithLabelValues(p.config.Name, "tcp").Inc()
 	defer p.metrics.ConnectionsActive.WithLabelValues(p.config.Name, "tcp").Dec()
 
-	// Connect to target
-	targetConn, err := net.DialTimeout("tcp", p.config.TargetAddress, 10*time.Second)
+	// The script sees the end of every admitted flow, including those
+	// whose target could not be reached
+	defer func() {
+		closeScript(p.script, p.config, p.logger, p.metrics, p.scriptFlow(stats, clientPort, targetAddr, sni), script.Stats{
+			BytesSent:     stats.bytesSent.Load(),
+			BytesReceived: stats.bytesReceived.Load(),
+			Duration:      time.Since(stats.startTime),
+			CloseReason:   stats.reason(),
+		})
+	}()
+
+	// Connect to target, failing over to other targets if enabled
+	dialStart := time.Now()
+	targetConn, targetAddr, backend, err := p.dialTarget(clientAddr.IP, clientPort, targetAddr, backend)
+	dialed := time.Now()
+	if sampled {
+		p.metrics.ObservePhase(p.config.Name, "tcp", metrics.PhaseDial, dialed.Sub(dialStart))
+	}
+	var dialErr string
 	if err != nil {
-		p.logger.LogError("Failed to connect to target", map[string]interface{}{
+		dialErr = err.Error()
+	}
+	stats.span.Step(tracing.StepDial, dialStart, dialed, dialErr)
+	targetHost, targetPort, _ = net.SplitHostPort(targetAddr)
+	if err != nil {
+		p.logger.LogError(logging.EventTargetConnectFailed, map[string]interface{}{
 			"listener": p.config.Name,
-			"target":   p.config.TargetAddress,
+			"target":   targetAddr,
 			"error":    err.Error(),
 		})
 		p.metrics.Errors.WithLabelValues(p.config.Name, "target_connect").Inc()
 		p.logConnectionClose(clientIP, clientPort, targetHost, parsePort(targetPort), stats, err.Error())
+		p.endTrace(stats, false, err.Error())
 		return
 	}
 	defer targetConn.Close()
+	stats.clientStream = capture.NewStream(capture.SideClient, clientConn.RemoteAddr(), clientConn.LocalAddr())
+	stats.targetStream = capture.NewStream(capture.SideTarget, targetConn.LocalAddr(), targetConn.RemoteAddr())
+	stats.mirror = p.mirror.Open()
+	defer stats.mirror.Close()
+	if p.debug {
+		p.logger.LogDebug(logging.EventTargetConnected, map[string]interface{}{
+			"listener": p.config.Name,
+			"flow_id":  stats.flowID,
+			"target":   targetAddr,
+			"local":    targetConn.LocalAddr().String(),
+			"dial_ms":  dialed.Sub(dialStart).Milliseconds(),
+		})
+	}
+	p.backends.acquire(backend)
+	defer p.backends.release(backend)
+	defer p.flows.add(backend, func() {
+		stats.terminate(closeReasonDrained, clientConn, targetConn)
+	})()
+	stats.lastActive.Store(time.Now().UnixNano())
+	defer p.live.add(stats, func() {
+		stats.terminate(closeReasonKilled, clientConn, targetConn)
+	})()
+
+	// Send PROXY protocol header and the rewritten HTTP request head
+	if err := p.writePreamble(targetConn, clientConn, request, stats); err != nil {
+		p.targets.ReportFailure(backend)
+		p.logger.LogError(logging.EventTargetWriteFailed, map[string]interface{}{
+			"listener": p.config.Name,
+			"target":   targetAddr,
+			"error":    err.Error(),
+		})
+		p.metrics.Errors.WithLabelValues(p.config.Name, "target_write").Inc()
+		p.logConnectionClose(clientIP, clientPort, targetHost, parsePort(targetPort), stats, err.Error())
+		p.endTrace(stats, false, err.Error())
+		return
+	}
+	admitted()
 
 	// Set timeouts if configured
 	if p.config.TCP != nil {
@@ -138,29 +589,53 @@ func (p *TCPProxy) HandleConnection(clientConn net.Conn) {
 		}
 	}
 
+	// Enforce the max connection duration
+	if p.config.TCP != nil && p.config.TCP.MaxConnectionDuration > 0 {
+		timer := time.AfterFunc(p.config.TCP.MaxConnectionDuration, func() {
+			stats.terminate(closeReasonMaxDuration, clientConn, targetConn)
+		})
+		defer timer.Stop()
+	}
+
 	// Bidirectional copy
 	errChan := make(chan error, 2)
 
 	// Client to target
 	go func() {
-		written, err := p.copyWithStats(targetConn, clientConn, &stats.bytesSent, clientIP)
+		defer p.trackGoroutine()()
+		written, err := p.copyWithStats(targetConn, clientReader, stats, &stats.bytesSent, clientIP)
 		if err != nil && err != io.EOF {
 			errChan <- fmt.Errorf("client->target: %w", err)
 		} else {
 			errChan <- nil
 		}
 		p.metrics.BytesTransferred.WithLabelValues(p.config.Name, "sent").Add(float64(written))
+		p.metrics.AddTaggedBytes(p.config.Name, "sent", stats.tags, written)
+		p.metrics.AddClientBytes(p.config.Name, clientIP, "sent", written)
 	}()
 
 	// Target to client
+	responseHeaders := p.quotaHeaders(clientIP)
 	go func() {
-		written, err := p.copyWithStats(clientConn, targetConn, &stats.bytesReceived, clientIP)
+		defer p.trackGoroutine()()
+		var targetReader net.Conn = targetConn
+		if sampled {
+			targetReader = &firstByteConn{Conn: targetConn, onFirstByte: func() {
+				p.metrics.ObservePhase(p.config.Name, "tcp", metrics.PhaseFirstByte, time.Since(dialed))
+			}}
+		}
+		if responseHeaders != nil {
+			targetReader = injectResponseHeaders(targetReader, responseHeaders)
+		}
+		written, err := p.copyWithStats(clientConn, targetReader, stats, &stats.bytesReceived, clientIP)
 		if err != nil && err != io.EOF {
 			errChan <- fmt.Errorf("target->client: %w", err)
 		} else {
 			errChan <- nil
 		}
 		p.metrics.BytesTransferred.WithLabelValues(p.config.Name, "received").Add(float64(written))
+		p.metrics.AddTaggedBytes(p.config.Name, "received", stats.tags, written)
+		p.metrics.AddClientBytes(p.config.Name, clientIP, "received", written)
 	}()
 
 	// Wait for both directions to complete
@@ -173,23 +648,126 @@ func (p *TCPProxy) HandleConnection(clientConn net.Conn) {
 	} else if err2 != nil {
 		errMsg = err2.Error()
 	}
+	if reason := stats.reason(); reason != "" {
+		errMsg = closeReasonErrors[reason]
+		p.metrics.Terminated.WithLabelValues(p.config.Name, "tcp", reason).Inc()
+	}
+
+	if p.config.Classify {
+		p.metrics.ObserveClassified(p.config.Name, "tcp", stats.app(), stats.bytesSent.Load()+stats.bytesReceived.Load())
+	}
 
 	// Log connection close
 	p.logConnectionClose(clientIP, clientPort, targetHost, parsePort(targetPort), stats, errMsg)
+	p.endTrace(stats, true, errMsg)
 
 	// Record duration
-	duration := time.Since(stats.startTime)
-	p.metrics.ConnectionDuration.WithLabelValues(p.config.Name, "tcp").Observe(duration.Seconds())
+	if sampled {
+		duration := time.Since(stats.startTime)
+		p.metrics.ConnectionDuration.WithLabelValues(p.config.Name, "tcp").Observe(duration.Seconds())
+		p.metrics.ObservePhase(p.config.Name, "tcp", metrics.PhaseTotal, duration)
+		p.metrics.ObserveFlowSize(p.config.Name, "tcp", stats.bytesSent.Load(), stats.bytesReceived.Load())
+	}
+}
+
+// Close turns away connections waiting for a concurrency slot and closes
+// those in the tarpit, so stopping the listener does not wait for them
+func (p *TCPProxy) Close() {
+	p.concurrency.close()
+	p.deny.release()
+	p.releaseHeld()
+}
+
+// Drain closes the connections held in the tarpit or by the greylist, so
+// that they do not keep a draining listener waiting
+func (p *TCPProxy) Drain() {
+	p.deny.release()
+	p.releaseHeld()
+}
+
+// releaseHeld ends the greylist delays of held connections, which are
+// then closed
+func (p *TCPProxy) releaseHeld() {
+	p.releaseOnce.Do(func() {
+		close(p.released)
+	})
+}
+
+// Sampler returns the sampler picking the flows that are logged and timed
+func (p *TCPProxy) Sampler() *Sampler {
+	return p.sampler
+}
+
+// Tap returns the listener's packet capture slot
+func (p *TCPProxy) Tap() *Tap {
+	return &p.tap
+}
+
+// enterPending counts a connection as being admitted. It reports false,
+// counting nothing, when max_pending_accepts connections already are.
+func (p *TCPProxy) enterPending() bool {
+	n := p.pending.Add(1)
+	if p.config.TCP != nil && p.config.TCP.MaxPendingAccepts > 0 && n > int64(p.config.TCP.MaxPendingAccepts) {
+		p.pending.Add(-1)
+		return false
+	}
+	p.metrics.PendingAccepts.WithLabelValues(p.config.Name).Inc()
+	return true
 }
 
-// copyWithStats copies data and tracks bandwidth limits
-func (p *TCPProxy) copyWithStats(dst, src net.Conn, counter *int64, clientIP string) (int64, error) {
-	buf := make([]byte, 32*1024)
+// leavePending counts a connection as no longer being admitted
+func (p *TCPProxy) leavePending() {
+	p.pending.Add(-1)
+	p.metrics.PendingAccepts.WithLabelValues(p.config.Name).Dec()
+}
+
+// trackGoroutine counts a goroutine serving a connection until the
+// returned function is called
+func (p *TCPProxy) trackGoroutine() func() {
+	gauge := p.metrics.HandlerGoroutines.WithLabelValues(p.config.Name)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// trackBuffer counts a copy buffer of size bytes until the returned
+// function is called
+func (p *TCPProxy) trackBuffer(size int) func() {
+	gauge := p.metrics.BufferBytes.WithLabelValues(p.config.Name)
+	gauge.Add(float64(size))
+	return func() { gauge.Sub(float64(size)) }
+}
+
+// copyWithStats copies data and tracks bandwidth limits and the per-connection byte cap
+func (p *TCPProxy) copyWithStats(dst, src net.Conn, stats *connStats, counter *atomic.Int64, clientIP string) (int64, error) {
+	bufferSize := config.DefaultTCPBufferSize
+	var maxBytes int64
+	if p.config.TCP != nil {
+		bufferSize = p.config.TCP.GetBufferSize()
+		maxBytes = p.config.TCP.GetMaxBytesPerConnection()
+	}
+
+	direction, chaosDirection := "sent", chaos.Upstream
+	if counter == &stats.bytesReceived {
+		direction, chaosDirection = "received", chaos.Downstream
+	}
+
+	buf := make([]byte, bufferSize)
+	defer p.trackBuffer(len(buf))()
 	var written int64
 
 	for {
 		nr, err := src.Read(buf)
 		if nr > 0 {
+			if p.config.Classify {
+				stats.classify(buf[:nr])
+			}
+
+			// Client data matching a dropping signature is not forwarded
+			if direction == "sent" && !p.scanStream(stats, clientIP, buf[:nr]) {
+				stats.terminate(closeReasonSignature, src, dst)
+				return written, fmt.Errorf("payload matched a signature")
+			}
+
 			// Check bandwidth limit
 			allowed := p.rateLimiter.AllowBandwidth(clientIP, int64(nr))
 
@@ -197,13 +775,13 @@ func (p *TCPProxy) copyWithStats(dst, src net.Conn, counter *int64, clientIP str
 			if p.rateLimiter.IsBandwidthOverLimit(clientIP, int64(nr)) {
 				action := p.rateLimiter.GetAction()
 				if action == "log_only" {
-					p.logger.LogWarning("Bandwidth limit exceeded (log_only mode)", map[string]interface{}{
+					p.logger.LogWarning(logging.EventBandwidthLogOnly, map[string]interface{}{
 						"listener":  p.config.Name,
 						"client_ip": clientIP,
 						"bytes":     nr,
 					})
 				} else if !allowed {
-					p.logger.LogInfo("Connection dropped: bandwidth limit exceeded", map[string]interface{}{
+					p.logger.LogInfo(logging.EventBandwidthDropped, map[string]interface{}{
 						"listener":  p.config.Name,
 						"client_ip": clientIP,
 						"bytes":     nr,
@@ -214,13 +792,41 @@ func (p *TCPProxy) copyWithStats(dst, src net.Conn, counter *int64, clientIP str
 
 			if !allowed {
 				p.metrics.RateLimitDrops.WithLabelValues(p.config.Name, "bandwidth_limit").Inc()
+				p.metrics.IncClientDrops(p.config.Name, clientIP, "bandwidth_limit")
+				recordViolation(p.banList, p.config, p.logger, p.metrics, clientIP, "bandwidth_limit")
 				return written, fmt.Errorf("bandwidth limit exceeded")
 			}
 
+			// Exhausted quotas cut the connection or pace it
+			delay, admitted := p.quotas.Admit(clientIP, int64(nr))
+			if !admitted {
+				p.metrics.QuotaDrops.WithLabelValues(p.config.Name, p.quotas.Exhausted(clientIP)).Inc()
+				stats.terminate(closeReasonQuota, src, dst)
+				return written, fmt.Errorf("client quota exhausted")
+			}
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+
+			// Chaos mode holds each chunk back
+			if hold := p.chaos.Hold(chaosDirection, nr); hold > 0 {
+				time.Sleep(hold)
+			}
+
 			nw, ew := dst.Write(buf[0:nr])
+			if c := p.tap.Current(); c != nil && nw > 0 {
+				c.TCP(stats.clientStream, direction == "sent", buf[:nw])
+				c.TCP(stats.targetStream, direction == "sent", buf[:nw])
+			}
+			if direction == "sent" {
+				stats.mirror.Write(buf[:nw])
+				stats.fingerprint.observe(buf[:nw])
+			}
 			if nw > 0 {
 				written += int64(nw)
-				atomic.AddInt64(counter, int64(nw))
+				counter.Add(int64(nw))
+				stats.lastActive.Store(time.Now().UnixNano())
+				stats.meter.Add(direction, int64(nw))
 			}
 			if ew != nil {
 				return written, ew
@@ -229,6 +835,11 @@ func (p *TCPProxy) copyWithStats(dst, src net.Conn, counter *int64, clientIP str
 				return written, io.ErrShortWrite
 			}
 
+			if maxBytes > 0 && stats.bytesSent.Load()+stats.bytesReceived.Load() >= maxBytes {
+				stats.terminate(closeReasonMaxBytes, src, dst)
+				return written, fmt.Errorf("max bytes per connection exceeded")
+			}
+
 			// Update read deadline on activity
 			if p.config.TCP != nil && p.config.TCP.IdleTimeout > 0 {
 				src.SetReadDeadline(time.Now().Add(p.config.TCP.IdleTimeout))
@@ -246,12 +857,25 @@ func (p *TCPProxy) copyWithStats(dst, src net.Conn, counter *int64, clientIP str
 	return written, nil
 }
 
-// logConnectionClose logs the connection close event
+// logConnectionClose logs the connection close event of a sampled flow
 func (p *TCPProxy) logConnectionClose(clientIP string, clientPort int, targetIP string, targetPort int, stats *connStats, errMsg string) {
+	if stats.sampleRate == 0 {
+		return
+	}
 	duration := time.Since(stats.startTime)
 
+	var appProtocol string
+	if p.config.Classify {
+		appProtocol = stats.app()
+	}
+	var ja3, sshClient string
+	if f := stats.fingerprint; f != nil {
+		ja3, sshClient = f.ja3, f.ssh
+	}
+
 	p.logger.LogConnection(logging.ConnectionEvent{
 		Timestamp:     time.Now(),
+		FlowID:        stats.flowID,
 		ListenerName:  p.config.Name,
 		Protocol:      "tcp",
 		SourceIP:      clientIP,
@@ -259,13 +883,176 @@ func (p *TCPProxy) logConnectionClose(clientIP string, clientPort int, targetIP
 		TargetIP:      targetIP,
 		TargetPort:    targetPort,
 		EventType:     "close",
-		BytesSent:     atomic.LoadInt64(&stats.bytesSent),
-		BytesReceived: atomic.LoadInt64(&stats.bytesReceived),
+		BytesSent:     stats.bytesSent.Load(),
+		BytesReceived: stats.bytesReceived.Load(),
 		Duration:      duration.Milliseconds(),
+		SampleRate:    eventSampleRate(stats.sampleRate),
 		Error:         errMsg,
+		CloseReason:   stats.reason(),
+		AppProtocol:   appProtocol,
+		HTTPMethod:    stats.httpMethod,
+		HTTPHost:      stats.httpHost,
+		HTTPPath:      stats.httpPath,
+		JA3:           ja3,
+		SSHClient:     sshClient,
+		Tags:          stats.tags,
 	})
 }
 
+// sniff buffers the first client bytes in br until the sniff routes can
+// decide, the buffer is full or the sniff timeout expires, and returns
+// them. A client that sends nothing before the timeout yields no bytes and
+// no error.
+func (p *TCPProxy) sniff(clientConn net.Conn, br *bufio.Reader) ([]byte, error) {
+	clientConn.SetReadDeadline(time.Now().Add(p.config.Sniff.GetTimeout()))
+	defer clientConn.SetReadDeadline(time.Time{})
+
+	for {
+		buffered, _ := br.Peek(br.Buffered())
+		if len(buffered) >= config.MaxSniffBytes || (len(buffered) > 0 && p.targets.SniffComplete(buffered)) {
+			return buffered, nil
+		}
+		if _, err := br.Peek(len(buffered) + 1); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				buffered, _ = br.Peek(br.Buffered())
+				return buffered, nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// helloBufferSize returns the buffer needed to peek at a whole ClientHello,
+// or 0 if the pre-hook does not want the server name
+func (p *TCPProxy) helloBufferSize() int {
+	if !p.authorizer.WantsSNI() {
+		return 0
+	}
+	return classify.MaxClientHelloBytes
+}
+
+// readServerName peeks at the client's first TLS record, waiting up to the
+// pre-hook timeout, and returns the server name of its ClientHello. Clients
+// that send something else, or nothing in time, have none. The bytes stay
+// buffered for the target.
+func (p *TCPProxy) readServerName(clientConn net.Conn, br *bufio.Reader) string {
+	clientConn.SetReadDeadline(time.Now().Add(p.authorizer.Timeout()))
+	defer clientConn.SetReadDeadline(time.Time{})
+
+	for {
+		buffered, _ := br.Peek(br.Buffered())
+		if len(buffered) > 0 && !classify.HelloIncomplete(buffered) {
+			return classify.ServerName(buffered)
+		}
+		if _, err := br.Peek(len(buffered) + 1); err != nil {
+			return ""
+		}
+	}
+}
+
+// selectTarget picks the target of a flow, routing by the Host header of
+// request in HTTP-aware mode or by the sniffed first bytes. Failures are
+// logged and counted; false means the connection must be closed.
+func (p *TCPProxy) selectTarget(clientIP net.IP, clientPort int, request *httpmode.Request, sniffed []byte) (string, string, bool) {
+	var targetAddr, backend string
+	var err error
+	switch {
+	case request != nil:
+		targetAddr, backend, err = p.targets.SelectHost(request.Hostname(), clientIP, clientPort)
+	case p.targets.Sniffing():
+		targetAddr, backend, err = p.targets.SelectSniffed(sniffed, clientIP, clientPort)
+	default:
+		targetAddr, backend, err = p.targets.Select(clientIP, clientPort)
+	}
+	if errors.Is(err, target.ErrCircuitOpen) {
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "tcp", "circuit_open").Inc()
+		return "", "", false
+	}
+	if err != nil {
+		p.logger.LogError(logging.EventTargetSelectFailed, map[string]interface{}{
+			"listener":  p.config.Name,
+			"client_ip": clientIP.String(),
+			"error":     err.Error(),
+		})
+		if errors.Is(err, target.ErrForwardingLoop) {
+			p.metrics.Errors.WithLabelValues(p.config.Name, "forwarding_loop").Inc()
+			p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "tcp", "loop_detected").Inc()
+		} else {
+			p.metrics.Errors.WithLabelValues(p.config.Name, "invalid_target").Inc()
+		}
+		return "", "", false
+	}
+	return targetAddr, backend, true
+}
+
+// scriptFlow describes a flow to the script's hooks
+func (p *TCPProxy) scriptFlow(stats *connStats, clientPort int, targetAddr, sni string) script.Flow {
+	return script.Flow{
+		Listener:   p.config.Name,
+		Protocol:   "tcp",
+		FlowID:     stats.flowID,
+		ClientIP:   stats.clientIP.String(),
+		ClientPort: clientPort,
+		Target:     targetAddr,
+		SNI:        sni,
+		Tags:       stats.tags,
+	}
+}
+
+// rewriteRequest injects the flow ID and tag headers into the request head
+func (p *TCPProxy) rewriteRequest(request *httpmode.Request, stats *connStats) {
+	request.SetHeader(p.config.HTTP.GetFlowIDHeader(), stats.flowID)
+	if p.config.HTTP.TagsHeader != "" && len(stats.tags) > 0 {
+		request.SetHeader(p.config.HTTP.TagsHeader, proxyproto.FormatTags(stats.tags))
+	}
+}
+
+// writePreamble writes the PROXY protocol header (if enabled) and the
+// buffered HTTP request head (if any) to the target
+func (p *TCPProxy) writePreamble(targetConn, clientConn net.Conn, request *httpmode.Request, stats *connStats) error {
+	if p.config.TCP != nil && p.config.TCP.SendProxyProtocol != "" {
+		src := clientConn.RemoteAddr().(*net.TCPAddr)
+		dst := clientConn.LocalAddr().(*net.TCPAddr)
+		tlvs := proxyproto.FlowTLVs(stats.flowID, stats.tags)
+		if err := proxyproto.WriteHeader(targetConn, p.config.TCP.SendProxyProtocol, src, dst, tlvs); err != nil {
+			return fmt.Errorf("PROXY protocol header: %w", err)
+		}
+	}
+
+	if request != nil {
+		n, err := targetConn.Write(request.Bytes())
+		p.tap.Current().TCP(stats.targetStream, true, request.Bytes()[:n])
+		stats.mirror.Write(request.Bytes()[:n])
+		stats.bytesSent.Add(int64(n))
+		stats.meter.Add("sent", int64(n))
+		p.metrics.BytesTransferred.WithLabelValues(p.config.Name, "sent").Add(float64(n))
+		p.metrics.AddTaggedBytes(p.config.Name, "sent", stats.tags, int64(n))
+		p.metrics.AddClientBytes(p.config.Name, stats.clientIP.String(), "sent", int64(n))
+		if err != nil {
+			return fmt.Errorf("HTTP request head: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// firstByteConn calls onFirstByte when the first data is read
+type firstByteConn struct {
+	net.Conn
+	once        sync.Once
+	onFirstByte func()
+}
+
+// Read reads from the connection, reporting the first successful read
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(c.onFirstByte)
+	}
+	return n, err
+}
+
 // parsePort converts a port string to int
 func parsePort(portStr string) int {
 	_, port, err := net.SplitHostPort(":" + portStr)
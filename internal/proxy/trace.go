@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/espegro/packetpony/internal/httpmode"
+	"github.com/espegro/packetpony/internal/session"
+	"github.com/espegro/packetpony/internal/tracing"
+)
+
+// traceParentHeader carries W3C trace context in HTTP requests
+const traceParentHeader = "traceparent"
+
+// setFlowAttributes records who a flow connects, using the OpenTelemetry
+// semantic convention names
+func setFlowAttributes(span *tracing.Span, listener, protocol, clientIP string, clientPort int, targetAddr string) {
+	span.SetString("packetpony.listener", listener)
+	span.SetString("network.transport", protocol)
+	span.SetString("client.address", clientIP)
+	span.SetInt("client.port", int64(clientPort))
+	host, port, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return
+	}
+	span.SetString("server.address", host)
+	if n, err := strconv.Atoi(port); err == nil {
+		span.SetInt("server.port", int64(n))
+	}
+}
+
+// startTrace starts the span of a sampled connection once it is admitted.
+// In HTTP-aware mode the connection continues the trace of the request's
+// traceparent header, and the target receives the connection's span as
+// the new parent.
+func (p *TCPProxy) startTrace(stats *connStats, clientPort int, targetAddr string, request *httpmode.Request) {
+	if p.tracer == nil {
+		return
+	}
+
+	var parent string
+	if request != nil {
+		parent = request.Header(traceParentHeader)
+	}
+	span := p.tracer.StartFlow("tcp connection", stats.flowID, stats.startTime, parent)
+	setFlowAttributes(span, p.config.Name, "tcp", stats.clientIP.String(), clientPort, targetAddr)
+	span.NextStep(tracing.StepAdmission, time.Now(), "")
+	if request != nil {
+		request.SetHeader(traceParentHeader, span.TraceParent())
+	}
+	stats.span = span
+}
+
+// endTrace ends the span of a connection. transferred is false when the
+// connection closed before any data was forwarded.
+func (p *TCPProxy) endTrace(stats *connStats, transferred bool, errMsg string) {
+	if stats.span == nil {
+		return
+	}
+
+	now := time.Now()
+	if transferred {
+		stats.span.NextStep(tracing.StepTransfer, now, "")
+		stats.span.SetString("packetpony.close_reason", stats.reason())
+	}
+	stats.span.SetInt("packetpony.bytes_sent", stats.bytesSent.Load())
+	stats.span.SetInt("packetpony.bytes_received", stats.bytesReceived.Load())
+	stats.span.End(now, errMsg)
+}
+
+// startTrace starts the span of a sampled UDP session once it is admitted
+func (p *UDPProxy) startTrace(sess *session.Session, clientPort int) {
+	if p.tracer == nil {
+		return
+	}
+
+	span := p.tracer.StartFlow("udp session", sess.FlowID, sess.CreatedAt, "")
+	setFlowAttributes(span, p.config.Name, "udp", sess.SourceAddr.IP.String(), clientPort, sess.TargetAddress)
+	span.NextStep(tracing.StepAdmission, time.Now(), "")
+	sess.Span = span
+}
+
+// endTrace ends the span of a UDP session
+func (p *UDPProxy) endTrace(sess *session.Session, bytesSent, bytesReceived, packetsSent, packetsReceived int64, closeReason string) {
+	if sess.Span == nil {
+		return
+	}
+
+	now := time.Now()
+	sess.Span.NextStep(tracing.StepTransfer, now, "")
+	sess.Span.SetInt("packetpony.bytes_sent", bytesSent)
+	sess.Span.SetInt("packetpony.bytes_received", bytesReceived)
+	sess.Span.SetInt("packetpony.packets_sent", packetsSent)
+	sess.Span.SetInt("packetpony.packets_received", packetsReceived)
+	sess.Span.SetString("packetpony.close_reason", closeReason)
+	sess.Span.End(now, closeReasonErrors[closeReason])
+}
@@ -2,27 +2,81 @@
 package proxy
 
 import (
+	"errors"
 	"net"
+	"slices"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/espegro/packetpony/internal/accounting"
 	"github.com/espegro/packetpony/internal/acl"
+	"github.com/espegro/packetpony/internal/ban"
+	"github.com/espegro/packetpony/internal/capture"
+	"github.com/espegro/packetpony/internal/chaos"
+	"github.com/espegro/packetpony/internal/classify"
 	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/dnswire"
+	"github.com/espegro/packetpony/internal/greylist"
+	"github.com/espegro/packetpony/internal/hook"
 	"github.com/espegro/packetpony/internal/logging"
 	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/mirror"
+	"github.com/espegro/packetpony/internal/quota"
 	"github.com/espegro/packetpony/internal/ratelimit"
+	"github.com/espegro/packetpony/internal/script"
 	"github.com/espegro/packetpony/internal/session"
+	"github.com/espegro/packetpony/internal/signature"
+	"github.com/espegro/packetpony/internal/sip"
+	"github.com/espegro/packetpony/internal/tagging"
+	"github.com/espegro/packetpony/internal/target"
+	"github.com/espegro/packetpony/internal/tracing"
 )
 
+// scriptFailureLogInterval is the minimum time between logged on_packet
+// failures
+const scriptFailureLogInterval = 10 * time.Second
+
+// writeFailureLogInterval is the minimum time between logged replies that
+// failed to be sent in a batch
+const writeFailureLogInterval = 10 * time.Second
+
 // UDPProxy handles UDP packet proxying with session tracking.
-// Sessions are maintained per source IP:port, enabling bidirectional communication.
+// Sessions are keyed by source IP:port unless another session_key strategy
+// is configured, enabling bidirectional communication.
 type UDPProxy struct {
 	config         *config.ListenerConfig
 	logger         logging.Logger
 	rateLimiter    *ratelimit.RateLimitManager
 	allowlist      *acl.Allowlist
+	banList        *ban.BanList
 	sessionManager *session.SessionManager
 	metrics        *metrics.ProxyMetrics
+	tagger         *tagging.Tagger
+	targets        *target.Selector
+	backends       *backendConns
+	authorizer     *hook.Authorizer
+	ledger         *accounting.Ledger
+	quotas         *quota.Tracker
+	greylist       *greylist.List // nil unless greylisting is enabled
+	signatures     *signature.Set // nil unless the listener has signatures
+	script         *script.Engine // nil unless a script is enabled
+	sampler        *Sampler
+	tracer         *tracing.Tracer // nil unless tracing is enabled
+	tap            Tap             // Packet capture started through the admin API
+	mirror         *mirror.Target  // nil unless mirror_target is set
+	chaos          *chaos.Injector // Faults injected in chaos mode
+	replies        *replyValidator // nil unless replies from targets are validated
+	sip            *sip.Gateway    // nil unless protocol_hint is sip
+	batch          *replyBatch     // nil unless replies are sent in batches
+	scriptFailed   atomic.Int64    // Unix nanoseconds on_packet failures were last logged
+	writeFailed    atomic.Int64    // Unix nanoseconds failed batched replies were last logged
 	bufferSize     int
+	debug          bool // logger emits debug messages
+
+	// deny answers the datagrams of denied clients, nil unless
+	// udp.deny_response asks for answers
+	deny *udpDenyResponder
 }
 
 // NewUDPProxy creates a new UDP proxy
@@ -31,67 +85,306 @@ func NewUDPProxy(
 	logger logging.Logger,
 	rateLimiter *ratelimit.RateLimitManager,
 	allowlist *acl.Allowlist,
+	banList *ban.BanList,
 	sessionManager *session.SessionManager,
+	tagger *tagging.Tagger,
+	targets *target.Selector,
+	authorizer *hook.Authorizer,
+	ledger *accounting.Ledger,
+	quotas *quota.Tracker,
+	greyList *greylist.List,
+	scriptEngine *script.Engine,
+	mirrorTarget *mirror.Target,
+	tracer *tracing.Tracer,
 	metricsCollector *metrics.ProxyMetrics,
 ) *UDPProxy {
-	bufferSize := 4096
+	bufferSize := config.DefaultUDPBufferSize
 	if cfg.UDP != nil && cfg.UDP.BufferSize > 0 {
 		bufferSize = cfg.UDP.BufferSize
 	}
 
-	return &UDPProxy{
+	watchAllowlist(allowlist, cfg, logger, metricsCollector)
+	watchBanExpiry(banList, cfg, logger, metricsCollector)
+	watchSharedLimits(rateLimiter, cfg, logger, metricsCollector)
+	watchQuota(quotas, cfg, logger, metricsCollector)
+	watchGreylist(greyList, cfg, logger, metricsCollector)
+	watchCircuit(targets, cfg, logger, metricsCollector)
+
+	p := &UDPProxy{
 		config:         cfg,
 		logger:         logger,
 		rateLimiter:    rateLimiter,
 		allowlist:      allowlist,
+		banList:        banList,
 		sessionManager: sessionManager,
 		metrics:        metricsCollector,
+		tagger:         tagger,
+		targets:        targets,
+		backends:       trackBackends(targets, cfg, metricsCollector),
+		authorizer:     authorizer,
+		ledger:         ledger,
+		quotas:         quotas,
+		greylist:       greyList,
+		signatures:     signature.New(cfg.Signatures),
+		script:         scriptEngine,
+		mirror:         mirrorTarget,
+		sampler:        newSampler(cfg.Name, cfg.GetSampleRate(), metricsCollector),
+		chaos:          chaos.NewInjector(cfg.Name, cfg.Chaos, metricsCollector),
+		replies:        newReplyValidator(cfg.UDP),
+		sip:            sip.NewGateway(cfg, logger, metricsCollector),
+		tracer:         tracer,
+		deny:           newUDPDenyResponder(cfg, logger),
 		bufferSize:     bufferSize,
+		debug:          logging.DebugEnabled(logger),
 	}
+
+	// Sessions to addresses that left DNS are closed; the client's next
+	// packet opens a session to a current address
+	watchTargetResolution(targets, cfg, logger, metricsCollector, p.closeSessionsTo)
+
+	// Sessions to a drained target are closed when its grace period ends
+	watchDrainDeadline(targets, cfg, logger, p.closeSessionsFor)
+
+	return p
 }
 
-// HandlePacket handles a single UDP packet
-func (p *UDPProxy) HandlePacket(data []byte, srcAddr *net.UDPAddr, listenerConn *net.UDPConn) {
+// HandlePacket handles a single UDP packet. dscp is only read for ip_dscp
+// session keys.
+func (p *UDPProxy) HandlePacket(data []byte, srcAddr *net.UDPAddr, dscp int, listenerConn *net.UDPConn) {
+	received := time.Now()
 	clientIP := srcAddr.IP.String()
 	clientPort := srcAddr.Port
 
-	// Check ACL
-	if !p.allowlist.IsAllowed(srcAddr.IP) {
+	// Check ban list before the ACL; exempt clients are not held to bans
+	if p.banList.IsBanned(clientIP) && !p.rateLimiter.IsExempt(clientIP) {
+		p.metrics.BanDrops.WithLabelValues(p.config.Name).Inc()
+		p.metrics.IncClientDrops(p.config.Name, clientIP, "banned")
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "banned").Inc()
+		p.denyDatagram(data, srcAddr, denyReasonBanned, listenerConn)
+		return
+	}
+
+	// Check ACL. Clients allowed by a schedule that has ended keep their
+	// sessions; they are only refused new ones. In audit mode denied
+	// clients get sessions, and each new one is logged.
+	admitted, closedSchedule := p.allowlist.Check(srcAddr.IP)
+	audited := !admitted && p.config.Audit()
+	if !admitted && closedSchedule == "" && !audited {
 		p.metrics.ACLDrops.WithLabelValues(p.config.Name).Inc()
+		p.metrics.IncClientDrops(p.config.Name, clientIP, "acl_denied")
 		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "acl_denied").Inc()
+		p.denyDatagram(data, srcAddr, denyReasonACL, listenerConn)
 		return
 	}
 
-	// Get or create session
-	sess, isNew, err := p.sessionManager.GetOrCreate(srcAddr, p.config.TargetAddress)
+	// Datagrams matching a dropping signature are not forwarded
+	if !p.scanDatagram(data, clientIP) {
+		return
+	}
+
+	// Apply packet rules; each rule gets its own session so its datagrams
+	// can go to a different target
+	rule, drop := p.targets.MatchPacket(data)
+	if rule >= 0 {
+		action := config.PacketActionRoute
+		if drop {
+			action = config.PacketActionDrop
+		}
+		p.metrics.PacketRuleMatches.WithLabelValues(p.config.Name, strconv.Itoa(rule), action).Inc()
+		if drop {
+			return
+		}
+	}
+
+	// Get or create session. The script may deny a new session or route
+	// it elsewhere before its target is dialed.
+	key := p.sessionKey(data, srcAddr, dscp, rule)
+	p.adoptSession(key, srcAddr, rule)
+	var flowID string
+	var tags map[string]string
+	sess, isNew, err := p.sessionManager.GetOrCreate(key, srcAddr, func() (string, string, error) {
+		targetAddr, backend, err := p.targets.SelectPacket(rule, srcAddr.IP, clientPort)
+		if err != nil || !p.script.Has(script.HookConnect) {
+			return targetAddr, backend, err
+		}
+		flowID = newFlowID()
+		tags = p.tagger.Tags(srcAddr.IP, "")
+		flow := script.Flow{
+			Listener:   p.config.Name,
+			Protocol:   "udp",
+			FlowID:     flowID,
+			ClientIP:   clientIP,
+			ClientPort: clientPort,
+			Target:     targetAddr,
+			Tags:       tags,
+		}
+		targetAddr, backend, ok := connectScript(p.script, p.targets, p.config, p.logger, p.metrics, flow, srcAddr.IP, backend)
+		if !ok {
+			return "", "", errScriptDenied
+		}
+		return targetAddr, backend, nil
+	})
+	if errors.Is(err, errScriptDenied) {
+		return
+	}
+	if errors.Is(err, session.ErrDraining) {
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "draining").Inc()
+		return
+	}
+	if errors.Is(err, session.ErrMaxSessions) || errors.Is(err, session.ErrMaxSessionsPerIP) {
+		reason := "max_sessions"
+		if errors.Is(err, session.ErrMaxSessionsPerIP) {
+			reason = "max_sessions_per_ip"
+		}
+		p.metrics.SessionsRejected.WithLabelValues(p.config.Name, reason).Inc()
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "session_limit").Inc()
+		return
+	}
+	if errors.Is(err, target.ErrCircuitOpen) {
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "circuit_open").Inc()
+		return
+	}
+	if errors.Is(err, session.ErrTargetBackoff) {
+		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "target_backoff").Inc()
+		return
+	}
 	if err != nil {
-		p.logger.LogError("Failed to create UDP session", map[string]interface{}{
+		fields := map[string]interface{}{
 			"listener":  p.config.Name,
 			"client_ip": clientIP,
 			"error":     err.Error(),
-		})
-		p.metrics.Errors.WithLabelValues(p.config.Name, "session_create").Inc()
+		}
+		var dialErr *session.DialError
+		if errors.As(err, &dialErr) {
+			fields["target"] = dialErr.Target
+			fields["attempts"] = dialErr.Attempts
+			fields["backoff_ms"] = dialErr.Backoff.Milliseconds()
+		}
+		p.logger.LogError(logging.EventUDPSessionCreateError, fields)
+		if errors.Is(err, target.ErrForwardingLoop) {
+			p.metrics.Errors.WithLabelValues(p.config.Name, "forwarding_loop").Inc()
+			p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "loop_detected").Inc()
+		} else {
+			p.metrics.Errors.WithLabelValues(p.config.Name, "session_create").Inc()
+		}
 		return
 	}
 
-	// Check rate limits for new sessions
+	// Replies follow a client whose source address changed within its session
+	if !isNew && sess.SetPeer(srcAddr) {
+		sess.Rebinds.Add(1)
+		p.metrics.UDPSessionRebinds.WithLabelValues(p.config.Name).Inc()
+	}
+
+	// Check the schedule and rate limits for new sessions
 	if isNew {
-		if !p.rateLimiter.AllowConnection(clientIP) {
-			p.logger.LogInfo("UDP session denied by rate limit", map[string]interface{}{
+		if audited {
+			auditDenial(p.config, p.logger, p.metrics, clientIP, auditReasonACL, closedSchedule)
+		} else if closedSchedule != "" {
+			p.logger.LogInfo(logging.EventUDPDeniedSchedule, map[string]interface{}{
+				"listener":  p.config.Name,
+				"client_ip": clientIP,
+				"schedule":  closedSchedule,
+			})
+			p.metrics.ACLDrops.WithLabelValues(p.config.Name).Inc()
+			p.metrics.IncClientDrops(p.config.Name, clientIP, "acl_denied")
+			p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "acl_denied").Inc()
+			p.sessionManager.Discard(sess.ID)
+			p.denyDatagram(data, srcAddr, denyReasonACL, listenerConn)
+			return
+		}
+
+		if period := p.quotas.Exhausted(clientIP); period != "" && p.quotas.Action() == config.QuotaActionDrop {
+			p.logger.LogInfo(logging.EventDeniedQuota, map[string]interface{}{
+				"listener":  p.config.Name,
+				"client_ip": clientIP,
+				"period":    period,
+			})
+			p.metrics.QuotaDrops.WithLabelValues(p.config.Name, period).Inc()
+			p.metrics.IncClientDrops(p.config.Name, clientIP, "quota_exhausted")
+			p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "quota_exhausted").Inc()
+			p.sessionManager.Discard(sess.ID)
+			p.denyDatagram(data, srcAddr, denyReasonQuota, listenerConn)
+			return
+		}
+
+		if !p.rateLimiter.IsExempt(clientIP) && !p.greylistSession(data, srcAddr, clientIP, listenerConn) {
+			p.sessionManager.Discard(sess.ID)
+			return
+		}
+
+		allowed, reason := p.rateLimiter.CheckConnection(clientIP)
+		if !allowed {
+			p.logger.LogInfo(logging.EventUDPDeniedRateLimit, map[string]interface{}{
 				"listener":  p.config.Name,
 				"client_ip": clientIP,
 			})
 			p.metrics.RateLimitDrops.WithLabelValues(p.config.Name, "connection_limit").Inc()
+			p.metrics.IncClientDrops(p.config.Name, clientIP, "connection_limit")
 			p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "rate_limited").Inc()
-			p.sessionManager.Remove(sess.ID)
+			p.sessionManager.Discard(sess.ID)
+			if reason == ratelimit.ReasonAttemptLimit {
+				recordViolation(p.banList, p.config, p.logger, p.metrics, clientIP, reason)
+			}
+			p.denyDatagram(data, srcAddr, denyReasonRateLimited, listenerConn)
 			return
 		}
+		if reason != "" {
+			auditDenial(p.config, p.logger, p.metrics, clientIP, reason, "")
+		}
+
+		if p.rateLimiter.IsExempt(clientIP) {
+			p.metrics.ExemptFlows.WithLabelValues(p.config.Name).Inc()
+		}
+
+		// Sessions seen by the script keep the flow ID and tags it was given
+		if flowID == "" {
+			flowID = newFlowID()
+			tags = p.tagger.Tags(srcAddr.IP, "")
+		}
+		sess.FlowID = flowID
+		sess.SampleRate = p.sampler.sample()
+		sess.Tags = tags
+		if p.config.Classify {
+			sess.AppProtocol = classify.UDP(data)
+		}
+		if p.config.ProtocolHint == config.ProtocolHintDNS {
+			sess.DNS = dnswire.NewTracker()
+		}
+		if id := keyConnectionID(key); id != "" {
+			sess.SetConnectionID(id)
+		}
+
+		// Consult external pre-hook, whose answer may name the client
+		// for tag rules
+		identity, ok := authorize(p.authorizer, p.config, p.logger, p.metrics, hook.Request{
+			Listener:   p.config.Name,
+			Protocol:   "udp",
+			ClientIP:   clientIP,
+			ClientPort: clientPort,
+			Target:     sess.TargetAddress,
+			Tags:       sess.Tags,
+		})
+		if !ok {
+			p.sessionManager.Discard(sess.ID)
+			p.rateLimiter.ReleaseConnection(clientIP)
+			p.rateLimiter.ReleaseTotalConnection(clientIP)
+			return
+		}
+		if identity != "" {
+			sess.Tags = p.tagger.Tags(srcAddr.IP, identity)
+		}
+		if sess.SampleRate > 0 {
+			p.metrics.ObservePhase(p.config.Name, "udp", metrics.PhaseAdmission, time.Since(received))
+			p.startTrace(sess, clientPort)
+		}
 
 		// Log session open if enabled
-		if p.config.UDP.Logging.LogSessionStart {
-			targetHost, targetPort, _ := net.SplitHostPort(p.config.TargetAddress)
+		if p.config.UDP.Logging.LogSessionStart && sess.SampleRate > 0 {
+			targetHost, targetPort, _ := net.SplitHostPort(sess.TargetAddress)
 			p.logger.LogConnection(logging.ConnectionEvent{
 				Timestamp:    time.Now(),
+				FlowID:       sess.FlowID,
 				ListenerName: p.config.Name,
 				Protocol:     "udp",
 				SourceIP:     clientIP,
@@ -99,11 +392,19 @@ func (p *UDPProxy) HandlePacket(data []byte, srcAddr *net.UDPAddr, listenerConn
 				TargetIP:     targetHost,
 				TargetPort:   parsePort(targetPort),
 				EventType:    "open",
+				SampleRate:   eventSampleRate(sess.SampleRate),
+				Tags:         sess.Tags,
 			})
 		}
 
 		p.metrics.ConnectionsTotal.WithLabelValues(p.config.Name, "udp", "accepted").Inc()
+		p.metrics.IncTaggedConnections(p.config.Name, sess.Tags)
+		p.metrics.IncClientConnections(p.config.Name, clientIP)
+		sess.Meter = p.ledger.Meter(p.config.Name, sess.Tags)
+		sess.Mirror = p.mirror.Open()
 		p.metrics.ConnectionsActive.WithLabelValues(p.config.Name, "udp").Inc()
+		p.backends.acquire(sess.Backend)
+		p.setupPathMTU(sess)
 
 		// Start reading from target
 		go p.startSessionReader(sess, listenerConn)
@@ -116,13 +417,13 @@ func (p *UDPProxy) HandlePacket(data []byte, srcAddr *net.UDPAddr, listenerConn
 	if p.rateLimiter.IsBandwidthOverLimit(clientIP, int64(len(data))) {
 		action := p.rateLimiter.GetAction()
 		if action == "log_only" {
-			p.logger.LogWarning("Bandwidth limit exceeded (log_only mode)", map[string]interface{}{
+			p.logger.LogWarning(logging.EventBandwidthLogOnly, map[string]interface{}{
 				"listener":  p.config.Name,
 				"client_ip": clientIP,
 				"bytes":     len(data),
 			})
 		} else if !allowed {
-			p.logger.LogInfo("Packet dropped: bandwidth limit exceeded", map[string]interface{}{
+			p.logger.LogInfo(logging.EventPacketDropped, map[string]interface{}{
 				"listener":  p.config.Name,
 				"client_ip": clientIP,
 				"bytes":     len(data),
@@ -133,33 +434,185 @@ func (p *UDPProxy) HandlePacket(data []byte, srcAddr *net.UDPAddr, listenerConn
 
 	if !allowed {
 		p.metrics.RateLimitDrops.WithLabelValues(p.config.Name, "bandwidth_limit").Inc()
+		p.metrics.IncClientDrops(p.config.Name, clientIP, "bandwidth_limit")
+		recordViolation(p.banList, p.config, p.logger, p.metrics, clientIP, "bandwidth_limit")
 		return
 	}
 
-	// Forward packet to target
-	n, err := sess.TargetConn.Write(data)
+	// Exhausted quotas end the session, or drop datagrams over the
+	// throttle rate
+	if !p.quotas.AdmitPacket(clientIP, int64(len(data))) {
+		p.dropOverQuota(sess, clientIP)
+		return
+	}
+
+	// The script may drop the datagram
+	if !p.scriptPacket(sess, data, script.DirectionSent) {
+		return
+	}
+
+	// Chaos mode may lose or delay the datagram
+	delay, admitted := p.chaos.Admit(chaos.Upstream, len(data))
+	if !admitted {
+		return
+	}
+
+	// Forward packet to target. Its replies are allowed, its DNS query
+	// recorded and its SIP call's media relay opened first, so a fast
+	// target cannot answer before.
+	p.replies.request(sess)
+	p.dnsQuery(sess, data)
+	forwarded := p.sip.FromClient(data, sess.SourceAddr.IP, targetIP(sess))
+	var n int
+	if delay > 0 {
+		p.sendLater(delay, forwarded, "target_write", func(b []byte) error {
+			_, err := p.writeTarget(sess, b)
+			return err
+		})
+		n = len(forwarded)
+	} else {
+		n, err = p.writeTarget(sess, forwarded)
+	}
+	if err == nil && n == 0 {
+		return // Dropped by the oversize policy
+	}
 	if err != nil {
-		p.logger.LogError("Failed to write to target", map[string]interface{}{
+		p.logger.LogError(logging.EventTargetWriteFailed, map[string]interface{}{
 			"listener": p.config.Name,
 			"session":  sess.ID,
 			"error":    err.Error(),
 		})
 		p.metrics.Errors.WithLabelValues(p.config.Name, "target_write").Inc()
+		p.targets.ReportFailure(sess.Backend)
 		p.cleanupSession(sess)
 		return
 	}
+	if isNew {
+		p.targets.ReportSuccess(sess.Backend)
+	}
+	if c := p.tap.Current(); c != nil {
+		c.UDP(capture.SideClient, srcAddr, listenerConn.LocalAddr(), data)
+		c.UDP(capture.SideTarget, sess.TargetConn.LocalAddr(), sess.TargetConn.RemoteAddr(), forwarded)
+		c.Replay(sess.ID, data)
+	}
+	sess.Mirror.Write(forwarded)
+
+	if p.debug {
+		p.logger.LogDebug(logging.EventDatagramForwarded, map[string]interface{}{
+			"listener": p.config.Name,
+			"session":  sess.ID,
+			"flow_id":  sess.FlowID,
+			"target":   sess.TargetAddress,
+			"bytes":    n,
+		})
+	}
 
 	sess.AddBytesSent(int64(n))
+	sess.Meter.Add("sent", int64(n))
 	sess.AddPacketsSent(1)
 	p.metrics.BytesTransferred.WithLabelValues(p.config.Name, "sent").Add(float64(n))
+	p.metrics.AddTaggedBytes(p.config.Name, "sent", sess.Tags, int64(n))
+	p.metrics.AddClientBytes(p.config.Name, clientIP, "sent", int64(n))
 	p.metrics.PacketsTransferred.WithLabelValues(p.config.Name, "sent").Inc()
+
+	p.checkByteCap(sess)
+}
+
+// dropOverQuota counts a datagram dropped for an exhausted quota. With
+// action drop the session is terminated, and true returned.
+func (p *UDPProxy) dropOverQuota(sess *session.Session, clientIP string) bool {
+	p.metrics.QuotaDrops.WithLabelValues(p.config.Name, p.quotas.Exhausted(clientIP)).Inc()
+	if p.quotas.Action() != config.QuotaActionDrop {
+		return false
+	}
+	p.terminateSession(sess, closeReasonQuota)
+	return true
+}
+
+// checkByteCap terminates the session once it has transferred
+// max_bytes_per_connection in total
+func (p *UDPProxy) checkByteCap(sess *session.Session) {
+	if p.config.UDP == nil || p.config.UDP.GetMaxBytesPerConnection() <= 0 {
+		return
+	}
+	bytesSent, bytesReceived, _, _ := sess.GetStats()
+	if bytesSent+bytesReceived >= p.config.UDP.GetMaxBytesPerConnection() {
+		p.terminateSession(sess, closeReasonMaxBytes)
+	}
+}
+
+// terminateSession forcibly closes a session with the given close reason
+func (p *UDPProxy) terminateSession(sess *session.Session, reason string) {
+	if sess.SetCloseReason(reason) {
+		p.cleanupSession(sess)
+	}
+}
+
+// closeSessionsTo terminates sessions whose target is one of ips
+func (p *UDPProxy) closeSessionsTo(ips []net.IP) {
+	for _, sess := range p.sessionManager.Sessions() {
+		host, _, err := net.SplitHostPort(sess.TargetAddress)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && slices.ContainsFunc(ips, ip.Equal) {
+			p.terminateSession(sess, closeReasonTargetGone)
+		}
+	}
+}
+
+// closeSessionsFor terminates sessions balanced to backend
+func (p *UDPProxy) closeSessionsFor(backend string) {
+	for _, sess := range p.sessionManager.Sessions() {
+		if sess.Backend == backend {
+			p.terminateSession(sess, closeReasonDrained)
+		}
+	}
 }
 
 // startSessionReader reads responses from target and sends back to client
 func (p *UDPProxy) startSessionReader(sess *session.Session, listenerConn *net.UDPConn) {
+	goroutines := p.metrics.HandlerGoroutines.WithLabelValues(p.config.Name)
+	goroutines.Inc()
+	defer goroutines.Dec()
 	defer p.cleanupSession(sess)
 
-	buf := make([]byte, p.bufferSize)
+	// Enforce the max session duration
+	if p.config.UDP != nil && p.config.UDP.MaxConnectionDuration > 0 {
+		// Restored sessions keep the time they had before the restart
+		remaining := p.config.UDP.MaxConnectionDuration - time.Since(sess.GetCreatedAt())
+		timer := time.AfterFunc(remaining, func() {
+			p.terminateSession(sess, closeReasonMaxDuration)
+		})
+		defer timer.Stop()
+	}
+
+	// Read replies in batches or coalesced if the listener does, or one at
+	// a time into buf. Either way buf holds the reply being handled.
+	var buf []byte
+	var batch *BatchReader
+	bufferBytes := p.bufferSize
+	if size := p.config.UDP.GetBatchSize(); size > 1 || p.config.UDP.Offload {
+		batchSize := p.metrics.ReceiveBatchSize.WithLabelValues(p.config.Name, "target")
+		batch = NewBatchReader(sess.TargetConn, size, p.bufferSize, 0, func(n int) {
+			batchSize.Observe(float64(n))
+		})
+		if p.config.UDP.Offload {
+			// The listener logged if the kernel lacks it
+			segments := p.metrics.GROSegments.WithLabelValues(p.config.Name, "target")
+			batch.EnableGRO(func(n int) {
+				segments.Observe(float64(n))
+			})
+		}
+		bufferBytes = batch.Size()
+	} else {
+		buf = make([]byte, p.bufferSize)
+	}
+	buffered := p.metrics.BufferBytes.WithLabelValues(p.config.Name)
+	buffered.Add(float64(bufferBytes))
+	defer buffered.Sub(float64(bufferBytes))
+	firstByte := sess.SampleRate > 0
+	reported := false
 
 	for {
 		select {
@@ -173,13 +626,25 @@ func (p *UDPProxy) startSessionReader(sess *session.Session, listenerConn *net.U
 			sess.TargetConn.SetReadDeadline(time.Now().Add(p.config.UDP.SessionTimeout))
 		}
 
-		n, err := sess.TargetConn.Read(buf)
+		var n int
+		var src *net.UDPAddr
+		var err error
+		if batch != nil {
+			buf, _, src, err = batch.Read()
+			n = len(buf)
+		} else {
+			n, src, err = p.replies.read(sess.TargetConn, buf)
+		}
 		if err != nil {
+			if sess.Context().Err() != nil {
+				// Session was closed while waiting for the target
+				return
+			}
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				// Session timeout
 				return
 			}
-			p.logger.LogError("Failed to read from target", map[string]interface{}{
+			p.logger.LogError(logging.EventTargetReadFailed, map[string]interface{}{
 				"listener": p.config.Name,
 				"session":  sess.ID,
 				"error":    err.Error(),
@@ -189,6 +654,33 @@ func (p *UDPProxy) startSessionReader(sess *session.Session, listenerConn *net.U
 		}
 
 		if n > 0 {
+			var reason string
+			if n, reason = p.replies.check(sess, src, n); reason != "" {
+				p.metrics.RepliesInvalid.WithLabelValues(p.config.Name, reason).Inc()
+				// Once per session, a misbehaving target would flood the log
+				if !reported {
+					reported = true
+					fields := map[string]interface{}{
+						"listener": p.config.Name,
+						"session":  sess.ID,
+						"target":   sess.TargetAddress,
+						"reason":   reason,
+					}
+					if src != nil {
+						fields["source"] = src.String()
+					}
+					p.logger.LogWarning(logging.EventReplyInvalid, fields)
+				}
+				if n == 0 {
+					continue
+				}
+			}
+
+			if firstByte {
+				firstByte = false
+				p.metrics.ObservePhase(p.config.Name, "udp", metrics.PhaseFirstByte, time.Since(sess.CreatedAt))
+			}
+
 			// Check bandwidth limit for return traffic
 			clientIP := sess.SourceAddr.IP.String()
 			allowed := p.rateLimiter.AllowBandwidth(clientIP, int64(n))
@@ -197,13 +689,13 @@ func (p *UDPProxy) startSessionReader(sess *session.Session, listenerConn *net.U
 			if p.rateLimiter.IsBandwidthOverLimit(clientIP, int64(n)) {
 				action := p.rateLimiter.GetAction()
 				if action == "log_only" {
-					p.logger.LogWarning("Bandwidth limit exceeded on return traffic (log_only mode)", map[string]interface{}{
+					p.logger.LogWarning(logging.EventBandwidthReturnLogOnly, map[string]interface{}{
 						"listener":  p.config.Name,
 						"client_ip": clientIP,
 						"bytes":     n,
 					})
 				} else if !allowed {
-					p.logger.LogInfo("Packet dropped: bandwidth limit exceeded on return traffic", map[string]interface{}{
+					p.logger.LogInfo(logging.EventPacketReturnDropped, map[string]interface{}{
 						"listener":  p.config.Name,
 						"client_ip": clientIP,
 						"bytes":     n,
@@ -214,13 +706,44 @@ func (p *UDPProxy) startSessionReader(sess *session.Session, listenerConn *net.U
 
 			if !allowed {
 				p.metrics.RateLimitDrops.WithLabelValues(p.config.Name, "bandwidth_limit").Inc()
+				p.metrics.IncClientDrops(p.config.Name, clientIP, "bandwidth_limit")
+				recordViolation(p.banList, p.config, p.logger, p.metrics, clientIP, "bandwidth_limit")
 				return
 			}
 
+			if !p.quotas.AdmitPacket(clientIP, int64(n)) {
+				if p.dropOverQuota(sess, clientIP) {
+					return
+				}
+				continue
+			}
+
+			// The script may drop the response
+			if !p.scriptPacket(sess, buf[:n], script.DirectionReceived) {
+				continue
+			}
+
+			// Chaos mode may lose or delay the response
+			delay, admitted := p.chaos.Admit(chaos.Downstream, n)
+			if !admitted {
+				continue
+			}
+
 			// Send response back to client
-			_, err = listenerConn.WriteToUDP(buf[:n], sess.SourceAddr)
+			returned := p.sip.FromTarget(buf[:n], sess.SourceAddr.IP, targetIP(sess))
+			if delay > 0 {
+				peer := sess.Peer()
+				p.sendLater(delay, returned, "client_write", func(b []byte) error {
+					_, err := listenerConn.WriteToUDP(b, peer)
+					return err
+				})
+			} else if p.batch != nil {
+				p.batch.write(returned, sess.Peer())
+			} else {
+				_, err = listenerConn.WriteToUDP(returned, sess.Peer())
+			}
 			if err != nil {
-				p.logger.LogError("Failed to write to client", map[string]interface{}{
+				p.logger.LogError(logging.EventClientWriteFailed, map[string]interface{}{
 					"listener": p.config.Name,
 					"session":  sess.ID,
 					"error":    err.Error(),
@@ -228,18 +751,37 @@ func (p *UDPProxy) startSessionReader(sess *session.Session, listenerConn *net.U
 				p.metrics.Errors.WithLabelValues(p.config.Name, "client_write").Inc()
 				return
 			}
+			p.dnsResponse(sess, buf[:n])
+			if c := p.tap.Current(); c != nil {
+				c.UDP(capture.SideTarget, sess.TargetConn.RemoteAddr(), sess.TargetConn.LocalAddr(), buf[:n])
+				c.UDP(capture.SideClient, listenerConn.LocalAddr(), sess.Peer(), returned)
+			}
+			if p.debug {
+				p.logger.LogDebug(logging.EventDatagramReturned, map[string]interface{}{
+					"listener": p.config.Name,
+					"session":  sess.ID,
+					"flow_id":  sess.FlowID,
+					"client":   sess.Peer().String(),
+					"bytes":    n,
+				})
+			}
 
 			sess.AddBytesReceived(int64(n))
+			sess.Meter.Add("received", int64(n))
 			sess.AddPacketsReceived(1)
 			sess.UpdateActivity()
 			p.metrics.BytesTransferred.WithLabelValues(p.config.Name, "received").Add(float64(n))
+			p.metrics.AddTaggedBytes(p.config.Name, "received", sess.Tags, int64(n))
+			p.metrics.AddClientBytes(p.config.Name, clientIP, "received", int64(n))
 			p.metrics.PacketsTransferred.WithLabelValues(p.config.Name, "received").Inc()
 
 			// Check if we should log periodic update
-			if sess.ShouldLogPeriodic(p.config.UDP.Logging.PeriodicLogInterval, p.config.UDP.Logging.GetPeriodicLogBytes()) {
+			if sess.SampleRate > 0 && sess.ShouldLogPeriodic(p.config.UDP.Logging.PeriodicLogInterval, p.config.UDP.Logging.GetPeriodicLogBytes()) {
 				p.logSessionUpdate(sess)
 				sess.UpdatePeriodicLog()
 			}
+
+			p.checkByteCap(sess)
 		}
 	}
 }
@@ -254,20 +796,24 @@ func (p *UDPProxy) cleanupSession(sess *session.Session) {
 
 	// Close connection
 	sess.TargetConn.Close()
+	sess.Mirror.Close()
 
 	// Release rate limits
-	p.rateLimiter.ReleaseConnection(sess.SourceAddr.IP.String())
-	p.rateLimiter.ReleaseTotalConnection()
+	sourceIP := sess.SourceAddr.IP.String()
+	p.rateLimiter.ReleaseConnection(sourceIP)
+	p.rateLimiter.ReleaseTotalConnection(sourceIP)
 
 	// Get final stats
 	bytesSent, bytesReceived, packetsSent, packetsReceived := sess.GetStats()
 	totalBytes := bytesSent + bytesReceived
 	createdAt := sess.GetCreatedAt()
 	duration := time.Since(createdAt)
+	closeReason := sess.GetCloseReason()
 
-	// Check if we should log this session close based on thresholds
-	shouldLog := p.config.UDP.Logging.LogSessionClose
-	if shouldLog {
+	// Check if we should log this session close based on thresholds.
+	// Forced closes bypass the thresholds, not sampling.
+	shouldLog := p.config.UDP.Logging.LogSessionClose && sess.SampleRate > 0
+	if shouldLog && closeReason == "" {
 		minBytes := p.config.UDP.Logging.GetMinLogBytes()
 		minDuration := p.config.UDP.Logging.MinLogDuration
 
@@ -282,9 +828,10 @@ func (p *UDPProxy) cleanupSession(sess *session.Session) {
 
 	// Log session close if enabled and meets thresholds
 	if shouldLog {
-		targetHost, targetPort, _ := net.SplitHostPort(p.config.TargetAddress)
+		targetHost, targetPort, _ := net.SplitHostPort(sess.TargetAddress)
 		p.logger.LogConnection(logging.ConnectionEvent{
 			Timestamp:       time.Now(),
+			FlowID:          sess.FlowID,
 			ListenerName:    p.config.Name,
 			Protocol:        "udp",
 			SourceIP:        sess.SourceAddr.IP.String(),
@@ -297,11 +844,135 @@ func (p *UDPProxy) cleanupSession(sess *session.Session) {
 			PacketsSent:     packetsSent,
 			PacketsReceived: packetsReceived,
 			Duration:        duration.Milliseconds(),
+			SampleRate:      eventSampleRate(sess.SampleRate),
+			Error:           closeReasonErrors[closeReason],
+			CloseReason:     closeReason,
+			AppProtocol:     sess.AppProtocol,
+			ConnectionID:    sess.ConnectionID(),
+			Rebinds:         sess.Rebinds.Load(),
+			Tags:            sess.Tags,
 		})
 	}
 
+	if p.config.Classify {
+		p.metrics.ObserveClassified(p.config.Name, "udp", sess.AppProtocol, totalBytes)
+	}
+	if closeReason != "" {
+		p.metrics.Terminated.WithLabelValues(p.config.Name, "udp", closeReason).Inc()
+	}
 	p.metrics.ConnectionsActive.WithLabelValues(p.config.Name, "udp").Dec()
-	p.metrics.ConnectionDuration.WithLabelValues(p.config.Name, "udp").Observe(duration.Seconds())
+	p.backends.release(sess.Backend)
+	if sess.SampleRate > 0 {
+		p.metrics.ConnectionDuration.WithLabelValues(p.config.Name, "udp").Observe(duration.Seconds())
+		p.metrics.ObservePhase(p.config.Name, "udp", metrics.PhaseTotal, duration)
+		p.metrics.ObserveFlowSize(p.config.Name, "udp", bytesSent, bytesReceived)
+		p.metrics.SessionPackets.WithLabelValues(p.config.Name, "sent").Observe(float64(packetsSent))
+		p.metrics.SessionPackets.WithLabelValues(p.config.Name, "received").Observe(float64(packetsReceived))
+	}
+	p.endTrace(sess, bytesSent, bytesReceived, packetsSent, packetsReceived, closeReason)
+	closeScript(p.script, p.config, p.logger, p.metrics, p.scriptFlow(sess), script.Stats{
+		BytesSent:       bytesSent,
+		BytesReceived:   bytesReceived,
+		PacketsSent:     packetsSent,
+		PacketsReceived: packetsReceived,
+		Duration:        duration,
+		CloseReason:     closeReason,
+	})
+}
+
+// scriptPacket runs the script's on_packet hook for a datagram of sess and
+// reports whether it may pass. Failures are logged once per interval, as
+// a broken hook fails for every datagram.
+func (p *UDPProxy) scriptPacket(sess *session.Session, payload []byte, direction string) bool {
+	if !p.script.Has(script.HookPacket) {
+		return true
+	}
+	pass, err := p.script.OnPacket(p.scriptFlow(sess), payload, direction)
+	switch {
+	case err != nil:
+		p.metrics.ScriptCalls.WithLabelValues(p.config.Name, script.HookPacket, "error").Inc()
+		now := time.Now().UnixNano()
+		last := p.scriptFailed.Load()
+		if now-last >= int64(scriptFailureLogInterval) && p.scriptFailed.CompareAndSwap(last, now) {
+			p.logger.LogWarning(logging.EventScriptFailed, map[string]interface{}{
+				"listener":  p.config.Name,
+				"hook":      script.HookPacket,
+				"client_ip": sess.SourceAddr.IP.String(),
+				"error":     err.Error(),
+				"allowed":   pass,
+			})
+		}
+	case pass:
+		p.metrics.ScriptCalls.WithLabelValues(p.config.Name, script.HookPacket, "allow").Inc()
+	default:
+		p.metrics.ScriptCalls.WithLabelValues(p.config.Name, script.HookPacket, "drop").Inc()
+	}
+	return pass
+}
+
+// scriptFlow describes a session to the script's hooks
+func (p *UDPProxy) scriptFlow(sess *session.Session) script.Flow {
+	return script.Flow{
+		Listener:   p.config.Name,
+		Protocol:   "udp",
+		FlowID:     sess.FlowID,
+		ClientIP:   sess.SourceAddr.IP.String(),
+		ClientPort: sess.SourceAddr.Port,
+		Target:     sess.TargetAddress,
+		Tags:       sess.Tags,
+	}
+}
+
+// Close releases what the proxy holds beyond its sessions: the media
+// relays of SIP calls and the reply batch writer
+func (p *UDPProxy) Close() {
+	p.sip.Close()
+	p.batch.close()
+	p.deny.close()
+}
+
+// BatchReplies sends the replies of sessions started from now on through
+// conn in batches of up to size, from a single writer. With gso, replies
+// to the same client are segmented by the kernel.
+func (p *UDPProxy) BatchReplies(conn *net.UDPConn, size int, gso bool) {
+	batchSize := p.metrics.SendBatchSize.WithLabelValues(p.config.Name)
+	segments := p.metrics.GSOSegments.WithLabelValues(p.config.Name)
+	p.batch = newReplyBatch(conn, size, gso, func(n int) {
+		batchSize.Observe(float64(n))
+	}, func(n int) {
+		segments.Observe(float64(n))
+	}, p.batchWriteFailed, func(err error) {
+		p.logger.LogWarning(logging.EventUDPSegmentationFailed, map[string]interface{}{
+			"listener": p.config.Name,
+			"error":    err.Error(),
+		})
+	})
+}
+
+// batchWriteFailed counts a reply the batch writer could not send. The
+// session stays open, unlike when its reader fails to write; failures are
+// logged once per interval.
+func (p *UDPProxy) batchWriteFailed(client *net.UDPAddr, err error) {
+	p.metrics.Errors.WithLabelValues(p.config.Name, "client_write").Inc()
+	now := time.Now().UnixNano()
+	last := p.writeFailed.Load()
+	if now-last >= int64(writeFailureLogInterval) && p.writeFailed.CompareAndSwap(last, now) {
+		p.logger.LogError(logging.EventClientWriteFailed, map[string]interface{}{
+			"listener": p.config.Name,
+			"client":   client.String(),
+			"error":    err.Error(),
+		})
+	}
+}
+
+// Sampler returns the sampler picking the sessions that are logged and timed
+func (p *UDPProxy) Sampler() *Sampler {
+	return p.sampler
+}
+
+// Tap returns the listener's packet capture slot
+func (p *UDPProxy) Tap() *Tap {
+	return &p.tap
 }
 
 // logSessionUpdate logs a periodic update for an active UDP session
@@ -310,10 +981,11 @@ func (p *UDPProxy) logSessionUpdate(sess *session.Session) {
 	createdAt := sess.GetCreatedAt()
 	duration := time.Since(createdAt)
 
-	targetHost, targetPort, _ := net.SplitHostPort(p.config.TargetAddress)
+	targetHost, targetPort, _ := net.SplitHostPort(sess.TargetAddress)
 
 	p.logger.LogConnection(logging.ConnectionEvent{
 		Timestamp:       time.Now(),
+		FlowID:          sess.FlowID,
 		ListenerName:    p.config.Name,
 		Protocol:        "udp",
 		SourceIP:        sess.SourceAddr.IP.String(),
@@ -326,5 +998,19 @@ func (p *UDPProxy) logSessionUpdate(sess *session.Session) {
 		PacketsSent:     packetsSent,
 		PacketsReceived: packetsReceived,
 		Duration:        duration.Milliseconds(),
+		SampleRate:      eventSampleRate(sess.SampleRate),
+		AppProtocol:     sess.AppProtocol,
+		ConnectionID:    sess.ConnectionID(),
+		Rebinds:         sess.Rebinds.Load(),
+		Tags:            sess.Tags,
 	})
 }
+
+// targetIP returns the address of a session's target
+func targetIP(sess *session.Session) net.IP {
+	addr, ok := sess.TargetConn.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	return addr.IP
+}
@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Codes of the ICMP and ICMPv6 port unreachable messages
+const (
+	icmpCodePortUnreachable   = 3
+	icmpv6CodePortUnreachable = 4
+)
+
+// unreachableQuote is how much of a denied datagram's payload an ICMP
+// message quotes after its headers
+const unreachableQuote = 64
+
+// Results of answering a denied datagram
+const (
+	denyResultSent        = "sent"
+	denyResultRateLimited = "rate_limited"
+	denyResultFailed      = "failed"
+)
+
+var errNoICMPSocket = errors.New("no ICMP socket for the address family")
+
+// udpDenyResponder answers the datagrams of denied UDP clients as
+// udp.deny_response says, at most limit per second
+type udpDenyResponder struct {
+	action  string
+	payload string
+	limit   int
+	icmp4   *icmp.PacketConn // nil unless answering with ICMP over IPv4
+	icmp6   *icmp.PacketConn // nil unless answering with ICMPv6
+
+	mu     sync.Mutex
+	second int64 // Unix time of the second answers are counted for
+	sent   int
+}
+
+// newUDPDenyResponder returns the responder of a listener, or nil if
+// denied datagrams are dropped without an answer. ICMP answers need raw
+// sockets; without them the answers fail.
+func newUDPDenyResponder(cfg *config.ListenerConfig, logger logging.Logger) *udpDenyResponder {
+	if cfg.UDP == nil || cfg.UDP.DenyResponse.GetAction() == config.UDPDenyActionDrop {
+		return nil
+	}
+	d := cfg.UDP.DenyResponse
+	r := &udpDenyResponder{
+		action:  d.Action,
+		payload: d.Payload,
+		limit:   d.GetMaxPerSecond(),
+	}
+	if r.action == config.UDPDenyActionICMP {
+		var err error
+		r.icmp4, err = listenICMP("ip4:icmp", "0.0.0.0")
+		r.icmp6, _ = listenICMP("ip6:ipv6-icmp", "::")
+		if r.icmp4 == nil && r.icmp6 == nil {
+			logger.LogError(logging.EventICMPSocketFailed, map[string]interface{}{
+				"listener": cfg.Name,
+				"error":    err.Error(),
+			})
+		}
+	}
+	return r
+}
+
+// listenICMP opens a raw ICMP socket for sending. Incoming messages are
+// filtered out where the platform allows, so they do not fill its buffer.
+func listenICMP(network, address string) (*icmp.PacketConn, error) {
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if p := conn.IPv4PacketConn(); p != nil {
+		var filter ipv4.ICMPFilter
+		filter.SetAll(true)
+		p.SetICMPFilter(&filter)
+	}
+	if p := conn.IPv6PacketConn(); p != nil {
+		var filter ipv6.ICMPFilter
+		filter.SetAll(true)
+		p.SetICMPFilter(&filter)
+	}
+	return conn, nil
+}
+
+// allow reports whether another answer fits in this second's budget
+func (d *udpDenyResponder) allow() bool {
+	now := time.Now().Unix()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now != d.second {
+		d.second, d.sent = now, 0
+	}
+	if d.sent >= d.limit {
+		return false
+	}
+	d.sent++
+	return true
+}
+
+// close closes the ICMP sockets
+func (d *udpDenyResponder) close() {
+	if d == nil {
+		return
+	}
+	if d.icmp4 != nil {
+		d.icmp4.Close()
+	}
+	if d.icmp6 != nil {
+		d.icmp6.Close()
+	}
+}
+
+// denyDatagram answers a datagram of a denied client, which arrived on
+// the listener socket conn
+func (p *UDPProxy) denyDatagram(data []byte, srcAddr *net.UDPAddr, reason string, conn *net.UDPConn) {
+	d := p.deny
+	if d == nil {
+		return
+	}
+	result := denyResultSent
+	if !d.allow() {
+		result = denyResultRateLimited
+	} else if err := d.answer(data, srcAddr, reason, conn); err != nil {
+		result = denyResultFailed
+	}
+	p.metrics.UDPDenyResponses.WithLabelValues(p.config.Name, result).Inc()
+}
+
+// answer sends the answer to a denied datagram
+func (d *udpDenyResponder) answer(data []byte, client *net.UDPAddr, reason string, conn *net.UDPConn) error {
+	if d.action == config.UDPDenyActionPayload {
+		payload := strings.NewReplacer("{client_ip}", client.IP.String(), "{reason}", reason).Replace(d.payload)
+		_, err := conn.WriteToUDP([]byte(payload), client)
+		return err
+	}
+
+	// The message quotes the datagram as the client sent it, to the
+	// address it was sent to, so that the client's stack finds its socket
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	if local == nil {
+		return errNoICMPSocket
+	}
+	dst := local.IP
+	if dst == nil || dst.IsUnspecified() {
+		var err error
+		if dst, err = routeSource(client.IP); err != nil {
+			return err
+		}
+	}
+	quoted := data[:min(len(data), unreachableQuote)]
+	udp := udpHeader(client.Port, local.Port, len(data), quoted)
+
+	if src := client.IP.To4(); src != nil {
+		if d.icmp4 == nil {
+			return errNoICMPSocket
+		}
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeDestinationUnreachable,
+			Code: icmpCodePortUnreachable,
+			Body: &icmp.DstUnreach{Data: append(ipv4Header(src, dst.To4(), len(data)), udp...)},
+		}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			return err
+		}
+		_, err = d.icmp4.WriteTo(b, &net.IPAddr{IP: src})
+		return err
+	}
+
+	if d.icmp6 == nil {
+		return errNoICMPSocket
+	}
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeDestinationUnreachable,
+		Code: icmpv6CodePortUnreachable,
+		Body: &icmp.DstUnreach{Data: append(ipv6Header(client.IP, dst.To16(), len(data)), udp...)},
+	}
+	// The kernel computes the checksum of ICMPv6 messages
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	_, err = d.icmp6.WriteTo(b, &net.IPAddr{IP: client.IP, Zone: client.Zone})
+	return err
+}
+
+// routeSource returns the local address packets to ip are sent from
+func routeSource(ip net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// udpHeader returns the header of a datagram of size payload bytes,
+// without a checksum, followed by the quoted part of the payload
+func udpHeader(srcPort, dstPort, size int, quoted []byte) []byte {
+	b := make([]byte, 8, 8+len(quoted))
+	binary.BigEndian.PutUint16(b[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(b[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(b[4:], uint16(8+size))
+	return append(b, quoted...)
+}
+
+// ipv4Header returns the header of an IPv4 packet carrying a datagram of
+// size payload bytes
+func ipv4Header(src, dst net.IP, size int) []byte {
+	b := make([]byte, ipv4.HeaderLen)
+	b[0] = 4<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(b[2:], uint16(ipv4.HeaderLen+8+size))
+	b[8] = 64 // TTL
+	b[9] = 17 // UDP
+	copy(b[12:16], src)
+	copy(b[16:20], dst)
+
+	var sum uint32
+	for i := 0; i < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(b[10:], ^uint16(sum))
+	return b
+}
+
+// ipv6Header returns the header of an IPv6 packet carrying a datagram of
+// size payload bytes
+func ipv6Header(src, dst net.IP, size int) []byte {
+	b := make([]byte, ipv6.HeaderLen)
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:], uint16(8+size))
+	b[6] = 17 // UDP
+	b[7] = 64 // Hop limit
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst)
+	return b
+}
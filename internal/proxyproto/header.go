@@ -0,0 +1,127 @@
+// Package proxyproto writes HAProxy PROXY protocol headers to backends.
+// Version 1 is the human-readable text form; version 2 is the binary form,
+// which can also carry TLVs such as the packetpony flow ID and flow tags.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Custom TLV types (PP2_TYPE_MIN_CUSTOM range) used by packetpony
+const (
+	TLVFlowID byte = 0xE0 // Flow ID as ASCII
+	TLVTags   byte = 0xE1 // Flow tags as sorted "key=value" pairs joined by ","
+)
+
+// v2Signature is the fixed 12-byte PROXY protocol v2 signature
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// TLV is a type-length-value extension for PROXY protocol v2
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// FlowTLVs builds the packetpony TLVs for a flow ID and tag set
+func FlowTLVs(flowID string, tags map[string]string) []TLV {
+	var tlvs []TLV
+	if flowID != "" {
+		tlvs = append(tlvs, TLV{Type: TLVFlowID, Value: []byte(flowID)})
+	}
+	if len(tags) > 0 {
+		tlvs = append(tlvs, TLV{Type: TLVTags, Value: []byte(FormatTags(tags))})
+	}
+	return tlvs
+}
+
+// FormatTags renders tags as sorted "key=value" pairs joined by ","
+func FormatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+tags[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// WriteHeader writes a PROXY protocol header for a TCP connection from src to dst.
+// version is "v1" or "v2"; TLVs are only sent with v2.
+func WriteHeader(w io.Writer, version string, src, dst *net.TCPAddr, tlvs []TLV) error {
+	var header []byte
+	var err error
+
+	switch version {
+	case "v1":
+		header = v1Header(src, dst)
+	case "v2":
+		header, err = v2Header(src, dst, tlvs)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version: %s", version)
+	}
+
+	_, err = w.Write(header)
+	return err
+}
+
+// v1Header builds a text header
+func v1Header(src, dst *net.TCPAddr) []byte {
+	family := "TCP6"
+	srcIP, dstIP := src.IP.String(), dst.IP.String()
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		family = "TCP4"
+		srcIP, dstIP = src.IP.To4().String(), dst.IP.To4().String()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, src.Port, dst.Port))
+}
+
+// v2Header builds a binary header with optional TLVs
+func v2Header(src, dst *net.TCPAddr, tlvs []TLV) ([]byte, error) {
+	var addrs bytes.Buffer
+	var family byte
+
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		family = 0x11 // AF_INET, STREAM
+		addrs.Write(src4)
+		addrs.Write(dst4)
+	} else {
+		family = 0x21 // AF_INET6, STREAM
+		addrs.Write(src.IP.To16())
+		addrs.Write(dst.IP.To16())
+	}
+	binary.Write(&addrs, binary.BigEndian, uint16(src.Port))
+	binary.Write(&addrs, binary.BigEndian, uint16(dst.Port))
+
+	for _, tlv := range tlvs {
+		if len(tlv.Value) > 0xFFFF {
+			return nil, fmt.Errorf("TLV 0x%02x too long: %d bytes", tlv.Type, len(tlv.Value))
+		}
+		addrs.WriteByte(tlv.Type)
+		binary.Write(&addrs, binary.BigEndian, uint16(len(tlv.Value)))
+		addrs.Write(tlv.Value)
+	}
+
+	if addrs.Len() > 0xFFFF {
+		return nil, fmt.Errorf("PROXY v2 header too long: %d bytes", addrs.Len())
+	}
+
+	header := make([]byte, 0, 16+addrs.Len())
+	header = append(header, v2Signature...)
+	header = append(header, 0x21, family) // version 2, PROXY command
+	header = binary.BigEndian.AppendUint16(header, uint16(addrs.Len()))
+	header = append(header, addrs.Bytes()...)
+	return header, nil
+}
@@ -0,0 +1,545 @@
+// Package quota caps the bytes each client may transfer per calendar day
+// and month. Usage is counted in memory as traffic flows and added to the
+// state storage on an interval, from which every instance sharing the
+// store reads back the combined usage. Once a quota is exhausted, the
+// client's traffic is dropped or throttled until the period ends.
+package quota
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/metrics"
+	"github.com/espegro/packetpony/internal/storage"
+)
+
+// Periods a quota applies to
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// SyncInterval is how often usage is exchanged with the store. Between
+// syncs an instance only sees its own new usage, so a client may overshoot
+// its quota by what the other instances admit in one interval.
+const SyncInterval = 10 * time.Second
+
+// idleTimeout is how long a client is kept in memory after its last
+// traffic. Its usage stays in the store and is read back at the first sync
+// after it returns.
+const idleTimeout = 1 * time.Hour
+
+// period describes one of the quotas
+type period struct {
+	name   string
+	layout string // Formats the ID of the period containing a time
+	limit  int64
+}
+
+// counter is a client's usage in one period
+type counter struct {
+	id        string // Period the counter is for, e.g. 2026-10
+	total     int64  // Combined usage as of the last sync, plus own usage since
+	pending   int64  // Own usage not yet added to the store
+	exhausted bool   // Reported through onExhausted
+}
+
+// client is the usage of one client IP
+type client struct {
+	counters   []counter // One per period
+	next       time.Time // When a throttled client may send again
+	lastActive time.Time
+}
+
+// Usage is a client's usage of one quota
+type Usage struct {
+	Client    string `json:"client"`
+	Period    string `json:"period"`
+	ID        string `json:"id"`
+	Used      int64  `json:"used_bytes"`
+	Limit     int64  `json:"limit_bytes"`
+	Exhausted bool   `json:"exhausted"`
+}
+
+// Tracker counts the usage of the clients of one listener
+type Tracker struct {
+	listener string
+	store    storage.Store
+	prefix   string // Store key prefix, ending in "/"
+	periods  []period
+	action   string
+	rate     int64 // Bytes per second of a throttled client
+	location *time.Location
+	metrics  *metrics.ProxyMetrics
+
+	mu          sync.Mutex
+	clients     map[string]*client
+	onError     func(err error)
+	onExhausted func(ip, period string, used, limit int64)
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// New creates the quota tracker of a listener, continuing from the usage
+// in the store, and starts syncing. Returns nil if quotas are disabled.
+func New(listener string, cfg *config.QuotaConfig, store storage.Store, metricsCollector *metrics.ProxyMetrics) (*Tracker, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	t := &Tracker{
+		listener: listener,
+		store:    store,
+		prefix:   "quota/" + listener + "/",
+		action:   cfg.GetAction(),
+		rate:     cfg.GetThrottleRate(),
+		location: cfg.GetLocation(),
+		metrics:  metricsCollector,
+		clients:  make(map[string]*client),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if limit := cfg.GetDailyBytes(); limit > 0 {
+		t.periods = append(t.periods, period{name: PeriodDay, layout: "2006-01-02", limit: limit})
+	}
+	if limit := cfg.GetMonthlyBytes(); limit > 0 {
+		t.periods = append(t.periods, period{name: PeriodMonth, layout: "2006-01", limit: limit})
+	}
+
+	now := time.Now()
+	stored, err := t.stored(now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load quota usage: %w", err)
+	}
+	for ip, used := range stored {
+		c := t.newClient(now)
+		for i := range c.counters {
+			c.counters[i].total = used[i]
+			c.counters[i].exhausted = used[i] >= t.periods[i].limit
+		}
+		t.clients[ip] = c
+	}
+
+	go t.syncLoop()
+
+	return t, nil
+}
+
+// OnStoreError registers a callback for failures to sync usage with the
+// store
+func (t *Tracker) OnStoreError(fn func(err error)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onError = fn
+}
+
+// OnExhausted registers a callback for clients exhausting a quota. It is
+// called once per client and period.
+func (t *Tracker) OnExhausted(fn func(ip, period string, used, limit int64)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onExhausted = fn
+}
+
+// Action returns what happens to the traffic of exhausted clients
+func (t *Tracker) Action() string {
+	return t.action
+}
+
+// Exhausted returns the period whose quota the client has exhausted, or
+// "" if it has quota left
+func (t *Tracker) Exhausted(ip string) string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, exists := t.clients[ip]
+	if !exists {
+		return ""
+	}
+	return t.exhaustedLocked(c, time.Now())
+}
+
+// Admit records n bytes of a stream of the client. It returns false if the
+// client's quota is exhausted and its traffic is dropped, or how long to
+// hold the bytes back if it is throttled.
+func (t *Tracker) Admit(ip string, n int64) (time.Duration, bool) {
+	return t.admit(ip, n, true)
+}
+
+// AdmitPacket records a datagram of n bytes of the client. It returns
+// false if the client's quota is exhausted and the datagram is dropped,
+// either by action drop or because it would exceed the throttle rate.
+func (t *Tracker) AdmitPacket(ip string, n int64) bool {
+	_, admitted := t.admit(ip, n, false)
+	return admitted
+}
+
+// admit records n bytes of the client if its quota allows them. A
+// throttled client is paced at the throttle rate: wait returns the delay
+// for the bytes, otherwise bytes that would have to wait are refused.
+func (t *Tracker) admit(ip string, n int64, wait bool) (time.Duration, bool) {
+	if t == nil || n <= 0 {
+		return 0, true
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	c := t.clientLocked(ip, now)
+	var delay time.Duration
+	if t.exhaustedLocked(c, now) != "" {
+		if t.action != config.QuotaActionThrottle {
+			t.mu.Unlock()
+			return 0, false
+		}
+		start := c.next
+		if start.Before(now) {
+			start = now
+		}
+		delay = start.Sub(now)
+		if delay > 0 && !wait {
+			t.mu.Unlock()
+			return 0, false
+		}
+		c.next = start.Add(time.Duration(n) * time.Second / time.Duration(t.rate))
+	}
+
+	type exhaustion struct {
+		period      string
+		used, limit int64
+	}
+	var exhausted []exhaustion
+	for i := range c.counters {
+		counter := &c.counters[i]
+		counter.total += n
+		counter.pending += n
+		if !counter.exhausted && counter.total >= t.periods[i].limit {
+			counter.exhausted = true
+			exhausted = append(exhausted, exhaustion{t.periods[i].name, counter.total, t.periods[i].limit})
+		}
+	}
+	onExhausted := t.onExhausted
+	t.mu.Unlock()
+
+	if onExhausted != nil {
+		for _, e := range exhausted {
+			onExhausted(ip, e.period, e.used, e.limit)
+		}
+	}
+	return delay, true
+}
+
+// newClient returns a client with empty counters for the periods
+// containing now
+func (t *Tracker) newClient(now time.Time) *client {
+	c := &client{counters: make([]counter, len(t.periods)), lastActive: now}
+	for i, p := range t.periods {
+		c.counters[i].id = t.periodID(p, now)
+	}
+	return c
+}
+
+// clientLocked returns the client with its counters rolled over to the
+// current periods. Must be called with t.mu held.
+func (t *Tracker) clientLocked(ip string, now time.Time) *client {
+	c, exists := t.clients[ip]
+	if !exists {
+		c = t.newClient(now)
+		t.clients[ip] = c
+	}
+	t.rollLocked(c, now)
+	c.lastActive = now
+	return c
+}
+
+// rollLocked starts new counters for periods that have ended. Own usage
+// not yet synced belongs to the old period and is dropped. Must be called
+// with t.mu held.
+func (t *Tracker) rollLocked(c *client, now time.Time) {
+	for i, p := range t.periods {
+		if id := t.periodID(p, now); c.counters[i].id != id {
+			c.counters[i] = counter{id: id}
+		}
+	}
+}
+
+// exhaustedLocked returns the first period whose quota the client has
+// exhausted, or "". Must be called with t.mu held.
+func (t *Tracker) exhaustedLocked(c *client, now time.Time) string {
+	t.rollLocked(c, now)
+	for i, p := range t.periods {
+		if c.counters[i].total >= p.limit {
+			return p.name
+		}
+	}
+	return ""
+}
+
+// periodID returns the ID of the period containing now
+func (t *Tracker) periodID(p period, now time.Time) string {
+	return now.In(t.location).Format(p.layout)
+}
+
+// periodTTL returns how long the store keeps the usage of the period
+// containing now: until it ends, and a day more for reporting
+func (t *Tracker) periodTTL(p period, now time.Time) time.Duration {
+	local := now.In(t.location)
+	year, month, day := local.Date()
+	end := time.Date(year, month, day+1, 0, 0, 0, 0, t.location)
+	if p.name == PeriodMonth {
+		end = time.Date(year, month+1, 1, 0, 0, 0, 0, t.location)
+	}
+	return end.Sub(now) + 24*time.Hour
+}
+
+// key returns the store key of a client's usage in a period
+func (t *Tracker) key(p period, id, ip string) string {
+	return t.prefix + p.name + "/" + id + "/" + ip
+}
+
+// stored returns the usage in the store of every client in the current
+// periods, indexed like t.periods
+func (t *Tracker) stored(now time.Time) (map[string][]int64, error) {
+	usage := make(map[string][]int64)
+	for i, p := range t.periods {
+		prefix := t.prefix + p.name + "/" + t.periodID(p, now) + "/"
+		var decodeErr error
+		err := t.store.Scan(prefix, func(key string, value []byte) bool {
+			used, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				decodeErr = fmt.Errorf("invalid quota usage %s: %w", key, err)
+				return false
+			}
+			ip := strings.TrimPrefix(key, prefix)
+			if usage[ip] == nil {
+				usage[ip] = make([]int64, len(t.periods))
+			}
+			usage[ip][i] = used
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+	}
+	return usage, nil
+}
+
+// sync adds the pending usage of every client to the store and reads back
+// the combined usage. Clients idle for idleTimeout are forgotten.
+func (t *Tracker) sync() {
+	type job struct {
+		ip      string
+		period  int
+		id      string
+		pending int64
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	var jobs []job
+	for ip, c := range t.clients {
+		if now.Sub(c.lastActive) > idleTimeout {
+			delete(t.clients, ip)
+			continue
+		}
+		t.rollLocked(c, now)
+		for i := range c.counters {
+			jobs = append(jobs, job{ip: ip, period: i, id: c.counters[i].id, pending: c.counters[i].pending})
+			c.counters[i].pending = 0
+		}
+	}
+	t.mu.Unlock()
+
+	var firstErr error
+	for _, j := range jobs {
+		p := t.periods[j.period]
+		total, err := t.store.Incr(t.key(p, j.id, j.ip), j.pending, t.periodTTL(p, now))
+
+		t.mu.Lock()
+		exhausted := false
+		if c, exists := t.clients[j.ip]; exists && c.counters[j.period].id == j.id {
+			counter := &c.counters[j.period]
+			if err != nil {
+				counter.pending += j.pending // Retried at the next sync
+			} else {
+				// Own usage since the job was taken is not in the store yet
+				counter.total = total + counter.pending
+				exhausted = !counter.exhausted && counter.total >= p.limit
+				counter.exhausted = counter.total >= p.limit
+				total = counter.total
+			}
+		}
+		onExhausted := t.onExhausted
+		t.mu.Unlock()
+
+		if exhausted && onExhausted != nil {
+			onExhausted(j.ip, p.name, total, p.limit)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	t.updateMetrics(now)
+
+	t.mu.Lock()
+	onError := t.onError
+	t.mu.Unlock()
+	if firstErr != nil && onError != nil {
+		onError(firstErr)
+	}
+}
+
+// updateMetrics sets the number of exhausted clients of each period
+func (t *Tracker) updateMetrics(now time.Time) {
+	exhausted := make([]int, len(t.periods))
+	t.mu.Lock()
+	for _, c := range t.clients {
+		t.rollLocked(c, now)
+		for i, p := range t.periods {
+			if c.counters[i].total >= p.limit {
+				exhausted[i]++
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	for i, p := range t.periods {
+		t.metrics.QuotaExhausted.WithLabelValues(t.listener, p.name).Set(float64(exhausted[i]))
+	}
+}
+
+// syncLoop syncs every SyncInterval until Close
+func (t *Tracker) syncLoop() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.sync()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// List returns the usage of every client with usage in the current
+// periods, on this instance or in the store, sorted by client
+func (t *Tracker) List() ([]Usage, error) {
+	now := time.Now()
+	stored, err := t.stored(now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota usage: %w", err)
+	}
+
+	t.mu.Lock()
+	for ip, c := range t.clients {
+		t.rollLocked(c, now)
+		used := stored[ip]
+		if used == nil {
+			used = make([]int64, len(t.periods))
+			stored[ip] = used
+		}
+		for i, counter := range c.counters {
+			used[i] = max(used[i], counter.total-counter.pending) + counter.pending
+		}
+	}
+	t.mu.Unlock()
+
+	usages := make([]Usage, 0, len(stored)*len(t.periods))
+	for ip, used := range stored {
+		usages = append(usages, t.usages(ip, used, now)...)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Client != usages[j].Client {
+			return usages[i].Client < usages[j].Client
+		}
+		return usages[i].Period < usages[j].Period
+	})
+	return usages, nil
+}
+
+// Client returns the usage of one client
+func (t *Tracker) Client(ip string) ([]Usage, error) {
+	usages, err := t.List()
+	if err != nil {
+		return nil, err
+	}
+	var client []Usage
+	for _, u := range usages {
+		if u.Client == ip {
+			client = append(client, u)
+		}
+	}
+	if client == nil {
+		client = t.usages(ip, make([]int64, len(t.periods)), time.Now())
+	}
+	return client, nil
+}
+
+// usages returns the usage of a client in each period
+func (t *Tracker) usages(ip string, used []int64, now time.Time) []Usage {
+	usages := make([]Usage, len(t.periods))
+	for i, p := range t.periods {
+		usages[i] = Usage{
+			Client:    ip,
+			Period:    p.name,
+			ID:        t.periodID(p, now),
+			Used:      used[i],
+			Limit:     p.limit,
+			Exhausted: used[i] >= p.limit,
+		}
+	}
+	return usages
+}
+
+// Reset clears a client's usage in the current periods, here and in the
+// store. Other instances learn of it at their next sync.
+func (t *Tracker) Reset(ip string) error {
+	now := time.Now()
+	t.mu.Lock()
+	delete(t.clients, ip)
+	t.mu.Unlock()
+
+	for _, p := range t.periods {
+		if err := t.store.Delete(t.key(p, t.periodID(p, now), ip)); err != nil {
+			return fmt.Errorf("failed to reset quota usage: %w", err)
+		}
+	}
+	t.updateMetrics(now)
+	return nil
+}
+
+// Close stops syncing after adding the pending usage to the store. The
+// store must still be open.
+func (t *Tracker) Close() {
+	if t == nil {
+		return
+	}
+	t.closeOnce.Do(func() {
+		close(t.stop)
+		<-t.done
+		t.sync()
+	})
+}
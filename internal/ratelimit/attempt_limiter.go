@@ -13,6 +13,8 @@ type AttemptLimiter struct {
 	window      time.Duration
 	attempts    map[string]*attemptEntry
 	stopCleanup chan struct{}
+	closeOnce   sync.Once
+	shared      *sharedUsage // Attempts of other instances, nil unless shared
 }
 
 // attemptEntry tracks connection attempt timestamps for an IP
@@ -62,9 +64,10 @@ func (l *AttemptLimiter) RecordAttempt(ip string) bool {
 		}
 	}
 	entry.timestamps = validTimestamps
+	l.shared.add(ip, 1)
 
 	// Check if limit is exceeded
-	if len(entry.timestamps) >= l.maxPerIP {
+	if len(entry.timestamps)+int(l.shared.others(ip)) >= l.maxPerIP {
 		// Still record the attempt for tracking
 		entry.timestamps = append(entry.timestamps, now)
 		return false
@@ -75,6 +78,39 @@ func (l *AttemptLimiter) RecordAttempt(ip string) bool {
 	return true
 }
 
+// Usage returns the number of attempts by ip in the current window and the
+// time until the oldest of them leaves the window
+func (l *AttemptLimiter) Usage(ip string) (int, time.Duration) {
+	l.mu.RLock()
+	entry, exists := l.attempts[ip]
+	l.mu.RUnlock()
+
+	others := int(l.shared.others(ip))
+	if !exists {
+		return others, 0
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+	used := 0
+	var oldest time.Time
+	for _, ts := range entry.timestamps {
+		if ts.After(cutoff) {
+			if used == 0 {
+				oldest = ts
+			}
+			used++
+		}
+	}
+	if used == 0 {
+		return others, 0
+	}
+	return used + others, oldest.Add(l.window).Sub(now)
+}
+
 // cleanupLoop periodically removes expired entries
 func (l *AttemptLimiter) cleanupLoop() {
 	ticker := time.NewTicker(l.window)
@@ -117,5 +153,7 @@ func (l *AttemptLimiter) cleanup() {
 
 // Close stops the cleanup goroutine
 func (l *AttemptLimiter) Close() {
-	close(l.stopCleanup)
+	l.closeOnce.Do(func() {
+		close(l.stopCleanup)
+	})
 }
@@ -2,18 +2,22 @@ package ratelimit
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // BandwidthLimiter limits bandwidth per IP using a sliding window
 type BandwidthLimiter struct {
 	mu              sync.RWMutex
-	maxPerIP        int64 // bytes
-	throttleMinimum int64 // bytes - minimum bandwidth when throttling
+	maxPerIP        int64        // bytes
+	limit           atomic.Int64 // maxPerIP, scaled down in emergency mode
+	throttleMinimum int64        // bytes - minimum bandwidth when throttling
 	window          time.Duration
 	buckets         map[string]*bandwidthBucket
 	stopCleanup     chan struct{}
-	action          string // drop, throttle, log_only
+	closeOnce       sync.Once
+	action          string       // drop, throttle, log_only
+	shared          *sharedUsage // Bytes of other instances, nil unless shared
 }
 
 // bandwidthBucket tracks bandwidth consumption for an IP
@@ -43,6 +47,7 @@ func NewBandwidthLimiter(maxPerIP int64, window time.Duration, action string, th
 		stopCleanup:     make(chan struct{}),
 		action:          action,
 	}
+	limiter.limit.Store(maxPerIP)
 
 	// Start cleanup goroutine
 	go limiter.cleanupLoop()
@@ -84,9 +89,10 @@ func (l *BandwidthLimiter) Allow(ip string, bytes int64) bool {
 		}
 	}
 	bucket.entries = validEntries
+	currentUsage += l.shared.others(ip)
 
 	// Check if adding this would exceed the limit
-	if currentUsage+bytes > l.maxPerIP {
+	if currentUsage+bytes > l.limit.Load() {
 		// Handle based on action mode
 		switch l.action {
 		case "log_only":
@@ -95,6 +101,7 @@ func (l *BandwidthLimiter) Allow(ip string, bytes int64) bool {
 				bytes:     bytes,
 				timestamp: now,
 			})
+			l.shared.add(ip, bytes)
 			return true
 		case "throttle":
 			// Throttle mode: allow only up to minimum bandwidth
@@ -103,6 +110,7 @@ func (l *BandwidthLimiter) Allow(ip string, bytes int64) bool {
 					bytes:     bytes,
 					timestamp: now,
 				})
+				l.shared.add(ip, bytes)
 				return true
 			}
 			return false
@@ -116,6 +124,7 @@ func (l *BandwidthLimiter) Allow(ip string, bytes int64) bool {
 		bytes:     bytes,
 		timestamp: now,
 	})
+	l.shared.add(ip, bytes)
 
 	return true
 }
@@ -131,8 +140,9 @@ func (l *BandwidthLimiter) IsOverLimit(ip string, bytes int64) bool {
 	bucket, exists := l.buckets[ip]
 	l.mu.RUnlock()
 
+	currentUsage := l.shared.others(ip)
 	if !exists {
-		return false
+		return currentUsage+bytes > l.limit.Load()
 	}
 
 	bucket.mu.Lock()
@@ -141,14 +151,18 @@ func (l *BandwidthLimiter) IsOverLimit(ip string, bytes int64) bool {
 	now := time.Now()
 	cutoff := now.Add(-l.window)
 
-	var currentUsage int64
 	for _, entry := range bucket.entries {
 		if entry.timestamp.After(cutoff) {
 			currentUsage += entry.bytes
 		}
 	}
 
-	return currentUsage+bytes > l.maxPerIP
+	return currentUsage+bytes > l.limit.Load()
+}
+
+// SetScale applies factor (0 < factor <= 1) to the configured limit
+func (l *BandwidthLimiter) SetScale(factor float64) {
+	l.limit.Store(max(int64(float64(l.maxPerIP)*factor), 1))
 }
 
 // cleanupLoop periodically removes expired buckets
@@ -190,5 +204,46 @@ func (l *BandwidthLimiter) cleanup() {
 
 // Close stops the cleanup goroutine
 func (l *BandwidthLimiter) Close() {
-	close(l.stopCleanup)
+	l.closeOnce.Do(func() {
+		close(l.stopCleanup)
+	})
+}
+
+// Usage returns the bytes consumed per key within the current window
+func (l *BandwidthLimiter) Usage() map[string]int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	cutoff := time.Now().Add(-l.window)
+	usage := make(map[string]int64, len(l.buckets))
+
+	for ip, bucket := range l.buckets {
+		bucket.mu.Lock()
+		var total int64
+		for _, entry := range bucket.entries {
+			if entry.timestamp.After(cutoff) {
+				total += entry.bytes
+			}
+		}
+		bucket.mu.Unlock()
+
+		if total > 0 {
+			usage[ip] = total
+		}
+	}
+
+	return usage
+}
+
+// Throughput returns the average bytes per second of each key with usage
+// in the current window
+func (l *BandwidthLimiter) Throughput() []float64 {
+	usage := l.Usage()
+	seconds := l.window.Seconds()
+
+	rates := make([]float64, 0, len(usage))
+	for _, bytes := range usage {
+		rates = append(rates, float64(bytes)/seconds)
+	}
+	return rates
 }
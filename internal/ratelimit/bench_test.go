@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// benchWindow is the limiter window of the benchmarks. The limiters keep
+// every event of the window, so a short window keeps their state at a
+// steady-state size instead of growing with b.N.
+const benchWindow = 100 * time.Millisecond
+
+// BenchmarkBandwidthAllow measures the per-chunk cost of the bandwidth
+// limiter on the copy path, for one busy client and for many clients
+func BenchmarkBandwidthAllow(b *testing.B) {
+	for _, clients := range []int{1, 1024} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			limiter := NewBandwidthLimiter(1<<50, benchWindow, "drop", 0)
+			defer limiter.Close()
+			ips := make([]string, clients)
+			for i := range ips {
+				ips[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				limiter.Allow(ips[i%clients], 32*1024)
+			}
+		})
+	}
+}
+
+// BenchmarkCheckConnection measures admission of a connection against the
+// per-client connection and attempt limits and its release
+func BenchmarkCheckConnection(b *testing.B) {
+	manager := NewRateLimitManager(config.RateLimitConfig{
+		MaxConnectionsPerIP:        1 << 30,
+		ConnectionsWindow:          benchWindow,
+		MaxConnectionAttemptsPerIP: 1 << 30,
+		AttemptsWindow:             benchWindow,
+		MaxTotalConnections:        1 << 30,
+	}, nil)
+	defer manager.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if allowed, reason := manager.CheckConnection("10.0.0.1"); !allowed {
+			b.Fatalf("connection denied: %s", reason)
+		}
+		manager.ReleaseConnection("10.0.0.1")
+		manager.ReleaseTotalConnection("10.0.0.1")
+	}
+}
@@ -12,6 +12,7 @@ type ConnectionLimiter struct {
 	window      time.Duration
 	connections map[string]*connEntry
 	stopCleanup chan struct{}
+	closeOnce   sync.Once
 }
 
 // connEntry tracks connection timestamps for an IP
@@ -76,6 +77,23 @@ func (l *ConnectionLimiter) Allow(ip string) bool {
 	return true
 }
 
+// Track counts a connection for the IP without enforcing the limit
+func (l *ConnectionLimiter) Track(ip string) {
+	l.mu.Lock()
+	entry, exists := l.connections[ip]
+	if !exists {
+		entry = &connEntry{}
+		l.connections[ip] = entry
+	}
+	l.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	entry.timestamps = append(entry.timestamps, time.Now())
+	entry.count++
+}
+
 // Release releases a connection for the IP
 func (l *ConnectionLimiter) Release(ip string) {
 	l.mu.RLock()
@@ -140,5 +158,24 @@ func (l *ConnectionLimiter) cleanup() {
 
 // Close stops the cleanup goroutine
 func (l *ConnectionLimiter) Close() {
-	close(l.stopCleanup)
+	l.closeOnce.Do(func() {
+		close(l.stopCleanup)
+	})
+}
+
+// Counts returns the number of tracked connections per key
+func (l *ConnectionLimiter) Counts() map[string]int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	counts := make(map[string]int, len(l.connections))
+	for ip, entry := range l.connections {
+		entry.mu.Lock()
+		if entry.count > 0 {
+			counts[ip] = entry.count
+		}
+		entry.mu.Unlock()
+	}
+
+	return counts
 }
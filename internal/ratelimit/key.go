@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"net"
+)
+
+// keyMapper maps a client IP to the key its limits are aggregated under.
+// With prefix aggregation enabled, all addresses in the same prefix share
+// one connection, attempt and bandwidth budget.
+type keyMapper struct {
+	v4Mask net.IPMask // nil = per address
+	v6Mask net.IPMask // nil = per address
+}
+
+// newKeyMapper creates a key mapper for the given prefix lengths (0 = per address)
+func newKeyMapper(v4Prefix, v6Prefix int) keyMapper {
+	var mapper keyMapper
+	if v4Prefix > 0 && v4Prefix < 32 {
+		mapper.v4Mask = net.CIDRMask(v4Prefix, 32)
+	}
+	if v6Prefix > 0 && v6Prefix < 128 {
+		mapper.v6Mask = net.CIDRMask(v6Prefix, 128)
+	}
+	return mapper
+}
+
+// key returns the rate limit key for an IP string
+func (k keyMapper) key(ip string) string {
+	if k.v4Mask == nil && k.v6Mask == nil {
+		return ip
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		if k.v4Mask == nil {
+			return ip
+		}
+		return (&net.IPNet{IP: v4.Mask(k.v4Mask), Mask: k.v4Mask}).String()
+	}
+
+	if k.v6Mask == nil {
+		return ip
+	}
+	return (&net.IPNet{IP: parsed.Mask(k.v6Mask), Mask: k.v6Mask}).String()
+}
@@ -3,9 +3,19 @@
 package ratelimit
 
 import (
+	"net"
 	"sync/atomic"
+	"time"
 
 	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/storage"
+)
+
+// Reasons returned by CheckConnection when a connection is denied
+const (
+	ReasonAttemptLimit    = "attempt_limit"
+	ReasonTotalLimit      = "total_limit"
+	ReasonConnectionLimit = "connection_limit"
 )
 
 // RateLimitManager manages all rate limiting for a listener
@@ -13,13 +23,23 @@ type RateLimitManager struct {
 	connLimiter      *ConnectionLimiter
 	attemptLimiter   *AttemptLimiter
 	bandwidthLimiter *BandwidthLimiter
-	totalConns       int64
+	totalConns       atomic.Int64
 	maxTotalConns    int64
+	generalConns     atomic.Int64 // Connections from clients outside priority_clients
+	maxGeneralConns  int64        // maxTotalConns less the priority reserve
+	isPriority       func(ip net.IP) bool
 	action           string
+	keys             keyMapper
+	exempt           func(ip string) bool
+	schedule         *config.Schedule
+	stopShare        chan struct{} // Closed by Close, nil unless shared
+	audit            bool          // Admit what the limits would deny
 }
 
-// NewRateLimitManager creates a new rate limit manager
-func NewRateLimitManager(cfg config.RateLimitConfig) *RateLimitManager {
+// NewRateLimitManager creates a new rate limit manager. Clients for which
+// exempt returns true bypass per-client limits; exempt may be nil. With a
+// schedule, per-client limits only apply while it is active.
+func NewRateLimitManager(cfg config.RateLimitConfig, exempt func(ip string) bool) *RateLimitManager {
 	var connLimiter *ConnectionLimiter
 	if cfg.MaxConnectionsPerIP > 0 && cfg.ConnectionsWindow > 0 {
 		connLimiter = NewConnectionLimiter(cfg.MaxConnectionsPerIP, cfg.ConnectionsWindow)
@@ -49,41 +69,128 @@ func NewRateLimitManager(cfg config.RateLimitConfig) *RateLimitManager {
 		attemptLimiter:   attemptLimiter,
 		bandwidthLimiter: bandwidthLimiter,
 		maxTotalConns:    int64(cfg.MaxTotalConnections),
+		maxGeneralConns:  int64(cfg.MaxTotalConnections - cfg.GetPriorityReserved()),
+		isPriority:       cfg.IsPriority,
 		action:           cfg.Action,
+		keys:             newKeyMapper(cfg.GetKeyPrefixes()),
+		exempt:           exempt,
+		schedule:         cfg.GetSchedule(),
 	}
 }
 
+// IsExempt reports whether the client holds an active rate limit exemption
+func (m *RateLimitManager) IsExempt(ip string) bool {
+	return m.exempt != nil && m.exempt(ip)
+}
+
+// unlimited reports whether the client is not held to per-client limits
+// right now: it is exempt, or the limits' schedule is not active
+func (m *RateLimitManager) unlimited(ip string) bool {
+	return m.IsExempt(ip) || !m.schedule.Active(time.Now())
+}
+
 // AllowConnection checks if a new connection from the given IP is allowed
 func (m *RateLimitManager) AllowConnection(ip string) bool {
+	allowed, _ := m.CheckConnection(ip)
+	return allowed
+}
+
+// CheckConnection checks if a new connection from the given IP is allowed.
+// When denied, it also returns which limit was hit. In audit mode the
+// connection is admitted and counted anyway, and the limit it would have
+// hit is returned with it.
+func (m *RateLimitManager) CheckConnection(ip string) (bool, string) {
+	allowed, reason := m.checkConnection(ip)
+	if allowed || !m.audit {
+		return allowed, reason
+	}
+
+	// A denial counts nothing, so count the connection as admitted to keep
+	// ReleaseConnection and ReleaseTotalConnection balanced
+	if m.maxTotalConns > 0 {
+		m.totalConns.Add(1)
+		if m.isGeneral(ip) {
+			m.generalConns.Add(1)
+		}
+	}
+	if m.connLimiter != nil {
+		m.connLimiter.Track(m.keys.key(ip))
+	}
+	return true, reason
+}
+
+// checkConnection checks and counts a new connection against the limits
+func (m *RateLimitManager) checkConnection(ip string) (bool, string) {
+	unlimited := m.unlimited(ip)
+	clientIP := ip
+	ip = m.keys.key(ip)
+
+	// Exempt clients, and every client outside the schedule, skip
+	// per-client limits but still count towards them, so
+	// ReleaseConnection stays balanced
+	if unlimited {
+		if !m.AllowTotalConnection(clientIP) {
+			return false, ReasonTotalLimit
+		}
+		if m.connLimiter != nil {
+			m.connLimiter.Track(ip)
+		}
+		return true, ""
+	}
+
 	// Check connection attempt limit first (tracks all attempts)
 	if m.attemptLimiter != nil {
 		if !m.attemptLimiter.RecordAttempt(ip) {
 			// Too many attempts - don't even check other limits
-			return false
+			return false, ReasonAttemptLimit
 		}
 	}
 
 	// Check total connection limit
-	if !m.AllowTotalConnection() {
-		return false
+	if !m.AllowTotalConnection(clientIP) {
+		return false, ReasonTotalLimit
 	}
 
 	// Check per-IP connection limit
 	if m.connLimiter != nil {
 		if !m.connLimiter.Allow(ip) {
 			// Rollback total connection increment
-			m.ReleaseTotalConnection()
-			return false
+			m.ReleaseTotalConnection(clientIP)
+			return false, ReasonConnectionLimit
 		}
 	}
 
-	return true
+	return true, ""
+}
+
+// Quota describes a client's connection attempt budget in the current window
+type Quota struct {
+	Limit     int
+	Remaining int
+	Window    time.Duration
+	Reset     time.Duration // Until the oldest attempt leaves the window
+}
+
+// AttemptQuota returns the client's connection attempt budget. It returns
+// false when no attempt limit is configured or applies to the client.
+func (m *RateLimitManager) AttemptQuota(ip string) (Quota, bool) {
+	if m.attemptLimiter == nil || m.unlimited(ip) {
+		return Quota{}, false
+	}
+
+	used, reset := m.attemptLimiter.Usage(m.keys.key(ip))
+	return Quota{
+		Limit:     m.attemptLimiter.maxPerIP,
+		Remaining: max(m.attemptLimiter.maxPerIP-used, 0),
+		Window:    m.attemptLimiter.window,
+		Reset:     reset,
+	}, true
 }
 
 // AllowBandwidth checks if bandwidth usage for the given IP is within limits
 func (m *RateLimitManager) AllowBandwidth(ip string, bytes int64) bool {
-	if m.bandwidthLimiter != nil {
-		return m.bandwidthLimiter.Allow(ip, bytes)
+	if m.bandwidthLimiter != nil && !m.unlimited(ip) {
+		return m.bandwidthLimiter.Allow(m.keys.key(ip), bytes)
 	}
 	return true
 }
@@ -91,12 +198,83 @@ func (m *RateLimitManager) AllowBandwidth(ip string, bytes int64) bool {
 // IsBandwidthOverLimit checks if the IP would be over the bandwidth limit
 // Useful for logging violations in log_only mode
 func (m *RateLimitManager) IsBandwidthOverLimit(ip string, bytes int64) bool {
-	if m.bandwidthLimiter != nil {
-		return m.bandwidthLimiter.IsOverLimit(ip, bytes)
+	if m.bandwidthLimiter != nil && !m.unlimited(ip) {
+		return m.bandwidthLimiter.IsOverLimit(m.keys.key(ip), bytes)
 	}
 	return false
 }
 
+// Throughput returns the average bytes per second of each client (or
+// prefix) over the current bandwidth window. Nil without a bandwidth limit.
+func (m *RateLimitManager) Throughput() []float64 {
+	if m.bandwidthLimiter == nil {
+		return nil
+	}
+	return m.bandwidthLimiter.Throughput()
+}
+
+// SetBandwidthScale clamps the per-client bandwidth limit to factor of its
+// configured value; 1 restores it. No-op without a bandwidth limit.
+func (m *RateLimitManager) SetBandwidthScale(factor float64) {
+	if m.bandwidthLimiter != nil {
+		m.bandwidthLimiter.SetScale(factor)
+	}
+}
+
+// Share counts connection attempts and bandwidth together with the other
+// instances using store, under keys starting with prefix. Each instance
+// keeps enforcing the limits itself against the combined usage, so the
+// limits hold without the store, only per instance. Connection limits
+// stay per instance. Must be called before the manager is used.
+func (m *RateLimitManager) Share(store storage.Store, prefix string) {
+	if m.stopShare != nil {
+		return
+	}
+	m.stopShare = make(chan struct{})
+	if m.attemptLimiter != nil {
+		m.attemptLimiter.shared = newSharedUsage(store, prefix+"attempts/", m.attemptLimiter.window)
+		go m.attemptLimiter.shared.syncLoop(m.stopShare)
+	}
+	if m.bandwidthLimiter != nil {
+		m.bandwidthLimiter.shared = newSharedUsage(store, prefix+"bandwidth/", m.bandwidthLimiter.window)
+		go m.bandwidthLimiter.shared.syncLoop(m.stopShare)
+	}
+}
+
+// Audit has the limits admit the connections and traffic they would
+// deny, so that these can be logged instead: CheckConnection reports the
+// limit hit but admits, and the bandwidth limit acts as log_only. Must be
+// called before the manager is used.
+func (m *RateLimitManager) Audit() {
+	m.audit = true
+	m.action = "log_only"
+	if m.bandwidthLimiter != nil {
+		m.bandwidthLimiter.action = "log_only"
+	}
+}
+
+// OnStoreError registers a callback for failures to share usage through
+// the store. No-op unless shared.
+func (m *RateLimitManager) OnStoreError(fn func(err error)) {
+	for _, u := range m.sharedUsages() {
+		u.mu.Lock()
+		u.onError = fn
+		u.mu.Unlock()
+	}
+}
+
+// sharedUsages returns the shared counters of the manager's limiters
+func (m *RateLimitManager) sharedUsages() []*sharedUsage {
+	var usages []*sharedUsage
+	if m.attemptLimiter != nil && m.attemptLimiter.shared != nil {
+		usages = append(usages, m.attemptLimiter.shared)
+	}
+	if m.bandwidthLimiter != nil && m.bandwidthLimiter.shared != nil {
+		usages = append(usages, m.bandwidthLimiter.shared)
+	}
+	return usages
+}
+
 // GetAction returns the configured action mode
 func (m *RateLimitManager) GetAction() string {
 	if m.action == "" {
@@ -105,38 +283,62 @@ func (m *RateLimitManager) GetAction() string {
 	return m.action
 }
 
-// AllowTotalConnection checks and increments the total connection counter
-func (m *RateLimitManager) AllowTotalConnection() bool {
+// AllowTotalConnection checks and increments the total connection counter.
+// Clients outside priority_clients may only fill max_total_connections up
+// to the priority reserve.
+func (m *RateLimitManager) AllowTotalConnection(ip string) bool {
 	if m.maxTotalConns == 0 {
 		return true
 	}
 
-	current := atomic.AddInt64(&m.totalConns, 1)
+	general := m.isGeneral(ip)
+	if general && m.generalConns.Add(1) > m.maxGeneralConns {
+		m.generalConns.Add(-1)
+		return false
+	}
+
+	current := m.totalConns.Add(1)
 	if current > m.maxTotalConns {
-		atomic.AddInt64(&m.totalConns, -1)
+		m.totalConns.Add(-1)
+		if general {
+			m.generalConns.Add(-1)
+		}
 		return false
 	}
 
 	return true
 }
 
+// isGeneral reports whether ip counts against the connections left after
+// the priority reserve. Without a reserve, every client does.
+func (m *RateLimitManager) isGeneral(ip string) bool {
+	if m.maxGeneralConns == m.maxTotalConns {
+		return true
+	}
+	return !m.isPriority(net.ParseIP(ip))
+}
+
 // ReleaseConnection releases a connection for the given IP
 func (m *RateLimitManager) ReleaseConnection(ip string) {
 	if m.connLimiter != nil {
-		m.connLimiter.Release(ip)
+		m.connLimiter.Release(m.keys.key(ip))
 	}
 }
 
-// ReleaseTotalConnection decrements the total connection counter
-func (m *RateLimitManager) ReleaseTotalConnection() {
+// ReleaseTotalConnection decrements the total connection counter for a
+// connection admitted by AllowTotalConnection for ip
+func (m *RateLimitManager) ReleaseTotalConnection(ip string) {
 	if m.maxTotalConns > 0 {
-		atomic.AddInt64(&m.totalConns, -1)
+		m.totalConns.Add(-1)
+		if m.isGeneral(ip) {
+			m.generalConns.Add(-1)
+		}
 	}
 }
 
 // GetTotalConnections returns the current total connection count
 func (m *RateLimitManager) GetTotalConnections() int64 {
-	return atomic.LoadInt64(&m.totalConns)
+	return m.totalConns.Load()
 }
 
 // Close stops all cleanup goroutines
@@ -150,4 +352,8 @@ func (m *RateLimitManager) Close() {
 	if m.bandwidthLimiter != nil {
 		m.bandwidthLimiter.Close()
 	}
+	if m.stopShare != nil {
+		close(m.stopShare)
+		m.stopShare = nil
+	}
 }
@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/storage"
+)
+
+// SharedSyncInterval is how often usage is exchanged with the other
+// instances sharing a limit. Between syncs an instance only sees its own
+// new usage, so a client may overshoot a shared budget by what the other
+// instances admit in up to two intervals.
+const SharedSyncInterval = 1 * time.Second
+
+// sharedUsage counts one kind of usage per key in a store shared between
+// instances. Usage is counted in fixed windows aligned to the epoch, so
+// instances need synchronized clocks. Each instance adds its new usage at
+// every sync and reads back the combined count, from which it learns the
+// usage of the others.
+type sharedUsage struct {
+	store   storage.Store
+	prefix  string // Store key prefix, ending in "/"
+	window  time.Duration
+	mu      sync.Mutex
+	entries map[string]*sharedEntry
+	onError func(err error)
+}
+
+// sharedEntry is the usage of one key in the current and previous window
+type sharedEntry struct {
+	window     int64 // Index of the current window
+	pending    int64 // Own usage not yet added to the store
+	own, total int64 // Own and combined usage of the current window, as of the last sync
+	prevOthers int64 // Usage of the other instances in the previous window
+	lastActive time.Time
+}
+
+// newSharedUsage creates a shared counter for usage measured over window
+func newSharedUsage(store storage.Store, prefix string, window time.Duration) *sharedUsage {
+	return &sharedUsage{
+		store:   store,
+		prefix:  prefix,
+		window:  window,
+		entries: make(map[string]*sharedEntry),
+	}
+}
+
+// windowIndex returns the index of the window containing t
+func (u *sharedUsage) windowIndex(t time.Time) int64 {
+	return t.UnixNano() / int64(u.window)
+}
+
+// entryLocked returns the entry of key, rolled over to the current window.
+// Must be called with u.mu held.
+func (u *sharedUsage) entryLocked(key string, now time.Time) *sharedEntry {
+	e, exists := u.entries[key]
+	if !exists {
+		e = &sharedEntry{window: u.windowIndex(now)}
+		u.entries[key] = e
+	}
+	u.rollLocked(e, now)
+	e.lastActive = now
+	return e
+}
+
+// rollLocked moves an entry to the window containing now. Own usage not
+// yet synced stays pending and is counted in the new window. Must be
+// called with u.mu held.
+func (u *sharedUsage) rollLocked(e *sharedEntry, now time.Time) {
+	index := u.windowIndex(now)
+	if index == e.window {
+		return
+	}
+	e.prevOthers = 0
+	if index == e.window+1 {
+		e.prevOthers = e.total - e.own
+	}
+	e.window = index
+	e.own, e.total = 0, 0
+}
+
+// add records n units of own usage by key, to be shared at the next sync
+func (u *sharedUsage) add(key string, n int64) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.entryLocked(key, time.Now()).pending += n
+}
+
+// others returns the usage of key by the other instances over the last
+// window. The previous fixed window is weighted by how much of it the
+// sliding window still covers.
+func (u *sharedUsage) others(key string) int64 {
+	if u == nil {
+		return 0
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	e := u.entryLocked(key, now)
+	elapsed := now.UnixNano() - e.window*int64(u.window)
+	covered := 1 - float64(elapsed)/float64(u.window)
+	return e.total - e.own + int64(float64(e.prevOthers)*covered)
+}
+
+// sync adds the pending usage of every key to the store and reads back
+// the combined usage. Keys idle for two windows are forgotten.
+func (u *sharedUsage) sync() {
+	type job struct {
+		key     string
+		window  int64
+		pending int64
+	}
+
+	now := time.Now()
+	u.mu.Lock()
+	jobs := make([]job, 0, len(u.entries))
+	for key, e := range u.entries {
+		if now.Sub(e.lastActive) > 2*u.window {
+			delete(u.entries, key)
+			continue
+		}
+		u.rollLocked(e, now)
+		jobs = append(jobs, job{key: key, window: e.window, pending: e.pending})
+		e.pending = 0
+	}
+	u.mu.Unlock()
+
+	var firstErr error
+	for _, j := range jobs {
+		storeKey := u.prefix + j.key + "/" + strconv.FormatInt(j.window, 10)
+		total, err := u.store.Incr(storeKey, j.pending, 2*u.window)
+
+		u.mu.Lock()
+		if e, exists := u.entries[j.key]; exists {
+			switch {
+			case err != nil:
+				e.pending += j.pending // Retried at the next sync
+			case e.window == j.window:
+				e.own += j.pending
+				e.total = total
+			}
+		}
+		u.mu.Unlock()
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	u.mu.Lock()
+	onError := u.onError
+	u.mu.Unlock()
+	if firstErr != nil && onError != nil {
+		onError(firstErr)
+	}
+}
+
+// syncLoop syncs until stop is closed. Usage still pending then is not
+// shared; it expires with its window anyway.
+func (u *sharedUsage) syncLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(SharedSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			u.sync()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"sort"
+)
+
+// Talker is a rate limit key (IP or prefix) with its current usage
+type Talker struct {
+	Key         string `json:"key"`
+	Bytes       int64  `json:"bytes"`
+	Connections int    `json:"connections"`
+}
+
+// TopTalkers returns the top n keys ranked by bandwidth and by connection
+// count within the current limiter windows. Usage is taken from the
+// bandwidth and connection limiters, so a dimension is empty when its
+// limiter is not configured.
+func (m *RateLimitManager) TopTalkers(n int) (byBytes, byConnections []Talker) {
+	talkers := make(map[string]*Talker)
+	get := func(key string) *Talker {
+		t, exists := talkers[key]
+		if !exists {
+			t = &Talker{Key: key}
+			talkers[key] = t
+		}
+		return t
+	}
+
+	if m.bandwidthLimiter != nil {
+		for key, bytes := range m.bandwidthLimiter.Usage() {
+			get(key).Bytes = bytes
+		}
+	}
+	if m.connLimiter != nil {
+		for key, count := range m.connLimiter.Counts() {
+			get(key).Connections = count
+		}
+	}
+
+	all := make([]Talker, 0, len(talkers))
+	for _, t := range talkers {
+		all = append(all, *t)
+	}
+
+	byBytes = topN(all, n, func(a, b Talker) bool {
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Key < b.Key
+	}, func(t Talker) bool { return t.Bytes > 0 })
+
+	byConnections = topN(all, n, func(a, b Talker) bool {
+		if a.Connections != b.Connections {
+			return a.Connections > b.Connections
+		}
+		return a.Key < b.Key
+	}, func(t Talker) bool { return t.Connections > 0 })
+
+	return byBytes, byConnections
+}
+
+// topN sorts a copy of talkers and returns the first n that pass the filter
+func topN(talkers []Talker, n int, less func(a, b Talker) bool, keep func(Talker) bool) []Talker {
+	sorted := make([]Talker, 0, len(talkers))
+	for _, t := range talkers {
+		if keep(t) {
+			sorted = append(sorted, t)
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+
+	if n > 0 && len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
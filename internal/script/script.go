@@ -0,0 +1,351 @@
+// Package script runs a listener's Lua policy script. The script defines
+// hook functions that are called as flows open, as datagrams pass and as
+// flows close, and may deny a flow, route it to another target or drop a
+// datagram. Lua states are not safe for concurrent use, so the engine
+// keeps a pool of them, each with its own copy of the script's globals.
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// Hook functions a script may define
+const (
+	HookConnect = "on_connect"
+	HookPacket  = "on_packet"
+	HookClose   = "on_close"
+)
+
+// Directions of the datagrams passed to on_packet
+const (
+	DirectionSent     = "sent"     // Client to target
+	DirectionReceived = "received" // Target to client
+)
+
+// defaultDenyReason is the reason of a denial the script gave none for
+const defaultDenyReason = "script"
+
+// Flow describes a connection or session to the hooks
+type Flow struct {
+	Listener   string
+	Protocol   string
+	FlowID     string
+	ClientIP   string
+	ClientPort int
+	Target     string
+	SNI        string // Server name of the TLS ClientHello, with the pre-hook's sni set
+	Tags       map[string]string
+}
+
+// Stats summarizes a finished flow for on_close
+type Stats struct {
+	BytesSent       int64
+	BytesReceived   int64
+	PacketsSent     int64 // UDP only
+	PacketsReceived int64 // UDP only
+	Duration        time.Duration
+	CloseReason     string // Why the proxy closed the flow, empty if it ended normally
+}
+
+// Verdict is the outcome of on_connect
+type Verdict struct {
+	Allow  bool
+	Reason string // Why the flow was denied
+	Target string // Target the script routed the flow to, empty to keep the selected one
+}
+
+// Engine runs the hooks of one listener's script
+type Engine struct {
+	listener string
+	proto    *lua.FunctionProto
+	states   chan *lua.LState
+	timeout  time.Duration
+	failOpen bool
+	hooks    map[string]bool // Hooks the script defines
+	logger   logging.Logger
+}
+
+// Check compiles the script at path, reporting syntax errors without
+// running it
+func Check(path string) error {
+	_, err := compile(path)
+	return err
+}
+
+// New loads the listener's script and runs it in a pool of Lua states,
+// one per CPU. Returns nil if no script is enabled.
+func New(listener string, cfg *config.ScriptConfig, logger logging.Logger) (*Engine, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	proto, err := compile(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Engine{
+		listener: listener,
+		proto:    proto,
+		states:   make(chan *lua.LState, runtime.GOMAXPROCS(0)),
+		timeout:  cfg.GetTimeout(),
+		failOpen: cfg.OnError == "allow",
+		hooks:    make(map[string]bool),
+		logger:   logger,
+	}
+	for i := 0; i < cap(e.states); i++ {
+		L, err := e.newState()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run %s: %w", cfg.Path, err)
+		}
+		e.states <- L
+	}
+
+	// Every state runs the same script, so any shows the hooks it defines
+	L := <-e.states
+	for _, hook := range []string{HookConnect, HookPacket, HookClose} {
+		e.hooks[hook] = L.GetGlobal(hook).Type() == lua.LTFunction
+	}
+	e.states <- L
+
+	return e, nil
+}
+
+// compile parses and compiles the script at path
+func compile(path string) (*lua.FunctionProto, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chunk, err := parse.Parse(f, path)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, path)
+}
+
+// newState creates a Lua state with the safe standard libraries and the
+// packetpony functions, and runs the script in it
+func (e *Engine) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// Scripts do not read other files
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+
+	L.SetGlobal("log", L.NewFunction(e.luaLog))
+	L.SetGlobal("cidr_match", L.NewFunction(luaCIDRMatch))
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(e.proto))
+	err := L.PCall(0, 0, nil)
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+// Has reports whether the script defines hook
+func (e *Engine) Has(hook string) bool {
+	return e != nil && e.hooks[hook]
+}
+
+// OnConnect runs on_connect for a new flow. A script that does not
+// define it allows every flow. If the hook fails, the verdict follows
+// on_error and the error is returned with it.
+func (e *Engine) OnConnect(flow Flow) (Verdict, error) {
+	if !e.Has(HookConnect) {
+		return Verdict{Allow: true}, nil
+	}
+
+	var verdict Verdict
+	err := e.call(HookConnect, func(L *lua.LState) error {
+		table := flowTable(L, flow)
+		ret, err := e.invoke(L, HookConnect, 2, table)
+		if err != nil {
+			return err
+		}
+
+		if ret[0] == lua.LFalse {
+			verdict.Reason = defaultDenyReason
+			if reason, ok := ret[1].(lua.LString); ok && reason != "" {
+				verdict.Reason = string(reason)
+			}
+			return nil
+		}
+		verdict.Allow = true
+
+		switch target := table.RawGetString("target").(type) {
+		case lua.LString:
+			if string(target) != flow.Target {
+				verdict.Target = string(target)
+			}
+		default:
+			return fmt.Errorf("flow.target must be a string, not %s", target.Type())
+		}
+		return nil
+	})
+	if err != nil {
+		return Verdict{Allow: e.failOpen, Reason: "script_error"}, err
+	}
+	return verdict, nil
+}
+
+// OnPacket runs on_packet for a datagram of a UDP session and reports
+// whether it may pass. A script that does not define it passes every
+// datagram. If the hook fails, the datagram passes as on_error says.
+func (e *Engine) OnPacket(flow Flow, payload []byte, direction string) (bool, error) {
+	if !e.Has(HookPacket) {
+		return true, nil
+	}
+
+	pass := true
+	err := e.call(HookPacket, func(L *lua.LState) error {
+		ret, err := e.invoke(L, HookPacket, 1, flowTable(L, flow), lua.LString(payload), lua.LString(direction))
+		if err != nil {
+			return err
+		}
+		pass = ret[0] != lua.LFalse
+		return nil
+	})
+	if err != nil {
+		return e.failOpen, err
+	}
+	return pass, nil
+}
+
+// OnClose runs on_close for a finished flow
+func (e *Engine) OnClose(flow Flow, stats Stats) error {
+	if !e.Has(HookClose) {
+		return nil
+	}
+
+	return e.call(HookClose, func(L *lua.LState) error {
+		summary := L.NewTable()
+		summary.RawSetString("bytes_sent", lua.LNumber(stats.BytesSent))
+		summary.RawSetString("bytes_received", lua.LNumber(stats.BytesReceived))
+		if flow.Protocol == "udp" {
+			summary.RawSetString("packets_sent", lua.LNumber(stats.PacketsSent))
+			summary.RawSetString("packets_received", lua.LNumber(stats.PacketsReceived))
+		}
+		summary.RawSetString("duration_ms", lua.LNumber(stats.Duration.Milliseconds()))
+		summary.RawSetString("close_reason", lua.LString(stats.CloseReason))
+		_, err := e.invoke(L, HookClose, 0, flowTable(L, flow), summary)
+		return err
+	})
+}
+
+// call runs fn with a state from the pool, within the hook timeout. A
+// state whose hook ran out of time may have been stopped anywhere in the
+// script, so it is replaced by a fresh one.
+func (e *Engine) call(hook string, fn func(L *lua.LState) error) error {
+	L := <-e.states
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	L.SetContext(ctx)
+	err := fn(L)
+	L.RemoveContext()
+	expired := ctx.Err() != nil
+	cancel()
+	L.SetTop(0)
+
+	if expired {
+		if fresh, freshErr := e.newState(); freshErr == nil {
+			L.Close()
+			L = fresh
+		}
+		err = fmt.Errorf("%s: timed out after %s", hook, e.timeout)
+	}
+	e.states <- L
+	return err
+}
+
+// invoke calls the hook function with args and returns its first nret
+// results
+func (e *Engine) invoke(L *lua.LState, hook string, nret int, args ...lua.LValue) ([]lua.LValue, error) {
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal(hook), NRet: nret, Protect: true}, args...)
+	if err != nil {
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			return nil, fmt.Errorf("%s: %s", hook, apiErr.Object.String())
+		}
+		return nil, fmt.Errorf("%s: %w", hook, err)
+	}
+	ret := make([]lua.LValue, nret)
+	for i := range ret {
+		ret[i] = L.Get(i - nret)
+	}
+	L.Pop(nret)
+	return ret, nil
+}
+
+// flowTable returns the flow as a Lua table
+func flowTable(L *lua.LState, flow Flow) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("listener", lua.LString(flow.Listener))
+	t.RawSetString("protocol", lua.LString(flow.Protocol))
+	t.RawSetString("flow_id", lua.LString(flow.FlowID))
+	t.RawSetString("client_ip", lua.LString(flow.ClientIP))
+	t.RawSetString("client_port", lua.LNumber(flow.ClientPort))
+	t.RawSetString("target", lua.LString(flow.Target))
+	if flow.SNI != "" {
+		t.RawSetString("sni", lua.LString(flow.SNI))
+	}
+	tags := L.NewTable()
+	for k, v := range flow.Tags {
+		tags.RawSetString(k, lua.LString(v))
+	}
+	t.RawSetString("tags", tags)
+	return t
+}
+
+// luaLog logs its argument as a script message: log(message)
+func (e *Engine) luaLog(L *lua.LState) int {
+	e.logger.LogInfo(logging.EventScriptLog, map[string]interface{}{
+		"listener": e.listener,
+		"message":  L.CheckString(1),
+	})
+	return 0
+}
+
+// luaCIDRMatch reports whether an IP is in a CIDR block:
+// cidr_match(ip, cidr). An IP that does not parse is in no block.
+func luaCIDRMatch(L *lua.LState) int {
+	ip := net.ParseIP(L.CheckString(1))
+	_, network, err := net.ParseCIDR(strings.TrimSpace(L.CheckString(2)))
+	if err != nil {
+		L.ArgError(2, "invalid CIDR")
+	}
+	L.Push(lua.LBool(ip != nil && network.Contains(ip)))
+	return 1
+}
@@ -0,0 +1,135 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/espegro/packetpony/internal/transparent"
+)
+
+// ErrTargetBackoff is returned by GetOrCreate while new sessions for a
+// target are refused after its dial failed
+var ErrTargetBackoff = errors.New("target dial failed recently, backing off")
+
+// DialPolicy controls how target dials for new sessions are retried
+type DialPolicy struct {
+	Retries           int           // Further attempts after a failed dial
+	RetryBackoff      time.Duration // Pause before the first retry, doubling
+	FailureBackoff    time.Duration // Refuse new sessions for the target this long after the attempts failed, 0 = never
+	FailureBackoffMax time.Duration // Cap of the failure backoff, which doubles per consecutive failure
+}
+
+// DialError is returned by GetOrCreate when dialing the target failed
+type DialError struct {
+	Target   string
+	Attempts int
+	Backoff  time.Duration // How long new sessions for the target are refused, 0 = not at all
+	Err      error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("failed to dial target %s after %d attempts: %v", e.Target, e.Attempts, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// dialFailure tracks a target whose dials keep failing
+type dialFailure struct {
+	failures int       // Consecutive failed dials
+	until    time.Time // End of the current backoff
+}
+
+// SetDialPolicy sets how target dials for new sessions are retried
+func (m *SessionManager) SetDialPolicy(policy DialPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dialPolicy = policy
+}
+
+// dialTargetLocked opens the target connection of a new session from
+// srcAddr. Must be called with m.mu held.
+func (m *SessionManager) dialTargetLocked(srcAddr *net.UDPAddr, targetAddr string) (*net.UDPConn, error) {
+	dialer := &net.Dialer{Timeout: m.dialTimeout}
+	if m.transparent {
+		dialer = transparent.Dialer("udp", srcAddr.IP, dialer.Timeout)
+	} else if m.bindSource != nil {
+		dialer.LocalAddr = &net.UDPAddr{IP: m.bindSource}
+	}
+	m.sockOpts.Dialer(dialer)
+	targetConn, err := m.dialLocked(dialer, targetAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn, ok := targetConn.(*net.UDPConn)
+	if !ok {
+		targetConn.Close()
+		return nil, fmt.Errorf("failed to convert to UDP connection")
+	}
+	return udpConn, nil
+}
+
+// dialLocked dials targetAddr for a new session, retrying and backing off
+// according to the dial policy. Must be called with m.mu held.
+func (m *SessionManager) dialLocked(dialer *net.Dialer, targetAddr string) (net.Conn, error) {
+	now := time.Now()
+	failure := m.dialFailures[targetAddr]
+	if failure != nil && now.Before(failure.until) {
+		return nil, ErrTargetBackoff
+	}
+
+	pause := m.dialPolicy.RetryBackoff
+	attempts := 0
+	for {
+		attempts++
+		conn, err := m.dns.DialWith(dialer, "udp", targetAddr)
+		if err == nil {
+			delete(m.dialFailures, targetAddr)
+			return conn, nil
+		}
+		if attempts > m.dialPolicy.Retries {
+			return nil, m.dialFailedLocked(targetAddr, failure, attempts, err)
+		}
+		time.Sleep(pause)
+		pause *= 2
+	}
+}
+
+// dialFailedLocked starts or extends the backoff of a target whose dial
+// failed. Must be called with m.mu held.
+func (m *SessionManager) dialFailedLocked(targetAddr string, failure *dialFailure, attempts int, err error) error {
+	dialErr := &DialError{Target: targetAddr, Attempts: attempts, Err: err}
+	if m.dialPolicy.FailureBackoff <= 0 {
+		return dialErr
+	}
+	if failure == nil {
+		failure = &dialFailure{}
+		m.dialFailures[targetAddr] = failure
+	}
+
+	backoff := m.dialPolicy.FailureBackoff
+	for i := 0; i < failure.failures && backoff < m.dialPolicy.FailureBackoffMax; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, m.dialPolicy.FailureBackoffMax)
+
+	failure.failures++
+	failure.until = time.Now().Add(backoff)
+	dialErr.Backoff = backoff
+	return dialErr
+}
+
+// pruneDialFailuresLocked forgets targets that have not failed for longer
+// than the maximum backoff, so their next failure starts over. Must be
+// called with m.mu held.
+func (m *SessionManager) pruneDialFailuresLocked(now time.Time) {
+	for target, failure := range m.dialFailures {
+		if now.Sub(failure.until) > m.dialPolicy.FailureBackoffMax {
+			delete(m.dialFailures, target)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"time"
+)
+
+// ErrKeyTaken is returned by Restore when a session already uses one of
+// the saved session's keys
+var ErrKeyTaken = errors.New("session key already in use")
+
+// Saved is the state of a session kept across a restart. The target
+// connection is dialed again on restore; anything else not listed here,
+// such as pending DNS queries or reply credit, starts over.
+type Saved struct {
+	Key                  string            `json:"key"`
+	Aliases              []string          `json:"aliases,omitempty"`
+	Source               string            `json:"source"`
+	Peer                 string            `json:"peer"`
+	Target               string            `json:"target"`
+	Backend              string            `json:"backend,omitempty"`
+	FlowID               string            `json:"flow_id"`
+	SampleRate           int               `json:"sample_rate"`
+	AppProtocol          string            `json:"app_protocol,omitempty"`
+	ConnectionID         string            `json:"connection_id,omitempty"`
+	Tags                 map[string]string `json:"tags,omitempty"`
+	CreatedAt            time.Time         `json:"created_at"`
+	LastPeriodicLog      time.Time         `json:"last_periodic_log"`
+	LastPeriodicLogBytes int64             `json:"last_periodic_log_bytes"`
+	BytesSent            int64             `json:"bytes_sent"`
+	BytesReceived        int64             `json:"bytes_received"`
+	PacketsSent          int64             `json:"packets_sent"`
+	PacketsReceived      int64             `json:"packets_received"`
+	Rebinds              int64             `json:"rebinds,omitempty"`
+}
+
+// save returns the state of the session to restore after a restart. Must
+// be called with the manager locked, which guards the aliases.
+func (s *Session) save() Saved {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Saved{
+		Key:                  s.ID,
+		Aliases:              slices.Clone(s.aliases),
+		Source:               s.SourceAddr.String(),
+		Peer:                 s.Peer().String(),
+		Target:               s.TargetAddress,
+		Backend:              s.Backend,
+		FlowID:               s.FlowID,
+		SampleRate:           s.SampleRate,
+		AppProtocol:          s.AppProtocol,
+		ConnectionID:         s.ConnectionID(),
+		Tags:                 s.Tags,
+		CreatedAt:            s.CreatedAt,
+		LastPeriodicLog:      s.LastPeriodicLog,
+		LastPeriodicLogBytes: s.LastPeriodicLogBytes,
+		BytesSent:            s.BytesSent.Load(),
+		BytesReceived:        s.BytesReceived.Load(),
+		PacketsSent:          s.PacketsSent.Load(),
+		PacketsReceived:      s.PacketsReceived.Load(),
+		Rebinds:              s.Rebinds.Load(),
+	}
+}
+
+// Save returns the state of every session
+func (m *SessionManager) Save() []Saved {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	saved := make([]Saved, 0, len(m.sessions)-m.aliases)
+	for key, session := range m.sessions {
+		if key == session.ID {
+			saved = append(saved, session.save())
+		}
+	}
+	return saved
+}
+
+// Restore recreates a saved session under its keys, dialing its target
+// again. The session's idle timeout starts over. Session limits apply as
+// for new sessions.
+func (m *SessionManager) Restore(saved Saved) (*Session, error) {
+	srcAddr, err := net.ResolveUDPAddr("udp", saved.Source)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := net.ResolveUDPAddr("udp", saved.Peer)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.draining {
+		return nil, ErrDraining
+	}
+	for _, key := range append([]string{saved.Key}, saved.Aliases...) {
+		if _, taken := m.sessions[key]; taken {
+			return nil, ErrKeyTaken
+		}
+	}
+	if err := m.checkLimitsLocked(srcAddr); err != nil {
+		return nil, err
+	}
+	conn, err := m.dialTargetLocked(srcAddr, saved.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	session := m.addLocked(saved.Key, srcAddr, saved.Target, saved.Backend, conn)
+	session.peer.Store(peer)
+	session.FlowID = saved.FlowID
+	session.SampleRate = saved.SampleRate
+	session.AppProtocol = saved.AppProtocol
+	session.Tags = saved.Tags
+	if saved.ConnectionID != "" {
+		session.SetConnectionID(saved.ConnectionID)
+	}
+	session.CreatedAt = saved.CreatedAt
+	session.LastPeriodicLog = saved.LastPeriodicLog
+	session.LastPeriodicLogBytes = saved.LastPeriodicLogBytes
+	session.BytesSent.Store(saved.BytesSent)
+	session.BytesReceived.Store(saved.BytesReceived)
+	session.PacketsSent.Store(saved.PacketsSent)
+	session.PacketsReceived.Store(saved.PacketsReceived)
+	session.Rebinds.Store(saved.Rebinds)
+
+	for _, alias := range saved.Aliases {
+		m.sessions[alias] = session
+		session.aliases = append(session.aliases, alias)
+		m.aliases++
+	}
+	m.resizedLocked()
+	return session, nil
+}
@@ -1,48 +1,109 @@
 // Package session provides UDP session tracking and management.
-// Sessions are identified by source IP:port and maintain bidirectional communication state.
+// Sessions are identified by a key derived from their datagrams, by default
+// the source IP:port, and maintain bidirectional communication state.
 package session
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/espegro/packetpony/internal/accounting"
+	"github.com/espegro/packetpony/internal/dns"
+	"github.com/espegro/packetpony/internal/dnswire"
+	"github.com/espegro/packetpony/internal/mirror"
+	"github.com/espegro/packetpony/internal/sockopt"
+	"github.com/espegro/packetpony/internal/tracing"
+)
+
+// Errors returned by GetOrCreate when a session limit is reached
+var (
+	ErrMaxSessions      = errors.New("maximum sessions reached")
+	ErrMaxSessionsPerIP = errors.New("maximum sessions per IP reached")
+	ErrDraining         = errors.New("session manager is draining")
 )
 
 // SessionManager manages UDP sessions
 type SessionManager struct {
-	mu          sync.RWMutex
-	sessions    map[string]*Session
-	timeout     time.Duration
-	stopCleanup chan struct{}
+	mu            sync.RWMutex
+	sessions      map[string]*Session // Keyed by ID and by any aliases
+	aliases       int                 // Alias entries in sessions
+	perIP         map[string]int      // source IP -> session count
+	timeout       time.Duration
+	maxSessions   int // 0 = unlimited
+	maxSessionsIP int // 0 = unlimited
+	draining      bool
+	dns           *dns.Resolver // Resolves hostname targets when dialing
+	transparent   bool          // Dial targets from the client's address
+	dialTimeout   time.Duration
+	bindSource    net.IP // Source address of target sockets, nil = chosen by the kernel
+	sockOpts      *sockopt.Options
+	dialPolicy    DialPolicy
+	dialFailures  map[string]*dialFailure // By target address, while backing off
+	stopCleanup   chan struct{}
+	closeOnce     sync.Once
+	onResize      func(entries int) // Called with m.mu held when the map changes size
 }
 
 // Session represents a UDP session
 type Session struct {
 	ID                   string
-	SourceAddr           *net.UDPAddr
+	FlowID               string
+	SampleRate           int          // Rate the session was sampled at for logging and histograms, 0 = not sampled
+	AppProtocol          string       // detected application protocol, empty unless classify is enabled
+	SourceAddr           *net.UDPAddr // Address that opened the session
+	TargetAddress        string
+	Backend              string // Balanced target the session was assigned to, if any
+	MaxPayload           int    // Largest datagram that fits the path MTU toward the target, 0 = unchecked
 	TargetConn           *net.UDPConn
 	LastActivity         time.Time
-	BytesSent            int64
-	BytesReceived        int64
-	PacketsSent          int64
-	PacketsReceived      int64
+	BytesSent            atomic.Int64
+	BytesReceived        atomic.Int64
+	PacketsSent          atomic.Int64
+	PacketsReceived      atomic.Int64
+	Rebinds              atomic.Int64 // Times replies moved to a new client address
 	CreatedAt            time.Time
 	LastPeriodicLog      time.Time
 	LastPeriodicLogBytes int64
+	Tags                 map[string]string
+	Meter                *accounting.Meter           // nil unless accounting is enabled
+	Mirror               *mirror.Conn                // nil unless mirror_target is set
+	Span                 *tracing.Span               // nil unless the session is traced
+	DNS                  *dnswire.Tracker            // nil unless protocol_hint is dns
+	peer                 atomic.Pointer[net.UDPAddr] // Latest source address, where replies go
+	connectionID         atomic.Pointer[string]      // Hex DTLS or QUIC connection ID the session is keyed by
+	aliases              []string                    // Further keys of the session, guarded by the manager
+	replyCredit          atomic.Int64                // Replies the target may still send, see GrantReplies
+	closeReason          string
 	ctx                  context.Context
 	cancel               context.CancelFunc
 	mu                   sync.Mutex
 }
 
-// NewSessionManager creates a new session manager
-func NewSessionManager(timeout time.Duration) *SessionManager {
+// NewSessionManager creates a new session manager.
+// maxSessions and maxSessionsPerIP bound the session table (0 = unlimited).
+// Hostname targets are resolved through dnsResolver, within dialTimeout.
+// With transparent set, target connections use the client's IP as their
+// source address, else bindSource if it is not nil. sockOpts are set on
+// target sockets (nil = none).
+func NewSessionManager(timeout time.Duration, maxSessions, maxSessionsPerIP int, dnsResolver *dns.Resolver, dialTimeout time.Duration, transparent bool, bindSource net.IP, sockOpts *sockopt.Options) *SessionManager {
 	manager := &SessionManager{
-		sessions:    make(map[string]*Session),
-		timeout:     timeout,
-		stopCleanup: make(chan struct{}),
+		dns:           dnsResolver,
+		transparent:   transparent,
+		dialTimeout:   dialTimeout,
+		bindSource:    bindSource,
+		sockOpts:      sockOpts,
+		sessions:      make(map[string]*Session),
+		perIP:         make(map[string]int),
+		dialFailures:  make(map[string]*dialFailure),
+		timeout:       timeout,
+		maxSessions:   maxSessions,
+		maxSessionsIP: maxSessionsPerIP,
+		stopCleanup:   make(chan struct{}),
 	}
 
 	// Start cleanup goroutine
@@ -51,10 +112,9 @@ func NewSessionManager(timeout time.Duration) *SessionManager {
 	return manager
 }
 
-// GetOrCreate gets an existing session or creates a new one
-func (m *SessionManager) GetOrCreate(srcAddr *net.UDPAddr, targetAddr string) (*Session, bool, error) {
-	key := sessionKey(srcAddr)
-
+// GetOrCreate gets the session for key or creates one for srcAddr.
+// resolveTarget is only called when a new session needs a target connection.
+func (m *SessionManager) GetOrCreate(key string, srcAddr *net.UDPAddr, resolveTarget func() (target, backend string, err error)) (*Session, bool, error) {
 	// Check if session exists
 	m.mu.RLock()
 	session, exists := m.sessions[key]
@@ -76,25 +136,54 @@ func (m *SessionManager) GetOrCreate(srcAddr *net.UDPAddr, targetAddr string) (*
 		return session, false, nil
 	}
 
+	// Refuse new sessions while draining
+	if m.draining {
+		return nil, false, ErrDraining
+	}
+
+	// Enforce session limits before dialing the target
+	if err := m.checkLimitsLocked(srcAddr); err != nil {
+		return nil, false, err
+	}
+
 	// Create target connection
-	targetConn, err := net.DialTimeout("udp", targetAddr, 5*time.Second)
+	targetAddr, backend, err := resolveTarget()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to select target: %w", err)
+	}
+	udpConn, err := m.dialTargetLocked(srcAddr, targetAddr)
 	if err != nil {
-		return nil, false, fmt.Errorf("failed to dial target: %w", err)
+		return nil, false, err
 	}
 
-	udpConn, ok := targetConn.(*net.UDPConn)
-	if !ok {
-		targetConn.Close()
-		return nil, false, fmt.Errorf("failed to convert to UDP connection")
+	session = m.addLocked(key, srcAddr, targetAddr, backend, udpConn)
+	return session, true, nil
+}
+
+// checkLimitsLocked returns an error if a new session from srcAddr would
+// exceed a session limit. Must be called with m.mu held.
+func (m *SessionManager) checkLimitsLocked(srcAddr *net.UDPAddr) error {
+	if m.maxSessions > 0 && len(m.sessions)-m.aliases >= m.maxSessions {
+		return ErrMaxSessions
+	}
+	if m.maxSessionsIP > 0 && m.perIP[srcAddr.IP.String()] >= m.maxSessionsIP {
+		return ErrMaxSessionsPerIP
 	}
+	return nil
+}
 
+// addLocked registers a new session for key with its target connection.
+// Must be called with m.mu held.
+func (m *SessionManager) addLocked(key string, srcAddr *net.UDPAddr, targetAddr, backend string, conn *net.UDPConn) *Session {
 	ctx, cancel := context.WithCancel(context.Background())
 	now := time.Now()
 
-	session = &Session{
+	session := &Session{
 		ID:                   key,
 		SourceAddr:           srcAddr,
-		TargetConn:           udpConn,
+		TargetAddress:        targetAddr,
+		Backend:              backend,
+		TargetConn:           conn,
 		LastActivity:         now,
 		CreatedAt:            now,
 		LastPeriodicLog:      now,
@@ -102,16 +191,16 @@ func (m *SessionManager) GetOrCreate(srcAddr *net.UDPAddr, targetAddr string) (*
 		ctx:                  ctx,
 		cancel:               cancel,
 	}
+	session.peer.Store(srcAddr)
 
 	m.sessions[key] = session
-
-	return session, true, nil
+	m.perIP[srcAddr.IP.String()]++
+	m.resizedLocked()
+	return session
 }
 
 // Get retrieves an existing session
-func (m *SessionManager) Get(srcAddr *net.UDPAddr) (*Session, bool) {
-	key := sessionKey(srcAddr)
-
+func (m *SessionManager) Get(key string) (*Session, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -123,6 +212,43 @@ func (m *SessionManager) Get(srcAddr *net.UDPAddr) (*Session, bool) {
 	return session, exists
 }
 
+// Alias adds key as a further key of session, so datagrams keyed either
+// way reach it. Returns false if the session is gone or key is taken.
+func (m *SessionManager) Alias(key string, session *Session) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sessions[session.ID] != session {
+		return false
+	}
+	if _, taken := m.sessions[key]; taken {
+		return false
+	}
+	m.sessions[key] = session
+	session.aliases = append(session.aliases, key)
+	m.aliases++
+	m.resizedLocked()
+	return true
+}
+
+// OnResize registers a callback invoked with the number of session map
+// entries, aliases included, whenever it changes. It runs with the
+// manager locked and must not call back into it.
+func (m *SessionManager) OnResize(fn func(entries int)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onResize = fn
+	m.resizedLocked()
+}
+
+// resizedLocked reports the map size to the OnResize callback. Must be
+// called with m.mu held.
+func (m *SessionManager) resizedLocked() {
+	if m.onResize != nil {
+		m.onResize(len(m.sessions))
+	}
+}
+
 // Remove removes a session from the manager
 func (m *SessionManager) Remove(sessionID string) *Session {
 	m.mu.Lock()
@@ -133,12 +259,20 @@ func (m *SessionManager) Remove(sessionID string) *Session {
 		return nil
 	}
 
-	delete(m.sessions, sessionID)
+	m.deleteLocked(session)
 	session.cancel()
 
 	return session
 }
 
+// Discard removes a session that was refused before it was admitted and
+// closes its target connection, which GetOrCreate has already dialed
+func (m *SessionManager) Discard(sessionID string) {
+	if session := m.Remove(sessionID); session != nil {
+		session.TargetConn.Close()
+	}
+}
+
 // cleanupLoop periodically removes expired sessions
 func (m *SessionManager) cleanupLoop() {
 	ticker := time.NewTicker(m.timeout / 2)
@@ -154,28 +288,41 @@ func (m *SessionManager) cleanupLoop() {
 	}
 }
 
-// cleanup removes expired sessions
+// cleanup removes expired sessions and targets done backing off
 func (m *SessionManager) cleanup() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	now := time.Now()
 	for key, session := range m.sessions {
+		if key != session.ID {
+			continue // Expired with its primary entry
+		}
 		session.mu.Lock()
 		lastActivity := session.LastActivity
 		session.mu.Unlock()
 
 		if now.Sub(lastActivity) > m.timeout {
-			delete(m.sessions, key)
+			m.deleteLocked(session)
 			session.cancel()
 			session.TargetConn.Close()
+			session.Mirror.Close()
 		}
 	}
+	m.pruneDialFailuresLocked(now)
 }
 
-// Close closes all sessions and stops the cleanup goroutine
+// Close closes all sessions and stops the cleanup goroutine. Only the
+// first call has any effect.
 func (m *SessionManager) Close() {
-	close(m.stopCleanup)
+	first := false
+	m.closeOnce.Do(func() {
+		close(m.stopCleanup)
+		first = true
+	})
+	if !first {
+		return
+	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -183,8 +330,59 @@ func (m *SessionManager) Close() {
 	for _, session := range m.sessions {
 		session.cancel()
 		session.TargetConn.Close()
+		session.Mirror.Close()
 	}
 	m.sessions = make(map[string]*Session)
+	m.aliases = 0
+	m.perIP = make(map[string]int)
+	m.resizedLocked()
+}
+
+// Drain stops new sessions from being created. Existing sessions continue
+// until they expire or are closed.
+func (m *SessionManager) Drain() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.draining = true
+}
+
+// Sessions returns a snapshot of all active sessions
+func (m *SessionManager) Sessions() []*Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(m.sessions)-m.aliases)
+	for key, session := range m.sessions {
+		if key == session.ID {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// Count returns the number of active sessions
+func (m *SessionManager) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions) - m.aliases
+}
+
+// deleteLocked removes a session under all its keys and updates the
+// per-IP count. Must be called with m.mu held.
+func (m *SessionManager) deleteLocked(session *Session) {
+	delete(m.sessions, session.ID)
+	for _, alias := range session.aliases {
+		delete(m.sessions, alias)
+	}
+	m.aliases -= len(session.aliases)
+	m.resizedLocked()
+
+	sourceIP := session.SourceAddr.IP.String()
+	if m.perIP[sourceIP] <= 1 {
+		delete(m.perIP, sourceIP)
+	} else {
+		m.perIP[sourceIP]--
+	}
 }
 
 // UpdateActivity updates the last activity timestamp
@@ -194,32 +392,107 @@ func (s *Session) UpdateActivity() {
 	s.LastActivity = time.Now()
 }
 
+// Peer returns the address replies are sent to
+func (s *Session) Peer() *net.UDPAddr {
+	return s.peer.Load()
+}
+
+// SetPeer moves the session to the client's latest source address.
+// Returns true if it changed.
+func (s *Session) SetPeer(addr *net.UDPAddr) bool {
+	current := s.peer.Load()
+	if current.Port == addr.Port && current.IP.Equal(addr.IP) {
+		return false
+	}
+	s.peer.Store(addr)
+	return true
+}
+
+// ConnectionID returns the hex DTLS or QUIC connection ID the session is
+// keyed by, or "" if it has none
+func (s *Session) ConnectionID() string {
+	if id := s.connectionID.Load(); id != nil {
+		return *id
+	}
+	return ""
+}
+
+// SetConnectionID records the connection ID the session is keyed by. The
+// first one sticks; later IDs are aliases of the same session.
+func (s *Session) SetConnectionID(id string) {
+	s.connectionID.CompareAndSwap(nil, &id)
+}
+
 // AddBytesSent atomically adds to bytes sent counter
 func (s *Session) AddBytesSent(bytes int64) {
-	atomic.AddInt64(&s.BytesSent, bytes)
+	s.BytesSent.Add(bytes)
 }
 
 // AddBytesReceived atomically adds to bytes received counter
 func (s *Session) AddBytesReceived(bytes int64) {
-	atomic.AddInt64(&s.BytesReceived, bytes)
+	s.BytesReceived.Add(bytes)
 }
 
 // AddPacketsSent atomically adds to packets sent counter
 func (s *Session) AddPacketsSent(count int64) {
-	atomic.AddInt64(&s.PacketsSent, count)
+	s.PacketsSent.Add(count)
 }
 
 // AddPacketsReceived atomically adds to packets received counter
 func (s *Session) AddPacketsReceived(count int64) {
-	atomic.AddInt64(&s.PacketsReceived, count)
+	s.PacketsReceived.Add(count)
+}
+
+// GrantReplies allows the target count more replies, keeping at most max
+// unused
+func (s *Session) GrantReplies(count, max int64) {
+	for {
+		credit := s.replyCredit.Load()
+		next := min(credit+count, max)
+		if next <= credit || s.replyCredit.CompareAndSwap(credit, next) {
+			return
+		}
+	}
+}
+
+// TakeReply uses up one allowed reply. Returns false if none is left.
+func (s *Session) TakeReply() bool {
+	for {
+		credit := s.replyCredit.Load()
+		if credit <= 0 {
+			return false
+		}
+		if s.replyCredit.CompareAndSwap(credit, credit-1) {
+			return true
+		}
+	}
 }
 
 // GetStats returns the session statistics
 func (s *Session) GetStats() (bytesSent, bytesReceived, packetsSent, packetsReceived int64) {
-	return atomic.LoadInt64(&s.BytesSent),
-		atomic.LoadInt64(&s.BytesReceived),
-		atomic.LoadInt64(&s.PacketsSent),
-		atomic.LoadInt64(&s.PacketsReceived)
+	return s.BytesSent.Load(),
+		s.BytesReceived.Load(),
+		s.PacketsSent.Load(),
+		s.PacketsReceived.Load()
+}
+
+// SetCloseReason records why the session is being forcibly closed.
+// Returns false if a reason was already set.
+func (s *Session) SetCloseReason(reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closeReason != "" {
+		return false
+	}
+	s.closeReason = reason
+	return true
+}
+
+// GetCloseReason returns the forced close reason, if any
+func (s *Session) GetCloseReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeReason
 }
 
 // Context returns the session context
@@ -240,7 +513,7 @@ func (s *Session) ShouldLogPeriodic(intervalDuration time.Duration, intervalByte
 	defer s.mu.Unlock()
 
 	now := time.Now()
-	totalBytes := atomic.LoadInt64(&s.BytesSent) + atomic.LoadInt64(&s.BytesReceived)
+	totalBytes := s.BytesSent.Load() + s.BytesReceived.Load()
 
 	// Check time-based threshold
 	if intervalDuration > 0 && now.Sub(s.LastPeriodicLog) >= intervalDuration {
@@ -261,7 +534,7 @@ func (s *Session) UpdatePeriodicLog() {
 	defer s.mu.Unlock()
 
 	s.LastPeriodicLog = time.Now()
-	s.LastPeriodicLogBytes = atomic.LoadInt64(&s.BytesSent) + atomic.LoadInt64(&s.BytesReceived)
+	s.LastPeriodicLogBytes = s.BytesSent.Load() + s.BytesReceived.Load()
 }
 
 // GetCreatedAt returns the session creation time safely
@@ -270,8 +543,3 @@ func (s *Session) GetCreatedAt() time.Time {
 	defer s.mu.Unlock()
 	return s.CreatedAt
 }
-
-// sessionKey generates a unique key for a UDP session
-func sessionKey(addr *net.UDPAddr) string {
-	return addr.String()
-}
@@ -0,0 +1,169 @@
+// Package signature matches the data clients send against byte patterns
+// of known exploit payloads, for basic inline filtering in front of
+// backends that cannot be patched at once. Each pattern may be bounded to
+// a range of the data, counted from the start of a TCP stream or of a UDP
+// datagram. It is a stopgap, not an IDS: patterns are matched literally,
+// so an attacker who varies the payload gets past them.
+package signature
+
+import (
+	"bytes"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// Rule is a compiled signature
+type Rule struct {
+	Name    string
+	Drop    bool // Drop the flow or datagram, rather than only log it
+	pattern []byte
+	offset  int64
+	end     int64 // Offset the pattern must end by, -1 = no limit
+}
+
+// Set holds the signatures of a listener
+type Set struct {
+	rules   []*Rule
+	longest int // Longest pattern
+}
+
+// New compiles the signatures of a listener. Returns nil if there are
+// none. The signatures must have passed validation.
+func New(cfg []config.Signature) *Set {
+	if len(cfg) == 0 {
+		return nil
+	}
+	s := &Set{}
+	for _, sig := range cfg {
+		rule := &Rule{
+			Name:    sig.Name,
+			Drop:    sig.GetAction() == config.SignatureActionDrop,
+			pattern: sig.GetPattern(),
+			offset:  int64(sig.Offset),
+			end:     -1,
+		}
+		if sig.Depth > 0 {
+			rule.end = int64(sig.Offset + sig.Depth)
+		}
+		s.rules = append(s.rules, rule)
+		s.longest = max(s.longest, len(rule.pattern))
+	}
+	return s
+}
+
+// Match returns the signatures a datagram matches, in order, up to and
+// including the first that drops it
+func (s *Set) Match(payload []byte) []*Rule {
+	if s == nil {
+		return nil
+	}
+	var matched []*Rule
+	for _, rule := range s.rules {
+		if rule.find(payload, 0) {
+			matched = append(matched, rule)
+			if rule.Drop {
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// find reports whether the pattern lies within its range in buf, which
+// holds the data from offset start on
+func (r *Rule) find(buf []byte, start int64) bool {
+	lo := max(r.offset-start, 0)
+	hi := int64(len(buf))
+	if r.end >= 0 {
+		hi = min(hi, r.end-start)
+	}
+	if hi-lo < int64(len(r.pattern)) {
+		return false
+	}
+	return bytes.Contains(buf[lo:hi], r.pattern)
+}
+
+// Stream matches the signatures against the data of one TCP stream, read
+// in chunks. Patterns split across chunks are found too. A Stream is not
+// safe for concurrent use.
+type Stream struct {
+	set     *Set
+	pos     int64  // Offset of the next chunk
+	tail    []byte // Last bytes of the data so far, shorter than the longest pattern
+	matched []bool // Signatures already reported
+	left    int    // Signatures that can still match
+}
+
+// Stream starts matching a new stream. Returns nil if the set is nil.
+func (s *Set) Stream() *Stream {
+	if s == nil {
+		return nil
+	}
+	return &Stream{
+		set:     s,
+		matched: make([]bool, len(s.rules)),
+		left:    len(s.rules),
+	}
+}
+
+// Scan matches the next chunk of the stream. It returns the signatures
+// matched for the first time, in order, up to and including the first
+// that drops the stream. Each signature is reported once per stream.
+func (st *Stream) Scan(data []byte) []*Rule {
+	if st == nil || st.left == 0 || len(data) == 0 {
+		return nil
+	}
+
+	// Patterns that started in earlier chunks end within the first bytes
+	// of this one
+	var joined []byte
+	if len(st.tail) > 0 {
+		joined = append(st.tail, data[:min(len(data), st.set.longest-1)]...)
+	}
+	joinedStart := st.pos - int64(len(st.tail))
+
+	var matched []*Rule
+	for i, rule := range st.set.rules {
+		if st.matched[i] {
+			continue
+		}
+		if rule.end >= 0 && rule.end <= joinedStart {
+			// Past its range; it can no longer match
+			st.matched[i] = true
+			st.left--
+			continue
+		}
+		if rule.find(data, st.pos) || (joined != nil && rule.find(joined, joinedStart)) {
+			st.matched[i] = true
+			st.left--
+			matched = append(matched, rule)
+			if rule.Drop {
+				break
+			}
+		}
+	}
+
+	st.pos += int64(len(data))
+	st.keepTail(joined, data)
+	return matched
+}
+
+// keepTail keeps the last bytes of the stream, which a pattern ending in
+// the next chunk may start in. joined holds the previous tail followed by
+// the first bytes of data, or is nil if there was no tail.
+func (st *Stream) keepTail(joined, data []byte) {
+	n := st.set.longest - 1
+	if st.left == 0 || n == 0 {
+		st.tail = nil
+		return
+	}
+	if len(data) >= n {
+		st.tail = append(st.tail[:0], data[len(data)-n:]...)
+		return
+	}
+	// The chunk is shorter than the tail: joined ends with all of it
+	if joined == nil {
+		joined = data
+	}
+	st.tail = append(st.tail[:0], joined[max(len(joined)-n, 0):]...)
+}
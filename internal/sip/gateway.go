@@ -0,0 +1,320 @@
+package sip
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+	"github.com/espegro/packetpony/internal/metrics"
+)
+
+// Reasons a call's relay is closed
+const (
+	closeBye      = "bye"
+	closeCancel   = "cancel"
+	closeRejected = "rejected"
+	closeTimeout  = "timeout"
+	closeShutdown = "shutdown"
+)
+
+// Results counted in packetpony_sip_calls_total
+const (
+	resultRelayed  = "relayed"
+	resultMaxCalls = "max_calls"
+	resultNoPorts  = "no_ports"
+)
+
+// Gateway rewrites the SDP of the SIP messages a listener proxies and
+// relays the media of their calls. Calls are keyed by client IP and
+// Call-ID, so one client cannot end another's call.
+type Gateway struct {
+	listener string
+	ip       net.IP
+	ports    *portPool
+	timeout  time.Duration
+	maxCalls int
+	logger   logging.Logger
+	metrics  *metrics.ProxyMetrics
+	counters counters
+	mu       sync.Mutex
+	calls    map[string]*call
+	wg       sync.WaitGroup
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewGateway creates the media relay of a listener, or returns nil unless
+// its protocol_hint is sip. Methods on a nil Gateway pass messages through.
+func NewGateway(cfg *config.ListenerConfig, logger logging.Logger, metricsCollector *metrics.ProxyMetrics) *Gateway {
+	if cfg.ProtocolHint != config.ProtocolHintSIP || cfg.SIP == nil {
+		return nil
+	}
+	first, last, _ := cfg.SIP.MediaPortRange()
+	ip := cfg.SIP.MediaIP(cfg.ListenAddress)
+	g := &Gateway{
+		listener: cfg.Name,
+		ip:       ip,
+		ports:    newPortPool(ip, first, last),
+		timeout:  cfg.SIP.GetMediaTimeout(),
+		maxCalls: cfg.SIP.MaxCalls,
+		logger:   logger,
+		metrics:  metricsCollector,
+		counters: counters{
+			sent:          metricsCollector.SIPMediaPackets.WithLabelValues(cfg.Name, "sent"),
+			received:      metricsCollector.SIPMediaPackets.WithLabelValues(cfg.Name, "received"),
+			unknownSource: metricsCollector.SIPMediaDropped.WithLabelValues(cfg.Name, "unknown_source"),
+			noPeer:        metricsCollector.SIPMediaDropped.WithLabelValues(cfg.Name, "no_peer"),
+			writeError:    metricsCollector.SIPMediaDropped.WithLabelValues(cfg.Name, "write_error"),
+		},
+		calls: make(map[string]*call),
+		stop:  make(chan struct{}),
+	}
+	go g.reap()
+	return g
+}
+
+// FromClient processes a datagram from the client on its way to the
+// target, returning it with its SDP rewritten to the call's relay
+func (g *Gateway) FromClient(data []byte, clientIP, targetIP net.IP) []byte {
+	return g.process(data, true, clientIP, targetIP)
+}
+
+// FromTarget processes a datagram from the target on its way to the
+// client, returning it with its SDP rewritten to the call's relay
+func (g *Gateway) FromTarget(data []byte, clientIP, targetIP net.IP) []byte {
+	return g.process(data, false, clientIP, targetIP)
+}
+
+// process follows the calls of SIP messages in either direction
+func (g *Gateway) process(data []byte, fromClient bool, clientIP, targetIP net.IP) []byte {
+	if g == nil {
+		return data
+	}
+	m := parseMessage(data)
+	if m == nil {
+		return data
+	}
+	id := m.header("Call-ID", "i")
+	if id == "" {
+		return data
+	}
+	key := clientIP.String() + " " + id
+
+	method, status := m.method(), m.status()
+	switch {
+	case method == "BYE":
+		g.end(key, closeBye)
+		return data
+	case method == "CANCEL":
+		g.end(key, closeCancel)
+		return data
+	case status >= 300 && status != 401 && status != 407 && m.cseqMethod() == "INVITE":
+		// A failed initial INVITE ends the call; a failed re-INVITE keeps
+		// the media it had. Authentication challenges are retried.
+		g.mu.Lock()
+		c := g.calls[key]
+		answered := c != nil && c.answered
+		g.mu.Unlock()
+		if !answered {
+			g.end(key, closeRejected)
+		}
+		return data
+	}
+
+	if !m.hasSDP() {
+		g.mu.Lock()
+		if c := g.calls[key]; c != nil {
+			c.touch()
+		}
+		g.mu.Unlock()
+		return data
+	}
+	body, ok := g.relay(key, id, m.body, fromClient, status > 0, clientIP, targetIP)
+	if !ok {
+		return data
+	}
+	return m.withBody(body)
+}
+
+// relay points the media descriptions of an SDP offer or answer at the
+// call's relay, opening the call and its streams as needed. Returns false
+// if the media cannot be relayed and the message is passed on unchanged.
+func (g *Gateway) relay(key, id string, body []byte, fromClient, answer bool, clientIP, targetIP net.IP) ([]byte, bool) {
+	medias := parseSDP(body)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c := g.calls[key]
+	opened := c == nil
+	if opened {
+		if g.maxCalls > 0 && len(g.calls) >= g.maxCalls {
+			g.failed(id, clientIP, resultMaxCalls)
+			return nil, false
+		}
+		c = &call{id: id, clientIP: clientIP, targetIP: targetIP, opened: time.Now()}
+	}
+
+	ports := make([]int, len(medias))
+	for i, md := range medias {
+		if md.rtp == nil {
+			continue
+		}
+		for len(c.streams) <= i {
+			c.streams = append(c.streams, nil)
+		}
+		s := c.streams[i]
+		if s == nil {
+			var err error
+			if s, err = g.openStream(c); err != nil {
+				if opened {
+					g.closeSockets(c)
+				}
+				g.failed(id, clientIP, resultNoPorts)
+				return nil, false
+			}
+			c.streams[i] = s
+		}
+		if fromClient {
+			s.rtp.clientPeer.Store(md.rtp)
+			s.rtcp.clientPeer.Store(md.rtcp)
+			ports[i] = s.targetPort
+		} else {
+			s.rtp.targetPeer.Store(md.rtp)
+			s.rtcp.targetPeer.Store(md.rtcp)
+			ports[i] = s.clientPort
+		}
+	}
+	if answer {
+		c.answered = true
+	}
+	c.touch()
+
+	if opened {
+		g.calls[key] = c
+		g.metrics.SIPCallsActive.WithLabelValues(g.listener).Inc()
+		g.metrics.SIPCalls.WithLabelValues(g.listener, resultRelayed).Inc()
+		g.logger.LogInfo(logging.EventSIPRelayOpened, map[string]interface{}{
+			"listener":  g.listener,
+			"call_id":   id,
+			"client_ip": clientIP.String(),
+			"streams":   len(medias),
+		})
+	}
+	return rewriteSDP(body, g.ip, ports), true
+}
+
+// openStream opens the client and target sockets of a media stream and
+// starts relaying. Must be called with g.mu held.
+func (g *Gateway) openStream(c *call) (*stream, error) {
+	clientRTP, clientRTCP, err := g.ports.open()
+	if err != nil {
+		return nil, err
+	}
+	targetRTP, targetRTCP, err := g.ports.open()
+	if err != nil {
+		clientRTP.Close()
+		clientRTCP.Close()
+		g.ports.release(clientRTP.LocalAddr().(*net.UDPAddr).Port)
+		return nil, err
+	}
+	s := &stream{
+		rtp:        pipe{client: clientRTP, target: targetRTP},
+		rtcp:       pipe{client: clientRTCP, target: targetRTCP},
+		clientPort: clientRTP.LocalAddr().(*net.UDPAddr).Port,
+		targetPort: targetRTP.LocalAddr().(*net.UDPAddr).Port,
+	}
+	for _, p := range []*pipe{&s.rtp, &s.rtcp} {
+		g.wg.Add(2)
+		go g.forward(c, p.client, p.target, &p.clientPeer, &p.targetPeer, c.clientIP, g.counters.sent)
+		go g.forward(c, p.target, p.client, &p.targetPeer, &p.clientPeer, c.targetIP, g.counters.received)
+	}
+	return s, nil
+}
+
+// failed counts and logs a call whose media is not relayed. Must be
+// called with g.mu held.
+func (g *Gateway) failed(id string, clientIP net.IP, result string) {
+	g.metrics.SIPCalls.WithLabelValues(g.listener, result).Inc()
+	g.logger.LogWarning(logging.EventSIPRelayFailed, map[string]interface{}{
+		"listener":  g.listener,
+		"call_id":   id,
+		"client_ip": clientIP.String(),
+		"reason":    result,
+	})
+}
+
+// end closes the relay of a call, if it has one
+func (g *Gateway) end(key, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c := g.calls[key]; c != nil {
+		g.closeLocked(key, c, reason)
+	}
+}
+
+// closeLocked closes a call's relay and logs it. Must be called with g.mu
+// held.
+func (g *Gateway) closeLocked(key string, c *call, reason string) {
+	delete(g.calls, key)
+	g.closeSockets(c)
+	g.metrics.SIPCallsActive.WithLabelValues(g.listener).Dec()
+	g.logger.LogInfo(logging.EventSIPRelayClosed, map[string]interface{}{
+		"listener":    g.listener,
+		"call_id":     c.id,
+		"client_ip":   c.clientIP.String(),
+		"reason":      reason,
+		"duration_ms": time.Since(c.opened).Milliseconds(),
+		"packets":     c.packets.Load(),
+	})
+}
+
+// closeSockets closes a call's sockets and returns their ports to the pool
+func (g *Gateway) closeSockets(c *call) {
+	for _, conn := range c.sockets() {
+		conn.Close()
+		if port := conn.LocalAddr().(*net.UDPAddr).Port; port%2 == 0 {
+			g.ports.release(port)
+		}
+	}
+}
+
+// reap closes the relays of calls without media or signalling for the
+// media timeout
+func (g *Gateway) reap() {
+	ticker := time.NewTicker(max(g.timeout/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stop:
+			return
+		case <-ticker.C:
+		}
+		idle := time.Now().Add(-g.timeout).UnixNano()
+		g.mu.Lock()
+		for key, c := range g.calls {
+			if c.lastActive.Load() < idle {
+				g.closeLocked(key, c, closeTimeout)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// Close closes every relay and waits for their goroutines
+func (g *Gateway) Close() {
+	if g == nil {
+		return
+	}
+	g.stopOnce.Do(func() {
+		close(g.stop)
+		g.mu.Lock()
+		for key, c := range g.calls {
+			g.closeLocked(key, c, closeShutdown)
+		}
+		g.mu.Unlock()
+		g.wg.Wait()
+	})
+}
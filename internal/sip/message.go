@@ -0,0 +1,122 @@
+// Package sip relays the media of SIP calls proxied by a UDP listener. The
+// SDP offer and answer of each call are rewritten to relay ports opened
+// for it, RTP and RTCP are forwarded between them, and the ports are
+// closed again when the call ends or its media stops.
+package sip
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+var (
+	crlf          = []byte("\r\n")
+	headerEnd     = []byte("\r\n\r\n")
+	versionPrefix = []byte("SIP/2.0 ")
+	versionSuffix = []byte(" SIP/2.0")
+)
+
+// message is a SIP request or response
+type message struct {
+	head [][]byte // Start line and header fields
+	body []byte
+}
+
+// parseMessage splits a datagram into a SIP message. Returns nil for
+// datagrams that are not SIP, such as keepalives.
+func parseMessage(b []byte) *message {
+	i := bytes.Index(b, headerEnd)
+	if i < 0 {
+		return nil
+	}
+	m := &message{head: bytes.Split(b[:i], crlf), body: b[i+len(headerEnd):]}
+	start := m.head[0]
+	if !bytes.HasPrefix(start, versionPrefix) && !bytes.HasSuffix(start, versionSuffix) {
+		return nil
+	}
+	// Anything after Content-Length is not part of the message
+	if length, err := strconv.Atoi(m.header("Content-Length", "l")); err == nil && length >= 0 && length < len(m.body) {
+		m.body = m.body[:length]
+	}
+	return m
+}
+
+// method returns the method of a request, or "" for a response
+func (m *message) method() string {
+	if bytes.HasPrefix(m.head[0], versionPrefix) {
+		return ""
+	}
+	method, _, _ := bytes.Cut(m.head[0], []byte(" "))
+	return string(method)
+}
+
+// status returns the status code of a response, or 0 for a request
+func (m *message) status() int {
+	rest, ok := bytes.CutPrefix(m.head[0], versionPrefix)
+	if !ok {
+		return 0
+	}
+	code, _, _ := bytes.Cut(rest, []byte(" "))
+	n, _ := strconv.Atoi(string(code))
+	return n
+}
+
+// cseqMethod returns the method named in the CSeq header field, which
+// tells what request a response answers
+func (m *message) cseqMethod() string {
+	fields := strings.Fields(m.header("CSeq", ""))
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+// header returns the value of the first header field called name, or its
+// compact form
+func (m *message) header(name, compact string) string {
+	for _, line := range m.head[1:] {
+		field, value, ok := bytes.Cut(line, []byte(":"))
+		if ok && isField(field, name, compact) {
+			return string(bytes.TrimSpace(value))
+		}
+	}
+	return ""
+}
+
+// isField reports whether field is called name or compact
+func isField(field []byte, name, compact string) bool {
+	field = bytes.TrimSpace(field)
+	return bytes.EqualFold(field, []byte(name)) || (compact != "" && bytes.EqualFold(field, []byte(compact)))
+}
+
+// hasSDP reports whether the body is a session description
+func (m *message) hasSDP() bool {
+	mediaType, _, _ := strings.Cut(m.header("Content-Type", "c"), ";")
+	return len(m.body) > 0 && strings.EqualFold(strings.TrimSpace(mediaType), "application/sdp")
+}
+
+// withBody returns the message with body instead of its own, and a
+// Content-Length to match
+func (m *message) withBody(body []byte) []byte {
+	var out bytes.Buffer
+	length := "Content-Length: " + strconv.Itoa(len(body))
+	found := false
+	for i, line := range m.head {
+		if i > 0 {
+			out.Write(crlf)
+			if field, _, ok := bytes.Cut(line, []byte(":")); ok && isField(field, "Content-Length", "l") {
+				line = []byte(length)
+				found = true
+			}
+		}
+		out.Write(line)
+	}
+	if !found {
+		out.Write(crlf)
+		out.WriteString(length)
+	}
+	out.Write(headerEnd)
+	out.Write(body)
+	return out.Bytes()
+}
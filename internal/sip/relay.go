@@ -0,0 +1,157 @@
+package sip
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errNoPorts is returned when every relay port is in use
+var errNoPorts = errors.New("no free media relay ports")
+
+// mediaBufferSize fits any RTP or RTCP packet that is not fragmented
+const mediaBufferSize = 2048
+
+// portPool hands out relay sockets in pairs of adjacent ports, RTP on the
+// even port and RTCP on the one above
+type portPool struct {
+	mu    sync.Mutex
+	ip    net.IP
+	first int // First even port of the range
+	pairs int
+	next  int // Pair to try first, so ports are not reused right away
+	used  map[int]bool
+}
+
+// newPortPool creates a pool of the port pairs between first and last
+func newPortPool(ip net.IP, first, last int) *portPool {
+	first += first % 2
+	return &portPool{
+		ip:    ip,
+		first: first,
+		pairs: (last - first + 1) / 2,
+		used:  make(map[int]bool),
+	}
+}
+
+// open binds an RTP and RTCP socket on the next free pair of ports.
+// Ports that another process holds are skipped.
+func (p *portPool) open() (rtp, rtcp *net.UDPConn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := 0; i < p.pairs; i++ {
+		pair := (p.next + i) % p.pairs
+		port := p.first + 2*pair
+		if p.used[port] {
+			continue
+		}
+		rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: p.ip, Port: port})
+		if err != nil {
+			continue
+		}
+		rtcp, err := net.ListenUDP("udp", &net.UDPAddr{IP: p.ip, Port: port + 1})
+		if err != nil {
+			rtp.Close()
+			continue
+		}
+		p.used[port] = true
+		p.next = pair + 1
+		return rtp, rtcp, nil
+	}
+	return nil, nil, errNoPorts
+}
+
+// release returns the pair starting at port to the pool
+func (p *portPool) release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.used, port)
+}
+
+// pipe relays one media stream, RTP or RTCP, between the socket the
+// client sends to and the socket the target sends to. Packets leave
+// through the other socket, so each party sees the port it was told
+// about.
+type pipe struct {
+	client, target         *net.UDPConn
+	clientPeer, targetPeer atomic.Pointer[net.UDPAddr] // Where packets to each party go
+}
+
+// stream relays one media description of a call
+type stream struct {
+	rtp, rtcp              pipe
+	clientPort, targetPort int // RTP ports advertised to the client and to the target
+}
+
+// call is the media relay of one SIP call
+type call struct {
+	id                 string
+	clientIP, targetIP net.IP    // Signalling addresses, which may always send media
+	streams            []*stream // Guarded by the gateway
+	answered           bool      // An SDP answer was seen, guarded by the gateway
+	opened             time.Time
+	lastActive         atomic.Int64 // Unix nanoseconds of the latest media or signalling
+	packets            atomic.Int64
+}
+
+// touch records activity on the call
+func (c *call) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// sockets returns every socket of the call
+func (c *call) sockets() []*net.UDPConn {
+	var conns []*net.UDPConn
+	for _, s := range c.streams {
+		if s != nil {
+			conns = append(conns, s.rtp.client, s.rtcp.client, s.rtp.target, s.rtcp.target)
+		}
+	}
+	return conns
+}
+
+// counters are a listener's media metrics, looked up once
+type counters struct {
+	sent, received        prometheus.Counter
+	unknownSource, noPeer prometheus.Counter
+	writeError            prometheus.Counter
+}
+
+// forward copies packets arriving on in to the peer in to, through out.
+// Packets are only accepted from the signalling address of their sender
+// or the address its SDP named. The source of the latest one becomes the
+// address the other direction sends to, which gets media through NAT.
+func (g *Gateway) forward(c *call, in, out *net.UDPConn, from, to *atomic.Pointer[net.UDPAddr], signalIP net.IP, relayed prometheus.Counter) {
+	defer g.wg.Done()
+	buf := make([]byte, mediaBufferSize)
+	for {
+		n, src, err := in.ReadFromUDP(buf)
+		if err != nil {
+			return // Closed with the call
+		}
+		peer := from.Load()
+		if !src.IP.Equal(signalIP) && (peer == nil || !src.IP.Equal(peer.IP)) {
+			g.counters.unknownSource.Inc()
+			continue
+		}
+		if peer == nil || !src.IP.Equal(peer.IP) || src.Port != peer.Port {
+			from.Store(src)
+		}
+		dst := to.Load()
+		if dst == nil {
+			g.counters.noPeer.Inc()
+			continue
+		}
+		if _, err := out.WriteToUDP(buf[:n], dst); err != nil {
+			g.counters.writeError.Inc()
+			continue
+		}
+		c.touch()
+		c.packets.Add(1)
+		relayed.Inc()
+	}
+}
@@ -0,0 +1,126 @@
+package sip
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// media is where a party receives one media description of an SDP body.
+// rtp is nil for disabled streams (port 0) and streams without a usable
+// connection address.
+type media struct {
+	rtp, rtcp *net.UDPAddr
+}
+
+// sdpLines splits an SDP body into lines without their line endings
+func sdpLines(body []byte) []string {
+	lines := strings.Split(string(body), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// parseConnection returns the address of a "c=IN IP4 addr" line value.
+// Multicast TTLs and address counts are ignored.
+func parseConnection(value string) net.IP {
+	fields := strings.Fields(value)
+	if len(fields) < 3 || fields[0] != "IN" {
+		return nil
+	}
+	addr, _, _ := strings.Cut(fields[2], "/")
+	return net.ParseIP(addr)
+}
+
+// parseSDP returns the media descriptions of an SDP body, in order
+func parseSDP(body []byte) []media {
+	type description struct {
+		port, rtcpPort int
+		conn, rtcpConn net.IP
+	}
+	var session net.IP
+	var descs []description
+	for _, line := range sdpLines(body) {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch {
+		case key == "c" && len(descs) == 0:
+			session = parseConnection(value)
+		case key == "c":
+			descs[len(descs)-1].conn = parseConnection(value)
+		case key == "m":
+			var d description
+			if fields := strings.Fields(value); len(fields) >= 3 {
+				port, _, _ := strings.Cut(fields[1], "/")
+				d.port, _ = strconv.Atoi(port)
+			}
+			descs = append(descs, d)
+		case key == "a" && strings.HasPrefix(value, "rtcp:") && len(descs) > 0:
+			// RFC 3605: "a=rtcp:port [IN IP4 addr]"
+			port, conn, _ := strings.Cut(strings.TrimPrefix(value, "rtcp:"), " ")
+			d := &descs[len(descs)-1]
+			d.rtcpPort, _ = strconv.Atoi(port)
+			d.rtcpConn = parseConnection(conn)
+		}
+	}
+
+	medias := make([]media, len(descs))
+	for i, d := range descs {
+		conn := d.conn
+		if conn == nil {
+			conn = session
+		}
+		if d.port <= 0 || d.port > 65535 || conn == nil || conn.IsUnspecified() {
+			continue
+		}
+		rtcp := &net.UDPAddr{IP: conn, Port: d.port + 1}
+		if d.rtcpPort > 0 && d.rtcpPort <= 65535 {
+			rtcp.Port = d.rtcpPort
+		}
+		if d.rtcpConn != nil {
+			rtcp.IP = d.rtcpConn
+		}
+		medias[i] = media{rtp: &net.UDPAddr{IP: conn, Port: d.port}, rtcp: rtcp}
+	}
+	return medias
+}
+
+// rewriteSDP points every connection address of an SDP body at addr, and
+// the media description i at port ports[i], with RTCP on the port above
+// it. Descriptions with a zero port are left alone.
+func rewriteSDP(body []byte, addr net.IP, ports []int) []byte {
+	family := "IP4"
+	if addr.To4() == nil {
+		family = "IP6"
+	}
+	var out bytes.Buffer
+	i := -1
+	for _, line := range sdpLines(body) {
+		key, value, _ := strings.Cut(line, "=")
+		switch {
+		case key == "c":
+			line = "c=IN " + family + " " + addr.String()
+		case key == "m":
+			i++
+			fields := strings.Fields(value)
+			if i < len(ports) && ports[i] > 0 && len(fields) >= 3 {
+				fields[1] = strconv.Itoa(ports[i])
+				line = "m=" + strings.Join(fields, " ")
+			}
+		case key == "a" && strings.HasPrefix(value, "rtcp:"):
+			if i >= 0 && i < len(ports) && ports[i] > 0 {
+				line = "a=rtcp:" + strconv.Itoa(ports[i]+1)
+			}
+		}
+		out.WriteString(line)
+		out.WriteString("\r\n")
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,69 @@
+// Package sockopt applies a listener's socket block to its sockets: the
+// listening socket, accepted client connections and the sockets toward
+// targets. Options are set through the raw file descriptor so they reach
+// outbound sockets before they connect.
+package sockopt
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// Options are the socket options of one listener
+type Options struct {
+	ReceiveBuffer int    // SO_RCVBUF in bytes, 0 = kernel default
+	SendBuffer    int    // SO_SNDBUF in bytes, 0 = kernel default
+	DSCP          int    // DSCP of sent packets, -1 = unmarked
+	Mark          uint32 // SO_MARK, 0 = none
+}
+
+// FromConfig returns the options of a listener's socket block, or nil if
+// it has none. A nil *Options sets nothing.
+func FromConfig(cfg *config.SocketConfig) *Options {
+	if cfg == nil {
+		return nil
+	}
+	o := &Options{
+		ReceiveBuffer: cfg.GetReceiveBuffer(),
+		SendBuffer:    cfg.GetSendBuffer(),
+		DSCP:          -1,
+		Mark:          cfg.Mark,
+	}
+	if dscp, ok := cfg.GetDSCP(); ok {
+		o.DSCP = dscp
+	}
+	return o
+}
+
+// Apply sets the options on an open socket, such as a listening socket or
+// an accepted connection
+func (o *Options) Apply(conn syscall.Conn) error {
+	if o == nil {
+		return nil
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return o.control(raw)
+}
+
+// Dialer makes dialer set the options on its sockets before they connect,
+// after any Control function it already has (e.g. for transparent mode)
+func (o *Options) Dialer(dialer *net.Dialer) *net.Dialer {
+	if o == nil {
+		return dialer
+	}
+	previous := dialer.Control
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		if previous != nil {
+			if err := previous(network, address, c); err != nil {
+				return err
+			}
+		}
+		return o.control(c)
+	}
+	return dialer
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package sockopt
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// control sets the options on the socket behind c
+func (o *Options) control(c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = o.set(int(fd))
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// set sets the options on fd. The TOS byte is set for both IPv4 and IPv6
+// since dual-stack sockets carry both; the one that does not apply to the
+// socket's family may fail.
+func (o *Options) set(fd int) error {
+	if o.ReceiveBuffer > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.ReceiveBuffer); err != nil {
+			return fmt.Errorf("failed to set receive buffer: %w", err)
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuffer); err != nil {
+			return fmt.Errorf("failed to set send buffer: %w", err)
+		}
+	}
+	if o.DSCP >= 0 {
+		tos := o.DSCP << 2
+		errV4 := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		errV6 := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		if errV4 != nil && errV6 != nil {
+			return fmt.Errorf("failed to set DSCP: %w", errV4)
+		}
+	}
+	if o.Mark != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(o.Mark)); err != nil {
+			return fmt.Errorf("failed to set mark: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sockopt
+
+import (
+	"errors"
+	"syscall"
+)
+
+// control is not supported on this platform; configuration validation
+// rejects socket blocks outside Linux
+func (o *Options) control(c syscall.RawConn) error {
+	return errors.New("socket options are only supported on Linux")
+}
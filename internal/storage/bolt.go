@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltOpenTimeout bounds the wait for the database lock, held by another
+// process using the same file
+const boltOpenTimeout = 5 * time.Second
+
+// boltBucket holds every key of the store
+var boltBucket = []byte("state")
+
+// BoltStore keeps state in a bbolt database file, so state survives
+// restarts of a single instance. Each change updates only the pages it
+// touches, however large the store grows, and is synced to disk before it
+// returns. Concurrent changes are committed together in one transaction
+// (db.Batch), so a busy store syncs far less often than it is written.
+type BoltStore struct {
+	db        *bolt.DB
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenBoltStore opens or creates the database at path
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{
+		Timeout:      boltOpenTimeout,
+		FreelistType: bolt.FreelistMapType,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open state database %s: %w", path, err)
+	}
+
+	s := &BoltStore{
+		db:   db,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.purge()
+
+	go s.purgeLoop()
+
+	return s, nil
+}
+
+// encodeBolt returns the stored form of a value: its expiry in Unix
+// nanoseconds (0 = never), then the value
+func encodeBolt(value []byte, expires time.Time) []byte {
+	b := make([]byte, 8, 8+len(value))
+	if !expires.IsZero() {
+		binary.BigEndian.PutUint64(b, uint64(expires.UnixNano()))
+	}
+	return append(b, value...)
+}
+
+// decodeBolt splits a stored value into the value and its expiry. ok is
+// false if it has expired at now or is malformed.
+func decodeBolt(stored []byte, now time.Time) (value []byte, expires time.Time, ok bool) {
+	if len(stored) < 8 {
+		return nil, time.Time{}, false
+	}
+	if n := binary.BigEndian.Uint64(stored); n != 0 {
+		expires = time.Unix(0, int64(n))
+	}
+	item := memoryItem{expires: expires}
+	if item.expired(now) {
+		return nil, time.Time{}, false
+	}
+	return stored[8:], expires, true
+}
+
+// Get returns the value for key
+func (s *BoltStore) Get(key string) ([]byte, bool, error) {
+	var value []byte
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var v []byte
+		v, _, ok = decodeBolt(tx.Bucket(boltBucket).Get([]byte(key)), time.Now())
+		// Values are only valid within the transaction
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Set stores value under key with an optional ttl
+func (s *BoltStore) Set(key string, value []byte, ttl time.Duration) error {
+	stored := encodeBolt(value, expiry(ttl))
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), stored)
+	})
+}
+
+// Incr adds delta to the integer stored under key
+func (s *BoltStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	var value int64
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		// Batch runs fn again if the transaction it shared fails
+		value = 0
+		bucket := tx.Bucket(boltBucket)
+		current, expires, ok := decodeBolt(bucket.Get([]byte(key)), time.Now())
+		if !ok {
+			current, expires = nil, expiry(ttl)
+		}
+		if len(current) > 0 {
+			var err error
+			if value, err = strconv.ParseInt(string(current), 10, 64); err != nil {
+				return fmt.Errorf("value of %s is not an integer", key)
+			}
+		}
+		value += delta
+		return bucket.Put([]byte(key), encodeBolt(strconv.AppendInt(nil, value, 10), expires))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value, nil
+}
+
+// Delete removes key
+func (s *BoltStore) Delete(key string) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+// TTL returns the remaining lifetime of key
+func (s *BoltStore) TTL(key string) (time.Duration, bool, error) {
+	now := time.Now()
+	var ttl time.Duration
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var expires time.Time
+		_, expires, ok = decodeBolt(tx.Bucket(boltBucket).Get([]byte(key)), now)
+		if ok && !expires.IsZero() {
+			ttl = expires.Sub(now)
+		}
+		return nil
+	})
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	return ttl, true, nil
+}
+
+// Scan calls fn for every live key with the given prefix
+func (s *BoltStore) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	type kv struct {
+		key   string
+		value []byte
+	}
+
+	// Collect first so fn may call back into the store
+	var matches []kv
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if value, _, ok := decodeBolt(v, now); ok {
+				matches = append(matches, kv{string(k), append([]byte(nil), value...)})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range matches {
+		if !fn(m.key, m.value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close stops purging and closes the database
+func (s *BoltStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.closeErr = s.db.Close()
+	})
+	return s.closeErr
+}
+
+// purgeLoop periodically removes expired keys
+func (s *BoltStore) purgeLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(memoryPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.purge()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// purge removes expired keys
+func (s *BoltStore) purge() {
+	now := time.Now()
+	s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if _, _, ok := decodeBolt(v, now); !ok {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
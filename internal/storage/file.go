@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fileFlushInterval is how often changes are written to the state file
+const fileFlushInterval = 1 * time.Second
+
+// fileEntry is the on-disk form of a stored value
+type fileEntry struct {
+	Value   []byte    `json:"value"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// FileStore keeps state in memory and persists it to a local file, so
+// state survives restarts of a single instance. Changes are written at
+// most once per second and on Close.
+type FileStore struct {
+	*MemoryStore
+	path      string
+	dirty     atomic.Bool
+	flushMu   sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenFileStore opens the state file at path, loading any live entries
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	if err := s.load(); err != nil {
+		s.MemoryStore.Close()
+		return nil, err
+	}
+
+	go s.flushLoop()
+
+	return s, nil
+}
+
+// Set stores value under key and schedules a write
+func (s *FileStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.dirty.Store(true)
+	return s.MemoryStore.Set(key, value, ttl)
+}
+
+// Incr adds delta to the integer stored under key and schedules a write
+func (s *FileStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	s.dirty.Store(true)
+	return s.MemoryStore.Incr(key, delta, ttl)
+}
+
+// Delete removes key and schedules a write
+func (s *FileStore) Delete(key string) error {
+	s.dirty.Store(true)
+	return s.MemoryStore.Delete(key)
+}
+
+// Close writes pending changes and stops the background goroutines
+func (s *FileStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.closeErr = s.flush()
+		s.MemoryStore.Close()
+	})
+	return s.closeErr
+}
+
+// load reads the state file; a missing file is an empty store
+func (s *FileStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var entries map[string]fileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse state file %s: %w", s.path, err)
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range entries {
+		item := memoryItem{value: entry.Value, expires: entry.Expires}
+		if !item.expired(now) {
+			s.items[key] = item
+		}
+	}
+	return nil
+}
+
+// flushLoop writes the state file whenever it has changed
+func (s *FileStore) flushLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(fileFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// flush atomically replaces the state file if there are pending changes
+func (s *FileStore) flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	if !s.dirty.Swap(false) {
+		return nil
+	}
+
+	now := time.Now()
+	entries := make(map[string]fileEntry)
+	s.mu.RLock()
+	for key, item := range s.items {
+		if !item.expired(now) {
+			entries[key] = fileEntry{Value: item.value, Expires: item.expires}
+		}
+	}
+	s.mu.RUnlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		s.dirty.Store(true)
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		s.dirty.Store(true)
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		s.dirty.Store(true)
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		s.dirty.Store(true)
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		os.Remove(tmp.Name())
+		s.dirty.Store(true)
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	return nil
+}
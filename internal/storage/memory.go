@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryPurgeInterval is how often expired keys are removed
+const memoryPurgeInterval = 1 * time.Minute
+
+// memoryItem is a stored value with its expiry (zero = never)
+type memoryItem struct {
+	value   []byte
+	expires time.Time
+}
+
+// expired reports whether the item has expired at now
+func (i memoryItem) expired(now time.Time) bool {
+	return !i.expires.IsZero() && !now.Before(i.expires)
+}
+
+// MemoryStore keeps state in process memory. State is lost on restart.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	items     map[string]memoryItem
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemoryStore creates an in-memory store
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		items: make(map[string]memoryItem),
+		stop:  make(chan struct{}),
+	}
+
+	go s.purgeLoop()
+
+	return s
+}
+
+// Get returns the value for key
+func (s *MemoryStore) Get(key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	item, ok := s.items[key]
+	if !ok || item.expired(time.Now()) {
+		return nil, false, nil
+	}
+	return append([]byte(nil), item.value...), true, nil
+}
+
+// Set stores value under key with an optional ttl
+func (s *MemoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items[key] = memoryItem{
+		value:   append([]byte(nil), value...),
+		expires: expiry(ttl),
+	}
+	return nil
+}
+
+// Incr adds delta to the integer stored under key
+func (s *MemoryStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[key]
+	if !ok || item.expired(time.Now()) {
+		item = memoryItem{expires: expiry(ttl)}
+	}
+	var value int64
+	if len(item.value) > 0 {
+		var err error
+		if value, err = strconv.ParseInt(string(item.value), 10, 64); err != nil {
+			return 0, fmt.Errorf("value of %s is not an integer", key)
+		}
+	}
+	value += delta
+	item.value = strconv.AppendInt(nil, value, 10)
+	s.items[key] = item
+	return value, nil
+}
+
+// Delete removes key
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.items, key)
+	return nil
+}
+
+// TTL returns the remaining lifetime of key
+func (s *MemoryStore) TTL(key string) (time.Duration, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	item, ok := s.items[key]
+	if !ok || item.expired(now) {
+		return 0, false, nil
+	}
+	if item.expires.IsZero() {
+		return 0, true, nil
+	}
+	return item.expires.Sub(now), true, nil
+}
+
+// Scan calls fn for every live key with the given prefix
+func (s *MemoryStore) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	type kv struct {
+		key   string
+		value []byte
+	}
+
+	// Collect first so fn may call back into the store
+	s.mu.RLock()
+	now := time.Now()
+	var matches []kv
+	for key, item := range s.items {
+		if strings.HasPrefix(key, prefix) && !item.expired(now) {
+			matches = append(matches, kv{key, append([]byte(nil), item.value...)})
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, m := range matches {
+		if !fn(m.key, m.value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close stops the purge goroutine
+func (s *MemoryStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	return nil
+}
+
+// purgeLoop periodically removes expired keys
+func (s *MemoryStore) purgeLoop() {
+	ticker := time.NewTicker(memoryPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.purge()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// purge removes expired keys
+func (s *MemoryStore) purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, item := range s.items {
+		if item.expired(now) {
+			delete(s.items, key)
+		}
+	}
+}
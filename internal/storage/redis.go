@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+const (
+	defaultRedisKeyPrefix = "packetpony:"
+	defaultRedisTimeout   = 2 * time.Second
+	redisScanCount        = 100
+)
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisStore keeps state in Redis so it is shared between instances and
+// survives restarts. It speaks RESP over a single connection, which is
+// re-established on the next command after a failure.
+type RedisStore struct {
+	cfg     config.RedisConfig
+	prefix  string
+	timeout time.Duration
+	mu      sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+// OpenRedisStore connects to Redis, failing if the server is unreachable
+func OpenRedisStore(cfg config.RedisConfig) (*RedisStore, error) {
+	s := &RedisStore{
+		cfg:     cfg,
+		prefix:  cfg.KeyPrefix,
+		timeout: cfg.Timeout,
+	}
+	if s.prefix == "" {
+		s.prefix = defaultRedisKeyPrefix
+	}
+	if s.timeout <= 0 {
+		s.timeout = defaultRedisTimeout
+	}
+
+	if _, err := s.do("PING"); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", cfg.Address, err)
+	}
+	return s, nil
+}
+
+// Get returns the value for key
+func (s *RedisStore) Get(key string) ([]byte, bool, error) {
+	reply, err := s.do("GET", s.prefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	return value, ok, nil
+}
+
+// Set stores value under key with an optional ttl
+func (s *RedisStore) Set(key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", s.prefix + key, string(value)}
+	if ttl > 0 {
+		ms := ttl.Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		args = append(args, "PX", strconv.FormatInt(ms, 10))
+	}
+	_, err := s.do(args...)
+	return err
+}
+
+// incrScript adds to a counter and sets its expiry only when it has none,
+// in one round trip
+const incrScript = `local v = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) == -1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return v`
+
+// Incr adds delta to the integer stored under key
+func (s *RedisStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	var ms int64
+	if ttl > 0 {
+		ms = max(ttl.Milliseconds(), 1)
+	}
+	reply, err := s.do("EVAL", incrScript, "1", s.prefix+key, strconv.FormatInt(delta, 10), strconv.FormatInt(ms, 10))
+	if err != nil {
+		return 0, err
+	}
+	value, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply to INCRBY of %s", key)
+	}
+	return value, nil
+}
+
+// Delete removes key
+func (s *RedisStore) Delete(key string) error {
+	_, err := s.do("DEL", s.prefix+key)
+	return err
+}
+
+// TTL returns the remaining lifetime of key
+func (s *RedisStore) TTL(key string) (time.Duration, bool, error) {
+	reply, err := s.do("PTTL", s.prefix+key)
+	if err != nil {
+		return 0, false, err
+	}
+	ms, _ := reply.(int64)
+	switch {
+	case ms == -2:
+		return 0, false, nil
+	case ms < 0:
+		return 0, true, nil
+	default:
+		return time.Duration(ms) * time.Millisecond, true, nil
+	}
+}
+
+// Scan calls fn for every live key with the given prefix
+func (s *RedisStore) Scan(prefix string, fn func(key string, value []byte) bool) error {
+	pattern := escapeGlob(s.prefix+prefix) + "*"
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(redisScanCount))
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		next, _ := parts[0].([]byte)
+		keys, _ := parts[1].([]interface{})
+
+		if len(keys) > 0 {
+			args := []string{"MGET"}
+			for _, k := range keys {
+				b, _ := k.([]byte)
+				args = append(args, string(b))
+			}
+			values, err := s.do(args...)
+			if err != nil {
+				return err
+			}
+			list, _ := values.([]interface{})
+			for i, v := range list {
+				value, ok := v.([]byte)
+				if !ok {
+					continue // expired between SCAN and MGET
+				}
+				if !fn(strings.TrimPrefix(args[i+1], s.prefix), value) {
+					return nil
+				}
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// Close closes the connection
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// do sends a command and reads its reply, connecting first if needed.
+// The connection is dropped on I/O errors and re-established next time.
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := s.roundTrip(args)
+	if err != nil {
+		var replyErr redisError
+		if !errors.As(err, &replyErr) {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return nil, err
+	}
+	return reply, nil
+}
+
+// connect dials the server and authenticates. Must be called with mu held.
+func (s *RedisStore) connect() error {
+	conn, err := net.DialTimeout("tcp", s.cfg.Address, s.timeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	if s.cfg.Password != "" {
+		if _, err := s.roundTrip([]string{"AUTH", s.cfg.Password}); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	if s.cfg.DB != 0 {
+		if _, err := s.roundTrip([]string{"SELECT", strconv.Itoa(s.cfg.DB)}); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// roundTrip writes one command and reads its reply. Must be called with mu held.
+func (s *RedisStore) roundTrip(args []string) (interface{}, error) {
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readReply(s.reader)
+}
+
+// readReply parses one RESP reply. Bulk strings are returned as []byte
+// (nil for a null reply), integers as int64, arrays as []interface{}.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type %q", line[0])
+	}
+}
+
+// escapeGlob escapes Redis glob metacharacters in s
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,66 @@
+// Package storage provides a key-value store with per-key expiry for
+// stateful features such as bans. The backend is selected in config:
+// in-memory (default), a local state file or bbolt database, or Redis for
+// state shared between instances.
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// Store is a key-value store with optional per-key expiry.
+// Implementations are safe for concurrent use.
+type Store interface {
+	// Get returns the value for key. ok is false if the key does not exist
+	// or has expired.
+	Get(key string) (value []byte, ok bool, err error)
+
+	// Set stores value under key. A ttl of 0 means the key never expires.
+	Set(key string, value []byte, ttl time.Duration) error
+
+	// Incr adds delta to the integer stored under key and returns the sum.
+	// A missing key counts as 0 and expires after ttl (0 = never); adding
+	// to an existing key keeps its expiry.
+	Incr(key string, delta int64, ttl time.Duration) (int64, error)
+
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+
+	// TTL returns the remaining lifetime of key, 0 if it never expires.
+	// ok is false if the key does not exist.
+	TTL(key string) (ttl time.Duration, ok bool, err error)
+
+	// Scan calls fn for every live key starting with prefix, until fn
+	// returns false. Keys are visited in no particular order.
+	Scan(prefix string, fn func(key string, value []byte) bool) error
+
+	// Close releases resources held by the store
+	Close() error
+}
+
+// Open creates the store selected by the configuration
+func Open(cfg config.StorageConfig) (Store, error) {
+	switch cfg.Backend {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return OpenFileStore(cfg.Path)
+	case "bolt":
+		return OpenBoltStore(cfg.Path)
+	case "redis":
+		return OpenRedisStore(*cfg.Redis)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.Backend)
+	}
+}
+
+// expiry converts a ttl to an absolute expiry time (zero = never)
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
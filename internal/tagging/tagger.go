@@ -0,0 +1,109 @@
+// Package tagging attaches operator-defined tags to flows.
+// Tags come from static listener tags and rules matching the source address,
+// the client's country or the identity the pre-hook reported, and are
+// propagated to connection events and (optionally) metric labels.
+package tagging
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/espegro/packetpony/internal/acl"
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/geoip"
+)
+
+// Tagger computes the tag set for a flow
+type Tagger struct {
+	static map[string]string
+	rules  []tagRule
+	geo    *geoip.DB // nil unless a rule matches countries
+}
+
+// tagRule pairs the conditions of a rule with the tags it attaches. A
+// condition without entries matches every flow.
+type tagRule struct {
+	match      *acl.Allowlist // nil = any source address
+	countries  []string
+	identities []string
+	tags       map[string]string
+}
+
+// NewTagger creates a tagger from listener tags and tag rules. Countries
+// are looked up in geo.
+func NewTagger(static map[string]string, rules []config.TagRuleConfig, geo *geoip.DB) (*Tagger, error) {
+	tagger := &Tagger{
+		static: static,
+	}
+
+	for i, rule := range rules {
+		var match *acl.Allowlist
+		if len(rule.Match) > 0 {
+			var err error
+			if match, err = acl.NewAllowlist(rule.Match); err != nil {
+				return nil, fmt.Errorf("tag rule %d: %w", i, err)
+			}
+		}
+		if len(rule.Countries) > 0 {
+			if geo == nil {
+				return nil, fmt.Errorf("tag rule %d: countries need a GeoIP database", i)
+			}
+			tagger.geo = geo
+		}
+		tagger.rules = append(tagger.rules, tagRule{
+			match:      match,
+			countries:  rule.Countries,
+			identities: rule.Identities,
+			tags:       rule.Tags,
+		})
+	}
+
+	return tagger, nil
+}
+
+// Tags returns the tags for a flow from the given source IP, with the
+// client identity reported by the pre-hook ("" before the hook has run or
+// without one). Listener tags are applied first, then matching rules in
+// order. Returns nil if no tags apply.
+func (t *Tagger) Tags(ip net.IP, identity string) map[string]string {
+	if t == nil || (len(t.static) == 0 && len(t.rules) == 0) {
+		return nil
+	}
+
+	var tags map[string]string
+	set := func(src map[string]string) {
+		if len(src) == 0 {
+			return
+		}
+		if tags == nil {
+			tags = make(map[string]string, len(src))
+		}
+		for key, value := range src {
+			tags[key] = value
+		}
+	}
+
+	// The country is looked up once, for the first rule that needs it
+	country, looked := "", false
+	set(t.static)
+	for _, rule := range t.rules {
+		if rule.match != nil && !rule.match.IsAllowed(ip) {
+			continue
+		}
+		if len(rule.identities) > 0 && (identity == "" || !slices.Contains(rule.identities, identity)) {
+			continue
+		}
+		if len(rule.countries) > 0 {
+			if !looked {
+				country, looked = t.geo.Country(ip), true
+			}
+			if country == "" || !slices.Contains(rule.countries, country) {
+				continue
+			}
+		}
+		set(rule.tags)
+	}
+
+	return tags
+}
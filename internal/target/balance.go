@@ -0,0 +1,153 @@
+package target
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// balancer picks one of several configured targets for each flow
+type balancer struct {
+	policy  string
+	targets []string
+	weights []int
+	next    atomic.Uint64 // Round-robin position
+
+	mu      sync.Mutex
+	current []int                     // Smooth weighted round-robin state
+	load    func(target string) int64 // Active flows per target, for least_conn
+}
+
+// newBalancer creates a balancer over the listener's targets
+func newBalancer(cfg *config.ListenerConfig) *balancer {
+	b := &balancer{
+		policy:  cfg.GetBalance(),
+		targets: make([]string, len(cfg.Targets)),
+		weights: make([]int, len(cfg.Targets)),
+		current: make([]int, len(cfg.Targets)),
+	}
+	for i, t := range cfg.Targets {
+		b.targets[i] = t.Address
+		b.weights[i] = t.GetWeight()
+	}
+	return b
+}
+
+// pick returns the target for the next flow, choosing among the targets
+// for which available returns true. If none is available, all are used.
+func (b *balancer) pick(available func(target string) bool) string {
+	usable := func(i int) bool { return available(b.targets[i]) }
+	found := false
+	for i := range b.targets {
+		if usable(i) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		usable = func(int) bool { return true }
+	}
+
+	switch b.policy {
+	case config.BalanceWeighted:
+		return b.targets[b.pickWeighted(usable)]
+	case config.BalanceLeastConn:
+		return b.targets[b.pickLeastConn(usable)]
+	case config.BalanceRandom:
+		return b.targets[b.pickRandom(usable)]
+	default:
+		return b.targets[b.pickRoundRobin(usable)]
+	}
+}
+
+// pickRoundRobin returns the next usable target in turn
+func (b *balancer) pickRoundRobin(usable func(i int) bool) int {
+	start := int((b.next.Add(1) - 1) % uint64(len(b.targets)))
+	for n := 0; n < len(b.targets); n++ {
+		if i := (start + n) % len(b.targets); usable(i) {
+			return i
+		}
+	}
+	return start
+}
+
+// pickWeighted uses smooth weighted round-robin, which spreads a heavier
+// target's share evenly instead of sending it bursts of flows
+func (b *balancer) pickWeighted(usable func(i int) bool) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	best, total := -1, 0
+	for i, w := range b.weights {
+		if !usable(i) {
+			continue
+		}
+		b.current[i] += w
+		total += w
+		if best < 0 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	b.current[best] -= total
+	return best
+}
+
+// pickLeastConn returns the usable target with the fewest active flows
+// relative to its weight. Ties are broken round-robin so idle targets share
+// new flows.
+func (b *balancer) pickLeastConn(usable func(i int) bool) int {
+	b.mu.Lock()
+	load := b.load
+	b.mu.Unlock()
+	if load == nil {
+		return b.pickRoundRobin(usable)
+	}
+
+	start := int((b.next.Add(1) - 1) % uint64(len(b.targets)))
+	best := -1
+	var bestActive int64
+	for n := 0; n < len(b.targets); n++ {
+		i := (start + n) % len(b.targets)
+		if !usable(i) {
+			continue
+		}
+		active := load(b.targets[i])
+		// active/weight < bestActive/bestWeight, without division
+		if best < 0 || active*int64(b.weights[best]) < bestActive*int64(b.weights[i]) {
+			best, bestActive = i, active
+		}
+	}
+	return best
+}
+
+// pickRandom picks a usable target at random, in proportion to its weight
+func (b *balancer) pickRandom(usable func(i int) bool) int {
+	total, last := 0, 0
+	for i, w := range b.weights {
+		if usable(i) {
+			total += w
+			last = i
+		}
+	}
+
+	n := rand.IntN(total)
+	for i, w := range b.weights {
+		if !usable(i) {
+			continue
+		}
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return last
+}
+
+// setLoad registers the active flow count used by least_conn
+func (b *balancer) setLoad(fn func(target string) int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.load = fn
+}
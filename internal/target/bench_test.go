@@ -0,0 +1,57 @@
+package target
+
+import (
+	"net"
+	"testing"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// BenchmarkSelect measures target selection per new flow
+func BenchmarkSelect(b *testing.B) {
+	targets := []config.TargetEntry{
+		{Address: "10.0.0.1:80"},
+		{Address: "10.0.0.2:80", Weight: 2},
+		{Address: "10.0.0.3:80"},
+	}
+	cases := []struct {
+		name string
+		cfg  config.ListenerConfig
+		host string
+	}{
+		{"fixed", config.ListenerConfig{TargetAddress: "10.0.0.1:80"}, ""},
+		{"template", config.ListenerConfig{TargetAddress: "10.0.{client_octet3}.1:80"}, ""},
+		{"round_robin", config.ListenerConfig{Targets: targets}, ""},
+		{"weighted_breaker", config.ListenerConfig{
+			Targets:        targets,
+			Balance:        "weighted",
+			CircuitBreaker: &config.CircuitBreakerConfig{Enabled: true},
+		}, ""},
+		{"host_route", config.ListenerConfig{
+			TargetAddress: "10.0.0.1:80",
+			HTTP: &config.HTTPConfig{Enabled: true, HostRoutes: []config.HostRoute{
+				{Host: "api.example.com", Target: "10.0.0.2:80"},
+				{Host: "*.example.com", Target: "10.0.0.3:80"},
+			}},
+		}, "www.example.com"},
+	}
+
+	clientIP := net.ParseIP("192.168.1.50")
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			selector, err := NewSelector(&tc.cfg, nil, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer selector.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := selector.SelectHost(tc.host, clientIP, 40000); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package target
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// ErrCircuitOpen is returned by Select when the circuit of every balanced
+// target is open
+var ErrCircuitOpen = errors.New("circuit open for every target")
+
+// Circuit states of a balanced target
+const (
+	CircuitClosed   = "closed"    // Flows are routed normally
+	CircuitOpen     = "open"      // No new flows until the cooldown has passed
+	CircuitHalfOpen = "half_open" // One trial flow decides whether to close or reopen
+)
+
+// circuit is the breaker state of one target
+type circuit struct {
+	state     string
+	failures  int       // Consecutive failures while closed
+	openUntil time.Time // End of the cooldown while open
+	trial     time.Time // When the trial flow was admitted while half-open
+}
+
+// breaker stops routing to targets after consecutive failures. After the
+// cooldown a single trial flow is admitted: success closes the circuit,
+// failure opens it again.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+	onChange func(target, state string)
+}
+
+// newBreaker creates a breaker with all circuits closed
+func newBreaker(cfg *config.CircuitBreakerConfig) *breaker {
+	return &breaker{
+		threshold: cfg.GetFailureThreshold(),
+		cooldown:  cfg.GetCooldown(),
+		circuits:  make(map[string]*circuit),
+	}
+}
+
+// get returns the circuit of target, creating a closed one. Callers hold b.mu.
+func (b *breaker) get(target string) *circuit {
+	c, exists := b.circuits[target]
+	if !exists {
+		c = &circuit{state: CircuitClosed}
+		b.circuits[target] = c
+	}
+	return c
+}
+
+// available reports whether target may be picked for a new flow. An open
+// circuit whose cooldown has passed is available for a trial flow; a
+// half-open circuit is not while its trial flow is pending.
+func (b *breaker) available(target string) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.admissible(b.get(target), time.Now())
+}
+
+// admissible reports whether c accepts a new flow. Callers hold b.mu.
+func (b *breaker) admissible(c *circuit, now time.Time) bool {
+	switch c.state {
+	case CircuitOpen:
+		return !now.Before(c.openUntil)
+	case CircuitHalfOpen:
+		// A trial flow that never reported back does not block forever
+		return now.Sub(c.trial) >= b.cooldown
+	default:
+		return true
+	}
+}
+
+// admit claims a new flow to target, moving an open circuit whose cooldown
+// has passed to half-open. It returns false if the circuit refuses the flow.
+func (b *breaker) admit(target string) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	c := b.get(target)
+	now := time.Now()
+	if !b.admissible(c, now) {
+		b.mu.Unlock()
+		return false
+	}
+	changed := c.state == CircuitOpen
+	if c.state != CircuitClosed {
+		c.state = CircuitHalfOpen
+		c.trial = now
+	}
+	b.mu.Unlock()
+
+	if changed {
+		b.notify(target, CircuitHalfOpen)
+	}
+	return true
+}
+
+// failure records a failed connect or write, opening the circuit at the
+// threshold or when a trial flow fails
+func (b *breaker) failure(target string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	c := b.get(target)
+	changed := false
+	switch c.state {
+	case CircuitClosed:
+		c.failures++
+		changed = c.failures >= b.threshold
+	case CircuitHalfOpen:
+		changed = true
+	}
+	if changed {
+		c.state = CircuitOpen
+		c.failures = 0
+		c.openUntil = time.Now().Add(b.cooldown)
+	}
+	b.mu.Unlock()
+
+	if changed {
+		b.notify(target, CircuitOpen)
+	}
+}
+
+// success records a successful connect or write, closing the circuit
+func (b *breaker) success(target string) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	c := b.get(target)
+	changed := c.state != CircuitClosed
+	c.state = CircuitClosed
+	c.failures = 0
+	b.mu.Unlock()
+
+	if changed {
+		b.notify(target, CircuitClosed)
+	}
+}
+
+// state returns the circuit state of target
+func (b *breaker) state(target string) string {
+	if b == nil {
+		return CircuitClosed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.get(target).state
+}
+
+// notify passes a state change to the registered callback
+func (b *breaker) notify(target, state string) {
+	b.mu.Lock()
+	onChange := b.onChange
+	b.mu.Unlock()
+
+	if onChange != nil {
+		onChange(target, state)
+	}
+}
+
+// OnCircuitChange registers a callback invoked when the circuit of a
+// balanced target changes state
+func (s *Selector) OnCircuitChange(fn func(target, state string)) {
+	if s.breaker == nil {
+		return
+	}
+
+	s.breaker.mu.Lock()
+	defer s.breaker.mu.Unlock()
+	s.breaker.onChange = fn
+}
@@ -0,0 +1,193 @@
+package target
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Errors returned when draining targets
+var (
+	ErrNotBalanced   = errors.New("listener does not balance across targets")
+	ErrUnknownTarget = errors.New("unknown target")
+	ErrNotDraining   = errors.New("target is not draining")
+	ErrLastTarget    = errors.New("cannot drain the last target in service")
+)
+
+// drainer tracks balanced targets taken out of rotation. Flows already on a
+// draining target are left alone until its grace deadline, if any.
+type drainer struct {
+	mu         sync.Mutex
+	deadlines  map[string]time.Time // Zero time = no deadline
+	timers     map[string]*time.Timer
+	onDeadline func(target string)
+}
+
+// newDrainer creates a drainer with every target in service
+func newDrainer() *drainer {
+	return &drainer{
+		deadlines: make(map[string]time.Time),
+		timers:    make(map[string]*time.Timer),
+	}
+}
+
+// draining reports whether target is out of rotation
+func (d *drainer) draining(target string) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, exists := d.deadlines[target]
+	return exists
+}
+
+// TargetStatus describes a balanced target for the admin API
+type TargetStatus struct {
+	Address       string     `json:"address"`
+	Weight        int        `json:"weight"`
+	Active        int64      `json:"active"`
+	Draining      bool       `json:"draining"`
+	DrainDeadline *time.Time `json:"drain_deadline,omitempty"`
+	Circuit       string     `json:"circuit"` // closed, open or half_open
+}
+
+// Drain takes a balanced target out of rotation. New flows are steered to
+// the other targets; existing flows continue until they end or, if grace
+// is positive, until the grace period passes and the OnDrainDeadline
+// callback is invoked for the target. Draining a target again replaces its
+// deadline.
+func (s *Selector) Drain(target string, grace time.Duration) (TargetStatus, error) {
+	if s.balancer == nil {
+		return TargetStatus{}, ErrNotBalanced
+	}
+	if !slices.Contains(s.balancer.targets, target) {
+		return TargetStatus{}, fmt.Errorf("%w: %s", ErrUnknownTarget, target)
+	}
+
+	d := s.drains
+	d.mu.Lock()
+	if _, exists := d.deadlines[target]; !exists && len(d.deadlines) >= len(s.balancer.targets)-1 {
+		d.mu.Unlock()
+		return TargetStatus{}, ErrLastTarget
+	}
+	if timer := d.timers[target]; timer != nil {
+		timer.Stop()
+		delete(d.timers, target)
+	}
+	var deadline time.Time
+	if grace > 0 {
+		deadline = time.Now().Add(grace)
+		d.timers[target] = time.AfterFunc(grace, func() { d.expire(target, deadline) })
+	}
+	d.deadlines[target] = deadline
+	d.mu.Unlock()
+
+	return s.status(target), nil
+}
+
+// Undrain puts a draining target back into rotation
+func (s *Selector) Undrain(target string) (TargetStatus, error) {
+	if s.balancer == nil {
+		return TargetStatus{}, ErrNotBalanced
+	}
+
+	d := s.drains
+	d.mu.Lock()
+	if _, exists := d.deadlines[target]; !exists {
+		d.mu.Unlock()
+		return TargetStatus{}, fmt.Errorf("%w: %s", ErrNotDraining, target)
+	}
+	if timer := d.timers[target]; timer != nil {
+		timer.Stop()
+		delete(d.timers, target)
+	}
+	delete(d.deadlines, target)
+	d.mu.Unlock()
+
+	return s.status(target), nil
+}
+
+// OnDrainDeadline registers a callback invoked when a draining target's
+// grace period ends, to close the flows still using it
+func (s *Selector) OnDrainDeadline(fn func(target string)) {
+	if s.drains == nil {
+		return
+	}
+
+	s.drains.mu.Lock()
+	defer s.drains.mu.Unlock()
+	s.drains.onDeadline = fn
+}
+
+// Targets returns the state of each balanced target, in configuration order
+func (s *Selector) Targets() []TargetStatus {
+	if s.balancer == nil {
+		return nil
+	}
+
+	result := make([]TargetStatus, len(s.balancer.targets))
+	for i, target := range s.balancer.targets {
+		result[i] = s.status(target)
+	}
+	return result
+}
+
+// status returns the state of a balanced target
+func (s *Selector) status(target string) TargetStatus {
+	b := s.balancer
+	st := TargetStatus{
+		Address: target,
+		Weight:  b.weights[slices.Index(b.targets, target)],
+		Circuit: s.breaker.state(target),
+	}
+
+	b.mu.Lock()
+	load := b.load
+	b.mu.Unlock()
+	if load != nil {
+		st.Active = load(target)
+	}
+
+	s.drains.mu.Lock()
+	deadline, draining := s.drains.deadlines[target]
+	s.drains.mu.Unlock()
+	if draining {
+		st.Draining = true
+		if !deadline.IsZero() {
+			st.DrainDeadline = &deadline
+		}
+	}
+	return st
+}
+
+// expire invokes the deadline callback if target is still draining with
+// the same deadline
+func (d *drainer) expire(target string, deadline time.Time) {
+	d.mu.Lock()
+	current, draining := d.deadlines[target]
+	onDeadline := d.onDeadline
+	delete(d.timers, target)
+	d.mu.Unlock()
+
+	if draining && current.Equal(deadline) && onDeadline != nil {
+		onDeadline(target)
+	}
+}
+
+// stop cancels pending drain deadlines
+func (d *drainer) stop() {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for target, timer := range d.timers {
+		timer.Stop()
+		delete(d.timers, target)
+	}
+}
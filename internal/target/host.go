@@ -0,0 +1,59 @@
+package target
+
+import (
+	"net"
+	"strings"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// hostRule routes HTTP requests for a host to a target template
+type hostRule struct {
+	host     string // Lower case, without the "*." of a wildcard
+	wildcard bool
+	target   string
+}
+
+// newHostRules compiles the HTTP host routes of a listener
+func newHostRules(cfg *config.ListenerConfig) []hostRule {
+	if cfg.HTTP == nil || !cfg.HTTP.Enabled {
+		return nil
+	}
+	var rules []hostRule
+	for _, route := range cfg.HTTP.HostRoutes {
+		host := strings.ToLower(route.Host)
+		rule := hostRule{host: host, target: route.Target}
+		if suffix, ok := strings.CutPrefix(host, "*."); ok {
+			rule.host = suffix
+			rule.wildcard = true
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// matches reports whether the rule applies to host. A wildcard matches
+// subdomains at any depth but not the domain itself.
+func (r hostRule) matches(host string) bool {
+	if r.wildcard {
+		return strings.HasSuffix(host, "."+r.host)
+	}
+	return host == r.host
+}
+
+// SelectHost returns the target address for a client whose first HTTP
+// request is for host (lower case, without port). Host routes are checked
+// in order; flows matching none fall back to Select. Routed flows are not
+// balanced, so the returned backend is empty for them.
+func (s *Selector) SelectHost(host string, clientIP net.IP, clientPort int) (string, string, error) {
+	for _, rule := range s.hosts {
+		if host != "" && rule.matches(host) {
+			addr, err := s.finish(rule.target, clientIP, clientPort)
+			if err != nil {
+				return "", "", err
+			}
+			return addr, "", nil
+		}
+	}
+	return s.Select(clientIP, clientPort)
+}
@@ -0,0 +1,75 @@
+package target
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/dns"
+)
+
+// maxResolveCache bounds the number of hostnames a Resolver rotates between
+const maxResolveCache = 10000
+
+// ErrForwardingLoop is returned when a flow's target is a local listener
+var ErrForwardingLoop = errors.New("forwarding loop detected")
+
+// LoopGuard refuses flows whose target is a local listener.
+// It covers templated targets and DNS changes that the config-time
+// check cannot see.
+type LoopGuard struct {
+	endpoints []config.Endpoint
+	localIPs  []net.IP
+	dns       *dns.Resolver
+}
+
+// NewLoopGuard creates a guard for the given listeners that resolves
+// hostname targets through dnsResolver
+func NewLoopGuard(listeners []config.ListenerConfig, dnsResolver *dns.Resolver) *LoopGuard {
+	return &LoopGuard{
+		endpoints: config.ListenerEndpoints(listeners),
+		localIPs:  config.LocalIPs(),
+		dns:       dnsResolver,
+	}
+}
+
+// Check returns ErrForwardingLoop if addr reaches the source listener itself,
+// or another local listener when chaining is not allowed.
+// A nil guard allows everything.
+func (g *LoopGuard) Check(source *config.ListenerConfig, addr string) error {
+	if g == nil {
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil
+	}
+
+	for _, ip := range g.resolve(host) {
+		name, ok := config.MatchEndpoint(g.endpoints, g.localIPs, strings.ToLower(source.Protocol), ip, port)
+		if !ok {
+			continue
+		}
+		if name == source.Name || !source.AllowChaining {
+			return fmt.Errorf("%w: %s reaches listener %s", ErrForwardingLoop, addr, name)
+		}
+	}
+	return nil
+}
+
+// resolve looks up host; hostnames that do not resolve yield no addresses
+func (g *LoopGuard) resolve(host string) []net.IP {
+	ips, err := g.dns.LookupIP(host)
+	if err != nil {
+		return nil
+	}
+	return ips
+}
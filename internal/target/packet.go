@@ -0,0 +1,74 @@
+package target
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// packetRule routes or drops UDP datagrams matching a payload prefix or
+// regular expression
+type packetRule struct {
+	prefix []byte         // Set for prefix rules
+	re     *regexp.Regexp // Set for regex rules
+	drop   bool
+	target string
+}
+
+// newPacketRules compiles the packet rules of a listener
+func newPacketRules(cfg *config.ListenerConfig) ([]packetRule, error) {
+	rules := make([]packetRule, 0, len(cfg.PacketRules))
+	for i, entry := range cfg.PacketRules {
+		rule := packetRule{
+			prefix: entry.MatchPrefix(),
+			drop:   entry.GetAction() == config.PacketActionDrop,
+			target: entry.Target,
+		}
+		if entry.Regex != "" {
+			re, err := regexp.Compile(entry.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("packet_rules[%d]: %w", i, err)
+			}
+			rule.re = re
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matches reports whether the rule applies to payload
+func (r packetRule) matches(payload []byte) bool {
+	if r.re != nil {
+		return r.re.Match(payload)
+	}
+	return bytes.HasPrefix(payload, r.prefix)
+}
+
+// MatchPacket returns the index of the first packet rule matching payload,
+// or -1, and whether that rule drops the datagram
+func (s *Selector) MatchPacket(payload []byte) (int, bool) {
+	for i, rule := range s.packets {
+		if rule.matches(payload) {
+			return i, rule.drop
+		}
+	}
+	return -1, false
+}
+
+// SelectPacket returns the target address for datagrams matching the
+// packet rule at index rule, as returned by MatchPacket. Datagrams matching
+// no rule (-1) fall back to Select. Routed datagrams are not balanced, so
+// the returned backend is empty for them.
+func (s *Selector) SelectPacket(rule int, clientIP net.IP, clientPort int) (string, string, error) {
+	if rule < 0 {
+		return s.Select(clientIP, clientPort)
+	}
+	addr, err := s.finish(s.packets[rule].target, clientIP, clientPort)
+	if err != nil {
+		return "", "", err
+	}
+	return addr, "", nil
+}
@@ -0,0 +1,195 @@
+package target
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/espegro/packetpony/internal/dns"
+)
+
+// Resolver resolves target hostnames and re-resolves them periodically, so
+// flows follow DNS changes (failover, rescheduled Kubernetes pods) instead of
+// whatever address was current when the first flow was dialed. Lookups that
+// fail keep the last known addresses.
+type Resolver struct {
+	interval    time.Duration
+	dns         *dns.Resolver
+	mu          sync.Mutex
+	hosts       map[string]*hostEntry
+	onChange    func(host string, removed []net.IP)
+	onError     func(host string, err error)
+	stopRefresh chan struct{}
+	closeOnce   sync.Once
+}
+
+// hostEntry holds the current addresses of a hostname
+type hostEntry struct {
+	ips  []net.IP
+	next atomic.Uint64 // Round-robin position
+}
+
+// NewResolver creates a resolver that refreshes known hostnames every
+// interval, looking them up through dnsResolver
+func NewResolver(interval time.Duration, dnsResolver *dns.Resolver) *Resolver {
+	r := &Resolver{
+		interval:    interval,
+		dns:         dnsResolver,
+		hosts:       make(map[string]*hostEntry),
+		stopRefresh: make(chan struct{}),
+	}
+
+	go r.refreshLoop()
+
+	return r
+}
+
+// Resolve replaces a hostname in addr with one of its addresses, rotating
+// between them for successive flows. IP addresses are returned unchanged.
+func (r *Resolver) Resolve(addr string) (string, error) {
+	if r == nil {
+		return addr, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	r.mu.Lock()
+	entry, exists := r.hosts[host]
+	r.mu.Unlock()
+
+	if !exists {
+		ips, err := preferIPv4(r.dns.LookupIP(host))
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve target %s: %w", host, err)
+		}
+		r.mu.Lock()
+		if len(r.hosts) >= maxResolveCache {
+			r.hosts = make(map[string]*hostEntry)
+		}
+		if entry, exists = r.hosts[host]; !exists {
+			entry = &hostEntry{ips: ips}
+			r.hosts[host] = entry
+		}
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	ips := entry.ips
+	r.mu.Unlock()
+
+	ip := ips[(entry.next.Add(1)-1)%uint64(len(ips))]
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// OnChange registers a callback invoked after a refresh drops addresses
+// of a hostname
+func (r *Resolver) OnChange(fn func(host string, removed []net.IP)) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onChange = fn
+}
+
+// OnError registers a callback invoked when refreshing a hostname fails
+func (r *Resolver) OnError(fn func(host string, err error)) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onError = fn
+}
+
+// refreshLoop periodically re-resolves all known hostnames
+func (r *Resolver) refreshLoop() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.refresh()
+		case <-r.stopRefresh:
+			return
+		}
+	}
+}
+
+// refresh re-resolves every known hostname, reporting removed addresses
+func (r *Resolver) refresh() {
+	r.mu.Lock()
+	hosts := make([]string, 0, len(r.hosts))
+	for host := range r.hosts {
+		hosts = append(hosts, host)
+	}
+	r.mu.Unlock()
+
+	for _, host := range hosts {
+		ips, err := preferIPv4(r.dns.Refresh(host))
+
+		r.mu.Lock()
+		onChange, onError := r.onChange, r.onError
+		entry, exists := r.hosts[host]
+		var removed []net.IP
+		if err == nil && exists {
+			for _, old := range entry.ips {
+				if !slices.ContainsFunc(ips, old.Equal) {
+					removed = append(removed, old)
+				}
+			}
+			entry.ips = ips
+		}
+		r.mu.Unlock()
+
+		if err != nil {
+			if onError != nil {
+				onError(host, err)
+			}
+			continue
+		}
+		if len(removed) > 0 && onChange != nil {
+			onChange(host, removed)
+		}
+	}
+}
+
+// Close stops the refresh goroutine
+func (r *Resolver) Close() {
+	if r == nil {
+		return
+	}
+	r.closeOnce.Do(func() {
+		close(r.stopRefresh)
+	})
+}
+
+// preferIPv4 keeps only the IPv4 addresses of a lookup result, if it has
+// any, so rotation does not mix address families
+func preferIPv4(ips []net.IP, err error) ([]net.IP, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if len(v4) > 0 {
+		return v4, nil
+	}
+	return v6, nil
+}
@@ -0,0 +1,276 @@
+// Package target selects the backend address for a flow.
+// Targets can be fixed, templated from client attributes, or chosen from a
+// CIDR-keyed mapping table.
+package target
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/espegro/packetpony/internal/acl"
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/dns"
+)
+
+// ErrNoTarget is returned by Failover when every target has been tried
+var ErrNoTarget = errors.New("no target left to fail over to")
+
+// Selector picks the target address for a client
+type Selector struct {
+	listener      *config.ListenerConfig
+	listenPort    string // Port of listen_address, for the {port} placeholder
+	defaultTarget string
+	balancer      *balancer // nil unless several targets are configured
+	breaker       *breaker  // nil unless balanced targets have a circuit breaker
+	drains        *drainer  // nil unless several targets are configured
+	rules         []mapRule
+	hosts         []hostRule   // HTTP host routes, checked before rules
+	sniffs        []sniffRule  // Protocol sniffing routes, checked before rules
+	packets       []packetRule // UDP packet rules, checked before rules
+	guard         *LoopGuard
+	resolver      *Resolver // nil unless target_resolve_interval is set
+}
+
+// mapRule routes clients matching a CIDR set to a target template
+type mapRule struct {
+	match  *acl.Allowlist
+	target string
+}
+
+// NewSelector creates a target selector from listener configuration.
+// guard, if non-nil, refuses targets that loop back to local listeners.
+// dnsResolver resolves hostname targets when target_resolve_interval is set.
+func NewSelector(cfg *config.ListenerConfig, guard *LoopGuard, dnsResolver *dns.Resolver) (*Selector, error) {
+	_, listenPort, _ := net.SplitHostPort(cfg.ListenAddress)
+	selector := &Selector{
+		listener:      cfg,
+		listenPort:    listenPort,
+		defaultTarget: cfg.TargetAddress,
+		guard:         guard,
+		hosts:         newHostRules(cfg),
+		sniffs:        newSniffRules(cfg),
+	}
+	if len(cfg.Targets) > 0 {
+		selector.balancer = newBalancer(cfg)
+		selector.drains = newDrainer()
+		if cfg.HasCircuitBreaker() {
+			selector.breaker = newBreaker(cfg.CircuitBreaker)
+		}
+	}
+	if cfg.TargetResolveInterval > 0 {
+		selector.resolver = NewResolver(cfg.TargetResolveInterval, dnsResolver)
+	}
+
+	for i, entry := range cfg.TargetMap {
+		match, err := acl.NewAllowlist(entry.Match)
+		if err != nil {
+			return nil, fmt.Errorf("target_map[%d]: %w", i, err)
+		}
+		selector.rules = append(selector.rules, mapRule{
+			match:  match,
+			target: entry.Target,
+		})
+	}
+
+	packets, err := newPacketRules(cfg)
+	if err != nil {
+		return nil, err
+	}
+	selector.packets = packets
+
+	return selector, nil
+}
+
+// Select returns the target address for a client, and the balanced target
+// it was derived from (empty unless the flow was balanced across targets).
+// Mapping rules are checked in order, falling back to the default target;
+// placeholders in the chosen target are then expanded and the result is
+// checked for forwarding loops. ErrCircuitOpen is returned when every
+// balanced target's circuit is open.
+func (s *Selector) Select(clientIP net.IP, clientPort int) (string, string, error) {
+	target := ""
+	for _, rule := range s.rules {
+		if rule.match.IsAllowed(clientIP) {
+			target = rule.target
+			break
+		}
+	}
+
+	var backend string
+	if target == "" {
+		if s.balancer != nil {
+			backend = s.pickBalanced()
+			if backend == "" {
+				return "", "", ErrCircuitOpen
+			}
+			target = backend
+		} else {
+			target = s.defaultTarget
+		}
+	}
+
+	addr, err := s.finish(target, clientIP, clientPort)
+	if err != nil {
+		return "", "", err
+	}
+	return addr, backend, nil
+}
+
+// pickBalanced returns the balanced target for a new flow, or "" if every
+// circuit refuses it. A pick whose circuit no longer admits the flow (its
+// trial flow was just taken) is retried among the remaining targets.
+func (s *Selector) pickBalanced() string {
+	for range s.balancer.targets {
+		backend := s.balancer.pick(s.available)
+		if s.breaker.admit(backend) {
+			return backend
+		}
+	}
+	return ""
+}
+
+// Failover returns the next balanced target to try after the targets in
+// tried failed, in configuration order and skipping draining targets and
+// targets whose circuit is open. ErrNoTarget is returned when none is left.
+func (s *Selector) Failover(clientIP net.IP, clientPort int, tried []string) (string, string, error) {
+	if s.balancer == nil || len(tried) == 0 {
+		return "", "", ErrNoTarget
+	}
+
+	targets := s.balancer.targets
+	start := slices.Index(targets, tried[len(tried)-1]) + 1
+	for n := 0; n < len(targets); n++ {
+		backend := targets[(start+n)%len(targets)]
+		if slices.Contains(tried, backend) || !s.available(backend) || !s.breaker.admit(backend) {
+			continue
+		}
+		addr, err := s.finish(backend, clientIP, clientPort)
+		if err != nil {
+			return "", "", err
+		}
+		return addr, backend, nil
+	}
+	return "", "", ErrNoTarget
+}
+
+// available reports whether a balanced target may receive new flows
+func (s *Selector) available(backend string) bool {
+	return !s.drains.draining(backend) && s.breaker.available(backend)
+}
+
+// ReportFailure records a failed connect or write to a balanced target
+func (s *Selector) ReportFailure(backend string) {
+	if backend != "" {
+		s.breaker.failure(backend)
+	}
+}
+
+// ReportSuccess records a successful connect or write to a balanced target
+func (s *Selector) ReportSuccess(backend string) {
+	if backend != "" {
+		s.breaker.success(backend)
+	}
+}
+
+// finish expands placeholders in target, resolves it and checks the
+// result for forwarding loops
+func (s *Selector) finish(target string, clientIP net.IP, clientPort int) (string, error) {
+	addr, err := expand(target, clientIP, clientPort, s.listenPort)
+	if err != nil {
+		return "", err
+	}
+	if addr, err = s.resolver.Resolve(addr); err != nil {
+		return "", err
+	}
+	if err := s.guard.Check(s.listener, addr); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// Route returns the address of a target chosen outside the configured
+// ones, such as by the listener's script. It takes placeholders and is
+// resolved and checked for loops like any target.
+func (s *Selector) Route(target string, clientIP net.IP, clientPort int) (string, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return "", fmt.Errorf("invalid target %q: %w", target, err)
+	}
+	return s.finish(target, clientIP, clientPort)
+}
+
+// SetLoad registers a function reporting the active flows of a balanced
+// target, used by the least_conn policy
+func (s *Selector) SetLoad(fn func(target string) int64) {
+	if s.balancer != nil {
+		s.balancer.setLoad(fn)
+	}
+}
+
+// Resolver returns the target resolver, or nil if targets are resolved at
+// dial time
+func (s *Selector) Resolver() *Resolver {
+	return s.resolver
+}
+
+// Close stops background target resolution and pending drain deadlines
+func (s *Selector) Close() {
+	s.resolver.Close()
+	s.drains.stop()
+}
+
+// expand replaces {placeholder} references with client attributes and
+// {port} with the listen port
+func expand(template string, clientIP net.IP, clientPort int, listenPort string) (string, error) {
+	if !strings.Contains(template, "{") {
+		return template, nil
+	}
+
+	var b strings.Builder
+	rest := template
+	for {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			b.WriteString(rest)
+			break
+		}
+		end := strings.Index(rest[open:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated placeholder in %s", template)
+		}
+
+		b.WriteString(rest[:open])
+		value, err := placeholderValue(rest[open+1:open+end], clientIP, clientPort, listenPort)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		rest = rest[open+end+1:]
+	}
+
+	return b.String(), nil
+}
+
+// placeholderValue resolves a single placeholder
+func placeholderValue(name string, clientIP net.IP, clientPort int, listenPort string) (string, error) {
+	switch name {
+	case "port":
+		return listenPort, nil
+	case "client_ip":
+		return clientIP.String(), nil
+	case "client_port":
+		return strconv.Itoa(clientPort), nil
+	case "client_octet1", "client_octet2", "client_octet3", "client_octet4":
+		v4 := clientIP.To4()
+		if v4 == nil {
+			return "", fmt.Errorf("placeholder {%s} requires an IPv4 client, got %s", name, clientIP)
+		}
+		index := int(name[len(name)-1] - '1')
+		return strconv.Itoa(int(v4[index])), nil
+	default:
+		return "", fmt.Errorf("unknown placeholder {%s}", name)
+	}
+}
@@ -0,0 +1,95 @@
+package target
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/espegro/packetpony/internal/classify"
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// sniffRule routes flows whose first bytes match to a target template
+type sniffRule struct {
+	protocol string // Set for protocol routes
+	prefix   []byte // Set for prefix routes
+	target   string
+}
+
+// newSniffRules compiles the sniff routes of a listener
+func newSniffRules(cfg *config.ListenerConfig) []sniffRule {
+	if cfg.Sniff == nil || !cfg.Sniff.Enabled {
+		return nil
+	}
+	rules := make([]sniffRule, 0, len(cfg.Sniff.Routes))
+	for _, route := range cfg.Sniff.Routes {
+		rules = append(rules, sniffRule{
+			protocol: route.Protocol,
+			prefix:   route.MatchPrefix(),
+			target:   route.Target,
+		})
+	}
+	return rules
+}
+
+// matches reports whether the rule applies to payload
+func (r sniffRule) matches(payload []byte) bool {
+	if r.prefix != nil {
+		return bytes.HasPrefix(payload, r.prefix)
+	}
+	return classify.TCP(payload) == r.protocol
+}
+
+// undecided reports whether the rule does not match payload yet but might
+// once more bytes arrive
+func (r sniffRule) undecided(payload []byte) bool {
+	if r.prefix != nil {
+		return len(payload) < len(r.prefix) && bytes.HasPrefix(r.prefix, payload)
+	}
+	return classify.Incomplete(payload, r.protocol)
+}
+
+// Sniffing reports whether the listener routes by the first client bytes
+func (s *Selector) Sniffing() bool {
+	return len(s.sniffs) > 0
+}
+
+// SniffComplete reports whether payload is enough to pick a sniff route.
+// Routes are first match, so an earlier route that could still match once
+// more bytes arrive keeps the decision open.
+func (s *Selector) SniffComplete(payload []byte) bool {
+	for _, rule := range s.sniffs {
+		if rule.matches(payload) {
+			return true
+		}
+		if rule.undecided(payload) {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectSniffed returns the target address for a client that sent payload
+// before the sniff timeout. Clients that sent nothing go to the timeout
+// target if one is set; flows matching no route fall back to Select.
+// Routed flows are not balanced, so the returned backend is empty for them.
+func (s *Selector) SelectSniffed(payload []byte, clientIP net.IP, clientPort int) (string, string, error) {
+	target := ""
+	if len(payload) == 0 {
+		target = s.listener.Sniff.TimeoutTarget
+	} else {
+		for _, rule := range s.sniffs {
+			if rule.matches(payload) {
+				target = rule.target
+				break
+			}
+		}
+	}
+	if target == "" {
+		return s.Select(clientIP, clientPort)
+	}
+	addr, err := s.finish(target, clientIP, clientPort)
+	if err != nil {
+		return "", "", err
+	}
+	return addr, "", nil
+}
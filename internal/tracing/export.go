@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// The types below are the OTLP/HTTP JSON encoding of an export request.
+// IDs are hex strings and 64-bit integers are decimal strings.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []Attribute `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []spanJSON `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type spanJSON struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []Attribute `json:"attributes,omitempty"`
+	Status            *status     `json:"status,omitempty"`
+}
+
+// OTLP status code for a failed span
+const statusError = 2
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Attribute is a span attribute
+type Attribute struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+// encode converts a span to its OTLP JSON form
+func (s *Span) encode() spanJSON {
+	out := spanJSON{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(s.end),
+		Attributes:        s.attrs,
+	}
+	if s.parentID != ([8]byte{}) {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.errMsg != "" {
+		out.Status = &status{Code: statusError, Message: s.errMsg}
+	}
+	return out
+}
+
+// newExportRequest wraps spans in an export request under the resource
+func newExportRequest(res []Attribute, spans []*Span) exportRequest {
+	encoded := make([]spanJSON, len(spans))
+	for i, s := range spans {
+		encoded[i] = s.encode()
+	}
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: res},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{Name: "packetpony"},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func formatInt(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
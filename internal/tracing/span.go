@@ -0,0 +1,162 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// OTLP span kinds
+const (
+	kindInternal = 1
+	kindServer   = 2
+	kindClient   = 3
+)
+
+// Span is one timed step of a flow. A nil *Span is valid and records
+// nothing, so callers do not need to check whether a flow is traced.
+// A span is not safe for concurrent use.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for a root span without a remote parent
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []Attribute
+	errMsg   string
+	ended    bool
+	stepEnd  time.Time // End of the latest step
+}
+
+// StartFlow starts the root span of a connection or UDP session. flowID
+// becomes the span ID, so the span can be found from the flow_id in logs.
+// traceParent is a W3C traceparent value the flow continues, or empty to
+// start a new trace. Returns nil on a nil tracer.
+func (t *Tracer) StartFlow(name, flowID string, start time.Time, traceParent string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, kind: kindServer, start: start}
+	if !parseTraceParent(traceParent, &s.traceID, &s.parentID) {
+		rand.Read(s.traceID[:])
+	}
+	if b, err := hex.DecodeString(flowID); err == nil && len(b) == len(s.spanID) {
+		copy(s.spanID[:], b)
+	} else {
+		rand.Read(s.spanID[:])
+	}
+	s.SetString("packetpony.flow_id", flowID)
+	return s
+}
+
+// SetString sets a string attribute
+func (s *Span) SetString(key, value string) {
+	if s == nil || value == "" {
+		return
+	}
+	s.attrs = append(s.attrs, Attribute{Key: key, Value: anyValue{StringValue: &value}})
+}
+
+// SetInt sets an integer attribute
+func (s *Span) SetInt(key string, value int64) {
+	if s == nil {
+		return
+	}
+	v := formatInt(value)
+	s.attrs = append(s.attrs, Attribute{Key: key, Value: anyValue{IntValue: &v}})
+}
+
+// Step records a completed child step of the span, such as admission or
+// dialing the target. A non-empty errMsg marks the step as failed.
+func (s *Span) Step(name string, start, end time.Time, errMsg string) {
+	if s == nil {
+		return
+	}
+	kind := kindInternal
+	if name == StepDial {
+		kind = kindClient
+	}
+	child := &Span{
+		tracer:   s.tracer,
+		traceID:  s.traceID,
+		parentID: s.spanID,
+		name:     name,
+		kind:     kind,
+		start:    start,
+		end:      end,
+		errMsg:   errMsg,
+		ended:    true,
+	}
+	rand.Read(child.spanID[:])
+	s.tracer.enqueue(child)
+	s.stepEnd = end
+}
+
+// NextStep records a completed child step that started where the
+// previous step ended, or with the span if there was none
+func (s *Span) NextStep(name string, end time.Time, errMsg string) {
+	if s == nil {
+		return
+	}
+	start := s.stepEnd
+	if start.IsZero() {
+		start = s.start
+	}
+	s.Step(name, start, end, errMsg)
+}
+
+// End ends the span and queues it for export. A non-empty errMsg marks
+// the flow as failed. Only the first call has any effect.
+func (s *Span) End(end time.Time, errMsg string) {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	s.end = end
+	s.errMsg = errMsg
+	s.tracer.enqueue(s)
+}
+
+// TraceParent returns the W3C traceparent value naming this span as the
+// parent, for passing the trace on to the target
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// parseTraceParent reads the trace and parent span IDs from a W3C
+// traceparent value. Reports false if it is missing or malformed.
+func parseTraceParent(value string, traceID *[16]byte, parentID *[8]byte) bool {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return false
+	}
+	t, err := hex.DecodeString(parts[1])
+	if err != nil || len(t) != len(traceID) {
+		return false
+	}
+	p, err := hex.DecodeString(parts[2])
+	if err != nil || len(p) != len(parentID) {
+		return false
+	}
+	var zeroTrace [16]byte
+	var zeroSpan [8]byte
+	copy(traceID[:], t)
+	copy(parentID[:], p)
+	if *traceID == zeroTrace || *parentID == zeroSpan {
+		*traceID, *parentID = zeroTrace, zeroSpan
+		return false
+	}
+	return true
+}
+
+// stringAttr returns a string attribute
+func stringAttr(key, value string) Attribute {
+	return Attribute{Key: key, Value: anyValue{StringValue: &value}}
+}
@@ -0,0 +1,198 @@
+// Package tracing exports the lifecycle of connections and UDP sessions
+// as OpenTelemetry spans over OTLP/HTTP with JSON encoding.
+//
+// Each traced flow is a root span with child spans for its steps:
+// admission, dialing the target and transferring data. Spans are queued
+// and exported in batches by a background goroutine; when the queue is
+// full, new spans are dropped rather than slowing down forwarding.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/espegro/packetpony/internal/config"
+	"github.com/espegro/packetpony/internal/logging"
+)
+
+// Names of the child spans of a flow
+const (
+	StepAdmission = "admission"
+	StepDial      = "dial"
+	StepTransfer  = "transfer"
+)
+
+// failureLogInterval limits how often export failures are logged
+const failureLogInterval = time.Minute
+
+// Tracer queues finished spans and exports them in batches. A nil
+// *Tracer is valid and traces nothing.
+type Tracer struct {
+	cfg      config.TracingConfig
+	resource []Attribute
+	client   *http.Client
+	logger   logging.Logger
+	queue    chan *Span
+	dropped  atomic.Int64 // Spans dropped since the last logged failure
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	lastFailure time.Time // Guarded by the export goroutine
+}
+
+// NewTracer starts a tracer exporting to cfg.Endpoint. instance is
+// exported as the service.instance.id resource attribute. Returns nil
+// when tracing is disabled.
+func NewTracer(cfg config.TracingConfig, instance string, logger logging.Logger) *Tracer {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	t := &Tracer{
+		cfg: cfg,
+		resource: []Attribute{
+			stringAttr("service.name", cfg.GetServiceName()),
+			stringAttr("service.instance.id", instance),
+		},
+		client: &http.Client{Timeout: cfg.GetTimeout()},
+		logger: logger,
+		queue:  make(chan *Span, cfg.GetQueueSize()),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// enqueue queues a finished span, dropping it if the queue is full
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// run exports queued spans whenever a batch is full or the flush
+// interval passes, and what is left once the tracer is closed
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.cfg.GetFlushInterval())
+	defer ticker.Stop()
+
+	batchSize := t.cfg.GetBatchSize()
+	batch := make([]*Span, 0, batchSize)
+	flush := func() bool {
+		if len(batch) == 0 {
+			return true
+		}
+		ok := t.export(batch)
+		batch = batch[:0]
+		return ok
+	}
+
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			if t.dropped.Load() > 0 {
+				t.reportFailure(fmt.Errorf("export queue full"), 0)
+			}
+		case <-t.stop:
+			// Give up on the rest after a failure so an unreachable
+			// endpoint does not hold up shutdown
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+					if len(batch) >= batchSize && !flush() {
+						return
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends a batch of spans to the endpoint. Reports whether it was
+// accepted.
+func (t *Tracer) export(spans []*Span) bool {
+	body, err := json.Marshal(newExportRequest(t.resource, spans))
+	if err != nil {
+		t.reportFailure(err, len(spans))
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.GetTimeout())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		t.reportFailure(err, len(spans))
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		t.reportFailure(err, len(spans))
+		return false
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		t.reportFailure(fmt.Errorf("endpoint returned %s", resp.Status), len(spans))
+		return false
+	}
+	return true
+}
+
+// reportFailure counts lost spans and logs them, at most once per
+// failureLogInterval. Only called from the export goroutine.
+func (t *Tracer) reportFailure(err error, lost int) {
+	t.dropped.Add(int64(lost))
+	if time.Since(t.lastFailure) < failureLogInterval {
+		return
+	}
+	t.lastFailure = time.Now()
+	t.logger.LogWarning(logging.EventTraceExportFailed, map[string]interface{}{
+		"endpoint": t.cfg.Endpoint,
+		"error":    err.Error(),
+		"dropped":  t.dropped.Swap(0),
+	})
+}
+
+// Close exports the queued spans and stops the tracer. Spans ended
+// afterwards are dropped. It is safe to call more than once.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.closeOnce.Do(func() {
+		close(t.stop)
+	})
+	<-t.done
+	return nil
+}
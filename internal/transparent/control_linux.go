@@ -0,0 +1,27 @@
+//go:build linux
+
+package transparent
+
+import (
+	"strings"
+	"syscall"
+)
+
+// ipv6Transparent is IPV6_TRANSPARENT, which the syscall package lacks
+const ipv6Transparent = 75
+
+// control sets IP_TRANSPARENT (IPV6_TRANSPARENT for IPv6 sockets) so the
+// socket may bind to an address that is not local
+func control(network, _ string, c syscall.RawConn) error {
+	level, opt := syscall.SOL_IP, syscall.IP_TRANSPARENT
+	if strings.HasSuffix(network, "6") {
+		level, opt = syscall.SOL_IPV6, ipv6Transparent
+	}
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
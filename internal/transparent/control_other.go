@@ -0,0 +1,13 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"errors"
+	"syscall"
+)
+
+// control fails: transparent sockets are only available on Linux
+func control(_, _ string, _ syscall.RawConn) error {
+	return errors.New("transparent mode is only supported on Linux")
+}
@@ -0,0 +1,29 @@
+// Package transparent opens target connections from the client's own IP
+// address, so backends see the real source. The kernel only allows this
+// for sockets with IP_TRANSPARENT, which needs CAP_NET_ADMIN, and replies
+// to the client's address are only delivered back with policy routing.
+package transparent
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Dialer returns a dialer whose connections use source as their source
+// address. network is "tcp" or "udp"; the source port is left to the
+// kernel.
+func Dialer(network string, source net.IP, timeout time.Duration) *net.Dialer {
+	if ip4 := source.To4(); ip4 != nil {
+		source = ip4
+	}
+	var local net.Addr = &net.TCPAddr{IP: source}
+	if strings.HasPrefix(network, "udp") {
+		local = &net.UDPAddr{IP: source}
+	}
+	return &net.Dialer{
+		Timeout:   timeout,
+		LocalAddr: local,
+		Control:   control,
+	}
+}
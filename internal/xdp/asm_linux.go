@@ -0,0 +1,161 @@
+//go:build linux
+
+package xdp
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// insnSize is the size of an encoded instruction
+const insnSize = 8
+
+// Registers. R0 holds return values, R1-R5 arguments and are clobbered by
+// calls, R6-R9 survive calls and R10 is the read-only frame pointer.
+const (
+	r0 uint8 = iota
+	r1
+	r2
+	r3
+	r4
+	r5
+	r6
+	r7
+	r8
+	r9
+	r10
+)
+
+// Helper functions the programs call
+const (
+	funcMapLookupElem = 1
+	funcRedirectMap   = 51
+)
+
+// insn is an eBPF instruction
+type insn struct {
+	op       uint8
+	dst, src uint8
+	off      int16
+	imm      int32
+	target   string // Label of a jump, resolved into off
+}
+
+// assembler builds a program from instructions and jump labels
+type assembler struct {
+	insns  []insn
+	labels map[string]int
+}
+
+// emit appends an instruction
+func (a *assembler) emit(i insn) {
+	a.insns = append(a.insns, i)
+}
+
+// label names the position of the next instruction
+func (a *assembler) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+// mov sets dst to imm
+func (a *assembler) mov(dst uint8, imm int32) {
+	a.emit(insn{op: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K, dst: dst, imm: imm})
+}
+
+// movReg sets dst to src
+func (a *assembler) movReg(dst, src uint8) {
+	a.emit(insn{op: unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X, dst: dst, src: src})
+}
+
+// alu applies op with imm to dst
+func (a *assembler) alu(op uint8, dst uint8, imm int32) {
+	a.emit(insn{op: unix.BPF_ALU64 | op | unix.BPF_K, dst: dst, imm: imm})
+}
+
+// aluReg applies op with src to dst
+func (a *assembler) aluReg(op uint8, dst, src uint8) {
+	a.emit(insn{op: unix.BPF_ALU64 | op | unix.BPF_X, dst: dst, src: src})
+}
+
+// be16 converts the 16-bit network order value in dst to host order
+func (a *assembler) be16(dst uint8) {
+	a.emit(insn{op: unix.BPF_ALU | unix.BPF_END | unix.BPF_TO_BE, dst: dst, imm: 16})
+}
+
+// load sets dst to the value of size at src+off
+func (a *assembler) load(size uint8, dst, src uint8, off int16) {
+	a.emit(insn{op: unix.BPF_LDX | size | unix.BPF_MEM, dst: dst, src: src, off: off})
+}
+
+// store writes src as a value of size to dst+off
+func (a *assembler) store(size uint8, dst uint8, off int16, src uint8) {
+	a.emit(insn{op: unix.BPF_STX | size | unix.BPF_MEM, dst: dst, src: src, off: off})
+}
+
+// storeImm writes imm as a value of size to dst+off
+func (a *assembler) storeImm(size uint8, dst uint8, off int16, imm int32) {
+	a.emit(insn{op: unix.BPF_ST | size | unix.BPF_MEM, dst: dst, off: off, imm: imm})
+}
+
+// jump continues at target
+func (a *assembler) jump(target string) {
+	a.emit(insn{op: unix.BPF_JMP | unix.BPF_JA, target: target})
+}
+
+// jumpIf continues at target if dst compares to imm by op
+func (a *assembler) jumpIf(op uint8, dst uint8, imm int32, target string) {
+	a.emit(insn{op: unix.BPF_JMP | op | unix.BPF_K, dst: dst, imm: imm, target: target})
+}
+
+// jumpIfReg continues at target if dst compares to src by op
+func (a *assembler) jumpIfReg(op uint8, dst, src uint8, target string) {
+	a.emit(insn{op: unix.BPF_JMP | op | unix.BPF_X, dst: dst, src: src, target: target})
+}
+
+// call calls a helper function
+func (a *assembler) call(fn int32) {
+	a.emit(insn{op: unix.BPF_JMP | unix.BPF_CALL, imm: fn})
+}
+
+// exit returns R0
+func (a *assembler) exit() {
+	a.emit(insn{op: unix.BPF_JMP | unix.BPF_EXIT})
+}
+
+// loadMap sets dst to the map with file descriptor fd. It takes two
+// instruction slots.
+func (a *assembler) loadMap(dst uint8, fd int) {
+	a.emit(insn{op: unix.BPF_LD | unix.BPF_DW | unix.BPF_IMM, dst: dst, src: unix.BPF_PSEUDO_MAP_FD, imm: int32(fd)})
+	a.emit(insn{})
+}
+
+// assemble resolves jump labels and encodes the instructions in host
+// byte order
+func (a *assembler) assemble() ([]byte, error) {
+	// The register nibbles are ordered by the host too
+	littleEndian := binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+	out := make([]byte, 0, len(a.insns)*insnSize)
+	for n, i := range a.insns {
+		if i.target != "" {
+			pos, ok := a.labels[i.target]
+			if !ok {
+				return nil, fmt.Errorf("undefined label %s", i.target)
+			}
+			i.off = int16(pos - n - 1)
+		}
+		regs := i.dst | i.src<<4
+		if !littleEndian {
+			regs = i.dst<<4 | i.src
+		}
+		out = append(out, i.op, regs)
+		out = binary.NativeEndian.AppendUint16(out, uint16(i.off))
+		out = binary.NativeEndian.AppendUint32(out, uint32(i.imm))
+	}
+	return out, nil
+}
@@ -0,0 +1,230 @@
+//go:build linux
+
+package xdp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// verifierLogSize is the size of the buffer for the verifier's log of a
+// rejected program
+const verifierLogSize = 64 * 1024
+
+// pad follows each pointer in a bpf attribute, filling its 64-bit field:
+// the upper half of the pointer on 32-bit little-endian platforms
+type pad [8 - unsafe.Sizeof(uintptr(0))]byte
+
+// mapCreateAttr is the attribute of BPF_MAP_CREATE
+type mapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+	innerMapFD uint32
+	numaNode   uint32
+	mapName    [unix.BPF_OBJ_NAME_LEN]byte
+}
+
+// mapElemAttr is the attribute of the BPF_MAP_*_ELEM commands
+type mapElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   unsafe.Pointer
+	_     pad
+	value unsafe.Pointer
+	_     pad
+	flags uint64
+}
+
+// progLoadAttr is the attribute of BPF_PROG_LOAD
+type progLoadAttr struct {
+	progType    uint32
+	insnCount   uint32
+	insns       unsafe.Pointer
+	_           pad
+	license     unsafe.Pointer
+	_           pad
+	logLevel    uint32
+	logSize     uint32
+	logBuf      unsafe.Pointer
+	_           pad
+	kernVersion uint32
+	progFlags   uint32
+	progName    [unix.BPF_OBJ_NAME_LEN]byte
+}
+
+// linkCreateAttr is the attribute of BPF_LINK_CREATE
+type linkCreateAttr struct {
+	progFD        uint32
+	targetIfindex uint32
+	attachType    uint32
+	flags         uint32
+}
+
+// bpf runs a bpf(2) command and returns the file descriptor it created, if any
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	runtime.KeepAlive(attr)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// objName returns name as a kernel object name
+func objName(name string) [unix.BPF_OBJ_NAME_LEN]byte {
+	var b [unix.BPF_OBJ_NAME_LEN]byte
+	copy(b[:len(b)-1], name)
+	return b
+}
+
+// bpfMap is a kernel map
+type bpfMap struct {
+	fd        int
+	valueSize int // Of a lookup, which has a value per CPU for per-CPU maps
+}
+
+// createMap creates a kernel map
+func createMap(name string, mapType, keySize, valueSize, maxEntries, flags uint32) (*bpfMap, error) {
+	attr := mapCreateAttr{
+		mapType:    mapType,
+		keySize:    keySize,
+		valueSize:  valueSize,
+		maxEntries: maxEntries,
+		mapFlags:   flags,
+		mapName:    objName(name),
+	}
+	fd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create map %s: %w", name, err)
+	}
+
+	m := &bpfMap{fd: fd, valueSize: int(valueSize)}
+	if mapType == unix.BPF_MAP_TYPE_PERCPU_ARRAY {
+		cpus, err := possibleCPUs()
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.valueSize = cpus * int((valueSize+7)&^7)
+	}
+	return m, nil
+}
+
+// elem runs a command on an element of the map
+func (m *bpfMap) elem(cmd int, key, value []byte, flags uint64) error {
+	attr := mapElemAttr{
+		mapFD: uint32(m.fd),
+		key:   unsafe.Pointer(&key[0]),
+		flags: flags,
+	}
+	if value != nil {
+		attr.value = unsafe.Pointer(&value[0])
+	}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// update sets the value of key
+func (m *bpfMap) update(key, value []byte) error {
+	return m.elem(unix.BPF_MAP_UPDATE_ELEM, key, value, unix.BPF_ANY)
+}
+
+// delete removes key, which is not an error if it is absent
+func (m *bpfMap) delete(key []byte) error {
+	if err := m.elem(unix.BPF_MAP_DELETE_ELEM, key, nil, 0); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+// lookup returns the value of key
+func (m *bpfMap) lookup(key []byte) ([]byte, error) {
+	value := make([]byte, m.valueSize)
+	if err := m.elem(unix.BPF_MAP_LOOKUP_ELEM, key, value, 0); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// close releases the map; the kernel frees it once no program uses it
+func (m *bpfMap) close() {
+	if m != nil {
+		unix.Close(m.fd)
+	}
+}
+
+// loadProgram loads an XDP program, returning the verifier's log if the
+// kernel rejects it
+func loadProgram(name string, insns []byte) (int, error) {
+	license := []byte("MIT\x00")
+	attr := progLoadAttr{
+		progType:  unix.BPF_PROG_TYPE_XDP,
+		insnCount: uint32(len(insns) / insnSize),
+		insns:     unsafe.Pointer(&insns[0]),
+		license:   unsafe.Pointer(&license[0]),
+		progName:  objName(name),
+	}
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		return fd, nil
+	}
+
+	// Load again for the verifier's reasons
+	log := make([]byte, verifierLogSize)
+	attr.logLevel = 1
+	attr.logSize = uint32(len(log))
+	attr.logBuf = unsafe.Pointer(&log[0])
+	if fd, retryErr := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); retryErr == nil {
+		return fd, nil
+	}
+	if n := strings.IndexByte(string(log), 0); n > 0 {
+		return -1, fmt.Errorf("failed to load program: %w: %s", err, strings.TrimSpace(string(log[:n])))
+	}
+	return -1, fmt.Errorf("failed to load program: %w", err)
+}
+
+// attachProgram attaches an XDP program to an interface, returning the
+// link that detaches it once closed
+func attachProgram(prog, ifindex int, flags uint32) (int, error) {
+	attr := linkCreateAttr{
+		progFD:        uint32(prog),
+		targetIfindex: uint32(ifindex),
+		attachType:    unix.BPF_XDP,
+		flags:         flags,
+	}
+	return bpf(unix.BPF_LINK_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// possibleCPUs returns the number of CPUs the kernel keeps per-CPU map
+// values for
+func possibleCPUs() (int, error) {
+	data, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return 0, err
+	}
+
+	// A list of ranges such as 0-3,5; values are kept up to the last
+	n := 0
+	for _, r := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		_, last, found := strings.Cut(r, "-")
+		if !found {
+			last = r
+		}
+		cpu, err := strconv.Atoi(last)
+		if err != nil {
+			return 0, fmt.Errorf("invalid possible CPUs %q", data)
+		}
+		n = max(n, cpu+1)
+	}
+	return n, nil
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package xdp
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Header sizes of the frames the redirect program steers to the sockets
+const (
+	ethHeaderLen  = 14
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+)
+
+// parseFrame returns the UDP datagram in an Ethernet frame, which the
+// redirect program checked to carry IPv4 without options or fragments, or
+// IPv6 without extension headers. Frames that are truncated or have
+// inconsistent lengths are not datagrams. The UDP checksum is not
+// verified: local senders such as the peers of veth interfaces leave it
+// for a checksum offload that never happens.
+func parseFrame(frame []byte) (Datagram, bool) {
+	if len(frame) < ethHeaderLen {
+		return Datagram{}, false
+	}
+	packet := frame[ethHeaderLen:]
+
+	var src net.IP
+	var dscp int
+	var udp []byte
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case 0x0800:
+		if len(packet) < ipv4HeaderLen || !ipv4ChecksumValid(packet[:ipv4HeaderLen]) {
+			return Datagram{}, false
+		}
+		total := int(binary.BigEndian.Uint16(packet[2:]))
+		if total < ipv4HeaderLen+udpHeaderLen || total > len(packet) {
+			return Datagram{}, false
+		}
+		src = net.IPv4(packet[12], packet[13], packet[14], packet[15])
+		dscp = int(packet[1] >> 2)
+		udp = packet[ipv4HeaderLen:total]
+	case 0x86dd:
+		if len(packet) < ipv6HeaderLen {
+			return Datagram{}, false
+		}
+		length := int(binary.BigEndian.Uint16(packet[4:]))
+		if length < udpHeaderLen || ipv6HeaderLen+length > len(packet) {
+			return Datagram{}, false
+		}
+		src = append(net.IP(nil), packet[8:24]...)
+		dscp = int(binary.BigEndian.Uint16(packet)>>4&0xff) >> 2
+		udp = packet[ipv6HeaderLen : ipv6HeaderLen+length]
+	default:
+		return Datagram{}, false
+	}
+
+	length := int(binary.BigEndian.Uint16(udp[4:]))
+	if length < udpHeaderLen || length > len(udp) {
+		return Datagram{}, false
+	}
+	udp = udp[:length]
+
+	return Datagram{
+		Source:  &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(udp))},
+		DSCP:    dscp,
+		Payload: udp[udpHeaderLen:],
+	}, true
+}
+
+// ipv4ChecksumValid reports whether an IPv4 header sums to all ones, as
+// it does with a correct checksum
+func ipv4ChecksumValid(header []byte) bool {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return sum == 0xffff
+}
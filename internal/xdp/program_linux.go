@@ -0,0 +1,337 @@
+//go:build linux
+
+package xdp
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// XDP verdicts
+const (
+	xdpDrop = 1
+	xdpPass = 2
+)
+
+// Transport protocols the program filters
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// Drop counter indexes within a listener's pair of counters
+const (
+	dropACL = iota
+	dropBanned
+	dropReasons
+)
+
+// dropReasonNames are the reasons of the drop counters, by index
+var dropReasonNames = [dropReasons]string{ReasonACL, ReasonBanned}
+
+// Map key sizes
+const (
+	portKeySize  = 20
+	banKeySize   = 20
+	allowKeySize = 24
+)
+
+// rxQueueIndexOff is the offset of the receive queue in the context of
+// an XDP program
+const rxQueueIndexOff = 16
+
+// Stack offsets of the map keys the program builds, laid out like the
+// keys encoded by portKey, banKey and allowKey
+const (
+	portKeyOff  = -24 // Destination address (16), port (2), protocol, padding
+	banKeyOff   = -48 // Listener ID (4), source address (16)
+	allowKeyOff = -72 // Prefix length (4), listener ID (4), source address (16)
+	dropKeyOff  = -76 // Drop counter index (4)
+)
+
+// allowPrefixBits is the prefix length of an allowKey matching a single
+// address: the listener ID and the whole address
+const allowPrefixBits = 32 + 128
+
+// portKey returns the key of the ports map: the listener bound to a
+// destination address (zero for all addresses), port and protocol
+func portKey(addr [16]byte, port uint16, proto uint8) []byte {
+	key := make([]byte, portKeySize)
+	copy(key, addr[:])
+	binary.BigEndian.PutUint16(key[16:], port)
+	key[18] = proto
+	return key
+}
+
+// banKey returns the key of the bans map: a client banned on a listener
+func banKey(id uint32, addr [16]byte) []byte {
+	key := make([]byte, banKeySize)
+	binary.NativeEndian.PutUint32(key, id)
+	copy(key[4:], addr[:])
+	return key
+}
+
+// allowKey returns the key of the allow trie: a network the listener's
+// allowlist allows. IPv4 networks are stored as IPv4-mapped IPv6 ones.
+func allowKey(id uint32, network *net.IPNet) []byte {
+	ones, bits := network.Mask.Size()
+	if bits == 32 {
+		ones += 96
+	}
+	key := make([]byte, allowKeySize)
+	binary.NativeEndian.PutUint32(key, uint32(32+ones))
+	binary.NativeEndian.PutUint32(key[4:], id)
+	copy(key[8:], network.IP.To16())
+	return key
+}
+
+// dropKey returns the key of a drop counter
+func dropKey(id uint32, reason int) []byte {
+	return binary.NativeEndian.AppendUint32(nil, id*dropReasons+uint32(reason))
+}
+
+// program returns the XDP program filtering with the given maps. Packets
+// that are not IPv4 or IPv6 over Ethernet, IPv4 packets with options or
+// fragments, IPv6 packets with extension headers, TCP segments other
+// than SYNs and packets of other protocols pass unchecked.
+func program(ports, bans, allow, drops *bpfMap) ([]byte, error) {
+	var a assembler
+
+	// R2 and R3 are the start and end of the packet. Keys are zeroed
+	// first so that their padding and IPv4-mapped prefixes are set.
+	a.load(unix.BPF_W, r2, r1, 0)
+	a.load(unix.BPF_W, r3, r1, 4)
+	for off := int16(allowKeyOff); off < 0; off += 4 {
+		a.storeImm(unix.BPF_W, r10, off, 0)
+	}
+
+	// Ethernet
+	a.movReg(r4, r2)
+	a.alu(unix.BPF_ADD, r4, 14)
+	a.jumpIfReg(unix.BPF_JGT, r4, r3, "pass")
+	a.load(unix.BPF_H, r5, r2, 12)
+	a.be16(r5)
+	a.jumpIf(unix.BPF_JEQ, r5, unix.ETH_P_IP, "ipv4")
+	a.jumpIf(unix.BPF_JEQ, r5, unix.ETH_P_IPV6, "ipv6")
+	a.jump("pass")
+
+	// IPv4 without options or fragments. Addresses are IPv4-mapped.
+	a.label("ipv4")
+	a.movReg(r4, r2)
+	a.alu(unix.BPF_ADD, r4, 34)
+	a.jumpIfReg(unix.BPF_JGT, r4, r3, "pass")
+	a.load(unix.BPF_B, r5, r2, 14)
+	a.jumpIf(unix.BPF_JNE, r5, 0x45, "pass")
+	a.load(unix.BPF_H, r5, r2, 20)
+	a.be16(r5)
+	a.alu(unix.BPF_AND, r5, 0x3fff) // More fragments flag and offset
+	a.jumpIf(unix.BPF_JNE, r5, 0, "pass")
+	a.load(unix.BPF_B, r9, r2, 23)
+	a.load(unix.BPF_W, r5, r2, 26)
+	a.store(unix.BPF_W, r10, banKeyOff+4+12, r5)
+	a.store(unix.BPF_W, r10, allowKeyOff+8+12, r5)
+	a.load(unix.BPF_W, r5, r2, 30)
+	a.store(unix.BPF_W, r10, portKeyOff+12, r5)
+	a.storeImm(unix.BPF_H, r10, banKeyOff+4+10, 0xffff)
+	a.storeImm(unix.BPF_H, r10, allowKeyOff+8+10, 0xffff)
+	a.storeImm(unix.BPF_H, r10, portKeyOff+10, 0xffff)
+	a.movReg(r7, r2)
+	a.alu(unix.BPF_ADD, r7, 34)
+	a.jump("transport")
+
+	// IPv6 without extension headers
+	a.label("ipv6")
+	a.movReg(r4, r2)
+	a.alu(unix.BPF_ADD, r4, 54)
+	a.jumpIfReg(unix.BPF_JGT, r4, r3, "pass")
+	a.load(unix.BPF_B, r9, r2, 20)
+	for i := int16(0); i < 16; i += 4 {
+		a.load(unix.BPF_W, r5, r2, 22+i)
+		a.store(unix.BPF_W, r10, banKeyOff+4+i, r5)
+		a.store(unix.BPF_W, r10, allowKeyOff+8+i, r5)
+		a.load(unix.BPF_W, r5, r2, 38+i)
+		a.store(unix.BPF_W, r10, portKeyOff+i, r5)
+	}
+	a.movReg(r7, r2)
+	a.alu(unix.BPF_ADD, r7, 54)
+
+	// R7 is the transport header and R9 its protocol. Only SYNs without
+	// ACK open TCP connections; later segments are left to the socket.
+	a.label("transport")
+	a.jumpIf(unix.BPF_JEQ, r9, protoTCP, "tcp")
+	a.jumpIf(unix.BPF_JNE, r9, protoUDP, "pass")
+	a.movReg(r4, r7)
+	a.alu(unix.BPF_ADD, r4, 8)
+	a.jumpIfReg(unix.BPF_JGT, r4, r3, "pass")
+	a.jump("listener")
+	a.label("tcp")
+	a.movReg(r4, r7)
+	a.alu(unix.BPF_ADD, r4, 14)
+	a.jumpIfReg(unix.BPF_JGT, r4, r3, "pass")
+	a.load(unix.BPF_B, r5, r7, 13)
+	a.alu(unix.BPF_AND, r5, 0x12) // SYN and ACK
+	a.jumpIf(unix.BPF_JNE, r5, 0x02, "pass")
+
+	// Find the listener bound to the destination address, then to all
+	// addresses. R8 is its ID.
+	a.label("listener")
+	a.load(unix.BPF_H, r5, r7, 2)
+	a.store(unix.BPF_H, r10, portKeyOff+16, r5)
+	a.store(unix.BPF_B, r10, portKeyOff+18, r9)
+	a.loadMap(r1, ports.fd)
+	a.movReg(r2, r10)
+	a.alu(unix.BPF_ADD, r2, portKeyOff)
+	a.call(funcMapLookupElem)
+	a.jumpIf(unix.BPF_JNE, r0, 0, "found")
+	for i := int16(0); i < 16; i += 4 {
+		a.storeImm(unix.BPF_W, r10, portKeyOff+i, 0)
+	}
+	a.loadMap(r1, ports.fd)
+	a.movReg(r2, r10)
+	a.alu(unix.BPF_ADD, r2, portKeyOff)
+	a.call(funcMapLookupElem)
+	a.jumpIf(unix.BPF_JEQ, r0, 0, "pass")
+	a.label("found")
+	a.load(unix.BPF_W, r8, r0, 0)
+
+	// Bans are checked before the allowlist, like the listener does.
+	// R7 is the reason of a drop.
+	a.store(unix.BPF_W, r10, banKeyOff, r8)
+	a.loadMap(r1, bans.fd)
+	a.movReg(r2, r10)
+	a.alu(unix.BPF_ADD, r2, banKeyOff)
+	a.call(funcMapLookupElem)
+	a.mov(r7, dropBanned)
+	a.jumpIf(unix.BPF_JNE, r0, 0, "drop")
+	a.storeImm(unix.BPF_W, r10, allowKeyOff, allowPrefixBits)
+	a.store(unix.BPF_W, r10, allowKeyOff+4, r8)
+	a.loadMap(r1, allow.fd)
+	a.movReg(r2, r10)
+	a.alu(unix.BPF_ADD, r2, allowKeyOff)
+	a.call(funcMapLookupElem)
+	a.jumpIf(unix.BPF_JNE, r0, 0, "pass")
+	a.mov(r7, dropACL)
+
+	// Count the drop in this CPU's counter
+	a.label("drop")
+	a.alu(unix.BPF_MUL, r8, dropReasons)
+	a.aluReg(unix.BPF_ADD, r8, r7)
+	a.store(unix.BPF_W, r10, dropKeyOff, r8)
+	a.loadMap(r1, drops.fd)
+	a.movReg(r2, r10)
+	a.alu(unix.BPF_ADD, r2, dropKeyOff)
+	a.call(funcMapLookupElem)
+	a.jumpIf(unix.BPF_JEQ, r0, 0, "dropped")
+	a.load(unix.BPF_DW, r1, r0, 0)
+	a.alu(unix.BPF_ADD, r1, 1)
+	a.store(unix.BPF_DW, r0, 0, r1)
+	a.label("dropped")
+	a.mov(r0, xdpDrop)
+	a.exit()
+
+	a.label("pass")
+	a.mov(r0, xdpPass)
+	a.exit()
+
+	return a.assemble()
+}
+
+// redirectProgram returns the XDP program steering the UDP datagrams for
+// the listen address in ports to the AF_XDP socket in xsks for the
+// receive queue they arrived on. Datagrams arriving on a queue without a
+// socket pass, as do IPv4 datagrams with options or fragments, IPv6
+// datagrams with extension headers and all other packets.
+func redirectProgram(ports, xsks *bpfMap) ([]byte, error) {
+	var a assembler
+
+	// R6 is the context, R2 and R3 the start and end of the packet
+	a.movReg(r6, r1)
+	a.load(unix.BPF_W, r2, r1, 0)
+	a.load(unix.BPF_W, r3, r1, 4)
+	for off := int16(portKeyOff); off < portKeyOff+portKeySize; off += 4 {
+		a.storeImm(unix.BPF_W, r10, off, 0)
+	}
+
+	// Ethernet
+	a.movReg(r4, r2)
+	a.alu(unix.BPF_ADD, r4, 14)
+	a.jumpIfReg(unix.BPF_JGT, r4, r3, "pass")
+	a.load(unix.BPF_H, r5, r2, 12)
+	a.be16(r5)
+	a.jumpIf(unix.BPF_JEQ, r5, unix.ETH_P_IP, "ipv4")
+	a.jumpIf(unix.BPF_JEQ, r5, unix.ETH_P_IPV6, "ipv6")
+	a.jump("pass")
+
+	// IPv4 without options or fragments. The address is IPv4-mapped.
+	a.label("ipv4")
+	a.movReg(r4, r2)
+	a.alu(unix.BPF_ADD, r4, 34)
+	a.jumpIfReg(unix.BPF_JGT, r4, r3, "pass")
+	a.load(unix.BPF_B, r5, r2, 14)
+	a.jumpIf(unix.BPF_JNE, r5, 0x45, "pass")
+	a.load(unix.BPF_H, r5, r2, 20)
+	a.be16(r5)
+	a.alu(unix.BPF_AND, r5, 0x3fff) // More fragments flag and offset
+	a.jumpIf(unix.BPF_JNE, r5, 0, "pass")
+	a.load(unix.BPF_B, r5, r2, 23)
+	a.jumpIf(unix.BPF_JNE, r5, protoUDP, "pass")
+	a.load(unix.BPF_W, r5, r2, 30)
+	a.store(unix.BPF_W, r10, portKeyOff+12, r5)
+	a.storeImm(unix.BPF_H, r10, portKeyOff+10, 0xffff)
+	a.movReg(r7, r2)
+	a.alu(unix.BPF_ADD, r7, 34)
+	a.jump("udp")
+
+	// IPv6 without extension headers
+	a.label("ipv6")
+	a.movReg(r4, r2)
+	a.alu(unix.BPF_ADD, r4, 54)
+	a.jumpIfReg(unix.BPF_JGT, r4, r3, "pass")
+	a.load(unix.BPF_B, r5, r2, 20)
+	a.jumpIf(unix.BPF_JNE, r5, protoUDP, "pass")
+	for i := int16(0); i < 16; i += 4 {
+		a.load(unix.BPF_W, r5, r2, 38+i)
+		a.store(unix.BPF_W, r10, portKeyOff+i, r5)
+	}
+	a.movReg(r7, r2)
+	a.alu(unix.BPF_ADD, r7, 54)
+
+	// R7 is the UDP header. Match the destination address, then all
+	// addresses.
+	a.label("udp")
+	a.movReg(r4, r7)
+	a.alu(unix.BPF_ADD, r4, 8)
+	a.jumpIfReg(unix.BPF_JGT, r4, r3, "pass")
+	a.load(unix.BPF_H, r5, r7, 2)
+	a.store(unix.BPF_H, r10, portKeyOff+16, r5)
+	a.storeImm(unix.BPF_B, r10, portKeyOff+18, protoUDP)
+	a.loadMap(r1, ports.fd)
+	a.movReg(r2, r10)
+	a.alu(unix.BPF_ADD, r2, portKeyOff)
+	a.call(funcMapLookupElem)
+	a.jumpIf(unix.BPF_JNE, r0, 0, "redirect")
+	for i := int16(0); i < 16; i += 4 {
+		a.storeImm(unix.BPF_W, r10, portKeyOff+i, 0)
+	}
+	a.loadMap(r1, ports.fd)
+	a.movReg(r2, r10)
+	a.alu(unix.BPF_ADD, r2, portKeyOff)
+	a.call(funcMapLookupElem)
+	a.jumpIf(unix.BPF_JEQ, r0, 0, "pass")
+
+	// Passes if the queue has no socket
+	a.label("redirect")
+	a.loadMap(r1, xsks.fd)
+	a.load(unix.BPF_W, r2, r6, rxQueueIndexOff)
+	a.mov(r3, xdpPass)
+	a.call(funcRedirectMap)
+	a.exit()
+
+	a.label("pass")
+	a.mov(r0, xdpPass)
+	a.exit()
+
+	return a.assemble()
+}
@@ -0,0 +1,349 @@
+//go:build linux
+
+package xdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// frameSize is the size of a packet buffer, a page to hold any frame up to
+// a jumbo MTU
+const frameSize = 4096
+
+// completionRingSize is the size of the unused completion ring, which the
+// kernel requires even of sockets that only receive
+const completionRingSize = 64
+
+// Receiver reads the UDP datagrams for a listen address from AF_XDP
+// sockets, one for each receive queue of an interface
+type Receiver struct {
+	iface  string
+	mu     sync.Mutex
+	closed bool
+	link   int // Detaches the program once closed
+	prog   int
+	ports  *bpfMap // The listen address
+	xsks   *bpfMap // Sockets by receive queue
+	queues []*Queue
+}
+
+// Queue is the AF_XDP socket of a receive queue. The kernel writes each
+// datagram into a buffer of the socket's memory (UMEM) taken from the
+// fill ring and hands it over through the receive ring.
+type Queue struct {
+	id   int
+	fd   int
+	umem []byte
+	fill ring // Free buffers, by address in umem
+	rx   ring // Received frames, as unix.XDPDesc
+}
+
+// ring is a ring shared with the kernel, mapped from the socket
+type ring struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	entries  unsafe.Pointer
+	mask     uint32
+}
+
+// Listen loads a program steering the UDP datagrams for address to
+// AF_XDP sockets on queues of the interface, all of them if none are
+// given, and attaches it. Each socket has frames packet buffers; with
+// zeroCopy the driver writes into them directly. The program is detached
+// and the sockets closed when the receiver is closed.
+func Listen(iface, address string, queues []int, frames int, zeroCopy bool) (*Receiver, error) {
+	ifc, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	if len(queues) == 0 {
+		if queues, err = rxQueues(iface); err != nil {
+			return nil, err
+		}
+	}
+
+	// Kernels before 5.11 charge maps and UMEM against the locked memory limit
+	unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY})
+
+	r := &Receiver{
+		iface: iface,
+		link:  -1,
+		prog:  -1,
+	}
+	attached := false
+	defer func() {
+		if !attached {
+			r.release()
+		}
+	}()
+
+	key, err := listenerKey(Listener{Protocol: "udp", Address: address})
+	if err != nil {
+		return nil, err
+	}
+	if r.ports, err = createMap("pp_ports", unix.BPF_MAP_TYPE_HASH, portKeySize, 4, 1, 0); err != nil {
+		return nil, err
+	}
+	if err := r.ports.update(key, make([]byte, 4)); err != nil {
+		return nil, fmt.Errorf("failed to add listen address: %w", err)
+	}
+	if r.xsks, err = createMap("pp_xsks", unix.BPF_MAP_TYPE_XSKMAP, 4, 4, uint32(slices.Max(queues)+1), 0); err != nil {
+		return nil, err
+	}
+
+	for _, id := range queues {
+		q, err := openQueue(ifc.Index, id, frames, zeroCopy)
+		if err != nil {
+			return nil, fmt.Errorf("queue %d: %w", id, err)
+		}
+		r.queues = append(r.queues, q)
+		if err := r.xsks.update(binary.NativeEndian.AppendUint32(nil, uint32(id)), binary.NativeEndian.AppendUint32(nil, uint32(q.fd))); err != nil {
+			return nil, fmt.Errorf("queue %d: failed to add socket: %w", id, err)
+		}
+	}
+
+	insns, err := redirectProgram(r.ports, r.xsks)
+	if err != nil {
+		return nil, err
+	}
+	if r.prog, err = loadProgram("packetpony_xsk", insns); err != nil {
+		return nil, err
+	}
+	if r.link, err = attachProgram(r.prog, ifc.Index, 0); err != nil {
+		return nil, fmt.Errorf("failed to attach program to %s: %w", iface, err)
+	}
+
+	attached = true
+	return r, nil
+}
+
+// rxQueues returns the receive queues of an interface
+func rxQueues(iface string) ([]int, error) {
+	entries, err := os.ReadDir("/sys/class/net/" + iface + "/queues")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list receive queues: %w", err)
+	}
+	var queues []int
+	for _, e := range entries {
+		if s, ok := strings.CutPrefix(e.Name(), "rx-"); ok {
+			if id, err := strconv.Atoi(s); err == nil {
+				queues = append(queues, id)
+			}
+		}
+	}
+	if len(queues) == 0 {
+		return nil, fmt.Errorf("interface %s has no receive queues", iface)
+	}
+	slices.Sort(queues)
+	return queues, nil
+}
+
+// openQueue creates the AF_XDP socket of a receive queue, with its UMEM
+// handed to the kernel in full, and binds it
+func openQueue(ifindex, id, frames int, zeroCopy bool) (*Queue, error) {
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %w", err)
+	}
+	q := &Queue{id: id, fd: fd}
+	ok := false
+	defer func() {
+		if !ok {
+			q.close()
+		}
+	}()
+
+	if q.umem, err = unix.Mmap(-1, 0, frames*frameSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS); err != nil {
+		return nil, fmt.Errorf("failed to allocate buffers: %w", err)
+	}
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&q.umem[0]))),
+		Len:  uint64(len(q.umem)),
+		Size: frameSize,
+	}
+	if err := setsockopt(fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return nil, fmt.Errorf("failed to register buffers: %w", err)
+	}
+	for _, opt := range []struct {
+		name string
+		opt  int
+		size int
+	}{
+		{"fill", unix.XDP_UMEM_FILL_RING, frames},
+		{"completion", unix.XDP_UMEM_COMPLETION_RING, completionRingSize},
+		{"receive", unix.XDP_RX_RING, frames},
+	} {
+		if err := unix.SetsockoptInt(fd, unix.SOL_XDP, opt.opt, opt.size); err != nil {
+			return nil, fmt.Errorf("failed to size %s ring: %w", opt.name, err)
+		}
+	}
+
+	var off unix.XDPMmapOffsets
+	size := uint32(unsafe.Sizeof(off))
+	if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS, uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+		return nil, fmt.Errorf("failed to get ring offsets: %w", errno)
+	}
+	if q.fill, err = mapRing(fd, unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, frames, 8); err != nil {
+		return nil, fmt.Errorf("failed to map fill ring: %w", err)
+	}
+	if q.rx, err = mapRing(fd, unix.XDP_PGOFF_RX_RING, off.Rx, frames, int(unsafe.Sizeof(unix.XDPDesc{}))); err != nil {
+		return nil, fmt.Errorf("failed to map receive ring: %w", err)
+	}
+
+	// Every buffer starts out free
+	for i := 0; i < frames; i++ {
+		*q.fill.addr(uint32(i)) = uint64(i * frameSize)
+	}
+	atomic.StoreUint32(q.fill.producer, uint32(frames))
+
+	var flags uint16 = unix.XDP_COPY
+	if zeroCopy {
+		flags = unix.XDP_ZEROCOPY
+	}
+	if err := unix.Bind(fd, &unix.SockaddrXDP{Flags: flags, Ifindex: uint32(ifindex), QueueID: uint32(id)}); err != nil {
+		return nil, fmt.Errorf("failed to bind socket: %w", err)
+	}
+
+	ok = true
+	return q, nil
+}
+
+// setsockopt sets an AF_XDP socket option to a struct
+func setsockopt(fd, opt int, value unsafe.Pointer, size uintptr) error {
+	if _, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt), uintptr(value), size, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// mapRing maps a ring of n entries of entrySize bytes from the socket
+func mapRing(fd int, pgoff int64, off unix.XDPRingOffset, n, entrySize int) (ring, error) {
+	mem, err := unix.Mmap(fd, pgoff, int(off.Desc)+n*entrySize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return ring{}, err
+	}
+	return ring{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[off.Producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[off.Consumer])),
+		entries:  unsafe.Pointer(&mem[off.Desc]),
+		mask:     uint32(n - 1),
+	}, nil
+}
+
+// addr returns entry i of a fill ring
+func (r *ring) addr(i uint32) *uint64 {
+	return (*uint64)(unsafe.Add(r.entries, uintptr(i&r.mask)*8))
+}
+
+// desc returns entry i of a receive ring
+func (r *ring) desc(i uint32) *unix.XDPDesc {
+	return (*unix.XDPDesc)(unsafe.Add(r.entries, uintptr(i&r.mask)*unsafe.Sizeof(unix.XDPDesc{})))
+}
+
+// unmap releases the ring's memory
+func (r *ring) unmap() {
+	if r.mem != nil {
+		unix.Munmap(r.mem)
+	}
+}
+
+// Interface returns the name of the interface the program is attached to
+func (r *Receiver) Interface() string {
+	return r.iface
+}
+
+// Queues returns the sockets of the receive queues. Each is read by a
+// single goroutine.
+func (r *Receiver) Queues() []*Queue {
+	return r.queues
+}
+
+// Close detaches the program and closes the sockets. The queues must no
+// longer be read.
+func (r *Receiver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.release()
+}
+
+// release closes the link, program, maps and sockets created so far
+func (r *Receiver) release() error {
+	var err error
+	if r.link >= 0 {
+		err = unix.Close(r.link)
+	}
+	if r.prog >= 0 {
+		unix.Close(r.prog)
+	}
+	r.ports.close()
+	r.xsks.close()
+	for _, q := range r.queues {
+		q.close()
+	}
+	return err
+}
+
+// ID returns the receive queue of the socket
+func (q *Queue) ID() int {
+	return q.id
+}
+
+// Receive waits up to timeout for datagrams and calls handle with each
+// received, then returns their buffers to the kernel. It returns the
+// number of datagrams handled and of malformed frames dropped.
+func (q *Queue) Receive(timeout time.Duration, handle func(Datagram)) (received, malformed int, err error) {
+	cons := atomic.LoadUint32(q.rx.consumer)
+	prod := atomic.LoadUint32(q.rx.producer)
+	if prod == cons {
+		fds := []unix.PollFd{{Fd: int32(q.fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, int(timeout/time.Millisecond)); err != nil && !errors.Is(err, unix.EINTR) {
+			return 0, 0, err
+		}
+		prod = atomic.LoadUint32(q.rx.producer)
+	}
+
+	free := atomic.LoadUint32(q.fill.producer)
+	for ; cons != prod; cons++ {
+		desc := q.rx.desc(cons)
+		if d, ok := parseFrame(q.umem[desc.Addr : desc.Addr+uint64(desc.Len)]); ok {
+			handle(d)
+			received++
+		} else {
+			malformed++
+		}
+		*q.fill.addr(free) = desc.Addr &^ (frameSize - 1)
+		free++
+	}
+	atomic.StoreUint32(q.rx.consumer, cons)
+	atomic.StoreUint32(q.fill.producer, free)
+	return received, malformed, nil
+}
+
+// close unmaps the rings and buffers and closes the socket
+func (q *Queue) close() {
+	q.rx.unmap()
+	q.fill.unmap()
+	if q.umem != nil {
+		unix.Munmap(q.umem)
+	}
+	unix.Close(q.fd)
+}
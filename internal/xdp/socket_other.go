@@ -0,0 +1,41 @@
+//go:build !linux
+
+package xdp
+
+import "time"
+
+// Receiver is not supported on this platform
+type Receiver struct{}
+
+// Queue is not supported on this platform
+type Queue struct{}
+
+// Listen is not supported on this platform
+func Listen(iface, address string, queues []int, frames int, zeroCopy bool) (*Receiver, error) {
+	return nil, ErrUnsupported
+}
+
+// Interface returns the name of the interface
+func (r *Receiver) Interface() string {
+	return ""
+}
+
+// Queues returns the sockets of the receive queues
+func (r *Receiver) Queues() []*Queue {
+	return nil
+}
+
+// Close is not supported on this platform
+func (r *Receiver) Close() error {
+	return nil
+}
+
+// ID returns the receive queue of the socket
+func (q *Queue) ID() int {
+	return 0
+}
+
+// Receive is not supported on this platform
+func (q *Queue) Receive(timeout time.Duration, handle func(Datagram)) (received, malformed int, err error) {
+	return 0, 0, ErrUnsupported
+}
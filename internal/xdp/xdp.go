@@ -0,0 +1,49 @@
+// Package xdp drops the packets of denied and banned clients in the
+// kernel, before they reach a listener's socket. An XDP program attached
+// to a network interface finds the listener of each new TCP connection
+// (SYN) and UDP datagram by its destination address and port, and drops
+// it if the source is banned on the listener or not in its allowlist.
+// Everything else passes to the network stack, where the listener checks
+// it again: the program only drops what the listener would drop too.
+//
+// The package also reads UDP listeners' datagrams from AF_XDP sockets,
+// bypassing the kernel's UDP stack: a second kind of program steers the
+// datagrams for a listen address to a socket for each receive queue.
+package xdp
+
+import (
+	"errors"
+	"net"
+)
+
+// Reasons a packet was dropped
+const (
+	ReasonACL    = "acl_denied"
+	ReasonBanned = "banned"
+)
+
+// ErrUnsupported is returned by Attach and Listen on platforms without XDP
+var ErrUnsupported = errors.New("xdp is only supported on Linux")
+
+// Listener is a listener whose packets the program filters
+type Listener struct {
+	Name     string
+	Protocol string       // tcp or udp
+	Address  string       // Listen address, with an IP or empty host
+	Allow    []*net.IPNet // Networks the configured allowlist can allow, scheduled or not
+}
+
+// Drops counts the packets dropped for a listener for one reason
+type Drops struct {
+	Listener string
+	Reason   string
+	Packets  uint64
+}
+
+// Datagram is a UDP datagram read from an AF_XDP socket. Payload points
+// into the socket's buffers and is only valid until the handler returns.
+type Datagram struct {
+	Source  *net.UDPAddr
+	DSCP    int
+	Payload []byte
+}
@@ -0,0 +1,346 @@
+//go:build linux
+
+package xdp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/espegro/packetpony/internal/config"
+)
+
+// maxBans bounds the bans a program holds across its listeners. Bans
+// beyond it are enforced by the listeners only.
+const maxBans = 65536
+
+// maxRuntimeNetworks bounds the networks added to allowlists at runtime
+// that a program holds across its listeners. The program drops clients
+// of networks beyond it.
+const maxRuntimeNetworks = 65536
+
+// Filter is an XDP program attached to an interface, filtering the
+// packets of one or more listeners
+type Filter struct {
+	iface   string
+	mu      sync.Mutex
+	closed  bool
+	link    int // Detaches the program once closed
+	prog    int
+	ports   *bpfMap             // Listener ID by destination address, port and protocol
+	bans    *bpfMap             // Banned clients by listener ID
+	allow   *bpfMap             // Allowed networks by listener ID
+	drops   *bpfMap             // Per-CPU drop counters by listener ID and reason
+	names   []string            // Listener names by ID
+	ids     map[string]uint32   // Listener IDs by name
+	banned  []map[[16]byte]bool // Clients in the bans map, by listener ID
+	static  []map[string]bool   // Keys of configured networks in the allow trie, by listener ID
+	added   []map[string]bool   // Keys of runtime networks in the allow trie, by listener ID
+	counted []uint64            // Drops already reported, by counter index
+}
+
+// Attach loads a program filtering the packets of listeners and attaches
+// it to the interface in mode (auto, native or generic). The program is
+// detached when the filter is closed.
+func Attach(iface, mode string, listeners []Listener) (*Filter, error) {
+	ifc, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	var flags uint32
+	switch mode {
+	case config.XDPModeNative:
+		flags = unix.XDP_FLAGS_DRV_MODE
+	case config.XDPModeGeneric:
+		flags = unix.XDP_FLAGS_SKB_MODE
+	}
+
+	// Kernels before 5.11 charge maps against the locked memory limit
+	unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY})
+
+	f := &Filter{
+		iface: iface,
+		link:  -1,
+		prog:  -1,
+		ids:   make(map[string]uint32),
+	}
+	attached := false
+	defer func() {
+		if !attached {
+			f.release()
+		}
+	}()
+
+	networks := 0
+	for _, l := range listeners {
+		networks += len(l.Allow)
+	}
+	n := uint32(len(listeners))
+	if f.ports, err = createMap("pp_ports", unix.BPF_MAP_TYPE_HASH, portKeySize, 4, n, 0); err != nil {
+		return nil, err
+	}
+	if f.bans, err = createMap("pp_bans", unix.BPF_MAP_TYPE_HASH, banKeySize, 1, maxBans, unix.BPF_F_NO_PREALLOC); err != nil {
+		return nil, err
+	}
+	if f.allow, err = createMap("pp_allow", unix.BPF_MAP_TYPE_LPM_TRIE, allowKeySize, 1, uint32(networks+maxRuntimeNetworks), unix.BPF_F_NO_PREALLOC); err != nil {
+		return nil, err
+	}
+	if f.drops, err = createMap("pp_drops", unix.BPF_MAP_TYPE_PERCPU_ARRAY, 4, 8, n*dropReasons, 0); err != nil {
+		return nil, err
+	}
+
+	for i, l := range listeners {
+		id := uint32(i)
+		key, err := listenerKey(l)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", l.Name, err)
+		}
+		if err := f.ports.update(key, binary.NativeEndian.AppendUint32(nil, id)); err != nil {
+			return nil, fmt.Errorf("listener %s: failed to add port: %w", l.Name, err)
+		}
+		static := make(map[string]bool)
+		for _, network := range l.Allow {
+			key := allowKey(id, network)
+			if err := f.allow.update(key, []byte{1}); err != nil {
+				return nil, fmt.Errorf("listener %s: failed to add allowed network %s: %w", l.Name, network, err)
+			}
+			static[string(key)] = true
+		}
+		f.names = append(f.names, l.Name)
+		f.ids[l.Name] = id
+		f.banned = append(f.banned, make(map[[16]byte]bool))
+		f.static = append(f.static, static)
+		f.added = append(f.added, make(map[string]bool))
+	}
+	f.counted = make([]uint64, n*dropReasons)
+
+	insns, err := program(f.ports, f.bans, f.allow, f.drops)
+	if err != nil {
+		return nil, err
+	}
+	if f.prog, err = loadProgram("packetpony", insns); err != nil {
+		return nil, err
+	}
+	if f.link, err = attachProgram(f.prog, ifc.Index, flags); err != nil {
+		return nil, fmt.Errorf("failed to attach program to %s: %w", iface, err)
+	}
+
+	attached = true
+	return f, nil
+}
+
+// listenerKey returns the ports map key of a listener. A listener bound
+// to all addresses has the zero address.
+func listenerKey(l Listener) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(l.Address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portStr)
+	}
+
+	var addr [16]byte
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("listen address %s is not an IP address", host)
+		}
+		if !ip.IsUnspecified() {
+			copy(addr[:], ip.To16())
+		}
+	}
+
+	var proto uint8
+	switch strings.ToLower(l.Protocol) {
+	case "tcp":
+		proto = protoTCP
+	case "udp":
+		proto = protoUDP
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", l.Protocol)
+	}
+	return portKey(addr, uint16(port), proto), nil
+}
+
+// Interface returns the name of the interface the program is attached to
+func (f *Filter) Interface() string {
+	return f.iface
+}
+
+// Listeners returns the names of the filtered listeners
+func (f *Filter) Listeners() []string {
+	return append([]string(nil), f.names...)
+}
+
+// SetBans replaces the clients the program drops as banned on a listener
+// with ips. Clients are updated one by one; those that could not be are
+// tried again at the next call and the first failure is returned.
+func (f *Filter) SetBans(listener string, ips []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	id, ok := f.ids[listener]
+	if !ok {
+		return fmt.Errorf("unknown listener: %s", listener)
+	}
+
+	want := make(map[[16]byte]bool, len(ips))
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip != nil {
+			var addr [16]byte
+			copy(addr[:], ip.To16())
+			want[addr] = true
+		}
+	}
+
+	var firstErr error
+	banned := f.banned[id]
+	for addr := range banned {
+		if want[addr] {
+			continue
+		}
+		if err := f.bans.delete(banKey(id, addr)); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to remove ban of %s: %w", net.IP(addr[:]), err)
+			}
+			continue
+		}
+		delete(banned, addr)
+	}
+	for addr := range want {
+		if banned[addr] {
+			continue
+		}
+		if err := f.bans.update(banKey(id, addr), []byte{1}); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to add ban of %s: %w", net.IP(addr[:]), err)
+			}
+			continue
+		}
+		banned[addr] = true
+	}
+	return firstErr
+}
+
+// SetAllowed replaces the networks the program allows on a listener in
+// addition to its configured ones with networks. Networks are updated one
+// by one; those that could not be are tried again at the next call and
+// the first failure is returned.
+func (f *Filter) SetAllowed(listener string, networks []*net.IPNet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	id, ok := f.ids[listener]
+	if !ok {
+		return fmt.Errorf("unknown listener: %s", listener)
+	}
+
+	static := f.static[id]
+	want := make(map[string]*net.IPNet, len(networks))
+	for _, network := range networks {
+		if key := string(allowKey(id, network)); !static[key] {
+			want[key] = network
+		}
+	}
+
+	var firstErr error
+	added := f.added[id]
+	for key := range added {
+		if want[key] != nil {
+			continue
+		}
+		if err := f.allow.delete([]byte(key)); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to remove allowed network: %w", err)
+			}
+			continue
+		}
+		delete(added, key)
+	}
+	for key, network := range want {
+		if added[key] {
+			continue
+		}
+		if err := f.allow.update([]byte(key), []byte{1}); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to add allowed network %s: %w", network, err)
+			}
+			continue
+		}
+		added[key] = true
+	}
+	return firstErr
+}
+
+// Drops returns the packets dropped since the previous call, for each
+// listener and reason with any
+func (f *Filter) Drops() ([]Drops, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, nil
+	}
+
+	var result []Drops
+	for id, name := range f.names {
+		for reason := 0; reason < dropReasons; reason++ {
+			values, err := f.drops.lookup(dropKey(uint32(id), reason))
+			if err != nil {
+				return result, fmt.Errorf("failed to read drop counter: %w", err)
+			}
+			var total uint64
+			for i := 0; i+8 <= len(values); i += 8 {
+				total += binary.NativeEndian.Uint64(values[i:])
+			}
+
+			index := id*dropReasons + reason
+			if total > f.counted[index] {
+				result = append(result, Drops{
+					Listener: name,
+					Reason:   dropReasonNames[reason],
+					Packets:  total - f.counted[index],
+				})
+				f.counted[index] = total
+			}
+		}
+	}
+	return result, nil
+}
+
+// Close detaches the program and releases its maps
+func (f *Filter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	return f.release()
+}
+
+// release closes the link, program and maps created so far
+func (f *Filter) release() error {
+	var err error
+	if f.link >= 0 {
+		err = unix.Close(f.link)
+	}
+	if f.prog >= 0 {
+		unix.Close(f.prog)
+	}
+	f.ports.close()
+	f.bans.close()
+	f.allow.close()
+	f.drops.close()
+	return err
+}
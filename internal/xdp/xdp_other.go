@@ -0,0 +1,43 @@
+//go:build !linux
+
+package xdp
+
+import "net"
+
+// Filter is not supported on this platform
+type Filter struct{}
+
+// Attach is not supported on this platform
+func Attach(iface, mode string, listeners []Listener) (*Filter, error) {
+	return nil, ErrUnsupported
+}
+
+// Interface returns the name of the interface
+func (f *Filter) Interface() string {
+	return ""
+}
+
+// Listeners returns the names of the filtered listeners
+func (f *Filter) Listeners() []string {
+	return nil
+}
+
+// SetBans is not supported on this platform
+func (f *Filter) SetBans(listener string, ips []string) error {
+	return ErrUnsupported
+}
+
+// SetAllowed is not supported on this platform
+func (f *Filter) SetAllowed(listener string, networks []*net.IPNet) error {
+	return ErrUnsupported
+}
+
+// Drops is not supported on this platform
+func (f *Filter) Drops() ([]Drops, error) {
+	return nil, ErrUnsupported
+}
+
+// Close is not supported on this platform
+func (f *Filter) Close() error {
+	return nil
+}
@@ -0,0 +1,58 @@
+#!/bin/sh
+# perfcheck.sh compares two `go test -bench -benchmem` outputs and exits 1
+# if any benchmark got slower, or allocates more, by more than a threshold.
+# The fastest of the -count runs of each benchmark is compared, which is
+# less sensitive to noise from other load on the machine.
+#
+# Usage: perfcheck.sh baseline.txt current.txt [threshold-percent]
+
+set -eu
+
+if [ $# -lt 2 ]; then
+	echo "usage: $0 baseline.txt current.txt [threshold-percent]" >&2
+	exit 2
+fi
+
+awk -v threshold="${3:-10}" '
+# record keeps the lowest value of a metric per file and benchmark
+function record(file, metric, name, value) {
+	key = file SUBSEP metric SUBSEP name
+	if (!(key in best) || value + 0 < best[key]) best[key] = value + 0
+}
+
+/^Benchmark/ {
+	file = (FILENAME == ARGV[1]) ? "base" : "cur"
+	name = $1
+	sub(/-[0-9]+$/, "", name) # GOMAXPROCS suffix
+	names[name] = 1
+	for (i = 3; i < NF; i += 2) {
+		if ($(i + 1) == "ns/op" || $(i + 1) == "allocs/op") record(file, $(i + 1), name, $i)
+	}
+}
+
+END {
+	failed = 0
+	printf "%-50s %14s %14s %8s %14s\n", "benchmark", "base ns/op", "ns/op", "delta", "allocs/op"
+	for (name in names) {
+		curNs = best["cur", "ns/op", name]
+		curAllocs = best["cur", "allocs/op", name]
+		if (!(("cur", "ns/op", name) in best)) continue
+		if (!(("base", "ns/op", name) in best)) {
+			printf "%-50s %14s %14.1f %8s %14s\n", name, "-", curNs, "new", curAllocs
+			continue
+		}
+		baseNs = best["base", "ns/op", name]
+		baseAllocs = best["base", "allocs/op", name]
+		delta = (curNs - baseNs) * 100 / baseNs
+		flag = ""
+		if (delta > threshold) flag = "  SLOWER"
+		if (curAllocs > baseAllocs * (1 + threshold / 100) + 0.5) flag = flag "  MORE ALLOCS"
+		if (flag != "") failed++
+		printf "%-50s %14.1f %14.1f %+7.1f%% %14s%s\n", name, baseNs, curNs, delta, baseAllocs " -> " curAllocs, flag
+	}
+	if (failed > 0) {
+		printf "\n%d benchmark(s) regressed by more than %s%%\n", failed, threshold
+		exit 1
+	}
+}
+' "$1" "$2"